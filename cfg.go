@@ -51,4 +51,145 @@ type CfgEvent struct {
 	Key   string
 	CAS   uint64
 	Error error
+
+	// Val is the key's value as of the CAS, which is only carried by
+	// the Cfg providers that deliver the events of a key in order,
+	// such as CfgMem, CfgSimple and CfgRaft, and is nil otherwise,
+	// including for a deletion.  It's shared by the subscribers of
+	// the key, so it must not be modified.
+	Val []byte
+}
+
+// CfgTxn is an optional interface that a Cfg provider may also
+// implement to support all-or-nothing updates across multiple keys.
+// Callers should type-assert a Cfg to a CfgTxn and fall back to
+// individual Set()/Del() calls when it's not supported.
+type CfgTxn interface {
+	// Txn applies the ops, in order, as a single atomic change.
+	// Either every op succeeds, or none of them are applied and an
+	// error is returned, which is a *CfgCASError on any CAS
+	// mismatch.  On success, the returned casSuccess has an entry
+	// for each op, which is the new CAS for a "set" op and 0 for the
+	// other ops.
+	Txn(ops []CfgTxnOp) (casSuccess []uint64, err error)
+}
+
+const (
+	CFG_TXN_OP_SET   = "set"
+	CFG_TXN_OP_DEL   = "del"
+	CFG_TXN_OP_CHECK = "check"
+)
+
+// A CfgTxnOp is a single operation of a CfgTxn.Txn().  The CAS has
+// the same meaning as with Cfg.Set() and Cfg.Del().  A "check" op
+// does not change its key, but only asserts that the key's current
+// CAS matches, where a zero CAS asserts that the key does not exist.
+type CfgTxnOp struct {
+	Op  string `json:"op"`
+	Key string `json:"key"`
+	Val []byte `json:"val,omitempty"`
+	CAS uint64 `json:"cas,omitempty"`
+}
+
+// ------------------------------------------------------------------------
+
+// A cfgWrapper is a Cfg that wraps another Cfg, such as a CfgHistory,
+// a CfgFaulty or a CfgSharded, and that implements the optional
+// interfaces on behalf of the wrapped Cfg.
+type cfgWrapper interface {
+	Cfg
+	Txn(ops []CfgTxnOp) ([]uint64, error)
+	ClusterVersion() (uint64, error)
+}
+
+// wrapCfg returns the wrapper as a Cfg that also implements CfgTxn
+// and VersionReader, but only when the wrapped cfg does.  Use
+// unwrapCfgWrapper() to retrieve the wrapper from the returned Cfg.
+func wrapCfg(wrapper cfgWrapper, wrapped Cfg) Cfg {
+	w := &cfgWrapped{wrapper}
+
+	_, isTxn := wrapped.(CfgTxn)
+	_, isVersionReader := wrapped.(VersionReader)
+
+	switch {
+	case isTxn && isVersionReader:
+		return &cfgWrappedTxnVersion{&cfgWrappedTxn{w}}
+	case isTxn:
+		return &cfgWrappedTxn{w}
+	case isVersionReader:
+		return &cfgWrappedVersion{w}
+	}
+
+	return w
+}
+
+// unwrapCfgWrapper returns the wrapper of a Cfg that was returned by
+// wrapCfg(), or nil.
+func unwrapCfgWrapper(cfg Cfg) cfgWrapper {
+	switch c := cfg.(type) {
+	case *cfgWrapped:
+		return c.wrapper
+	case *cfgWrappedTxn:
+		return c.wrapper
+	case *cfgWrappedVersion:
+		return c.wrapper
+	case *cfgWrappedTxnVersion:
+		return c.wrapper
+	}
+	return nil
+}
+
+// cfgWrapped exposes only the Cfg methods of a wrapper, which is why
+// the wrapper is not embedded.
+type cfgWrapped struct {
+	wrapper cfgWrapper
+}
+
+func (c *cfgWrapped) Get(key string, cas uint64) ([]byte, uint64, error) {
+	return c.wrapper.Get(key, cas)
+}
+
+func (c *cfgWrapped) Set(key string, val []byte, cas uint64) (
+	uint64, error) {
+	return c.wrapper.Set(key, val, cas)
+}
+
+func (c *cfgWrapped) Del(key string, cas uint64) error {
+	return c.wrapper.Del(key, cas)
+}
+
+func (c *cfgWrapped) Subscribe(key string, ch chan CfgEvent) error {
+	return c.wrapper.Subscribe(key, ch)
+}
+
+func (c *cfgWrapped) Refresh() error {
+	return c.wrapper.Refresh()
+}
+
+// cfgWrappedTxn also exposes the CfgTxn of a wrapper.
+type cfgWrappedTxn struct {
+	*cfgWrapped
+}
+
+func (c *cfgWrappedTxn) Txn(ops []CfgTxnOp) ([]uint64, error) {
+	return c.wrapper.Txn(ops)
+}
+
+// cfgWrappedVersion also exposes the VersionReader of a wrapper.
+type cfgWrappedVersion struct {
+	*cfgWrapped
+}
+
+func (c *cfgWrappedVersion) ClusterVersion() (uint64, error) {
+	return c.wrapper.ClusterVersion()
+}
+
+// cfgWrappedTxnVersion also exposes the CfgTxn and the VersionReader
+// of a wrapper.
+type cfgWrappedTxnVersion struct {
+	*cfgWrappedTxn
+}
+
+func (c *cfgWrappedTxnVersion) ClusterVersion() (uint64, error) {
+	return c.wrapper.ClusterVersion()
 }
@@ -0,0 +1,506 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/couchbase/clog"
+)
+
+// The severities of a CfgCheckIssue.
+const (
+	CFG_CHECK_SEVERITY_ERROR = "error"
+	CFG_CHECK_SEVERITY_WARN  = "warn"
+)
+
+// The kinds of a CfgCheckIssue.
+const (
+	// A Cfg value could not be parsed.
+	CFG_CHECK_PARSE = "parse"
+
+	// A plan pindex refers to an index that has no indexDef.
+	CFG_CHECK_PLAN_PINDEX_INDEX_MISSING = "planPIndexIndexMissing"
+
+	// A plan pindex refers to an older or newer indexDef UUID.
+	CFG_CHECK_PLAN_PINDEX_INDEX_UUID = "planPIndexIndexUUIDMismatch"
+
+	// A plan pindex is assigned to a node that's not wanted.
+	CFG_CHECK_PLAN_PINDEX_NODE_MISSING = "planPIndexNodeMissing"
+
+	// A plan pindex is not assigned to any node.
+	CFG_CHECK_PLAN_PINDEX_NO_NODES = "planPIndexNoNodes"
+
+	// Plan pindexes of an index cover the same source partition.
+	CFG_CHECK_PLAN_PINDEX_PARTITION_OVERLAP = "planPIndexPartitionOverlap"
+
+	// An indexDef has no plan pindexes.
+	CFG_CHECK_INDEX_NOT_PLANNED = "indexDefNotPlanned"
+
+	// A wanted node is not a known node.
+	CFG_CHECK_NODE_WANTED_NOT_KNOWN = "nodeWantedNotKnown"
+)
+
+// A CfgCheckIssue is an inconsistency between, or within, the values
+// of a Cfg.
+type CfgCheckIssue struct {
+	Severity       string `json:"severity"`
+	Kind           string `json:"kind"`
+	Key            string `json:"key"` // The Cfg key of the inconsistency.
+	IndexName      string `json:"indexName,omitempty"`
+	PlanPIndexName string `json:"planPIndexName,omitempty"`
+	NodeUUID       string `json:"nodeUUID,omitempty"`
+	Msg            string `json:"msg"`
+}
+
+func (i *CfgCheckIssue) String() string {
+	return fmt.Sprintf("%s: %s, key: %s, %s", i.Severity, i.Kind, i.Key, i.Msg)
+}
+
+// CfgCheckRepairOptions configures RepairCfgInvariants().
+type CfgCheckRepairOptions struct {
+	// When DryRun is true, the repairs are computed but not saved.
+	DryRun bool
+
+	// The Version, Server and Options are used to replan the indexes,
+	// as with the planner.  A "" Version means the Cfg's version.
+	Version string
+	Server  string
+	Options map[string]string
+}
+
+// CfgCheckRepairResult describes the repairs of RepairCfgInvariants().
+type CfgCheckRepairResult struct {
+	DryRun bool `json:"dryRun"`
+
+	// The issues that were found before the repairs.
+	Issues []*CfgCheckIssue `json:"issues"`
+
+	// The plan pindexes that were pruned as orphans.
+	PrunedPlanPIndexes []string `json:"prunedPlanPIndexes"`
+
+	// The nodes that were pruned from plan pindexes, keyed by plan
+	// pindex name.
+	PrunedNodes map[string][]string `json:"prunedNodes"`
+
+	// The indexes that were replanned.
+	ReplannedIndexes []string `json:"replannedIndexes"`
+
+	// The issues that are not repaired, such as parse errors.
+	Unrepaired []*CfgCheckIssue `json:"unrepaired"`
+
+	// Saved is true when a repaired plan was saved to the Cfg.
+	Saved bool `json:"saved"`
+}
+
+// cfgCheckState holds the Cfg values that are checked.
+type cfgCheckState struct {
+	indexDefs         *IndexDefs
+	indexDefsCAS      uint64
+	nodeDefsKnown     *NodeDefs
+	nodeDefsWanted    *NodeDefs
+	nodeDefsWantedCAS uint64
+	planPIndexes      *PlanPIndexes
+	planPIndexesCAS   uint64
+
+	issues []*CfgCheckIssue
+}
+
+func (s *cfgCheckState) add(severity, kind, key string, issue CfgCheckIssue,
+	format string, args ...interface{}) {
+	issue.Severity = severity
+	issue.Kind = kind
+	issue.Key = key
+	issue.Msg = fmt.Sprintf(format, args...)
+	s.issues = append(s.issues, &issue)
+}
+
+// CheckCfgInvariants returns every inconsistency between the
+// indexDefs, nodeDefs and planPIndexes of a Cfg, such as plan pindexes
+// of deleted indexes, or plan pindexes assigned to unwanted nodes.  An
+// error is returned only when the Cfg could not be read.
+func CheckCfgInvariants(cfg Cfg) ([]*CfgCheckIssue, error) {
+	s, err := cfgCheckLoad(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	s.check()
+
+	return s.issues, nil
+}
+
+// cfgCheckLoad reads the Cfg values, where unparsable values are
+// reported as issues.
+func cfgCheckLoad(cfg Cfg) (*cfgCheckState, error) {
+	s := &cfgCheckState{}
+
+	get := func(key string, rv interface{}) (bool, uint64, error) {
+		buf, cas, err := cfg.Get(key, 0)
+		if err != nil {
+			return false, 0, fmt.Errorf("cfg_check: could not get,"+
+				" key: %s, err: %v", key, err)
+		}
+		if buf == nil {
+			return false, cas, nil
+		}
+
+		err = json.Unmarshal(buf, rv)
+		if err != nil {
+			s.add(CFG_CHECK_SEVERITY_ERROR, CFG_CHECK_PARSE, key,
+				CfgCheckIssue{}, "could not parse, err: %v", err)
+			return false, cas, nil
+		}
+
+		return true, cas, nil
+	}
+
+	indexDefs := &IndexDefs{}
+	ok, cas, err := get(INDEX_DEFS_KEY, indexDefs)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		s.indexDefs = indexDefs
+	}
+	s.indexDefsCAS = cas
+
+	nodeDefsKnown := &NodeDefs{}
+	ok, _, err = get(CfgNodeDefsKey(NODE_DEFS_KNOWN), nodeDefsKnown)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		s.nodeDefsKnown = nodeDefsKnown
+	}
+
+	nodeDefsWanted := &NodeDefs{}
+	ok, cas, err = get(CfgNodeDefsKey(NODE_DEFS_WANTED), nodeDefsWanted)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		s.nodeDefsWanted = nodeDefsWanted
+	}
+	s.nodeDefsWantedCAS = cas
+
+	planPIndexes := &PlanPIndexes{}
+	ok, cas, err = get(PLAN_PINDEXES_KEY, planPIndexes)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		s.planPIndexes = planPIndexes
+	}
+	s.planPIndexesCAS = cas
+
+	return s, nil
+}
+
+// check appends the issues of the loaded Cfg values.
+func (s *cfgCheckState) check() {
+	indexDefs := map[string]*IndexDef{}
+	if s.indexDefs != nil {
+		indexDefs = s.indexDefs.IndexDefs
+	}
+
+	nodeDefsWanted := map[string]*NodeDef{}
+	if s.nodeDefsWanted != nil {
+		nodeDefsWanted = s.nodeDefsWanted.NodeDefs
+	}
+
+	if s.nodeDefsKnown != nil {
+		for _, nodeUUID := range cfgCheckSortedKeys(nodeDefsWanted) {
+			if s.nodeDefsKnown.NodeDefs[nodeUUID] == nil {
+				s.add(CFG_CHECK_SEVERITY_WARN, CFG_CHECK_NODE_WANTED_NOT_KNOWN,
+					CfgNodeDefsKey(NODE_DEFS_WANTED),
+					CfgCheckIssue{NodeUUID: nodeUUID},
+					"wanted node is not known, node: %s", nodeUUID)
+			}
+		}
+	}
+
+	planned := map[string]bool{}      // Keyed by index name.
+	partitions := map[string]string{} // Keyed by "indexName/partition".
+	overlapped := map[string]bool{}   // Keyed by index name.
+
+	if s.planPIndexes != nil {
+		names := make([]string, 0, len(s.planPIndexes.PlanPIndexes))
+		for name := range s.planPIndexes.PlanPIndexes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			ppi := s.planPIndexes.PlanPIndexes[name]
+
+			issue := CfgCheckIssue{IndexName: ppi.IndexName,
+				PlanPIndexName: name}
+
+			indexDef := indexDefs[ppi.IndexName]
+			if indexDef == nil {
+				s.add(CFG_CHECK_SEVERITY_ERROR,
+					CFG_CHECK_PLAN_PINDEX_INDEX_MISSING, PLAN_PINDEXES_KEY,
+					issue, "plan pindex: %s, of a missing index: %s",
+					name, ppi.IndexName)
+				continue
+			}
+
+			if indexDef.UUID != ppi.IndexUUID {
+				s.add(CFG_CHECK_SEVERITY_ERROR,
+					CFG_CHECK_PLAN_PINDEX_INDEX_UUID, PLAN_PINDEXES_KEY,
+					issue, "plan pindex: %s, has index UUID: %s,"+
+						" but index: %s, has UUID: %s",
+					name, ppi.IndexUUID, ppi.IndexName, indexDef.UUID)
+				continue
+			}
+
+			planned[ppi.IndexName] = true
+
+			for _, nodeUUID := range cfgCheckSortedKeys(ppi.Nodes) {
+				if nodeDefsWanted[nodeUUID] == nil {
+					nodeIssue := issue
+					nodeIssue.NodeUUID = nodeUUID
+					s.add(CFG_CHECK_SEVERITY_ERROR,
+						CFG_CHECK_PLAN_PINDEX_NODE_MISSING, PLAN_PINDEXES_KEY,
+						nodeIssue, "plan pindex: %s, is assigned to a node"+
+							" that's not wanted: %s", name, nodeUUID)
+				}
+			}
+
+			if len(ppi.Nodes) <= 0 && len(nodeDefsWanted) > 0 {
+				s.add(CFG_CHECK_SEVERITY_WARN,
+					CFG_CHECK_PLAN_PINDEX_NO_NODES, PLAN_PINDEXES_KEY,
+					issue, "plan pindex: %s, is not assigned to any node", name)
+			}
+
+			if ppi.SourcePartitions == "" {
+				continue
+			}
+
+			for _, partition := range strings.Split(ppi.SourcePartitions, ",") {
+				k := ppi.IndexName + "/" + partition
+				if other, exists := partitions[k]; exists {
+					if !overlapped[ppi.IndexName] {
+						overlapped[ppi.IndexName] = true
+						s.add(CFG_CHECK_SEVERITY_ERROR,
+							CFG_CHECK_PLAN_PINDEX_PARTITION_OVERLAP,
+							PLAN_PINDEXES_KEY, issue,
+							"plan pindexes: %s and %s, of index: %s,"+
+								" both have source partition: %s",
+							other, name, ppi.IndexName, partition)
+					}
+				} else {
+					partitions[k] = name
+				}
+			}
+		}
+	}
+
+	for _, indexName := range cfgCheckSortedKeys(indexDefs) {
+		if !planned[indexName] {
+			s.add(CFG_CHECK_SEVERITY_WARN, CFG_CHECK_INDEX_NOT_PLANNED,
+				INDEX_DEFS_KEY, CfgCheckIssue{IndexName: indexName},
+				"index: %s, has no plan pindexes", indexName)
+		}
+	}
+}
+
+// cfgCheckSortedKeys returns the sorted keys of a map keyed by string.
+func cfgCheckSortedKeys(m interface{}) []string {
+	var rv []string
+
+	switch x := m.(type) {
+	case map[string]*IndexDef:
+		for k := range x {
+			rv = append(rv, k)
+		}
+	case map[string]*NodeDef:
+		for k := range x {
+			rv = append(rv, k)
+		}
+	case map[string]*PlanPIndexNode:
+		for k := range x {
+			rv = append(rv, k)
+		}
+	}
+
+	sort.Strings(rv)
+
+	return rv
+}
+
+// ----------------------------------------------------------------
+
+// RepairCfgInvariants checks the Cfg, and repairs the issues that
+// involve the planPIndexes, by pruning the orphaned plan pindexes and
+// the unwanted nodes, and then by replanning the affected indexes,
+// while the plans of the other indexes are kept.  The repaired plan is
+// saved unless the options are a DryRun, and only if the indexDefs,
+// nodeDefs and planPIndexes did not concurrently change.
+func RepairCfgInvariants(cfg Cfg, options CfgCheckRepairOptions) (
+	*CfgCheckRepairResult, error) {
+	s, err := cfgCheckLoad(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	s.check()
+
+	res := &CfgCheckRepairResult{
+		DryRun:      options.DryRun,
+		Issues:      s.issues,
+		PrunedNodes: map[string][]string{},
+	}
+
+	replan := map[string]bool{} // Keyed by index name.
+	pruned := map[string]bool{} // Keyed by plan pindex name.
+	prunedNodes := map[string]bool{}
+
+	for _, issue := range s.issues {
+		switch issue.Kind {
+		case CFG_CHECK_PLAN_PINDEX_INDEX_MISSING,
+			CFG_CHECK_PLAN_PINDEX_INDEX_UUID:
+			pruned[issue.PlanPIndexName] = true
+			replan[issue.IndexName] = true
+
+		case CFG_CHECK_PLAN_PINDEX_NODE_MISSING:
+			prunedNodes[issue.PlanPIndexName+"/"+issue.NodeUUID] = true
+			res.PrunedNodes[issue.PlanPIndexName] =
+				append(res.PrunedNodes[issue.PlanPIndexName], issue.NodeUUID)
+			replan[issue.IndexName] = true
+
+		case CFG_CHECK_PLAN_PINDEX_NO_NODES,
+			CFG_CHECK_PLAN_PINDEX_PARTITION_OVERLAP,
+			CFG_CHECK_INDEX_NOT_PLANNED:
+			replan[issue.IndexName] = true
+
+		default:
+			res.Unrepaired = append(res.Unrepaired, issue)
+		}
+	}
+
+	if len(replan) <= 0 {
+		return res, nil
+	}
+
+	for _, issue := range s.issues {
+		if issue.Kind == CFG_CHECK_PARSE &&
+			(issue.Key == INDEX_DEFS_KEY || issue.Key == PLAN_PINDEXES_KEY ||
+				issue.Key == CfgNodeDefsKey(NODE_DEFS_WANTED)) {
+			return nil, fmt.Errorf("cfg_check: cannot repair the plan,"+
+				" as a needed value could not be parsed, key: %s", issue.Key)
+		}
+	}
+
+	version := options.Version
+	if version == "" {
+		version = CfgGetVersion(cfg)
+	}
+
+	// Prune a copy of the plan.
+	planPIndexesPrev := NewPlanPIndexes(version)
+	if s.planPIndexes != nil {
+		planPIndexesPrev.UUID = s.planPIndexes.UUID
+		planPIndexesPrev.ImplVersion = s.planPIndexes.ImplVersion
+		for k, v := range s.planPIndexes.Warnings {
+			planPIndexesPrev.Warnings[k] = v
+		}
+
+		for name, ppi := range s.planPIndexes.PlanPIndexes {
+			if pruned[name] {
+				res.PrunedPlanPIndexes = append(res.PrunedPlanPIndexes, name)
+				continue
+			}
+
+			ppiCopy := *ppi
+			ppiCopy.Nodes = map[string]*PlanPIndexNode{}
+			for nodeUUID, node := range ppi.Nodes {
+				if !prunedNodes[name+"/"+nodeUUID] {
+					ppiCopy.Nodes[nodeUUID] = node
+				}
+			}
+
+			planPIndexesPrev.PlanPIndexes[name] = &ppiCopy
+		}
+	}
+	sort.Strings(res.PrunedPlanPIndexes)
+
+	indexDefs := s.indexDefs
+	if indexDefs == nil {
+		indexDefs = NewIndexDefs(version)
+	}
+
+	nodeDefs := s.nodeDefsWanted
+	if nodeDefs == nil {
+		nodeDefs = NewNodeDefs(version)
+	}
+
+	for indexName := range replan {
+		if indexDefs.IndexDefs[indexName] != nil {
+			res.ReplannedIndexes = append(res.ReplannedIndexes, indexName)
+		}
+	}
+	sort.Strings(res.ReplannedIndexes)
+
+	delta := &IndexDefsDelta{
+		Added:   map[string]*IndexDef{},
+		Removed: map[string]*IndexDef{},
+		Changed: map[string]*IndexDef{},
+	}
+	for _, indexName := range res.ReplannedIndexes {
+		delta.Changed[indexName] = indexDefs.IndexDefs[indexName]
+	}
+
+	planPIndexes, err := CalcPlan("", indexDefs, nodeDefs,
+		planPIndexesPrev, version, options.Server, options.Options,
+		plannerFilterDelta(delta))
+	if err != nil {
+		return nil, fmt.Errorf("cfg_check: could not replan, err: %v", err)
+	}
+
+	if options.DryRun {
+		return res, nil
+	}
+
+	cas := s.planPIndexesCAS
+
+	if cfgTxn, ok := cfg.(CfgTxn); ok {
+		var op CfgTxnOp
+		op, err = CfgTxnOpSetPlanPIndexes(planPIndexes, cas)
+		if err == nil {
+			_, err = cfgTxn.Txn([]CfgTxnOp{
+				{Op: CFG_TXN_OP_CHECK, Key: INDEX_DEFS_KEY,
+					CAS: s.indexDefsCAS},
+				{Op: CFG_TXN_OP_CHECK, Key: CfgNodeDefsKey(NODE_DEFS_WANTED),
+					CAS: s.nodeDefsWantedCAS},
+				op,
+			})
+		}
+	} else {
+		_, err = CfgSetPlanPIndexes(cfg, planPIndexes, cas)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cfg_check: could not save repaired plan,"+
+			" cas: %d, err: %v", cas, err)
+	}
+
+	res.Saved = true
+
+	log.Printf("cfg_check: repaired plan, pruned: %v, replanned: %v",
+		res.PrunedPlanPIndexes, res.ReplannedIndexes)
+
+	return res, nil
+}
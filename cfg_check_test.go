@@ -0,0 +1,267 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func testCfgCheckKinds(issues []*CfgCheckIssue) map[string]int {
+	rv := map[string]int{}
+	for _, issue := range issues {
+		rv[issue.Kind]++
+	}
+	return rv
+}
+
+func testCfgCheckSetup(t *testing.T, emptyDir string) (Cfg, *Manager) {
+	cfg := NewCfgMem()
+
+	mgr := NewManager(VERSION, cfg, NewUUID(), nil,
+		"", 1, "", ":1000", emptyDir, "some-datasource", nil)
+	err := mgr.Register("wanted")
+	if err != nil {
+		t.Fatalf("expected Manager.Register() to work, err: %v", err)
+	}
+
+	indexDefs := NewIndexDefs(VERSION)
+	for _, name := range []string{"a", "b"} {
+		indexDefs.IndexDefs[name] = &IndexDef{
+			Type:       "blackhole",
+			Name:       name,
+			UUID:       NewUUID(),
+			SourceType: "primary",
+			SourceName: "default",
+		}
+	}
+	_, err = CfgSetIndexDefs(cfg, indexDefs, 0)
+	if err != nil {
+		t.Fatalf("expected CfgSetIndexDefs to work, err: %v", err)
+	}
+
+	_, err = mgr.PlannerOnce("test")
+	if err != nil {
+		t.Fatalf("expected PlannerOnce to work, err: %v", err)
+	}
+
+	return cfg, mgr
+}
+
+func TestCheckCfgInvariants(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	issues, err := CheckCfgInvariants(NewCfgMem())
+	if err != nil || len(issues) != 0 {
+		t.Errorf("expected an empty cfg to be consistent, issues: %v,"+
+			" err: %v", issues, err)
+	}
+
+	cfg, _ := testCfgCheckSetup(t, emptyDir)
+
+	issues, err = CheckCfgInvariants(cfg)
+	if err != nil || len(issues) != 0 {
+		t.Fatalf("expected a planned cfg to be consistent, issues: %v,"+
+			" err: %v", issues, err)
+	}
+
+	indexDefs, indexDefsCAS, _ := CfgGetIndexDefs(cfg)
+	delete(indexDefs.IndexDefs, "b")
+	indexDefs.IndexDefs["c"] = &IndexDef{
+		Type:       "blackhole",
+		Name:       "c",
+		UUID:       NewUUID(),
+		SourceType: "primary",
+		SourceName: "default",
+	}
+	CfgSetIndexDefs(cfg, indexDefs, indexDefsCAS)
+
+	planPIndexes, planPIndexesCAS, _ := CfgGetPlanPIndexes(cfg)
+	var dup PlanPIndex
+	for _, ppi := range planPIndexes.PlanPIndexes {
+		if ppi.IndexName == "a" {
+			ppi.SourcePartitions = "0,1"
+			dup = *ppi
+			dup.Name = ppi.Name + "_dup"
+			dup.Nodes = map[string]*PlanPIndexNode{}
+			ppi.Nodes["ghost"] = &PlanPIndexNode{CanRead: true,
+				CanWrite: true, Priority: 1}
+		}
+	}
+	planPIndexes.PlanPIndexes[dup.Name] = &dup
+	CfgSetPlanPIndexes(cfg, planPIndexes, planPIndexesCAS)
+
+	nodeDefs, nodeDefsCAS, _ := CfgGetNodeDefs(cfg, NODE_DEFS_WANTED)
+	nodeDefs.NodeDefs["unknown"] = &NodeDef{UUID: "unknown"}
+	CfgSetNodeDefs(cfg, NODE_DEFS_WANTED, nodeDefs, nodeDefsCAS)
+
+	issues, err = CheckCfgInvariants(cfg)
+	if err != nil {
+		t.Fatalf("expected CheckCfgInvariants to work, err: %v", err)
+	}
+
+	kinds := testCfgCheckKinds(issues)
+	exp := map[string]int{
+		CFG_CHECK_PLAN_PINDEX_INDEX_MISSING:     1,
+		CFG_CHECK_PLAN_PINDEX_NODE_MISSING:      1,
+		CFG_CHECK_PLAN_PINDEX_NO_NODES:          1,
+		CFG_CHECK_PLAN_PINDEX_PARTITION_OVERLAP: 1,
+		CFG_CHECK_INDEX_NOT_PLANNED:             1,
+		CFG_CHECK_NODE_WANTED_NOT_KNOWN:         1,
+	}
+	if len(kinds) != len(exp) {
+		t.Errorf("expected issue kinds: %v, got: %v", exp, kinds)
+	}
+	for kind, n := range exp {
+		if kinds[kind] != n {
+			t.Errorf("expected %d issues of kind: %s, got: %v",
+				n, kind, issues)
+		}
+	}
+
+	for _, issue := range issues {
+		if issue.Kind == CFG_CHECK_PLAN_PINDEX_NODE_MISSING &&
+			(issue.NodeUUID != "ghost" || issue.IndexName != "a" ||
+				issue.Severity != CFG_CHECK_SEVERITY_ERROR) {
+			t.Errorf("unexpected issue: %#v", issue)
+		}
+		if issue.Kind == CFG_CHECK_INDEX_NOT_PLANNED &&
+			(issue.IndexName != "c" ||
+				issue.Severity != CFG_CHECK_SEVERITY_WARN) {
+			t.Errorf("unexpected issue: %#v", issue)
+		}
+	}
+
+	// A changed index UUID orphans its plan pindexes.
+	indexDefs, indexDefsCAS, _ = CfgGetIndexDefs(cfg)
+	indexDefs.IndexDefs["a"].UUID = NewUUID()
+	CfgSetIndexDefs(cfg, indexDefs, indexDefsCAS)
+
+	issues, _ = CheckCfgInvariants(cfg)
+	if testCfgCheckKinds(issues)[CFG_CHECK_PLAN_PINDEX_INDEX_UUID] != 2 {
+		t.Errorf("expected index UUID mismatches, issues: %v", issues)
+	}
+}
+
+func TestRepairCfgInvariants(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg, mgr := testCfgCheckSetup(t, emptyDir)
+
+	indexDefs, indexDefsCAS, _ := CfgGetIndexDefs(cfg)
+	delete(indexDefs.IndexDefs, "b")
+	indexDefs.IndexDefs["c"] = &IndexDef{
+		Type:       "blackhole",
+		Name:       "c",
+		UUID:       NewUUID(),
+		SourceType: "primary",
+		SourceName: "default",
+	}
+	CfgSetIndexDefs(cfg, indexDefs, indexDefsCAS)
+
+	planPIndexes, planPIndexesCAS, _ := CfgGetPlanPIndexes(cfg)
+	var planPIndexA string
+	for _, ppi := range planPIndexes.PlanPIndexes {
+		if ppi.IndexName == "a" {
+			planPIndexA = ppi.Name
+			ppi.Nodes["ghost"] = &PlanPIndexNode{CanRead: true,
+				CanWrite: true, Priority: 1}
+		}
+	}
+	planPIndexesCAS, _ = CfgSetPlanPIndexes(cfg, planPIndexes, planPIndexesCAS)
+
+	res, err := RepairCfgInvariants(cfg, CfgCheckRepairOptions{DryRun: true})
+	if err != nil {
+		t.Fatalf("expected a dry run repair to work, err: %v", err)
+	}
+	if res.Saved || len(res.Issues) != 3 ||
+		len(res.PrunedPlanPIndexes) != 1 ||
+		len(res.PrunedNodes[planPIndexA]) != 1 ||
+		len(res.ReplannedIndexes) != 2 ||
+		res.ReplannedIndexes[0] != "a" || res.ReplannedIndexes[1] != "c" {
+		t.Errorf("unexpected dry run result: %#v", res)
+	}
+
+	_, cas, _ := CfgGetPlanPIndexes(cfg)
+	if cas != planPIndexesCAS {
+		t.Errorf("expected a dry run to not save the plan")
+	}
+
+	res, err = RepairCfgInvariants(cfg, CfgCheckRepairOptions{
+		Server: mgr.Server(),
+	})
+	if err != nil || !res.Saved {
+		t.Fatalf("expected a repair to work, res: %#v, err: %v", res, err)
+	}
+
+	issues, err := CheckCfgInvariants(cfg)
+	if err != nil || len(issues) != 0 {
+		t.Errorf("expected a repaired cfg to be consistent, issues: %v,"+
+			" err: %v", issues, err)
+	}
+
+	planPIndexes, _, _ = CfgGetPlanPIndexes(cfg)
+	if len(planPIndexes.PlanPIndexes) != 2 {
+		t.Errorf("expected plan pindexes for a and c, got: %#v",
+			planPIndexes.PlanPIndexes)
+	}
+	for _, ppi := range planPIndexes.PlanPIndexes {
+		if len(ppi.Nodes) != 1 || ppi.Nodes[mgr.UUID()] == nil {
+			t.Errorf("expected the wanted node only, ppi: %#v", ppi)
+		}
+	}
+
+	// A consistent cfg needs no repair.
+	res, err = RepairCfgInvariants(cfg, CfgCheckRepairOptions{})
+	if err != nil || res.Saved || len(res.ReplannedIndexes) != 0 {
+		t.Errorf("expected no repairs, res: %#v, err: %v", res, err)
+	}
+
+	// Parse issues are reported, but not repaired.
+	_, cas, _ = cfg.Get(CfgNodeDefsKey(NODE_DEFS_KNOWN), 0)
+	cfg.Set(CfgNodeDefsKey(NODE_DEFS_KNOWN), []byte("not json"), cas)
+	res, err = RepairCfgInvariants(cfg, CfgCheckRepairOptions{})
+	if err != nil || res.Saved || len(res.Unrepaired) != 1 ||
+		res.Unrepaired[0].Kind != CFG_CHECK_PARSE {
+		t.Errorf("expected an unrepaired parse issue, res: %#v, err: %v",
+			res, err)
+	}
+
+	// A concurrent change of the indexDefs fails the repair.
+	planPIndexes, planPIndexesCAS, _ = CfgGetPlanPIndexes(cfg)
+	for _, ppi := range planPIndexes.PlanPIndexes {
+		ppi.Nodes = map[string]*PlanPIndexNode{}
+	}
+	CfgSetPlanPIndexes(cfg, planPIndexes, planPIndexesCAS)
+
+	cfgTxn := &cfgCheckTestTxn{CfgMem: cfg.(*CfgMem)}
+	_, err = RepairCfgInvariants(cfgTxn, CfgCheckRepairOptions{})
+	if err == nil {
+		t.Errorf("expected a concurrent change to fail the repair")
+	}
+}
+
+// cfgCheckTestTxn changes the indexDefs before each txn.
+type cfgCheckTestTxn struct {
+	*CfgMem
+}
+
+func (c *cfgCheckTestTxn) Txn(ops []CfgTxnOp) ([]uint64, error) {
+	indexDefs, cas, _ := CfgGetIndexDefs(c.CfgMem)
+	indexDefs.UUID = NewUUID()
+	CfgSetIndexDefs(c.CfgMem, indexDefs, cas)
+
+	return c.CfgMem.Txn(ops)
+}
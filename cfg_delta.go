@@ -0,0 +1,370 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// A CfgValueEvent is like a CfgEvent, but also carries the previous
+// and the new values of the key.  A nil Val (and a zero CAS) means
+// the key was deleted, and a nil PrevVal means the key did not exist.
+// The values may be shared with the Cfg, so they must not be modified.
+type CfgValueEvent struct {
+	Key     string
+	CAS     uint64
+	Val     []byte
+	PrevCAS uint64
+	PrevVal []byte
+	Error   error
+}
+
+// CfgSubscribeValues subscribes to changes of a key, where each
+// change is delivered on the channel with the key's previous and new
+// values.  Unlike with Cfg.Subscribe(), events that don't change the
+// key's CAS (such as those from a Refresh()) are not delivered.  For
+// the PLAN_PINDEXES_KEY, changes to the PLAN_PINDEXES_DIRECTORY_STAMP
+// are also followed, as some Cfg providers store plans separately.
+// The new value is taken from the event when the Cfg provider carries
+// it and it's newer than the last value, so a large value isn't
+// retrieved again with a Get() on every change, where a Get() is
+// still used for deletions and for the events of other providers.
+// The subscription ends when the stopCh is closed.
+func CfgSubscribeValues(cfg Cfg, key string, ch chan CfgValueEvent,
+	stopCh chan struct{}) error {
+	ec := make(chan CfgEvent)
+
+	err := cfg.Subscribe(key, ec)
+	if err != nil {
+		return err
+	}
+
+	if key == PLAN_PINDEXES_KEY {
+		err = cfg.Subscribe(PLAN_PINDEXES_DIRECTORY_STAMP, ec)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Get after Subscribe, so that no change can be missed.
+	val, cas, err := cfg.Get(key, 0)
+	if err != nil {
+		return err
+	}
+
+	send := func(ev CfgValueEvent) bool {
+		select {
+		case <-stopCh:
+			return false
+		case ch <- ev:
+			return true
+		}
+	}
+
+	go func() {
+		for {
+			select {
+			case <-stopCh:
+				return
+
+			case e := <-ec:
+				if e.Error != nil {
+					if !send(CfgValueEvent{Key: key, Error: e.Error}) {
+						return
+					}
+					continue
+				}
+
+				// A carried value of an event that's delivered after
+				// the initial Get() may be older than the last value.
+				valNext, casNext := e.Val, e.CAS
+				if e.Val == nil || e.Key != key || e.CAS <= cas {
+					var err error
+					valNext, casNext, err = cfg.Get(key, 0)
+					if err != nil {
+						if !send(CfgValueEvent{Key: key, Error: err}) {
+							return
+						}
+						continue
+					}
+				}
+
+				if casNext == cas {
+					continue
+				}
+
+				if !send(CfgValueEvent{
+					Key:     key,
+					CAS:     casNext,
+					Val:     valNext,
+					PrevCAS: cas,
+					PrevVal: val,
+				}) {
+					return
+				}
+
+				val, cas = valNext, casNext
+			}
+		}
+	}()
+
+	return nil
+}
+
+// ------------------------------------------------------------------------
+
+// A CfgDeltaEvent is delivered by CfgSubscribeDeltas(), with the
+// parsed new value and a delta from the previous value.  Only the
+// fields for the event's key are populated.  A nil IndexDefs or
+// PlanPIndexes means the key does not exist.
+type CfgDeltaEvent struct {
+	Key     string
+	CAS     uint64
+	PrevCAS uint64
+	Error   error
+
+	IndexDefs      *IndexDefs
+	IndexDefsDelta *IndexDefsDelta
+
+	PlanPIndexes      *PlanPIndexes
+	PlanPIndexesDelta *PlanPIndexesDelta
+}
+
+// An IndexDefsDelta holds the index definitions that were added,
+// removed or changed between two IndexDefs, keyed by name.  A changed
+// entry holds the new index definition.
+type IndexDefsDelta struct {
+	Added   map[string]*IndexDef `json:"added"`
+	Removed map[string]*IndexDef `json:"removed"`
+	Changed map[string]*IndexDef `json:"changed"`
+}
+
+// A PlanPIndexesDelta holds the plan pindexes that were added,
+// removed or changed between two PlanPIndexes, keyed by name.  A
+// changed entry holds the new plan pindex.
+type PlanPIndexesDelta struct {
+	Added   map[string]*PlanPIndex `json:"added"`
+	Removed map[string]*PlanPIndex `json:"removed"`
+	Changed map[string]*PlanPIndex `json:"changed"`
+}
+
+// CfgSubscribeDeltas is like CfgSubscribeValues, but is only for the
+// INDEX_DEFS_KEY or the PLAN_PINDEXES_KEY, whose values are parsed
+// just once and delivered with a delta from the previous value.  The
+// last parsed value is kept to compute the next delta, and is reused
+// as-is when a new CAS has the same bytes, so the parsed values of
+// the events must not be modified.
+func CfgSubscribeDeltas(cfg Cfg, key string, ch chan *CfgDeltaEvent,
+	stopCh chan struct{}) error {
+	if key != INDEX_DEFS_KEY && key != PLAN_PINDEXES_KEY {
+		return fmt.Errorf("cfg_delta: unsupported key: %s", key)
+	}
+
+	vc := make(chan CfgValueEvent)
+
+	err := CfgSubscribeValues(cfg, key, vc, stopCh)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		var prevIndexDefs *IndexDefs
+		var prevPlanPIndexes *PlanPIndexes
+		var prevVal []byte // The bytes of the prev parsed values.
+		var parsed bool    // True when the prev values have been parsed.
+
+		for {
+			var ve CfgValueEvent
+
+			select {
+			case <-stopCh:
+				return
+			case ve = <-vc:
+			}
+
+			ev := &CfgDeltaEvent{
+				Key:     ve.Key,
+				CAS:     ve.CAS,
+				PrevCAS: ve.PrevCAS,
+				Error:   ve.Error,
+			}
+
+			if ev.Error == nil && !parsed {
+				prevIndexDefs, prevPlanPIndexes, ev.Error =
+					cfgDeltaParse(key, ve.PrevVal)
+				prevVal = ve.PrevVal
+			}
+
+			if ev.Error == nil {
+				if ve.Val != nil && prevVal != nil &&
+					bytes.Equal(ve.Val, prevVal) {
+					ev.IndexDefs, ev.PlanPIndexes =
+						prevIndexDefs, prevPlanPIndexes
+				} else {
+					ev.IndexDefs, ev.PlanPIndexes, ev.Error =
+						cfgDeltaParse(key, ve.Val)
+				}
+			}
+
+			if ev.Error == nil {
+				if key == INDEX_DEFS_KEY {
+					ev.IndexDefsDelta =
+						CalcIndexDefsDelta(prevIndexDefs, ev.IndexDefs)
+				} else {
+					ev.PlanPIndexesDelta =
+						CalcPlanPIndexesDelta(prevPlanPIndexes, ev.PlanPIndexes)
+				}
+
+				prevIndexDefs, prevPlanPIndexes = ev.IndexDefs, ev.PlanPIndexes
+				prevVal = ve.Val
+				parsed = true
+			} else {
+				// The next event's PrevVal will be reparsed.
+				parsed = false
+			}
+
+			select {
+			case <-stopCh:
+				return
+			case ch <- ev:
+			}
+		}
+	}()
+
+	return nil
+}
+
+func cfgDeltaParse(key string, val []byte) (
+	*IndexDefs, *PlanPIndexes, error) {
+	if val == nil {
+		return nil, nil, nil
+	}
+
+	if key == INDEX_DEFS_KEY {
+		rv := &IndexDefs{}
+		err := json.Unmarshal(val, rv)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cfg_delta: could not parse,"+
+				" key: %s, err: %v", key, err)
+		}
+		return rv, nil, nil
+	}
+
+	rv := &PlanPIndexes{}
+	err := json.Unmarshal(val, rv)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cfg_delta: could not parse,"+
+			" key: %s, err: %v", key, err)
+	}
+	return nil, rv, nil
+}
+
+// ------------------------------------------------------------------------
+
+// CalcIndexDefsDelta returns the index definitions that were added,
+// removed or changed from the prev to the curr IndexDefs, either of
+// which may be nil.
+func CalcIndexDefsDelta(prev, curr *IndexDefs) *IndexDefsDelta {
+	rv := &IndexDefsDelta{
+		Added:   map[string]*IndexDef{},
+		Removed: map[string]*IndexDef{},
+		Changed: map[string]*IndexDef{},
+	}
+
+	var prevDefs, currDefs map[string]*IndexDef
+	if prev != nil {
+		prevDefs = prev.IndexDefs
+	}
+	if curr != nil {
+		currDefs = curr.IndexDefs
+	}
+
+	for name, indexDef := range currDefs {
+		prevDef, exists := prevDefs[name]
+		if !exists {
+			rv.Added[name] = indexDef
+		} else if !reflect.DeepEqual(prevDef, indexDef) {
+			rv.Changed[name] = indexDef
+		}
+	}
+
+	for name, prevDef := range prevDefs {
+		if _, exists := currDefs[name]; !exists {
+			rv.Removed[name] = prevDef
+		}
+	}
+
+	return rv
+}
+
+// IsEmpty returns true when nothing was added, removed or changed.
+func (d *IndexDefsDelta) IsEmpty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// CalcPlanPIndexesDelta returns the plan pindexes that were added,
+// removed or changed from the prev to the curr PlanPIndexes, either
+// of which may be nil.
+func CalcPlanPIndexesDelta(prev, curr *PlanPIndexes) *PlanPIndexesDelta {
+	rv := &PlanPIndexesDelta{
+		Added:   map[string]*PlanPIndex{},
+		Removed: map[string]*PlanPIndex{},
+		Changed: map[string]*PlanPIndex{},
+	}
+
+	var prevPlans, currPlans map[string]*PlanPIndex
+	if prev != nil {
+		prevPlans = prev.PlanPIndexes
+	}
+	if curr != nil {
+		currPlans = curr.PlanPIndexes
+	}
+
+	for name, planPIndex := range currPlans {
+		prevPlan, exists := prevPlans[name]
+		if !exists {
+			rv.Added[name] = planPIndex
+		} else if !reflect.DeepEqual(prevPlan, planPIndex) {
+			rv.Changed[name] = planPIndex
+		}
+	}
+
+	for name, prevPlan := range prevPlans {
+		if _, exists := currPlans[name]; !exists {
+			rv.Removed[name] = prevPlan
+		}
+	}
+
+	return rv
+}
+
+// IsEmpty returns true when nothing was added, removed or changed.
+func (d *PlanPIndexesDelta) IsEmpty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// IndexNames returns the names of the indexes of the added, removed
+// or changed plan pindexes.
+func (d *PlanPIndexesDelta) IndexNames() map[string]bool {
+	rv := map[string]bool{}
+	for _, m := range []map[string]*PlanPIndex{d.Added, d.Removed, d.Changed} {
+		for _, planPIndex := range m {
+			if planPIndex != nil {
+				rv[planPIndex.IndexName] = true
+			}
+		}
+	}
+	return rv
+}
@@ -0,0 +1,349 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCfgSubscribeValues(t *testing.T) {
+	c := NewCfgMem()
+	cas0, _ := c.Set("a", []byte("A"), 0)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	ch := make(chan CfgValueEvent)
+	err := CfgSubscribeValues(c, "a", ch, stopCh)
+	if err != nil {
+		t.Fatalf("expected CfgSubscribeValues to work, err: %v", err)
+	}
+
+	next := func() CfgValueEvent {
+		select {
+		case ev := <-ch:
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected an event")
+		}
+		return CfgValueEvent{}
+	}
+
+	cas1, _ := c.Set("a", []byte("B"), cas0)
+	ev := next()
+	if ev.Key != "a" || ev.CAS != cas1 || string(ev.Val) != "B" ||
+		ev.PrevCAS != cas0 || string(ev.PrevVal) != "A" {
+		t.Errorf("expected set event, ev: %#v", ev)
+	}
+
+	// A refresh with no changes is not delivered.
+	c.Refresh()
+
+	c.Del("a", 0)
+	ev = next()
+	if ev.CAS != 0 || ev.Val != nil ||
+		ev.PrevCAS != cas1 || string(ev.PrevVal) != "B" {
+		t.Errorf("expected del event, ev: %#v", ev)
+	}
+}
+
+// getCountingCfg counts the Get() invocations of a CfgMem.
+type getCountingCfg struct {
+	*CfgMem
+	gets int64
+}
+
+func (c *getCountingCfg) Get(key string, cas uint64) ([]byte, uint64, error) {
+	atomic.AddInt64(&c.gets, 1)
+	return c.CfgMem.Get(key, cas)
+}
+
+func TestCfgSubscribeValuesCarried(t *testing.T) {
+	c := &getCountingCfg{CfgMem: NewCfgMem()}
+	cas, _ := c.Set("a", []byte("A0"), 0)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	ch := make(chan CfgValueEvent)
+	err := CfgSubscribeValues(c, "a", ch, stopCh)
+	if err != nil {
+		t.Fatalf("expected CfgSubscribeValues to work, err: %v", err)
+	}
+
+	// The events of a CfgMem are delivered in order, with their
+	// values, so no Get() is needed after the initial one.
+	for i := 1; i <= 10; i++ {
+		cas, _ = c.Set("a", []byte(fmt.Sprintf("A%d", i)), cas)
+	}
+
+	for i := 1; i <= 10; i++ {
+		ev := <-ch
+		if string(ev.Val) != fmt.Sprintf("A%d", i) ||
+			string(ev.PrevVal) != fmt.Sprintf("A%d", i-1) {
+			t.Errorf("expected in-order values, i: %d, ev: %#v", i, ev)
+		}
+	}
+
+	if atomic.LoadInt64(&c.gets) != 1 {
+		t.Errorf("expected only the initial Get, gets: %d", c.gets)
+	}
+
+	// A deletion still uses a Get().
+	c.Del("a", 0)
+	ev := <-ch
+	if ev.Val != nil || ev.CAS != 0 || string(ev.PrevVal) != "A10" ||
+		atomic.LoadInt64(&c.gets) != 2 {
+		t.Errorf("expected del event, ev: %#v, gets: %d", ev, c.gets)
+	}
+}
+
+func TestCalcIndexDefsDelta(t *testing.T) {
+	prev := NewIndexDefs(VERSION)
+	prev.IndexDefs["a"] = &IndexDef{Name: "a", UUID: "a0"}
+	prev.IndexDefs["b"] = &IndexDef{Name: "b", UUID: "b0"}
+	prev.IndexDefs["c"] = &IndexDef{Name: "c", UUID: "c0"}
+
+	curr := NewIndexDefs(VERSION)
+	curr.IndexDefs["a"] = &IndexDef{Name: "a", UUID: "a0"}
+	curr.IndexDefs["b"] = &IndexDef{Name: "b", UUID: "b1"}
+	curr.IndexDefs["d"] = &IndexDef{Name: "d", UUID: "d0"}
+
+	d := CalcIndexDefsDelta(prev, curr)
+	if len(d.Added) != 1 || d.Added["d"] == nil ||
+		len(d.Removed) != 1 || d.Removed["c"] == nil ||
+		len(d.Changed) != 1 || d.Changed["b"].UUID != "b1" {
+		t.Errorf("unexpected delta: %#v", d)
+	}
+
+	if !CalcIndexDefsDelta(curr, curr).IsEmpty() {
+		t.Errorf("expected empty delta")
+	}
+
+	d = CalcIndexDefsDelta(nil, curr)
+	if len(d.Added) != 3 || len(d.Removed) != 0 {
+		t.Errorf("expected all added from nil, delta: %#v", d)
+	}
+}
+
+func TestCalcPlanPIndexesDelta(t *testing.T) {
+	prev := NewPlanPIndexes(VERSION)
+	prev.PlanPIndexes["x0"] = &PlanPIndex{Name: "x0", IndexName: "x",
+		Nodes: map[string]*PlanPIndexNode{"n0": {CanRead: true}}}
+	prev.PlanPIndexes["y0"] = &PlanPIndex{Name: "y0", IndexName: "y"}
+
+	curr := NewPlanPIndexes(VERSION)
+	curr.PlanPIndexes["x0"] = &PlanPIndex{Name: "x0", IndexName: "x",
+		Nodes: map[string]*PlanPIndexNode{"n1": {CanRead: true}}}
+	curr.PlanPIndexes["z0"] = &PlanPIndex{Name: "z0", IndexName: "z"}
+
+	d := CalcPlanPIndexesDelta(prev, curr)
+	if d.Changed["x0"] == nil || d.Removed["y0"] == nil ||
+		d.Added["z0"] == nil {
+		t.Errorf("unexpected delta: %#v", d)
+	}
+
+	names := d.IndexNames()
+	if len(names) != 3 || !names["x"] || !names["y"] || !names["z"] {
+		t.Errorf("unexpected index names: %#v", names)
+	}
+}
+
+func TestCfgSubscribeDeltas(t *testing.T) {
+	c := NewCfgMem()
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	ch := make(chan *CfgDeltaEvent)
+	err := CfgSubscribeDeltas(c, "not-supported", ch, stopCh)
+	if err == nil {
+		t.Errorf("expected err on an unsupported key")
+	}
+
+	err = CfgSubscribeDeltas(c, INDEX_DEFS_KEY, ch, stopCh)
+	if err != nil {
+		t.Fatalf("expected CfgSubscribeDeltas to work, err: %v", err)
+	}
+
+	indexDefs := NewIndexDefs(VERSION)
+	indexDefs.IndexDefs["a"] = &IndexDef{Name: "a", UUID: "a0"}
+	cas, _ := CfgSetIndexDefs(c, indexDefs, 0)
+
+	ev := <-ch
+	if ev.Error != nil || ev.CAS != cas || ev.PrevCAS != 0 ||
+		ev.IndexDefs.IndexDefs["a"] == nil ||
+		ev.IndexDefsDelta.Added["a"] == nil {
+		t.Errorf("expected added event, ev: %#v", ev)
+	}
+
+	indexDefs.IndexDefs["b"] = &IndexDef{Name: "b", UUID: "b0"}
+	indexDefs.IndexDefs["a"] = &IndexDef{Name: "a", UUID: "a1"}
+	cas2, _ := CfgSetIndexDefs(c, indexDefs, cas)
+
+	ev = <-ch
+	if ev.PrevCAS != cas || ev.CAS != cas2 ||
+		len(ev.IndexDefsDelta.Added) != 1 || ev.IndexDefsDelta.Added["b"] == nil ||
+		len(ev.IndexDefsDelta.Changed) != 1 || ev.IndexDefsDelta.Changed["a"] == nil {
+		t.Errorf("expected changed event, ev: %#v", ev)
+	}
+
+	// The same bytes under a new CAS reuse the last parsed value.
+	val, _, _ := c.Get(INDEX_DEFS_KEY, 0)
+	cas3, _ := c.Set(INDEX_DEFS_KEY, val, cas2)
+
+	prevIndexDefs := ev.IndexDefs
+	ev = <-ch
+	if ev.CAS != cas3 || ev.IndexDefs != prevIndexDefs ||
+		!ev.IndexDefsDelta.IsEmpty() {
+		t.Errorf("expected an empty delta, ev: %#v", ev)
+	}
+
+	c.Set(INDEX_DEFS_KEY, []byte("not json"), cas3)
+	ev = <-ch
+	if ev.Error == nil {
+		t.Errorf("expected parse err event")
+	}
+}
+
+func TestManagerPlannerJanitorDelta(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+
+	// Only registered, without the planner and janitor loops, so
+	// that only the test runs the planner and janitor.
+	mgr := NewManager(VERSION, cfg, NewUUID(), nil,
+		"", 1, "", ":1000", emptyDir, "some-datasource", nil)
+	err := mgr.Register("wanted")
+	if err != nil {
+		t.Fatalf("expected Manager.Register() to work, err: %v", err)
+	}
+
+	indexDefs := NewIndexDefs(VERSION)
+	var indexDefsCAS uint64
+
+	createIndex := func(name string) (*IndexDefs, uint64) {
+		indexDefs.IndexDefs[name] = &IndexDef{
+			Type:       "blackhole",
+			Name:       name,
+			UUID:       NewUUID(),
+			SourceType: "primary",
+			SourceName: "default",
+		}
+		indexDefs.UUID = NewUUID()
+		indexDefsCAS, err = CfgSetIndexDefs(cfg, indexDefs, indexDefsCAS)
+		if err != nil {
+			t.Fatalf("expected CfgSetIndexDefs to work, err: %v", err)
+		}
+		rv, cas, _ := CfgGetIndexDefs(cfg)
+		return rv, cas
+	}
+
+	indexDefs0, cas0 := createIndex("a")
+
+	_, err = mgr.PlannerOnce("test")
+	if err != nil {
+		t.Fatalf("expected PlannerOnce to work, err: %v", err)
+	}
+	planPIndexes0, planCAS0, _ := CfgGetPlanPIndexes(cfg)
+
+	err = mgr.JanitorOnce("test")
+	if err != nil {
+		t.Fatalf("expected JanitorOnce to work, err: %v", err)
+	}
+	_, pindexes0 := mgr.CurrentMaps()
+	if len(pindexes0) != 1 {
+		t.Fatalf("expected 1 pindex, got: %d", len(pindexes0))
+	}
+
+	indexDefs1, cas1 := createIndex("b")
+
+	ev := &CfgDeltaEvent{
+		Key:            INDEX_DEFS_KEY,
+		CAS:            cas1,
+		PrevCAS:        cas0,
+		IndexDefs:      indexDefs1,
+		IndexDefsDelta: CalcIndexDefsDelta(indexDefs0, indexDefs1),
+	}
+
+	changed, err := mgr.PlannerOnceDelta("test", ev)
+	if err != nil || !changed {
+		t.Fatalf("expected PlannerOnceDelta to change the plan, err: %v", err)
+	}
+	if atomic.LoadUint64(&mgr.stats.TotPlannerKickDelta) != 1 {
+		t.Errorf("expected a delta planner run")
+	}
+
+	planPIndexes1, planCAS1, _ := CfgGetPlanPIndexes(cfg)
+	for name, p := range planPIndexes0.PlanPIndexes {
+		if planPIndexes1.PlanPIndexes[name] == nil ||
+			planPIndexes1.PlanPIndexes[name].UUID != p.UUID {
+			t.Errorf("expected the plan of a to be kept, name: %s", name)
+		}
+	}
+	if len(planPIndexes1.PlanPIndexes) != 2 {
+		t.Errorf("expected plans for a and b, got: %#v", planPIndexes1)
+	}
+
+	// Already planned.
+	changed, err = mgr.PlannerOnceDelta("test", ev)
+	if err != nil || changed {
+		t.Errorf("expected a replay to do nothing, err: %v", err)
+	}
+
+	err = mgr.JanitorOnceDelta("test", &CfgDeltaEvent{
+		Key:               PLAN_PINDEXES_KEY,
+		CAS:               planCAS1,
+		PrevCAS:           planCAS0,
+		PlanPIndexes:      planPIndexes1,
+		PlanPIndexesDelta: CalcPlanPIndexesDelta(planPIndexes0, planPIndexes1),
+	})
+	if err != nil {
+		t.Fatalf("expected JanitorOnceDelta to work, err: %v", err)
+	}
+	if atomic.LoadUint64(&mgr.stats.TotJanitorKickDelta) != 1 {
+		t.Errorf("expected a delta janitor run")
+	}
+
+	_, pindexes1 := mgr.CurrentMaps()
+	if len(pindexes1) != 2 {
+		t.Errorf("expected 2 pindexes, got: %d", len(pindexes1))
+	}
+	for name, pindex := range pindexes0 {
+		if pindexes1[name] != pindex {
+			t.Errorf("expected pindex of a to be untouched, name: %s", name)
+		}
+	}
+
+	// A delta that doesn't follow from the last run falls back to a
+	// full run.
+	err = mgr.JanitorOnceDelta("test", &CfgDeltaEvent{
+		Key:               PLAN_PINDEXES_KEY,
+		CAS:               planCAS1 + 100,
+		PrevCAS:           planCAS1 + 99,
+		PlanPIndexes:      planPIndexes1,
+		PlanPIndexesDelta: &PlanPIndexesDelta{},
+	})
+	if err != nil {
+		t.Errorf("expected fallback JanitorOnce to work, err: %v", err)
+	}
+	if atomic.LoadUint64(&mgr.stats.TotJanitorKickDelta) != 1 {
+		t.Errorf("expected a full janitor run")
+	}
+}
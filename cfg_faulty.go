@@ -0,0 +1,413 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// The names of the Cfg operations, as used by CfgFaultyOptions.
+const (
+	CFG_FAULTY_OP_GET       = "get"
+	CFG_FAULTY_OP_SET       = "set"
+	CFG_FAULTY_OP_DEL       = "del"
+	CFG_FAULTY_OP_SUBSCRIBE = "subscribe"
+	CFG_FAULTY_OP_REFRESH   = "refresh"
+	CFG_FAULTY_OP_TXN       = "txn"
+
+	CFG_FAULTY_OP_CLUSTER_VERSION = "clusterVersion"
+)
+
+// CfgFaultyOptions configure the faults injected by a CfgFaulty.
+// The zero value injects no faults.
+type CfgFaultyOptions struct {
+	// Seed of the random number generator, for repeatable runs.
+	Seed int64
+
+	// Every operation is delayed by the Latency plus a random
+	// duration up to the LatencyJitter.
+	Latency       time.Duration
+	LatencyJitter time.Duration
+
+	// The probability, from 0.0 to 1.0, of an operation failing with
+	// a *CfgFaultyError, keyed by CFG_FAULTY_OP_XXX.
+	ErrorRates map[string]float64
+
+	// The probability of a set, del or txn operation failing with a
+	// *CfgCASError, without being applied.
+	CASMismatchRate float64
+
+	// Deterministic faults, which unlike the random faults do not
+	// depend on the scheduling of concurrent callers.  The operations
+	// are counted from the last SetOptions().  When > 0, every Nth
+	// operation of a kind fails with a *CfgFaultyError, keyed by
+	// CFG_FAULTY_OP_XXX.
+	ErrorEvery map[string]int
+
+	// When > 0, every Nth set, del or txn operation fails with a
+	// *CfgCASError, without being applied.
+	CASMismatchEvery int
+
+	// When > 0, every operation after the first ErrorAfter operations
+	// fails with a *CfgFaultyError.
+	ErrorAfter int
+
+	// When > 0, the first ErrorUntil operations fail with a
+	// *CfgFaultyError.
+	ErrorUntil int
+
+	// The probability of a Subscribe() event being dropped.
+	EventDropRate float64
+
+	// Each Subscribe() event is delayed by a random duration up to
+	// the EventDelay, so events might also be reordered.
+	EventDelay time.Duration
+
+	// When non-empty, only the operations and events of these keys
+	// are faulted, except for partitions.
+	Keys []string
+}
+
+// CfgFaultyStats counts the faults injected by a CfgFaulty.
+type CfgFaultyStats struct {
+	TotOps            uint64
+	TotErrors         uint64
+	TotCASMismatches  uint64
+	TotPartitioned    uint64
+	TotEventsDropped  uint64
+	TotEventsDelayed  uint64
+	TotEventsHeld     uint64
+	TotEventsReceived uint64
+}
+
+// A CfgFaultyError is the error of an injected fault.
+type CfgFaultyError struct {
+	Op     string
+	Key    string
+	Reason string
+}
+
+func (e *CfgFaultyError) Error() string {
+	return fmt.Sprintf("cfg_faulty: injected %s fault, op: %s, key: %s",
+		e.Reason, e.Op, e.Key)
+}
+
+// A CfgFaulty is a Cfg that wraps another Cfg and injects faults,
+// such as latency, errors, CAS mismatches, lost or delayed events,
+// and network partitions, for resilience testing.  The faults can be
+// changed while in use, via SetOptions(), Partition() and Heal().
+type CfgFaulty struct {
+	cfg Cfg
+
+	m           sync.Mutex // Protects the fields that follow.
+	options     CfgFaultyOptions
+	keys        map[string]bool
+	rand        *rand.Rand
+	stats       CfgFaultyStats
+	numOps      int            // Operations since the last SetOptions().
+	opCounts    map[string]int // Keyed by CFG_FAULTY_OP_XXX.
+	numCASOps   int            // Set, del and txn operations.
+	partitioned bool
+	healCh      chan struct{} // Closed when a partition heals.
+}
+
+// NewCfgFaulty returns a CfgFaulty that wraps the given cfg.  The
+// returned Cfg also implements CfgTxn and VersionReader when the
+// wrapped cfg does.  Use GetCfgFaulty() to retrieve the CfgFaulty
+// from the returned Cfg.
+func NewCfgFaulty(cfg Cfg, options CfgFaultyOptions) Cfg {
+	c := &CfgFaulty{cfg: cfg}
+	c.SetOptions(options)
+
+	return wrapCfg(c, cfg)
+}
+
+// GetCfgFaulty returns the CfgFaulty of a Cfg that was returned by
+// NewCfgFaulty(), or nil.
+func GetCfgFaulty(cfg Cfg) *CfgFaulty {
+	c, _ := unwrapCfgWrapper(cfg).(*CfgFaulty)
+	return c
+}
+
+// Unwrap returns the wrapped Cfg.
+func (c *CfgFaulty) Unwrap() Cfg {
+	return c.cfg
+}
+
+// SetOptions replaces the faults to be injected, which also reseeds
+// the random number generator and restarts the counting of the
+// operations for the deterministic faults.
+func (c *CfgFaulty) SetOptions(options CfgFaultyOptions) {
+	keys := map[string]bool{}
+	for _, key := range options.Keys {
+		keys[key] = true
+	}
+
+	c.m.Lock()
+	c.options = options
+	c.keys = keys
+	c.rand = rand.New(rand.NewSource(options.Seed))
+	c.numOps = 0
+	c.opCounts = map[string]int{}
+	c.numCASOps = 0
+	c.m.Unlock()
+}
+
+// Stats returns a copy of the fault counters.
+func (c *CfgFaulty) Stats() CfgFaultyStats {
+	c.m.Lock()
+	rv := c.stats
+	c.m.Unlock()
+	return rv
+}
+
+// Partition starts a partition window, where every operation fails
+// and Subscribe() events are held until the partition heals, either
+// after the given duration, or, if the duration is <= 0, when Heal()
+// is called.
+func (c *CfgFaulty) Partition(d time.Duration) {
+	c.m.Lock()
+	if !c.partitioned {
+		c.partitioned = true
+		c.healCh = make(chan struct{})
+	}
+	healCh := c.healCh
+	c.m.Unlock()
+
+	if d > 0 {
+		time.AfterFunc(d, func() {
+			c.m.Lock()
+			if c.healCh == healCh {
+				c.healLOCKED()
+			}
+			c.m.Unlock()
+		})
+	}
+}
+
+// Heal ends any partition window, delivering any held events.
+func (c *CfgFaulty) Heal() {
+	c.m.Lock()
+	c.healLOCKED()
+	c.m.Unlock()
+}
+
+func (c *CfgFaulty) healLOCKED() {
+	if c.partitioned {
+		c.partitioned = false
+		close(c.healCh)
+	}
+}
+
+// Partitioned returns true during a partition window.
+func (c *CfgFaulty) Partitioned() bool {
+	c.m.Lock()
+	rv := c.partitioned
+	c.m.Unlock()
+	return rv
+}
+
+// ----------------------------------------------------------------
+
+// fault sleeps for any latency and returns any fault to be injected
+// for an operation on a key.
+func (c *CfgFaulty) fault(op, key string) error {
+	c.m.Lock()
+
+	c.stats.TotOps++
+
+	c.numOps++
+	c.opCounts[op]++
+
+	isCASOp := op == CFG_FAULTY_OP_SET || op == CFG_FAULTY_OP_DEL ||
+		op == CFG_FAULTY_OP_TXN
+	if isCASOp {
+		c.numCASOps++
+	}
+
+	latency := c.options.Latency
+	if c.options.LatencyJitter > 0 {
+		latency += time.Duration(c.rand.Int63n(int64(c.options.LatencyJitter)))
+	}
+
+	var err error
+
+	if c.partitioned {
+		c.stats.TotPartitioned++
+		err = &CfgFaultyError{Op: op, Key: key, Reason: "partition"}
+	} else if c.faultyKeyLOCKED(key) {
+		o := &c.options
+
+		every := o.ErrorEvery[op]
+
+		if (every > 0 && c.opCounts[op]%every == 0) ||
+			(o.ErrorAfter > 0 && c.numOps > o.ErrorAfter) ||
+			(o.ErrorUntil > 0 && c.numOps <= o.ErrorUntil) ||
+			c.rand.Float64() < o.ErrorRates[op] {
+			c.stats.TotErrors++
+			err = &CfgFaultyError{Op: op, Key: key, Reason: "error"}
+		} else if isCASOp &&
+			((o.CASMismatchEvery > 0 &&
+				c.numCASOps%o.CASMismatchEvery == 0) ||
+				c.rand.Float64() < o.CASMismatchRate) {
+			c.stats.TotCASMismatches++
+			err = &CfgCASError{}
+		}
+	}
+
+	c.m.Unlock()
+
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+
+	return err
+}
+
+func (c *CfgFaulty) faultyKeyLOCKED(key string) bool {
+	return len(c.keys) == 0 || c.keys[key]
+}
+
+func (c *CfgFaulty) Get(key string, cas uint64) ([]byte, uint64, error) {
+	err := c.fault(CFG_FAULTY_OP_GET, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return c.cfg.Get(key, cas)
+}
+
+func (c *CfgFaulty) Set(key string, val []byte, cas uint64) (
+	uint64, error) {
+	err := c.fault(CFG_FAULTY_OP_SET, key)
+	if err != nil {
+		return 0, err
+	}
+	return c.cfg.Set(key, val, cas)
+}
+
+func (c *CfgFaulty) Del(key string, cas uint64) error {
+	err := c.fault(CFG_FAULTY_OP_DEL, key)
+	if err != nil {
+		return err
+	}
+	return c.cfg.Del(key, cas)
+}
+
+// Subscribe subscribes to the wrapped Cfg, where the events are
+// forwarded to the given channel subject to the injected faults.
+func (c *CfgFaulty) Subscribe(key string, ch chan CfgEvent) error {
+	err := c.fault(CFG_FAULTY_OP_SUBSCRIBE, key)
+	if err != nil {
+		return err
+	}
+
+	ec := make(chan CfgEvent)
+
+	err = c.cfg.Subscribe(key, ec)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for ev := range ec {
+			c.forward(ev, ch)
+		}
+	}()
+
+	return nil
+}
+
+func (c *CfgFaulty) forward(ev CfgEvent, ch chan CfgEvent) {
+	c.m.Lock()
+
+	c.stats.TotEventsReceived++
+
+	var healCh chan struct{}
+	if c.partitioned {
+		c.stats.TotEventsHeld++
+		healCh = c.healCh
+	}
+
+	var delay time.Duration
+
+	if c.faultyKeyLOCKED(ev.Key) {
+		if c.rand.Float64() < c.options.EventDropRate {
+			c.stats.TotEventsDropped++
+			c.m.Unlock()
+			return
+		}
+
+		if c.options.EventDelay > 0 {
+			c.stats.TotEventsDelayed++
+			delay = time.Duration(c.rand.Int63n(int64(c.options.EventDelay)))
+		}
+	}
+
+	c.m.Unlock()
+
+	if healCh != nil {
+		<-healCh
+	}
+
+	if delay > 0 {
+		time.AfterFunc(delay, func() { ch <- ev })
+		return
+	}
+
+	ch <- ev
+}
+
+func (c *CfgFaulty) Refresh() error {
+	err := c.fault(CFG_FAULTY_OP_REFRESH, "")
+	if err != nil {
+		return err
+	}
+	return c.cfg.Refresh()
+}
+
+// ClusterVersion is only exposed by NewCfgFaulty() when the wrapped
+// cfg is a VersionReader.
+func (c *CfgFaulty) ClusterVersion() (uint64, error) {
+	err := c.fault(CFG_FAULTY_OP_CLUSTER_VERSION, "")
+	if err != nil {
+		return 0, err
+	}
+	return c.cfg.(VersionReader).ClusterVersion()
+}
+
+// Txn is only exposed by NewCfgFaulty() when the wrapped cfg supports
+// CfgTxn.
+func (c *CfgFaulty) Txn(ops []CfgTxnOp) ([]uint64, error) {
+	// A txn is faulted if any of its keys are faulted.
+	key := ""
+	if len(ops) > 0 {
+		key = ops[0].Key
+	}
+
+	c.m.Lock()
+	for _, op := range ops {
+		if c.faultyKeyLOCKED(op.Key) {
+			key = op.Key
+			break
+		}
+	}
+	c.m.Unlock()
+
+	err := c.fault(CFG_FAULTY_OP_TXN, key)
+	if err != nil {
+		return nil, err
+	}
+	return c.cfg.(CfgTxn).Txn(ops)
+}
@@ -0,0 +1,362 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCfgFaultyErrors(t *testing.T) {
+	c := NewCfgFaulty(NewCfgMem(), CfgFaultyOptions{})
+	cf := GetCfgFaulty(c)
+	if cf == nil || GetCfgFaulty(NewCfgMem()) != nil {
+		t.Fatalf("expected GetCfgFaulty to work")
+	}
+	if _, ok := c.(CfgTxn); !ok {
+		t.Errorf("expected CfgTxn support to be kept")
+	}
+	if _, ok := NewCfgFaulty(&struct{ Cfg }{NewCfgMem()},
+		CfgFaultyOptions{}).(CfgTxn); ok {
+		t.Errorf("expected no CfgTxn support to be kept")
+	}
+	if _, ok := c.(VersionReader); ok {
+		t.Errorf("expected no VersionReader for a CfgMem")
+	}
+
+	cas, err := c.Set("a", []byte("A"), 0)
+	if err != nil {
+		t.Fatalf("expected no faults by default, err: %v", err)
+	}
+
+	cf.SetOptions(CfgFaultyOptions{
+		ErrorRates: map[string]float64{CFG_FAULTY_OP_GET: 1.0},
+		Keys:       []string{"a"},
+	})
+	_, _, err = c.Get("a", 0)
+	if e, ok := err.(*CfgFaultyError); !ok || e.Op != "get" || e.Key != "a" {
+		t.Errorf("expected a get fault, err: %v", err)
+	}
+	_, _, err = c.Get("b", 0)
+	if err != nil {
+		t.Errorf("expected no fault on an unlisted key, err: %v", err)
+	}
+
+	cf.SetOptions(CfgFaultyOptions{CASMismatchRate: 1.0})
+	_, err = c.Set("a", []byte("AA"), cas)
+	if _, ok := err.(*CfgCASError); !ok {
+		t.Errorf("expected a CAS mismatch, err: %v", err)
+	}
+	_, err = c.(CfgTxn).Txn([]CfgTxnOp{{Op: CFG_TXN_OP_DEL, Key: "a"}})
+	if _, ok := err.(*CfgCASError); !ok {
+		t.Errorf("expected a txn CAS mismatch, err: %v", err)
+	}
+	_, _, err = c.Get("a", 0)
+	if err != nil {
+		t.Errorf("expected no CAS mismatch on get, err: %v", err)
+	}
+
+	cf.SetOptions(CfgFaultyOptions{})
+	v, cas2, err := c.Get("a", 0)
+	if err != nil || string(v) != "A" || cas2 != cas {
+		t.Errorf("expected faulted ops to not be applied, v: %s", v)
+	}
+
+	cf.SetOptions(CfgFaultyOptions{Latency: 20 * time.Millisecond})
+	start := time.Now()
+	c.Get("a", 0)
+	if time.Since(start) < 20*time.Millisecond {
+		t.Errorf("expected latency")
+	}
+
+	s := cf.Stats()
+	if s.TotOps != 8 || s.TotErrors != 1 || s.TotCASMismatches != 2 {
+		t.Errorf("unexpected stats: %#v", s)
+	}
+}
+
+func TestCfgFaultyVersionReader(t *testing.T) {
+	c := NewCfgFaulty(&versionTestCfg{NewCfgMem(), 42},
+		CfgFaultyOptions{ErrorUntil: 1})
+	if GetCfgFaulty(c) == nil {
+		t.Fatalf("expected GetCfgFaulty to work")
+	}
+	if _, ok := c.(CfgTxn); !ok {
+		t.Errorf("expected CfgTxn support to be kept")
+	}
+
+	vr, ok := c.(VersionReader)
+	if !ok {
+		t.Fatalf("expected VersionReader support to be kept")
+	}
+	_, err := vr.ClusterVersion()
+	if e, ok := err.(*CfgFaultyError); !ok || e.Op != "clusterVersion" {
+		t.Errorf("expected a clusterVersion fault, err: %v", err)
+	}
+	v, err := vr.ClusterVersion()
+	if err != nil || v != 42 {
+		t.Errorf("expected the wrapped cluster version, v: %d, err: %v", v, err)
+	}
+
+	c = NewCfgFaulty(&struct {
+		Cfg
+		VersionReader
+	}{NewCfgMem(), &versionTestCfg{version: 1}}, CfgFaultyOptions{})
+	if _, ok := c.(CfgTxn); ok {
+		t.Errorf("expected no CfgTxn support")
+	}
+	if _, ok := c.(VersionReader); !ok || GetCfgFaulty(c) == nil {
+		t.Errorf("expected VersionReader support to be kept")
+	}
+}
+
+func TestCfgFaultyDeterministic(t *testing.T) {
+	c := NewCfgFaulty(NewCfgMem(), CfgFaultyOptions{
+		ErrorEvery:       map[string]int{CFG_FAULTY_OP_GET: 3},
+		CASMismatchEvery: 2,
+	})
+	cf := GetCfgFaulty(c)
+
+	var errs []bool
+	for i := 0; i < 6; i++ {
+		_, _, err := c.Get("a", 0)
+		errs = append(errs, err != nil)
+	}
+	if !reflect.DeepEqual(errs, []bool{false, false, true, false, false, true}) {
+		t.Errorf("expected every 3rd get to fail, errs: %v", errs)
+	}
+
+	errs = nil
+	for i := 0; i < 4; i++ {
+		_, err := c.Set(fmt.Sprintf("k%d", i), []byte("v"), 0)
+		_, isCASError := err.(*CfgCASError)
+		errs = append(errs, isCASError)
+	}
+	if !reflect.DeepEqual(errs, []bool{false, true, false, true}) {
+		t.Errorf("expected every 2nd set to mismatch, errs: %v", errs)
+	}
+
+	cf.SetOptions(CfgFaultyOptions{ErrorAfter: 2})
+	errs = nil
+	for i := 0; i < 4; i++ {
+		_, _, err := c.Get("a", 0)
+		errs = append(errs, err != nil)
+	}
+	if !reflect.DeepEqual(errs, []bool{false, false, true, true}) {
+		t.Errorf("expected ops after the 2nd to fail, errs: %v", errs)
+	}
+
+	cf.SetOptions(CfgFaultyOptions{ErrorUntil: 2})
+	errs = nil
+	for i := 0; i < 4; i++ {
+		_, _, err := c.Get("a", 0)
+		errs = append(errs, err != nil)
+	}
+	if !reflect.DeepEqual(errs, []bool{true, true, false, false}) {
+		t.Errorf("expected the first 2 ops to fail, errs: %v", errs)
+	}
+
+	s := cf.Stats()
+	if s.TotOps != 18 || s.TotErrors != 6 || s.TotCASMismatches != 2 {
+		t.Errorf("unexpected stats: %#v", s)
+	}
+}
+
+func TestCfgFaultyEvents(t *testing.T) {
+	inner := NewCfgMem()
+	c := NewCfgFaulty(inner, CfgFaultyOptions{EventDropRate: 1.0})
+	cf := GetCfgFaulty(c)
+
+	ch := make(chan CfgEvent, 10)
+	err := c.Subscribe("a", ch)
+	if err != nil {
+		t.Fatalf("expected Subscribe to work, err: %v", err)
+	}
+
+	expectEvent := func(expected bool, msg string) {
+		select {
+		case <-ch:
+			if !expected {
+				t.Errorf("expected no event, %s", msg)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if expected {
+				t.Errorf("expected an event, %s", msg)
+			}
+		}
+	}
+
+	cas, _ := inner.Set("a", []byte("A"), 0)
+	expectEvent(false, "when dropped")
+
+	cf.SetOptions(CfgFaultyOptions{EventDelay: 50 * time.Millisecond})
+	cas, _ = inner.Set("a", []byte("B"), cas)
+	expectEvent(true, "when delayed")
+
+	cf.SetOptions(CfgFaultyOptions{})
+	cf.Partition(0)
+	if !cf.Partitioned() {
+		t.Errorf("expected partitioned")
+	}
+	_, _, err = c.Get("a", 0)
+	if e, ok := err.(*CfgFaultyError); !ok || e.Reason != "partition" {
+		t.Errorf("expected a partition fault, err: %v", err)
+	}
+	err = c.Subscribe("b", ch)
+	if err == nil {
+		t.Errorf("expected Subscribe to fail in a partition")
+	}
+
+	inner.Set("a", []byte("C"), cas)
+	expectEvent(false, "when partitioned")
+
+	cf.Heal()
+	expectEvent(true, "when healed")
+
+	cf.Partition(50 * time.Millisecond)
+	_, _, err = c.Get("a", 0)
+	if err == nil {
+		t.Errorf("expected a partition fault")
+	}
+	time.Sleep(100 * time.Millisecond)
+	v, _, err := c.Get("a", 0)
+	if err != nil || string(v) != "C" {
+		t.Errorf("expected a timed partition to heal, err: %v", err)
+	}
+
+	s := cf.Stats()
+	if s.TotEventsReceived != 3 || s.TotEventsDropped != 1 ||
+		s.TotEventsDelayed != 1 || s.TotEventsHeld != 1 ||
+		s.TotPartitioned != 3 {
+		t.Errorf("unexpected stats: %#v", s)
+	}
+}
+
+// TestManagerCfgFaultyChaos runs the planner and janitor against a
+// Cfg with injected faults, and checks that they converge once the
+// faults stop.  The errors, CAS mismatches and partition are injected
+// deterministically, so that they happen regardless of the scheduling
+// of the planner and janitor, while the event faults are random.
+func TestManagerCfgFaultyChaos(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	inner := NewCfgMem()
+	cfg := NewCfgFaulty(inner, CfgFaultyOptions{})
+	cf := GetCfgFaulty(cfg)
+
+	m := NewManager(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+	err := m.Start("wanted")
+	if err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+
+	cf.SetOptions(CfgFaultyOptions{
+		Seed: 1,
+		ErrorEvery: map[string]int{
+			CFG_FAULTY_OP_GET: 5,
+			CFG_FAULTY_OP_SET: 3,
+			CFG_FAULTY_OP_TXN: 3,
+		},
+		CASMismatchEvery: 4,
+		EventDropRate:    0.3,
+		EventDelay:       5 * time.Millisecond,
+		LatencyJitter:    time.Millisecond,
+	})
+
+	sourceParams := `{"numPartitions":4}`
+
+	for i := 0; i < 5; i++ {
+		indexName := fmt.Sprintf("idx%d", i)
+		for tries := 0; ; tries++ {
+			if tries > 100 {
+				t.Fatalf("expected CreateIndex to eventually work")
+			}
+			err = m.CreateIndex("primary", "default", "", sourceParams,
+				"blackhole", indexName, "",
+				PlanParams{MaxPartitionsPerPIndex: 1}, "")
+			if err == nil {
+				break
+			}
+			indexDefs, _, _ := CfgGetIndexDefs(inner)
+			if indexDefs != nil && indexDefs.IndexDefs[indexName] != nil {
+				break // The save worked, but a later step failed.
+			}
+		}
+
+		if i == 2 {
+			cf.Partition(0)
+			err = m.CreateIndex("primary", "default", "", sourceParams,
+				"blackhole", "idxPartitioned", "",
+				PlanParams{MaxPartitionsPerPIndex: 1}, "")
+			if err == nil {
+				t.Errorf("expected CreateIndex to fail in a partition")
+			}
+			cf.Heal()
+		}
+
+		m.PlannerKick("chaos")
+		m.JanitorKick("chaos")
+	}
+
+	err = m.DeleteIndex("idx0")
+	for tries := 0; err != nil && tries < 100; tries++ {
+		err = m.DeleteIndex("idx0")
+	}
+
+	cf.SetOptions(CfgFaultyOptions{})
+	cf.Heal()
+
+	m.PlannerKick("healed")
+	m.JanitorKick("healed")
+
+	indexDefs, _, _ := CfgGetIndexDefs(inner)
+	planPIndexes, _, _ := CfgGetPlanPIndexes(inner)
+	_, pindexes := m.CurrentMaps()
+
+	if len(indexDefs.IndexDefs) != 4 || indexDefs.IndexDefs["idx0"] != nil {
+		t.Errorf("expected 4 indexes, got: %#v", indexDefs.IndexDefs)
+	}
+
+	// A plan pindex per source partition.
+	if len(planPIndexes.PlanPIndexes) != 16 {
+		t.Errorf("expected 16 plan pindexes, got: %d",
+			len(planPIndexes.PlanPIndexes))
+	}
+	for name, planPIndex := range planPIndexes.PlanPIndexes {
+		if indexDefs.IndexDefs[planPIndex.IndexName] == nil ||
+			indexDefs.IndexDefs[planPIndex.IndexName].UUID !=
+				planPIndex.IndexUUID {
+			t.Errorf("expected plan of a current index, name: %s", name)
+		}
+		if len(planPIndex.Nodes) != 1 {
+			t.Errorf("expected an assigned plan, name: %s", name)
+		}
+		if pindexes[name] == nil {
+			t.Errorf("expected a pindex for the plan, name: %s", name)
+		}
+	}
+	if len(pindexes) != len(planPIndexes.PlanPIndexes) {
+		t.Errorf("expected pindexes to match the plan, got: %d",
+			len(pindexes))
+	}
+
+	s := cf.Stats()
+	if s.TotErrors == 0 || s.TotCASMismatches == 0 || s.TotPartitioned == 0 {
+		t.Errorf("expected faults to be injected, stats: %#v", s)
+	}
+}
@@ -0,0 +1,572 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/couchbase/clog"
+)
+
+// CFG_HISTORY_KEY_PREFIX is the prefix of the keys where a CfgHistory
+// keeps the revisions of a key in the wrapped Cfg.  The revision
+// metadata of key "foo" is stored under "cfgHistory-foo", and the
+// value of each revision is stored under "cfgHistory-foo/<id>", so
+// that the metadata stays small even for large values.
+const CFG_HISTORY_KEY_PREFIX = "cfgHistory-"
+
+// CFG_HISTORY_MAX_REVISIONS is the default number of revisions kept
+// per key.
+const CFG_HISTORY_MAX_REVISIONS = 10
+
+// CfgHistoryMaxBytes caps the total stored size of the revision
+// values kept per key, as values like the planPIndexes can be large,
+// where the latest revision is always kept.
+var CfgHistoryMaxBytes = 4 * 1024 * 1024
+
+// CfgHistoryMaxValueBytes caps the stored size of a single revision's
+// value, where a revision with a larger value only has its metadata
+// kept, and can't be diffed or restored.
+var CfgHistoryMaxValueBytes = 1024 * 1024
+
+// CFG_HISTORY_COMPRESS_MIN is the size from which revision values are
+// stored gzip compressed, which shrinks JSON values like the
+// planPIndexes several times over.
+const CFG_HISTORY_COMPRESS_MIN = 1024
+
+// CfgHistoryKeys are the well-known keys whose history is reported
+// by default, such as by the REST API.
+var CfgHistoryKeys = []string{
+	INDEX_DEFS_KEY,
+	CfgNodeDefsKey(NODE_DEFS_KNOWN),
+	CfgNodeDefsKey(NODE_DEFS_WANTED),
+	PLAN_PINDEXES_KEY,
+	VERSION_KEY,
+}
+
+// CfgHistory is a Cfg wrapper that records the last N revisions of
+// every key that's changed through it, along with the time and the
+// node UUID of each change.  The revisions are stored in the wrapped
+// Cfg, so they are shared by the nodes of a cluster and survive
+// restarts.  As that adds to the writes of the wrapped Cfg, large
+// values are stored compressed, and are capped per revision and per
+// key.  Recording a revision happens after the change itself
+// succeeds, and a failure to record is logged but not returned.
+type CfgHistory struct {
+	cfg          Cfg
+	nodeUUID     string
+	maxRevisions int
+}
+
+// A CfgHistoryRevision describes a single change to a key.
+type CfgHistoryRevision struct {
+	Rev      uint64    `json:"rev"`
+	ID       string    `json:"id,omitempty"` // Locates the value.
+	Op       string    `json:"op"`           // "set" or "del".
+	CAS      uint64    `json:"cas,omitempty"`
+	Time     time.Time `json:"time"`
+	NodeUUID string    `json:"nodeUUID,omitempty"`
+	Size     int       `json:"size"`
+
+	// The stored size and encoding of the value, where a set without
+	// an ID didn't have its value kept.
+	Stored int    `json:"stored,omitempty"`
+	Enc    string `json:"enc,omitempty"` // "" or "gzip".
+}
+
+// storedSize returns the size of the revision's stored value.
+func (r *CfgHistoryRevision) storedSize() int {
+	if r.ID == "" {
+		return 0
+	}
+	if r.Stored > 0 {
+		return r.Stored
+	}
+	return r.Size
+}
+
+// CfgHistoryRevisions is the revision metadata of a key.
+type CfgHistoryRevisions struct {
+	Key       string                `json:"key"`
+	RevNext   uint64                `json:"revNext"`
+	Revisions []*CfgHistoryRevision `json:"revisions"` // Oldest first.
+}
+
+// A CfgHistoryDiff is a single difference between two JSON values,
+// where the Path is a "/" separated path to the differing field, and
+// the Op is "add", "remove" or "change".
+type CfgHistoryDiff struct {
+	Path string      `json:"path"`
+	Op   string      `json:"op"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+// NewCfgHistory returns a CfgHistory that wraps the given cfg, where
+// nodeUUID is recorded as the originator of the changes, and
+// maxRevisions <= 0 means CFG_HISTORY_MAX_REVISIONS.  The returned Cfg
+// also implements CfgTxn and VersionReader when the wrapped cfg does.
+// Use GetCfgHistory() to retrieve the CfgHistory from the returned Cfg.
+func NewCfgHistory(cfg Cfg, nodeUUID string, maxRevisions int) Cfg {
+	if maxRevisions <= 0 {
+		maxRevisions = CFG_HISTORY_MAX_REVISIONS
+	}
+
+	c := &CfgHistory{
+		cfg:          cfg,
+		nodeUUID:     nodeUUID,
+		maxRevisions: maxRevisions,
+	}
+
+	return wrapCfg(c, cfg)
+}
+
+// GetCfgHistory returns the CfgHistory of a Cfg that was returned by
+// NewCfgHistory(), or nil.
+func GetCfgHistory(cfg Cfg) *CfgHistory {
+	c, _ := unwrapCfgWrapper(cfg).(*CfgHistory)
+	return c
+}
+
+// Unwrap returns the wrapped Cfg.
+func (c *CfgHistory) Unwrap() Cfg {
+	return c.cfg
+}
+
+func (c *CfgHistory) Get(key string, cas uint64) ([]byte, uint64, error) {
+	return c.cfg.Get(key, cas)
+}
+
+func (c *CfgHistory) Set(key string, val []byte, cas uint64) (
+	uint64, error) {
+	casResult, err := c.cfg.Set(key, val, cas)
+	if err != nil {
+		return casResult, err
+	}
+
+	c.record(key, CFG_TXN_OP_SET, val, casResult)
+
+	return casResult, nil
+}
+
+func (c *CfgHistory) Del(key string, cas uint64) error {
+	err := c.cfg.Del(key, cas)
+	if err != nil {
+		return err
+	}
+
+	c.record(key, CFG_TXN_OP_DEL, nil, 0)
+
+	return nil
+}
+
+func (c *CfgHistory) Subscribe(key string, ch chan CfgEvent) error {
+	return c.cfg.Subscribe(key, ch)
+}
+
+func (c *CfgHistory) Refresh() error {
+	return c.cfg.Refresh()
+}
+
+// ClusterVersion is only exposed by NewCfgHistory() when the wrapped
+// cfg is a VersionReader.
+func (c *CfgHistory) ClusterVersion() (uint64, error) {
+	return c.cfg.(VersionReader).ClusterVersion()
+}
+
+// Txn is only exposed by NewCfgHistory() when the wrapped cfg supports
+// CfgTxn.
+func (c *CfgHistory) Txn(ops []CfgTxnOp) ([]uint64, error) {
+	casSuccess, err := c.cfg.(CfgTxn).Txn(ops)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, op := range ops {
+		if op.Op == CFG_TXN_OP_SET || op.Op == CFG_TXN_OP_DEL {
+			c.record(op.Key, op.Op, op.Val, casSuccess[i])
+		}
+	}
+
+	return casSuccess, nil
+}
+
+// ----------------------------------------------------------------
+
+func isCfgHistoryKey(key string) bool {
+	return strings.HasPrefix(key, CFG_HISTORY_KEY_PREFIX)
+}
+
+func cfgHistoryValKey(key, id string) string {
+	return CFG_HISTORY_KEY_PREFIX + key + "/" + id
+}
+
+// record adds a revision for a change to a key, dropping the oldest
+// revisions beyond the maxRevisions or the CfgHistoryMaxBytes.
+func (c *CfgHistory) record(key, op string, val []byte, cas uint64) {
+	if isCfgHistoryKey(key) {
+		return
+	}
+
+	rev := &CfgHistoryRevision{
+		Op:       op,
+		CAS:      cas,
+		Time:     time.Now(),
+		NodeUUID: c.nodeUUID,
+		Size:     len(val),
+	}
+
+	// The value is written first, under a unique id, so that the
+	// metadata never refers to a missing value.
+	if op == CFG_TXN_OP_SET {
+		stored, enc := cfgHistoryEncodeVal(val)
+		if len(stored) <= CfgHistoryMaxValueBytes {
+			rev.ID = NewUUID()
+			rev.Stored = len(stored)
+			rev.Enc = enc
+
+			_, err := c.cfg.Set(cfgHistoryValKey(key, rev.ID), stored,
+				CFG_CAS_FORCE)
+			if err != nil {
+				log.Warnf("cfg_history: record, could not save value,"+
+					" key: %s, err: %v", key, err)
+				return
+			}
+		}
+	}
+
+	var dropped []*CfgHistoryRevision
+
+	for tries := 0; tries < 10; tries++ {
+		revs, revsCAS, err := c.getRevisions(key)
+		if err != nil {
+			break
+		}
+
+		rev.Rev = revs.RevNext
+		revs.RevNext++
+		revs.Revisions = append(revs.Revisions, rev)
+
+		size := 0
+		for _, r := range revs.Revisions {
+			size += r.storedSize()
+		}
+
+		n := 0
+		for n < len(revs.Revisions)-1 &&
+			(len(revs.Revisions)-n > c.maxRevisions ||
+				size > CfgHistoryMaxBytes) {
+			size -= revs.Revisions[n].storedSize()
+			n++
+		}
+
+		dropped = revs.Revisions[:n]
+		revs.Revisions = revs.Revisions[n:]
+
+		buf, err := json.Marshal(revs)
+		if err != nil {
+			break
+		}
+
+		_, err = c.cfg.Set(CFG_HISTORY_KEY_PREFIX+key, buf, revsCAS)
+		if err == nil {
+			for _, d := range dropped {
+				if d.ID != "" {
+					c.cfg.Del(cfgHistoryValKey(key, d.ID), 0)
+				}
+			}
+			return
+		}
+		if _, ok := err.(*CfgCASError); !ok {
+			log.Warnf("cfg_history: record, could not save revisions,"+
+				" key: %s, err: %v", key, err)
+			break
+		}
+	}
+
+	if rev.ID != "" {
+		c.cfg.Del(cfgHistoryValKey(key, rev.ID), 0)
+	}
+}
+
+func (c *CfgHistory) getRevisions(key string) (
+	*CfgHistoryRevisions, uint64, error) {
+	buf, cas, err := c.cfg.Get(CFG_HISTORY_KEY_PREFIX+key, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	revs := &CfgHistoryRevisions{Key: key, RevNext: 1}
+	if len(buf) > 0 {
+		err = json.Unmarshal(buf, revs)
+		if err != nil {
+			return nil, 0, fmt.Errorf("cfg_history: could not parse"+
+				" revisions, key: %s, err: %v", key, err)
+		}
+	}
+
+	return revs, cas, nil
+}
+
+// ----------------------------------------------------------------
+
+// Revisions returns the revision metadata of a key, oldest first.
+func (c *CfgHistory) Revisions(key string) ([]*CfgHistoryRevision, error) {
+	revs, _, err := c.getRevisions(key)
+	if err != nil {
+		return nil, err
+	}
+	return revs.Revisions, nil
+}
+
+// Revision returns a revision of a key and its value, which is nil
+// for a deletion.
+func (c *CfgHistory) Revision(key string, rev uint64) (
+	*CfgHistoryRevision, []byte, error) {
+	revs, _, err := c.getRevisions(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, r := range revs.Revisions {
+		if r.Rev == rev {
+			if r.Op != CFG_TXN_OP_SET {
+				return r, nil, nil
+			}
+			if r.ID == "" {
+				return nil, nil, fmt.Errorf("cfg_history: value not kept,"+
+					" key: %s, rev: %d, size: %d", key, rev, r.Size)
+			}
+
+			val, _, err := c.cfg.Get(cfgHistoryValKey(key, r.ID), 0)
+			if err != nil {
+				return nil, nil, err
+			}
+			if val == nil {
+				return nil, nil, fmt.Errorf("cfg_history: missing value,"+
+					" key: %s, rev: %d", key, rev)
+			}
+
+			val, err = cfgHistoryDecodeVal(val, r.Enc)
+			if err != nil {
+				return nil, nil, fmt.Errorf("cfg_history: could not decode"+
+					" value, key: %s, rev: %d, err: %v", key, rev, err)
+			}
+
+			return r, val, nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("cfg_history: no such revision,"+
+		" key: %s, rev: %d", key, rev)
+}
+
+// Diff returns the differences between two revisions of a key, where
+// a revTo of 0 means the key's current value.
+func (c *CfgHistory) Diff(key string, revFrom, revTo uint64) (
+	[]*CfgHistoryDiff, error) {
+	_, valFrom, err := c.Revision(key, revFrom)
+	if err != nil {
+		return nil, err
+	}
+
+	var valTo []byte
+	if revTo == 0 {
+		valTo, _, err = c.cfg.Get(key, 0)
+	} else {
+		_, valTo, err = c.Revision(key, revTo)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return CfgHistoryDiffVals(valFrom, valTo), nil
+}
+
+// Restore sets a key back to the value of an earlier revision, where
+// the cas must match the key's current CAS (0 if the key does not
+// currently exist).  The restored indexDefs or planPIndexes are given
+// a new UUID, so that planners and janitors notice the change.
+//
+// The credentials of restored indexDefs or planPIndexes are taken
+// from the current value, as with SecureCfgVal(), rather than from
+// the revision, so a revision whose index definitions or plans with
+// credentials have since been removed can't be restored.  The options
+// are the manager options that configure the SecretProvider.
+func (c *CfgHistory) Restore(key string, rev uint64, cas uint64,
+	options map[string]string) (uint64, error) {
+	r, val, err := c.Revision(key, rev)
+	if err != nil {
+		return 0, err
+	}
+	if r.Op != CFG_TXN_OP_SET {
+		return 0, fmt.Errorf("cfg_history: cannot restore a deletion,"+
+			" key: %s, rev: %d", key, rev)
+	}
+
+	switch key {
+	case INDEX_DEFS_KEY:
+		indexDefs := &IndexDefs{}
+		err = json.Unmarshal(val, indexDefs)
+		if err != nil {
+			return 0, err
+		}
+		indexDefs.UUID = NewUUID()
+		val, err = json.Marshal(indexDefs)
+
+	case PLAN_PINDEXES_KEY:
+		planPIndexes := &PlanPIndexes{}
+		err = json.Unmarshal(val, planPIndexes)
+		if err != nil {
+			return 0, err
+		}
+		planPIndexes.UUID = NewUUID()
+		val, err = json.Marshal(planPIndexes)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	val, err = SecureCfgVal(c.cfg, key, RedactCfgVal(key, val), options)
+	if err != nil {
+		return 0, fmt.Errorf("cfg_history: restore, credentials of"+
+			" removed entries, key: %s, rev: %d, err: %v", key, rev, err)
+	}
+
+	log.Printf("cfg_history: restore, key: %s, rev: %d, cas: %d",
+		key, rev, cas)
+
+	return c.Set(key, val, cas)
+}
+
+// cfgHistoryEncodeVal returns a revision value as it's stored, along
+// with its encoding.
+func cfgHistoryEncodeVal(val []byte) ([]byte, string) {
+	if len(val) < CFG_HISTORY_COMPRESS_MIN {
+		return val, ""
+	}
+
+	var buf bytes.Buffer
+
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(val)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil || buf.Len() >= len(val) {
+		return val, ""
+	}
+
+	return buf.Bytes(), "gzip"
+}
+
+func cfgHistoryDecodeVal(stored []byte, enc string) ([]byte, error) {
+	switch enc {
+	case "":
+		return stored, nil
+	case "gzip":
+		r, err := gzip.NewReader(bytes.NewReader(stored))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	}
+	return nil, fmt.Errorf("cfg_history: unknown encoding: %q", enc)
+}
+
+// ----------------------------------------------------------------
+
+// CfgHistoryDiffVals returns the differences between two values,
+// comparing them field by field when they are both JSON.
+func CfgHistoryDiffVals(a, b []byte) []*CfgHistoryDiff {
+	var av, bv interface{}
+	if (a == nil || json.Unmarshal(a, &av) == nil) &&
+		(b == nil || json.Unmarshal(b, &bv) == nil) {
+		return cfgHistoryDiffJSON("", av, bv, nil)
+	}
+
+	if bytes.Equal(a, b) {
+		return nil
+	}
+	return []*CfgHistoryDiff{
+		{Path: "", Op: "change", Old: string(a), New: string(b)},
+	}
+}
+
+func cfgHistoryDiffJSON(path string, a, b interface{},
+	rv []*CfgHistoryDiff) []*CfgHistoryDiff {
+	if a == nil && b == nil {
+		return rv
+	}
+	if a == nil {
+		return append(rv, &CfgHistoryDiff{Path: path, Op: "add", New: b})
+	}
+	if b == nil {
+		return append(rv, &CfgHistoryDiff{Path: path, Op: "remove", Old: a})
+	}
+
+	switch am := a.(type) {
+	case map[string]interface{}:
+		bm, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+
+		keys := make([]string, 0, len(am)+len(bm))
+		for k := range am {
+			keys = append(keys, k)
+		}
+		for k := range bm {
+			if _, exists := am[k]; !exists {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			rv = cfgHistoryDiffJSON(path+"/"+k, am[k], bm[k], rv)
+		}
+		return rv
+
+	case []interface{}:
+		ba, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+
+		for i := 0; i < len(am) || i < len(ba); i++ {
+			var ai, bi interface{}
+			if i < len(am) {
+				ai = am[i]
+			}
+			if i < len(ba) {
+				bi = ba[i]
+			}
+			rv = cfgHistoryDiffJSON(path+"/"+strconv.Itoa(i), ai, bi, rv)
+		}
+		return rv
+	}
+
+	if reflect.DeepEqual(a, b) {
+		return rv
+	}
+	return append(rv, &CfgHistoryDiff{Path: path, Op: "change", Old: a, New: b})
+}
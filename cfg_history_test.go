@@ -0,0 +1,332 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestCfgHistory(t *testing.T) {
+	m := NewCfgMem()
+	c := NewCfgHistory(m, "node0", 3)
+
+	h := GetCfgHistory(c)
+	if h == nil {
+		t.Fatalf("expected GetCfgHistory to work")
+	}
+	if GetCfgHistory(m) != nil {
+		t.Errorf("expected GetCfgHistory on plain cfg to be nil")
+	}
+
+	var cas uint64
+	var err error
+	for _, v := range []string{"A", "B", "C", "D"} {
+		cas, err = c.Set("a", []byte(v), cas)
+		if err != nil {
+			t.Fatalf("expected Set to work, err: %v", err)
+		}
+	}
+
+	_, err = c.Set("a", []byte("X"), cas+100)
+	if _, ok := err.(*CfgCASError); !ok {
+		t.Errorf("expected CfgCASError, got: %v", err)
+	}
+
+	revs, err := h.Revisions("a")
+	if err != nil || len(revs) != 3 {
+		t.Fatalf("expected 3 revisions, revs: %#v, err: %v", revs, err)
+	}
+	if revs[0].Rev != 2 || revs[2].Rev != 4 ||
+		revs[2].NodeUUID != "node0" || revs[2].CAS != cas ||
+		revs[2].Op != CFG_TXN_OP_SET {
+		t.Errorf("expected revisions 2..4, revs: %#v", revs)
+	}
+
+	_, val, err := h.Revision("a", 2)
+	if err != nil || string(val) != "B" {
+		t.Errorf("expected revision 2 to be B, val: %s, err: %v", val, err)
+	}
+	_, _, err = h.Revision("a", 1)
+	if err == nil {
+		t.Errorf("expected trimmed revision to be gone")
+	}
+
+	// The values of the trimmed revisions are deleted.
+	n := 0
+	for k := range m.Entries {
+		if strings.HasPrefix(k, CFG_HISTORY_KEY_PREFIX+"a/") {
+			n++
+		}
+	}
+	if n != 3 {
+		t.Errorf("expected 3 saved values, got: %d", n)
+	}
+
+	err = c.Del("a", cas)
+	if err != nil {
+		t.Fatalf("expected Del to work, err: %v", err)
+	}
+	revs, _ = h.Revisions("a")
+	if revs[2].Op != CFG_TXN_OP_DEL || revs[2].Rev != 5 {
+		t.Errorf("expected a del revision, revs: %#v", revs)
+	}
+
+	_, err = h.Restore("a", 5, 0, nil)
+	if err == nil {
+		t.Errorf("expected restore of a del to fail")
+	}
+	_, err = h.Restore("a", 3, 0, nil)
+	if err != nil {
+		t.Errorf("expected restore to work, err: %v", err)
+	}
+	v, _, _ := c.Get("a", 0)
+	if string(v) != "C" {
+		t.Errorf("expected restored value, got: %s", v)
+	}
+}
+
+func TestCfgHistoryTxn(t *testing.T) {
+	c := NewCfgHistory(NewCfgMem(), "node0", 0)
+
+	cfgTxn, ok := c.(testCfgTxnCfg)
+	if !ok {
+		t.Fatalf("expected CfgHistory of a CfgMem to be a CfgTxn")
+	}
+	testCfgTxn(t, cfgTxn)
+
+	revs, err := GetCfgHistory(c).Revisions("b")
+	if err != nil || len(revs) == 0 {
+		t.Errorf("expected txn to be recorded, revs: %#v, err: %v",
+			revs, err)
+	}
+}
+
+func TestCfgHistoryRestoreIndexDefs(t *testing.T) {
+	c := NewCfgHistory(NewCfgMem(), "node0", 0)
+	h := GetCfgHistory(c)
+
+	indexDefs := NewIndexDefs(CfgAppVersion)
+	indexDefs.IndexDefs["foo"] = &IndexDef{Name: "foo", UUID: "u0"}
+	cas, err := CfgSetIndexDefs(c, indexDefs, 0)
+	if err != nil {
+		t.Fatalf("expected CfgSetIndexDefs to work, err: %v", err)
+	}
+
+	delete(indexDefs.IndexDefs, "foo")
+	indexDefs.UUID = NewUUID()
+	cas, err = CfgSetIndexDefs(c, indexDefs, cas)
+	if err != nil {
+		t.Fatalf("expected CfgSetIndexDefs to work, err: %v", err)
+	}
+
+	diffs, err := h.Diff(INDEX_DEFS_KEY, 1, 0)
+	if err != nil {
+		t.Fatalf("expected Diff to work, err: %v", err)
+	}
+	var sawRemove bool
+	for _, d := range diffs {
+		if d.Path == "/indexDefs/foo" && d.Op == "remove" {
+			sawRemove = true
+		}
+	}
+	if !sawRemove {
+		t.Errorf("expected diff to remove foo, diffs: %#v", diffs)
+	}
+
+	_, err = h.Restore(INDEX_DEFS_KEY, 1, cas+100, nil)
+	if _, ok := err.(*CfgCASError); !ok {
+		t.Errorf("expected CfgCASError on wrong cas, got: %v", err)
+	}
+	_, err = h.Restore(INDEX_DEFS_KEY, 1, cas, nil)
+	if err != nil {
+		t.Fatalf("expected Restore to work, err: %v", err)
+	}
+
+	restored, _, err := CfgGetIndexDefs(c)
+	if err != nil || restored.IndexDefs["foo"] == nil ||
+		restored.UUID == indexDefs.UUID {
+		t.Errorf("expected foo to be restored with a new UUID,"+
+			" restored: %#v, err: %v", restored, err)
+	}
+}
+
+func TestCfgHistoryDiffVals(t *testing.T) {
+	tests := []struct {
+		a, b string
+		exp  string
+	}{
+		{`{"x":1}`, `{"x":1}`, `null`},
+		{`{"x":1}`, `{"x":2}`,
+			`[{"path":"/x","op":"change","old":1,"new":2}]`},
+		{`{"x":[1]}`, `{"x":[1,2],"y":true}`,
+			`[{"path":"/x/1","op":"add","new":2},` +
+				`{"path":"/y","op":"add","new":true}]`},
+		{`not json`, `also not`,
+			`[{"path":"","op":"change","old":"not json","new":"also not"}]`},
+	}
+
+	for i, test := range tests {
+		diffs := CfgHistoryDiffVals([]byte(test.a), []byte(test.b))
+		buf, _ := json.Marshal(diffs)
+		if string(buf) != test.exp {
+			t.Errorf("i: %d, expected: %s, got: %s", i, test.exp, buf)
+		}
+	}
+}
+
+func TestCfgHistoryVersionReader(t *testing.T) {
+	if _, ok := NewCfgHistory(NewCfgMem(), "node0", 0).(VersionReader); ok {
+		t.Errorf("expected no VersionReader for a CfgMem")
+	}
+
+	c := NewCfgHistory(&versionTestCfg{NewCfgMem(), 42}, "node0", 0)
+	if GetCfgHistory(c) == nil {
+		t.Errorf("expected GetCfgHistory to work")
+	}
+	if _, ok := c.(CfgTxn); !ok {
+		t.Errorf("expected a CfgTxn")
+	}
+
+	vr, ok := c.(VersionReader)
+	if !ok {
+		t.Fatalf("expected a VersionReader")
+	}
+	if v, err := vr.ClusterVersion(); err != nil || v != 42 {
+		t.Errorf("expected the wrapped ClusterVersion, v: %d, err: %v", v, err)
+	}
+}
+
+func TestCfgHistoryMaxBytes(t *testing.T) {
+	maxBytes := CfgHistoryMaxBytes
+	defer func() { CfgHistoryMaxBytes = maxBytes }()
+	CfgHistoryMaxBytes = 25
+
+	c := NewCfgHistory(NewCfgMem(), "node0", 0)
+	h := GetCfgHistory(c)
+
+	for _, v := range []string{"0123456789", "0123456789", "0123456789"} {
+		c.Set("a", []byte(v), CFG_CAS_FORCE)
+	}
+
+	revs, err := h.Revisions("a")
+	if err != nil || len(revs) != 2 || revs[0].Rev != 2 {
+		t.Errorf("expected revisions capped by size, revs: %#v, err: %v",
+			revs, err)
+	}
+
+	// The latest revision is kept even when it's too large.
+	c.Set("a", []byte(strings.Repeat("x", 100)), CFG_CAS_FORCE)
+
+	revs, _ = h.Revisions("a")
+	if len(revs) != 1 || revs[0].Rev != 4 {
+		t.Errorf("expected only the latest revision, revs: %#v", revs)
+	}
+	if _, _, err = h.Revision("a", 3); err == nil {
+		t.Errorf("expected dropped revisions to be gone")
+	}
+}
+
+func TestCfgHistoryCompressed(t *testing.T) {
+	maxValueBytes := CfgHistoryMaxValueBytes
+	defer func() { CfgHistoryMaxValueBytes = maxValueBytes }()
+	CfgHistoryMaxValueBytes = 1000
+
+	m := NewCfgMem()
+	c := NewCfgHistory(m, "node0", 0)
+	h := GetCfgHistory(c)
+
+	big := strings.Repeat(`{"x":"0123456789"}`, 1000)
+	c.Set("a", []byte(big), CFG_CAS_FORCE)
+
+	revs, _ := h.Revisions("a")
+	if len(revs) != 1 || revs[0].Enc != "gzip" ||
+		revs[0].Stored >= revs[0].Size || revs[0].Size != len(big) {
+		t.Fatalf("expected a compressed revision, revs: %#v", revs)
+	}
+	stored, _, _ := m.Get(cfgHistoryValKey("a", revs[0].ID), 0)
+	if len(stored) != revs[0].Stored {
+		t.Errorf("expected the compressed value, len: %d", len(stored))
+	}
+	_, val, err := h.Revision("a", revs[0].Rev)
+	if err != nil || string(val) != big {
+		t.Errorf("expected the decompressed value, err: %v", err)
+	}
+
+	// A value that's too large only has its metadata kept.
+	random := make([]byte, 2000)
+	rand.New(rand.NewSource(1)).Read(random)
+	c.Set("a", random, CFG_CAS_FORCE)
+
+	revs, _ = h.Revisions("a")
+	if len(revs) != 2 || revs[1].ID != "" || revs[1].Size != 2000 {
+		t.Fatalf("expected a revision without a value, revs: %#v", revs)
+	}
+	if _, _, err = h.Revision("a", revs[1].Rev); err == nil {
+		t.Errorf("expected a revision without a value to fail")
+	}
+	if _, err = h.Restore("a", revs[1].Rev, 0, nil); err == nil {
+		t.Errorf("expected a restore without a value to fail")
+	}
+}
+
+func TestCfgHistoryRestoreCredentials(t *testing.T) {
+	c := NewCfgHistory(NewCfgMem(), "node0", 0)
+	h := GetCfgHistory(c)
+
+	options := map[string]string{"secretProvider": SECRET_PROVIDER_NONE}
+
+	indexDefs := NewIndexDefs(CfgAppVersion)
+	indexDefs.IndexDefs["foo"] = &IndexDef{Name: "foo", UUID: "u0",
+		SourceParams: `{"authUser":"foo","authPassword":"old"}`}
+	indexDefs.IndexDefs["bar"] = &IndexDef{Name: "bar", UUID: "u1",
+		SourceParams: `{"authUser":"bar","authPassword":"bar"}`}
+	cas, err := CfgSetIndexDefs(c, indexDefs, 0)
+	if err != nil {
+		t.Fatalf("expected CfgSetIndexDefs to work, err: %v", err)
+	}
+
+	indexDefs.IndexDefs["foo"].SourceParams =
+		`{"authUser":"foo","authPassword":"new"}`
+	indexDefs.UUID = NewUUID()
+	cas, err = CfgSetIndexDefs(c, indexDefs, cas)
+	if err != nil {
+		t.Fatalf("expected CfgSetIndexDefs to work, err: %v", err)
+	}
+
+	// The credentials of a current index are kept.
+	cas, err = h.Restore(INDEX_DEFS_KEY, 1, cas, options)
+	if err != nil {
+		t.Fatalf("expected Restore to work, err: %v", err)
+	}
+	restored, _, _ := CfgGetIndexDefs(c)
+	if restored.IndexDefs["foo"] == nil ||
+		!strings.Contains(restored.IndexDefs["foo"].SourceParams, "new") {
+		t.Errorf("expected the current credentials, restored: %#v",
+			restored.IndexDefs["foo"])
+	}
+
+	// The credentials of a removed index aren't restored.
+	delete(restored.IndexDefs, "bar")
+	restored.UUID = NewUUID()
+	cas, err = CfgSetIndexDefs(c, restored, cas)
+	if err != nil {
+		t.Fatalf("expected CfgSetIndexDefs to work, err: %v", err)
+	}
+
+	_, err = h.Restore(INDEX_DEFS_KEY, 1, cas, options)
+	if err == nil {
+		t.Errorf("expected the restore of removed credentials to fail")
+	}
+}
@@ -27,7 +27,15 @@ type CfgMem struct {
 	m             sync.Mutex
 	CASNext       uint64
 	Entries       map[string]*CfgMemEntry
-	subscriptions map[string][]chan<- CfgEvent // Keyed by key.
+	subscriptions map[string][]*cfgMemSubscription // Keyed by key.
+}
+
+// A cfgMemSubscription delivers the events of a key to a channel in
+// the order they were fired, without blocking the firing goroutine.
+type cfgMemSubscription struct {
+	ch      chan<- CfgEvent
+	pending []CfgEvent // Protected by the CfgMem's lock.
+	sending bool       // True while a goroutine delivers the pending.
 }
 
 // CfgMemEntry is a CAS-Val pairing tracked by CfgMem.
@@ -42,7 +50,7 @@ func NewCfgMem() *CfgMem {
 	return &CfgMem{
 		CASNext:       1,
 		Entries:       make(map[string]*CfgMemEntry),
-		subscriptions: make(map[string][]chan<- CfgEvent),
+		subscriptions: make(map[string][]*cfgMemSubscription),
 	}
 }
 
@@ -98,17 +106,9 @@ func (c *CfgMem) Set(key string, val []byte, cas uint64) (
 	defer c.m.Unlock()
 
 	prevEntry, exists := c.Entries[key]
-	switch {
-	case cas == 0:
-		if exists {
-			return 0, fmt.Errorf("cfg_mem: entry already exists, key: %s", key)
-		}
-	case cas == CFG_CAS_FORCE:
-		break
-	default:
-		if !exists || cas != prevEntry.CAS {
-			return 0, &CfgCASError{}
-		}
+	err := cfgMemCheckSetCAS(key, prevEntry, exists, cas)
+	if err != nil {
+		return 0, err
 	}
 
 	nextEntry := &CfgMemEntry{
@@ -118,10 +118,27 @@ func (c *CfgMem) Set(key string, val []byte, cas uint64) (
 	copy(nextEntry.Val, val)
 	c.Entries[key] = nextEntry
 	c.CASNext += 1
-	c.fireEvent(key, nextEntry.CAS, nil)
+	c.fireEvent(key, nextEntry.CAS, nextEntry.Val, nil)
 	return nextEntry.CAS, nil
 }
 
+func cfgMemCheckSetCAS(key string, prevEntry *CfgMemEntry, exists bool,
+	cas uint64) error {
+	switch {
+	case cas == 0:
+		if exists {
+			return fmt.Errorf("cfg_mem: entry already exists, key: %s", key)
+		}
+	case cas == CFG_CAS_FORCE:
+		break
+	default:
+		if !exists || cas != prevEntry.CAS {
+			return &CfgCASError{}
+		}
+	}
+	return nil
+}
+
 func (c *CfgMem) Del(key string, cas uint64) error {
 	c.m.Lock()
 	defer c.m.Unlock()
@@ -133,35 +150,129 @@ func (c *CfgMem) Del(key string, cas uint64) error {
 		}
 	}
 	delete(c.Entries, key)
-	c.fireEvent(key, 0, nil)
+	c.fireEvent(key, 0, nil, nil)
 	return nil
 }
 
-func (c *CfgMem) Subscribe(key string, ch chan CfgEvent) error {
+// Txn implements the CfgTxn interface.  The ops are first applied to
+// a copy of the entries, which replaces the entries only if all the
+// ops succeed.
+func (c *CfgMem) Txn(ops []CfgTxnOp) ([]uint64, error) {
 	c.m.Lock()
 	defer c.m.Unlock()
 
-	a, exists := c.subscriptions[key]
-	if !exists || a == nil {
-		a = make([]chan<- CfgEvent, 0)
+	entries := make(map[string]*CfgMemEntry, len(c.Entries))
+	for key, entry := range c.Entries {
+		entries[key] = entry
+	}
+
+	casNext := c.CASNext
+	casSuccess := make([]uint64, len(ops))
+
+	for i, op := range ops {
+		prevEntry, exists := entries[op.Key]
+
+		switch op.Op {
+		case CFG_TXN_OP_SET:
+			err := cfgMemCheckSetCAS(op.Key, prevEntry, exists, op.CAS)
+			if err != nil {
+				return nil, err
+			}
+
+			nextEntry := &CfgMemEntry{
+				CAS: casNext,
+				Val: make([]byte, len(op.Val)),
+			}
+			copy(nextEntry.Val, op.Val)
+			entries[op.Key] = nextEntry
+			casNext += 1
+			casSuccess[i] = nextEntry.CAS
+
+		case CFG_TXN_OP_DEL:
+			if op.CAS != 0 && (!exists || op.CAS != prevEntry.CAS) {
+				return nil, &CfgCASError{}
+			}
+			delete(entries, op.Key)
+
+		case CFG_TXN_OP_CHECK:
+			if op.CAS == 0 {
+				if exists {
+					return nil, &CfgCASError{}
+				}
+			} else if op.CAS != CFG_CAS_FORCE &&
+				(!exists || op.CAS != prevEntry.CAS) {
+				return nil, &CfgCASError{}
+			}
+
+		default:
+			return nil, fmt.Errorf("cfg_mem: unknown txn op: %q, key: %s",
+				op.Op, op.Key)
+		}
+	}
+
+	c.Entries = entries
+	c.CASNext = casNext
+
+	fired := map[string]bool{}
+	for _, op := range ops {
+		if op.Op != CFG_TXN_OP_CHECK && !fired[op.Key] {
+			fired[op.Key] = true
+			if entry, exists := entries[op.Key]; exists {
+				c.fireEvent(op.Key, entry.CAS, entry.Val, nil)
+			} else {
+				c.fireEvent(op.Key, 0, nil, nil)
+			}
+		}
 	}
-	c.subscriptions[key] = append(a, ch)
+
+	return casSuccess, nil
+}
+
+func (c *CfgMem) Subscribe(key string, ch chan CfgEvent) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.subscriptions[key] =
+		append(c.subscriptions[key], &cfgMemSubscription{ch: ch})
 	return nil
 }
 
 func (c *CfgMem) FireEvent(key string, cas uint64, err error) {
 	c.m.Lock()
-	c.fireEvent(key, cas, err)
+	c.fireEvent(key, cas, nil, err)
 	c.m.Unlock()
 }
 
-func (c *CfgMem) fireEvent(key string, cas uint64, err error) {
-	for _, c := range c.subscriptions[key] {
-		go func(c chan<- CfgEvent) {
-			c <- CfgEvent{
-				Key: key, CAS: cas, Error: err,
-			}
-		}(c)
+// fireEvent queues an event for the subscriptions of the key, where
+// the val of a Set() is carried by the event, and is shared by the
+// subscribers, so it must not be modified.
+func (c *CfgMem) fireEvent(key string, cas uint64, val []byte, err error) {
+	for _, s := range c.subscriptions[key] {
+		s.pending = append(s.pending, CfgEvent{
+			Key: key, CAS: cas, Val: val, Error: err,
+		})
+		if !s.sending {
+			s.sending = true
+			go c.send(s)
+		}
+	}
+}
+
+// send delivers the pending events of a subscription, in order.
+func (c *CfgMem) send(s *cfgMemSubscription) {
+	for {
+		c.m.Lock()
+		if len(s.pending) <= 0 {
+			s.sending = false
+			c.m.Unlock()
+			return
+		}
+		ev := s.pending[0]
+		s.pending[0] = CfgEvent{}
+		s.pending = s.pending[1:]
+		c.m.Unlock()
+
+		s.ch <- ev
 	}
 }
 
@@ -172,9 +283,9 @@ func (c *CfgMem) Refresh() error {
 	for key := range c.subscriptions {
 		entry, exists := c.Entries[key]
 		if exists && entry != nil {
-			c.fireEvent(key, entry.CAS, nil)
+			c.fireEvent(key, entry.CAS, entry.Val, nil)
 		} else {
-			c.fireEvent(key, 0, nil)
+			c.fireEvent(key, 0, nil, nil)
 		}
 	}
 
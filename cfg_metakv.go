@@ -15,6 +15,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"hash/crc32"
+	"hash/fnv"
 	"io/ioutil"
 	"math"
 	"net/http"
@@ -98,15 +99,19 @@ var cfgMetaKvAdvancedKeys map[string]cfgMetaKvAdvancedHandler = map[string]cfgMe
 }
 
 type CfgMetaKv struct {
-	prefix   string // Prefix for paths stores in metakv.
-	nodeUUID string // The uuid for this node.
+	prefix   string         // Prefix for paths stores in metakv.
+	nodeUUID string         // The uuid for this node.
+	kv       cfgMetaKvStore // The metakv, which tests may replace.
 
 	m            sync.Mutex // Protects the fields that follow.
 	cfgMem       *CfgMem
 	cancelCh     chan struct{}
-	lastSplitCAS uint64
 	splitEntries map[string]CfgMetaKvEntry
 	nsServerUrl  string
+
+	// The nodeUUID of an intent record that's being rolled forward,
+	// which a split set uses instead of our own nodeUUID.
+	txnNodeUUID string
 }
 
 type CfgMetaKvEntry struct {
@@ -124,14 +129,73 @@ type VersionReader interface {
 	ClusterVersion() (uint64, error)
 }
 
+// cfgMetaKvStore is the subset of the metakv API that's used by
+// CfgMetaKv, so that tests can run against an in-memory metakv.
+type cfgMetaKvStore interface {
+	Get(path string) ([]byte, interface{}, error)
+	Set(path string, value []byte, rev interface{}) error
+	Add(path string, value []byte) error
+	Delete(path string, rev interface{}) error
+	RecursiveDelete(dirpath string) error
+	ListAllChildren(dirpath string) ([]metakv.KVEntry, error)
+	IterateChildren(dirpath string, callback metakv.Callback) error
+	RunObserveChildren(dirpath string, callback metakv.Callback,
+		cancel <-chan struct{}) error
+}
+
+// cfgMetaKvCBAuthStore is the cfgMetaKvStore of the cbauth metakv.
+type cfgMetaKvCBAuthStore struct{}
+
+func (cfgMetaKvCBAuthStore) Get(path string) ([]byte, interface{}, error) {
+	return metakv.Get(path)
+}
+
+func (cfgMetaKvCBAuthStore) Set(path string, value []byte,
+	rev interface{}) error {
+	return metakv.Set(path, value, rev)
+}
+
+func (cfgMetaKvCBAuthStore) Add(path string, value []byte) error {
+	return metakv.Add(path, value)
+}
+
+func (cfgMetaKvCBAuthStore) Delete(path string, rev interface{}) error {
+	return metakv.Delete(path, rev)
+}
+
+func (cfgMetaKvCBAuthStore) RecursiveDelete(dirpath string) error {
+	return metakv.RecursiveDelete(dirpath)
+}
+
+func (cfgMetaKvCBAuthStore) ListAllChildren(dirpath string) (
+	[]metakv.KVEntry, error) {
+	return metakv.ListAllChildren(dirpath)
+}
+
+func (cfgMetaKvCBAuthStore) IterateChildren(dirpath string,
+	callback metakv.Callback) error {
+	return metakv.IterateChildren(dirpath, callback)
+}
+
+func (cfgMetaKvCBAuthStore) RunObserveChildren(dirpath string,
+	callback metakv.Callback, cancel <-chan struct{}) error {
+	return metakv.RunObserveChildren(dirpath, callback, cancel)
+}
+
 // NewCfgMetaKv returns a CfgMetaKv that reads and stores its single
 // configuration file in the metakv.
 func NewCfgMetaKv(nodeUUID string, options map[string]string) (*CfgMetaKv, error) {
+	return newCfgMetaKv(nodeUUID, options, cfgMetaKvCBAuthStore{})
+}
+
+func newCfgMetaKv(nodeUUID string, options map[string]string,
+	kv cfgMetaKvStore) (*CfgMetaKv, error) {
 	nsServerURL, _ := options["nsServerURL"]
 
 	cfg := &CfgMetaKv{
 		prefix:       CfgMetaKvPrefix,
 		nodeUUID:     nodeUUID,
+		kv:           kv,
 		cfgMem:       NewCfgMem(),
 		cancelCh:     make(chan struct{}),
 		splitEntries: map[string]CfgMetaKvEntry{},
@@ -140,13 +204,16 @@ func NewCfgMetaKv(nodeUUID string, options map[string]string) (*CfgMetaKv, error
 	backoffStartSleepMS := 200
 	backoffFactor := float32(1.5)
 	backoffMaxSleepMS := 5000
-	leanPlanKeyPrefix = CfgMetaKvPrefix + leanPlanKeyPrefix
+	if !strings.HasPrefix(leanPlanKeyPrefix, CfgMetaKvPrefix) {
+		// Only once, as there can be more than one CfgMetaKv.
+		leanPlanKeyPrefix = CfgMetaKvPrefix + leanPlanKeyPrefix
+	}
 
 	cfg.nsServerUrl = nsServerURL + "/pools/default"
 
 	go ExponentialBackoffLoop("cfg_metakv.RunObserveChildren",
 		func() int {
-			err := metakv.RunObserveChildren(cfg.prefix, cfg.metaKVCallback,
+			err := cfg.kv.RunObserveChildren(cfg.prefix, cfg.metaKVCallback,
 				cfg.cancelCh)
 			if err == nil {
 				return -1 // Success, so stop the loop.
@@ -181,12 +248,15 @@ func (c *CfgMetaKv) getLOCKED(key string, cas uint64) ([]byte, uint64, error) {
 func (c *CfgMetaKv) getRawLOCKED(key string, cas uint64) ([]byte, uint64, error) {
 	path := c.keyToPath(key)
 
-	v, _, err := metakv.Get(path) // TODO: Handle rev.
+	v, rev, err := c.kv.Get(path)
 	if err != nil {
 		return nil, 0, err
 	}
+	if v == nil {
+		return nil, 0, nil
+	}
 
-	return v, 1, nil
+	return v, cfgMetaKvRevCAS(rev), nil
 }
 
 func (c *CfgMetaKv) Set(key string, val []byte, cas uint64) (
@@ -211,18 +281,35 @@ func (c *CfgMetaKv) setLOCKED(key string, val []byte, cas uint64) (
 	return c.setRawLOCKED(key, val, cas)
 }
 
+// setRawLOCKED checks the cas against the rev of the current value,
+// and then writes conditionally on that rev, so that a racing write
+// of another node fails the CAS check.
 func (c *CfgMetaKv) setRawLOCKED(key string, val []byte, cas uint64) (
 	uint64, error) {
 	path := c.keyToPath(key)
 
 	log.Printf("cfg_metakv: Set path: %v", path)
 
-	err := metakv.Set(path, val, nil) // TODO: Handle rev better.
+	var rev interface{}
+
+	if cas != 0 && cas != CFG_CAS_FORCE {
+		var err error
+
+		rev, err = c.checkRevCASLOCKED(path, cas)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err := c.kv.Set(path, val, rev)
 	if err != nil {
+		if err == metakv.ErrRevMismatch {
+			return 0, &CfgCASError{}
+		}
 		return 0, err
 	}
 
-	return 1, nil
+	return c.revCASLOCKED(path)
 }
 
 func (c *CfgMetaKv) Del(key string, cas uint64) error {
@@ -245,17 +332,78 @@ func (c *CfgMetaKv) delLOCKED(key string, cas uint64) error {
 func (c *CfgMetaKv) delRawLOCKED(key string, cas uint64) error {
 	path := c.keyToPath(key)
 
-	return metakv.Delete(path, nil) // TODO: Handle rev better.
+	var rev interface{}
+
+	if cas != 0 && cas != CFG_CAS_FORCE {
+		var err error
+
+		rev, err = c.checkRevCASLOCKED(path, cas)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := c.kv.Delete(path, rev)
+	if err == metakv.ErrRevMismatch {
+		return &CfgCASError{}
+	}
+
+	return err
+}
+
+// checkRevCASLOCKED returns the rev of the value at a path, or a
+// CfgCASError if the value is missing or has a different CAS.
+func (c *CfgMetaKv) checkRevCASLOCKED(path string, cas uint64) (
+	interface{}, error) {
+	v, rev, err := c.kv.Get(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if v == nil || cfgMetaKvRevCAS(rev) != cas {
+		log.Warnf("cfg_metakv: cas mismatch, path: %v, cas: %x", path, cas)
+
+		return nil, &CfgCASError{}
+	}
+
+	return rev, nil
+}
+
+// revCASLOCKED returns the CAS of the value at a path.  metakv
+// doesn't return the rev of a write, so a writer reads it back.
+func (c *CfgMetaKv) revCASLOCKED(path string) (uint64, error) {
+	v, rev, err := c.kv.Get(path)
+	if err != nil || v == nil {
+		return 0, err
+	}
+
+	return cfgMetaKvRevCAS(rev), nil
 }
 
 func (c *CfgMetaKv) Load() error {
-	metakv.IterateChildren(c.prefix, c.metaKVCallback)
+	// Leftover intent records are rolled forward now only if no Txn()
+	// is in progress, as otherwise the next Txn() rolls them forward.
+	if held, ok := c.tryLockTxn(); ok {
+		c.m.Lock()
+		err := c.recoverTxnsLOCKED(held)
+		c.m.Unlock()
+		if err != nil {
+			log.Warnf("cfg_metakv: Load, recoverTxns, err: %v", err)
+		}
+		c.unlockTxn(held)
+	}
+
+	c.kv.IterateChildren(c.prefix, c.metaKVCallback)
 
 	return nil
 }
 
 func (c *CfgMetaKv) metaKVCallback(path string,
 	value []byte, rev interface{}) error {
+	if isCfgMetaKvTxnPath(c, path) {
+		return nil
+	}
+
 	key := c.pathToKey(path)
 
 	log.Printf("cfg_metakv: metaKVCallback, path: %v, key: %v,"+
@@ -293,7 +441,7 @@ func (c *CfgMetaKv) Refresh() error {
 // should no longer use this CfgMetaKv instance, but instead create a
 // new instance.
 func (c *CfgMetaKv) RemoveAllKeys() {
-	metakv.RecursiveDelete(c.prefix)
+	c.kv.RecursiveDelete(c.prefix)
 }
 
 func (c *CfgMetaKv) keyToPath(key string) string {
@@ -309,7 +457,7 @@ func (c *CfgMetaKv) listChildPaths(key string) ([]string, error) {
 	g := []string{}
 
 	if cfgMetaKvAdvancedKeys[key] != nil {
-		m, err := metakv.ListAllChildren(c.keyToPath(key) + "/")
+		m, err := c.kv.ListAllChildren(c.keyToPath(key) + "/")
 		if err != nil {
 			return nil, err
 		}
@@ -321,6 +469,53 @@ func (c *CfgMetaKv) listChildPaths(key string) ([]string, error) {
 	return g, nil
 }
 
+// cfgMetaKvRevCAS returns the CAS of a metakv rev, as the revs are
+// opaque to the Cfg interface.  A metakv rev changes on every write,
+// even of the same bytes, and a missing value has a CAS of 0.
+func cfgMetaKvRevCAS(rev interface{}) uint64 {
+	if rev == nil {
+		return 0
+	}
+
+	h := fnv.New64a()
+	if b, ok := rev.([]byte); ok {
+		h.Write(b)
+	} else {
+		fmt.Fprintf(h, "%v", rev)
+	}
+
+	return cfgMetaKvHashCAS(h.Sum64())
+}
+
+// cfgMetaKvChildrenCAS returns the CAS of the composite value of a
+// split key, from the paths and revs of its child entries.
+func cfgMetaKvChildrenCAS(children []metakv.KVEntry) uint64 {
+	entries := make([]string, 0, len(children))
+	for _, child := range children {
+		entries = append(entries, fmt.Sprintf("%s/%x",
+			child.Path, cfgMetaKvRevCAS(child.Rev)))
+	}
+	sort.Strings(entries)
+
+	h := fnv.New64a()
+	for _, entry := range entries {
+		h.Write([]byte(entry))
+		h.Write([]byte{0})
+	}
+
+	return cfgMetaKvHashCAS(h.Sum64())
+}
+
+// cfgMetaKvHashCAS keeps a hash clear of the CAS values that have
+// special meanings.
+func cfgMetaKvHashCAS(cas uint64) uint64 {
+	if cas == 0 || cas == CFG_CAS_FORCE {
+		cas = 1
+	}
+
+	return cas
+}
+
 func checkSumUUIDs(uuids []string) string {
 	sort.Strings(uuids)
 	d, _ := json.Marshal(uuids)
@@ -336,7 +531,7 @@ type cfgMetaKvNodeDefsSplitHandler struct{}
 // with c.m.Lock()'ed.
 func (a *cfgMetaKvNodeDefsSplitHandler) get(
 	c *CfgMetaKv, key string, cas uint64) ([]byte, uint64, error) {
-	m, err := metakv.ListAllChildren(c.keyToPath(key) + "/")
+	m, err := c.kv.ListAllChildren(c.keyToPath(key) + "/")
 	if err != nil {
 		return nil, 0, err
 	}
@@ -380,8 +575,7 @@ func (a *cfgMetaKvNodeDefsSplitHandler) get(
 		return nil, 0, err
 	}
 
-	casResult := c.lastSplitCAS + 1
-	c.lastSplitCAS = casResult
+	casResult := cfgMetaKvChildrenCAS(m)
 
 	c.splitEntries[key] = CfgMetaKvEntry{
 		cas:  casResult,
@@ -397,15 +591,29 @@ func (a *cfgMetaKvNodeDefsSplitHandler) set(
 	c *CfgMetaKv, key string, val []byte, cas uint64) (uint64, error) {
 	path := c.keyToPath(key)
 
-	curEntry := c.splitEntries[key]
+	nodeUUID := c.nodeUUID
+	if c.txnNodeUUID != "" {
+		nodeUUID = c.txnNodeUUID
+	}
+
+	if cas != math.MaxUint64 && cas != 0 {
+		// The CAS is checked against the current children, as the
+		// nodes of other versions write them without any CAS.
+		_, curCAS, err := a.get(c, key, 0)
+		if err != nil {
+			return 0, err
+		}
 
-	if cas != math.MaxUint64 && cas != 0 && cas != curEntry.cas {
-		log.Warnf("cfg_metakv: Set split, key: %v, cas mismatch: %x != %x",
-			key, cas, curEntry.cas)
+		if cas != curCAS {
+			log.Warnf("cfg_metakv: Set split, key: %v, cas mismatch: %x != %x",
+				key, cas, curCAS)
 
-		return 0, &CfgCASError{}
+			return 0, &CfgCASError{}
+		}
 	}
 
+	curEntry := c.splitEntries[key]
+
 	var curNodeDefs NodeDefs
 
 	if curEntry.data != nil && len(curEntry.data) > 0 {
@@ -453,13 +661,13 @@ func (a *cfgMetaKvNodeDefsSplitHandler) set(
 
 LOOP:
 	for k, v := range nd.NodeDefs {
-		if cas != math.MaxUint64 && c.nodeUUID != "" && c.nodeUUID != v.UUID {
+		if cas != math.MaxUint64 && nodeUUID != "" && nodeUUID != v.UUID {
 			// If we have a nodeUUID, only add/update our
 			// nodeDef, where other nodes will each add/update
 			// only their own nodeDef's.
 			log.Printf("cfg_metakv: Set split, key: %v,"+
 				" skipping other node UUID: %v, self nodeUUID: %s",
-				key, v.UUID, c.nodeUUID)
+				key, v.UUID, nodeUUID)
 
 			continue LOOP
 		}
@@ -481,7 +689,7 @@ LOOP:
 		log.Printf("cfg_metakv: Set split, key: %v, childPath: %v",
 			key, childPath)
 
-		err = metakv.Set(childPath, val, nil)
+		err = c.kv.Set(childPath, val, nil)
 		if err != nil {
 			return 0, err
 		}
@@ -502,15 +710,17 @@ LOOP:
 
 			log.Printf("cfg_metakv: Set delete, childPath: %v", childPath)
 
-			err = metakv.Delete(childPath, nil)
+			err = c.kv.Delete(childPath, nil)
 			if err != nil {
 				return 0, err
 			}
 		}
 	}
 
-	casResult := c.lastSplitCAS + 1
-	c.lastSplitCAS = casResult
+	// The CAS is that of the resulting composite nodeDefs, which
+	// might also have other nodes' nodeDefs.
+	_, casResult, err := a.get(c, key, 0)
+
 	return casResult, err
 }
 
@@ -520,7 +730,7 @@ func (a *cfgMetaKvNodeDefsSplitHandler) del(
 
 	path := c.keyToPath(key)
 
-	return metakv.RecursiveDelete(path + "/")
+	return c.kv.RecursiveDelete(path + "/")
 }
 
 // ----------------------------------------------------------------
@@ -71,6 +71,124 @@ type LeanPlanPIndex struct {
 	Nodes            map[string]*PlanPIndexNode `json:"nodes"`
 }
 
+// leanPlanIndex holds the fields that are shared by the plan pindexes
+// of an index, which a lean or sharded plan stores once per index.
+// Unlike an IndexDef, the params are kept as the exact strings.
+type leanPlanIndex struct {
+	IndexType    string `json:"indexType"`
+	IndexName    string `json:"indexName"`
+	IndexUUID    string `json:"indexUUID"`
+	IndexParams  string `json:"indexParams,omitempty"`
+	SourceType   string `json:"sourceType"`
+	SourceName   string `json:"sourceName,omitempty"`
+	SourceUUID   string `json:"sourceUUID,omitempty"`
+	SourceParams string `json:"sourceParams,omitempty"`
+}
+
+// leanIndexPlan is the lean version of the plan pindexes of an index.
+type leanIndexPlan struct {
+	leanPlanIndex
+	PlanPIndexes map[string]*LeanPlanPIndex `json:"planPIndexes"`
+}
+
+// splitLeanPlan groups plan pindexes by their index name, keeping the
+// index fields once per index.  An error is returned when the plan
+// pindexes of an index have different index fields.
+func splitLeanPlan(planPIndexes map[string]*PlanPIndex) (
+	map[string]*leanIndexPlan, error) {
+	rv := map[string]*leanIndexPlan{}
+
+	for name, ppi := range planPIndexes {
+		index := leanPlanIndex{
+			IndexType:    ppi.IndexType,
+			IndexName:    ppi.IndexName,
+			IndexUUID:    ppi.IndexUUID,
+			IndexParams:  ppi.IndexParams,
+			SourceType:   ppi.SourceType,
+			SourceName:   ppi.SourceName,
+			SourceUUID:   ppi.SourceUUID,
+			SourceParams: ppi.SourceParams,
+		}
+
+		lip := rv[ppi.IndexName]
+		if lip == nil {
+			lip = &leanIndexPlan{
+				leanPlanIndex: index,
+				PlanPIndexes:  map[string]*LeanPlanPIndex{},
+			}
+			rv[ppi.IndexName] = lip
+		} else if lip.leanPlanIndex != index {
+			return nil, fmt.Errorf("cfg_metakv_lean: plan pindexes of"+
+				" index: %s have different index fields", ppi.IndexName)
+		}
+
+		lip.PlanPIndexes[name] = &LeanPlanPIndex{
+			Name:             ppi.Name,
+			UUID:             ppi.UUID,
+			SourcePartitions: ppi.SourcePartitions,
+			Nodes:            ppi.Nodes,
+		}
+	}
+
+	return rv, nil
+}
+
+// join adds the plan pindexes of an index back into planPIndexes.
+func (lip *leanIndexPlan) join(planPIndexes map[string]*PlanPIndex) {
+	for name, lpp := range lip.PlanPIndexes {
+		planPIndexes[name] = &PlanPIndex{
+			Name:             lpp.Name,
+			UUID:             lpp.UUID,
+			IndexType:        lip.IndexType,
+			IndexName:        lip.IndexName,
+			IndexUUID:        lip.IndexUUID,
+			IndexParams:      lip.IndexParams,
+			SourceType:       lip.SourceType,
+			SourceName:       lip.SourceName,
+			SourceUUID:       lip.SourceUUID,
+			SourceParams:     lip.SourceParams,
+			SourcePartitions: lpp.SourcePartitions,
+			Nodes:            lpp.Nodes,
+		}
+	}
+}
+
+// newLeanIndexPlanPIndexes converts the lean version of the plan
+// pindexes of an index into the format stored by a CfgMetaKv.
+func newLeanIndexPlanPIndexes(lip *leanIndexPlan) *LeanIndexPlanPIndexes {
+	return &LeanIndexPlanPIndexes{
+		IndexDef: &IndexDef{
+			Type:         lip.IndexType,
+			Name:         lip.IndexName,
+			UUID:         lip.IndexUUID,
+			Params:       lip.IndexParams,
+			SourceType:   lip.SourceType,
+			SourceName:   lip.SourceName,
+			SourceUUID:   lip.SourceUUID,
+			SourceParams: lip.SourceParams,
+		},
+		LeanPlanPIndexes: lip.PlanPIndexes,
+	}
+}
+
+// leanIndexPlan converts the plan pindexes of an index, as stored by
+// a CfgMetaKv, into their lean version.
+func (ipp *LeanIndexPlanPIndexes) leanIndexPlan() *leanIndexPlan {
+	return &leanIndexPlan{
+		leanPlanIndex: leanPlanIndex{
+			IndexType:    ipp.IndexDef.Type,
+			IndexName:    ipp.IndexDef.Name,
+			IndexUUID:    ipp.IndexDef.UUID,
+			IndexParams:  ipp.IndexDef.Params,
+			SourceType:   ipp.IndexDef.SourceType,
+			SourceName:   ipp.IndexDef.SourceName,
+			SourceUUID:   ipp.IndexDef.SourceUUID,
+			SourceParams: ipp.IndexDef.SourceParams,
+		},
+		PlanPIndexes: ipp.LeanPlanPIndexes,
+	}
+}
+
 // planMeta represents the json contents of curMetaKvPlanKey
 type planMeta struct {
 	Path        string `json:"path"`
@@ -88,6 +206,16 @@ type planMeta struct {
 // while reading back.
 func setLeanPlan(c *CfgMetaKv,
 	key string, val []byte, cas uint64) (uint64, error) {
+	var metaRev interface{}
+	if cas != 0 && cas != CFG_CAS_FORCE {
+		var err error
+
+		metaRev, err = checkLeanPlanCAS(c, key, cas)
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	hashMD5, err := computeMD5(val)
 	if err != nil {
 		return 0, err
@@ -113,31 +241,12 @@ func setLeanPlan(c *CfgMetaKv,
 	leanPlanPIndexes.ImplVersion = planPIndexes.ImplVersion
 	leanPlanPIndexes.UUID = planPIndexes.UUID
 	leanPlanPIndexes.Warnings = planPIndexes.Warnings
-	for _, ppi := range planPIndexes.PlanPIndexes {
-		indexPlanPIndexes, exists := leanPlanPIndexes.IndexPlanPIndexes[ppi.IndexName]
-		if !exists {
-			ipp := &LeanIndexPlanPIndexes{
-				LeanPlanPIndexes: make(map[string]*LeanPlanPIndex)}
-			ipp.IndexDef = &IndexDef{Name: ppi.IndexName,
-				UUID:         ppi.IndexUUID,
-				SourceName:   ppi.SourceName,
-				SourceParams: ppi.SourceParams,
-				SourceType:   ppi.SourceType,
-				SourceUUID:   ppi.SourceUUID,
-				Type:         ppi.IndexType,
-				Params:       ppi.IndexParams,
-			}
-			leanPlanPIndexes.IndexPlanPIndexes[ppi.IndexName] = ipp
-			indexPlanPIndexes = ipp
-		}
-		if _, exist := indexPlanPIndexes.LeanPlanPIndexes[ppi.Name]; !exist {
-			indexPlanPIndexes.LeanPlanPIndexes[ppi.Name] = &LeanPlanPIndex{
-				Name:             ppi.Name,
-				UUID:             ppi.UUID,
-				SourcePartitions: ppi.SourcePartitions,
-				Nodes:            ppi.Nodes,
-			}
-		}
+	indexPlans, err := splitLeanPlan(planPIndexes.PlanPIndexes)
+	if err != nil {
+		return 0, err
+	}
+	for name, lip := range indexPlans {
+		leanPlanPIndexes.IndexPlanPIndexes[name] = newLeanIndexPlanPIndexes(lip)
 	}
 
 	for name, ipp := range leanPlanPIndexes.IndexPlanPIndexes {
@@ -152,15 +261,15 @@ func setLeanPlan(c *CfgMetaKv,
 		if err != nil {
 			// clean up the incomplete plan directories
 			log.Printf("cfg_metakv_lean: setLeanPlan json marshal, err: %v", err)
-			metakv.RecursiveDelete(newPath)
+			c.kv.RecursiveDelete(newPath)
 			return 0, err
 		}
 		childPath := newPath + name
-		err = metakv.Set(childPath, val, nil)
+		err = c.kv.Set(childPath, val, nil)
 		if err != nil {
 			// clean up the incomplete plan directories
 			log.Printf("cfg_metakv_lean: setLeanPlan metakv.Set, err: %v", err)
-			metakv.RecursiveDelete(newPath)
+			c.kv.RecursiveDelete(newPath)
 			return 0, err
 		}
 		log.Printf("cfg_metakv_lean: setLeanPlan, key: %v, childPath: %v",
@@ -174,25 +283,57 @@ func setLeanPlan(c *CfgMetaKv,
 	}
 	metaJSON, err := json.Marshal(meta)
 	if err != nil {
-		metakv.RecursiveDelete(newPath)
+		c.kv.RecursiveDelete(newPath)
 		return 0, err
 	}
-	err = metakv.Set(c.keyToPath(curMetaKvPlanKey), metaJSON, nil)
+	err = c.kv.Set(c.keyToPath(curMetaKvPlanKey), metaJSON, metaRev)
 	if err != nil {
 		log.Printf("cfg_metakv_lean: setLeanPlan, curMetaKvPlanKey "+
 			"set, err: %v", err)
-		metakv.RecursiveDelete(newPath)
+		c.kv.RecursiveDelete(newPath)
+		if err == metakv.ErrRevMismatch {
+			return 0, &CfgCASError{}
+		}
 		return 0, err
 	}
 
 	log.Printf("cfg_metakv_lean: setLeanPlan, curMetaKvPlanKey "+
 		"set, val: %s", metaJSON)
 
-	casResult := c.lastSplitCAS + 1
-	c.lastSplitCAS = casResult
 	// purge any orphaned, old enough lean planPIndexes
 	purgeOrphanedLeanPlans(c, newPath)
-	return casResult, err
+	return c.revCASLOCKED(c.keyToPath(curMetaKvPlanKey))
+}
+
+// checkLeanPlanCAS returns the rev of the current plan key, or a
+// CfgCASError if the current plan has a different CAS.  Before any
+// lean plan was written, the CAS is that of the shared plan, whose
+// write is then checked only here.
+func checkLeanPlanCAS(c *CfgMetaKv, key string, cas uint64) (
+	interface{}, error) {
+	meta, metaRev, err := getCurMetaKvPlanMeta(c)
+	if err != nil {
+		return nil, err
+	}
+
+	curCAS := cfgMetaKvRevCAS(metaRev)
+	if meta == nil {
+		_, curCAS, err = c.getRawLOCKED(key, 0)
+		if err != nil {
+			return nil, err
+		}
+	} else if meta.Path == "" {
+		curCAS = 0
+	}
+
+	if cas != curCAS {
+		log.Warnf("cfg_metakv_lean: setLeanPlan, cas mismatch: %x != %x",
+			cas, curCAS)
+
+		return nil, &CfgCASError{}
+	}
+
+	return metaRev, nil
 }
 
 // getLeanPlan retrieves multiple child entries from the metakv and
@@ -207,7 +348,7 @@ func getLeanPlan(c *CfgMetaKv,
 RETRY:
 	attempt++
 	// fetch the current planPIndex meta first
-	planMeta, err := getCurMetaKvPlanMeta(c)
+	planMeta, planMetaRev, err := getCurMetaKvPlanMeta(c)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -231,7 +372,7 @@ RETRY:
 	rv.UUID = planMeta.UUID
 	rv.ImplVersion = planMeta.ImplVersion
 
-	children, err := metakv.ListAllChildren(planMeta.Path)
+	children, err := c.kv.ListAllChildren(planMeta.Path)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -243,23 +384,7 @@ RETRY:
 		}
 
 		for _, ipp := range childPlan.IndexPlanPIndexes {
-			for _, lpp := range ipp.LeanPlanPIndexes {
-				planPIndex := &PlanPIndex{
-					Name:             lpp.Name,
-					UUID:             lpp.UUID,
-					IndexName:        ipp.IndexDef.Name,
-					IndexType:        ipp.IndexDef.Type,
-					IndexUUID:        ipp.IndexDef.UUID,
-					IndexParams:      ipp.IndexDef.Params,
-					SourceName:       ipp.IndexDef.SourceName,
-					SourceType:       ipp.IndexDef.SourceType,
-					SourceUUID:       ipp.IndexDef.SourceUUID,
-					SourceParams:     ipp.IndexDef.SourceParams,
-					SourcePartitions: lpp.SourcePartitions,
-					Nodes:            lpp.Nodes,
-				}
-				rv.PlanPIndexes[lpp.Name] = planPIndex
-			}
+			ipp.leanIndexPlan().join(rv.PlanPIndexes)
 			leanPlanPIndexes.IndexPlanPIndexes[ipp.IndexDef.Name] = ipp
 
 			if childPlan.Warnings != nil {
@@ -314,24 +439,22 @@ RETRY:
 		return nil, 0, err
 	}
 
-	casResult := c.lastSplitCAS + 1
-	c.lastSplitCAS = casResult
-	return data, casResult, nil
+	return data, cfgMetaKvRevCAS(planMetaRev), nil
 }
 
 func delLeanPlan(
 	c *CfgMetaKv, key string, cas uint64) error {
 	// Check for any sharedPlan left overs and clean it.
-	buf, _, _ := c.getRawLOCKED(key, cas)
+	buf, _, _ := c.getRawLOCKED(key, 0)
 	if len(buf) > 0 {
-		delSharedPlan(c, key, cas)
+		delSharedPlan(c, key, 0)
 	}
 	// fetch the current planPIndex path
-	meta, err := getCurMetaKvPlanMeta(c)
+	meta, _, err := getCurMetaKvPlanMeta(c)
 	if err != nil || meta == nil {
 		return err
 	}
-	err = metakv.RecursiveDelete(meta.Path)
+	err = c.kv.RecursiveDelete(meta.Path)
 	if err != nil {
 		log.Printf("cfg_metakv_lean: delLeanPlan, RecursiveDelete,"+
 			" err: %v", err)
@@ -347,7 +470,7 @@ func delLeanPlan(
 	if err != nil {
 		return err
 	}
-	err = metakv.Set(c.keyToPath(curMetaKvPlanKey), metaJSON, nil)
+	err = c.kv.Set(c.keyToPath(curMetaKvPlanKey), metaJSON, nil)
 	if err != nil {
 		log.Printf("cfg_metakv_lean: delLeanPlan, curMetaKvPlanKey "+
 			"Set, err: %v", err)
@@ -361,7 +484,7 @@ func delLeanPlan(
 // purgeOrphanedLeanPlans purges all those planPIndexes directories
 // which are left orphaned due to those rare metakv race scenarios
 func purgeOrphanedLeanPlans(c *CfgMetaKv, curPath string) error {
-	children, err := metakv.ListAllChildren(c.keyToPath("planPIndexesLean") + "/")
+	children, err := c.kv.ListAllChildren(c.keyToPath("planPIndexesLean") + "/")
 	if err != nil {
 		log.Printf("cfg_metakv_lean: purgeOrphanedLeanPlans, err: %v", err)
 		return err
@@ -391,7 +514,7 @@ func purgeOrphanedLeanPlans(c *CfgMetaKv, curPath string) error {
 			bornTimeMs, _ := strconv.Atoi(bornTimeStr)
 			age := curTimeMs - int64(bornTimeMs)
 			if age >= PlanPurgeTimeout {
-				err = metakv.RecursiveDelete(orphanPath)
+				err = c.kv.RecursiveDelete(orphanPath)
 				if err != nil {
 					// errs are logged and ignored except the last one
 					log.Printf("cfg_metakv_lean: purgeOrphanedLeanPlans, "+
@@ -405,24 +528,27 @@ func purgeOrphanedLeanPlans(c *CfgMetaKv, curPath string) error {
 	return err
 }
 
-func getCurMetaKvPlanMeta(c *CfgMetaKv) (*planMeta, error) {
+// getCurMetaKvPlanMeta also returns the rev of the current plan key,
+// which changes with every setLeanPlan and so serves as the CAS of
+// the lean plan.
+func getCurMetaKvPlanMeta(c *CfgMetaKv) (*planMeta, interface{}, error) {
 	path := c.keyToPath(curMetaKvPlanKey)
-	v, _, err := metakv.Get(path)
+	v, rev, err := c.kv.Get(path)
 	if err != nil {
 		log.Printf("cfg_metakv_lean: getCurMetaKvPlanMeta, err: %v", err)
-		return nil, err
+		return nil, nil, err
 	}
 	if len(v) == 0 {
-		return nil, nil
+		return nil, nil, nil
 	}
 	meta := &planMeta{}
 	err = json.Unmarshal(v, meta)
 	if err != nil {
 		log.Printf("cfg_metakv_lean: getCurMetaKvPlanMeta, json err: %v", err)
-		return nil, err
+		return nil, nil, err
 	}
 
-	return meta, nil
+	return meta, rev, nil
 }
 
 func computeMD5(payload []byte) (string, error) {
@@ -0,0 +1,814 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbase/cbauth/metakv"
+
+	"github.com/couchbase/cbgt/cmd/metakvmock"
+)
+
+// mockMetaKvStore is a cfgMetaKvStore that speaks the metakv REST
+// protocol, including the continuous change feed, to a httptest
+// server that's backed by the same in-memory metakvmock.Store as the
+// cmd/metakv-mock server, so that CfgMetaKv can be tested without a
+// running metakv.  The embedded Store allows tests to inspect the
+// entries directly.
+type mockMetaKvStore struct {
+	*metakvmock.Store
+
+	server  *httptest.Server
+	closeCh chan struct{} // Closed to end the change feeds for good.
+}
+
+func newMockMetaKvStore() *mockMetaKvStore {
+	store := metakvmock.NewStore()
+
+	return &mockMetaKvStore{
+		Store:   store,
+		server:  httptest.NewServer(store),
+		closeCh: make(chan struct{}),
+	}
+}
+
+// Close stops the server, after which the change feeds of the
+// CfgMetaKv's end rather than being retried.
+func (s *mockMetaKvStore) Close() {
+	close(s.closeCh)
+	s.Store.Close()
+	s.server.Close()
+}
+
+func newMockCfgMetaKv(t *testing.T, kv *mockMetaKvStore,
+	nodeUUID string) *CfgMetaKv {
+	numWatchers := kv.NumWatchers()
+
+	c, err := newCfgMetaKv(nodeUUID, nil, kv)
+	if err != nil {
+		t.Fatalf("expected newCfgMetaKv to work, err: %v", err)
+	}
+
+	// Wait for the CfgMetaKv to start observing, so no events are lost.
+	for kv.NumWatchers() <= numWatchers {
+		time.Sleep(time.Millisecond)
+	}
+
+	return c
+}
+
+func (s *mockMetaKvStore) url(path string) string {
+	return s.server.URL + metakvmock.METAKV_PATH_PREFIX + path
+}
+
+// do sends a metakv request, where a conflict is a rev mismatch.
+func (s *mockMetaKvStore) do(method, u string, form url.Values) (
+	[]byte, error) {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusConflict {
+		return nil, metakv.ErrRevMismatch
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("mockMetaKvStore: %s %s, status: %d, body: %s",
+			method, u, resp.StatusCode, buf)
+	}
+
+	return buf, nil
+}
+
+// decodeMetaKvEntries invokes the callback with each entry of a stream of
+// metakv JSON entries, until the end of the stream.
+func decodeMetaKvEntries(r io.Reader,
+	callback func(e *metakvmock.KvEntry) error) error {
+	dec := json.NewDecoder(r)
+	for {
+		var e metakvmock.KvEntry
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = callback(&e)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *mockMetaKvStore) Get(path string) ([]byte, interface{}, error) {
+	buf, err := s.do("GET", s.url(path), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var e metakvmock.KvEntry
+	err = json.Unmarshal(buf, &e)
+	if err != nil {
+		return nil, nil, err
+	}
+	if e.Rev == nil {
+		return nil, nil, nil
+	}
+
+	return e.Value, e.Rev, nil
+}
+
+func (s *mockMetaKvStore) set(path string, value []byte,
+	rev interface{}, create bool) error {
+	form := url.Values{"value": {string(value)}}
+	if rev != nil {
+		form.Set("rev", string(rev.([]byte)))
+	}
+	if create {
+		form.Set("create", "true")
+	}
+
+	_, err := s.do("PUT", s.url(path), form)
+	return err
+}
+
+func (s *mockMetaKvStore) Set(path string, value []byte,
+	rev interface{}) error {
+	return s.set(path, value, rev, false)
+}
+
+func (s *mockMetaKvStore) Add(path string, value []byte) error {
+	return s.set(path, value, nil, true)
+}
+
+func (s *mockMetaKvStore) Delete(path string, rev interface{}) error {
+	u := s.url(path)
+	if rev != nil {
+		u += "?" + url.Values{"rev": {string(rev.([]byte))}}.Encode()
+	}
+
+	_, err := s.do("DELETE", u, nil)
+	return err
+}
+
+func (s *mockMetaKvStore) RecursiveDelete(dirpath string) error {
+	_, err := s.do("DELETE", s.url(dirpath), nil)
+	return err
+}
+
+func (s *mockMetaKvStore) ListAllChildren(dirpath string) (
+	[]metakv.KVEntry, error) {
+	buf, err := s.do("GET", s.url(dirpath), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var rv []metakv.KVEntry
+	err = decodeMetaKvEntries(strings.NewReader(string(buf)),
+		func(e *metakvmock.KvEntry) error {
+			rv = append(rv, metakv.KVEntry{
+				Path: e.Path, Value: e.Value, Rev: e.Rev})
+			return nil
+		})
+
+	return rv, err
+}
+
+func (s *mockMetaKvStore) IterateChildren(dirpath string,
+	callback metakv.Callback) error {
+	children, err := s.ListAllChildren(dirpath)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range children {
+		err = callback(e.Path, e.Value, e.Rev)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RunObserveChildren follows the continuous change feed of the
+// server, which starts with the current entries, until it's
+// cancelled or the mockMetaKvStore is closed.
+func (s *mockMetaKvStore) RunObserveChildren(dirpath string,
+	callback metakv.Callback, cancel <-chan struct{}) error {
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	defer ctxCancel()
+
+	go func() {
+		select {
+		case <-cancel:
+			ctxCancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	req, err := http.NewRequest("GET", s.url(dirpath)+"?feed=continuous", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err == nil {
+		defer resp.Body.Close()
+
+		err = decodeMetaKvEntries(resp.Body, func(e *metakvmock.KvEntry) error {
+			return callback(e.Path, e.Value, e.Rev)
+		})
+	}
+
+	select {
+	case <-cancel:
+		return nil
+	case <-s.closeCh:
+		return nil
+	default:
+	}
+
+	if err == nil {
+		err = fmt.Errorf("mockMetaKvStore: change feed ended")
+	}
+
+	return err
+}
+
+// ------------------------------------------------
+
+func TestCfgMetaKvMock(t *testing.T) {
+	kv := newMockMetaKvStore()
+	defer kv.Close()
+	c := newMockCfgMetaKv(t, kv, "")
+
+	ech := make(chan CfgEvent, 100)
+	err := c.Subscribe("hello", ech)
+	if err != nil {
+		t.Fatalf("expected no subscribe err, err: %v", err)
+	}
+
+	expectEvent := func(msg string) {
+		for {
+			select {
+			case ev := <-ech:
+				if ev.Key == "hello" {
+					return
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("expected an event, %s", msg)
+			}
+		}
+	}
+
+	cas, err := c.Set("hello", []byte("world"), 0)
+	if err != nil {
+		t.Errorf("expected no set err, err: %v", err)
+	}
+	expectEvent("on set")
+
+	val, cas2, err := c.Get("hello", 0)
+	if err != nil || string(val) != "world" || cas2 != cas {
+		t.Errorf("expected get to work, val: %s, cas: %d, cas2: %d, err: %v",
+			val, cas, cas2, err)
+	}
+
+	err = c.Del("hello", 0)
+	if err != nil {
+		t.Errorf("expected no del err, err: %v", err)
+	}
+	expectEvent("on del")
+
+	val, _, err = c.Get("hello", 0)
+	if err != nil || val != nil {
+		t.Errorf("expected a deleted key, val: %s, err: %v", val, err)
+	}
+
+	// A change by another node arrives through the change feed.
+	c1 := newMockCfgMetaKv(t, kv, "n1")
+
+	_, err = c1.Set("hello", []byte("again"), 0)
+	if err != nil {
+		t.Errorf("expected no set err, err: %v", err)
+	}
+	expectEvent("on set by another node")
+
+	err = c.Refresh()
+	if err != nil {
+		t.Errorf("expected no refresh err, err: %v", err)
+	}
+}
+
+func TestCfgMetaKvIllConfigured(t *testing.T) {
+	// Nothing listens at the address of the closed store.
+	kv := newMockMetaKvStore()
+	kv.Close()
+
+	m, err := newCfgMetaKv("", nil, kv)
+	if err != nil || m == nil {
+		t.Errorf("expected no err")
+	}
+
+	err = m.Load()
+	if err != nil {
+		t.Errorf("expected no load err")
+	}
+
+	err = m.Refresh()
+	if err != nil {
+		t.Errorf("expected no refresh err")
+	}
+
+	ech := make(chan CfgEvent, 100)
+	err = m.Subscribe("hello", ech)
+	if err != nil {
+		t.Errorf("expected no subscribe err")
+	}
+
+	val, cas, err := m.Get("key-not-there", 0)
+	if err == nil || val != nil || cas != 0 {
+		t.Errorf("expected err on get because metakv not properly setup")
+	}
+
+	cas, err = m.Set("key", []byte("val"), 0)
+	if err == nil || cas != 0 {
+		t.Errorf("expected err on set because metakv not properly setup")
+	}
+
+	err = m.Del("key", 0)
+	if err == nil {
+		t.Errorf("expected err on del because metakv not properly setup")
+	}
+}
+
+func TestCfgMetaKvMockSplitNodeDefs(t *testing.T) {
+	kv := newMockMetaKvStore()
+	defer kv.Close()
+	c := newMockCfgMetaKv(t, kv, "")
+
+	splitKey := CfgNodeDefsKey(NODE_DEFS_WANTED)
+
+	nodeDefs := NewNodeDefs("1.0.0")
+	for i := 0; i < 3; i++ {
+		uuid := fmt.Sprintf("n%d", i)
+		nodeDefs.NodeDefs[uuid] = &NodeDef{
+			HostPort: uuid + ":1000", UUID: uuid, ImplVersion: "1.0.0",
+		}
+	}
+
+	// A max cas writes the nodeDefs of every node, not just our own.
+	_, err := CfgSetNodeDefs(c, NODE_DEFS_WANTED, nodeDefs, math.MaxUint64)
+	if err != nil {
+		t.Fatalf("expected no set nodeDefs err, err: %v", err)
+	}
+
+	paths, err := c.listChildPaths(splitKey)
+	if err != nil || len(paths) != 3 {
+		t.Errorf("expected split children, paths: %v, err: %v", paths, err)
+	}
+
+	nodeDefs2, _, err := CfgGetNodeDefs(c, NODE_DEFS_WANTED)
+	if err != nil || !compareMockNodeDefs(nodeDefs, nodeDefs2) {
+		t.Errorf("expected nodeDefs to round trip, nodeDefs2: %#v, err: %v",
+			nodeDefs2, err)
+	}
+
+	// Another node only adds its own nodeDef.
+	c1 := newMockCfgMetaKv(t, kv, "n3")
+
+	nodeDefs3, cas, _ := CfgGetNodeDefs(c1, NODE_DEFS_WANTED)
+	nodeDefs3.NodeDefs["n3"] = &NodeDef{
+		HostPort: "n3:1000", UUID: "n3", ImplVersion: "1.0.0",
+	}
+	delete(nodeDefs3.NodeDefs, "n0")
+
+	_, err = CfgSetNodeDefs(c1, NODE_DEFS_WANTED, nodeDefs3, cas)
+	if err != nil {
+		t.Errorf("expected no set nodeDefs err, err: %v", err)
+	}
+
+	paths, _ = c.listChildPaths(splitKey)
+	if len(paths) != 4 {
+		t.Errorf("expected only n3 to be added, paths: %v", paths)
+	}
+}
+
+func compareMockNodeDefs(a, b *NodeDefs) bool {
+	if a == nil || b == nil || len(a.NodeDefs) != len(b.NodeDefs) {
+		return false
+	}
+	for k, v := range a.NodeDefs {
+		if b.NodeDefs[k] == nil || b.NodeDefs[k].HostPort != v.HostPort {
+			return false
+		}
+	}
+	return true
+}
+
+func TestCfgMetaKvMockLeanPlan(t *testing.T) {
+	kv := newMockMetaKvStore()
+	defer kv.Close()
+	c := newMockCfgMetaKv(t, kv, "")
+
+	_, err := c.Set(VERSION_KEY, []byte(LeanPlanVersion), 0)
+	if err != nil {
+		t.Fatalf("expected no set version err, err: %v", err)
+	}
+
+	for _, kind := range []string{NODE_DEFS_KNOWN, NODE_DEFS_WANTED} {
+		nodeDefs := NewNodeDefs(LeanPlanVersion)
+		nodeDefs.NodeDefs["n0"] = &NodeDef{
+			HostPort:    "n0:1000",
+			UUID:        "n0",
+			ImplVersion: LeanPlanVersion,
+			Extras:      `{"features":"` + NodeFeatureLeanPlan + `"}`,
+		}
+		_, err = CfgSetNodeDefs(c, kind, nodeDefs, math.MaxUint64)
+		if err != nil {
+			t.Fatalf("expected no set nodeDefs err, err: %v", err)
+		}
+	}
+
+	c.m.Lock()
+	leanPlanSupported := isLeanPlanSupported(c)
+	c.m.Unlock()
+	if !leanPlanSupported {
+		t.Fatalf("expected lean plans to be supported")
+	}
+
+	planPIndexes := NewPlanPIndexes(LeanPlanVersion)
+	for i := 0; i < 4; i++ {
+		name := fmt.Sprintf("idx%d_%d", i%2, i)
+		planPIndexes.PlanPIndexes[name] = &PlanPIndex{
+			Name:             name,
+			UUID:             "u" + name,
+			IndexName:        fmt.Sprintf("idx%d", i%2),
+			IndexType:        "blackhole",
+			IndexUUID:        fmt.Sprintf("iu%d", i%2),
+			SourceType:       "nil",
+			SourcePartitions: strconv.Itoa(i),
+			Nodes: map[string]*PlanPIndexNode{
+				"n0": {CanRead: true, CanWrite: true},
+			},
+		}
+	}
+
+	// An old, orphaned plan directory, which should be purged.
+	orphan := leanPlanKeyPrefix + strings.Repeat("0", md5HashLength) + "-1/idx0"
+	kv.Set(orphan, []byte("{}"), nil)
+
+	_, err = CfgSetPlanPIndexes(c, planPIndexes, 0)
+	if err != nil {
+		t.Fatalf("expected no set plan err, err: %v", err)
+	}
+
+	planPIndexes2, _, err := CfgGetPlanPIndexes(c)
+	if err != nil || planPIndexes2 == nil ||
+		len(planPIndexes2.PlanPIndexes) != 4 ||
+		planPIndexes2.PlanPIndexes["idx1_3"].IndexUUID != "iu1" {
+		t.Errorf("expected the lean plan to round trip,"+
+			" planPIndexes2: %#v, err: %v", planPIndexes2, err)
+	}
+
+	dirs := map[string]bool{}
+	for _, e := range kv.List(CfgMetaKvPrefix + "planPIndexesLean/") {
+		dirs[e.Path[:strings.LastIndex(e.Path, "/")]] = true
+	}
+	if len(dirs) != 1 {
+		t.Errorf("expected the orphaned plan to be purged, dirs: %v", dirs)
+	}
+
+	err = c.Del(PLAN_PINDEXES_KEY, 0)
+	if err != nil {
+		t.Errorf("expected no del plan err, err: %v", err)
+	}
+
+	planPIndexes2, _, err = CfgGetPlanPIndexes(c)
+	if err != nil || (planPIndexes2 != nil &&
+		len(planPIndexes2.PlanPIndexes) != 0) {
+		t.Errorf("expected no plan, planPIndexes2: %#v, err: %v",
+			planPIndexes2, err)
+	}
+}
+
+func TestCfgMetaKvMockTxn(t *testing.T) {
+	kv := newMockMetaKvStore()
+	defer kv.Close()
+	c := newMockCfgMetaKv(t, kv, "n0")
+
+	casA, err := c.Set("a", []byte("1"), 0)
+	if err != nil {
+		t.Fatalf("expected no set err, err: %v", err)
+	}
+
+	expectCASError := func(ops []CfgTxnOp) {
+		_, err := c.Txn(ops)
+		if _, ok := err.(*CfgCASError); !ok {
+			t.Errorf("expected a CfgCASError, ops: %+v, err: %v", ops, err)
+		}
+		if val, _, _ := c.Get("b", 0); val != nil {
+			t.Errorf("expected no partial write, ops: %+v", ops)
+		}
+	}
+
+	setB := CfgTxnOp{Op: CFG_TXN_OP_SET, Key: "b", Val: []byte("2")}
+
+	expectCASError([]CfgTxnOp{
+		{Op: CFG_TXN_OP_CHECK, Key: "a", CAS: casA + 1}, setB,
+	})
+	expectCASError([]CfgTxnOp{
+		{Op: CFG_TXN_OP_CHECK, Key: "a", CAS: 0}, setB,
+	})
+	expectCASError([]CfgTxnOp{
+		setB, {Op: CFG_TXN_OP_SET, Key: "a", Val: []byte("3"), CAS: casA + 1},
+	})
+
+	casSuccess, err := c.Txn([]CfgTxnOp{
+		{Op: CFG_TXN_OP_CHECK, Key: "a", CAS: casA},
+		{Op: CFG_TXN_OP_CHECK, Key: "missing", CAS: 0},
+		setB,
+	})
+	if err != nil || len(casSuccess) != 3 {
+		t.Fatalf("expected txn to work, err: %v", err)
+	}
+
+	val, casB, _ := c.Get("b", 0)
+	if string(val) != "2" || casB != casSuccess[2] {
+		t.Errorf("expected b to be set, val: %s, casB: %x, casSuccess: %v",
+			val, casB, casSuccess)
+	}
+
+	if n := len(kv.List(c.keyToPath(cfgMetaKvTxnKey) + "/")); n != 0 {
+		t.Errorf("expected no intent records, n: %d", n)
+	}
+	if kv.Store.Get(c.keyToPath(cfgMetaKvTxnLockKey)) != nil {
+		t.Errorf("expected the txn lock to be released")
+	}
+}
+
+func TestCfgMetaKvMockTxnRollForward(t *testing.T) {
+	kv := newMockMetaKvStore()
+	defer kv.Close()
+	c0 := newMockCfgMetaKv(t, kv, "n0")
+	c1 := newMockCfgMetaKv(t, kv, "n1")
+
+	casX0, _ := c0.Set("x", []byte("x0"), 0)
+	casZ0, _ := c0.Set("z", []byte("z0"), 0)
+
+	// An intent record of n0, which crashed after writing only x,
+	// and where z was changed by another txn afterwards.
+	record := &cfgMetaKvTxnRecord{
+		NodeUUID: "n0",
+		Ops: []CfgTxnOp{
+			{Op: CFG_TXN_OP_SET, Key: "x", Val: []byte("x1")},
+			{Op: CFG_TXN_OP_SET, Key: "y", Val: []byte("y1")},
+			{Op: CFG_TXN_OP_SET, Key: "z", Val: []byte("z1")},
+		},
+		Prevs: []uint64{casX0, 0, casZ0},
+	}
+	buf, _ := json.Marshal(record)
+	kv.Add(c0.keyToPath(cfgMetaKvTxnKey)+"/t0", buf)
+
+	c0.Set("x", []byte("x1"), 0)
+	c0.Set("z", []byte("z2"), 0)
+
+	// Another node rolls forward the txn on its next txn.
+	_, err := c1.Txn([]CfgTxnOp{{Op: CFG_TXN_OP_SET, Key: "w", Val: []byte("w1")}})
+	if err != nil {
+		t.Fatalf("expected txn to work, err: %v", err)
+	}
+
+	for key, exp := range map[string]string{
+		"x": "x1", "y": "y1", "z": "z2", "w": "w1",
+	} {
+		val, _, _ := c1.Get(key, 0)
+		if string(val) != exp {
+			t.Errorf("expected key: %s, val: %s, got: %s", key, exp, val)
+		}
+	}
+
+	if n := len(kv.List(c1.keyToPath(cfgMetaKvTxnKey) + "/")); n != 0 {
+		t.Errorf("expected the intent record to be removed, n: %d", n)
+	}
+}
+
+func TestCfgMetaKvMockTxnLock(t *testing.T) {
+	kv := newMockMetaKvStore()
+	defer kv.Close()
+	c := newMockCfgMetaKv(t, kv, "n0")
+
+	lockTimeout := CfgMetaKvTxnLockTimeout
+	defer func() { CfgMetaKvTxnLockTimeout = lockTimeout }()
+	CfgMetaKvTxnLockTimeout = 50 * time.Millisecond
+
+	// A lock left behind by a crashed node.
+	lockPath := c.keyToPath(cfgMetaKvTxnLockKey)
+	kv.Add(lockPath, []byte(`{"nodeUUID":"n1","lockId":"l1"}`))
+
+	// An intent record, which is not rolled forward while locked.
+	record := &cfgMetaKvTxnRecord{
+		NodeUUID: "n1",
+		Ops:      []CfgTxnOp{{Op: CFG_TXN_OP_SET, Key: "y", Val: []byte("y1")}},
+		Prevs:    []uint64{0},
+	}
+	buf, _ := json.Marshal(record)
+	kv.Add(c.keyToPath(cfgMetaKvTxnKey)+"/t0", buf)
+
+	c.Load()
+	if val, _, _ := c.Get("y", 0); val != nil {
+		t.Errorf("expected no roll forward while locked, val: %s", val)
+	}
+
+	_, err := c.Txn([]CfgTxnOp{{Op: CFG_TXN_OP_SET, Key: "x", Val: []byte("x1")}})
+	if err != nil {
+		t.Fatalf("expected the abandoned lock to be taken over, err: %v", err)
+	}
+
+	if val, _, _ := c.Get("y", 0); string(val) != "y1" {
+		t.Errorf("expected a roll forward, val: %s", val)
+	}
+	if kv.Store.Get(lockPath) != nil {
+		t.Errorf("expected the txn lock to be released")
+	}
+}
+
+func TestCfgMetaKvMockTxnLockRefresh(t *testing.T) {
+	kv := newMockMetaKvStore()
+	defer kv.Close()
+	c0 := newMockCfgMetaKv(t, kv, "n0")
+	c1 := newMockCfgMetaKv(t, kv, "n1")
+
+	lockTimeout := CfgMetaKvTxnLockTimeout
+	defer func() { CfgMetaKvTxnLockTimeout = lockTimeout }()
+	CfgMetaKvTxnLockTimeout = 40 * time.Millisecond
+
+	held, err := c0.lockTxn(CfgMetaKvTxnLockTimeout)
+	if err != nil {
+		t.Fatalf("expected lock to work, err: %v", err)
+	}
+
+	// A plain set doesn't wait for the txn lock.
+	_, err = c1.Set("a", []byte("1"), 0)
+	if err != nil {
+		t.Errorf("expected the set to work while locked, err: %v", err)
+	}
+
+	txnDone := make(chan error, 1)
+	go func() {
+		_, err := c1.Txn([]CfgTxnOp{
+			{Op: CFG_TXN_OP_SET, Key: "b", Val: []byte("2")},
+		})
+		txnDone <- err
+	}()
+
+	// A refreshed lock isn't taken over, even after the timeout.
+	select {
+	case err = <-txnDone:
+		t.Fatalf("expected the txn to wait for the lock, err: %v", err)
+	case <-time.After(5 * CfgMetaKvTxnLockTimeout):
+	}
+
+	// The waiting txn doesn't block the gets of its node.
+	if val, _, _ := c1.Get("a", 0); string(val) != "1" {
+		t.Errorf("expected a to be set, val: %s", val)
+	}
+
+	c0.unlockTxn(held)
+
+	err = <-txnDone
+	if err != nil {
+		t.Errorf("expected the txn to work after the unlock, err: %v", err)
+	}
+	if val, _, _ := c0.Get("b", 0); string(val) != "2" {
+		t.Errorf("expected b to be set, val: %s", val)
+	}
+}
+
+func TestCfgMetaKvMockTxnLockLost(t *testing.T) {
+	kv := newMockMetaKvStore()
+	defer kv.Close()
+	c := newMockCfgMetaKv(t, kv, "n0")
+
+	held, err := c.lockTxn(CfgMetaKvTxnLockTimeout)
+	if err != nil {
+		t.Fatalf("expected lock to work, err: %v", err)
+	}
+
+	// Another node took over the lock while this node was stalled.
+	lockPath := c.keyToPath(cfgMetaKvTxnLockKey)
+	kv.Set(lockPath, []byte(`{"nodeUUID":"n1","lockId":"l1"}`), nil)
+
+	c.m.Lock()
+	_, err = c.applyTxnLOCKED(held, []CfgTxnOp{
+		{Op: CFG_TXN_OP_SET, Key: "a", Val: []byte("1")},
+	})
+	if err == nil {
+		t.Errorf("expected a txn write without the lock to fail")
+	}
+	if val, _, _ := c.getLOCKED("a", 0); val != nil {
+		t.Errorf("expected no write, val: %s", val)
+	}
+	c.m.Unlock()
+
+	// The lock of the other node is not released.
+	c.unlockTxn(held)
+	if kv.Store.Get(lockPath) == nil {
+		t.Errorf("expected the other node's lock to remain")
+	}
+}
+
+func TestCfgMetaKvMockCAS(t *testing.T) {
+	kv := newMockMetaKvStore()
+	defer kv.Close()
+	c := newMockCfgMetaKv(t, kv, "n0")
+
+	if cfgMetaKvRevCAS(nil) != 0 {
+		t.Errorf("expected a CAS of 0 for a missing value")
+	}
+
+	cas1, _ := c.Set("a", []byte("1"), 0)
+	_, casGet, _ := c.Get("a", 0)
+	if cas1 == 0 || cas1 == CFG_CAS_FORCE || cas1 != casGet {
+		t.Errorf("expected the set and get CAS to match, cas1: %x,"+
+			" casGet: %x", cas1, casGet)
+	}
+
+	// The CAS follows the metakv rev, so even a rewrite of the same
+	// value has a different CAS.
+	casSame, err := c.Set("a", []byte("1"), cas1)
+	if err != nil || casSame == cas1 {
+		t.Errorf("expected a rev based CAS, cas1: %x, casSame: %x,"+
+			" err: %v", cas1, casSame, err)
+	}
+
+	_, err = c.Set("a", []byte("2"), cas1)
+	if _, ok := err.(*CfgCASError); !ok {
+		t.Errorf("expected a CfgCASError for a stale set, err: %v", err)
+	}
+	err = c.Del("a", cas1)
+	if _, ok := err.(*CfgCASError); !ok {
+		t.Errorf("expected a CfgCASError for a stale del, err: %v", err)
+	}
+
+	_, err = c.Txn([]CfgTxnOp{{Op: CFG_TXN_OP_CHECK, Key: "a", CAS: cas1}})
+	if _, ok := err.(*CfgCASError); !ok {
+		t.Errorf("expected a CfgCASError for a changed value, err: %v", err)
+	}
+
+	_, err = c.Txn([]CfgTxnOp{{Op: CFG_TXN_OP_CHECK, Key: "a", CAS: casSame}})
+	if err != nil {
+		t.Errorf("expected a check of the current CAS to work, err: %v", err)
+	}
+
+	err = c.Del("a", casSame)
+	if err != nil {
+		t.Errorf("expected a del of the current CAS to work, err: %v", err)
+	}
+	if val, cas, _ := c.Get("a", 0); val != nil || cas != 0 {
+		t.Errorf("expected a to be deleted, val: %s, cas: %x", val, cas)
+	}
+}
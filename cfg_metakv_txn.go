@@ -0,0 +1,484 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbase/cbauth/metakv"
+)
+
+// metakv has no multi-key transactions, so CfgMetaKv.Txn() works in
+// three steps, while holding a cluster wide txn lock entry...
+//
+// 1. All the "check" ops and the CAS values of the other ops are
+//    checked against the current values, before anything's written.
+//
+// 2. The ops are recorded as an intent record under the
+//    cfgMetaKvTxnKey directory, along with the CAS that each op's
+//    key had before the txn.
+//
+// 3. The ops are applied, and then the intent record is removed.
+//
+// If a node fails part way through step 3, the leftover intent
+// record is rolled forward by the next Txn() or Load() of any node,
+// where only the ops whose keys still have their before-txn CAS are
+// applied, so that the txn is eventually all-or-nothing without
+// undoing the later changes of others.
+//
+// Only Txn() takes the txn lock, so the txns of the nodes are
+// serialized, while Set() and Del() are single key writes that are
+// made conditional on the metakv rev of the key instead, like the
+// writes of the nodes of earlier versions.  The holder refreshes the
+// lock entry, so that only the lock of a crashed or stalled node is
+// taken over, and the holder verifies that it still holds the lock
+// before each write.  As metakv has no conditional writes across
+// keys, a holder that stalls between that verification and its
+// write can still overlap with the next holder.
+
+const cfgMetaKvTxnKey = "txn"
+
+const cfgMetaKvTxnLockKey = "txnLock"
+
+// CfgMetaKvTxnLockTimeout is how long a Txn() waits for an unchanged
+// txn lock entry, such as one left behind by a crashed node, before
+// taking over the lock.  The holder refreshes the entry 4 times
+// within the timeout.
+var CfgMetaKvTxnLockTimeout = 10 * time.Second
+
+type cfgMetaKvTxnRecord struct {
+	NodeUUID string     `json:"nodeUUID"`
+	Ops      []CfgTxnOp `json:"ops"`
+	Prevs    []uint64   `json:"prevs"` // The CAS of each op's key before the txn.
+}
+
+type cfgMetaKvTxnLock struct {
+	NodeUUID  string `json:"nodeUUID"`
+	LockId    string `json:"lockId"`
+	Refreshes uint64 `json:"refreshes,omitempty"`
+}
+
+// cfgMetaKvTxnLockHeld tracks the txn lock of this node while it's
+// held, along with the goroutine that refreshes the lock entry.
+type cfgMetaKvTxnLockHeld struct {
+	lockId string
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+// Txn implements the CfgTxn interface.  The CAS values are those
+// returned by Get(), and like with Set(), a CAS of 0 for a "set" or
+// "del" op means the op is not checked.
+func (c *CfgMetaKv) Txn(ops []CfgTxnOp) ([]uint64, error) {
+	log.Printf("cfg_metakv: Txn, ops: %d, nodeUUID: %s",
+		len(ops), c.nodeUUID)
+
+	for _, op := range ops {
+		if op.Op != CFG_TXN_OP_SET &&
+			op.Op != CFG_TXN_OP_DEL &&
+			op.Op != CFG_TXN_OP_CHECK {
+			return nil, fmt.Errorf("cfg_metakv: unknown txn op: %q,"+
+				" key: %s", op.Op, op.Key)
+		}
+	}
+
+	// The txn lock is waited for without holding c.m, so that the
+	// Get(), Set() and Del() of this node aren't blocked meanwhile.
+	held, err := c.lockTxn(CfgMetaKvTxnLockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.unlockTxn(held)
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	err = c.recoverTxnsLOCKED(held)
+	if err != nil {
+		return nil, err
+	}
+
+	prevs := make([]uint64, len(ops))
+	curCASs := map[string]uint64{}
+
+	// The keys that an earlier op of the txn sets, whose CAS can't be
+	// known ahead of the write, so that no CAS of a later op matches.
+	setKeys := map[string]bool{}
+
+	for i, op := range ops {
+		cur, exists := curCASs[op.Key]
+		if !exists {
+			_, cur, err = c.getLOCKED(op.Key, 0)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		prevs[i] = cur
+
+		if op.Op == CFG_TXN_OP_CHECK && op.CAS == 0 {
+			if cur != 0 || setKeys[op.Key] {
+				log.Warnf("cfg_metakv: Txn, key: %v, exists", op.Key)
+
+				return nil, &CfgCASError{}
+			}
+		} else if op.CAS != 0 && op.CAS != CFG_CAS_FORCE &&
+			(op.CAS != cur || setKeys[op.Key]) {
+			log.Warnf("cfg_metakv: Txn, key: %v, cas mismatch: %x != %x",
+				op.Key, op.CAS, cur)
+
+			return nil, &CfgCASError{}
+		}
+
+		switch op.Op {
+		case CFG_TXN_OP_SET:
+			setKeys[op.Key] = true
+			curCASs[op.Key] = cur
+		case CFG_TXN_OP_DEL:
+			delete(setKeys, op.Key)
+			curCASs[op.Key] = 0
+		default:
+			curCASs[op.Key] = cur
+		}
+	}
+
+	record := &cfgMetaKvTxnRecord{NodeUUID: c.nodeUUID, Ops: ops, Prevs: prevs}
+
+	buf, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.verifyTxnLock(held)
+	if err != nil {
+		return nil, err
+	}
+
+	path := c.keyToPath(cfgMetaKvTxnKey) + "/" + NewUUID()
+
+	err = c.kv.Add(path, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	casSuccess, err := c.applyTxnLOCKED(held, ops)
+	if err != nil {
+		// The intent record is left in place, to be rolled forward.
+		return nil, fmt.Errorf("cfg_metakv: Txn incomplete, path: %s,"+
+			" err: %v", path, err)
+	}
+
+	err = c.kv.Delete(path, nil)
+	if err != nil {
+		log.Warnf("cfg_metakv: Txn, could not remove intent record,"+
+			" path: %s, err: %v", path, err)
+	}
+
+	return casSuccess, nil
+}
+
+// applyTxnLOCKED applies the "set" and "del" ops, whose CAS values
+// were already checked, so the CAS values are only passed through
+// when they're CFG_CAS_FORCE, which a split set treats specially.
+// The txn lock is verified to be still held before each op.
+func (c *CfgMetaKv) applyTxnLOCKED(held *cfgMetaKvTxnLockHeld,
+	ops []CfgTxnOp) ([]uint64, error) {
+	casSuccess := make([]uint64, len(ops))
+
+	for i, op := range ops {
+		if op.Op == CFG_TXN_OP_CHECK {
+			continue
+		}
+
+		err := c.verifyTxnLock(held)
+		if err != nil {
+			return nil, err
+		}
+
+		cas := uint64(0)
+		if op.CAS == CFG_CAS_FORCE {
+			cas = CFG_CAS_FORCE
+		}
+
+		switch op.Op {
+		case CFG_TXN_OP_SET:
+			casSuccess[i], err = c.setLOCKED(op.Key, op.Val, cas)
+		case CFG_TXN_OP_DEL:
+			err = c.delLOCKED(op.Key, cas)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return casSuccess, nil
+}
+
+// recoverTxnsLOCKED rolls forward the intent records that were left
+// behind by any node, and must be invoked while holding the txn lock.
+func (c *CfgMetaKv) recoverTxnsLOCKED(held *cfgMetaKvTxnLockHeld) error {
+	children, err := c.kv.ListAllChildren(
+		c.keyToPath(cfgMetaKvTxnKey) + "/")
+	if err != nil {
+		return err
+	}
+
+	for _, child := range children {
+		var record cfgMetaKvTxnRecord
+
+		err = json.Unmarshal(child.Value, &record)
+		if err != nil || len(record.Prevs) != len(record.Ops) {
+			log.Warnf("cfg_metakv: recoverTxns, skipping bad intent record,"+
+				" path: %s, err: %v", child.Path, err)
+			continue
+		}
+
+		log.Printf("cfg_metakv: recoverTxns, rolling forward, path: %s,"+
+			" nodeUUID: %s", child.Path, record.NodeUUID)
+
+		err = c.recoverTxnLOCKED(held, &record)
+		if err != nil {
+			return err
+		}
+
+		err = c.kv.Delete(child.Path, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recoverTxnLOCKED applies the ops of an intent record to the keys
+// that still have their before-txn CAS.  The other keys were either
+// already written by the txn or were changed after it, and are left
+// alone.
+func (c *CfgMetaKv) recoverTxnLOCKED(held *cfgMetaKvTxnLockHeld,
+	record *cfgMetaKvTxnRecord) error {
+	c.txnNodeUUID = record.NodeUUID
+	defer func() { c.txnNodeUUID = "" }()
+
+	applied := map[string]bool{}
+	skipped := map[string]bool{}
+
+	for i, op := range record.Ops {
+		if op.Op == CFG_TXN_OP_CHECK || skipped[op.Key] {
+			continue
+		}
+
+		if !applied[op.Key] {
+			_, cur, err := c.getLOCKED(op.Key, 0)
+			if err != nil {
+				return err
+			}
+
+			if cur != record.Prevs[i] {
+				log.Printf("cfg_metakv: recoverTxns, skipping key: %s,"+
+					" cas: %x != %x", op.Key, cur, record.Prevs[i])
+
+				skipped[op.Key] = true
+				continue
+			}
+
+			applied[op.Key] = true
+		}
+
+		_, err := c.applyTxnLOCKED(held, []CfgTxnOp{op})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lockTxn acquires the cluster wide txn lock, waiting for it up to
+// the given timeout, after which an unchanged lock entry is
+// considered abandoned and is taken over.  lockTxn must be invoked
+// without holding c.m.
+func (c *CfgMetaKv) lockTxn(timeout time.Duration) (
+	*cfgMetaKvTxnLockHeld, error) {
+	lockId := NewUUID()
+
+	buf, err := json.Marshal(&cfgMetaKvTxnLock{
+		NodeUUID: c.nodeUUID,
+		LockId:   lockId,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	path := c.keyToPath(cfgMetaKvTxnLockKey)
+
+	var heldBuf []byte
+	var heldSince time.Time
+
+	for {
+		errAdd := c.kv.Add(path, buf)
+		if errAdd == nil {
+			return c.holdTxnLock(lockId), nil
+		}
+
+		v, rev, err := c.kv.Get(path)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			if errAdd != metakv.ErrRevMismatch {
+				return nil, errAdd
+			}
+			continue // The lock was just released.
+		}
+
+		if heldBuf == nil || string(v) != string(heldBuf) {
+			heldBuf, heldSince = v, time.Now()
+		} else if time.Since(heldSince) >= timeout {
+			log.Warnf("cfg_metakv: Txn, taking over the txn lock: %s", v)
+
+			c.kv.Delete(path, rev)
+			continue
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// tryLockTxn is like lockTxn, but without any waiting.
+func (c *CfgMetaKv) tryLockTxn() (*cfgMetaKvTxnLockHeld, bool) {
+	lockId := NewUUID()
+
+	buf, err := json.Marshal(&cfgMetaKvTxnLock{
+		NodeUUID: c.nodeUUID,
+		LockId:   lockId,
+	})
+	if err != nil {
+		return nil, false
+	}
+
+	err = c.kv.Add(c.keyToPath(cfgMetaKvTxnLockKey), buf)
+	if err != nil {
+		return nil, false
+	}
+
+	return c.holdTxnLock(lockId), true
+}
+
+// holdTxnLock starts refreshing the just acquired txn lock.
+func (c *CfgMetaKv) holdTxnLock(lockId string) *cfgMetaKvTxnLockHeld {
+	held := &cfgMetaKvTxnLockHeld{
+		lockId: lockId,
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}
+
+	go c.refreshTxnLock(held, CfgMetaKvTxnLockTimeout/4)
+
+	return held
+}
+
+// refreshTxnLock rewrites the txn lock entry periodically until it's
+// stopped or until the lock was taken over, so that the lock isn't
+// considered abandoned by the waiters of other nodes.
+func (c *CfgMetaKv) refreshTxnLock(held *cfgMetaKvTxnLockHeld,
+	interval time.Duration) {
+	defer close(held.doneCh)
+
+	path := c.keyToPath(cfgMetaKvTxnLockKey)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for refreshes := uint64(1); ; refreshes++ {
+		select {
+		case <-held.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		v, rev, err := c.kv.Get(path)
+		if err != nil {
+			log.Warnf("cfg_metakv: Txn, could not refresh lock, err: %v", err)
+			continue
+		}
+
+		var lock cfgMetaKvTxnLock
+
+		if v == nil || json.Unmarshal(v, &lock) != nil ||
+			lock.LockId != held.lockId {
+			log.Warnf("cfg_metakv: Txn, lock was taken over, lockId: %s",
+				held.lockId)
+			return
+		}
+
+		lock.Refreshes = refreshes
+
+		buf, err := json.Marshal(&lock)
+		if err == nil {
+			err = c.kv.Set(path, buf, rev)
+		}
+		if err != nil {
+			log.Warnf("cfg_metakv: Txn, could not refresh lock, err: %v", err)
+		}
+	}
+}
+
+// verifyTxnLock returns an error unless the txn lock is still held.
+func (c *CfgMetaKv) verifyTxnLock(held *cfgMetaKvTxnLockHeld) error {
+	v, _, err := c.kv.Get(c.keyToPath(cfgMetaKvTxnLockKey))
+	if err != nil {
+		return err
+	}
+
+	var lock cfgMetaKvTxnLock
+
+	if v == nil || json.Unmarshal(v, &lock) != nil ||
+		lock.LockId != held.lockId {
+		return fmt.Errorf("cfg_metakv: txn lock was taken over,"+
+			" lockId: %s, lock: %s", held.lockId, v)
+	}
+
+	return nil
+}
+
+// unlockTxn releases the txn lock, unless it was taken over.
+func (c *CfgMetaKv) unlockTxn(held *cfgMetaKvTxnLockHeld) {
+	close(held.stopCh)
+	<-held.doneCh
+
+	path := c.keyToPath(cfgMetaKvTxnLockKey)
+
+	v, rev, err := c.kv.Get(path)
+	if err != nil || v == nil {
+		return
+	}
+
+	var lock cfgMetaKvTxnLock
+
+	err = json.Unmarshal(v, &lock)
+	if err == nil && lock.LockId == held.lockId {
+		err = c.kv.Delete(path, rev)
+	}
+	if err != nil {
+		log.Warnf("cfg_metakv: Txn, could not unlock, err: %v", err)
+	}
+}
+
+func isCfgMetaKvTxnPath(c *CfgMetaKv, path string) bool {
+	return strings.HasPrefix(path, c.keyToPath(cfgMetaKvTxnKey)+"/") ||
+		path == c.keyToPath(cfgMetaKvTxnLockKey)
+}
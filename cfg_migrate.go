@@ -0,0 +1,353 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/couchbase/clog"
+)
+
+// CFG_MIGRATIONS_KEY is the Cfg key that records which CfgMigration
+// steps have been applied.
+const CFG_MIGRATIONS_KEY = "cfgMigrations"
+
+// A CfgMigration is a step that upgrades the JSON of stored
+// definitions to the shape expected by a given ImplVersion, such as
+// when a field of IndexDef, PlanPIndex or NodeDef is renamed or
+// restructured.  A step is applied just once per Cfg, after the
+// Cfg's version (the VERSION_KEY) has reached the step's ImplVersion,
+// which means every node of the cluster is at least at that version.
+//
+// Each func is optional and transforms a single definition, as a
+// generic JSON object (where numbers are json.Number's), in place,
+// returning true if it changed the definition.  As definitions might
+// already have been written in the new shape by upgraded nodes, or
+// (for a Cfg provider without CfgTxn support) a step might be
+// interrupted and retried, a step must be idempotent.
+type CfgMigration struct {
+	Name        string // Unique name of the step.
+	ImplVersion string // See VERSION.
+
+	IndexDef   func(indexDef map[string]interface{}) (bool, error)
+	PlanPIndex func(planPIndex map[string]interface{}) (bool, error)
+	NodeDef    func(nodeDef map[string]interface{}) (bool, error)
+}
+
+// CfgMigrations is the registry of CfgMigration steps, ordered by
+// ImplVersion and then by registration order.
+var CfgMigrations []*CfgMigration
+
+// RegisterCfgMigration adds a CfgMigration step to the registry,
+// replacing any step of the same name.  This is usually called
+// during an init() function.
+func RegisterCfgMigration(m *CfgMigration) {
+	UnregisterCfgMigration(m.Name)
+
+	i := 0
+	for i < len(CfgMigrations) &&
+		VersionGTE(m.ImplVersion, CfgMigrations[i].ImplVersion) {
+		i++
+	}
+
+	CfgMigrations = append(CfgMigrations, nil)
+	copy(CfgMigrations[i+1:], CfgMigrations[i:])
+	CfgMigrations[i] = m
+}
+
+// UnregisterCfgMigration removes a CfgMigration step from the registry.
+func UnregisterCfgMigration(name string) {
+	for i, m := range CfgMigrations {
+		if m.Name == name {
+			CfgMigrations = append(CfgMigrations[:i], CfgMigrations[i+1:]...)
+			return
+		}
+	}
+}
+
+// CfgMigrationsApplied is the value of the CFG_MIGRATIONS_KEY.
+type CfgMigrationsApplied struct {
+	Applied map[string]*CfgMigrationApplied `json:"applied"` // Keyed by name.
+}
+
+// A CfgMigrationApplied records when a CfgMigration was applied.
+type CfgMigrationApplied struct {
+	ImplVersion string    `json:"implVersion"`
+	Applied     time.Time `json:"applied"`
+}
+
+// A CfgMigrateResult describes the steps applied (or, for a dry run,
+// to be applied) by CfgMigrate().
+type CfgMigrateResult struct {
+	Version string                  `json:"version"` // The Cfg's version.
+	Steps   []*CfgMigrateStepResult `json:"steps"`
+}
+
+// A CfgMigrateStepResult has the number of definitions changed by a
+// step, keyed by Cfg key.
+type CfgMigrateStepResult struct {
+	Name        string         `json:"name"`
+	ImplVersion string         `json:"implVersion"`
+	Changed     map[string]int `json:"changed"`
+}
+
+// cfgMigrationKeys are the Cfg keys of the definitions that are
+// migrated, with the JSON field of each key's definitions.
+var cfgMigrationKeys = []struct {
+	key    string
+	field  string
+	stepFn func(m *CfgMigration) func(map[string]interface{}) (bool, error)
+}{
+	{INDEX_DEFS_KEY, "indexDefs",
+		func(m *CfgMigration) func(map[string]interface{}) (bool, error) {
+			return m.IndexDef
+		}},
+	{CfgNodeDefsKey(NODE_DEFS_KNOWN), "nodeDefs",
+		func(m *CfgMigration) func(map[string]interface{}) (bool, error) {
+			return m.NodeDef
+		}},
+	{CfgNodeDefsKey(NODE_DEFS_WANTED), "nodeDefs",
+		func(m *CfgMigration) func(map[string]interface{}) (bool, error) {
+			return m.NodeDef
+		}},
+	{PLAN_PINDEXES_KEY, "planPIndexes",
+		func(m *CfgMigration) func(map[string]interface{}) (bool, error) {
+			return m.PlanPIndex
+		}},
+}
+
+// ------------------------------------------------------------------------
+
+// CfgMigrationApply applies a single CfgMigration step to the stored
+// value of a Cfg key, returning the new value and the number of
+// changed definitions.  When no definitions are changed, the
+// original value is returned.  This is the building block of
+// CfgMigrate(), and is also useful for testing individual steps.
+func CfgMigrationApply(m *CfgMigration, key string, val []byte) (
+	[]byte, int, error) {
+	if val == nil {
+		return nil, 0, nil
+	}
+
+	for _, k := range cfgMigrationKeys {
+		if k.key != key {
+			continue
+		}
+
+		fn := k.stepFn(m)
+		if fn == nil {
+			return val, 0, nil
+		}
+
+		var doc map[string]interface{}
+
+		d := json.NewDecoder(bytes.NewReader(val))
+		d.UseNumber()
+		err := d.Decode(&doc)
+		if err != nil {
+			return nil, 0, fmt.Errorf("cfg_migrate: could not parse,"+
+				" key: %s, err: %v", key, err)
+		}
+
+		defs, _ := doc[k.field].(map[string]interface{})
+
+		changed := 0
+		for name, v := range defs {
+			def, ok := v.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			c, err := fn(def)
+			if err != nil {
+				return nil, 0, fmt.Errorf("cfg_migrate: step: %s,"+
+					" key: %s, name: %s, err: %v", m.Name, key, name, err)
+			}
+			if c {
+				changed++
+			}
+		}
+
+		if changed == 0 {
+			return val, 0, nil
+		}
+
+		// The definitions are now in the step's shape.
+		implVersion, _ := doc["implVersion"].(string)
+		if !VersionGTE(implVersion, m.ImplVersion) {
+			doc["implVersion"] = m.ImplVersion
+		}
+
+		rv, err := json.Marshal(doc)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		return rv, changed, nil
+	}
+
+	return nil, 0, fmt.Errorf("cfg_migrate: unsupported key: %s", key)
+}
+
+// CfgMigrate applies the registered CfgMigration steps that have not
+// yet been applied to the Cfg and whose ImplVersion has been reached
+// by the Cfg's version.  The steps are applied in order, and the
+// changed definitions are saved together with the record of the
+// applied steps, atomically if the Cfg supports CfgTxn.  With dryRun,
+// the Cfg is not changed.
+func CfgMigrate(cfg Cfg, dryRun bool) (*CfgMigrateResult, error) {
+	if len(CfgMigrations) == 0 {
+		return &CfgMigrateResult{}, nil
+	}
+
+	for tries := 0; tries < 100; tries++ {
+		res, err := cfgMigrate(cfg, dryRun)
+		if err != nil {
+			if _, ok := err.(*CfgCASError); ok {
+				// Retry as another node might be migrating.
+				continue
+			}
+			return nil, err
+		}
+
+		return res, nil
+	}
+
+	return nil, fmt.Errorf("cfg_migrate: CfgMigrate too many tries")
+}
+
+func cfgMigrate(cfg Cfg, dryRun bool) (*CfgMigrateResult, error) {
+	v, _, err := cfg.Get(VERSION_KEY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &CfgMigrateResult{Version: string(v)}
+	if v == nil {
+		return res, nil
+	}
+
+	appliedVal, appliedCAS, err := cfg.Get(CFG_MIGRATIONS_KEY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := &CfgMigrationsApplied{}
+	if appliedVal != nil {
+		err = json.Unmarshal(appliedVal, applied)
+		if err != nil {
+			return nil, fmt.Errorf("cfg_migrate: could not parse,"+
+				" key: %s, err: %v", CFG_MIGRATIONS_KEY, err)
+		}
+	}
+	if applied.Applied == nil {
+		applied.Applied = map[string]*CfgMigrationApplied{}
+	}
+
+	var pending []*CfgMigration
+	for _, m := range CfgMigrations {
+		if applied.Applied[m.Name] == nil &&
+			VersionGTE(res.Version, m.ImplVersion) {
+			pending = append(pending, m)
+		}
+	}
+	if len(pending) == 0 {
+		return res, nil
+	}
+
+	vals := map[string][]byte{}
+	cass := map[string]uint64{}
+	changed := map[string]bool{}
+
+	for _, k := range cfgMigrationKeys {
+		vals[k.key], cass[k.key], err = cfg.Get(k.key, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+
+	for _, m := range pending {
+		stepRes := &CfgMigrateStepResult{
+			Name:        m.Name,
+			ImplVersion: m.ImplVersion,
+			Changed:     map[string]int{},
+		}
+
+		for _, k := range cfgMigrationKeys {
+			val, n, err := CfgMigrationApply(m, k.key, vals[k.key])
+			if err != nil {
+				return nil, err
+			}
+			if n > 0 {
+				vals[k.key] = val
+				changed[k.key] = true
+				stepRes.Changed[k.key] = n
+			}
+		}
+
+		res.Steps = append(res.Steps, stepRes)
+
+		applied.Applied[m.Name] = &CfgMigrationApplied{
+			ImplVersion: m.ImplVersion,
+			Applied:     now,
+		}
+	}
+
+	if dryRun {
+		return res, nil
+	}
+
+	appliedVal, err = json.Marshal(applied)
+	if err != nil {
+		return nil, err
+	}
+
+	// The record of the applied steps is last, so that without CfgTxn
+	// support an interrupted migration is retried.
+	var ops []CfgTxnOp
+	for _, k := range cfgMigrationKeys {
+		if changed[k.key] {
+			ops = append(ops, CfgTxnOp{
+				Op: CFG_TXN_OP_SET, Key: k.key, Val: vals[k.key], CAS: cass[k.key],
+			})
+		}
+	}
+	ops = append(ops, CfgTxnOp{
+		Op: CFG_TXN_OP_SET, Key: CFG_MIGRATIONS_KEY, Val: appliedVal, CAS: appliedCAS,
+	})
+
+	if cfgTxn, ok := cfg.(CfgTxn); ok {
+		_, err = cfgTxn.Txn(ops)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		for _, op := range ops {
+			_, err = cfg.Set(op.Key, op.Val, op.CAS)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, stepRes := range res.Steps {
+		log.Printf("cfg_migrate: applied step: %s, implVersion: %s,"+
+			" changed: %v", stepRes.Name, stepRes.ImplVersion, stepRes.Changed)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,226 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// testCfgMigrationRenameType is an example step, which renames an
+// index type of the index definitions and plans.
+func testCfgMigrationRenameType(name, implVersion,
+	from, to string, calls *int) *CfgMigration {
+	return &CfgMigration{
+		Name:        name,
+		ImplVersion: implVersion,
+		IndexDef: func(indexDef map[string]interface{}) (bool, error) {
+			*calls++
+			if indexDef["type"] != from {
+				return false, nil
+			}
+			indexDef["type"] = to
+			return true, nil
+		},
+		PlanPIndex: func(planPIndex map[string]interface{}) (bool, error) {
+			if planPIndex["indexType"] != from {
+				return false, nil
+			}
+			planPIndex["indexType"] = to
+			return true, nil
+		},
+	}
+}
+
+// testCfgNoTxn hides the CfgTxn support of a Cfg.
+type testCfgNoTxn struct {
+	Cfg
+}
+
+func TestRegisterCfgMigration(t *testing.T) {
+	defer func(m []*CfgMigration) { CfgMigrations = m }(CfgMigrations)
+	CfgMigrations = nil
+
+	for _, m := range []*CfgMigration{
+		{Name: "c", ImplVersion: "2.0.0"},
+		{Name: "a", ImplVersion: "1.0.0"},
+		{Name: "b", ImplVersion: "1.0.0"},
+		{Name: "d", ImplVersion: "1.5.0"},
+		{Name: "c", ImplVersion: "0.5.0"},
+	} {
+		RegisterCfgMigration(m)
+	}
+
+	var names string
+	for _, m := range CfgMigrations {
+		names += m.Name
+	}
+	if names != "cabd" {
+		t.Errorf("expected steps in version order, got: %s", names)
+	}
+
+	UnregisterCfgMigration("a")
+	if len(CfgMigrations) != 3 || CfgMigrations[1].Name != "b" {
+		t.Errorf("expected unregister to work")
+	}
+}
+
+func TestCfgMigrationApply(t *testing.T) {
+	calls := 0
+	m := testCfgMigrationRenameType("rename", "1.0.0", "old", "new", &calls)
+
+	indexDefs := NewIndexDefs("0.9.0")
+	indexDefs.IndexDefs["a"] = &IndexDef{Type: "old", Name: "a", UUID: "a0",
+		Params: `{"n":10}`}
+	indexDefs.IndexDefs["b"] = &IndexDef{Type: "other", Name: "b", UUID: "b0"}
+	val, _ := json.Marshal(indexDefs)
+
+	val2, n, err := CfgMigrationApply(m, INDEX_DEFS_KEY, val)
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 change, n: %d, err: %v", n, err)
+	}
+
+	indexDefs2 := &IndexDefs{}
+	json.Unmarshal(val2, indexDefs2)
+	if indexDefs2.IndexDefs["a"].Type != "new" ||
+		indexDefs2.IndexDefs["b"].Type != "other" ||
+		indexDefs2.IndexDefs["a"].Params != `{"n":10}` ||
+		indexDefs2.UUID != indexDefs.UUID ||
+		indexDefs2.ImplVersion != "1.0.0" {
+		t.Errorf("unexpected migrated indexDefs: %s", val2)
+	}
+
+	// Idempotent.
+	val3, n, err := CfgMigrationApply(m, INDEX_DEFS_KEY, val2)
+	if err != nil || n != 0 || string(val3) != string(val2) {
+		t.Errorf("expected no changes on a re-apply, n: %d, err: %v", n, err)
+	}
+
+	// No NodeDef func.
+	nodeDefs, _ := json.Marshal(NewNodeDefs("0.9.0"))
+	val4, n, err := CfgMigrationApply(m,
+		CfgNodeDefsKey(NODE_DEFS_KNOWN), nodeDefs)
+	if err != nil || n != 0 || string(val4) != string(nodeDefs) {
+		t.Errorf("expected no changes to nodeDefs, n: %d, err: %v", n, err)
+	}
+
+	_, _, err = CfgMigrationApply(m, "not-a-key", val)
+	if err == nil {
+		t.Errorf("expected err on an unsupported key")
+	}
+
+	_, _, err = CfgMigrationApply(m, INDEX_DEFS_KEY, []byte("not json"))
+	if err == nil {
+		t.Errorf("expected err on unparsable value")
+	}
+
+	mErr := &CfgMigration{Name: "err", ImplVersion: "1.0.0",
+		IndexDef: func(map[string]interface{}) (bool, error) {
+			return false, fmt.Errorf("oops")
+		}}
+	_, _, err = CfgMigrationApply(mErr, INDEX_DEFS_KEY, val)
+	if err == nil {
+		t.Errorf("expected a step's err")
+	}
+}
+
+func TestCfgMigrate(t *testing.T) {
+	defer func(m []*CfgMigration) { CfgMigrations = m }(CfgMigrations)
+	CfgMigrations = nil
+
+	for _, cfg := range []Cfg{NewCfgMem(), &testCfgNoTxn{NewCfgMem()}} {
+		res, err := CfgMigrate(cfg, false)
+		if err != nil || len(res.Steps) != 0 {
+			t.Errorf("expected no steps without a registry, err: %v", err)
+		}
+
+		calls0, calls1 := 0, 0
+		RegisterCfgMigration(
+			testCfgMigrationRenameType("s0", "0.1.0", "old", "mid", &calls0))
+		RegisterCfgMigration(
+			testCfgMigrationRenameType("s1", "99.0.0", "mid", "new", &calls1))
+
+		indexDefs := NewIndexDefs(VERSION)
+		indexDefs.IndexDefs["a"] = &IndexDef{Type: "old", Name: "a", UUID: "a0"}
+		CfgSetIndexDefs(cfg, indexDefs, 0)
+
+		planPIndexes := NewPlanPIndexes(VERSION)
+		planPIndexes.PlanPIndexes["a_0"] = &PlanPIndex{
+			Name: "a_0", IndexType: "old", IndexName: "a"}
+		CfgSetPlanPIndexes(cfg, planPIndexes, 0)
+
+		// Nothing is applied before the cfg has a version.
+		res, err = CfgMigrate(cfg, false)
+		if err != nil || len(res.Steps) != 0 || calls0 != 0 {
+			t.Errorf("expected no steps without a version, err: %v", err)
+		}
+
+		CheckVersion(cfg, VERSION)
+
+		res, err = CfgMigrate(cfg, true)
+		if err != nil || len(res.Steps) != 1 || res.Steps[0].Name != "s0" ||
+			res.Steps[0].Changed[INDEX_DEFS_KEY] != 1 ||
+			res.Steps[0].Changed[PLAN_PINDEXES_KEY] != 1 {
+			t.Errorf("expected a dry run of s0, res: %#v, err: %v", res, err)
+		}
+		indexDefs, _, _ = CfgGetIndexDefs(cfg)
+		applied, _, _ := cfg.Get(CFG_MIGRATIONS_KEY, 0)
+		if indexDefs.IndexDefs["a"].Type != "old" || applied != nil {
+			t.Errorf("expected a dry run to not change the cfg")
+		}
+
+		// The planner applies pending steps.
+		err = PlannerCheckVersion(cfg, VERSION)
+		if err != nil {
+			t.Errorf("expected PlannerCheckVersion to work, err: %v", err)
+		}
+		indexDefs, _, _ = CfgGetIndexDefs(cfg)
+		planPIndexes, _, _ = CfgGetPlanPIndexes(cfg)
+		if indexDefs.IndexDefs["a"].Type != "mid" ||
+			planPIndexes.PlanPIndexes["a_0"].IndexType != "mid" ||
+			calls1 != 0 {
+			t.Errorf("expected s0 to be applied, indexDefs: %#v", indexDefs)
+		}
+
+		// Exactly once.
+		calls0 = 0
+		res, err = CfgMigrate(cfg, false)
+		if err != nil || len(res.Steps) != 0 || calls0 != 0 {
+			t.Errorf("expected s0 to be applied once, err: %v", err)
+		}
+
+		// Once the cfg version advances, the next step is applied.
+		_, cas, _ := cfg.Get(VERSION_KEY, 0)
+		cfg.Set(VERSION_KEY, []byte("99.0.0"), cas)
+		res, err = CfgMigrate(cfg, false)
+		if err != nil || len(res.Steps) != 1 || res.Steps[0].Name != "s1" ||
+			calls0 != 0 {
+			t.Errorf("expected s1 to be applied, res: %#v, err: %v", res, err)
+		}
+		indexDefs, _, _ = CfgGetIndexDefs(cfg)
+		if indexDefs.IndexDefs["a"].Type != "new" ||
+			indexDefs.ImplVersion != "99.0.0" {
+			t.Errorf("expected s1 to be applied, indexDefs: %#v", indexDefs)
+		}
+
+		applied, _, _ = cfg.Get(CFG_MIGRATIONS_KEY, 0)
+		a := &CfgMigrationsApplied{}
+		json.Unmarshal(applied, a)
+		if len(a.Applied) != 2 || a.Applied["s0"] == nil ||
+			a.Applied["s1"].ImplVersion != "99.0.0" {
+			t.Errorf("expected applied steps to be recorded: %s", applied)
+		}
+
+		CfgMigrations = nil
+	}
+}
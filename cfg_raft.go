@@ -0,0 +1,1391 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/couchbase/clog"
+)
+
+// CfgRaft is an implementation of the Cfg interface that replicates
+// the Cfg key space across a fixed set of cbgt nodes using the Raft
+// consensus protocol, so that a cluster can run without any external
+// configuration service.
+//
+// Every mutation (Set/Del) is appended to a replicated log by the
+// current leader and is applied, in log order, to a CfgMem on every
+// node once a majority of nodes have stored it.  As every node
+// applies the same sequence of operations, CAS values are identical
+// cluster wide.  Get() reads the local, applied state, and Subscribe()
+// fires on every node as entries are applied.
+//
+// Nodes talk to each other through a CfgRaftTransport, where
+// CfgRaftHTTPTransport is used between processes and CfgRaftLoopback
+// is useful for in-process testing.
+type CfgRaft struct {
+	id        string   // This node's id, which is also its address.
+	peers     []string // Ids of the other nodes in the cluster.
+	transport CfgRaftTransport
+	path      string // Persistence file path, or "" for memory-only.
+
+	heartbeat     time.Duration
+	electionMin   time.Duration
+	snapshotEvery uint64
+
+	cfgMem *CfgMem // The applied state machine.
+
+	m sync.Mutex // Protects the fields that follow.
+
+	stopped bool
+	stopCh  chan struct{}
+
+	term     uint64
+	votedFor string
+	state    int
+	leader   string
+
+	log       []*CfgRaftEntry // Entries after the snapshot.
+	snapIndex uint64
+	snapTerm  uint64
+	snapData  []byte // JSON of the CfgMem as of snapIndex.
+
+	// True when the last persist failed, so the term, vote or log
+	// entries in memory may not survive a crash, and nothing is
+	// acked until a retried persist succeeds.
+	unpersisted bool
+
+	// What's already persisted, so that a persist only writes what
+	// changed.  The log file is appended to, and is rewritten after a
+	// compaction or a failed append.
+	metaPersisted      bool
+	persistedTerm      uint64
+	persistedVotedFor  string
+	persistedSnapIndex uint64
+	persistedLogLen    int      // Of the log entries in the log file.
+	logFile            *os.File // Opened for appends.
+	logRewrite         bool
+
+	commitIndex uint64
+	lastApplied uint64
+	appliedCh   chan struct{} // Closed & replaced on every apply.
+
+	lastContact     time.Time
+	electionTimeout time.Duration
+
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	inflight   map[string]bool
+
+	waiters map[uint64]*cfgRaftWaiter // Keyed by log index.
+}
+
+const (
+	cfgRaftFollower = iota
+	cfgRaftCandidate
+	cfgRaftLeader
+)
+
+var cfgRaftStateNames = []string{"follower", "candidate", "leader"}
+
+// CfgRaftProposeTimeout is how long a Set/Del waits for its log
+// entry to be committed and applied.  A CfgRaftHTTPTransport waits
+// longer than this for the response of a forwarded proposal, so the
+// leader's result, rather than a client timeout, reaches the node.
+var CfgRaftProposeTimeout = 10 * time.Second
+
+// ErrCfgRaftNoLeader is returned when a mutation could not be
+// handed to a leader.
+var ErrCfgRaftNoLeader = errors.New("cfg_raft: no leader")
+
+// ErrCfgRaftStopped is returned by a closed CfgRaft.
+var ErrCfgRaftStopped = errors.New("cfg_raft: stopped")
+
+const errCfgRaftNotLeader = "cfg_raft: not leader"
+
+// A CfgRaftEntry is a single operation in the replicated log.
+type CfgRaftEntry struct {
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Op    string `json:"op,omitempty"` // "set", "del", "txn" or "" for a no-op.
+	Key   string `json:"key,omitempty"`
+	Val   []byte `json:"val,omitempty"`
+	CAS   uint64 `json:"cas,omitempty"`
+	ID    string `json:"id,omitempty"` // Matches up proposals and results.
+
+	Ops []CfgTxnOp `json:"ops,omitempty"` // Used by "txn" entries.
+}
+
+// A CfgRaftMsg is the request and response envelope exchanged
+// between CfgRaft nodes.  The Kind of a request is one of "vote",
+// "append", "snapshot", "propose" or "commitIndex".
+type CfgRaftMsg struct {
+	Kind string `json:"kind"`
+	From string `json:"from,omitempty"`
+	Term uint64 `json:"term"`
+
+	// Used by "vote" requests.
+	LastLogIndex uint64 `json:"lastLogIndex,omitempty"`
+	LastLogTerm  uint64 `json:"lastLogTerm,omitempty"`
+
+	// Used by "append" requests.
+	PrevLogIndex uint64          `json:"prevLogIndex,omitempty"`
+	PrevLogTerm  uint64          `json:"prevLogTerm,omitempty"`
+	Entries      []*CfgRaftEntry `json:"entries,omitempty"`
+	LeaderCommit uint64          `json:"leaderCommit,omitempty"`
+
+	// Used by "snapshot" requests.
+	SnapIndex uint64 `json:"snapIndex,omitempty"`
+	SnapTerm  uint64 `json:"snapTerm,omitempty"`
+	SnapData  []byte `json:"snapData,omitempty"`
+
+	// Used by "propose" requests.
+	Entry *CfgRaftEntry `json:"entry,omitempty"`
+
+	// Used by responses.
+	Success     bool     `json:"success,omitempty"`
+	MatchIndex  uint64   `json:"matchIndex,omitempty"`
+	CommitIndex uint64   `json:"commitIndex,omitempty"`
+	Index       uint64   `json:"index,omitempty"`
+	CAS         uint64   `json:"cas,omitempty"`
+	CASes       []uint64 `json:"cases,omitempty"`
+	Err         string   `json:"err,omitempty"`
+	ErrCAS      bool     `json:"errCAS,omitempty"`
+	Leader      string   `json:"leader,omitempty"`
+}
+
+// A CfgRaftHandler processes an incoming CfgRaftMsg request and
+// returns the response.
+type CfgRaftHandler func(msg *CfgRaftMsg) (*CfgRaftMsg, error)
+
+// CfgRaftTransport is the interface that carries messages between
+// CfgRaft nodes.
+type CfgRaftTransport interface {
+	// Register hooks up the handler for incoming messages to the
+	// node with the given id.
+	Register(id string, handler CfgRaftHandler) error
+
+	// Send delivers a request to a node and waits for its response.
+	Send(from, to string, msg *CfgRaftMsg) (*CfgRaftMsg, error)
+}
+
+type cfgRaftWaiter struct {
+	id string
+	ch chan *CfgRaftMsg
+}
+
+// cfgRaftPersisted is the JSON format of a CfgRaft's persistence
+// file, whose log entries are instead appended as JSON lines to the
+// path + ".log" file.  A later line with the index of an earlier
+// line replaces it and truncates the entries after it.
+type cfgRaftPersisted struct {
+	Term      uint64 `json:"term"`
+	VotedFor  string `json:"votedFor"`
+	SnapIndex uint64 `json:"snapIndex"`
+	SnapTerm  uint64 `json:"snapTerm"`
+	SnapData  []byte `json:"snapData"`
+
+	// Used by files from before the ".log" file.
+	Log []*CfgRaftEntry `json:"log,omitempty"`
+}
+
+// NewCfgRaft returns a CfgRaft node, which starts participating in
+// elections and replication right away.
+//
+// id:        this node's id (for CfgRaftHTTPTransport, its host:port)
+// peers:     the ids of the other nodes in the cluster
+// transport: carries messages between the nodes
+// path:      optional file path where the node persists its state
+// options:   optional settings
+//
+// Allowed options include:
+// - 'raftHeartbeatMS':       leader heartbeat interval
+// - 'raftElectionTimeoutMS': minimum follower election timeout
+// - 'raftSnapshotEvery':     applied entries between log compactions
+func NewCfgRaft(id string, peers []string, transport CfgRaftTransport,
+	path string, options map[string]string) (*CfgRaft, error) {
+	c := &CfgRaft{
+		id:            id,
+		transport:     transport,
+		path:          path,
+		heartbeat:     50 * time.Millisecond,
+		electionMin:   500 * time.Millisecond,
+		snapshotEvery: 100,
+		cfgMem:        NewCfgMem(),
+		stopCh:        make(chan struct{}),
+		appliedCh:     make(chan struct{}),
+		lastContact:   time.Now(),
+		nextIndex:     map[string]uint64{},
+		matchIndex:    map[string]uint64{},
+		inflight:      map[string]bool{},
+		waiters:       map[uint64]*cfgRaftWaiter{},
+	}
+
+	for _, peer := range peers {
+		if peer != "" && peer != id {
+			c.peers = append(c.peers, peer)
+		}
+	}
+
+	if v, exists := options["raftHeartbeatMS"]; exists {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms <= 0 {
+			return nil, fmt.Errorf("cfg_raft: bad raftHeartbeatMS: %q", v)
+		}
+		c.heartbeat = time.Duration(ms) * time.Millisecond
+	}
+	if v, exists := options["raftElectionTimeoutMS"]; exists {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms <= 0 {
+			return nil, fmt.Errorf("cfg_raft: bad raftElectionTimeoutMS: %q", v)
+		}
+		c.electionMin = time.Duration(ms) * time.Millisecond
+	}
+	if v, exists := options["raftSnapshotEvery"]; exists {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("cfg_raft: bad raftSnapshotEvery: %q", v)
+		}
+		c.snapshotEvery = uint64(n)
+	}
+
+	c.electionTimeout = c.randomElectionTimeout()
+
+	if path != "" {
+		err := c.load()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := transport.Register(id, c.HandleMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	go c.run()
+
+	return c, nil
+}
+
+func (c *CfgRaft) Get(key string, cas uint64) ([]byte, uint64, error) {
+	return c.cfgMem.Get(key, cas)
+}
+
+func (c *CfgRaft) Set(key string, val []byte, cas uint64) (uint64, error) {
+	resp, err := c.propose(&CfgRaftEntry{
+		Op: "set", Key: key, Val: val, CAS: cas,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return resp.CAS, nil
+}
+
+func (c *CfgRaft) Del(key string, cas uint64) error {
+	_, err := c.propose(&CfgRaftEntry{Op: "del", Key: key, CAS: cas})
+	return err
+}
+
+// Txn implements the CfgTxn interface, where the ops are replicated
+// as a single log entry.
+func (c *CfgRaft) Txn(ops []CfgTxnOp) ([]uint64, error) {
+	resp, err := c.propose(&CfgRaftEntry{Op: "txn", Ops: ops})
+	if err != nil {
+		return nil, err
+	}
+	return resp.CASes, nil
+}
+
+func (c *CfgRaft) Subscribe(key string, ch chan CfgEvent) error {
+	return c.cfgMem.Subscribe(key, ch)
+}
+
+// Refresh catches this node up to the leader's commit index before
+// firing events to all subscribers.
+func (c *CfgRaft) Refresh() error {
+	c.m.Lock()
+	leader := c.leader
+	isLeader := c.state == cfgRaftLeader
+	c.m.Unlock()
+
+	if !isLeader && leader != "" {
+		resp, err := c.transport.Send(c.id, leader,
+			&CfgRaftMsg{Kind: "commitIndex", From: c.id})
+		if err == nil && resp.Err == "" {
+			c.waitApplied(resp.CommitIndex, CfgRaftProposeTimeout)
+		}
+	}
+
+	return c.cfgMem.Refresh()
+}
+
+// Close stops the node's participation in the cluster.
+func (c *CfgRaft) Close() error {
+	c.m.Lock()
+	if !c.stopped {
+		c.stopped = true
+		close(c.stopCh)
+		c.failWaitersLOCKED(0, ErrCfgRaftStopped.Error())
+		if c.logFile != nil {
+			c.logFile.Close()
+			c.logFile = nil
+		}
+	}
+	c.m.Unlock()
+
+	return nil
+}
+
+// Leader returns the id of the node that this node believes is the
+// current leader, or "" if unknown.
+func (c *CfgRaft) Leader() string {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.leader
+}
+
+// Stats returns a snapshot of the node's replication state.
+func (c *CfgRaft) Stats() map[string]interface{} {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return map[string]interface{}{
+		"id":          c.id,
+		"state":       cfgRaftStateNames[c.state],
+		"term":        c.term,
+		"leader":      c.leader,
+		"commitIndex": c.commitIndex,
+		"lastApplied": c.lastApplied,
+		"snapIndex":   c.snapIndex,
+		"logLen":      len(c.log),
+	}
+}
+
+// ----------------------------------------------------------------
+
+// propose hands a mutation to the leader, which might be this node,
+// and waits until it is committed and applied locally.
+func (c *CfgRaft) propose(e *CfgRaftEntry) (*CfgRaftMsg, error) {
+	e.ID = NewUUID()
+
+	deadline := time.Now().Add(CfgRaftProposeTimeout)
+
+	for time.Now().Before(deadline) {
+		c.m.Lock()
+		if c.stopped {
+			c.m.Unlock()
+			return nil, ErrCfgRaftStopped
+		}
+		if c.state == cfgRaftLeader {
+			ch := c.appendProposalLOCKED(e)
+			c.m.Unlock()
+
+			c.broadcastAppend()
+
+			return cfgRaftResult(c.waitResult(ch, deadline))
+		}
+		leader := c.leader
+		c.m.Unlock()
+
+		if leader == "" {
+			time.Sleep(c.heartbeat)
+			continue
+		}
+
+		resp, err := c.transport.Send(c.id, leader,
+			&CfgRaftMsg{Kind: "propose", From: c.id, Entry: e})
+		if err != nil {
+			// The leader may or may not have received the proposal,
+			// so it's not safe to retry.
+			return nil, err
+		}
+		if resp.Err == errCfgRaftNotLeader {
+			time.Sleep(c.heartbeat)
+			continue
+		}
+
+		// Wait for the entry to be applied locally, so that a
+		// subsequent Get() on this node sees the mutation.
+		c.waitApplied(resp.Index, deadline.Sub(time.Now()))
+
+		return cfgRaftResult(resp)
+	}
+
+	return nil, ErrCfgRaftNoLeader
+}
+
+func cfgRaftResult(resp *CfgRaftMsg) (*CfgRaftMsg, error) {
+	if resp.ErrCAS {
+		return nil, &CfgCASError{}
+	}
+	if resp.Err != "" {
+		return nil, errors.New(resp.Err)
+	}
+	return resp, nil
+}
+
+func (c *CfgRaft) waitResult(ch chan *CfgRaftMsg,
+	deadline time.Time) *CfgRaftMsg {
+	select {
+	case resp := <-ch:
+		return resp
+	case <-time.After(deadline.Sub(time.Now())):
+		return &CfgRaftMsg{Err: "cfg_raft: timeout waiting for commit"}
+	}
+}
+
+func (c *CfgRaft) waitApplied(index uint64, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		c.m.Lock()
+		applied := c.lastApplied >= index
+		appliedCh := c.appliedCh
+		c.m.Unlock()
+
+		if applied {
+			return true
+		}
+
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			return false
+		}
+
+		select {
+		case <-appliedCh:
+		case <-time.After(remaining):
+		}
+	}
+}
+
+// appendProposalLOCKED appends a proposal to the leader's log and
+// returns the channel that will receive its result.
+func (c *CfgRaft) appendProposalLOCKED(e *CfgRaftEntry) chan *CfgRaftMsg {
+	entry := *e
+	entry.Index = c.lastIndexLOCKED() + 1
+	entry.Term = c.term
+	c.log = append(c.log, &entry)
+	c.persistLOCKED()
+
+	ch := make(chan *CfgRaftMsg, 1)
+	c.waiters[entry.Index] = &cfgRaftWaiter{id: entry.ID, ch: ch}
+
+	// A single node cluster commits right away.
+	c.advanceCommitLOCKED()
+
+	return ch
+}
+
+// ----------------------------------------------------------------
+
+func (c *CfgRaft) randomElectionTimeout() time.Duration {
+	return c.electionMin +
+		time.Duration(rand.Int63n(int64(c.electionMin)))
+}
+
+func (c *CfgRaft) run() {
+	ticker := time.NewTicker(c.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		c.m.Lock()
+		if c.unpersisted {
+			c.persistLOCKED()
+		}
+		state := c.state
+		electionDue := state != cfgRaftLeader &&
+			time.Since(c.lastContact) > c.electionTimeout
+		c.m.Unlock()
+
+		if electionDue {
+			c.startElection()
+		} else if state == cfgRaftLeader {
+			c.broadcastAppend()
+		}
+	}
+}
+
+func (c *CfgRaft) quorum() int {
+	return (len(c.peers)+1)/2 + 1
+}
+
+func (c *CfgRaft) startElection() {
+	c.m.Lock()
+	c.state = cfgRaftCandidate
+	c.term++
+	c.votedFor = c.id
+	c.leader = ""
+	c.lastContact = time.Now()
+	c.electionTimeout = c.randomElectionTimeout()
+	if c.persistLOCKED() != nil {
+		c.m.Unlock()
+		return // Retried at the next election timeout.
+	}
+
+	term := c.term
+	lastIndex := c.lastIndexLOCKED()
+	lastTerm := c.termAtLOCKED(lastIndex)
+
+	votes := 1
+	if votes >= c.quorum() {
+		c.becomeLeaderLOCKED()
+	}
+	c.m.Unlock()
+
+	log.Printf("cfg_raft: %s, starting election, term: %d", c.id, term)
+
+	for _, peer := range c.peers {
+		go func(peer string) {
+			resp, err := c.transport.Send(c.id, peer, &CfgRaftMsg{
+				Kind:         "vote",
+				From:         c.id,
+				Term:         term,
+				LastLogIndex: lastIndex,
+				LastLogTerm:  lastTerm,
+			})
+			if err != nil {
+				return
+			}
+
+			c.m.Lock()
+			defer c.m.Unlock()
+
+			if resp.Term > c.term {
+				c.stepDownLOCKED(resp.Term)
+				return
+			}
+			if c.state != cfgRaftCandidate || c.term != term ||
+				!resp.Success {
+				return
+			}
+
+			votes++
+			if votes >= c.quorum() {
+				c.becomeLeaderLOCKED()
+				go c.broadcastAppend()
+			}
+		}(peer)
+	}
+}
+
+func (c *CfgRaft) becomeLeaderLOCKED() {
+	log.Printf("cfg_raft: %s, became leader, term: %d", c.id, c.term)
+
+	c.state = cfgRaftLeader
+	c.leader = c.id
+
+	lastIndex := c.lastIndexLOCKED()
+	for _, peer := range c.peers {
+		c.nextIndex[peer] = lastIndex + 1
+		c.matchIndex[peer] = 0
+	}
+
+	// A no-op entry from the new term lets the leader commit any
+	// entries left over from previous terms.
+	c.log = append(c.log, &CfgRaftEntry{Index: lastIndex + 1, Term: c.term})
+	c.persistLOCKED()
+	c.advanceCommitLOCKED()
+}
+
+func (c *CfgRaft) stepDownLOCKED(term uint64) {
+	if term > c.term {
+		c.term = term
+		c.votedFor = ""
+	}
+	if c.state == cfgRaftLeader {
+		log.Printf("cfg_raft: %s, stepping down, term: %d", c.id, c.term)
+	}
+	c.state = cfgRaftFollower
+	c.persistLOCKED()
+}
+
+func (c *CfgRaft) broadcastAppend() {
+	c.m.Lock()
+	var peers []string
+	if c.state == cfgRaftLeader {
+		for _, peer := range c.peers {
+			if !c.inflight[peer] {
+				c.inflight[peer] = true
+				peers = append(peers, peer)
+			}
+		}
+	}
+	c.m.Unlock()
+
+	for _, peer := range peers {
+		go c.replicateTo(peer)
+	}
+}
+
+// cfgRaftMaxAppendEntries limits the number of entries per append
+// message.
+var cfgRaftMaxAppendEntries = 64
+
+func (c *CfgRaft) replicateTo(peer string) {
+	c.m.Lock()
+	if c.state != cfgRaftLeader {
+		c.inflight[peer] = false
+		c.m.Unlock()
+		return
+	}
+
+	term := c.term
+	next := c.nextIndex[peer]
+
+	var msg *CfgRaftMsg
+	if next <= c.snapIndex {
+		msg = &CfgRaftMsg{
+			Kind:      "snapshot",
+			From:      c.id,
+			Term:      term,
+			SnapIndex: c.snapIndex,
+			SnapTerm:  c.snapTerm,
+			SnapData:  c.snapData,
+		}
+	} else {
+		prevIndex := next - 1
+		entries := c.log[next-c.snapIndex-1:]
+		if len(entries) > cfgRaftMaxAppendEntries {
+			entries = entries[:cfgRaftMaxAppendEntries]
+		}
+		msg = &CfgRaftMsg{
+			Kind:         "append",
+			From:         c.id,
+			Term:         term,
+			PrevLogIndex: prevIndex,
+			PrevLogTerm:  c.termAtLOCKED(prevIndex),
+			Entries:      append([]*CfgRaftEntry(nil), entries...),
+			LeaderCommit: c.commitIndex,
+		}
+	}
+	c.m.Unlock()
+
+	resp, err := c.transport.Send(c.id, peer, msg)
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.inflight[peer] = false
+
+	if err != nil {
+		return
+	}
+	if resp.Term > c.term {
+		c.stepDownLOCKED(resp.Term)
+		return
+	}
+	if c.state != cfgRaftLeader || c.term != term {
+		return
+	}
+
+	if msg.Kind == "snapshot" {
+		if resp.Success {
+			c.matchIndex[peer] = msg.SnapIndex
+			c.nextIndex[peer] = msg.SnapIndex + 1
+		}
+		return
+	}
+
+	if resp.Success {
+		match := msg.PrevLogIndex + uint64(len(msg.Entries))
+		if match > c.matchIndex[peer] {
+			c.matchIndex[peer] = match
+		}
+		c.nextIndex[peer] = match + 1
+		c.advanceCommitLOCKED()
+		return
+	}
+
+	// Back off, using the follower's hint when it's helpful.
+	next = msg.PrevLogIndex
+	if resp.MatchIndex+1 < next {
+		next = resp.MatchIndex + 1
+	}
+	if next < 1 {
+		next = 1
+	}
+	c.nextIndex[peer] = next
+}
+
+func (c *CfgRaft) advanceCommitLOCKED() {
+	// The leader's own log counts only once it's persisted.
+	if c.state != cfgRaftLeader || c.unpersisted {
+		return
+	}
+
+	for n := c.lastIndexLOCKED(); n > c.commitIndex; n-- {
+		if c.termAtLOCKED(n) != c.term {
+			break // Only entries from the current term count.
+		}
+		count := 1
+		for _, peer := range c.peers {
+			if c.matchIndex[peer] >= n {
+				count++
+			}
+		}
+		if count >= c.quorum() {
+			c.commitIndex = n
+			c.applyLOCKED()
+			return
+		}
+	}
+}
+
+// ----------------------------------------------------------------
+
+// HandleMsg processes a request from another node; it is the
+// CfgRaftHandler that NewCfgRaft registers with the transport.
+func (c *CfgRaft) HandleMsg(msg *CfgRaftMsg) (*CfgRaftMsg, error) {
+	if msg.Kind == "propose" {
+		return c.handlePropose(msg), nil
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.stopped {
+		return nil, ErrCfgRaftStopped
+	}
+
+	var resp *CfgRaftMsg
+
+	switch msg.Kind {
+	case "vote":
+		resp = c.handleVoteLOCKED(msg)
+	case "append":
+		resp = c.handleAppendLOCKED(msg)
+	case "snapshot":
+		resp = c.handleSnapshotLOCKED(msg)
+	case "commitIndex":
+		if c.state != cfgRaftLeader {
+			return &CfgRaftMsg{Term: c.term, Err: errCfgRaftNotLeader,
+				Leader: c.leader}, nil
+		}
+		return &CfgRaftMsg{Term: c.term, CommitIndex: c.commitIndex}, nil
+	default:
+		return nil, fmt.Errorf("cfg_raft: unknown msg kind: %q", msg.Kind)
+	}
+
+	// A vote or an ack must not be sent for a state that may not
+	// survive a crash, so the request fails instead.
+	if c.unpersisted && c.persistLOCKED() != nil {
+		return nil, fmt.Errorf("cfg_raft: %s, could not persist,"+
+			" msg kind: %q", c.id, msg.Kind)
+	}
+
+	return resp, nil
+}
+
+func (c *CfgRaft) handlePropose(msg *CfgRaftMsg) *CfgRaftMsg {
+	if msg.Entry == nil {
+		return &CfgRaftMsg{Err: "cfg_raft: propose without entry"}
+	}
+
+	c.m.Lock()
+	if c.stopped || c.state != cfgRaftLeader {
+		resp := &CfgRaftMsg{Term: c.term, Err: errCfgRaftNotLeader,
+			Leader: c.leader}
+		c.m.Unlock()
+		return resp
+	}
+	ch := c.appendProposalLOCKED(msg.Entry)
+	c.m.Unlock()
+
+	c.broadcastAppend()
+
+	return c.waitResult(ch, time.Now().Add(CfgRaftProposeTimeout))
+}
+
+func (c *CfgRaft) handleVoteLOCKED(msg *CfgRaftMsg) *CfgRaftMsg {
+	if msg.Term > c.term {
+		c.stepDownLOCKED(msg.Term)
+	}
+
+	granted := false
+	if msg.Term == c.term &&
+		(c.votedFor == "" || c.votedFor == msg.From) {
+		lastIndex := c.lastIndexLOCKED()
+		lastTerm := c.termAtLOCKED(lastIndex)
+		if msg.LastLogTerm > lastTerm ||
+			(msg.LastLogTerm == lastTerm && msg.LastLogIndex >= lastIndex) {
+			granted = true
+			c.votedFor = msg.From
+			c.lastContact = time.Now()
+			c.persistLOCKED()
+		}
+	}
+
+	return &CfgRaftMsg{Term: c.term, Success: granted}
+}
+
+func (c *CfgRaft) handleAppendLOCKED(msg *CfgRaftMsg) *CfgRaftMsg {
+	if msg.Term < c.term {
+		return &CfgRaftMsg{Term: c.term}
+	}
+	if msg.Term > c.term || c.state != cfgRaftFollower {
+		c.stepDownLOCKED(msg.Term)
+	}
+	c.leader = msg.From
+	c.lastContact = time.Now()
+
+	lastIndex := c.lastIndexLOCKED()
+	if msg.PrevLogIndex > lastIndex {
+		return &CfgRaftMsg{Term: c.term, MatchIndex: lastIndex}
+	}
+	if msg.PrevLogIndex >= c.snapIndex &&
+		c.termAtLOCKED(msg.PrevLogIndex) != msg.PrevLogTerm {
+		hint := c.snapIndex
+		if msg.PrevLogIndex > hint+1 {
+			hint = msg.PrevLogIndex - 1
+		}
+		return &CfgRaftMsg{Term: c.term, MatchIndex: hint}
+	}
+
+	changed := false
+	for _, e := range msg.Entries {
+		if e.Index <= c.snapIndex {
+			continue // Already part of our snapshot.
+		}
+		if e.Index <= c.lastIndexLOCKED() {
+			if c.termAtLOCKED(e.Index) == e.Term {
+				continue
+			}
+			// Conflicting entry, so drop it and everything after.
+			c.log = c.log[:e.Index-c.snapIndex-1]
+			if c.persistedLogLen > len(c.log) {
+				c.persistedLogLen = len(c.log)
+			}
+		}
+		c.log = append(c.log, e)
+		changed = true
+	}
+	if changed {
+		c.persistLOCKED()
+	}
+
+	// The commitIndex only advances, as the append may be from a
+	// stale leader, or may be a delayed duplicate.
+	match := msg.PrevLogIndex + uint64(len(msg.Entries))
+	commitIndex := msg.LeaderCommit
+	if commitIndex > match {
+		commitIndex = match
+	}
+	if commitIndex > c.commitIndex {
+		c.commitIndex = commitIndex
+		c.applyLOCKED()
+	}
+
+	return &CfgRaftMsg{Term: c.term, Success: true, MatchIndex: match}
+}
+
+func (c *CfgRaft) handleSnapshotLOCKED(msg *CfgRaftMsg) *CfgRaftMsg {
+	if msg.Term < c.term {
+		return &CfgRaftMsg{Term: c.term}
+	}
+	if msg.Term > c.term || c.state != cfgRaftFollower {
+		c.stepDownLOCKED(msg.Term)
+	}
+	c.leader = msg.From
+	c.lastContact = time.Now()
+
+	if msg.SnapIndex <= c.snapIndex {
+		return &CfgRaftMsg{Term: c.term, Success: true}
+	}
+
+	// When our log has the snapshot's last entry, it also has all the
+	// entries before it, so the snapshot is reached by applying our
+	// own log, and the applied state and the log suffix that follows
+	// the snapshot are kept.
+	if msg.SnapIndex <= c.lastIndexLOCKED() &&
+		c.termAtLOCKED(msg.SnapIndex) == msg.SnapTerm {
+		if c.commitIndex < msg.SnapIndex {
+			c.commitIndex = msg.SnapIndex
+			c.applyLOCKED()
+		}
+
+		// The apply may have compacted the log already.
+		if c.snapIndex < msg.SnapIndex {
+			c.log = append([]*CfgRaftEntry(nil),
+				c.log[msg.SnapIndex-c.snapIndex:]...)
+			c.snapIndex = msg.SnapIndex
+			c.snapTerm = msg.SnapTerm
+			c.snapData = msg.SnapData
+			c.persistLOCKED()
+		}
+
+		return &CfgRaftMsg{Term: c.term, Success: true}
+	}
+
+	err := c.restoreSnapshotLOCKED(msg.SnapData)
+	if err != nil {
+		log.Warnf("cfg_raft: %s, could not install snapshot, err: %v",
+			c.id, err)
+		return &CfgRaftMsg{Term: c.term}
+	}
+
+	c.log = nil
+	c.snapIndex = msg.SnapIndex
+	c.snapTerm = msg.SnapTerm
+	c.snapData = msg.SnapData
+	if c.commitIndex < msg.SnapIndex {
+		c.commitIndex = msg.SnapIndex
+	}
+	c.lastApplied = msg.SnapIndex
+	c.failWaitersLOCKED(msg.SnapIndex, "cfg_raft: superseded by snapshot")
+	c.persistLOCKED()
+	c.notifyAppliedLOCKED()
+
+	c.cfgMem.Refresh()
+
+	return &CfgRaftMsg{Term: c.term, Success: true}
+}
+
+// ----------------------------------------------------------------
+
+func (c *CfgRaft) lastIndexLOCKED() uint64 {
+	return c.snapIndex + uint64(len(c.log))
+}
+
+// termAtLOCKED returns the term of the entry at index, or 0 when the
+// index is unknown or has been compacted away.
+func (c *CfgRaft) termAtLOCKED(index uint64) uint64 {
+	if index == c.snapIndex {
+		return c.snapTerm
+	}
+	if index < c.snapIndex || index > c.lastIndexLOCKED() {
+		return 0
+	}
+	return c.log[index-c.snapIndex-1].Term
+}
+
+func (c *CfgRaft) applyLOCKED() {
+	for c.lastApplied < c.commitIndex {
+		c.lastApplied++
+
+		e := c.log[c.lastApplied-c.snapIndex-1]
+
+		resp := &CfgRaftMsg{Term: c.term, Index: e.Index}
+
+		var err error
+		switch e.Op {
+		case "set":
+			resp.CAS, err = c.cfgMem.Set(e.Key, e.Val, e.CAS)
+		case "del":
+			err = c.cfgMem.Del(e.Key, e.CAS)
+		case "txn":
+			resp.CASes, err = c.cfgMem.Txn(e.Ops)
+		}
+		if err != nil {
+			if _, ok := err.(*CfgCASError); ok {
+				resp.ErrCAS = true
+			} else {
+				resp.Err = err.Error()
+			}
+		}
+
+		w := c.waiters[e.Index]
+		if w != nil {
+			delete(c.waiters, e.Index)
+			if w.id != e.ID {
+				resp = &CfgRaftMsg{Err: "cfg_raft: proposal lost" +
+					" due to leadership change"}
+			}
+			w.ch <- resp
+		}
+	}
+
+	c.notifyAppliedLOCKED()
+
+	if c.lastApplied-c.snapIndex >= c.snapshotEvery {
+		c.compactLOCKED()
+	}
+}
+
+func (c *CfgRaft) notifyAppliedLOCKED() {
+	close(c.appliedCh)
+	c.appliedCh = make(chan struct{})
+}
+
+// failWaitersLOCKED fails the waiters on entries at or below index,
+// where an index of 0 means all waiters.
+func (c *CfgRaft) failWaitersLOCKED(index uint64, errMsg string) {
+	for i, w := range c.waiters {
+		if index == 0 || i <= index {
+			delete(c.waiters, i)
+			w.ch <- &CfgRaftMsg{Err: errMsg}
+		}
+	}
+}
+
+// compactLOCKED snapshots the applied state and drops the log
+// entries that the snapshot covers.
+func (c *CfgRaft) compactLOCKED() {
+	c.cfgMem.m.Lock()
+	data, err := json.Marshal(c.cfgMem)
+	c.cfgMem.m.Unlock()
+	if err != nil {
+		log.Warnf("cfg_raft: %s, snapshot marshal, err: %v", c.id, err)
+		return
+	}
+
+	snapTerm := c.termAtLOCKED(c.lastApplied)
+
+	c.log = append([]*CfgRaftEntry(nil),
+		c.log[c.lastApplied-c.snapIndex:]...)
+	c.snapIndex = c.lastApplied
+	c.snapTerm = snapTerm
+	c.snapData = data
+	c.persistLOCKED()
+}
+
+// restoreSnapshotLOCKED replaces the applied state with a snapshot,
+// keeping the existing subscriptions.
+func (c *CfgRaft) restoreSnapshotLOCKED(data []byte) error {
+	cfgMem := NewCfgMem()
+	if len(data) > 0 {
+		err := json.Unmarshal(data, cfgMem)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.cfgMem.m.Lock()
+	c.cfgMem.CASNext = cfgMem.CASNext
+	c.cfgMem.Entries = cfgMem.Entries
+	c.cfgMem.m.Unlock()
+
+	return nil
+}
+
+// ----------------------------------------------------------------
+
+// persistLOCKED durably writes what changed of the term, vote,
+// snapshot and log, where the new log entries are appended to the log
+// file.  On an error, the CfgRaft is marked as unpersisted, so that it
+// neither acks nor commits until a retried persist succeeds.
+func (c *CfgRaft) persistLOCKED() error {
+	if c.path == "" || c.stopped {
+		return nil
+	}
+
+	err := c.persistMetaLOCKED()
+	if err == nil {
+		err = c.persistLogLOCKED()
+	}
+	if err != nil {
+		// Raft's safety depends on this, so shout loudly.
+		log.Errorf("cfg_raft: %s, persist, path: %s, err: %v",
+			c.id, c.path, err)
+	}
+
+	c.unpersisted = err != nil
+
+	return err
+}
+
+// persistMetaLOCKED writes the term, vote and snapshot when they've
+// changed, where a new snapshot also leads to a rewrite of the log
+// file without the entries that the snapshot covers.
+func (c *CfgRaft) persistMetaLOCKED() error {
+	if c.metaPersisted &&
+		c.persistedTerm == c.term &&
+		c.persistedVotedFor == c.votedFor &&
+		c.persistedSnapIndex == c.snapIndex {
+		return nil
+	}
+
+	buf, err := json.Marshal(&cfgRaftPersisted{
+		Term:      c.term,
+		VotedFor:  c.votedFor,
+		SnapIndex: c.snapIndex,
+		SnapTerm:  c.snapTerm,
+		SnapData:  c.snapData,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = WriteFileSync(c.path, buf, 0600)
+	if err != nil {
+		return err
+	}
+
+	if !c.metaPersisted || c.persistedSnapIndex != c.snapIndex {
+		c.logRewrite = true
+	}
+
+	c.metaPersisted = true
+	c.persistedTerm = c.term
+	c.persistedVotedFor = c.votedFor
+	c.persistedSnapIndex = c.snapIndex
+
+	return nil
+}
+
+// persistLogLOCKED appends the log entries that aren't yet in the log
+// file, or rewrites the log file when needed.
+func (c *CfgRaft) persistLogLOCKED() error {
+	if c.logRewrite || c.logFile == nil {
+		return c.rewriteLogLOCKED()
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+
+	for _, e := range c.log[c.persistedLogLen:] {
+		err := enc.Encode(e)
+		if err != nil {
+			return err
+		}
+	}
+
+	if buf.Len() <= 0 {
+		return nil
+	}
+
+	_, err := c.logFile.Write(buf.Bytes())
+	if err == nil {
+		err = c.logFile.Sync()
+	}
+	if err != nil {
+		// The log file might have a partial entry now.
+		c.logRewrite = true
+		return err
+	}
+
+	c.persistedLogLen = len(c.log)
+
+	return nil
+}
+
+func (c *CfgRaft) rewriteLogLOCKED() error {
+	if c.logFile != nil {
+		c.logFile.Close()
+		c.logFile = nil
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+
+	for _, e := range c.log {
+		err := enc.Encode(e)
+		if err != nil {
+			return err
+		}
+	}
+
+	logPath := c.path + ".log"
+
+	err := WriteFileSync(logPath, buf.Bytes(), 0600)
+	if err != nil {
+		return err
+	}
+
+	c.logFile, err = os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	c.persistedLogLen = len(c.log)
+	c.logRewrite = false
+
+	return nil
+}
+
+func (c *CfgRaft) load() error {
+	buf, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var p cfgRaftPersisted
+	err = json.Unmarshal(buf, &p)
+	if err != nil {
+		return fmt.Errorf("cfg_raft: load, path: %s, err: %v", c.path, err)
+	}
+
+	err = c.restoreSnapshotLOCKED(p.SnapData)
+	if err != nil {
+		return err
+	}
+
+	c.term = p.Term
+	c.votedFor = p.VotedFor
+	c.snapIndex = p.SnapIndex
+	c.snapTerm = p.SnapTerm
+	c.snapData = p.SnapData
+	c.log = nil
+	for _, e := range p.Log {
+		c.loadEntryLOCKED(e)
+	}
+	c.commitIndex = p.SnapIndex
+	c.lastApplied = p.SnapIndex
+
+	err = c.loadLogLOCKED()
+	if err != nil {
+		return err
+	}
+
+	c.metaPersisted = true
+	c.persistedTerm = c.term
+	c.persistedVotedFor = c.votedFor
+	c.persistedSnapIndex = c.snapIndex
+
+	// The log file is rewritten by the next persist, which drops any
+	// partially written entry.
+	c.logRewrite = true
+
+	return nil
+}
+
+// loadLogLOCKED replays the log file, stopping at a partially written
+// entry, which was never acked.
+func (c *CfgRaft) loadLogLOCKED() error {
+	f, err := os.Open(c.path + ".log")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	d := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var e CfgRaftEntry
+		err = d.Decode(&e)
+		if err != nil {
+			if err != io.EOF {
+				log.Warnf("cfg_raft: %s, load log, path: %s, err: %v",
+					c.id, c.path, err)
+			}
+			return nil
+		}
+
+		if !c.loadEntryLOCKED(&e) {
+			log.Warnf("cfg_raft: %s, load log, path: %s,"+
+				" missing entries before index: %d", c.id, c.path, e.Index)
+			return nil
+		}
+	}
+}
+
+// loadEntryLOCKED adds a persisted entry to the log, replacing any
+// entry at its index along with the entries after it, and returns
+// false when entries before it are missing.
+func (c *CfgRaft) loadEntryLOCKED(e *CfgRaftEntry) bool {
+	if e.Index <= c.snapIndex {
+		return true // Covered by the snapshot.
+	}
+	if e.Index > c.lastIndexLOCKED()+1 {
+		return false
+	}
+	c.log = append(c.log[:e.Index-c.snapIndex-1], e)
+	return true
+}
+
+// ----------------------------------------------------------------
+
+// CfgRaftLoopback is an in-process CfgRaftTransport, which is useful
+// for testing.  Nodes can be isolated from the others to simulate
+// network partitions.
+type CfgRaftLoopback struct {
+	m        sync.Mutex
+	handlers map[string]CfgRaftHandler
+	isolated map[string]bool
+}
+
+// NewCfgRaftLoopback returns an empty CfgRaftLoopback.
+func NewCfgRaftLoopback() *CfgRaftLoopback {
+	return &CfgRaftLoopback{
+		handlers: map[string]CfgRaftHandler{},
+		isolated: map[string]bool{},
+	}
+}
+
+func (t *CfgRaftLoopback) Register(id string, handler CfgRaftHandler) error {
+	t.m.Lock()
+	t.handlers[id] = handler
+	t.m.Unlock()
+
+	return nil
+}
+
+// Isolate cuts off (or, when isolated is false, reconnects) all
+// messages to and from a node.
+func (t *CfgRaftLoopback) Isolate(id string, isolated bool) {
+	t.m.Lock()
+	t.isolated[id] = isolated
+	t.m.Unlock()
+}
+
+func (t *CfgRaftLoopback) Send(from, to string, msg *CfgRaftMsg) (
+	*CfgRaftMsg, error) {
+	t.m.Lock()
+	handler := t.handlers[to]
+	isolated := t.isolated[from] || t.isolated[to]
+	t.m.Unlock()
+
+	if handler == nil || isolated {
+		return nil, fmt.Errorf("cfg_raft: loopback, unreachable: %s", to)
+	}
+
+	// Round-trip through JSON so nodes never share memory.
+	var req CfgRaftMsg
+	err := cfgRaftCopy(msg, &req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := handler(&req)
+	if err != nil {
+		return nil, err
+	}
+
+	var rv CfgRaftMsg
+	err = cfgRaftCopy(resp, &rv)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rv, nil
+}
+
+func cfgRaftCopy(src, dst *CfgRaftMsg) error {
+	buf, err := json.Marshal(src)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, dst)
+}
@@ -0,0 +1,157 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/couchbase/clog"
+)
+
+// CFG_RAFT_HTTP_PATH is the URL path where a CfgRaftHTTPTransport
+// receives messages from other nodes.
+const CFG_RAFT_HTTP_PATH = "/cfgRaft"
+
+// CfgRaftHTTPTransport is a CfgRaftTransport that exchanges JSON
+// messages over HTTP, where each node listens on its own bind
+// address, which is also used as the node's CfgRaft id.
+//
+// The messages are not authenticated, so the bind address should be
+// on a private network that is reachable only by the cluster nodes.
+type CfgRaftHTTPTransport struct {
+	bindAddr string
+	client   *http.Client
+
+	m        sync.Mutex
+	listener net.Listener
+}
+
+// NewCfgRaftHTTPTransport returns a CfgRaftHTTPTransport that will
+// listen on the given bindAddr (host:port) once a handler is
+// registered.
+func NewCfgRaftHTTPTransport(bindAddr string) *CfgRaftHTTPTransport {
+	return &CfgRaftHTTPTransport{
+		bindAddr: bindAddr,
+		client:   &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (t *CfgRaftHTTPTransport) Register(id string,
+	handler CfgRaftHandler) error {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if t.listener != nil {
+		return fmt.Errorf("cfg_raft_http: already registered,"+
+			" bindAddr: %s", t.bindAddr)
+	}
+
+	listener, err := net.Listen("tcp", t.bindAddr)
+	if err != nil {
+		return fmt.Errorf("cfg_raft_http: listen, bindAddr: %s, err: %v",
+			t.bindAddr, err)
+	}
+	t.listener = listener
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(CFG_RAFT_HTTP_PATH,
+		func(w http.ResponseWriter, req *http.Request) {
+			var msg CfgRaftMsg
+			err := json.NewDecoder(req.Body).Decode(&msg)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			resp, err := handler(&msg)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(resp)
+		})
+
+	go func() {
+		err := http.Serve(listener, mux)
+		log.Printf("cfg_raft_http: serve done, bindAddr: %s, err: %v",
+			t.bindAddr, err)
+	}()
+
+	return nil
+}
+
+func (t *CfgRaftHTTPTransport) Send(from, to string, msg *CfgRaftMsg) (
+	*CfgRaftMsg, error) {
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	client := t.client
+	if msg.Kind == "propose" {
+		// The leader waits up to CfgRaftProposeTimeout for the commit,
+		// so the response isn't cut off by the client's timeout while
+		// the proposal might still be applied.
+		client = &http.Client{
+			Timeout: CfgRaftProposeTimeout + t.client.Timeout,
+		}
+	}
+
+	resp, err := client.Post("http://"+to+CFG_RAFT_HTTP_PATH,
+		"application/json", bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBuf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cfg_raft_http: send to: %s,"+
+			" status: %d, body: %s", to, resp.StatusCode, respBuf)
+	}
+
+	var rv CfgRaftMsg
+	err = json.Unmarshal(respBuf, &rv)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rv, nil
+}
+
+// Close stops listening for messages.
+func (t *CfgRaftHTTPTransport) Close() error {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if t.listener == nil {
+		return nil
+	}
+
+	err := t.listener.Close()
+	t.listener = nil
+
+	return err
+}
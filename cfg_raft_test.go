@@ -0,0 +1,518 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testCfgRaftOptions = map[string]string{
+	"raftHeartbeatMS":       "10",
+	"raftElectionTimeoutMS": "50",
+}
+
+func testCfgRaftCluster(t *testing.T, ids []string,
+	transport CfgRaftTransport, dir string) []*CfgRaft {
+	var rv []*CfgRaft
+	for _, id := range ids {
+		path := ""
+		if dir != "" {
+			path = dir + string(os.PathSeparator) + id + ".cfgRaft"
+		}
+		c, err := NewCfgRaft(id, ids, transport, path, testCfgRaftOptions)
+		if err != nil {
+			t.Fatalf("expected NewCfgRaft to work, err: %v", err)
+		}
+		rv = append(rv, c)
+	}
+	return rv
+}
+
+func testCfgRaftWaitLeader(t *testing.T, nodes []*CfgRaft) *CfgRaft {
+	for i := 0; i < 500; i++ {
+		for _, c := range nodes {
+			c.m.Lock()
+			isLeader := c.state == cfgRaftLeader
+			c.m.Unlock()
+			if isLeader {
+				return c
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected a leader to be elected")
+	return nil
+}
+
+func testCfgRaftWaitVal(t *testing.T, c *CfgRaft, key, val string) {
+	for i := 0; i < 500; i++ {
+		v, _, err := c.Get(key, 0)
+		if err == nil && string(v) == val {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %s to see key: %s, val: %s", c.id, key, val)
+}
+
+func TestCfgRaftSingleNode(t *testing.T) {
+	c, err := NewCfgRaft("a", nil, NewCfgRaftLoopback(), "",
+		testCfgRaftOptions)
+	if err != nil {
+		t.Fatalf("expected NewCfgRaft to work, err: %v", err)
+	}
+	defer c.Close()
+
+	testCfgRaftWaitLeader(t, []*CfgRaft{c})
+	testCfg(t, c)
+}
+
+func TestCfgRaftTxn(t *testing.T) {
+	transport := NewCfgRaftLoopback()
+	nodes := testCfgRaftCluster(t, []string{"a", "b", "c"}, transport, "")
+	defer func() {
+		for _, c := range nodes {
+			c.Close()
+		}
+	}()
+
+	leader := testCfgRaftWaitLeader(t, nodes)
+
+	var follower *CfgRaft
+	for _, c := range nodes {
+		if c != leader {
+			follower = c
+		}
+	}
+
+	testCfgTxn(t, follower)
+
+	for _, c := range nodes {
+		testCfgRaftWaitVal(t, c, "b", "B")
+	}
+}
+
+func TestCfgRaftBadOptions(t *testing.T) {
+	_, err := NewCfgRaft("a", nil, NewCfgRaftLoopback(), "",
+		map[string]string{"raftHeartbeatMS": "nope"})
+	if err == nil {
+		t.Errorf("expected err on bad raftHeartbeatMS")
+	}
+}
+
+func TestCfgRaftReplication(t *testing.T) {
+	transport := NewCfgRaftLoopback()
+	nodes := testCfgRaftCluster(t, []string{"a", "b", "c"}, transport, "")
+	defer func() {
+		for _, c := range nodes {
+			c.Close()
+		}
+	}()
+
+	leader := testCfgRaftWaitLeader(t, nodes)
+
+	var follower *CfgRaft
+	for _, c := range nodes {
+		if c != leader {
+			follower = c
+		}
+	}
+
+	ec := make(chan CfgEvent, 10)
+	follower.Subscribe("k", ec)
+
+	// Writes through a follower are forwarded to the leader.
+	cas, err := follower.Set("k", []byte("v1"), 0)
+	if err != nil || cas == 0 {
+		t.Fatalf("expected Set via follower to work, err: %v", err)
+	}
+	v, casGet, err := follower.Get("k", 0)
+	if err != nil || string(v) != "v1" || casGet != cas {
+		t.Errorf("expected follower to read its own write")
+	}
+
+	e := <-ec
+	if e.Key != "k" || e.CAS != cas {
+		t.Errorf("expected subscription event on follower, got: %+v", e)
+	}
+
+	for _, c := range nodes {
+		testCfgRaftWaitVal(t, c, "k", "v1")
+		_, casNode, _ := c.Get("k", 0)
+		if casNode != cas {
+			t.Errorf("expected same cas on every node")
+		}
+	}
+
+	_, err = leader.Set("k", []byte("v2"), cas+100)
+	if _, ok := err.(*CfgCASError); !ok {
+		t.Errorf("expected CfgCASError, got: %v", err)
+	}
+	_, err = follower.Set("k", []byte("v2"), 0)
+	if err == nil {
+		t.Errorf("expected re-creation Set() to fail with CAS 0")
+	}
+
+	err = follower.Del("k", cas)
+	if err != nil {
+		t.Errorf("expected Del via follower to work, err: %v", err)
+	}
+	for _, c := range nodes {
+		testCfgRaftWaitVal(t, c, "k", "")
+	}
+
+	err = follower.Refresh()
+	if err != nil {
+		t.Errorf("expected Refresh to work, err: %v", err)
+	}
+}
+
+func TestCfgRaftLeaderFailover(t *testing.T) {
+	transport := NewCfgRaftLoopback()
+	nodes := testCfgRaftCluster(t, []string{"a", "b", "c"}, transport, "")
+	defer func() {
+		for _, c := range nodes {
+			c.Close()
+		}
+	}()
+
+	leader := testCfgRaftWaitLeader(t, nodes)
+
+	_, err := leader.Set("k", []byte("before"), 0)
+	if err != nil {
+		t.Fatalf("expected Set to work, err: %v", err)
+	}
+
+	transport.Isolate(leader.id, true)
+
+	var rest []*CfgRaft
+	for _, c := range nodes {
+		if c != leader {
+			rest = append(rest, c)
+		}
+	}
+
+	leader2 := testCfgRaftWaitLeader(t, rest)
+
+	// A new leader applies earlier entries once its no-op commits.
+	testCfgRaftWaitVal(t, leader2, "k", "before")
+
+	_, cas, _ := leader2.Get("k", 0)
+	_, err = leader2.Set("k", []byte("after"), cas)
+	if err != nil {
+		t.Fatalf("expected Set on new leader to work, err: %v", err)
+	}
+
+	transport.Isolate(leader.id, false)
+
+	testCfgRaftWaitVal(t, leader, "k", "after")
+}
+
+func TestCfgRaftSnapshot(t *testing.T) {
+	testDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testDir)
+
+	options := map[string]string{
+		"raftHeartbeatMS":       "10",
+		"raftElectionTimeoutMS": "50",
+		"raftSnapshotEvery":     "5",
+	}
+
+	transport := NewCfgRaftLoopback()
+
+	ids := []string{"a", "b", "c"}
+	var nodes []*CfgRaft
+	for _, id := range ids {
+		c, err := NewCfgRaft(id, ids, transport,
+			testDir+string(os.PathSeparator)+id+".cfgRaft", options)
+		if err != nil {
+			t.Fatalf("expected NewCfgRaft to work, err: %v", err)
+		}
+		nodes = append(nodes, c)
+	}
+
+	leader := testCfgRaftWaitLeader(t, nodes)
+
+	var lagger *CfgRaft
+	for _, c := range nodes {
+		if c != leader {
+			lagger = c
+			break
+		}
+	}
+	transport.Isolate(lagger.id, true)
+
+	for i := 0; i < 20; i++ {
+		_, err := leader.Set(fmt.Sprintf("k%d", i), []byte("v"), 0)
+		if err != nil {
+			t.Fatalf("expected Set to work, err: %v", err)
+		}
+	}
+
+	leader.m.Lock()
+	snapIndex := leader.snapIndex
+	leader.m.Unlock()
+	if snapIndex == 0 {
+		t.Errorf("expected the leader's log to be compacted")
+	}
+
+	// The lagging node catches up through a snapshot.
+	transport.Isolate(lagger.id, false)
+	testCfgRaftWaitVal(t, lagger, "k19", "v")
+
+	for _, c := range nodes {
+		c.Close()
+	}
+
+	// Restarted nodes recover their state from their files.
+	transport2 := NewCfgRaftLoopback()
+	nodes2 := testCfgRaftCluster(t, ids, transport2, testDir)
+	defer func() {
+		for _, c := range nodes2 {
+			c.Close()
+		}
+	}()
+
+	for _, c := range nodes2 {
+		testCfgRaftWaitVal(t, c, "k0", "v")
+		testCfgRaftWaitVal(t, c, "k19", "v")
+	}
+}
+
+// testCfgRaftFollower returns a node of a 2 node cluster whose peer
+// never starts, so the node stays a follower that's driven directly
+// through its HandleMsg.
+func testCfgRaftFollower(t *testing.T, path string) *CfgRaft {
+	c, err := NewCfgRaft("a", []string{"a", "b"}, NewCfgRaftLoopback(),
+		path, map[string]string{"raftElectionTimeoutMS": "100000"})
+	if err != nil {
+		t.Fatalf("expected NewCfgRaft to work, err: %v", err)
+	}
+	return c
+}
+
+func TestCfgRaftPersistFailure(t *testing.T) {
+	testDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testDir)
+
+	// The directory of the persistence file doesn't exist yet.
+	dir := testDir + string(os.PathSeparator) + "missing"
+
+	c := testCfgRaftFollower(t, dir+string(os.PathSeparator)+"a.cfgRaft")
+	defer c.Close()
+
+	vote := &CfgRaftMsg{Kind: "vote", From: "b", Term: 1}
+
+	resp, err := c.HandleMsg(vote)
+	if err == nil {
+		t.Fatalf("expected an unpersisted vote to fail, resp: %+v", resp)
+	}
+
+	append1 := &CfgRaftMsg{Kind: "append", From: "b", Term: 1,
+		Entries: []*CfgRaftEntry{{Index: 1, Term: 1, Op: "set",
+			Key: "k", Val: []byte("v")}}}
+
+	resp, err = c.HandleMsg(append1)
+	if err == nil {
+		t.Fatalf("expected an unpersisted append to fail, resp: %+v", resp)
+	}
+
+	os.MkdirAll(dir, 0700)
+
+	// A resent append, whose entry is already in memory, is acked
+	// only once the retried persist succeeds.
+	resp, err = c.HandleMsg(append1)
+	if err != nil || !resp.Success || resp.MatchIndex != 1 {
+		t.Fatalf("expected the append to work, resp: %+v, err: %v",
+			resp, err)
+	}
+
+	c.Close()
+
+	c2 := testCfgRaftFollower(t, dir+string(os.PathSeparator)+"a.cfgRaft")
+	defer c2.Close()
+
+	c2.m.Lock()
+	term, votedFor, lastIndex := c2.term, c2.votedFor, c2.lastIndexLOCKED()
+	c2.m.Unlock()
+	if term != 1 || votedFor != "b" || lastIndex != 1 {
+		t.Errorf("expected the acked state to be persisted, term: %d,"+
+			" votedFor: %s, lastIndex: %d", term, votedFor, lastIndex)
+	}
+}
+
+func TestCfgRaftSnapshotKeepsLog(t *testing.T) {
+	c := testCfgRaftFollower(t, "")
+	defer c.Close()
+
+	var entries []*CfgRaftEntry
+	for i := uint64(1); i <= 3; i++ {
+		entries = append(entries, &CfgRaftEntry{Index: i, Term: 1,
+			Op: "set", Key: fmt.Sprintf("k%d", i), Val: []byte("v")})
+	}
+
+	resp, err := c.HandleMsg(&CfgRaftMsg{Kind: "append", From: "b",
+		Term: 1, Entries: entries, LeaderCommit: 1})
+	if err != nil || !resp.Success {
+		t.Fatalf("expected the append to work, resp: %+v, err: %v",
+			resp, err)
+	}
+
+	// The snapshot's data isn't used, as the log has its last entry.
+	resp, err = c.HandleMsg(&CfgRaftMsg{Kind: "snapshot", From: "b",
+		Term: 1, SnapIndex: 2, SnapTerm: 1,
+		SnapData: []byte(`{"entries":{"other":{"val":"eA==","cas":1}}}`)})
+	if err != nil || !resp.Success {
+		t.Fatalf("expected the snapshot to work, resp: %+v, err: %v",
+			resp, err)
+	}
+
+	for key, exp := range map[string]string{"k1": "v", "k2": "v", "k3": "",
+		"other": ""} {
+		v, _, _ := c.Get(key, 0)
+		if string(v) != exp {
+			t.Errorf("expected key: %s, val: %q, got: %q", key, exp, v)
+		}
+	}
+
+	c.m.Lock()
+	snapIndex, lastApplied, logLen := c.snapIndex, c.lastApplied, len(c.log)
+	c.m.Unlock()
+	if snapIndex != 2 || lastApplied != 2 || logLen != 1 {
+		t.Errorf("expected the log suffix to be kept, snapIndex: %d,"+
+			" lastApplied: %d, log: %d", snapIndex, lastApplied, logLen)
+	}
+}
+
+func TestCfgRaftCommitIndexOnlyAdvances(t *testing.T) {
+	c := testCfgRaftFollower(t, "")
+	defer c.Close()
+
+	var entries []*CfgRaftEntry
+	for i := uint64(1); i <= 3; i++ {
+		entries = append(entries, &CfgRaftEntry{Index: i, Term: 1,
+			Op: "set", Key: fmt.Sprintf("k%d", i), Val: []byte("v")})
+	}
+
+	resp, err := c.HandleMsg(&CfgRaftMsg{Kind: "append", From: "b",
+		Term: 1, Entries: entries, LeaderCommit: 3})
+	if err != nil || !resp.Success {
+		t.Fatalf("expected the append to work, resp: %+v, err: %v",
+			resp, err)
+	}
+
+	// A delayed duplicate of an earlier append.
+	resp, err = c.HandleMsg(&CfgRaftMsg{Kind: "append", From: "b",
+		Term: 1, Entries: entries[:1], LeaderCommit: 1})
+	if err != nil || !resp.Success {
+		t.Fatalf("expected the append to work, resp: %+v, err: %v",
+			resp, err)
+	}
+
+	c.m.Lock()
+	commitIndex := c.commitIndex
+	c.m.Unlock()
+	if commitIndex != 3 {
+		t.Errorf("expected commitIndex to stay at 3, got: %d", commitIndex)
+	}
+}
+
+func TestCfgRaftPersistLog(t *testing.T) {
+	testDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testDir)
+
+	path := testDir + string(os.PathSeparator) + "a.cfgRaft"
+
+	c := testCfgRaftFollower(t, path)
+
+	for i := uint64(1); i <= 3; i++ {
+		prevLogTerm := uint64(1)
+		if i == 1 {
+			prevLogTerm = 0
+		}
+		resp, err := c.HandleMsg(&CfgRaftMsg{Kind: "append", From: "b",
+			Term: 1, PrevLogIndex: i - 1, PrevLogTerm: prevLogTerm,
+			Entries: []*CfgRaftEntry{{Index: i, Term: 1, Op: "set",
+				Key: fmt.Sprintf("k%d", i), Val: []byte("v")}}})
+		if err != nil || !resp.Success {
+			t.Fatalf("expected the append to work, resp: %+v, err: %v",
+				resp, err)
+		}
+	}
+
+	// A conflicting entry from a new leader replaces the last one.
+	resp, err := c.HandleMsg(&CfgRaftMsg{Kind: "append", From: "b",
+		Term: 2, PrevLogIndex: 2, PrevLogTerm: 1,
+		Entries: []*CfgRaftEntry{{Index: 3, Term: 2, Op: "set",
+			Key: "k3", Val: []byte("v2")}}})
+	if err != nil || !resp.Success {
+		t.Fatalf("expected the append to work, resp: %+v, err: %v",
+			resp, err)
+	}
+
+	c.Close()
+
+	// The entries were appended to the log file, rather than
+	// rewritten with the rest of the state.
+	buf, _ := ioutil.ReadFile(path + ".log")
+	if n := strings.Count(string(buf), "\n"); n != 4 {
+		t.Errorf("expected 4 appended entries, got: %d, log: %s", n, buf)
+	}
+	buf, _ = ioutil.ReadFile(path)
+	if strings.Contains(string(buf), `"log"`) {
+		t.Errorf("expected no log entries in the state file: %s", buf)
+	}
+
+	// A partially written entry is ignored.
+	f, _ := os.OpenFile(path+".log", os.O_WRONLY|os.O_APPEND, 0600)
+	f.Write([]byte(`{"index":4,"term":2,"op":"se`))
+	f.Close()
+
+	c2 := testCfgRaftFollower(t, path)
+	defer c2.Close()
+
+	c2.m.Lock()
+	lastIndex, lastTerm := c2.lastIndexLOCKED(), c2.termAtLOCKED(3)
+	c2.m.Unlock()
+	if lastIndex != 3 || lastTerm != 2 {
+		t.Errorf("expected the persisted log, lastIndex: %d, term: %d",
+			lastIndex, lastTerm)
+	}
+}
+
+func TestCfgRaftHTTPTransport(t *testing.T) {
+	transport := NewCfgRaftHTTPTransport("127.0.0.1:0")
+	err := transport.Register("x", func(msg *CfgRaftMsg) (*CfgRaftMsg, error) {
+		return &CfgRaftMsg{Term: msg.Term + 1, Success: true}, nil
+	})
+	if err != nil {
+		t.Fatalf("expected Register to work, err: %v", err)
+	}
+	defer transport.Close()
+
+	addr := transport.listener.Addr().String()
+
+	resp, err := transport.Send("x", addr, &CfgRaftMsg{Kind: "vote", Term: 41})
+	if err != nil || resp.Term != 42 || !resp.Success {
+		t.Errorf("expected Send to work, resp: %+v, err: %v", resp, err)
+	}
+
+	_, err = transport.Send("x", "127.0.0.1:1", &CfgRaftMsg{Kind: "vote"})
+	if err == nil {
+		t.Errorf("expected Send to an unreachable node to fail")
+	}
+}
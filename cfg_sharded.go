@@ -0,0 +1,897 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/couchbase/clog"
+)
+
+// CFG_SHARDED_KEY_PREFIX is the prefix of the keys where a CfgSharded
+// stores a sharded key in the wrapped Cfg.  The manifest of key "foo"
+// is stored under "cfgShard-foo", each shard is stored under
+// "cfgShard-foo/<shardName>/<id>", and the shards that are being
+// written are tracked per shard name under
+// "cfgShard-foo.pending/<shardName>", so that orphaned shards can be
+// found without listing the wrapped Cfg.
+const CFG_SHARDED_KEY_PREFIX = "cfgShard-"
+
+// CfgShardedVersion is the cluster version from which every node
+// understands sharded values.  Until then, a CfgSharded keeps writing
+// the unsharded values, so that older nodes still see every change.
+var CfgShardedVersion = "5.5.0"
+
+// CfgShardedPurgeTimeout is how long a written shard can stay
+// unreferenced by the manifest before it's considered an orphan,
+// such as when its writer crashed before switching the manifest.
+var CfgShardedPurgeTimeout = 10 * time.Minute
+
+// CfgShardedGetRetries is the number of times a Get retries when a
+// shard is missing or has an unexpected checksum, which can happen
+// when a concurrent Set switches the manifest.
+var CfgShardedGetRetries = 3
+
+// A CfgSharder splits a value into a small header and named shards,
+// and joins them back.  Unchanged shards are not rewritten, so the
+// shards should be the parts of a value that change independently.
+type CfgSharder interface {
+	Split(val []byte) (header []byte, shards map[string][]byte, err error)
+	Join(header []byte, shards map[string][]byte) ([]byte, error)
+}
+
+// CfgSharders are the sharders of the keys that can be sharded by a
+// CfgSharded, where the planPIndexes are sharded per index and the
+// nodeDefs are sharded per node.  Applications can add their own
+// sharders at init() time.
+var CfgSharders = map[string]CfgSharder{
+	PLAN_PINDEXES_KEY:                &cfgPlanPIndexesSharder{},
+	CfgNodeDefsKey(NODE_DEFS_KNOWN):  &cfgNodeDefsSharder{},
+	CfgNodeDefsKey(NODE_DEFS_WANTED): &cfgNodeDefsSharder{},
+}
+
+// CfgSharded is a Cfg wrapper that stores large, composite values,
+// like the planPIndexes and nodeDefs, as a manifest and one shard per
+// index or per node in the wrapped Cfg, so that any Cfg provider
+// avoids rewriting one huge value on every change.
+//
+// A Set writes only the changed shards, each under a new id, and then
+// atomically switches the manifest with a CAS, so readers never see a
+// partial value.  The CAS of a sharded key is the CAS of its
+// manifest.  A Get verifies the MD5 checksum of every shard.  A value
+// that was stored unsharded, such as before an upgrade, is still
+// readable, and is replaced by a manifest on its first Set once the
+// cluster version reaches the CfgShardedVersion.
+type CfgSharded struct {
+	cfg      Cfg
+	sharders map[string]CfgSharder
+
+	sharding int32 // Non-zero once the cluster supports sharding.
+}
+
+// A CfgShardedManifest locates the shards of a sharded value.
+type CfgShardedManifest struct {
+	Header []byte                         `json:"header"`
+	Shards map[string]*CfgShardedShardRef `json:"shards"` // Keyed by shard name.
+}
+
+// A CfgShardedShardRef locates and verifies a single shard.
+type CfgShardedShardRef struct {
+	ID  string `json:"id"`
+	MD5 string `json:"md5"`
+}
+
+// cfgShardedPending tracks the shards that were written but might not
+// yet be referenced by the manifest, as shard key => the write time in
+// unix milliseconds.
+type cfgShardedPending map[string]int64
+
+// NewCfgSharded returns a CfgSharded that wraps the given cfg and
+// shards the given keys, where nil keys means every key of the
+// CfgSharders.  The returned Cfg also implements CfgTxn and
+// VersionReader when the wrapped cfg does.  Use GetCfgSharded() to
+// retrieve the CfgSharded from the returned Cfg.
+func NewCfgSharded(cfg Cfg, keys []string) (Cfg, error) {
+	sharders := map[string]CfgSharder{}
+
+	if keys == nil {
+		for key, sharder := range CfgSharders {
+			sharders[key] = sharder
+		}
+	}
+
+	for _, key := range keys {
+		sharder, exists := CfgSharders[key]
+		if !exists {
+			return nil, fmt.Errorf("cfg_sharded: no sharder, key: %s", key)
+		}
+		sharders[key] = sharder
+	}
+
+	c := &CfgSharded{cfg: cfg, sharders: sharders}
+
+	return wrapCfg(c, cfg), nil
+}
+
+// GetCfgSharded returns the CfgSharded of a Cfg that was returned by
+// NewCfgSharded(), or nil.
+func GetCfgSharded(cfg Cfg) *CfgSharded {
+	c, _ := unwrapCfgWrapper(cfg).(*CfgSharded)
+	return c
+}
+
+// Unwrap returns the wrapped Cfg.
+func (c *CfgSharded) Unwrap() Cfg {
+	return c.cfg
+}
+
+// isShardingSupported returns true once every node of the cluster
+// understands sharded values, according to the ClusterVersion() of a
+// VersionReader wrapped Cfg, or else to the version in the wrapped
+// Cfg, which CheckVersion() only bumps once every node is at it.
+func (c *CfgSharded) isShardingSupported() bool {
+	if atomic.LoadInt32(&c.sharding) != 0 {
+		return true
+	}
+
+	supported := false
+
+	if rsc, ok := c.cfg.(VersionReader); ok {
+		ccVersion, err := rsc.ClusterVersion()
+		if err != nil {
+			log.Printf("cfg_sharded: ClusterVersion, err: %v", err)
+			return false
+		}
+
+		shardedVersion, err := CompatibilityVersion(CfgShardedVersion)
+		if err != nil {
+			return false
+		}
+
+		supported = ccVersion >= shardedVersion
+	} else {
+		version, _, err := c.cfg.Get(VERSION_KEY, 0)
+		if err != nil {
+			return false
+		}
+
+		supported = version != nil &&
+			VersionGTE(string(version), CfgShardedVersion)
+	}
+
+	if supported {
+		// The cluster version never goes back down.
+		atomic.StoreInt32(&c.sharding, 1)
+	}
+
+	return supported
+}
+
+func cfgShardedManifestKey(key string) string {
+	return CFG_SHARDED_KEY_PREFIX + key
+}
+
+func cfgShardedPendingKey(key, name string) string {
+	return CFG_SHARDED_KEY_PREFIX + key + ".pending/" + name
+}
+
+func cfgShardedShardKey(key, name, id string) string {
+	return CFG_SHARDED_KEY_PREFIX + key + "/" + name + "/" + id
+}
+
+// ----------------------------------------------------------------
+
+func (c *CfgSharded) Get(key string, cas uint64) ([]byte, uint64, error) {
+	sharder := c.sharders[key]
+	if sharder == nil {
+		return c.cfg.Get(key, cas)
+	}
+
+	var err error
+
+	for tries := 0; tries <= CfgShardedGetRetries; tries++ {
+		manifest, manifestCAS, errM := c.getManifest(key)
+		if errM != nil {
+			return nil, 0, errM
+		}
+
+		if manifest == nil {
+			// Not sharded yet, such as before an upgrade.
+			return c.cfg.Get(key, cas)
+		}
+
+		if cas != 0 && cas != manifestCAS {
+			return nil, 0, &CfgCASError{}
+		}
+
+		var val []byte
+
+		val, err = c.join(key, sharder, manifest)
+		if err == nil {
+			return val, manifestCAS, nil
+		}
+
+		log.Printf("cfg_sharded: Get, key: %s, tries: %d, err: %v",
+			key, tries, err)
+	}
+
+	return nil, 0, err
+}
+
+// getManifest returns the manifest of a sharded key, or nil.
+func (c *CfgSharded) getManifest(key string) (
+	*CfgShardedManifest, uint64, error) {
+	buf, cas, err := c.cfg.Get(cfgShardedManifestKey(key), 0)
+	if err != nil || buf == nil {
+		return nil, 0, err
+	}
+
+	manifest := &CfgShardedManifest{}
+	err = json.Unmarshal(buf, manifest)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cfg_sharded: could not parse manifest,"+
+			" key: %s, err: %v", key, err)
+	}
+
+	return manifest, cas, nil
+}
+
+// join reads and verifies the shards of a manifest.
+func (c *CfgSharded) join(key string, sharder CfgSharder,
+	manifest *CfgShardedManifest) ([]byte, error) {
+	shards := make(map[string][]byte, len(manifest.Shards))
+
+	for name, ref := range manifest.Shards {
+		buf, _, err := c.cfg.Get(cfgShardedShardKey(key, name, ref.ID), 0)
+		if err != nil {
+			return nil, err
+		}
+
+		hash, err := computeMD5(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		if buf == nil || hash != ref.MD5 {
+			return nil, fmt.Errorf("cfg_sharded: checksum mismatch,"+
+				" key: %s, shard: %s, id: %s", key, name, ref.ID)
+		}
+
+		shards[name] = buf
+	}
+
+	return sharder.Join(manifest.Header, shards)
+}
+
+// ----------------------------------------------------------------
+
+func (c *CfgSharded) Set(key string, val []byte, cas uint64) (
+	uint64, error) {
+	sharder := c.sharders[key]
+	if sharder == nil {
+		return c.cfg.Set(key, val, cas)
+	}
+
+	if !c.isShardingSupported() {
+		manifest, _, err := c.getManifest(key)
+		if err != nil {
+			return 0, err
+		}
+
+		if manifest == nil {
+			// Older nodes only understand the unsharded value.
+			return c.cfg.Set(key, val, cas)
+		}
+	}
+
+	w, err := c.prepareSet(key, sharder, val, cas)
+	if err != nil {
+		return 0, err
+	}
+
+	var casResult uint64
+
+	if w.prevManifest != nil {
+		casResult, err = c.cfg.Set(cfgShardedManifestKey(key),
+			w.manifestVal, cas)
+	} else {
+		// Check the CAS of any unsharded value, which the new
+		// manifest replaces.
+		if cas != CFG_CAS_FORCE {
+			buf, prevCAS, errG := c.cfg.Get(key, 0)
+			if errG != nil {
+				err = errG
+			} else if (buf == nil && cas != 0) ||
+				(buf != nil && cas != prevCAS) {
+				err = &CfgCASError{}
+			}
+		}
+
+		if err == nil {
+			manifestCAS := uint64(0)
+			if cas == CFG_CAS_FORCE {
+				manifestCAS = CFG_CAS_FORCE
+			}
+
+			casResult, err = c.cfg.Set(cfgShardedManifestKey(key),
+				w.manifestVal, manifestCAS)
+			if err == nil {
+				c.cfg.Del(key, 0)
+			}
+		}
+	}
+
+	w.done(err == nil)
+
+	return casResult, err
+}
+
+func (c *CfgSharded) Del(key string, cas uint64) error {
+	sharder := c.sharders[key]
+	if sharder == nil {
+		return c.cfg.Del(key, cas)
+	}
+
+	manifest, _, err := c.getManifest(key)
+	if err != nil {
+		return err
+	}
+
+	if manifest == nil {
+		return c.cfg.Del(key, cas)
+	}
+
+	err = c.cfg.Del(cfgShardedManifestKey(key), cas)
+	if err != nil {
+		return err
+	}
+
+	c.afterDel(key, manifest)
+
+	return nil
+}
+
+// afterDel cleans up after a manifest was deleted.
+func (c *CfgSharded) afterDel(key string, manifest *CfgShardedManifest) {
+	for name, ref := range manifest.Shards {
+		c.cfg.Del(cfgShardedShardKey(key, name, ref.ID), 0)
+	}
+
+	c.cfg.Del(key, 0)
+}
+
+// Subscribe delivers the changes of a sharded key's manifest, and of
+// its unsharded value, as changes of the key.
+func (c *CfgSharded) Subscribe(key string, ch chan CfgEvent) error {
+	if c.sharders[key] == nil {
+		return c.cfg.Subscribe(key, ch)
+	}
+
+	ec := make(chan CfgEvent)
+
+	go func() {
+		for ev := range ec {
+			ev.Key = key
+			ev.Val = nil // The value of the manifest or of the key.
+			ch <- ev
+		}
+	}()
+
+	err := c.cfg.Subscribe(cfgShardedManifestKey(key), ec)
+	if err != nil {
+		return err
+	}
+
+	return c.cfg.Subscribe(key, ec)
+}
+
+func (c *CfgSharded) Refresh() error {
+	return c.cfg.Refresh()
+}
+
+// ClusterVersion implements the VersionReader interface by delegating
+// to the wrapped Cfg, and is only exposed by NewCfgSharded() when the
+// wrapped cfg is a VersionReader.
+func (c *CfgSharded) ClusterVersion() (uint64, error) {
+	return c.cfg.(VersionReader).ClusterVersion()
+}
+
+// Txn translates the ops of sharded keys into ops on their manifests,
+// after their shards are written, and is only exposed by
+// NewCfgSharded() when the wrapped cfg supports CfgTxn.
+func (c *CfgSharded) Txn(ops []CfgTxnOp) ([]uint64, error) {
+	var txnOps []CfgTxnOp
+
+	opIndexes := make([]int, len(ops)) // Index of an op's result in txnOps.
+
+	var writes []*cfgShardedWrite
+
+	done := func(ok bool) {
+		for _, w := range writes {
+			w.done(ok)
+		}
+	}
+
+	deleted := map[string]*CfgShardedManifest{}
+
+	sharding := false
+
+	for i, op := range ops {
+		sharder := c.sharders[op.Key]
+		if sharder == nil {
+			opIndexes[i] = len(txnOps)
+			txnOps = append(txnOps, op)
+			continue
+		}
+
+		manifestKey := cfgShardedManifestKey(op.Key)
+
+		manifest, _, err := c.getManifest(op.Key)
+		if err != nil {
+			done(false)
+			return nil, err
+		}
+
+		if op.Op == CFG_TXN_OP_SET && manifest == nil && !sharding {
+			sharding = c.isShardingSupported()
+			if !sharding {
+				// Older nodes only understand the unsharded value.
+				opIndexes[i] = len(txnOps)
+				txnOps = append(txnOps, op)
+				continue
+			}
+		}
+
+		if op.Op == CFG_TXN_OP_SET {
+			w, err := c.prepareSet(op.Key, sharder, op.Val, op.CAS)
+			if err != nil {
+				done(false)
+				return nil, err
+			}
+			writes = append(writes, w)
+
+			if manifest != nil {
+				opIndexes[i] = len(txnOps)
+				txnOps = append(txnOps, CfgTxnOp{Op: CFG_TXN_OP_SET,
+					Key: manifestKey, Val: w.manifestVal, CAS: op.CAS})
+				continue
+			}
+
+			// The manifest replaces any unsharded value.
+			manifestCAS := uint64(0)
+			if op.CAS == CFG_CAS_FORCE {
+				manifestCAS = CFG_CAS_FORCE
+			}
+
+			opIndexes[i] = len(txnOps) + 1
+			txnOps = append(txnOps,
+				CfgTxnOp{Op: CFG_TXN_OP_CHECK, Key: op.Key, CAS: op.CAS},
+				CfgTxnOp{Op: CFG_TXN_OP_SET, Key: manifestKey,
+					Val: w.manifestVal, CAS: manifestCAS},
+				CfgTxnOp{Op: CFG_TXN_OP_DEL, Key: op.Key})
+			continue
+		}
+
+		if manifest == nil {
+			opIndexes[i] = len(txnOps)
+			txnOps = append(txnOps, op)
+			continue
+		}
+
+		if op.Op == CFG_TXN_OP_DEL {
+			deleted[op.Key] = manifest
+		}
+
+		opIndexes[i] = len(txnOps)
+		txnOps = append(txnOps, CfgTxnOp{Op: op.Op,
+			Key: manifestKey, CAS: op.CAS})
+	}
+
+	casSuccess, err := c.cfg.(CfgTxn).Txn(txnOps)
+
+	done(err == nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for key, manifest := range deleted {
+		c.afterDel(key, manifest)
+	}
+
+	rv := make([]uint64, len(ops))
+	for i := range ops {
+		rv[i] = casSuccess[opIndexes[i]]
+	}
+
+	return rv, nil
+}
+
+// ----------------------------------------------------------------
+
+// A cfgShardedWrite is a Set of a sharded key whose shards were
+// written, but whose manifest is not yet switched.
+type cfgShardedWrite struct {
+	c            *CfgSharded
+	key          string
+	manifestVal  []byte
+	prevManifest *CfgShardedManifest // The manifest to be replaced.
+	written      map[string]string   // Shard name => key written by this Set.
+	unreferenced []string            // Shard keys of the prevManifest.
+	removed      []string            // Shard names of only the prevManifest.
+}
+
+// prepareSet writes the changed shards of a value, and returns the
+// manifest to be switched to.  The shards of the current manifest are
+// reused when unchanged, unless the cas is CFG_CAS_FORCE, as then a
+// concurrent Set might delete them.
+func (c *CfgSharded) prepareSet(key string, sharder CfgSharder,
+	val []byte, cas uint64) (*cfgShardedWrite, error) {
+	header, shards, err := sharder.Split(val)
+	if err != nil {
+		return nil, fmt.Errorf("cfg_sharded: could not split,"+
+			" key: %s, err: %v", key, err)
+	}
+
+	prevManifest, _, err := c.getManifest(key)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &CfgShardedManifest{
+		Header: header,
+		Shards: make(map[string]*CfgShardedShardRef, len(shards)),
+	}
+
+	w := &cfgShardedWrite{c: c, key: key, prevManifest: prevManifest,
+		written: map[string]string{}}
+
+	reused := map[string]bool{}
+
+	var toWrite []string
+
+	for name, shard := range shards {
+		hash, err := computeMD5(shard)
+		if err != nil {
+			return nil, err
+		}
+
+		if prevManifest != nil && cas != CFG_CAS_FORCE {
+			prevRef := prevManifest.Shards[name]
+			if prevRef != nil && prevRef.MD5 == hash {
+				manifest.Shards[name] = prevRef
+				reused[cfgShardedShardKey(key, name, prevRef.ID)] = true
+				continue
+			}
+		}
+
+		ref := &CfgShardedShardRef{ID: NewUUID(), MD5: hash}
+		manifest.Shards[name] = ref
+		toWrite = append(toWrite, name)
+	}
+
+	if prevManifest != nil {
+		for name, ref := range prevManifest.Shards {
+			shardKey := cfgShardedShardKey(key, name, ref.ID)
+			if !reused[shardKey] {
+				w.unreferenced = append(w.unreferenced, shardKey)
+			}
+			if manifest.Shards[name] == nil {
+				w.removed = append(w.removed, name)
+			}
+		}
+	}
+
+	for _, name := range toWrite {
+		shardKey := cfgShardedShardKey(key, name, manifest.Shards[name].ID)
+
+		// Track the shard before it's written, so that it can be
+		// purged if this Set never completes.
+		err = c.updatePending(key, name, []string{shardKey}, nil)
+		if err != nil {
+			w.done(false)
+			return nil, err
+		}
+
+		w.written[name] = shardKey
+
+		_, err = c.cfg.Set(shardKey, shards[name], CFG_CAS_FORCE)
+		if err != nil {
+			w.done(false)
+			return nil, fmt.Errorf("cfg_sharded: could not write shard,"+
+				" key: %s, shard: %s, err: %v", key, name, err)
+		}
+	}
+
+	w.manifestVal, err = json.Marshal(manifest)
+	if err != nil {
+		w.done(false)
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// done cleans up after the manifest switch either succeeded or failed.
+func (w *cfgShardedWrite) done(ok bool) {
+	if ok {
+		for _, shardKey := range w.unreferenced {
+			w.c.cfg.Del(shardKey, 0)
+		}
+	}
+
+	for name, shardKey := range w.written {
+		if !ok {
+			w.c.cfg.Del(shardKey, 0)
+		}
+
+		err := w.c.updatePending(w.key, name, nil, []string{shardKey})
+		if err != nil {
+			log.Warnf("cfg_sharded: could not update pending shards,"+
+				" key: %s, shard: %s, err: %v", w.key, name, err)
+		}
+	}
+
+	if !ok {
+		return
+	}
+
+	// The pending shards of a removed shard name are otherwise only
+	// checked when that shard name is written again.
+	for _, name := range w.removed {
+		err := w.c.updatePending(w.key, name, nil, nil)
+		if err != nil {
+			log.Warnf("cfg_sharded: could not update pending shards,"+
+				" key: %s, shard: %s, err: %v", w.key, name, err)
+		}
+	}
+}
+
+// updatePending adds and removes shard keys from the pending shards of
+// a shard name, and purges its pending shards that are older than the
+// CfgShardedPurgeTimeout and are unreferenced by the manifest.  The
+// pending shards are tracked per shard name, so that concurrent Sets
+// of different shards don't contend on a single pending key.
+func (c *CfgSharded) updatePending(key, name string,
+	add, remove []string) error {
+	pendingKey := cfgShardedPendingKey(key, name)
+
+	for tries := 0; tries < 100; tries++ {
+		buf, cas, err := c.cfg.Get(pendingKey, 0)
+		if err != nil {
+			return err
+		}
+
+		pending := cfgShardedPending{}
+		if len(buf) > 0 {
+			err = json.Unmarshal(buf, &pending)
+			if err != nil {
+				return fmt.Errorf("cfg_sharded: could not parse pending,"+
+					" key: %s, shard: %s, err: %v", key, name, err)
+			}
+		}
+
+		nowMs := time.Now().UnixNano() / int64(time.Millisecond)
+
+		for _, shardKey := range add {
+			pending[shardKey] = nowMs
+		}
+		for _, shardKey := range remove {
+			delete(pending, shardKey)
+		}
+
+		orphans := c.findOrphans(key, pending, nowMs)
+		for _, shardKey := range orphans {
+			delete(pending, shardKey)
+		}
+
+		if len(add) <= 0 && len(remove) <= 0 && len(orphans) <= 0 {
+			return nil
+		}
+
+		if len(pending) > 0 {
+			buf, err = json.Marshal(pending)
+			if err != nil {
+				return err
+			}
+			_, err = c.cfg.Set(pendingKey, buf, cas)
+		} else if cas != 0 {
+			err = c.cfg.Del(pendingKey, cas)
+		}
+
+		if err == nil {
+			for _, shardKey := range orphans {
+				log.Printf("cfg_sharded: purging orphaned shard: %s", shardKey)
+				c.cfg.Del(shardKey, 0)
+			}
+			return nil
+		}
+
+		// A racing create of the pending key is not a CfgCASError
+		// with some Cfg providers, like CfgMem.
+		if _, ok := err.(*CfgCASError); !ok &&
+			!strings.Contains(err.Error(), "already exists") {
+			return err
+		}
+	}
+
+	return fmt.Errorf("cfg_sharded: too many pending update retries,"+
+		" key: %s, shard: %s", key, name)
+}
+
+// findOrphans returns the pending shards that are too old, where the
+// shards that are referenced by the manifest are kept in the wrapped
+// Cfg but are no longer pending.
+func (c *CfgSharded) findOrphans(key string,
+	pending cfgShardedPending, nowMs int64) []string {
+	timeoutMs := int64(CfgShardedPurgeTimeout / time.Millisecond)
+
+	var old []string
+	for shardKey, bornMs := range pending {
+		if nowMs-bornMs >= timeoutMs {
+			old = append(old, shardKey)
+		}
+	}
+
+	if len(old) <= 0 {
+		return nil
+	}
+
+	manifest, _, err := c.getManifest(key)
+	if err != nil {
+		return nil
+	}
+
+	var orphans []string
+	for _, shardKey := range old {
+		if manifest != nil && cfgShardedReferenced(key, manifest, shardKey) {
+			delete(pending, shardKey)
+		} else {
+			orphans = append(orphans, shardKey)
+		}
+	}
+
+	return orphans
+}
+
+func cfgShardedReferenced(key string, manifest *CfgShardedManifest,
+	shardKey string) bool {
+	for name, ref := range manifest.Shards {
+		if cfgShardedShardKey(key, name, ref.ID) == shardKey {
+			return true
+		}
+	}
+	return false
+}
+
+// ----------------------------------------------------------------
+
+// cfgPlanPIndexesSharder shards a PlanPIndexes per index, where the
+// fields that are shared by the plan pindexes of an index are stored
+// once per index, like in a lean plan.
+type cfgPlanPIndexesSharder struct{}
+
+func (s *cfgPlanPIndexesSharder) Split(val []byte) (
+	[]byte, map[string][]byte, error) {
+	var planPIndexes PlanPIndexes
+
+	err := json.Unmarshal(val, &planPIndexes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	indexPlans, err := splitLeanPlan(planPIndexes.PlanPIndexes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	shards := make(map[string][]byte, len(indexPlans))
+	for indexName, lip := range indexPlans {
+		shards[indexName], err = json.Marshal(lip)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	planPIndexes.PlanPIndexes = nil
+
+	header, err := json.Marshal(&planPIndexes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return header, shards, nil
+}
+
+func (s *cfgPlanPIndexesSharder) Join(header []byte,
+	shards map[string][]byte) ([]byte, error) {
+	var planPIndexes PlanPIndexes
+
+	err := json.Unmarshal(header, &planPIndexes)
+	if err != nil {
+		return nil, err
+	}
+
+	planPIndexes.PlanPIndexes = map[string]*PlanPIndex{}
+
+	for _, buf := range shards {
+		var lip leanIndexPlan
+
+		err = json.Unmarshal(buf, &lip)
+		if err != nil {
+			return nil, err
+		}
+
+		lip.join(planPIndexes.PlanPIndexes)
+	}
+
+	return json.Marshal(&planPIndexes)
+}
+
+// cfgNodeDefsSharder shards a NodeDefs per node.
+type cfgNodeDefsSharder struct{}
+
+func (s *cfgNodeDefsSharder) Split(val []byte) (
+	[]byte, map[string][]byte, error) {
+	var nodeDefs NodeDefs
+
+	err := json.Unmarshal(val, &nodeDefs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	shards := make(map[string][]byte, len(nodeDefs.NodeDefs))
+	for k, nodeDef := range nodeDefs.NodeDefs {
+		shards[k], err = json.Marshal(nodeDef)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	nodeDefs.NodeDefs = nil
+
+	header, err := json.Marshal(&nodeDefs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return header, shards, nil
+}
+
+func (s *cfgNodeDefsSharder) Join(header []byte,
+	shards map[string][]byte) ([]byte, error) {
+	var nodeDefs NodeDefs
+
+	err := json.Unmarshal(header, &nodeDefs)
+	if err != nil {
+		return nil, err
+	}
+
+	nodeDefs.NodeDefs = make(map[string]*NodeDef, len(shards))
+
+	for k, shard := range shards {
+		nodeDef := &NodeDef{}
+
+		err = json.Unmarshal(shard, nodeDef)
+		if err != nil {
+			return nil, err
+		}
+
+		nodeDefs.NodeDefs[k] = nodeDef
+	}
+
+	return json.Marshal(&nodeDefs)
+}
@@ -0,0 +1,362 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testShardedPlanPIndexes(numIndexes, numPartitions int) *PlanPIndexes {
+	planPIndexes := NewPlanPIndexes(VERSION)
+	for i := 0; i < numIndexes; i++ {
+		for j := 0; j < numPartitions; j++ {
+			name := fmt.Sprintf("idx%d_%d", i, j)
+			planPIndexes.PlanPIndexes[name] = &PlanPIndex{
+				Name:             name,
+				UUID:             "u" + name,
+				IndexType:        "blackhole",
+				IndexName:        fmt.Sprintf("idx%d", i),
+				IndexUUID:        fmt.Sprintf("iu%d", i),
+				IndexParams:      `{"x":1}`,
+				SourceType:       "nil",
+				SourceParams:     `{"numPartitions":4}`,
+				SourcePartitions: fmt.Sprintf("%d", j),
+				Nodes: map[string]*PlanPIndexNode{
+					"n0": {CanRead: true, CanWrite: true},
+				},
+			}
+		}
+	}
+	planPIndexes.Warnings["idx0"] = []string{"w"}
+	return planPIndexes
+}
+
+// testShardedCfg returns a cfg to be wrapped whose cluster version
+// supports sharding.
+func testShardedCfg() *versionTestCfg {
+	version, _ := CompatibilityVersion(CfgShardedVersion)
+	return &versionTestCfg{NewCfgMem(), version}
+}
+
+// testShardKeys returns the shard keys of a key in the wrapped cfg.
+func testShardKeys(inner *CfgMem, key string) []string {
+	var rv []string
+	for k := range inner.Entries {
+		if strings.HasPrefix(k, cfgShardedManifestKey(key)+"/") {
+			rv = append(rv, k)
+		}
+	}
+	return rv
+}
+
+func TestCfgShardedPlanPIndexes(t *testing.T) {
+	inner := testShardedCfg()
+
+	c, err := NewCfgSharded(inner, nil)
+	if err != nil || GetCfgSharded(c) == nil {
+		t.Fatalf("expected NewCfgSharded to work, err: %v", err)
+	}
+	if _, ok := c.(CfgTxn); !ok {
+		t.Errorf("expected CfgTxn support to be kept")
+	}
+	if _, ok := c.(VersionReader); !ok {
+		t.Errorf("expected VersionReader support to be kept")
+	}
+	if _, err = NewCfgSharded(inner, []string{"nope"}); err == nil {
+		t.Errorf("expected err on a key without a sharder")
+	}
+
+	planPIndexes := testShardedPlanPIndexes(3, 4)
+
+	cas, err := CfgSetPlanPIndexes(c, planPIndexes, 0)
+	if err != nil {
+		t.Fatalf("expected set to work, err: %v", err)
+	}
+
+	if v, _, _ := inner.Get(PLAN_PINDEXES_KEY, 0); v != nil {
+		t.Errorf("expected no unsharded value")
+	}
+	if n := len(testShardKeys(inner.CfgMem, PLAN_PINDEXES_KEY)); n != 3 {
+		t.Errorf("expected a shard per index, got: %d", n)
+	}
+
+	planPIndexes2, cas2, err := CfgGetPlanPIndexes(c)
+	if err != nil || cas2 != cas ||
+		!SamePlanPIndexes(planPIndexes, planPIndexes2) ||
+		planPIndexes2.UUID != planPIndexes.UUID ||
+		len(planPIndexes2.Warnings["idx0"]) != 1 {
+		t.Fatalf("expected the plan to round trip, err: %v", err)
+	}
+	if planPIndexes2.PlanPIndexes["idx1_2"].SourceParams !=
+		planPIndexes.PlanPIndexes["idx1_2"].SourceParams {
+		t.Errorf("expected the shared fields to round trip")
+	}
+
+	_, err = CfgSetPlanPIndexes(c, planPIndexes, cas+100)
+	if _, ok := err.(*CfgCASError); !ok {
+		t.Errorf("expected a CAS mismatch, err: %v", err)
+	}
+	if n := len(testShardKeys(inner.CfgMem, PLAN_PINDEXES_KEY)); n != 3 {
+		t.Errorf("expected a failed set to clean up its shards, got: %d", n)
+	}
+
+	manifest, _, _ := GetCfgSharded(c).getManifest(PLAN_PINDEXES_KEY)
+	idx0ID := manifest.Shards["idx0"].ID
+
+	// Only the changed index is rewritten.
+	planPIndexes.PlanPIndexes["idx1_0"].Nodes["n1"] =
+		&PlanPIndexNode{CanRead: true}
+	cas, err = CfgSetPlanPIndexes(c, planPIndexes, cas)
+	if err != nil {
+		t.Fatalf("expected set to work, err: %v", err)
+	}
+
+	manifest2, _, _ := GetCfgSharded(c).getManifest(PLAN_PINDEXES_KEY)
+	if manifest2.Shards["idx0"].ID != idx0ID ||
+		manifest2.Shards["idx1"].ID == manifest.Shards["idx1"].ID {
+		t.Errorf("expected only the changed shard to be rewritten")
+	}
+	if n := len(testShardKeys(inner.CfgMem, PLAN_PINDEXES_KEY)); n != 3 {
+		t.Errorf("expected the replaced shard to be deleted, got: %d", n)
+	}
+
+	planPIndexes2, _, _ = CfgGetPlanPIndexes(c)
+	if planPIndexes2.PlanPIndexes["idx1_0"].Nodes["n1"] == nil {
+		t.Errorf("expected the change to be seen")
+	}
+
+	// A corrupted shard is detected.
+	shardKey := cfgShardedShardKey(PLAN_PINDEXES_KEY, "idx0", idx0ID)
+	inner.Set(shardKey, []byte(`{"indexName":"idx0"}`), CFG_CAS_FORCE)
+	_, _, err = c.Get(PLAN_PINDEXES_KEY, 0)
+	if err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("expected a checksum err, err: %v", err)
+	}
+
+	err = c.Del(PLAN_PINDEXES_KEY, cas)
+	if err != nil {
+		t.Errorf("expected del to work, err: %v", err)
+	}
+	if len(inner.Entries) != 0 {
+		t.Errorf("expected del to remove every entry, got: %#v",
+			inner.Entries)
+	}
+}
+
+func TestCfgShardedUpgradeAndSubscribe(t *testing.T) {
+	inner := NewCfgMem()
+
+	nodeDefs := NewNodeDefs(VERSION)
+	nodeDefs.NodeDefs["a"] = &NodeDef{UUID: "a", HostPort: "a:1000"}
+
+	cas, err := CfgSetNodeDefs(inner, NODE_DEFS_KNOWN, nodeDefs, 0)
+	if err != nil {
+		t.Fatalf("expected set to work, err: %v", err)
+	}
+
+	c, _ := NewCfgSharded(inner, []string{CfgNodeDefsKey(NODE_DEFS_KNOWN)})
+	if _, ok := c.(VersionReader); ok {
+		t.Errorf("expected no VersionReader without a wrapped one")
+	}
+
+	ch := make(chan CfgEvent, 10)
+	err = c.Subscribe(CfgNodeDefsKey(NODE_DEFS_KNOWN), ch)
+	if err != nil {
+		t.Fatalf("expected subscribe to work, err: %v", err)
+	}
+
+	nodeDefs2, cas2, err := CfgGetNodeDefs(c, NODE_DEFS_KNOWN)
+	if err != nil || cas2 != cas || nodeDefs2.NodeDefs["a"] == nil {
+		t.Fatalf("expected the unsharded value to be read, err: %v", err)
+	}
+
+	_, err = CfgSetNodeDefs(c, NODE_DEFS_KNOWN, nodeDefs, cas+100)
+	if _, ok := err.(*CfgCASError); !ok {
+		t.Errorf("expected a CAS mismatch, err: %v", err)
+	}
+
+	// Until every node understands shards, the value stays unsharded.
+	nodeDefs.NodeDefs["b"] = &NodeDef{UUID: "b", HostPort: "b:1000"}
+	cas, err = CfgSetNodeDefs(c, NODE_DEFS_KNOWN, nodeDefs, cas)
+	if err != nil {
+		t.Fatalf("expected set to work, err: %v", err)
+	}
+	if v, _, _ := inner.Get(CfgNodeDefsKey(NODE_DEFS_KNOWN), 0); v == nil {
+		t.Errorf("expected the unsharded value to be kept")
+	}
+	if n := len(testShardKeys(inner, CfgNodeDefsKey(NODE_DEFS_KNOWN))); n != 0 {
+		t.Errorf("expected no shards, got: %d", n)
+	}
+
+	_, err = inner.Set(VERSION_KEY, []byte(CfgShardedVersion), 0)
+	if err != nil {
+		t.Fatalf("expected version set to work, err: %v", err)
+	}
+
+	nodeDefs.NodeDefs["c"] = &NodeDef{UUID: "c", HostPort: "c:1000"}
+	cas, err = CfgSetNodeDefs(c, NODE_DEFS_KNOWN, nodeDefs, cas)
+	if err != nil {
+		t.Fatalf("expected set to replace the unsharded value, err: %v", err)
+	}
+	if v, _, _ := inner.Get(CfgNodeDefsKey(NODE_DEFS_KNOWN), 0); v != nil {
+		t.Errorf("expected the unsharded value to be deleted")
+	}
+	if n := len(testShardKeys(inner, CfgNodeDefsKey(NODE_DEFS_KNOWN))); n != 3 {
+		t.Errorf("expected a shard per node, got: %d", n)
+	}
+
+	nodeDefs2, cas2, err = CfgGetNodeDefs(c, NODE_DEFS_KNOWN)
+	if err != nil || cas2 != cas || nodeDefs2.UUID != nodeDefs.UUID ||
+		nodeDefs2.NodeDefs["b"].HostPort != "b:1000" {
+		t.Errorf("expected the sharded value to be read, err: %v", err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-ch:
+			if ev.Key != CfgNodeDefsKey(NODE_DEFS_KNOWN) {
+				t.Errorf("expected the event key to be renamed, ev: %#v", ev)
+			}
+			if ev.CAS != cas {
+				continue // The unsharded value's deletion.
+			}
+		case <-timeout:
+			t.Fatalf("expected a manifest event")
+		}
+		break
+	}
+
+	// Unsharded keys pass through.
+	_, err = c.Set(CfgNodeDefsKey(NODE_DEFS_WANTED), []byte("{}"), 0)
+	if err != nil {
+		t.Errorf("expected a pass through set to work, err: %v", err)
+	}
+	if v, _, _ := inner.Get(CfgNodeDefsKey(NODE_DEFS_WANTED), 0); v == nil {
+		t.Errorf("expected the pass through set to reach the wrapped cfg")
+	}
+}
+
+func TestCfgShardedTxnAndOrphans(t *testing.T) {
+	inner := testShardedCfg()
+	c, _ := NewCfgSharded(inner, nil)
+
+	planPIndexes := testShardedPlanPIndexes(2, 2)
+
+	op, _ := CfgTxnOpSetPlanPIndexes(planPIndexes, 0)
+	casSuccess, err := c.(CfgTxn).Txn([]CfgTxnOp{
+		{Op: CFG_TXN_OP_SET, Key: "other", Val: []byte("x")},
+		op,
+	})
+	if err != nil || len(casSuccess) != 2 {
+		t.Fatalf("expected txn to work, err: %v", err)
+	}
+
+	planPIndexes2, cas, err := CfgGetPlanPIndexes(c)
+	if err != nil || cas != casSuccess[1] ||
+		!SamePlanPIndexes(planPIndexes, planPIndexes2) {
+		t.Fatalf("expected the txn to set the plan, err: %v", err)
+	}
+
+	op, _ = CfgTxnOpSetPlanPIndexes(testShardedPlanPIndexes(1, 1), cas+100)
+	_, err = c.(CfgTxn).Txn([]CfgTxnOp{op})
+	if _, ok := err.(*CfgCASError); !ok {
+		t.Errorf("expected a txn CAS mismatch, err: %v", err)
+	}
+	if n := len(testShardKeys(inner.CfgMem, PLAN_PINDEXES_KEY)); n != 2 {
+		t.Errorf("expected a failed txn to clean up its shards, got: %d", n)
+	}
+
+	// A shard of a crashed writer is purged once it's old enough, on
+	// the next write of its shard name.
+	orphan := cfgShardedShardKey(PLAN_PINDEXES_KEY, "idx0", "crashed")
+	inner.Set(orphan, []byte("{}"), 0)
+	buf, _ := json.Marshal(cfgShardedPending{orphan: 1})
+	inner.Set(cfgShardedPendingKey(PLAN_PINDEXES_KEY, "idx0"), buf, 0)
+
+	_, err = c.(CfgTxn).Txn([]CfgTxnOp{
+		{Op: CFG_TXN_OP_DEL, Key: PLAN_PINDEXES_KEY, CAS: cas},
+	})
+	if err != nil {
+		t.Errorf("expected a txn del to work, err: %v", err)
+	}
+
+	_, err = CfgSetPlanPIndexes(c, planPIndexes, 0)
+	if err != nil {
+		t.Errorf("expected set to work, err: %v", err)
+	}
+	if v, _, _ := inner.Get(orphan, 0); v != nil {
+		t.Errorf("expected the orphaned shard to be purged")
+	}
+	for _, name := range []string{"idx0", "idx1"} {
+		pendingKey := cfgShardedPendingKey(PLAN_PINDEXES_KEY, name)
+		if v, _, _ := inner.Get(pendingKey, 0); v != nil {
+			t.Errorf("expected no pending shards, got: %s", v)
+		}
+	}
+	if n := len(testShardKeys(inner.CfgMem, PLAN_PINDEXES_KEY)); n != 2 {
+		t.Errorf("expected only the current shards, got: %d", n)
+	}
+}
+
+func TestManagerCfgSharded(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	// The nodeDefs are registered before the manager checks the
+	// version, so start from a cluster that's already upgraded.
+	inner := NewCfgMem()
+	inner.Set(VERSION_KEY, []byte(VERSION), 0)
+	cfg, _ := NewCfgSharded(inner, nil)
+
+	m := NewManager(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+	err := m.Start("wanted")
+	if err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		err = m.CreateIndex("primary", "default", "", `{"numPartitions":4}`,
+			"blackhole", fmt.Sprintf("idx%d", i), "",
+			PlanParams{MaxPartitionsPerPIndex: 1}, "")
+		if err != nil {
+			t.Fatalf("expected CreateIndex to work, err: %v", err)
+		}
+	}
+
+	m.PlannerKick("test")
+	m.JanitorKick("test")
+
+	planPIndexes, _, err := CfgGetPlanPIndexes(cfg)
+	if err != nil || len(planPIndexes.PlanPIndexes) != 12 {
+		t.Fatalf("expected 12 plan pindexes, err: %v", err)
+	}
+	if n := len(testShardKeys(inner, PLAN_PINDEXES_KEY)); n != 3 {
+		t.Errorf("expected a plan shard per index, got: %d", n)
+	}
+	if n := len(testShardKeys(inner, CfgNodeDefsKey(NODE_DEFS_WANTED))); n != 1 {
+		t.Errorf("expected a nodeDefs shard per node, got: %d", n)
+	}
+
+	_, pindexes := m.CurrentMaps()
+	if len(pindexes) != 12 {
+		t.Errorf("expected the janitor to follow the plan, got: %d",
+			len(pindexes))
+	}
+}
@@ -12,18 +12,37 @@
 package cbgt
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"os"
 	"sync"
+	"time"
+
+	log "github.com/couchbase/clog"
 )
 
+// CfgSimpleWatchInterval is how often a CfgSimple with subscribers
+// checks its file for changes made by other processes.
+var CfgSimpleWatchInterval = time.Second
+
 // CfgSimple is a local-only, persisted (in a single file)
 // implementation of the Cfg interface that's useful for
 // non-clustered, single-node instances for developers.
+//
+// Multiple processes (or multiple CfgSimple instances) may share the
+// same file.  Mutations take an advisory lock on a sibling ".lock"
+// file and are CAS-checked against the latest on-disk state, and
+// changes made by others are noticed on the next Get/Set/Del, or by
+// a background watcher once there are subscribers.
 type CfgSimple struct {
 	m      sync.Mutex
 	path   string
 	cfgMem *CfgMem
+
+	stat   os.FileInfo   // Of the file when it was last loaded or saved.
+	stopCh chan struct{} // Non-nil when the watcher is running.
 }
 
 // NewCfgSimple returns a CfgSimple that reads and stores its single
@@ -40,6 +59,11 @@ func (c *CfgSimple) Get(key string, cas uint64) (
 	c.m.Lock()
 	defer c.m.Unlock()
 
+	err := c.unlockedSync()
+	if err != nil {
+		return nil, 0, err
+	}
+
 	return c.cfgMem.Get(key, cas)
 }
 
@@ -48,13 +72,26 @@ func (c *CfgSimple) Set(key string, val []byte, cas uint64) (
 	c.m.Lock()
 	defer c.m.Unlock()
 
-	cas, err := c.cfgMem.Set(key, val, cas)
+	f, err := c.lockFile(true)
+	if err != nil {
+		return 0, err
+	}
+	defer c.unlockFile(f)
+
+	err = c.unlockedReload(false, true)
+	if err != nil {
+		return 0, err
+	}
+
+	cas, err = c.cfgMem.Set(key, val, cas)
 	if err != nil {
 		return 0, err
 	}
 
 	err = c.unlockedSave()
 	if err != nil {
+		// Go back to what's on disk, as nothing was committed.
+		c.unlockedReload(false, true)
 		return 0, err
 	}
 	return cas, err
@@ -64,13 +101,64 @@ func (c *CfgSimple) Del(key string, cas uint64) error {
 	c.m.Lock()
 	defer c.m.Unlock()
 
-	err := c.cfgMem.Del(key, cas)
+	f, err := c.lockFile(true)
+	if err != nil {
+		return err
+	}
+	defer c.unlockFile(f)
+
+	err = c.unlockedReload(false, true)
+	if err != nil {
+		return err
+	}
+
+	err = c.cfgMem.Del(key, cas)
 	if err != nil {
 		return err
 	}
-	return c.unlockedSave()
+
+	err = c.unlockedSave()
+	if err != nil {
+		// Go back to what's on disk, as nothing was committed.
+		c.unlockedReload(false, true)
+		return err
+	}
+	return nil
 }
 
+// Txn implements the CfgTxn interface, where the ops are CAS-checked
+// against the latest on-disk state and saved with a single write.
+func (c *CfgSimple) Txn(ops []CfgTxnOp) ([]uint64, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	f, err := c.lockFile(true)
+	if err != nil {
+		return nil, err
+	}
+	defer c.unlockFile(f)
+
+	err = c.unlockedReload(false, true)
+	if err != nil {
+		return nil, err
+	}
+
+	casSuccess, err := c.cfgMem.Txn(ops)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.unlockedSave()
+	if err != nil {
+		// Go back to what's on disk, as nothing was committed.
+		c.unlockedReload(false, true)
+		return nil, err
+	}
+
+	return casSuccess, nil
+}
+
+// Load reads the file, which must exist.
 func (c *CfgSimple) Load() error {
 	c.m.Lock()
 	defer c.m.Unlock()
@@ -79,48 +167,224 @@ func (c *CfgSimple) Load() error {
 }
 
 func (c *CfgSimple) unlockedLoad() error {
-	buf, err := ioutil.ReadFile(c.path)
+	f, err := c.lockFile(false)
 	if err != nil {
 		return err
 	}
+	defer c.unlockFile(f)
 
-	cfgMem := NewCfgMem()
-	err = json.Unmarshal(buf, cfgMem)
+	return c.unlockedReload(true, true)
+}
+
+// unlockedSync reloads the file if it was changed by others since it
+// was last loaded or saved, firing events for the changed keys.
+func (c *CfgSimple) unlockedSync() error {
+	stat, err := os.Stat(c.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		stat = nil
+	}
+	if sameCfgSimpleStat(c.stat, stat) {
+		return nil
+	}
+
+	f, err := c.lockFile(false)
 	if err != nil {
 		return err
 	}
+	defer c.unlockFile(f)
+
+	return c.unlockedReload(false, true)
+}
+
+// unlockedReload reads the file while the caller holds the file
+// lock.  A missing file is treated as an empty configuration unless
+// mustExist is true.
+func (c *CfgSimple) unlockedReload(mustExist, fire bool) error {
+	cfgMem := NewCfgMem()
+
+	stat, err := os.Stat(c.path)
+	if err != nil {
+		if mustExist || !os.IsNotExist(err) {
+			return err
+		}
+		stat = nil
+	}
+
+	if stat != nil {
+		buf, err := ioutil.ReadFile(c.path)
+		if err != nil {
+			return err
+		}
+
+		err = json.Unmarshal(buf, cfgMem)
+		if err != nil {
+			return fmt.Errorf("cfg_simple: could not parse, path: %s,"+
+				" err: %v", c.path, err)
+		}
+	}
+
+	c.stat = stat
+
+	c.cfgMem.m.Lock()
+	defer c.cfgMem.m.Unlock()
+
+	prevEntries := c.cfgMem.Entries
+
+	// CAS values never go backwards, even if the file was removed.
+	if c.cfgMem.CASNext < cfgMem.CASNext {
+		c.cfgMem.CASNext = cfgMem.CASNext
+	}
+	c.cfgMem.Entries = cfgMem.Entries
+
+	if fire {
+		for key := range c.cfgMem.subscriptions {
+			prevEntry := prevEntries[key]
+			nextEntry := c.cfgMem.Entries[key]
+			if nextEntry == nil {
+				if prevEntry != nil {
+					c.cfgMem.fireEvent(key, 0, nil, nil)
+				}
+			} else if prevEntry == nil ||
+				prevEntry.CAS != nextEntry.CAS ||
+				!bytes.Equal(prevEntry.Val, nextEntry.Val) {
+				c.cfgMem.fireEvent(key, nextEntry.CAS, nextEntry.Val, nil)
+			}
+		}
+	}
 
-	c.cfgMem = cfgMem
 	return nil
 }
 
+// unlockedSave writes the file while the caller holds the exclusive
+// file lock, via a rename so that readers never see a partial file.
 func (c *CfgSimple) unlockedSave() error {
 	buf, err := json.Marshal(c.cfgMem)
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(c.path, []byte(string(buf)+"\n"), 0600)
+
+	pathTmp := c.path + ".tmp"
+
+	err = ioutil.WriteFile(pathTmp, []byte(string(buf)+"\n"), 0600)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(pathTmp, c.path)
+	if err != nil {
+		os.Remove(pathTmp)
+		return err
+	}
+
+	stat, err := os.Stat(c.path)
+	if err != nil {
+		return err
+	}
+	c.stat = stat
+
+	return nil
+}
+
+// lockFile opens and takes an advisory lock on the sibling ".lock"
+// file, which coordinates the processes that share the file.
+func (c *CfgSimple) lockFile(exclusive bool) (*os.File, error) {
+	f, err := os.OpenFile(c.path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = flockFile(f, exclusive)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cfg_simple: could not lock, path: %s,"+
+			" err: %v", c.path, err)
+	}
+
+	return f, nil
+}
+
+func (c *CfgSimple) unlockFile(f *os.File) {
+	funlockFile(f)
+	f.Close()
+}
+
+func sameCfgSimpleStat(a, b os.FileInfo) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return os.SameFile(a, b) &&
+		a.Size() == b.Size() &&
+		a.ModTime().Equal(b.ModTime())
 }
 
 func (c *CfgSimple) Subscribe(key string, ch chan CfgEvent) error {
 	c.m.Lock()
 	defer c.m.Unlock()
 
+	if c.stopCh == nil {
+		c.stopCh = make(chan struct{})
+		go c.watch(c.stopCh, CfgSimpleWatchInterval)
+	}
+
 	return c.cfgMem.Subscribe(key, ch)
 }
 
+// watch polls the file for changes made by others until stopCh is
+// closed.
+func (c *CfgSimple) watch(stopCh chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var errPrev error
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		c.m.Lock()
+		err := c.unlockedSync()
+		c.m.Unlock()
+
+		if err != nil && (errPrev == nil || err.Error() != errPrev.Error()) {
+			log.Printf("cfg_simple: watch, path: %s, err: %v", c.path, err)
+		}
+		errPrev = err
+	}
+}
+
+// Close stops the background watcher, if any.
+func (c *CfgSimple) Close() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.stopCh != nil {
+		close(c.stopCh)
+		c.stopCh = nil
+	}
+
+	return nil
+}
+
 func (c *CfgSimple) Refresh() error {
 	c.m.Lock()
 	defer c.m.Unlock()
 
-	c2 := NewCfgSimple(c.path)
-	err := c2.Load()
+	f, err := c.lockFile(false)
 	if err != nil {
 		return err
 	}
 
-	c.cfgMem.CASNext = c2.cfgMem.CASNext
-	c.cfgMem.Entries = c2.cfgMem.Entries
+	err = c.unlockedReload(true, false)
+	c.unlockFile(f)
+	if err != nil {
+		return err
+	}
 
 	return c.cfgMem.Refresh()
 }
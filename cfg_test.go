@@ -12,145 +12,38 @@
 package cbgt
 
 import (
-	"fmt"
 	"io/ioutil"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
-type ErrorOnlyCfg struct{}
-
-func (c *ErrorOnlyCfg) Get(key string, cas uint64) (
-	[]byte, uint64, error) {
-	return nil, 0, fmt.Errorf("error only")
-}
-
-func (c *ErrorOnlyCfg) Set(key string, val []byte, cas uint64) (
-	uint64, error) {
-	return 0, fmt.Errorf("error only")
+// newErrorOnlyCfg returns a Cfg whose every operation fails.
+func newErrorOnlyCfg() Cfg {
+	return NewCfgFaulty(NewCfgMem(), CfgFaultyOptions{
+		ErrorRates: map[string]float64{
+			CFG_FAULTY_OP_GET:       1.0,
+			CFG_FAULTY_OP_SET:       1.0,
+			CFG_FAULTY_OP_DEL:       1.0,
+			CFG_FAULTY_OP_SUBSCRIBE: 1.0,
+			CFG_FAULTY_OP_REFRESH:   1.0,
+			CFG_FAULTY_OP_TXN:       1.0,
+		},
+	})
 }
 
-func (c *ErrorOnlyCfg) Del(key string, cas uint64) error {
-	return fmt.Errorf("error only")
+// versionTestCfg is a CfgMem that's also a VersionReader.
+type versionTestCfg struct {
+	*CfgMem
+	version uint64
 }
 
-func (c *ErrorOnlyCfg) Subscribe(key string, ch chan CfgEvent) error {
-	return fmt.Errorf("error only")
-}
-
-func (c *ErrorOnlyCfg) Refresh() error {
-	return fmt.Errorf("error only")
-}
-
-// ------------------------------------------------
-
-type ErrorAfterCfg struct {
-	inner    Cfg
-	errAfter int
-	numOps   int
-}
-
-func (c *ErrorAfterCfg) Get(key string, cas uint64) (
-	[]byte, uint64, error) {
-	c.numOps++
-	if c.numOps > c.errAfter {
-		return nil, 0, fmt.Errorf("error after")
-	}
-	return c.inner.Get(key, cas)
-}
-
-func (c *ErrorAfterCfg) Set(key string, val []byte, cas uint64) (
-	uint64, error) {
-	c.numOps++
-	if c.numOps > c.errAfter {
-		return 0, fmt.Errorf("error after")
-	}
-	return c.inner.Set(key, val, cas)
-}
-
-func (c *ErrorAfterCfg) Del(key string, cas uint64) error {
-	c.numOps++
-	if c.numOps > c.errAfter {
-		return fmt.Errorf("error after")
-	}
-	return c.inner.Del(key, cas)
-}
-
-func (c *ErrorAfterCfg) Subscribe(key string, ch chan CfgEvent) error {
-	c.numOps++
-	if c.numOps > c.errAfter {
-		return fmt.Errorf("error after")
-	}
-	return c.inner.Subscribe(key, ch)
-}
-
-func (c *ErrorAfterCfg) Refresh() error {
-	c.numOps++
-	if c.numOps > c.errAfter {
-		return fmt.Errorf("error after")
-	}
-	return c.inner.Refresh()
-}
-
-// ------------------------------------------------
-
-type ErrorUntilCfg struct {
-	inner    Cfg
-	errUntil int
-	numOps   int
-}
-
-func (c *ErrorUntilCfg) Get(key string, cas uint64) (
-	[]byte, uint64, error) {
-	c.numOps++
-	if c.numOps < c.errUntil {
-		return nil, 0, fmt.Errorf("Get error until %d", c.errUntil)
-	}
-	return c.inner.Get(key, cas)
-}
-
-func (c *ErrorUntilCfg) Set(key string, val []byte, cas uint64) (
-	uint64, error) {
-	c.numOps++
-	if c.numOps < c.errUntil {
-		return 0, fmt.Errorf("Set error until %d", c.errUntil)
-	}
-	return c.inner.Set(key, val, cas)
-}
-
-func (c *ErrorUntilCfg) Del(key string, cas uint64) error {
-	c.numOps++
-	if c.numOps < c.errUntil {
-		return fmt.Errorf("Del error until %d", c.errUntil)
-	}
-	return c.inner.Del(key, cas)
-}
-
-func (c *ErrorUntilCfg) Subscribe(key string, ch chan CfgEvent) error {
-	c.numOps++
-	if c.numOps < c.errUntil {
-		return fmt.Errorf("Subscribe error until %d", c.errUntil)
-	}
-	return c.inner.Subscribe(key, ch)
-}
-
-func (c *ErrorUntilCfg) Refresh() error {
-	c.numOps++
-	if c.numOps < c.errUntil {
-		return fmt.Errorf("Refresh error until %d", c.errUntil)
-	}
-	return c.inner.Refresh()
-}
-
-func (c *ErrorUntilCfg) ClusterVersion() (uint64, error) {
-	c.numOps++
-	if c.numOps < c.errUntil {
-		return 0, fmt.Errorf("ClusterVersion error until %d",
-			c.errUntil)
-	}
-	return CompatibilityVersion(LeanPlanVersion)
+func (c *versionTestCfg) ClusterVersion() (uint64, error) {
+	return c.version, nil
 }
 
 // ------------------------------------------------
@@ -267,6 +160,144 @@ func testCfg(t *testing.T, c Cfg) {
 	}
 }
 
+func TestCfgMemTxn(t *testing.T) {
+	testCfgTxn(t, NewCfgMem())
+}
+
+func TestCfgSimpleTxn(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	path := emptyDir + string(os.PathSeparator) + "test.cfg"
+
+	testCfgTxn(t, NewCfgSimple(path))
+
+	c2 := NewCfgSimple(path)
+	if err := c2.Load(); err != nil {
+		t.Errorf("expected Load() to work")
+	}
+	v, cas, err := c2.Get("b", 0)
+	if err != nil || string(v) != "B" || cas == 0 {
+		t.Errorf("expected Txn() to be saved, v: %s, err: %v", v, err)
+	}
+}
+
+type testCfgTxnCfg interface {
+	Cfg
+	CfgTxn
+}
+
+func testCfgTxn(t *testing.T, c testCfgTxnCfg) {
+	ec := make(chan CfgEvent, 10)
+	c.Subscribe("a", ec)
+
+	casA, err := c.Set("a", []byte("A"), 0)
+	if err != nil {
+		t.Fatalf("expected Set() to work, err: %v", err)
+	}
+	<-ec
+
+	// A failed check means nothing is applied.
+	_, err = c.Txn([]CfgTxnOp{
+		{Op: CFG_TXN_OP_SET, Key: "b", Val: []byte("B")},
+		{Op: CFG_TXN_OP_CHECK, Key: "a", CAS: casA + 100},
+	})
+	if _, ok := err.(*CfgCASError); !ok {
+		t.Errorf("expected CfgCASError on failed check, err: %v", err)
+	}
+	v, _, err := c.Get("b", 0)
+	if err != nil || v != nil {
+		t.Errorf("expected no partial Txn()")
+	}
+
+	_, err = c.Txn([]CfgTxnOp{
+		{Op: CFG_TXN_OP_CHECK, Key: "nope", CAS: 0},
+		{Op: CFG_TXN_OP_SET, Key: "b", Val: []byte("B")},
+		{Op: CFG_TXN_OP_SET, Key: "a", Val: []byte("A"), CAS: 0},
+	})
+	if err == nil {
+		t.Errorf("expected Txn() to fail on re-creation with CAS 0")
+	}
+	v, _, err = c.Get("b", 0)
+	if err != nil || v != nil {
+		t.Errorf("expected no partial Txn()")
+	}
+
+	_, err = c.Txn([]CfgTxnOp{{Op: "bogus", Key: "a"}})
+	if err == nil {
+		t.Errorf("expected Txn() to fail on unknown op")
+	}
+
+	casSuccess, err := c.Txn([]CfgTxnOp{
+		{Op: CFG_TXN_OP_CHECK, Key: "nope", CAS: 0},
+		{Op: CFG_TXN_OP_SET, Key: "b", Val: []byte("B")},
+		{Op: CFG_TXN_OP_SET, Key: "a", Val: []byte("AA"), CAS: casA},
+	})
+	if err != nil || len(casSuccess) != 3 ||
+		casSuccess[0] != 0 || casSuccess[1] == 0 || casSuccess[2] == 0 {
+		t.Fatalf("expected Txn() to work, casSuccess: %v, err: %v",
+			casSuccess, err)
+	}
+	v, cas, err := c.Get("a", 0)
+	if err != nil || string(v) != "AA" || cas != casSuccess[2] {
+		t.Errorf("expected Txn() to update a")
+	}
+	e := <-ec
+	if e.Key != "a" || e.CAS != casSuccess[2] {
+		t.Errorf("expected event on Txn(), got: %+v", e)
+	}
+
+	casSuccess, err = c.Txn([]CfgTxnOp{
+		{Op: CFG_TXN_OP_DEL, Key: "a", CAS: cas},
+		{Op: CFG_TXN_OP_CHECK, Key: "a", CAS: 0},
+	})
+	if err != nil || len(casSuccess) != 2 {
+		t.Errorf("expected Txn() del to work, err: %v", err)
+	}
+	v, cas, err = c.Get("a", 0)
+	if err != nil || v != nil || cas != 0 {
+		t.Errorf("expected Txn() to delete a")
+	}
+	e = <-ec
+	if e.Key != "a" || e.CAS != 0 {
+		t.Errorf("expected deletion event on Txn(), got: %+v", e)
+	}
+}
+
+func TestWrapCfg(t *testing.T) {
+	for i, test := range []struct {
+		cfg             Cfg
+		isTxn, isReader bool
+	}{
+		{struct{ Cfg }{NewCfgMem()}, false, false},
+		{NewCfgMem(), true, false},
+		{struct {
+			Cfg
+			VersionReader
+		}{NewCfgMem(), &versionTestCfg{version: 1}}, false, true},
+		{&versionTestCfg{NewCfgMem(), 1}, true, true},
+	} {
+		for _, c := range []Cfg{
+			NewCfgHistory(test.cfg, "node0", 0),
+			NewCfgFaulty(test.cfg, CfgFaultyOptions{}),
+		} {
+			_, isTxn := c.(CfgTxn)
+			_, isReader := c.(VersionReader)
+			if isTxn != test.isTxn || isReader != test.isReader {
+				t.Errorf("%d: expected only the wrapped cfg's interfaces,"+
+					" c: %T, isTxn: %t, isReader: %t", i, c, isTxn, isReader)
+			}
+			if unwrapCfgWrapper(c) == nil {
+				t.Errorf("%d: expected the wrapper, c: %T", i, c)
+			}
+		}
+	}
+
+	if unwrapCfgWrapper(NewCfgMem()) != nil {
+		t.Errorf("expected no wrapper of a plain cfg")
+	}
+}
+
 func TestCfgCASError(t *testing.T) {
 	err := &CfgCASError{}
 	if err.Error() != "CAS mismatch" {
@@ -320,6 +351,49 @@ func TestCfgSimpleSave(t *testing.T) {
 	}
 }
 
+func TestCfgSimpleSaveErrorReloads(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	path := emptyDir + string(os.PathSeparator) + "test.cfg"
+
+	c := NewCfgSimple(path)
+	casA, err := c.Set("a", []byte("A"), 0)
+	if err != nil {
+		t.Fatalf("expected Set() to work, err: %v", err)
+	}
+
+	// A directory in the way of the temp file makes saves fail.
+	os.Mkdir(path+".tmp", 0700)
+
+	_, err = c.Set("a", []byte("AA"), casA)
+	if err == nil {
+		t.Errorf("expected Set() to fail when it can't save")
+	}
+	v, cas, err := c.Get("a", 0)
+	if err != nil || string(v) != "A" || cas != casA {
+		t.Errorf("expected the unsaved Set() to be undone, v: %s,"+
+			" cas: %d, err: %v", v, cas, err)
+	}
+
+	err = c.Del("a", casA)
+	if err == nil {
+		t.Errorf("expected Del() to fail when it can't save")
+	}
+	v, _, err = c.Get("a", 0)
+	if err != nil || string(v) != "A" {
+		t.Errorf("expected the unsaved Del() to be undone, v: %s,"+
+			" err: %v", v, err)
+	}
+
+	os.Remove(path + ".tmp")
+
+	_, err = c.Set("a", []byte("AA"), casA)
+	if err != nil {
+		t.Errorf("expected Set() with the saved CAS to work, err: %v", err)
+	}
+}
+
 func TestCfgSimpleSubscribe(t *testing.T) {
 	emptyDir, _ := ioutil.TempDir("./tmp", "test")
 	defer os.RemoveAll(emptyDir)
@@ -407,6 +481,150 @@ func TestCfgSimpleSubscribe(t *testing.T) {
 	}
 }
 
+func TestCfgSimpleMultiProcess(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	path := emptyDir + string(os.PathSeparator) + "test.cfg"
+
+	// Two instances on the same file stand in for two processes.
+	c1 := NewCfgSimple(path)
+	c2 := NewCfgSimple(path)
+
+	cas1, err := c1.Set("a", []byte("A"), 0)
+	if err != nil || cas1 != 1 {
+		t.Errorf("expected Set() on c1 to work")
+	}
+	v, cas, err := c2.Get("a", 0)
+	if err != nil || string(v) != "A" || cas != cas1 {
+		t.Errorf("expected c2 to see c1's Set(), v: %s, cas: %d, err: %v",
+			v, cas, err)
+	}
+
+	cas2, err := c2.Set("a", []byte("AA"), cas1)
+	if err != nil || cas2 != 2 {
+		t.Errorf("expected Set() on c2 with c1's cas to work")
+	}
+	cas, err = c1.Set("a", []byte("A-stale"), cas1)
+	if _, ok := err.(*CfgCASError); !ok || cas != 0 {
+		t.Errorf("expected stale Set() on c1 to fail, err: %v", err)
+	}
+	cas, err = c1.Set("b", []byte("B"), 0)
+	if err != nil || cas != 3 {
+		t.Errorf("expected c1 cas to move past c2's, cas: %d", cas)
+	}
+
+	err = c2.Del("a", cas1)
+	if _, ok := err.(*CfgCASError); !ok {
+		t.Errorf("expected stale Del() on c2 to fail, err: %v", err)
+	}
+	err = c1.Del("a", cas2)
+	if err != nil {
+		t.Errorf("expected Del() on c1 with c2's cas to work")
+	}
+	v, cas, err = c2.Get("a", 0)
+	if err != nil || v != nil || cas != 0 {
+		t.Errorf("expected c2 to see c1's Del()")
+	}
+}
+
+func TestCfgSimpleConcurrentIncr(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	path := emptyDir + string(os.PathSeparator) + "test.cfg"
+
+	numWorkers := 4
+	numIncrs := 25
+
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := NewCfgSimple(path)
+			for j := 0; j < numIncrs; {
+				v, cas, err := c.Get("counter", 0)
+				if err != nil {
+					t.Errorf("expected Get() to work, err: %v", err)
+					return
+				}
+				n, _ := strconv.Atoi(string(v))
+				_, err = c.Set("counter", []byte(strconv.Itoa(n+1)), cas)
+				if err == nil {
+					j++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	v, _, err := NewCfgSimple(path).Get("counter", 0)
+	if err != nil || string(v) != strconv.Itoa(numWorkers*numIncrs) {
+		t.Errorf("expected no lost updates, got: %s, err: %v", v, err)
+	}
+}
+
+func TestCfgSimpleWatch(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	prevInterval := CfgSimpleWatchInterval
+	CfgSimpleWatchInterval = 10 * time.Millisecond
+	defer func() { CfgSimpleWatchInterval = prevInterval }()
+
+	path := emptyDir + string(os.PathSeparator) + "test.cfg"
+
+	ec := make(chan CfgEvent, 10)
+
+	c1 := NewCfgSimple(path)
+	defer c1.Close()
+	c1.Subscribe("a", ec)
+
+	c2 := NewCfgSimple(path)
+	cas1, err := c2.Set("a", []byte("A"), 0)
+	if err != nil {
+		t.Errorf("expected Set() on c2 to work")
+	}
+
+	select {
+	case e := <-ec:
+		if e.Key != "a" || e.CAS != cas1 {
+			t.Errorf("expected event for c2's Set(), got: %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected event for c2's Set()")
+	}
+
+	// An outside tool that rewrites the file is also noticed.
+	time.Sleep(20 * time.Millisecond)
+	err = ioutil.WriteFile(path,
+		[]byte(`{"CASNext":10,"Entries":{"a":{"CAS":9,"Val":"QUFB"}}}`), 0600)
+	if err != nil {
+		t.Fatalf("expected WriteFile to work, err: %v", err)
+	}
+
+	select {
+	case e := <-ec:
+		if e.Key != "a" || e.CAS != 9 {
+			t.Errorf("expected event for outside write, got: %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected event for outside write")
+	}
+
+	v, cas, err := c1.Get("a", 0)
+	if err != nil || string(v) != "AAA" || cas != 9 {
+		t.Errorf("expected Get() to see outside write, v: %s", v)
+	}
+
+	select {
+	case e := <-ec:
+		t.Errorf("expected no more events, got: %+v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
 // ------------------------------------------------
 
 func TestCfgMemRev(t *testing.T) {
@@ -77,6 +77,133 @@ func main() {
 
 	// ------------------------------------------------
 
+	if steps != nil && steps["cfgExport"] {
+		log.Printf("main: step cfgExport")
+
+		err = mainCfgExport(cfg, flags.CfgArchive)
+		if err != nil {
+			log.Fatalf("main: cfgExport, err: %v", err)
+		}
+	}
+
+	if steps != nil && steps["cfgImport"] {
+		log.Printf("main: step cfgImport")
+
+		err = mainCfgImport(cfg, flags.CfgArchive, cmd.CfgImportOptions{
+			DropNodes: flags.CfgImportDropNodes,
+			DryRun:    flags.DryRun,
+		})
+		if err != nil {
+			log.Fatalf("main: cfgImport, err: %v", err)
+		}
+	}
+
+	if steps != nil && steps["cfgMigrate"] {
+		log.Printf("main: step cfgMigrate")
+
+		res, err := cbgt.CfgMigrate(cfg, flags.DryRun)
+		if err != nil {
+			log.Fatalf("main: cfgMigrate, err: %v", err)
+		}
+
+		buf, _ := json.Marshal(res)
+		log.Printf("main: cfgMigrate, dryRun: %t, result: %s",
+			flags.DryRun, buf)
+	}
+
+	if steps != nil && steps["cfgCheck"] {
+		log.Printf("main: step cfgCheck")
+
+		issues, err := cbgt.CheckCfgInvariants(cfg)
+		if err != nil {
+			log.Fatalf("main: cfgCheck, err: %v", err)
+		}
+
+		numErrors := 0
+		for _, issue := range issues {
+			log.Printf("main: cfgCheck, issue: %s", issue)
+			if issue.Severity == cbgt.CFG_CHECK_SEVERITY_ERROR {
+				numErrors++
+			}
+		}
+
+		log.Printf("main: cfgCheck, issues: %d, errors: %d",
+			len(issues), numErrors)
+
+		if numErrors > 0 && !steps["cfgRepair"] {
+			log.Fatalf("main: cfgCheck, found errors: %d", numErrors)
+		}
+	}
+
+	if steps != nil && steps["cfgRepair"] {
+		log.Printf("main: step cfgRepair")
+
+		res, err := cbgt.RepairCfgInvariants(cfg, cbgt.CfgCheckRepairOptions{
+			DryRun:  flags.DryRun,
+			Version: cbgt.VERSION,
+			Server:  flags.Server,
+			Options: options,
+		})
+		if err != nil {
+			log.Fatalf("main: cfgRepair, err: %v", err)
+		}
+
+		buf, _ := json.Marshal(res)
+		log.Printf("main: cfgRepair, dryRun: %t, result: %s",
+			flags.DryRun, buf)
+	}
+
+	// ------------------------------------------------
+
+	if steps != nil && steps["secretKeyCreate"] {
+		log.Printf("main: step secretKeyCreate")
+
+		_, err = cbgt.CreateSecretKeyfile(options["secretKeyFile"])
+		if err != nil {
+			log.Fatalf("main: secretKeyCreate, err: %v", err)
+		}
+	}
+
+	if steps != nil && steps["secretKeyRotate"] {
+		log.Printf("main: step secretKeyRotate")
+
+		kf, err := cbgt.SecretKeyfileForOptions(options)
+		if err == nil {
+			_, err = kf.Rotate()
+		}
+		if err != nil {
+			log.Fatalf("main: secretKeyRotate, err: %v", err)
+		}
+	}
+
+	if steps != nil && steps["secretReencrypt"] {
+		log.Printf("main: step secretReencrypt")
+
+		res, err := cbgt.ReencryptCfgSecrets(cfg, options, flags.DryRun)
+		if err != nil {
+			log.Fatalf("main: secretReencrypt, err: %v", err)
+		}
+
+		buf, _ := json.Marshal(res)
+		log.Printf("main: secretReencrypt, dryRun: %t, result: %s",
+			flags.DryRun, buf)
+	}
+
+	if steps != nil && steps["secretKeyRemove"] {
+		log.Printf("main: step secretKeyRemove")
+
+		removed, err := cbgt.RemoveUnusedSecretKeys(cfg, options,
+			flags.DryRun)
+		if err != nil {
+			log.Fatalf("main: secretKeyRemove, err: %v", err)
+		}
+
+		log.Printf("main: secretKeyRemove, dryRun: %t, removed: %v",
+			flags.DryRun, removed)
+	}
+
+	// ------------------------------------------------
+
 	if steps != nil && steps["rebalance_"] {
 		log.Printf("main: step rebalance_")
 
@@ -170,3 +297,49 @@ func newRestRouter(ctl *ctl.Ctl) *mux.Router {
 
 	return r
 }
+
+// ------------------------------------------------
+
+func mainCfgExport(cfg cbgt.Cfg, archive string) error {
+	if archive == "" || archive == "-" {
+		return cmd.CfgExportTo(cfg, os.Stdout)
+	}
+
+	f, err := os.Create(archive)
+	if err != nil {
+		return err
+	}
+
+	err = cmd.CfgExportTo(cfg, f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func mainCfgImport(cfg cbgt.Cfg, archive string,
+	options cmd.CfgImportOptions) error {
+	r := os.Stdin
+	if archive != "" && archive != "-" {
+		f, err := os.Open(archive)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		r = f
+	}
+
+	res, err := cmd.CfgImportFrom(cfg, r, options)
+	if err != nil {
+		return err
+	}
+
+	buf, _ := json.Marshal(res)
+	log.Printf("main: cfgImport, dryRun: %t, result: %s",
+		options.DryRun, buf)
+
+	return nil
+}
@@ -0,0 +1,409 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"time"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbase/cbgt"
+)
+
+// A CfgArchive is a portable JSON snapshot of the well-known Cfg
+// keys, as produced by CfgExport() and consumed by CfgImport().
+type CfgArchive struct {
+	// The cbgt.VERSION of the exporting tool.
+	ImplVersion string    `json:"implVersion"`
+	Exported    time.Time `json:"exported"`
+
+	// The value of the cbgt.VERSION_KEY in the Cfg.
+	Version string `json:"version"`
+
+	IndexDefs      *cbgt.IndexDefs    `json:"indexDefs"`
+	NodeDefsKnown  *cbgt.NodeDefs     `json:"nodeDefsKnown"`
+	NodeDefsWanted *cbgt.NodeDefs     `json:"nodeDefsWanted"`
+	PlanPIndexes   *cbgt.PlanPIndexes `json:"planPIndexes"`
+}
+
+// CfgImportOptions control how CfgImport() applies a CfgArchive.
+type CfgImportOptions struct {
+	// DropNodes means the node-specific data is not imported, which
+	// is the node definitions, the plans, and the per-node plan
+	// params of the index definitions.  The index definitions are
+	// then merged into the Cfg's existing index definitions, so
+	// they'll be re-planned for the Cfg's nodes.
+	DropNodes bool
+
+	// DryRun means only the CfgImportResult is computed.
+	DryRun bool
+}
+
+// A CfgImportResult lists the names of the index definitions that
+// were (or, for a dry run, would be) affected by CfgImport().
+type CfgImportResult struct {
+	Added     []string `json:"added"`
+	Updated   []string `json:"updated"`
+	Unchanged []string `json:"unchanged"`
+	Removed   []string `json:"removed"`
+}
+
+// CfgExport retrieves the well-known Cfg keys into a CfgArchive.
+// For Cfg providers that store a plan in separate parts, such as
+// metakv's lean plans, the whole plan is retrieved.
+func CfgExport(cfg cbgt.Cfg) (*CfgArchive, error) {
+	v, _, err := cfg.Get(cbgt.VERSION_KEY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("cfg_archive: could not get version, err: %v", err)
+	}
+
+	a := &CfgArchive{
+		ImplVersion: cbgt.VERSION,
+		Exported:    time.Now(),
+		Version:     string(v),
+	}
+
+	a.IndexDefs, _, err = cbgt.CfgGetIndexDefs(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("cfg_archive: could not get indexDefs,"+
+			" err: %v", err)
+	}
+
+	a.NodeDefsKnown, _, err = cbgt.CfgGetNodeDefs(cfg, cbgt.NODE_DEFS_KNOWN)
+	if err != nil {
+		return nil, fmt.Errorf("cfg_archive: could not get nodeDefs-known,"+
+			" err: %v", err)
+	}
+
+	a.NodeDefsWanted, _, err = cbgt.CfgGetNodeDefs(cfg, cbgt.NODE_DEFS_WANTED)
+	if err != nil {
+		return nil, fmt.Errorf("cfg_archive: could not get nodeDefs-wanted,"+
+			" err: %v", err)
+	}
+
+	a.PlanPIndexes, _, err = cbgt.CfgGetPlanPIndexes(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("cfg_archive: could not get planPIndexes,"+
+			" err: %v", err)
+	}
+
+	return a, nil
+}
+
+// CfgExportTo writes a CfgArchive of the Cfg as JSON.
+func CfgExportTo(cfg cbgt.Cfg, w io.Writer) error {
+	a, err := CfgExport(cfg)
+	if err != nil {
+		return err
+	}
+
+	buf, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(buf)
+
+	return err
+}
+
+// CfgImportFrom reads a JSON CfgArchive and imports it into the Cfg.
+func CfgImportFrom(cfg cbgt.Cfg, r io.Reader,
+	options CfgImportOptions) (*CfgImportResult, error) {
+	a := &CfgArchive{}
+
+	err := json.NewDecoder(r).Decode(a)
+	if err != nil {
+		return nil, fmt.Errorf("cfg_archive: could not parse archive,"+
+			" err: %v", err)
+	}
+
+	return CfgImport(cfg, a, options)
+}
+
+// ------------------------------------------------
+
+// CfgValidateArchive returns an error if a CfgArchive was produced
+// by a newer cbgt, or is otherwise not importable.
+func CfgValidateArchive(a *CfgArchive) error {
+	if a.ImplVersion == "" {
+		return fmt.Errorf("cfg_archive: missing implVersion")
+	}
+
+	versions := map[string]string{
+		"implVersion": a.ImplVersion,
+		"version":     a.Version,
+	}
+	if a.IndexDefs != nil {
+		versions["indexDefs.implVersion"] = a.IndexDefs.ImplVersion
+	}
+	if a.NodeDefsKnown != nil {
+		versions["nodeDefsKnown.implVersion"] = a.NodeDefsKnown.ImplVersion
+	}
+	if a.NodeDefsWanted != nil {
+		versions["nodeDefsWanted.implVersion"] = a.NodeDefsWanted.ImplVersion
+	}
+	if a.PlanPIndexes != nil {
+		versions["planPIndexes.implVersion"] = a.PlanPIndexes.ImplVersion
+	}
+
+	for name, version := range versions {
+		if version != "" && !cbgt.VersionGTE(cbgt.VERSION, version) {
+			return fmt.Errorf("cfg_archive: %s: %s is newer than"+
+				" VERSION: %s", name, version, cbgt.VERSION)
+		}
+	}
+
+	if a.IndexDefs != nil {
+		for name, indexDef := range a.IndexDefs.IndexDefs {
+			if indexDef == nil || indexDef.Name != name ||
+				indexDef.Type == "" || indexDef.UUID == "" {
+				return fmt.Errorf("cfg_archive: invalid indexDef: %s", name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// CfgImport validates and then imports a CfgArchive into the Cfg.
+//
+// Without the DropNodes option, the Cfg's well-known keys are
+// replaced by those of the archive, as a restore.
+//
+// With the DropNodes option, only the index definitions are
+// imported.  They're handled like an index update with a
+// prevIndexUUID: an imported index that differs (other than by its
+// UUID) from the Cfg's existing index of the same name replaces it,
+// and every added or updated index gets a new UUID, so that no
+// pindex or plan from elsewhere can be mistaken as belonging to it,
+// and so that the planner and janitors rebuild it cleanly.  Indexes
+// that aren't in the archive are kept.
+func CfgImport(cfg cbgt.Cfg, a *CfgArchive,
+	options CfgImportOptions) (*CfgImportResult, error) {
+	err := CfgValidateArchive(a)
+	if err != nil {
+		return nil, err
+	}
+
+	// A dry run only reads the Cfg's version, as CheckVersion() might
+	// initialize or bump it.
+	var ok bool
+	if options.DryRun {
+		v, _, err := cfg.Get(cbgt.VERSION_KEY, 0)
+		if err != nil {
+			return nil, fmt.Errorf("cfg_archive: could not get version,"+
+				" err: %v", err)
+		}
+		ok = v == nil || cbgt.VersionGTE(cbgt.VERSION, string(v))
+	} else {
+		ok, err = cbgt.CheckVersion(cfg, cbgt.VERSION)
+		if err != nil {
+			return nil, fmt.Errorf("cfg_archive: CheckVersion, err: %v", err)
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("cfg_archive: the cfg has a version"+
+			" newer than VERSION: %s", cbgt.VERSION)
+	}
+
+	indexDefsCurr, indexDefsCAS, err := cbgt.CfgGetIndexDefs(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("cfg_archive: could not get indexDefs,"+
+			" err: %v", err)
+	}
+
+	indexDefs, res := cfgImportIndexDefs(indexDefsCurr, a.IndexDefs,
+		options.DropNodes)
+
+	log.Printf("cfg_archive: import, dropNodes: %t, dryRun: %t,"+
+		" added: %v, updated: %v, removed: %v", options.DropNodes,
+		options.DryRun, res.Added, res.Updated, res.Removed)
+
+	if options.DryRun {
+		return res, nil
+	}
+
+	type entry struct {
+		key string
+		val interface{}
+	}
+
+	entries := []entry{{cbgt.INDEX_DEFS_KEY, indexDefs}}
+	if !options.DropNodes {
+		entries = append(entries,
+			entry{cbgt.CfgNodeDefsKey(cbgt.NODE_DEFS_KNOWN), a.NodeDefsKnown},
+			entry{cbgt.CfgNodeDefsKey(cbgt.NODE_DEFS_WANTED), a.NodeDefsWanted},
+			entry{cbgt.PLAN_PINDEXES_KEY, a.PlanPIndexes})
+	}
+
+	var ops []cbgt.CfgTxnOp
+	for _, e := range entries {
+		cas := indexDefsCAS
+		if e.key != cbgt.INDEX_DEFS_KEY {
+			_, cas, err = cfg.Get(e.key, 0)
+			if err != nil {
+				return nil, fmt.Errorf("cfg_archive: could not get,"+
+					" key: %s, err: %v", e.key, err)
+			}
+		}
+
+		if reflect.ValueOf(e.val).IsNil() {
+			ops = append(ops, cbgt.CfgTxnOp{
+				Op: cbgt.CFG_TXN_OP_DEL, Key: e.key, CAS: cas})
+			continue
+		}
+
+		buf, err := json.Marshal(e.val)
+		if err != nil {
+			return nil, err
+		}
+
+		ops = append(ops, cbgt.CfgTxnOp{
+			Op: cbgt.CFG_TXN_OP_SET, Key: e.key, Val: buf, CAS: cas})
+	}
+
+	if cfgTxn, ok := cfg.(cbgt.CfgTxn); ok {
+		_, err = cfgTxn.Txn(ops)
+		if err != nil {
+			return nil, fmt.Errorf("cfg_archive: could not import,"+
+				" err: %v", err)
+		}
+
+		return res, nil
+	}
+
+	for _, op := range ops {
+		if op.Op == cbgt.CFG_TXN_OP_DEL {
+			err = cfg.Del(op.Key, op.CAS)
+		} else {
+			_, err = cfg.Set(op.Key, op.Val, op.CAS)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cfg_archive: could not import,"+
+				" key: %s, err: %v", op.Key, err)
+		}
+	}
+
+	return res, nil
+}
+
+// cfgImportIndexDefs returns the index definitions to be saved by an
+// import, and the changes compared to the current index definitions.
+func cfgImportIndexDefs(curr, imported *cbgt.IndexDefs,
+	dropNodes bool) (*cbgt.IndexDefs, *CfgImportResult) {
+	res := &CfgImportResult{}
+
+	var currDefs, importedDefs map[string]*cbgt.IndexDef
+	if curr != nil {
+		currDefs = curr.IndexDefs
+	}
+	if imported != nil {
+		importedDefs = imported.IndexDefs
+	}
+
+	var rv *cbgt.IndexDefs
+
+	if !dropNodes {
+		// A restore, where the imported index definitions are used
+		// as is, so that they match the imported plans.
+		if imported != nil {
+			rv = &cbgt.IndexDefs{
+				UUID:        cbgt.NewUUID(),
+				IndexDefs:   imported.IndexDefs,
+				ImplVersion: imported.ImplVersion,
+			}
+		}
+
+		for name := range currDefs {
+			if importedDefs[name] == nil {
+				res.Removed = append(res.Removed, name)
+			}
+		}
+	} else {
+		rv = cbgt.NewIndexDefs(cbgt.VERSION)
+		if curr != nil {
+			rv.ImplVersion = curr.ImplVersion
+		}
+		for name, indexDef := range currDefs {
+			rv.IndexDefs[name] = indexDef
+		}
+	}
+
+	for name, indexDef := range importedDefs {
+		if dropNodes {
+			indexDef = cfgImportDropNodes(indexDef)
+		}
+
+		currDef := currDefs[name]
+		if currDef == nil {
+			res.Added = append(res.Added, name)
+		} else if cfgImportSameIndexDef(currDef, indexDef, dropNodes) {
+			res.Unchanged = append(res.Unchanged, name)
+			continue
+		} else {
+			res.Updated = append(res.Updated, name)
+		}
+
+		if dropNodes {
+			indexDef.UUID = cbgt.NewUUID()
+			rv.IndexDefs[name] = indexDef
+		}
+	}
+
+	sort.Strings(res.Added)
+	sort.Strings(res.Updated)
+	sort.Strings(res.Unchanged)
+	sort.Strings(res.Removed)
+
+	return rv, res
+}
+
+// cfgImportSameIndexDef returns true when an imported indexDef is
+// the same as the current indexDef, where the UUID's are ignored if
+// the imported indexDef would get a new UUID anyway.
+func cfgImportSameIndexDef(currDef, indexDef *cbgt.IndexDef,
+	dropNodes bool) bool {
+	if dropNodes {
+		c := *currDef
+		c.UUID = indexDef.UUID
+		currDef = &c
+	}
+
+	return reflect.DeepEqual(currDef, indexDef)
+}
+
+// cfgImportDropNodes returns a copy of an indexDef without the plan
+// params that refer to specific nodes or plans.
+func cfgImportDropNodes(indexDef *cbgt.IndexDef) *cbgt.IndexDef {
+	rv := *indexDef
+
+	if rv.PlanParams.NodePlanParams != nil {
+		// Only the params for any node ("") are kept.
+		nodePlanParams := rv.PlanParams.NodePlanParams[""]
+		rv.PlanParams.NodePlanParams = nil
+		if nodePlanParams != nil {
+			rv.PlanParams.NodePlanParams =
+				map[string]map[string]*cbgt.NodePlanParam{"": nodePlanParams}
+		}
+	}
+
+	// A frozen plan would stay empty, as the plans are dropped.
+	rv.PlanParams.PlanFrozen = false
+
+	return &rv
+}
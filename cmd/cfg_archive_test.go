@@ -0,0 +1,208 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/couchbase/cbgt"
+)
+
+func testCfgArchiveSource(t *testing.T) cbgt.Cfg {
+	cfg := cbgt.NewCfgMem()
+	cbgt.CheckVersion(cfg, cbgt.VERSION)
+
+	indexDefs := cbgt.NewIndexDefs(cbgt.VERSION)
+	indexDefs.IndexDefs["a"] = &cbgt.IndexDef{
+		Type:       "blackhole",
+		Name:       "a",
+		UUID:       "a0",
+		SourceType: "primary",
+		SourceName: "default",
+		PlanParams: cbgt.PlanParams{
+			PlanFrozen: true,
+			NodePlanParams: map[string]map[string]*cbgt.NodePlanParam{
+				"":   {"": &cbgt.NodePlanParam{CanRead: true}},
+				"n0": {"": &cbgt.NodePlanParam{CanRead: false}},
+			},
+		},
+	}
+	_, err := cbgt.CfgSetIndexDefs(cfg, indexDefs, 0)
+	if err != nil {
+		t.Fatalf("expected CfgSetIndexDefs to work, err: %v", err)
+	}
+
+	nodeDefs := cbgt.NewNodeDefs(cbgt.VERSION)
+	nodeDefs.NodeDefs["n0"] = &cbgt.NodeDef{UUID: "n0", HostPort: "n0:8094"}
+	for _, kind := range []string{cbgt.NODE_DEFS_KNOWN, cbgt.NODE_DEFS_WANTED} {
+		_, err = cbgt.CfgSetNodeDefs(cfg, kind, nodeDefs, 0)
+		if err != nil {
+			t.Fatalf("expected CfgSetNodeDefs to work, err: %v", err)
+		}
+	}
+
+	planPIndexes := cbgt.NewPlanPIndexes(cbgt.VERSION)
+	planPIndexes.PlanPIndexes["a_0"] = &cbgt.PlanPIndex{
+		Name: "a_0", IndexName: "a", IndexUUID: "a0",
+		Nodes: map[string]*cbgt.PlanPIndexNode{"n0": {CanRead: true}},
+	}
+	_, err = cbgt.CfgSetPlanPIndexes(cfg, planPIndexes, 0)
+	if err != nil {
+		t.Fatalf("expected CfgSetPlanPIndexes to work, err: %v", err)
+	}
+
+	return cfg
+}
+
+func TestCfgArchiveRestore(t *testing.T) {
+	src := testCfgArchiveSource(t)
+
+	var buf bytes.Buffer
+	err := CfgExportTo(src, &buf)
+	if err != nil {
+		t.Fatalf("expected CfgExportTo to work, err: %v", err)
+	}
+
+	dst := cbgt.NewCfgMem()
+
+	// An existing index that's not in the archive.
+	indexDefs := cbgt.NewIndexDefs(cbgt.VERSION)
+	indexDefs.IndexDefs["z"] = &cbgt.IndexDef{Name: "z", UUID: "z0"}
+	cbgt.CfgSetIndexDefs(dst, indexDefs, 0)
+
+	res, err := CfgImportFrom(dst, bytes.NewReader(buf.Bytes()),
+		CfgImportOptions{})
+	if err != nil {
+		t.Fatalf("expected CfgImportFrom to work, err: %v", err)
+	}
+	if !reflect.DeepEqual(res.Added, []string{"a"}) ||
+		!reflect.DeepEqual(res.Removed, []string{"z"}) {
+		t.Errorf("unexpected result: %#v", res)
+	}
+
+	a, _ := CfgExport(src)
+	b, _ := CfgExport(dst)
+	if !reflect.DeepEqual(a.IndexDefs.IndexDefs, b.IndexDefs.IndexDefs) ||
+		!reflect.DeepEqual(a.NodeDefsKnown, b.NodeDefsKnown) ||
+		!reflect.DeepEqual(a.NodeDefsWanted, b.NodeDefsWanted) ||
+		!reflect.DeepEqual(a.PlanPIndexes, b.PlanPIndexes) ||
+		b.Version != cbgt.VERSION {
+		t.Errorf("expected a restore, a: %#v, b: %#v", a, b)
+	}
+}
+
+func TestCfgArchiveValidate(t *testing.T) {
+	a, err := CfgExport(testCfgArchiveSource(t))
+	if err != nil {
+		t.Fatalf("expected CfgExport to work, err: %v", err)
+	}
+	if CfgValidateArchive(a) != nil {
+		t.Errorf("expected a valid archive")
+	}
+
+	a.IndexDefs.ImplVersion = "99.0.0"
+	_, err = CfgImport(cbgt.NewCfgMem(), a, CfgImportOptions{})
+	if err == nil {
+		t.Errorf("expected an archive from a newer version to fail")
+	}
+	a.IndexDefs.ImplVersion = cbgt.VERSION
+
+	a.IndexDefs.IndexDefs["b"] = a.IndexDefs.IndexDefs["a"]
+	if CfgValidateArchive(a) == nil {
+		t.Errorf("expected a mismatched index name to fail")
+	}
+	delete(a.IndexDefs.IndexDefs, "b")
+
+	dst := cbgt.NewCfgMem()
+	dst.Set(cbgt.VERSION_KEY, []byte("99.0.0"), 0)
+	_, err = CfgImport(dst, a, CfgImportOptions{})
+	if err == nil {
+		t.Errorf("expected a cfg with a newer version to fail")
+	}
+
+	_, err = CfgImportFrom(cbgt.NewCfgMem(),
+		bytes.NewReader([]byte("not json")), CfgImportOptions{})
+	if err == nil {
+		t.Errorf("expected an unparsable archive to fail")
+	}
+}
+
+func TestCfgArchiveDropNodes(t *testing.T) {
+	a, _ := CfgExport(testCfgArchiveSource(t))
+
+	dst := cbgt.NewCfgMem()
+
+	indexDefs := cbgt.NewIndexDefs(cbgt.VERSION)
+	indexDefs.IndexDefs["z"] = &cbgt.IndexDef{Name: "z", UUID: "z0"}
+	cbgt.CfgSetIndexDefs(dst, indexDefs, 0)
+
+	res, err := CfgImport(dst, a, CfgImportOptions{DropNodes: true, DryRun: true})
+	if err != nil || !reflect.DeepEqual(res.Added, []string{"a"}) {
+		t.Errorf("expected a dry run to work, res: %#v, err: %v", res, err)
+	}
+	v, _, _ := dst.Get(cbgt.VERSION_KEY, 0)
+	indexDefs, _, _ = cbgt.CfgGetIndexDefs(dst)
+	if v != nil || indexDefs.IndexDefs["a"] != nil {
+		t.Errorf("expected a dry run to not change the cfg")
+	}
+
+	res, err = CfgImport(dst, a, CfgImportOptions{DropNodes: true})
+	if err != nil || !reflect.DeepEqual(res.Added, []string{"a"}) ||
+		len(res.Removed) != 0 {
+		t.Fatalf("expected import to work, res: %#v, err: %v", res, err)
+	}
+
+	indexDefs, _, _ = cbgt.CfgGetIndexDefs(dst)
+	if indexDefs.IndexDefs["z"] == nil {
+		t.Errorf("expected existing indexes to be kept")
+	}
+	imported := indexDefs.IndexDefs["a"]
+	if imported == nil || imported.UUID == "a0" ||
+		imported.PlanParams.PlanFrozen ||
+		len(imported.PlanParams.NodePlanParams) != 1 ||
+		imported.PlanParams.NodePlanParams[""] == nil {
+		t.Errorf("expected node-specific data to be dropped, got: %#v", imported)
+	}
+	if a.IndexDefs.IndexDefs["a"].UUID != "a0" ||
+		len(a.IndexDefs.IndexDefs["a"].PlanParams.NodePlanParams) != 2 {
+		t.Errorf("expected the archive to be unchanged")
+	}
+
+	for _, key := range []string{cbgt.PLAN_PINDEXES_KEY,
+		cbgt.CfgNodeDefsKey(cbgt.NODE_DEFS_KNOWN)} {
+		v, _, _ := dst.Get(key, 0)
+		if v != nil {
+			t.Errorf("expected no import of key: %s", key)
+		}
+	}
+
+	// Importing again is a no-op, even though the UUID's differ.
+	res, err = CfgImport(dst, a, CfgImportOptions{DropNodes: true})
+	if err != nil || !reflect.DeepEqual(res.Unchanged, []string{"a"}) {
+		t.Errorf("expected a re-import to be unchanged, res: %#v, err: %v",
+			res, err)
+	}
+
+	a.IndexDefs.IndexDefs["a"].SourceName = "other"
+	res, err = CfgImport(dst, a, CfgImportOptions{DropNodes: true})
+	if err != nil || !reflect.DeepEqual(res.Updated, []string{"a"}) {
+		t.Errorf("expected a changed import to update, res: %#v, err: %v",
+			res, err)
+	}
+	indexDefs2, _, _ := cbgt.CfgGetIndexDefs(dst)
+	if indexDefs2.IndexDefs["a"].UUID == imported.UUID ||
+		indexDefs2.IndexDefs["a"].SourceName != "other" {
+		t.Errorf("expected an update with a new UUID")
+	}
+}
@@ -12,9 +12,12 @@
 package cmd
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"testing"
+
+	"github.com/couchbase/cbgt"
 )
 
 func TestMainCfg(t *testing.T) {
@@ -57,6 +60,36 @@ func TestMainCfg(t *testing.T) {
 		t.Errorf("expected err on bad server")
 	}
 
+	cfg, err = MainCfg("cbgt", "raft:",
+		bindHttp, register, emptyDir)
+	if err == nil || cfg != nil {
+		t.Errorf("expected err on raft without addrs")
+	}
+
+	cfg, err = MainCfgEx("cbgt", "simple", bindHttp, register, emptyDir,
+		"uuid0", map[string]string{"cfgHistoryMax": "5"})
+	if err != nil || cbgt.GetCfgHistory(cfg) == nil {
+		t.Errorf("expected MainCfgEx() to wrap with cfg history")
+	}
+
+	cfg, err = MainCfgEx("cbgt", "simple", bindHttp, register, emptyDir,
+		"uuid0", map[string]string{"cfgHistoryMax": "nope"})
+	if err == nil || cfg != nil {
+		t.Errorf("expected err on bad cfgHistoryMax")
+	}
+
+	cfg, err = MainCfgEx("cbgt", "simple", bindHttp, register, emptyDir,
+		"uuid0", map[string]string{"cfgSharded": "planPIndexes"})
+	if err != nil || cbgt.GetCfgSharded(cfg) == nil {
+		t.Errorf("expected MainCfgEx() to wrap with cfg sharded")
+	}
+
+	cfg, err = MainCfgEx("cbgt", "simple", bindHttp, register, emptyDir,
+		"uuid0", map[string]string{"cfgSharded": "nope"})
+	if err == nil || cfg != nil {
+		t.Errorf("expected err on bad cfgSharded")
+	}
+
 	if false { // metakv skipped due to log spam.
 		cfg, err = MainCfg("cbgt", "metakv",
 			bindHttp, register, emptyDir)
@@ -65,3 +98,55 @@ func TestMainCfg(t *testing.T) {
 		}
 	}
 }
+
+func TestRegisterCfgProvider(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	var gotParams string
+
+	RegisterCfgProvider("test:", func(baseName, params, bindHttp,
+		register, dataDir, uuid string, options map[string]string) (
+		cbgt.Cfg, error) {
+		if options["testBad"] != "" {
+			return nil, fmt.Errorf("bad testBad option")
+		}
+		gotParams = params
+		return cbgt.NewCfgMem(), nil
+	})
+	defer delete(CfgProviders, "test:")
+
+	RegisterCfgProvider("test:longer:", func(baseName, params, bindHttp,
+		register, dataDir, uuid string, options map[string]string) (
+		cbgt.Cfg, error) {
+		gotParams = "longer " + params
+		return cbgt.NewCfgMem(), nil
+	})
+	defer delete(CfgProviders, "test:longer:")
+
+	cfg, err := MainCfgEx("cbgt", "test:foo", "10.1.1.20:8095", "wanted",
+		emptyDir, "uuid0", nil)
+	if err != nil || cfg == nil || gotParams != "foo" {
+		t.Errorf("expected registered provider, params: %q, err: %v",
+			gotParams, err)
+	}
+
+	cfg, err = MainCfgEx("cbgt", "test:longer:bar", "10.1.1.20:8095",
+		"wanted", emptyDir, "uuid0", nil)
+	if err != nil || cfg == nil || gotParams != "longer bar" {
+		t.Errorf("expected longest prefix, params: %q, err: %v",
+			gotParams, err)
+	}
+
+	cfg, err = MainCfgEx("cbgt", "test:foo", "10.1.1.20:8095", "wanted",
+		emptyDir, "uuid0", map[string]string{"testBad": "x"})
+	if err == nil || cfg != nil {
+		t.Errorf("expected provider option err")
+	}
+
+	cfg, err = MainCfgEx("cbgt", "simplex", "10.1.1.20:8095", "wanted",
+		emptyDir, "uuid0", nil)
+	if err == nil || cfg != nil {
+		t.Errorf("expected err on simple with params")
+	}
+}
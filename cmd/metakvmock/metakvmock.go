@@ -0,0 +1,545 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+// Package metakvmock provides an in-memory implementation of the
+// ns-server metakv REST protocol, as used by the cbauth/metakv
+// client, for dev/testing purposes.  It supports revisions,
+// create-only sets, recursive listings and deletes, continuous change
+// feeds for metakv.RunObserveChildren(), and the ns-server /pools
+// endpoints that report the cluster compatibility version.
+//
+// A Store is an http.Handler, so it can be started from Go tests
+// with httptest.NewServer(metakvmock.NewStore()), or with NewServer()
+// when a specific listen address is needed.
+package metakvmock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The optional path prefix of the metakv REST endpoints, which is
+// stripped from the request paths.
+const METAKV_PATH_PREFIX = "/_metakv"
+
+// ErrRevMismatch is returned when a rev does not match the current
+// rev of an entry, or when a create-only set finds an existing
+// entry.  It's a http.StatusConflict over REST.
+var ErrRevMismatch = errors.New("metakvmock: rev mismatch")
+
+// KvEntry is an entry of a Store, and is also the metakv wire format.
+// A nil Value in a change feed means the entry was deleted.
+type KvEntry struct {
+	Path      string
+	Value     []byte
+	Rev       []byte
+	Sensitive bool `json:",omitempty"`
+}
+
+// A Store is an in-memory metakv, which serves the metakv and
+// ns-server /pools REST endpoints.
+type Store struct {
+	m        sync.Mutex // Protects the fields that follow.
+	rev      uint64     // The last assigned rev.
+	entries  map[string]*KvEntry
+	watchers map[*watcher]bool
+
+	compatVersion uint64
+	numNodes      int
+
+	closeCh chan struct{} // Closed to end the change feeds.
+}
+
+// A watcher is a continuous change feed of a directory.
+type watcher struct {
+	dir      string
+	changes  []KvEntry     // Protected by Store.m.
+	notifyCh chan struct{} // Signaled when changes are appended.
+}
+
+// NewStore returns an empty Store, which reports a single node with
+// a cluster compatibility version of 6.0.
+func NewStore() *Store {
+	return &Store{
+		entries:       map[string]*KvEntry{},
+		watchers:      map[*watcher]bool{},
+		compatVersion: 65536 * 6,
+		numNodes:      1,
+		closeCh:       make(chan struct{}),
+	}
+}
+
+// Close ends the continuous change feeds, which otherwise would keep
+// a httptest.Server.Close() waiting.
+func (s *Store) Close() {
+	s.m.Lock()
+	select {
+	case <-s.closeCh:
+	default:
+		close(s.closeCh)
+	}
+	s.m.Unlock()
+}
+
+// NewServer starts a httptest.Server for the given Store.  The addr,
+// like "127.0.0.1:9000", is optional, where "" means a random port.
+func NewServer(s *Store, addr string) (*httptest.Server, error) {
+	if addr == "" {
+		return httptest.NewServer(s), nil
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("metakvmock: could not listen,"+
+			" addr: %s, err: %v", addr, err)
+	}
+
+	server := httptest.NewUnstartedServer(s)
+	server.Listener.Close()
+	server.Listener = l
+	server.Start()
+
+	return server, nil
+}
+
+// SetClusterVersion sets the cluster compatibility version and the
+// number of nodes reported by /pools/default, where the version is
+// like "5.5.0".
+func (s *Store) SetClusterVersion(version string, numNodes int) error {
+	xa := strings.Split(version, ".")
+	if len(xa) < 2 {
+		return fmt.Errorf("metakvmock: invalid version: %q", version)
+	}
+
+	major, err := strconv.Atoi(xa[0])
+	if err != nil {
+		return fmt.Errorf("metakvmock: invalid version: %q", version)
+	}
+
+	minor, err := strconv.Atoi(xa[1])
+	if err != nil {
+		return fmt.Errorf("metakvmock: invalid version: %q", version)
+	}
+
+	s.m.Lock()
+	s.compatVersion = uint64(65536*major + minor)
+	s.numNodes = numNodes
+	s.m.Unlock()
+
+	return nil
+}
+
+// Get returns a copy of an entry, or nil if the path does not exist.
+func (s *Store) Get(path string) *KvEntry {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	e, exists := s.entries[path]
+	if !exists {
+		return nil
+	}
+
+	rv := *e
+	return &rv
+}
+
+// Set stores the value of an entry and returns the entry's new rev.
+// A non-nil rev must match the entry's current rev.  When create is
+// true, the entry must not already exist.
+func (s *Store) Set(path string, value, rev []byte, create bool,
+	sensitive bool) ([]byte, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	e, exists := s.entries[path]
+	if create && exists {
+		return nil, ErrRevMismatch
+	}
+	if rev != nil && (!exists || string(e.Rev) != string(rev)) {
+		return nil, ErrRevMismatch
+	}
+
+	s.rev++
+
+	e = &KvEntry{
+		Path:      path,
+		Value:     append([]byte{}, value...),
+		Rev:       []byte(strconv.FormatUint(s.rev, 10)),
+		Sensitive: sensitive,
+	}
+	s.entries[path] = e
+
+	s.notifyLOCKED(*e)
+
+	return e.Rev, nil
+}
+
+// Delete removes an entry, where a non-nil rev must match the entry's
+// current rev.  Deleting a missing entry is not an error.
+func (s *Store) Delete(path string, rev []byte) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	e, exists := s.entries[path]
+	if rev != nil && (!exists || string(e.Rev) != string(rev)) {
+		return ErrRevMismatch
+	}
+
+	if exists {
+		s.deleteLOCKED(path)
+	}
+
+	return nil
+}
+
+// RecursiveDelete removes every entry under a directory path, which
+// should end with a "/", and returns the number of removed entries.
+func (s *Store) RecursiveDelete(dir string) int {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	paths := s.childPathsLOCKED(dir)
+	for _, path := range paths {
+		s.deleteLOCKED(path)
+	}
+
+	return len(paths)
+}
+
+func (s *Store) deleteLOCKED(path string) {
+	delete(s.entries, path)
+
+	s.rev++
+
+	s.notifyLOCKED(KvEntry{
+		Path: path,
+		Rev:  []byte(strconv.FormatUint(s.rev, 10)),
+	})
+}
+
+// List returns copies of every entry under a directory path,
+// recursively, sorted by path.
+func (s *Store) List(dir string) []KvEntry {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.listLOCKED(dir)
+}
+
+func (s *Store) listLOCKED(dir string) []KvEntry {
+	paths := s.childPathsLOCKED(dir)
+
+	rv := make([]KvEntry, 0, len(paths))
+	for _, path := range paths {
+		rv = append(rv, *s.entries[path])
+	}
+
+	return rv
+}
+
+func (s *Store) childPathsLOCKED(dir string) []string {
+	var rv []string
+	for path := range s.entries {
+		if strings.HasPrefix(path, dir) {
+			rv = append(rv, path)
+		}
+	}
+
+	sort.Strings(rv)
+
+	return rv
+}
+
+// notifyLOCKED appends a change to the feeds of the watchers of the
+// change's directories.
+func (s *Store) notifyLOCKED(e KvEntry) {
+	for w := range s.watchers {
+		if strings.HasPrefix(e.Path, w.dir) {
+			w.changes = append(w.changes, e)
+
+			select {
+			case w.notifyCh <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// NumWatchers returns the number of active continuous change feeds.
+func (s *Store) NumWatchers() int {
+	s.m.Lock()
+	rv := len(s.watchers)
+	s.m.Unlock()
+	return rv
+}
+
+// ----------------------------------------------------------------
+
+func (s *Store) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "RPCCONNECT" {
+		handleRPCConnect(w)
+		return
+	}
+
+	if r.URL.Path == "/pools" || r.URL.Path == "/pools/default" {
+		s.handlePools(w, r)
+		return
+	}
+
+	path := r.URL.Path
+	if strings.HasPrefix(path, METAKV_PATH_PREFIX+"/") {
+		path = path[len(METAKV_PATH_PREFIX):]
+	}
+
+	if path == "" || path[0] != '/' {
+		http.Error(w, "metakvmock: invalid path", http.StatusBadRequest)
+		return
+	}
+
+	isDir := strings.HasSuffix(path, "/")
+
+	switch r.Method {
+	case "GET":
+		if r.URL.Query().Get("feed") == "continuous" {
+			s.handleFeed(w, r, path)
+		} else if isDir {
+			s.handleList(w, path)
+		} else {
+			s.handleGet(w, path)
+		}
+
+	case "PUT", "POST":
+		if isDir {
+			http.Error(w, "metakvmock: cannot set a directory",
+				http.StatusBadRequest)
+			return
+		}
+		s.handleSet(w, r, path)
+
+	case "DELETE":
+		if isDir {
+			s.RecursiveDelete(path)
+			return
+		}
+		s.handleDelete(w, r, path)
+
+	default:
+		http.Error(w, "metakvmock: unsupported method",
+			http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Store) handleGet(w http.ResponseWriter, path string) {
+	e := s.Get(path)
+	if e == nil {
+		// The metakv client treats an entry without a rev as missing.
+		w.Write([]byte("{}"))
+		return
+	}
+
+	writeJSON(w, e)
+}
+
+func (s *Store) handleList(w http.ResponseWriter, dir string) {
+	// The metakv client decodes a listing as a stream of entries.
+	for _, e := range s.List(dir) {
+		writeJSON(w, e)
+	}
+}
+
+func (s *Store) handleSet(w http.ResponseWriter, r *http.Request,
+	path string) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("metakvmock: could not parse form,"+
+			" err: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var rev []byte
+	if _, exists := r.Form["rev"]; exists {
+		rev = []byte(r.Form.Get("rev"))
+	}
+
+	create := r.Form.Get("create") != ""
+	sensitive := r.Form.Get("sensitive") == "true"
+
+	_, err = s.Set(path, []byte(r.Form.Get("value")), rev, create, sensitive)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+	}
+}
+
+func (s *Store) handleDelete(w http.ResponseWriter, r *http.Request,
+	path string) {
+	var rev []byte
+	if _, exists := r.URL.Query()["rev"]; exists {
+		rev = []byte(r.URL.Query().Get("rev"))
+	}
+
+	err := s.Delete(path, rev)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+	}
+}
+
+// handleFeed streams the current entries under a directory, followed
+// by every later change, until the client goes away.
+func (s *Store) handleFeed(w http.ResponseWriter, r *http.Request,
+	dir string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "metakvmock: streaming unsupported",
+			http.StatusInternalServerError)
+		return
+	}
+
+	wt := &watcher{
+		dir:      dir,
+		notifyCh: make(chan struct{}, 1),
+	}
+
+	s.m.Lock()
+	wt.changes = s.listLOCKED(dir)
+	s.watchers[wt] = true
+	s.m.Unlock()
+
+	defer func() {
+		s.m.Lock()
+		delete(s.watchers, wt)
+		s.m.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		s.m.Lock()
+		changes := wt.changes
+		wt.changes = nil
+		s.m.Unlock()
+
+		for _, e := range changes {
+			err := writeJSON(w, e)
+			if err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+
+		select {
+		case <-wt.notifyCh:
+		case <-r.Context().Done():
+			return
+		case <-s.closeCh:
+			return
+		}
+	}
+}
+
+// PoolsDefaultNode is the part of a /pools/default node that's
+// read by cbgt.CfgMetaKv.ClusterVersion().
+type PoolsDefaultNode struct {
+	ClusterCompatibility uint64 `json:"clusterCompatibility"`
+	Version              string `json:"version"`
+}
+
+func (s *Store) handlePools(w http.ResponseWriter, r *http.Request) {
+	s.m.Lock()
+	compatVersion := s.compatVersion
+	numNodes := s.numNodes
+	s.m.Unlock()
+
+	version := fmt.Sprintf("%d.%d.0", compatVersion/65536, compatVersion%65536)
+
+	if r.URL.Path == "/pools" {
+		writeJSON(w, map[string]interface{}{
+			"isAdminCreds":          true,
+			"implementationVersion": version,
+			"pools": []map[string]string{
+				{"name": "default", "uri": "/pools/default"},
+			},
+		})
+		return
+	}
+
+	nodes := make([]PoolsDefaultNode, numNodes)
+	for i := range nodes {
+		nodes[i] = PoolsDefaultNode{
+			ClusterCompatibility: compatVersion,
+			Version:              version,
+		}
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"name":  "default",
+		"nodes": nodes,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+// ----------------------------------------------------------------
+
+// rpcBody is a canned cbauth revrpc AuthCacheSvc.UpdateDB request.
+var rpcBody string = "{\"jsonrpc\":\"2.0\",\"id\":0,\"method\":\"AuthCacheSvc.UpdateDB\",\"params\":[{\"specialUser\":\"@fts-cbauth\",\"nodes\":[{\"host\":\"127.0.0.1\",\"user\":\"_admin\",\"password\":\"c55756e3cf12269e4b49eb8cba10389d\",\"ports\":[9000,9200,9100,9101,9102,9103,9104,9105,9500,10000,12000,12001,9499],\"local\":true}],\"buckets\":[{\"name\":\"gamesim-sample\",\"password\":\"\"}],\"tokenCheckURL\":\"http://127.0.0.1:9000/_cbauth\",\"admin\":{\"user\":\"Administrator\",\"salt\":\"h+bTDx1y7VfNymzHos93kQ==\",\"mac\":\"XFaBj6SzQyzkNYMnRzt117OAhB0=\"}}]}"
+
+// handleRPCConnect accepts a cbauth revrpc connection.
+func handleRPCConnect(w http.ResponseWriter) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "webserver doesn't support hijacking",
+			http.StatusInternalServerError)
+		return
+	}
+	conn, bufrw, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Send a dummy response for the rpc connect.  The connection is
+	// not closed, otherwise an EOF error is seen by the cbauth client.
+	var header string = "HTTP/1.1 200 OK\r\n" +
+		"Server: Couchbase Server\r\n" +
+		"Content-Length: %d\r\n" +
+		"Content-Type: application/json; charset=utf-8\r\n\r\n"
+	bufrw.WriteString(fmt.Sprintf(header, len(rpcBody)))
+	bufrw.WriteString(rpcBody)
+	bufrw.WriteString("\r\n")
+	bufrw.Flush()
+	go func() {
+		defer conn.Close()
+		val := make([]byte, 1000)
+		for {
+			_, err := bufrw.Read(val)
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
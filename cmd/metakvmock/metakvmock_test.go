@@ -0,0 +1,242 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package metakvmock
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func doReq(t *testing.T, method, u string, form url.Values) (int, []byte) {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+
+	req, _ := http.NewRequest(method, u, body)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("expected request to work, err: %v", err)
+	}
+	defer resp.Body.Close()
+
+	buf, _ := ioutil.ReadAll(resp.Body)
+
+	return resp.StatusCode, buf
+}
+
+func decodeEntries(t *testing.T, buf []byte) []KvEntry {
+	var rv []KvEntry
+
+	dec := json.NewDecoder(strings.NewReader(string(buf)))
+	for {
+		var e KvEntry
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			return rv
+		}
+		if err != nil {
+			t.Fatalf("expected entries, buf: %s, err: %v", buf, err)
+		}
+		rv = append(rv, e)
+	}
+}
+
+func TestStoreREST(t *testing.T) {
+	s := NewStore()
+	server, err := NewServer(s, "")
+	if err != nil {
+		t.Fatalf("expected NewServer to work, err: %v", err)
+	}
+	defer server.Close()
+	defer s.Close()
+
+	u := server.URL + METAKV_PATH_PREFIX
+
+	code, buf := doReq(t, "GET", u+"/cfg/a", nil)
+	if code != 200 || string(buf) != "{}" {
+		t.Errorf("expected a missing entry, code: %d, buf: %s", code, buf)
+	}
+
+	code, _ = doReq(t, "PUT", u+"/cfg/a",
+		url.Values{"value": []string{"A&=%"}})
+	if code != 200 {
+		t.Errorf("expected set to work, code: %d", code)
+	}
+
+	code, buf = doReq(t, "GET", u+"/cfg/a", nil)
+	es := decodeEntries(t, buf)
+	if code != 200 || len(es) != 1 || string(es[0].Value) != "A&=%" ||
+		es[0].Path != "/cfg/a" || string(es[0].Rev) != "1" {
+		t.Fatalf("expected an entry, code: %d, buf: %s", code, buf)
+	}
+
+	code, _ = doReq(t, "PUT", u+"/cfg/a",
+		url.Values{"value": []string{"AA"}, "rev": []string{"100"}})
+	if code != http.StatusConflict {
+		t.Errorf("expected a rev mismatch, code: %d", code)
+	}
+
+	code, _ = doReq(t, "PUT", u+"/cfg/a",
+		url.Values{"value": []string{"AA"}, "create": []string{"1"}})
+	if code != http.StatusConflict {
+		t.Errorf("expected a create of an existing entry to fail, code: %d",
+			code)
+	}
+
+	code, _ = doReq(t, "PUT", u+"/cfg/a",
+		url.Values{"value": []string{"AA"}, "rev": []string{"1"}})
+	if code != 200 || string(s.Get("/cfg/a").Value) != "AA" {
+		t.Errorf("expected a set with the rev to work, code: %d", code)
+	}
+
+	doReq(t, "PUT", u+"/cfg/dir/b", url.Values{"value": []string{"B"}})
+	doReq(t, "PUT", u+"/cfg/dir/sub/c", url.Values{"value": []string{"C"}})
+	doReq(t, "PUT", u+"/other/d", url.Values{"value": []string{"D"}})
+
+	_, buf = doReq(t, "GET", u+"/cfg/", nil)
+	es = decodeEntries(t, buf)
+	if len(es) != 3 || es[0].Path != "/cfg/a" || es[2].Path != "/cfg/dir/sub/c" {
+		t.Errorf("expected a recursive listing, buf: %s", buf)
+	}
+
+	code, _ = doReq(t, "DELETE", u+"/cfg/a?rev=1", nil)
+	if code != http.StatusConflict || s.Get("/cfg/a") == nil {
+		t.Errorf("expected a delete rev mismatch, code: %d", code)
+	}
+	code, _ = doReq(t, "DELETE", u+"/cfg/a?rev="+string(s.Get("/cfg/a").Rev), nil)
+	if code != 200 || s.Get("/cfg/a") != nil {
+		t.Errorf("expected a delete to work, code: %d", code)
+	}
+
+	code, _ = doReq(t, "DELETE", u+"/cfg/dir/", nil)
+	if code != 200 || len(s.List("/")) != 1 {
+		t.Errorf("expected a recursive delete, entries: %#v", s.List("/"))
+	}
+
+	// The prefix is optional.
+	_, buf = doReq(t, "GET", server.URL+"/other/d", nil)
+	if es = decodeEntries(t, buf); len(es) != 1 || string(es[0].Value) != "D" {
+		t.Errorf("expected an unprefixed get to work, buf: %s", buf)
+	}
+}
+
+func TestStoreFeed(t *testing.T) {
+	s := NewStore()
+	server, _ := NewServer(s, "")
+	defer server.Close()
+	defer s.Close()
+
+	s.Set("/cfg/a", []byte("A"), nil, false, false)
+	s.Set("/other/b", []byte("B"), nil, false, false)
+
+	resp, err := http.Get(server.URL + "/cfg/?feed=continuous")
+	if err != nil {
+		t.Fatalf("expected a feed, err: %v", err)
+	}
+	defer resp.Body.Close()
+
+	entryCh := make(chan KvEntry, 10)
+	go func() {
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var e KvEntry
+			if dec.Decode(&e) != nil {
+				close(entryCh)
+				return
+			}
+			entryCh <- e
+		}
+	}()
+
+	expect := func(path, value string) {
+		select {
+		case e := <-entryCh:
+			if e.Path != path || string(e.Value) != value {
+				t.Errorf("expected path: %s, value: %q, got: %#v",
+					path, value, e)
+			}
+			if value == "" && e.Value != nil {
+				t.Errorf("expected a deletion, got: %#v", e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected an entry, path: %s", path)
+		}
+	}
+
+	expect("/cfg/a", "A")
+
+	s.Set("/other/c", []byte("C"), nil, false, false)
+	s.Set("/cfg/d/e", []byte("E"), nil, false, false)
+	expect("/cfg/d/e", "E")
+
+	s.Delete("/cfg/a", nil)
+	expect("/cfg/a", "")
+
+	s.RecursiveDelete("/cfg/d/")
+	expect("/cfg/d/e", "")
+
+	if s.NumWatchers() != 1 {
+		t.Errorf("expected a watcher")
+	}
+
+	s.Close()
+
+	select {
+	case _, ok := <-entryCh:
+		if ok {
+			t.Errorf("expected no more entries")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected the feed to end on close")
+	}
+}
+
+func TestStorePools(t *testing.T) {
+	s := NewStore()
+	server, _ := NewServer(s, "")
+	defer server.Close()
+
+	if s.SetClusterVersion("x", 1) == nil {
+		t.Errorf("expected an invalid version err")
+	}
+	if err := s.SetClusterVersion("5.5.0", 2); err != nil {
+		t.Errorf("expected SetClusterVersion to work, err: %v", err)
+	}
+
+	_, buf := doReq(t, "GET", server.URL+"/pools/default", nil)
+
+	var rv struct {
+		Nodes []PoolsDefaultNode `json:"nodes"`
+	}
+	err := json.Unmarshal(buf, &rv)
+	if err != nil || len(rv.Nodes) != 2 ||
+		rv.Nodes[0].ClusterCompatibility != 327685 ||
+		rv.Nodes[0].Version != "5.5.0" {
+		t.Errorf("unexpected /pools/default, buf: %s, err: %v", buf, err)
+	}
+
+	code, buf := doReq(t, "GET", server.URL+"/pools", nil)
+	if code != 200 || !strings.Contains(string(buf), "/pools/default") {
+		t.Errorf("unexpected /pools, buf: %s", buf)
+	}
+}
@@ -206,9 +206,17 @@ func (ctl *Ctl) getMovingPartitionsCount(keepNodeUUIDs, existingNodes []string)
 	totalPartitions := 0
 	if indexDefs != nil {
 		for _, indexDef := range indexDefs.IndexDefs {
+			sourceParams, err := cbgt.DecryptSourceParams(
+				indexDef.SourceParams, ctl.optionsCtl.Manager.SecretOptions())
+			if err != nil {
+				log.Printf("ctl: getMovingPartitionsCount, DecryptSourceParams"+
+					" failed, err: %v", err)
+				continue
+			}
+
 			partitions, err := cbgt.CouchbasePartitions(indexDef.SourceType,
 				indexDef.SourceName, indexDef.SourceUUID,
-				indexDef.SourceParams,
+				sourceParams,
 				ctl.optionsCtl.Manager.Server(),
 				ctl.optionsCtl.Manager.GetOptions())
 			if err != nil {
@@ -0,0 +1,148 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2018 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ctl
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/couchbase/cbgt"
+)
+
+// TestCtlCfgFaultyChaos runs ctl topology changes against a Cfg with
+// injected faults, and checks that the faults are reported as
+// PrevErrs, and that a retried failover converges once the faults
+// stop.
+func TestCtlCfgFaultyChaos(t *testing.T) {
+	testDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testDir)
+
+	inner := cbgt.NewCfgMem()
+	cfg := cbgt.NewCfgFaulty(inner, cbgt.CfgFaultyOptions{})
+	cf := cbgt.GetCfgFaulty(cfg)
+
+	var mgr0 *cbgt.Manager
+
+	// Nodes without the planner and janitor roles, so that only the
+	// ctl changes the plan.
+	for i, node := range []string{"a", "b"} {
+		dataDir := filepath.Join(testDir, node)
+		os.MkdirAll(dataDir, 0700)
+
+		mgr := cbgt.NewManager(cbgt.VERSION, inner, node,
+			[]string{"pindex"}, "", 1, "", fmt.Sprintf(":100%d", i),
+			dataDir, ".", nil)
+		err := mgr.Start("wanted")
+		if err != nil {
+			t.Fatalf("expected Manager.Start() to work, err: %v", err)
+		}
+		defer mgr.Stop()
+
+		if i == 0 {
+			mgr0 = mgr
+
+			err = mgr.CreateIndex("primary", "default", "",
+				`{"numPartitions":4}`, "blackhole", "x", "",
+				cbgt.PlanParams{MaxPartitionsPerPIndex: 1}, "")
+			if err != nil {
+				t.Fatalf("expected CreateIndex to work, err: %v", err)
+			}
+		}
+	}
+
+	_, err := cbgt.Plan(inner, cbgt.VERSION, "", ".", nil, nil)
+	if err != nil {
+		t.Fatalf("expected Plan to work, err: %v", err)
+	}
+
+	cf.Partition(0)
+	_, err = StartCtl(cfg, ".", nil, CtlOptions{Manager: mgr0})
+	if err == nil {
+		t.Errorf("expected StartCtl to fail in a partition")
+	}
+	cf.Heal()
+
+	ctl, err := StartCtl(cfg, ".", nil, CtlOptions{Manager: mgr0})
+	if err != nil {
+		t.Fatalf("expected StartCtl to work, err: %v", err)
+	}
+	defer ctl.Stop()
+
+	failover := func() *CtlTopology {
+		topology, err := ctl.ChangeTopology(&CtlChangeTopology{
+			Mode:            "failover-hard",
+			MemberNodeUUIDs: []string{"a"},
+		}, nil)
+		if err != nil {
+			t.Fatalf("expected ChangeTopology to work, err: %v", err)
+		}
+		for topology.ChangeTopology != nil {
+			topology, err = ctl.WaitGetTopology(topology.Rev, nil)
+			if err != nil {
+				t.Fatalf("expected WaitGetTopology to work, err: %v", err)
+			}
+		}
+		return topology
+	}
+
+	// Every write of the node definitions fails.
+	cf.SetOptions(cbgt.CfgFaultyOptions{
+		ErrorEvery: map[string]int{
+			cbgt.CFG_FAULTY_OP_SET: 1,
+			cbgt.CFG_FAULTY_OP_TXN: 1,
+		},
+		Keys: []string{
+			cbgt.CfgNodeDefsKey(cbgt.NODE_DEFS_KNOWN),
+			cbgt.CfgNodeDefsKey(cbgt.NODE_DEFS_WANTED),
+		},
+	})
+	topology := failover()
+	if len(topology.PrevErrs) == 0 {
+		t.Errorf("expected the faults to be reported as PrevErrs")
+	}
+	if cf.Stats().TotErrors == 0 {
+		t.Errorf("expected node defs write faults, stats: %#v", cf.Stats())
+	}
+
+	cf.SetOptions(cbgt.CfgFaultyOptions{})
+	topology = failover()
+	if len(topology.PrevErrs) != 0 {
+		t.Errorf("expected no PrevErrs once healed, got: %v",
+			topology.PrevErrs)
+	}
+
+	nodeDefs, _, err := cbgt.CfgGetNodeDefs(inner, cbgt.NODE_DEFS_WANTED)
+	if err != nil || len(nodeDefs.NodeDefs) != 1 ||
+		nodeDefs.NodeDefs["a"] == nil {
+		t.Errorf("expected only node a to be wanted, got: %#v, err: %v",
+			nodeDefs, err)
+	}
+
+	planPIndexes, _, err := cbgt.CfgGetPlanPIndexes(inner)
+	if err != nil || len(planPIndexes.PlanPIndexes) != 4 {
+		t.Fatalf("expected 4 plan pindexes, got: %#v, err: %v",
+			planPIndexes, err)
+	}
+	for name, planPIndex := range planPIndexes.PlanPIndexes {
+		if planPIndex.Nodes["a"] == nil || len(planPIndex.Nodes) != 1 {
+			t.Errorf("expected plan pindex on node a, name: %s, nodes: %#v",
+				name, planPIndex.Nodes)
+		}
+	}
+}
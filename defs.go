@@ -56,6 +56,8 @@ type IndexDef struct {
 // IMPORTANT!  This must be manually kept in sync with the IndexDef
 // struct definition.  If you change IndexDef struct, you must change
 // this indexDefBase definition, too; and also see defs_json.go.
+// TestDefsBaseInSync checks the fields, and a CfgMigration should be
+// registered when the JSON of stored definitions changes shape.
 type indexDefBase struct {
 	Type       string     `json:"type"` // Ex: "blackhole", etc.
 	Name       string     `json:"name"`
@@ -204,6 +206,8 @@ type PlanPIndex struct {
 // IMPORTANT!  This must be manually kept in sync with the PlanPIndex
 // struct definition.  If you change PlanPIndex struct, you must change
 // this planPIndexBase definition, too; and also see defs_json.go.
+// TestDefsBaseInSync checks the fields, and a CfgMigration should be
+// registered when the JSON of stored definitions changes shape.
 type planPIndexBase struct {
 	Name             string `json:"name,omitempty"` // Stable & unique cluster wide.
 	UUID             string `json:"uuid"`
@@ -284,6 +288,18 @@ func CfgSetIndexDefs(cfg Cfg, indexDefs *IndexDefs, cas uint64) (uint64, error)
 	return cfg.Set(INDEX_DEFS_KEY, buf, cas)
 }
 
+// CfgTxnOpSetIndexDefs returns a CfgTxnOp that updates index
+// definitions, for use with a CfgTxn.
+func CfgTxnOpSetIndexDefs(indexDefs *IndexDefs, cas uint64) (
+	CfgTxnOp, error) {
+	buf, err := json.Marshal(indexDefs)
+	if err != nil {
+		return CfgTxnOp{}, err
+	}
+	return CfgTxnOp{Op: CFG_TXN_OP_SET, Key: INDEX_DEFS_KEY,
+		Val: buf, CAS: cas}, nil
+}
+
 // ------------------------------------------------------------------------
 
 // GetNodePlanParam returns a relevant NodePlanParam for a given node
@@ -327,11 +343,18 @@ func NewNodeDefs(version string) *NodeDefs {
 
 // CfgGetVersion returns the Cfg version
 func CfgGetVersion(cfg Cfg) string {
-	v, _, err := cfg.Get(VERSION_KEY, 0)
+	version, _ := CfgGetVersionCAS(cfg)
+	return version
+}
+
+// CfgGetVersionCAS is like CfgGetVersion, but also returns the CAS of
+// the version entry, which is 0 when there's no version entry.
+func CfgGetVersionCAS(cfg Cfg) (string, uint64) {
+	v, cas, err := cfg.Get(VERSION_KEY, 0)
 	if err != nil || v == nil {
-		return VERSION
+		return VERSION, 0
 	}
-	return string(v)
+	return string(v), cas
 }
 
 // CfgNodeDefsKey returns the Cfg access key for a NodeDef kind.
@@ -484,6 +507,18 @@ func CfgSetPlanPIndexes(cfg Cfg, planPIndexes *PlanPIndexes, cas uint64) (
 	return cfg.Set(PLAN_PINDEXES_KEY, buf, cas)
 }
 
+// CfgTxnOpSetPlanPIndexes returns a CfgTxnOp that updates the
+// PlanPIndexes, for use with a CfgTxn.
+func CfgTxnOpSetPlanPIndexes(planPIndexes *PlanPIndexes, cas uint64) (
+	CfgTxnOp, error) {
+	buf, err := json.Marshal(planPIndexes)
+	if err != nil {
+		return CfgTxnOp{}, err
+	}
+	return CfgTxnOp{Op: CFG_TXN_OP_SET, Key: PLAN_PINDEXES_KEY,
+		Val: buf, CAS: cas}, nil
+}
+
 // Returns true if both PlanPIndexes are the same, where we ignore any
 // differences in UUID or ImplVersion.
 func SamePlanPIndexes(a, b *PlanPIndexes) bool {
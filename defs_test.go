@@ -249,7 +249,7 @@ func TestPIndexMatchesPlan(t *testing.T) {
 }
 
 func TestCfgGetHelpers(t *testing.T) {
-	errCfg := &ErrorOnlyCfg{}
+	errCfg := newErrorOnlyCfg()
 
 	if _, err := CheckVersion(errCfg, "my-version"); err == nil {
 		t.Errorf("expected to fail with errCfg")
@@ -490,3 +490,38 @@ func TestMetaKvIsLeanFeatureSupportedFailure(t *testing.T) {
 		t.Errorf(" `leanPlan` feature support check should have failed")
 	}
 }
+
+func TestDefsBaseInSync(t *testing.T) {
+	tests := []struct {
+		def       interface{}
+		base      interface{}
+		enveloped map[string]bool
+	}{
+		{IndexDef{}, indexDefBase{},
+			map[string]bool{"Params": true, "SourceParams": true}},
+		{PlanPIndex{}, planPIndexBase{},
+			map[string]bool{"IndexParams": true, "SourceParams": true}},
+	}
+
+	for _, test := range tests {
+		dt := reflect.TypeOf(test.def)
+		bt := reflect.TypeOf(test.base)
+
+		if dt.NumField() != bt.NumField()+len(test.enveloped) {
+			t.Errorf("expected %s to have the fields of %s", bt, dt)
+		}
+
+		for i := 0; i < dt.NumField(); i++ {
+			df := dt.Field(i)
+			if test.enveloped[df.Name] {
+				continue
+			}
+
+			bf, exists := bt.FieldByName(df.Name)
+			if !exists || bf.Type != df.Type || bf.Tag != df.Tag {
+				t.Errorf("expected %s.%s to match %s.%s",
+					bt, df.Name, dt, df.Name)
+			}
+		}
+	}
+}
@@ -141,6 +141,7 @@ type DestStats struct {
 
 	TimerDataUpdate    metrics.Timer
 	TimerDataDelete    metrics.Timer
+	TimerDataBatch     metrics.Timer
 	TimerSnapshotStart metrics.Timer
 	TimerOpaqueGet     metrics.Timer
 	TimerOpaqueSet     metrics.Timer
@@ -152,6 +153,7 @@ func NewDestStats() *DestStats {
 	return &DestStats{
 		TimerDataUpdate:    metrics.NewTimer(),
 		TimerDataDelete:    metrics.NewTimer(),
+		TimerDataBatch:     metrics.NewTimer(),
 		TimerSnapshotStart: metrics.NewTimer(),
 		TimerOpaqueGet:     metrics.NewTimer(),
 		TimerOpaqueSet:     metrics.NewTimer(),
@@ -167,6 +169,8 @@ func (d *DestStats) WriteJSON(w io.Writer) {
 	WriteTimerJSON(w, d.TimerDataUpdate)
 	w.Write([]byte(`,"TimerDataDelete":`))
 	WriteTimerJSON(w, d.TimerDataDelete)
+	w.Write([]byte(`,"TimerDataBatch":`))
+	WriteTimerJSON(w, d.TimerDataBatch)
 	w.Write([]byte(`,"TimerSnapshotStart":`))
 	WriteTimerJSON(w, d.TimerSnapshotStart)
 	w.Write([]byte(`,"TimerOpaqueGet":`))
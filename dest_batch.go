@@ -0,0 +1,421 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/couchbase/clog"
+	"github.com/rcrowley/go-metrics"
+)
+
+// DestBatchMaxSize is the max number of mutations that a feed
+// accumulates for a DestBatch before delivering them, even when the
+// end of the snapshot hasn't been reached.
+var DestBatchMaxSize = 1000
+
+// DestBatchMaxLatency is the max time that a mutation is buffered
+// for the end of its snapshot, whether for a DestBatch or for
+// coalescing, before it's delivered anyway.  It bounds the wait for
+// the tail of a snapshot whose end seq is never delivered as a
+// mutation, such as when it's filtered out or is a system event.
+var DestBatchMaxLatency = 100 * time.Millisecond
+
+// DestBatch is an optional interface that a Dest can implement to
+// receive the mutations of a snapshot as a batch, instead of with a
+// DataUpdate or DataDelete invocation per mutation.  Feeds that
+// support batching detect a DestBatch and invoke DataBatch before any
+// other Dest method for the partition, so a later OpaqueSet() is
+// still "in-stream" after the batch's mutations.  When a Dest
+// implements both DestBatch and DestEx, batching takes precedence.
+type DestBatch interface {
+	// DataBatch is invoked with the mutations of a partition, in seq
+	// order.  The batch and its slices are reused after DataBatch
+	// returns, so the DestBatch implementation is responsible for
+	// making its own copies of the keys, vals and extras data.
+	DataBatch(partition string, batch *DestBatchData) error
+}
+
+// DestBatchData holds a batch of mutations of a partition, where the
+// i'th mutation is described by the i'th entry of each slice.  A
+// deletion has a true Deletes entry and a nil Vals entry.  All the
+// mutations of a batch have the same ExtrasType.
+type DestBatchData struct {
+	Keys       [][]byte
+	Vals       [][]byte
+	Seqs       []uint64
+	Cas        []uint64
+	Deletes    []bool
+	ExtrasType DestExtrasType
+	Extras     [][]byte
+}
+
+// Len returns the number of mutations in the batch.
+func (b *DestBatchData) Len() int {
+	return len(b.Seqs)
+}
+
+// Append adds a mutation to the batch.
+func (b *DestBatchData) Append(key []byte, seq uint64, val []byte,
+	cas uint64, deleted bool, extras []byte) {
+	b.Keys = append(b.Keys, key)
+	b.Vals = append(b.Vals, val)
+	b.Seqs = append(b.Seqs, seq)
+	b.Cas = append(b.Cas, cas)
+	b.Deletes = append(b.Deletes, deleted)
+	b.Extras = append(b.Extras, extras)
+}
+
+// Reset empties the batch for reuse, keeping its allocated capacity.
+func (b *DestBatchData) Reset() {
+	for i := range b.Keys {
+		b.Keys[i], b.Vals[i], b.Extras[i] = nil, nil, nil
+	}
+	b.Keys = b.Keys[:0]
+	b.Vals = b.Vals[:0]
+	b.Seqs = b.Seqs[:0]
+	b.Cas = b.Cas[:0]
+	b.Deletes = b.Deletes[:0]
+	b.Extras = b.Extras[:0]
+}
+
+// from returns the mutations of the batch from the i'th mutation on,
+// sharing the batch's slices.
+func (b *DestBatchData) from(i int) *DestBatchData {
+	if i <= 0 {
+		return b
+	}
+	return &DestBatchData{
+		Keys:       b.Keys[i:],
+		Vals:       b.Vals[i:],
+		Seqs:       b.Seqs[i:],
+		Cas:        b.Cas[i:],
+		Deletes:    b.Deletes[i:],
+		ExtrasType: b.ExtrasType,
+		Extras:     b.Extras[i:],
+	}
+}
+
+// ------------------------------------------------------
+
+// A DestBatchAdapter implements DestBatch for a Dest that doesn't,
+// by invoking the Dest's DataUpdate or DataDelete for each mutation
+// of a batch, so existing Dest implementations work unchanged.
+type DestBatchAdapter struct {
+	Dest
+}
+
+func (d *DestBatchAdapter) DataBatch(partition string,
+	batch *DestBatchData) error {
+	for i, seq := range batch.Seqs {
+		var err error
+		if batch.Deletes[i] {
+			err = d.Dest.DataDelete(partition, batch.Keys[i], seq,
+				batch.Cas[i], batch.ExtrasType, batch.Extras[i])
+		} else {
+			err = d.Dest.DataUpdate(partition, batch.Keys[i], seq,
+				batch.Vals[i], batch.Cas[i], batch.ExtrasType, batch.Extras[i])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AsDestBatch returns the dest itself when it implements DestBatch,
+// otherwise a DestBatchAdapter of the dest.
+func AsDestBatch(dest Dest) DestBatch {
+	if destBatch, ok := dest.(DestBatch); ok {
+		return destBatch
+	}
+	return &DestBatchAdapter{Dest: dest}
+}
+
+// ------------------------------------------------------
+
+// A destSnapshotBuffer is the state of a partition whose mutations
+// are buffered until the end seq of their snapshot, which is shared
+// by the destBatcher and the DestCoalesce.  While mutations are
+// buffered, a timer flushes them after DestBatchMaxLatency, and the
+// error of such a timed flush is kept for the next invocation from
+// the feed, so that the feed can restart the partition's stream.
+type destSnapshotBuffer struct {
+	m          sync.Mutex // Protects the fields that follow.
+	inSnapshot bool       // True after a snapshot start until its end.
+	snapEnd    uint64
+	timer      *time.Timer // Non-nil while mutations are buffered.
+	err        error       // From a timed flush.
+	closed     bool
+}
+
+// snapshotStartLOCKED tracks the end seq of a new snapshot.
+func (p *destSnapshotBuffer) snapshotStartLOCKED(snapEnd uint64) {
+	p.inSnapshot = true
+	p.snapEnd = snapEnd
+}
+
+// endLOCKED returns true when the mutation of the seq is not within a
+// snapshot or ends its snapshot, so the buffer should be delivered.
+func (p *destSnapshotBuffer) endLOCKED(seq uint64) bool {
+	if p.inSnapshot && seq < p.snapEnd {
+		return false
+	}
+	p.inSnapshot = false
+	return true
+}
+
+// armLOCKED ensures that the flush func is invoked, with the lock
+// held, once DestBatchMaxLatency passes, unless disarmed before.
+func (p *destSnapshotBuffer) armLOCKED(flush func() error) {
+	if p.timer != nil || p.closed {
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(DestBatchMaxLatency, func() {
+		p.m.Lock()
+		defer p.m.Unlock()
+
+		if p.timer != timer {
+			return // Disarmed or rearmed meanwhile.
+		}
+		p.timer = nil
+
+		err := flush()
+		if err != nil {
+			log.Printf("dest_batch: timed flush, err: %v", err)
+			if p.err == nil {
+				p.err = err
+			}
+		}
+	})
+
+	p.timer = timer
+}
+
+// disarmLOCKED stops the timed flush, such as when the buffer is
+// delivered or dropped.
+func (p *destSnapshotBuffer) disarmLOCKED() {
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+}
+
+// takeErrLOCKED returns and clears the error of a timed flush.
+func (p *destSnapshotBuffer) takeErrLOCKED() error {
+	err := p.err
+	p.err = nil
+	return err
+}
+
+// resetLOCKED forgets the snapshot, such as on a rollback, where the
+// caller drops the buffered mutations.
+func (p *destSnapshotBuffer) resetLOCKED() {
+	p.disarmLOCKED()
+	p.inSnapshot = false
+	p.snapEnd = 0
+	p.err = nil
+}
+
+// closeLOCKED stops any later timed flush, as the feed is closing.
+func (p *destSnapshotBuffer) closeLOCKED() {
+	p.disarmLOCKED()
+	p.closed = true
+}
+
+// ------------------------------------------------------
+
+// A destBatcher is used by feeds to accumulate the mutations of the
+// partitions whose dests implement DestBatch.  A partition's batch is
+// delivered when the end seq of its snapshot is reached, when it
+// reaches DestBatchMaxSize, when its mutations were buffered for
+// DestBatchMaxLatency, before a mutation of a different ExtrasType,
+// when the feed flushes it before any other Dest method invocation
+// for the partition, or when the feed closes.
+//
+// A batch whose delivery fails is kept, instead of being dropped, and
+// its delivery is retried before the partition's next mutation or
+// flush, so the error restarts the partition's stream without losing
+// the batch's mutations.  The batch is only dropped by a rollback, or
+// by the close of the feed, whose next stream restarts from the
+// dest's last OpaqueSet(), which precedes the batch.
+type destBatcher struct {
+	timer     metrics.Timer
+	delivered func(partition string, seq uint64) // May be nil.
+
+	m       sync.Mutex // Protects the fields that follow.
+	closed  bool
+	pending map[string]*destBatchPending
+}
+
+type destBatchPending struct {
+	destSnapshotBuffer
+	dest   DestBatch // The dest of the batch, when it's not empty.
+	batch  DestBatchData
+	failed bool // True when the batch's delivery failed.
+}
+
+func newDestBatcher(timer metrics.Timer,
+	delivered func(partition string, seq uint64)) *destBatcher {
+	return &destBatcher{
+		timer:     timer,
+		delivered: delivered,
+		pending:   map[string]*destBatchPending{},
+	}
+}
+
+func (b *destBatcher) partitionPending(partition string) *destBatchPending {
+	b.m.Lock()
+	p := b.pending[partition]
+	if p == nil {
+		p = &destBatchPending{}
+		p.closed = b.closed
+		b.pending[partition] = p
+	}
+	b.m.Unlock()
+	return p
+}
+
+// add returns false when the dest doesn't implement DestBatch, so the
+// caller should invoke the dest's DataUpdate or DataDelete instead.
+func (b *destBatcher) add(partition string, dest Dest,
+	key []byte, seq uint64, val []byte, cas uint64, deleted bool,
+	extrasType DestExtrasType, extras []byte) (bool, error) {
+	destBatch, ok := dest.(DestBatch)
+	if !ok {
+		return false, nil
+	}
+
+	p := b.partitionPending(partition)
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	err := p.takeErrLOCKED()
+	if err != nil {
+		return true, err
+	}
+
+	if p.failed || (p.batch.Len() > 0 && p.batch.ExtrasType != extrasType) {
+		err = b.flushLOCKED(partition, p)
+		if err != nil {
+			return true, err
+		}
+	}
+
+	p.dest = destBatch
+	p.batch.ExtrasType = extrasType
+	p.batch.Append(key, seq, val, cas, deleted, extras)
+
+	if p.endLOCKED(seq) || p.batch.Len() >= DestBatchMaxSize {
+		return true, b.flushLOCKED(partition, p)
+	}
+
+	p.armLOCKED(func() error { return b.flushLOCKED(partition, p) })
+
+	return true, nil
+}
+
+// snapshotStart flushes the partition's batch and tracks the end seq
+// of the partition's new snapshot.
+func (b *destBatcher) snapshotStart(partition string, snapEnd uint64) error {
+	p := b.partitionPending(partition)
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	p.snapshotStartLOCKED(snapEnd)
+
+	return b.flushLOCKED(partition, p)
+}
+
+// flush delivers any accumulated mutations of the partition, or the
+// error of an earlier timed flush.
+func (b *destBatcher) flush(partition string) error {
+	p := b.partitionPending(partition)
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	return b.flushLOCKED(partition, p)
+}
+
+// reset drops any accumulated mutations of the partition, such as on
+// a rollback.
+func (b *destBatcher) reset(partition string) {
+	p := b.partitionPending(partition)
+
+	p.m.Lock()
+	p.batch.Reset()
+	p.failed = false
+	p.resetLOCKED()
+	p.m.Unlock()
+}
+
+// close delivers the accumulated mutations of every partition, as the
+// feed is closing, and stops any later timed flush.
+func (b *destBatcher) close() error {
+	b.m.Lock()
+	b.closed = true
+	pending := make(map[string]*destBatchPending, len(b.pending))
+	for partition, p := range b.pending {
+		pending[partition] = p
+	}
+	b.m.Unlock()
+
+	var errFirst error
+
+	for partition, p := range pending {
+		p.m.Lock()
+		err := b.flushLOCKED(partition, p)
+		p.closeLOCKED()
+		p.m.Unlock()
+
+		if err != nil && errFirst == nil {
+			errFirst = err
+		}
+	}
+
+	return errFirst
+}
+
+func (b *destBatcher) flushLOCKED(partition string,
+	p *destBatchPending) error {
+	p.disarmLOCKED()
+
+	err := p.takeErrLOCKED()
+	if err != nil || p.batch.Len() <= 0 {
+		return err
+	}
+
+	lastSeq := p.batch.Seqs[p.batch.Len()-1]
+
+	err = Timer(func() error {
+		return p.dest.DataBatch(partition, &p.batch)
+	}, b.timer)
+	if err != nil {
+		p.failed = true // Kept for a retry, see destBatcher.
+		return err
+	}
+
+	p.batch.Reset()
+	p.failed = false
+
+	if b.delivered != nil {
+		b.delivered(partition, lastSeq)
+	}
+
+	return nil
+}
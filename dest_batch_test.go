@@ -0,0 +1,437 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+	"github.com/rcrowley/go-metrics"
+)
+
+// batchTestDest is a httpFeedTestDest that also records the seqs of
+// the batches it receives.
+type batchTestDest struct {
+	*httpFeedTestDest
+
+	batches []string // Entries of "partition/seq[/d]...".
+}
+
+func (d *batchTestDest) DataBatch(partition string,
+	batch *DestBatchData) error {
+	s := partition
+	for i, seq := range batch.Seqs {
+		s = s + fmt.Sprintf("/%d", seq)
+		if batch.Deletes[i] {
+			s = s + "d"
+		}
+	}
+	d.batches = append(d.batches, s)
+	return nil
+}
+
+func TestDestBatchAdapter(t *testing.T) {
+	var batch DestBatchData
+	batch.Append([]byte("a"), 1, []byte("{}"), 0, false, nil)
+	batch.Append([]byte("b"), 2, nil, 0, true, nil)
+
+	dest := newHTTPFeedTestDest()
+
+	err := AsDestBatch(dest).DataBatch("0", &batch)
+	if err != nil ||
+		!reflect.DeepEqual(dest.updates, []string{"0/a/1"}) ||
+		!reflect.DeepEqual(dest.deletes, []string{"0/b/2"}) {
+		t.Errorf("expected the adapter to apply the batch, err: %v,"+
+			" updates: %v, deletes: %v", err, dest.updates, dest.deletes)
+	}
+
+	batch.Reset()
+	if batch.Len() != 0 {
+		t.Errorf("expected an empty batch")
+	}
+
+	bd := &batchTestDest{httpFeedTestDest: newHTTPFeedTestDest()}
+	if AsDestBatch(bd) != bd {
+		t.Errorf("expected a DestBatch to be used as-is")
+	}
+
+	fwd := &DestForwarder{DestProvider: &testDestProvider{dest: dest}}
+	batch.Append([]byte("c"), 3, []byte("{}"), 0, false, nil)
+	err = fwd.DataBatch("0", &batch)
+	if err != nil || len(dest.updates) != 2 {
+		t.Errorf("expected the forwarder to adapt, updates: %v",
+			dest.updates)
+	}
+}
+
+func TestDCPFeedDataBatch(t *testing.T) {
+	defer func(d time.Duration) { DestBatchMaxLatency = d }(DestBatchMaxLatency)
+	DestBatchMaxLatency = time.Hour
+
+	bd := &batchTestDest{httpFeedTestDest: newHTTPFeedTestDest()}
+	d1 := newHTTPFeedTestDest()
+
+	df, err := NewDCPFeed("aaa", "bbb",
+		"url", "poolName", "bucketName", "bucketUUID", "",
+		BasicPartitionFunc, map[string]Dest{"0": bd, "1": d1}, false, nil)
+	if err != nil {
+		t.Fatalf("expected NewDCPFeed to work, err: %v", err)
+	}
+
+	req := &gomemcached.MCRequest{Body: []byte("{}")}
+
+	df.SnapshotStart(0, 1, 3, 0)
+	df.SnapshotStart(1, 1, 3, 0)
+	df.DataUpdate(0, []byte("a"), 1, req)
+	df.DataUpdate(0, []byte("b"), 2, req)
+	df.DataUpdate(1, []byte("a"), 1, req)
+
+	if len(bd.batches) != 0 || len(bd.updates) != 0 ||
+		len(d1.updates) != 1 {
+		t.Errorf("expected mutations to accumulate only for a DestBatch,"+
+			" batches: %v, d1: %v", bd.batches, d1.updates)
+	}
+
+	// Reaching the snapshot's end delivers the batch.
+	df.DataDelete(0, []byte("c"), 3, req)
+
+	// Other callbacks flush the batch first.
+	df.SnapshotStart(0, 4, 10, 0)
+	df.DataUpdate(0, []byte("d"), 4, req)
+	df.SetMetaData(0, []byte("x"))
+
+	// A rollback drops the accumulated mutations.
+	df.DataUpdate(0, []byte("e"), 5, req)
+	df.Rollback(0, 4)
+	df.GetMetaData(0)
+
+	exp := []string{"0/1/2/3d", "0/4"}
+	if !reflect.DeepEqual(bd.batches, exp) {
+		t.Errorf("expected batches: %v, got: %v", exp, bd.batches)
+	}
+	if string(bd.opaques["0"]) != "x" {
+		t.Errorf("expected opaque after the batch")
+	}
+
+	if df.stats.TimerDataBatch.Count() != 2 {
+		t.Errorf("expected batch timer stats, count: %d",
+			df.stats.TimerDataBatch.Count())
+	}
+}
+
+// syncBatchTestDest records the batches it receives, including those
+// of timed flushes, as "partition/extrasType/seq...".
+type syncBatchTestDest struct {
+	TestDest
+
+	m       sync.Mutex
+	batches []string
+}
+
+func (d *syncBatchTestDest) DataBatch(partition string,
+	batch *DestBatchData) error {
+	s := fmt.Sprintf("%s/%d", partition, batch.ExtrasType)
+	for _, seq := range batch.Seqs {
+		s = s + fmt.Sprintf("/%d", seq)
+	}
+	d.m.Lock()
+	d.batches = append(d.batches, s)
+	d.m.Unlock()
+	return nil
+}
+
+func (d *syncBatchTestDest) Batches() []string {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return append([]string(nil), d.batches...)
+}
+
+func TestDestBatcherExtrasTypeAndClose(t *testing.T) {
+	defer func(d time.Duration) { DestBatchMaxLatency = d }(DestBatchMaxLatency)
+	DestBatchMaxLatency = time.Hour
+
+	var delivered []string
+	b := newDestBatcher(metrics.NewTimer(), func(partition string, seq uint64) {
+		delivered = append(delivered, fmt.Sprintf("%s/%d", partition, seq))
+	})
+
+	d := &syncBatchTestDest{}
+
+	b.snapshotStart("0", 10)
+	b.add("0", d, []byte("a"), 1, nil, 0, false, DEST_EXTRAS_TYPE_DCP, nil)
+	b.add("0", d, []byte("b"), 2, nil, 0, false, DEST_EXTRAS_TYPE_DCP, nil)
+
+	// A mutation of another extras type cuts the batch.
+	b.add("0", d, []byte("c"), 3, nil, 0, false, DEST_EXTRAS_TYPE_NIL, nil)
+
+	exp := []string{fmt.Sprintf("0/%d/1/2", DEST_EXTRAS_TYPE_DCP)}
+	if !reflect.DeepEqual(d.Batches(), exp) {
+		t.Errorf("expected batches: %v, got: %v", exp, d.Batches())
+	}
+
+	// Closing delivers the tail of the snapshot.
+	err := b.close()
+	if err != nil {
+		t.Errorf("expected close to work, err: %v", err)
+	}
+
+	exp = append(exp, fmt.Sprintf("0/%d/3", DEST_EXTRAS_TYPE_NIL))
+	if !reflect.DeepEqual(d.Batches(), exp) {
+		t.Errorf("expected batches: %v, got: %v", exp, d.Batches())
+	}
+	if !reflect.DeepEqual(delivered, []string{"0/2", "0/3"}) {
+		t.Errorf("expected delivered seqs, got: %v", delivered)
+	}
+}
+
+func TestDestBatcherTimedFlush(t *testing.T) {
+	defer func(d time.Duration) { DestBatchMaxLatency = d }(DestBatchMaxLatency)
+	DestBatchMaxLatency = 10 * time.Millisecond
+
+	b := newDestBatcher(metrics.NewTimer(), nil)
+
+	d := &syncBatchTestDest{}
+
+	// The snapshot's end seq of 10 is never delivered as a mutation.
+	b.snapshotStart("0", 10)
+	b.add("0", d, []byte("a"), 1, nil, 0, false, DEST_EXTRAS_TYPE_NIL, nil)
+	b.add("0", d, []byte("b"), 2, nil, 0, false, DEST_EXTRAS_TYPE_NIL, nil)
+
+	exp := []string{fmt.Sprintf("0/%d/1/2", DEST_EXTRAS_TYPE_NIL)}
+
+	for i := 0; i < 100 && len(d.Batches()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !reflect.DeepEqual(d.Batches(), exp) {
+		t.Errorf("expected a timed flush, batches: %v", d.Batches())
+	}
+
+	// A dropped batch isn't flushed later.
+	b.add("0", d, []byte("c"), 3, nil, 0, false, DEST_EXTRAS_TYPE_NIL, nil)
+	b.reset("0")
+	time.Sleep(5 * DestBatchMaxLatency)
+	if !reflect.DeepEqual(d.Batches(), exp) {
+		t.Errorf("expected no flush after a reset, batches: %v",
+			d.Batches())
+	}
+}
+
+// failingBatchTestDest fails the delivery of its first batches.
+type failingBatchTestDest struct {
+	syncBatchTestDest
+
+	fails int
+}
+
+func (d *failingBatchTestDest) DataBatch(partition string,
+	batch *DestBatchData) error {
+	if d.fails > 0 {
+		d.fails--
+		return fmt.Errorf("failingBatchTestDest")
+	}
+	return d.syncBatchTestDest.DataBatch(partition, batch)
+}
+
+func TestDestBatcherKeepsFailedBatch(t *testing.T) {
+	defer func(d time.Duration) { DestBatchMaxLatency = d }(DestBatchMaxLatency)
+	DestBatchMaxLatency = time.Hour
+
+	b := newDestBatcher(metrics.NewTimer(), nil)
+
+	d := &failingBatchTestDest{fails: 2}
+
+	b.snapshotStart("0", 2)
+	b.add("0", d, []byte("a"), 1, nil, 0, false, DEST_EXTRAS_TYPE_NIL, nil)
+	_, err := b.add("0", d, []byte("b"), 2, nil, 0, false,
+		DEST_EXTRAS_TYPE_NIL, nil)
+	if err == nil {
+		t.Errorf("expected the failed delivery to error")
+	}
+
+	// The failed batch is retried before the next mutation, which
+	// isn't accumulated while the batch still fails.
+	_, err = b.add("0", d, []byte("c"), 3, nil, 0, false,
+		DEST_EXTRAS_TYPE_NIL, nil)
+	if err == nil || len(d.Batches()) != 0 {
+		t.Errorf("expected the retry to error, batches: %v", d.Batches())
+	}
+
+	err = b.flush("0")
+	exp := []string{fmt.Sprintf("0/%d/1/2", DEST_EXTRAS_TYPE_NIL)}
+	if err != nil || !reflect.DeepEqual(d.Batches(), exp) {
+		t.Errorf("expected the kept batch to be delivered, err: %v,"+
+			" batches: %v", err, d.Batches())
+	}
+
+	// A rollback drops a failed batch.
+	d.fails = 1
+	b.add("0", d, []byte("d"), 4, nil, 0, false, DEST_EXTRAS_TYPE_NIL, nil)
+	b.reset("0")
+	err = b.flush("0")
+	if err != nil || !reflect.DeepEqual(d.Batches(), exp) {
+		t.Errorf("expected a reset to drop the failed batch, err: %v,"+
+			" batches: %v", err, d.Batches())
+	}
+}
+
+func TestDestWrappersDataBatch(t *testing.T) {
+	defer func(d time.Duration) { DestBatchMaxLatency = d }(DestBatchMaxLatency)
+	DestBatchMaxLatency = time.Hour
+
+	pipeline, err := NewFeedPipeline(
+		`{"pipeline":[{"stage":"keyExclude","regexp":"^_"}]}`)
+	if err != nil {
+		t.Fatalf("expected a pipeline, err: %v", err)
+	}
+
+	coalescer, err := NewFeedCoalescer(`{"coalesce":{}}`)
+	if err != nil {
+		t.Fatalf("expected a coalescer, err: %v", err)
+	}
+
+	rw, err := NewDestRecordWriter(ioutil.Discard)
+	if err != nil {
+		t.Fatalf("expected a recording, err: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		wrap func(Dest) Dest
+		exp  []string
+	}{
+		{"errorPolicy", func(d Dest) Dest {
+			return &DestErrorPolicy{Dest: d,
+				Params: &DestErrorPolicyParams{}}
+		}, []string{"0/1/2/3d"}},
+		{"pipeline", func(d Dest) Dest {
+			return &DestPipeline{Dest: d, Pipeline: pipeline}
+		}, []string{"0/1/2d/3d"}},
+		{"recorder", func(d Dest) Dest {
+			return &DestRecorder{Dest: d, Recording: rw}
+		}, []string{"0/1/2/3d"}},
+		{"fanout", func(d Dest) Dest {
+			fanout := NewDestFanout()
+			fanout.Attach("p0", d, 1)
+			return fanout
+		}, []string{"0/2/3d"}},
+		{"coalesce", func(d Dest) Dest {
+			return &DestCoalesce{Dest: d, Coalescer: coalescer}
+		}, []string{"0/1/2/3d"}},
+	}
+
+	for _, test := range tests {
+		bd := &batchTestDest{httpFeedTestDest: newHTTPFeedTestDest()}
+
+		dest := test.wrap(bd)
+
+		destBatch, ok := dest.(DestBatch)
+		if !ok {
+			t.Errorf("expected a DestBatch, test: %s", test.name)
+			continue
+		}
+
+		var batch DestBatchData
+		batch.Append([]byte("a"), 1, []byte("{}"), 0, false, nil)
+		batch.Append([]byte("_b"), 2, []byte("{}"), 0, false, nil)
+		batch.Append([]byte("c"), 3, nil, 0, true, nil)
+
+		dest.SnapshotStart("0", 1, 3)
+
+		err = destBatch.DataBatch("0", &batch)
+		if err != nil || !reflect.DeepEqual(bd.batches, test.exp) ||
+			len(bd.updates) != 0 || len(bd.deletes) != 0 {
+			t.Errorf("expected the batch to be forwarded as a batch,"+
+				" test: %s, err: %v, batches: %v, updates: %v",
+				test.name, err, bd.batches, bd.updates)
+		}
+	}
+}
+
+// testDestProvider provides a single dest to a DestForwarder.
+type testDestProvider struct {
+	TestDest
+
+	dest Dest
+}
+
+func (p *testDestProvider) Dest(partition string) (Dest, error) {
+	return p.dest, nil
+}
+
+// --------------------------------------------------------
+
+// benchmarkBlackHoleDCPFeed feeds snapshots of 100 mutations through
+// a DCPFeed to the dest.
+func benchmarkBlackHoleDCPFeed(b *testing.B, dest Dest) {
+	df, err := NewDCPFeed("aaa", "bbb",
+		"url", "poolName", "bucketName", "bucketUUID", "",
+		BasicPartitionFunc, map[string]Dest{"0": dest}, false, nil)
+	if err != nil {
+		b.Fatalf("expected NewDCPFeed to work, err: %v", err)
+	}
+
+	key := []byte("key")
+	req := &gomemcached.MCRequest{Body: []byte(`{"a":1}`)}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		seq := uint64(i + 1)
+		if i%100 == 0 {
+			df.SnapshotStart(0, seq, seq+99, 0)
+		}
+		df.DataUpdate(0, key, seq, req)
+	}
+}
+
+func BenchmarkBlackHoleDataUpdate(b *testing.B) {
+	// Hides the DataBatch method of the BlackHole.
+	benchmarkBlackHoleDCPFeed(b, struct{ Dest }{&BlackHole{}})
+}
+
+func BenchmarkBlackHoleDataBatch(b *testing.B) {
+	benchmarkBlackHoleDCPFeed(b, &BlackHole{})
+}
+
+// benchmarkPIndexDest wraps the dest of a pindex like the janitor
+// does for an index with an error policy and a pipeline.
+func benchmarkPIndexDest(b *testing.B, dest Dest) Dest {
+	pipeline, err := NewFeedPipeline(
+		`{"pipeline":[{"stage":"keyExclude","regexp":"^_"}]}`)
+	if err != nil {
+		b.Fatalf("expected a pipeline, err: %v", err)
+	}
+
+	return &DestPipeline{
+		Dest: &DestErrorPolicy{
+			Dest:   dest,
+			Params: &DestErrorPolicyParams{Policy: DEST_ERROR_POLICY_SKIP},
+		},
+		Pipeline: pipeline,
+	}
+}
+
+func BenchmarkPIndexDestDataUpdate(b *testing.B) {
+	// Hides the DataBatch method of the pindex's dest.
+	benchmarkBlackHoleDCPFeed(b,
+		struct{ Dest }{benchmarkPIndexDest(b, &BlackHole{})})
+}
+
+func BenchmarkPIndexDestDataBatch(b *testing.B) {
+	benchmarkBlackHoleDCPFeed(b, benchmarkPIndexDest(b, &BlackHole{}))
+}
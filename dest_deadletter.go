@@ -0,0 +1,885 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/couchbase/clog"
+)
+
+// The policies of a DestErrorPolicy.
+const (
+	DEST_ERROR_POLICY_RETRY       = "retry"      // Then the error is returned.
+	DEST_ERROR_POLICY_SKIP        = "skip"       // Then the mutation is skipped.
+	DEST_ERROR_POLICY_DEAD_LETTER = "deadLetter" // Then it's dead-lettered.
+)
+
+// DestErrorPolicyRetriesDefault is the number of retries of the
+// "retry" policy when retries isn't specified.
+var DestErrorPolicyRetriesDefault = 5
+
+// DestErrorPolicyBackoffMSDefault is the wait before the first retry
+// when backoffMS isn't specified, which doubles on each retry.
+var DestErrorPolicyBackoffMSDefault = 100
+
+// DestErrorPolicyMaxBackoffMSDefault is the max wait between retries
+// when maxBackoffMS isn't specified.
+var DestErrorPolicyMaxBackoffMSDefault = 10000
+
+// DestErrorPolicySourceParams represents the optional "errorPolicy"
+// part of a sourceParams JSON, which configures how an index handles
+// the errors of its pindexes' DataUpdate() and DataDelete()
+// invocations, for example...
+//
+//    {"errorPolicy":{"policy":"deadLetter","retries":3,"backoffMS":50}}
+type DestErrorPolicySourceParams struct {
+	ErrorPolicy *DestErrorPolicyParams `json:"errorPolicy"`
+}
+
+// DestErrorPolicyParams represents the JSON of an error policy.
+type DestErrorPolicyParams struct {
+	// Policy is one of the DEST_ERROR_POLICY_XXX values.
+	Policy string `json:"policy"`
+
+	// Retries is the number of retries before the policy gives up on
+	// a mutation.  A 0 means DestErrorPolicyRetriesDefault for the
+	// "retry" policy, and no retries for the other policies.
+	Retries int `json:"retries"`
+
+	BackoffMS    int `json:"backoffMS"`
+	MaxBackoffMS int `json:"maxBackoffMS"`
+}
+
+// NewDestErrorPolicyParams parses the errorPolicy part of a
+// sourceParams JSON, returning nil when the index doesn't have an
+// error policy.
+func NewDestErrorPolicyParams(sourceParams string) (
+	*DestErrorPolicyParams, error) {
+	if !strings.Contains(sourceParams, `"errorPolicy"`) {
+		return nil, nil
+	}
+
+	var params DestErrorPolicySourceParams
+
+	err := json.Unmarshal([]byte(sourceParams), &params)
+	if err != nil {
+		return nil, fmt.Errorf("dest_deadletter: could not parse"+
+			" sourceParams, err: %v", err)
+	}
+
+	p := params.ErrorPolicy
+	if p == nil {
+		return nil, nil
+	}
+
+	switch p.Policy {
+	case DEST_ERROR_POLICY_RETRY:
+		if p.Retries == 0 {
+			p.Retries = DestErrorPolicyRetriesDefault
+		}
+	case DEST_ERROR_POLICY_SKIP, DEST_ERROR_POLICY_DEAD_LETTER:
+	default:
+		return nil, fmt.Errorf("dest_deadletter: unknown policy: %q",
+			p.Policy)
+	}
+
+	if p.Retries < 0 || p.BackoffMS < 0 || p.MaxBackoffMS < 0 {
+		return nil, fmt.Errorf("dest_deadletter: negative retries,"+
+			" backoffMS or maxBackoffMS, errorPolicy: %+v", *p)
+	}
+
+	if p.BackoffMS == 0 {
+		p.BackoffMS = DestErrorPolicyBackoffMSDefault
+	}
+	if p.MaxBackoffMS == 0 {
+		p.MaxBackoffMS = DestErrorPolicyMaxBackoffMSDefault
+	}
+
+	return p, nil
+}
+
+// -----------------------------------------------------
+
+// A DestErrorPolicy implements the Dest, DestEx and DestBatch
+// interfaces by forwarding method calls to a pindex's Dest, where a
+// DataUpdate or DataDelete error is retried with an exponential
+// backoff, after which the mutation is either failed, skipped or
+// skipped and appended to the pindex's DeadLetterStore, according to
+// the policy.  This way, a single poisoned document doesn't stall or
+// endlessly restart a feed.  The other Dest methods are forwarded
+// as-is.
+type DestErrorPolicy struct {
+	Dest
+	Params      *DestErrorPolicyParams
+	DeadLetters *DeadLetterStore // Used by the "deadLetter" policy.
+}
+
+func (t *DestErrorPolicy) DataUpdate(partition string,
+	key []byte, seq uint64, val []byte,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	return t.handle(partition, key, seq, val, cas, false,
+		extrasType, extras, func() error {
+			return t.Dest.DataUpdate(partition, key, seq, val,
+				cas, extrasType, extras)
+		})
+}
+
+func (t *DestErrorPolicy) DataDelete(partition string,
+	key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	return t.handle(partition, key, seq, nil, cas, true,
+		extrasType, extras, func() error {
+			return t.Dest.DataDelete(partition, key, seq,
+				cas, extrasType, extras)
+		})
+}
+
+func (t *DestErrorPolicy) DataUpdateEx(partition string,
+	key []byte, seq uint64, val []byte,
+	cas uint64,
+	extrasType DestExtrasType, req interface{}) error {
+	return t.handle(partition, key, seq, val, cas, false,
+		DEST_EXTRAS_TYPE_DCP, destReqExtras(req), func() error {
+			if destEx, ok := t.Dest.(DestEx); ok {
+				return destEx.DataUpdateEx(partition, key, seq, val,
+					cas, extrasType, req)
+			}
+			return t.Dest.DataUpdate(partition, key, seq, val,
+				cas, DEST_EXTRAS_TYPE_DCP, destReqExtras(req))
+		})
+}
+
+func (t *DestErrorPolicy) DataDeleteEx(partition string,
+	key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, req interface{}) error {
+	return t.handle(partition, key, seq, nil, cas, true,
+		DEST_EXTRAS_TYPE_DCP, destReqExtras(req), func() error {
+			if destEx, ok := t.Dest.(DestEx); ok {
+				return destEx.DataDeleteEx(partition, key, seq,
+					cas, extrasType, req)
+			}
+			return t.Dest.DataDelete(partition, key, seq,
+				cas, DEST_EXTRAS_TYPE_DCP, destReqExtras(req))
+		})
+}
+
+func (t *DestErrorPolicy) RollbackEx(partition string, partitionUUID uint64,
+	rollbackSeq uint64) error {
+	if destEx, ok := t.Dest.(DestEx); ok {
+		return destEx.RollbackEx(partition, partitionUUID, rollbackSeq)
+	}
+	return t.Dest.Rollback(partition, rollbackSeq)
+}
+
+// DataBatch delivers the batch to the pindex's Dest as a whole, and
+// only when that fails, applies the policy to each of the batch's
+// mutations in turn, as the failed mutation isn't known.
+func (t *DestErrorPolicy) DataBatch(partition string,
+	batch *DestBatchData) error {
+	if t.DeadLetters != nil {
+		unlock := t.DeadLetters.lockPartition(partition)
+		defer unlock()
+	}
+
+	err := AsDestBatch(t.Dest).DataBatch(partition, batch)
+	if err != nil {
+		for i, seq := range batch.Seqs {
+			key, val, cas := batch.Keys[i], batch.Vals[i], batch.Cas[i]
+			deleted, extras := batch.Deletes[i], batch.Extras[i]
+
+			err = t.handlePolicy(partition, key, seq, val, cas, deleted,
+				batch.ExtrasType, extras, func() error {
+					if deleted {
+						return t.Dest.DataDelete(partition, key, seq,
+							cas, batch.ExtrasType, extras)
+					}
+					return t.Dest.DataUpdate(partition, key, seq, val,
+						cas, batch.ExtrasType, extras)
+				})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if t.DeadLetters != nil {
+		for i, seq := range batch.Seqs {
+			err = t.DeadLetters.supersede(partition, batch.Keys[i], seq)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// handle invokes the apply func, applying the policy on errors.  The
+// partition is locked against a concurrent replay of its DeadLetters,
+// and a DeadLetter of the key is superseded once the mutation is
+// handled, so that a later replay doesn't overwrite the newer value.
+func (t *DestErrorPolicy) handle(partition string,
+	key []byte, seq uint64, val []byte, cas uint64, deleted bool,
+	extrasType DestExtrasType, extras []byte, apply func() error) error {
+	if t.DeadLetters == nil {
+		return t.handlePolicy(partition, key, seq, val, cas, deleted,
+			extrasType, extras, apply)
+	}
+
+	unlock := t.DeadLetters.lockPartition(partition)
+	defer unlock()
+
+	err := t.handlePolicy(partition, key, seq, val, cas, deleted,
+		extrasType, extras, apply)
+	if err != nil {
+		return err
+	}
+
+	return t.DeadLetters.supersede(partition, key, seq)
+}
+
+func (t *DestErrorPolicy) handlePolicy(partition string,
+	key []byte, seq uint64, val []byte, cas uint64, deleted bool,
+	extrasType DestExtrasType, extras []byte, apply func() error) error {
+	err := apply()
+	if err == nil {
+		return nil
+	}
+
+	backoff := time.Duration(t.Params.BackoffMS) * time.Millisecond
+	maxBackoff := time.Duration(t.Params.MaxBackoffMS) * time.Millisecond
+
+	for i := 0; i < t.Params.Retries; i++ {
+		time.Sleep(backoff)
+
+		err = apply()
+		if err == nil {
+			return nil
+		}
+
+		backoff = backoff * 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+
+	switch t.Params.Policy {
+	case DEST_ERROR_POLICY_SKIP:
+		log.Printf("dest_deadletter: skipped, partition: %s, seq: %d,"+
+			" err: %v", partition, seq, err)
+		return nil
+
+	case DEST_ERROR_POLICY_DEAD_LETTER:
+		errDL := t.DeadLetters.Add(&DeadLetter{
+			Partition:  partition,
+			Key:        key,
+			Val:        val,
+			Seq:        seq,
+			Cas:        cas,
+			Deleted:    deleted,
+			ExtrasType: extrasType,
+			Extras:     extras,
+			Err:        err.Error(),
+		})
+		if errDL != nil {
+			return fmt.Errorf("dest_deadletter: could not dead-letter,"+
+				" partition: %s, seq: %d, err: %v, errDL: %v",
+				partition, seq, err, errDL)
+		}
+
+		log.Printf("dest_deadletter: dead-lettered, partition: %s,"+
+			" seq: %d, err: %v", partition, seq, err)
+		return nil
+	}
+
+	return err
+}
+
+// pindexFeedDest returns the dest of a pindex that a feed should use,
+// which applies the index's error policy, if any.  A pindex that
+// still has pending DeadLetters, such as from an earlier error
+// policy, keeps a pass-through error policy, so that its mutations
+// supersede those DeadLetters.
+func pindexFeedDest(pindex *PIndex) (Dest, error) {
+	params, err := NewDestErrorPolicyParams(pindex.SourceParams)
+	if err != nil {
+		return nil, err
+	}
+	if params == nil {
+		pending, err := pindex.DeadLetters().HasPending()
+		if err != nil {
+			return nil, err
+		}
+		if !pending {
+			return pindex.Dest, nil
+		}
+		params = &DestErrorPolicyParams{}
+	}
+
+	return &DestErrorPolicy{
+		Dest:        pindex.Dest,
+		Params:      params,
+		DeadLetters: pindex.DeadLetters(),
+	}, nil
+}
+
+// -----------------------------------------------------
+
+// DEAD_LETTERS_FILENAME is the file of a pindex's DeadLetterStore,
+// in the pindex's directory.
+const DEAD_LETTERS_FILENAME = "DEAD_LETTERS"
+
+// DeadLetterStoreMaxEntries and DeadLetterStoreMaxBytes bound the
+// DeadLetterStore of a pindex.  Past either bound, Add() fails, so
+// the "deadLetter" policy fails the mutation and the feed errors like
+// with the "retry" policy, instead of dropping the mutation.
+var DeadLetterStoreMaxEntries = 10000
+var DeadLetterStoreMaxBytes = int64(64 * 1024 * 1024)
+
+// A DeadLetter represents a mutation that a pindex's Dest failed to
+// apply, as it was delivered to the Dest.
+type DeadLetter struct {
+	Id         uint64         `json:"id"`
+	Time       time.Time      `json:"time"`
+	Partition  string         `json:"partition"`
+	Key        []byte         `json:"key"`
+	Val        []byte         `json:"val,omitempty"`
+	Seq        uint64         `json:"seq"`
+	Cas        uint64         `json:"cas"`
+	Deleted    bool           `json:"deleted"`
+	ExtrasType DestExtrasType `json:"extrasType"`
+	Extras     []byte         `json:"extras,omitempty"`
+	Err        string         `json:"err"`
+
+	// Superseded is true once a later mutation of the same key was
+	// handled, so the DeadLetter is stale and a replay skips it.
+	Superseded bool `json:"superseded,omitempty"`
+}
+
+// deadLetterRecord is a line of a DeadLetterStore's file, which is
+// either a DeadLetter or, when Supersedes is non-zero, a marker that
+// the DeadLetter with that id is superseded.
+type deadLetterRecord struct {
+	DeadLetter
+	Supersedes uint64 `json:"supersedes,omitempty"`
+}
+
+// A DeadLetterStore is an append-only file of DeadLetters, one JSON
+// line per DeadLetter or superseded marker, which is only rewritten
+// when DeadLetters are removed.  The file is only created on the
+// first Add(), each append is synced before it's acknowledged, and a
+// partial last line, such as from a crash, is ignored.
+type DeadLetterStore struct {
+	path string
+
+	m       sync.Mutex // Protects the fields that follow.
+	f       *os.File   // Opened for appends on demand.
+	loaded  bool
+	nextId  uint64
+	count   int                    // Number of DeadLetters in the file.
+	size    int64                  // Bytes of the file.
+	pending map[string]*DeadLetter // Unsuperseded, by deadLetterKey().
+
+	partitionLocks map[string]*sync.Mutex
+}
+
+func NewDeadLetterStore(path string) *DeadLetterStore {
+	return &DeadLetterStore{path: path}
+}
+
+func deadLetterKey(partition string, key []byte) string {
+	return partition + "/" + string(key)
+}
+
+// Add appends a DeadLetter, assigning its Id and Time, where an
+// earlier DeadLetter of the same key is superseded.
+func (s *DeadLetterStore) Add(dl *DeadLetter) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	err := s.loadLOCKED()
+	if err != nil {
+		return err
+	}
+
+	dl.Id = s.nextId
+	dl.Time = time.Now()
+	dl.Superseded = false
+
+	b, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+
+	if s.count >= DeadLetterStoreMaxEntries ||
+		s.size+int64(len(b)+1) > DeadLetterStoreMaxBytes {
+		return fmt.Errorf("dest_deadletter: full, path: %s, count: %d,"+
+			" size: %d", s.path, s.count, s.size)
+	}
+
+	err = s.appendLOCKED(b)
+	if err != nil {
+		return err
+	}
+
+	s.nextId++
+	s.count++
+
+	k := deadLetterKey(dl.Partition, dl.Key)
+	prev := s.pending[k]
+	s.pending[k] = dl
+
+	if prev != nil {
+		return s.appendSupersedesLOCKED(prev.Id)
+	}
+
+	return nil
+}
+
+// HasPending returns true when there are unsuperseded DeadLetters.
+func (s *DeadLetterStore) HasPending() (bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	err := s.loadLOCKED()
+	if err != nil {
+		return false, err
+	}
+
+	return len(s.pending) > 0, nil
+}
+
+// supersede marks the pending DeadLetter of a key, if any, as
+// superseded, when the seq is later than the DeadLetter's seq.
+func (s *DeadLetterStore) supersede(partition string,
+	key []byte, seq uint64) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	err := s.loadLOCKED()
+	if err != nil || len(s.pending) <= 0 {
+		return err
+	}
+
+	k := deadLetterKey(partition, key)
+
+	prev := s.pending[k]
+	if prev == nil || prev.Seq >= seq {
+		return nil
+	}
+
+	delete(s.pending, k)
+
+	return s.appendSupersedesLOCKED(prev.Id)
+}
+
+// isPending returns true when the DeadLetter is not yet superseded.
+func (s *DeadLetterStore) isPending(dl *DeadLetter) (bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	err := s.loadLOCKED()
+	if err != nil {
+		return false, err
+	}
+
+	prev := s.pending[deadLetterKey(dl.Partition, dl.Key)]
+
+	return prev != nil && prev.Id == dl.Id, nil
+}
+
+// lockPartition serializes the mutations of a partition, whether from
+// a feed or from a replay, and returns the unlock func.
+func (s *DeadLetterStore) lockPartition(partition string) func() {
+	s.m.Lock()
+	if s.partitionLocks == nil {
+		s.partitionLocks = map[string]*sync.Mutex{}
+	}
+	l := s.partitionLocks[partition]
+	if l == nil {
+		l = &sync.Mutex{}
+		s.partitionLocks[partition] = l
+	}
+	s.m.Unlock()
+
+	l.Lock()
+
+	return l.Unlock
+}
+
+func (s *DeadLetterStore) appendSupersedesLOCKED(id uint64) error {
+	b, err := json.Marshal(&deadLetterRecord{Supersedes: id})
+	if err != nil {
+		return err
+	}
+
+	return s.appendLOCKED(b)
+}
+
+// appendLOCKED appends a line to the file, and syncs it.
+func (s *DeadLetterStore) appendLOCKED(b []byte) error {
+	if s.f == nil {
+		dir := filepath.Dir(s.path)
+
+		err := os.MkdirAll(dir, 0700)
+		if err != nil {
+			return err
+		}
+
+		s.f, err = os.OpenFile(s.path,
+			os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+
+		err = SyncDir(dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := s.f.Write(append(b, '\n'))
+	if err == nil {
+		err = s.f.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("dest_deadletter: write, path: %s, err: %v",
+			s.path, err)
+	}
+
+	s.size += int64(len(b) + 1)
+
+	return nil
+}
+
+// loadLOCKED reads the file's state, unless it's already loaded.
+func (s *DeadLetterStore) loadLOCKED() error {
+	if s.loaded {
+		return nil
+	}
+
+	dls, size, err := s.readLOCKED()
+	if err != nil {
+		return err
+	}
+
+	s.nextId = 1
+	s.count = len(dls)
+	s.size = size
+	s.pending = map[string]*DeadLetter{}
+
+	for _, dl := range dls {
+		s.nextId = dl.Id + 1
+		if !dl.Superseded {
+			s.pending[deadLetterKey(dl.Partition, dl.Key)] = dl
+		}
+	}
+
+	s.loaded = true
+
+	return nil
+}
+
+// List returns the DeadLetters in Id order.
+func (s *DeadLetterStore) List() ([]*DeadLetter, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	dls, _, err := s.readLOCKED()
+
+	return dls, err
+}
+
+// Get returns the DeadLetter with the id, or nil.
+func (s *DeadLetterStore) Get(id uint64) (*DeadLetter, error) {
+	dls, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+
+	i := sort.Search(len(dls), func(i int) bool { return dls[i].Id >= id })
+	if i < len(dls) && dls[i].Id == id {
+		return dls[i], nil
+	}
+
+	return nil, nil
+}
+
+// Remove rewrites the file without the DeadLetters of the ids, and
+// without the superseded markers, which are folded into the kept
+// DeadLetters.  The rewrite is via a rename so that readers never see
+// a partial file.  It returns the number of DeadLetters that were
+// removed.
+func (s *DeadLetterStore) Remove(ids map[uint64]bool) (int, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	dls, _, err := s.readLOCKED()
+	if err != nil {
+		return 0, err
+	}
+
+	var buf bytes.Buffer
+	var kept int
+
+	for _, dl := range dls {
+		if ids[dl.Id] {
+			continue
+		}
+
+		b, err := json.Marshal(dl)
+		if err != nil {
+			return 0, err
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+		kept++
+	}
+
+	if kept == len(dls) {
+		return 0, nil
+	}
+
+	s.closeLOCKED()
+	s.loaded = false
+
+	if kept == 0 {
+		err = os.Remove(s.path)
+		if err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+		return len(dls), SyncDir(filepath.Dir(s.path))
+	}
+
+	err = WriteFileSync(s.path, buf.Bytes(), 0600)
+	if err != nil {
+		return 0, fmt.Errorf("dest_deadletter: rewrite, path: %s, err: %v",
+			s.path, err)
+	}
+
+	return len(dls) - kept, nil
+}
+
+// Close may be invoked more than once, and a later Add() reopens the
+// file.
+func (s *DeadLetterStore) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.closeLOCKED()
+}
+
+func (s *DeadLetterStore) closeLOCKED() error {
+	if s.f == nil {
+		return nil
+	}
+
+	err := s.f.Close()
+	s.f = nil
+
+	return err
+}
+
+// readLOCKED returns the DeadLetters of the file, with the superseded
+// markers applied, and the size of the file.
+func (s *DeadLetterStore) readLOCKED() ([]*DeadLetter, int64, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	var rv []*DeadLetter
+	var size int64
+
+	byId := map[uint64]*DeadLetter{}
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		size += int64(len(line))
+		if err == io.EOF {
+			return rv, size, nil // Ignores a partial last line.
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		var rec deadLetterRecord
+
+		err = json.Unmarshal(line, &rec)
+		if err != nil {
+			log.Printf("dest_deadletter: skipping unparsable line,"+
+				" path: %s, err: %v", s.path, err)
+			continue
+		}
+
+		if rec.Supersedes != 0 {
+			if dl := byId[rec.Supersedes]; dl != nil {
+				dl.Superseded = true
+			}
+			continue
+		}
+
+		dl := rec.DeadLetter
+
+		rv = append(rv, &dl)
+		byId[dl.Id] = &dl
+	}
+}
+
+// -----------------------------------------------------
+
+// The ops of Manager.DeadLetterControl().
+const (
+	DEAD_LETTER_OP_REPLAY = "replay"
+	DEAD_LETTER_OP_PURGE  = "purge"
+)
+
+// PIndexDeadLetters returns the DeadLetterStore of a pindex on this
+// node.
+func (mgr *Manager) PIndexDeadLetters(pindexName string) (
+	*DeadLetterStore, error) {
+	pindex := mgr.GetPIndex(pindexName)
+	if pindex == nil {
+		return nil, fmt.Errorf("dest_deadletter: no pindex,"+
+			" pindexName: %s", pindexName)
+	}
+
+	return pindex.DeadLetters(), nil
+}
+
+// DeadLetterControl replays or purges the DeadLetters of a pindex on
+// this node, where an id of 0 means every DeadLetter.  A replay
+// invokes the pindex's Dest directly, in Id order, stopping at the
+// first error, and removes the DeadLetters that were applied.  The
+// replay of a partition is serialized with its feed, and superseded
+// DeadLetters, whose keys have since had later mutations, are removed
+// without being applied.  It returns the number of DeadLetters that
+// were replayed, skipped as superseded, or purged.
+func (mgr *Manager) DeadLetterControl(pindexName, op string, id uint64) (
+	int, error) {
+	atomic.AddUint64(&mgr.stats.TotDeadLetterControl, 1)
+
+	if op != DEAD_LETTER_OP_REPLAY && op != DEAD_LETTER_OP_PURGE {
+		return 0, fmt.Errorf("dest_deadletter: unsupported op: %s", op)
+	}
+
+	pindex := mgr.GetPIndex(pindexName)
+	if pindex == nil {
+		return 0, fmt.Errorf("dest_deadletter: no pindex,"+
+			" pindexName: %s", pindexName)
+	}
+
+	store := pindex.DeadLetters()
+
+	dls, err := store.List()
+	if err != nil {
+		return 0, err
+	}
+
+	ids := map[uint64]bool{}
+	for _, dl := range dls {
+		if id == 0 || dl.Id == id {
+			ids[dl.Id] = true
+		}
+	}
+	if id != 0 && !ids[id] {
+		return 0, fmt.Errorf("dest_deadletter: no dead letter,"+
+			" pindexName: %s, id: %d", pindexName, id)
+	}
+
+	if op == DEAD_LETTER_OP_REPLAY {
+		ids, err = replayDeadLetters(pindex, store, dls, ids)
+	}
+
+	n, errRemove := store.Remove(ids)
+	if errRemove != nil {
+		return n, errRemove
+	}
+	if err != nil {
+		return n, fmt.Errorf("dest_deadletter: replay, pindexName: %s,"+
+			" replayed: %d, err: %v", pindexName, n, err)
+	}
+
+	atomic.AddUint64(&mgr.stats.TotDeadLetterControlOk, 1)
+	return n, nil
+}
+
+// replayDeadLetters applies the wanted DeadLetters to the pindex's
+// Dest, returning the ids of those that were applied or superseded.
+func replayDeadLetters(pindex *PIndex, store *DeadLetterStore,
+	dls []*DeadLetter, wanted map[uint64]bool) (map[uint64]bool, error) {
+	rv := map[uint64]bool{}
+
+	if pindex.Dest == nil {
+		return rv, fmt.Errorf("dest_deadletter: no pindex.Dest,"+
+			" pindexName: %s", pindex.Name)
+	}
+
+	for _, dl := range dls {
+		if !wanted[dl.Id] {
+			continue
+		}
+
+		err := replayDeadLetter(pindex, store, dl)
+		if err != nil {
+			return rv, fmt.Errorf("id: %d, err: %v", dl.Id, err)
+		}
+
+		rv[dl.Id] = true
+	}
+
+	return rv, nil
+}
+
+func replayDeadLetter(pindex *PIndex, store *DeadLetterStore,
+	dl *DeadLetter) error {
+	unlock := store.lockPartition(dl.Partition)
+	defer unlock()
+
+	pending, err := store.isPending(dl)
+	if err != nil {
+		return err
+	}
+	if !pending {
+		log.Printf("dest_deadletter: replay, skipped superseded,"+
+			" pindexName: %s, id: %d", pindex.Name, dl.Id)
+		return nil
+	}
+
+	if dl.Deleted {
+		return pindex.Dest.DataDelete(dl.Partition, dl.Key, dl.Seq,
+			dl.Cas, dl.ExtrasType, dl.Extras)
+	}
+
+	return pindex.Dest.DataUpdate(dl.Partition, dl.Key, dl.Seq,
+		dl.Val, dl.Cas, dl.ExtrasType, dl.Extras)
+}
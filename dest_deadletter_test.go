@@ -0,0 +1,321 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// flakyTestDest fails the DataUpdates of its failKey until fails
+// reaches 0, where a negative fails means always.
+type flakyTestDest struct {
+	*httpFeedTestDest
+
+	fails int
+}
+
+func (d *flakyTestDest) DataUpdate(partition string,
+	key []byte, seq uint64, val []byte,
+	cas uint64, extrasType DestExtrasType, extras []byte) error {
+	if string(key) == d.failKey && d.fails != 0 {
+		d.fails--
+		return fmt.Errorf("failKey")
+	}
+	d.updates = append(d.updates, fmt.Sprintf("%s/%s/%d", partition, key, seq))
+	return nil
+}
+
+func TestNewDestErrorPolicyParams(t *testing.T) {
+	for _, sourceParams := range []string{"", "{}", `{"x":1}`} {
+		p, err := NewDestErrorPolicyParams(sourceParams)
+		if err != nil || p != nil {
+			t.Errorf("expected no errorPolicy, sourceParams: %s", sourceParams)
+		}
+	}
+
+	p, err := NewDestErrorPolicyParams(`{"errorPolicy":{"policy":"retry"}}`)
+	if err != nil || !reflect.DeepEqual(p, &DestErrorPolicyParams{
+		Policy:       DEST_ERROR_POLICY_RETRY,
+		Retries:      DestErrorPolicyRetriesDefault,
+		BackoffMS:    DestErrorPolicyBackoffMSDefault,
+		MaxBackoffMS: DestErrorPolicyMaxBackoffMSDefault,
+	}) {
+		t.Errorf("expected retry defaults, p: %+v, err: %v", p, err)
+	}
+
+	p, err = NewDestErrorPolicyParams(`{"errorPolicy":{"policy":"skip"}}`)
+	if err != nil || p.Retries != 0 {
+		t.Errorf("expected no retries, p: %+v, err: %v", p, err)
+	}
+
+	for _, sourceParams := range []string{
+		`{"errorPolicy":1}`,
+		`{"errorPolicy":{}}`,
+		`{"errorPolicy":{"policy":"unknown"}}`,
+		`{"errorPolicy":{"policy":"skip","retries":-1}}`,
+	} {
+		_, err := NewDestErrorPolicyParams(sourceParams)
+		if err == nil {
+			t.Errorf("expected err, sourceParams: %s", sourceParams)
+		}
+	}
+}
+
+func TestDestErrorPolicy(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	newDest := func(policy string, retries, fails int) (
+		*DestErrorPolicy, *flakyTestDest) {
+		d := &flakyTestDest{httpFeedTestDest: newHTTPFeedTestDest(), fails: fails}
+		d.failKey = "bad"
+		return &DestErrorPolicy{
+			Dest: d,
+			Params: &DestErrorPolicyParams{
+				Policy:       policy,
+				Retries:      retries,
+				BackoffMS:    1,
+				MaxBackoffMS: 2,
+			},
+			DeadLetters: NewDeadLetterStore(
+				filepath.Join(emptyDir, policy, DEAD_LETTERS_FILENAME)),
+		}, d
+	}
+
+	// Retries succeed before running out.
+	dep, _ := newDest(DEST_ERROR_POLICY_RETRY, 3, 2)
+	if err := dep.DataUpdate("0", []byte("bad"), 1, nil,
+		0, DEST_EXTRAS_TYPE_NIL, nil); err != nil {
+		t.Errorf("expected retries to succeed, err: %v", err)
+	}
+
+	dep, _ = newDest(DEST_ERROR_POLICY_RETRY, 3, -1)
+	if err := dep.DataUpdate("0", []byte("bad"), 1, nil,
+		0, DEST_EXTRAS_TYPE_NIL, nil); err == nil {
+		t.Errorf("expected the retry policy to fail")
+	}
+
+	dep, _ = newDest(DEST_ERROR_POLICY_SKIP, 0, -1)
+	if err := dep.DataUpdate("0", []byte("bad"), 1, nil,
+		0, DEST_EXTRAS_TYPE_NIL, nil); err != nil {
+		t.Errorf("expected the skip policy to skip, err: %v", err)
+	}
+	if dls, _ := dep.DeadLetters.List(); len(dls) != 0 {
+		t.Errorf("expected no dead letters, got: %v", dls)
+	}
+
+	dep, d := newDest(DEST_ERROR_POLICY_DEAD_LETTER, 1, -1)
+	for seq, key := range []string{"ok", "bad", "bad"} {
+		err := dep.DataUpdate("0", []byte(key), uint64(seq+1), []byte("{}"),
+			0, DEST_EXTRAS_TYPE_NIL, nil)
+		if err != nil {
+			t.Errorf("expected the deadLetter policy to skip, err: %v", err)
+		}
+	}
+
+	// The later dead letter of the same key supersedes the earlier.
+	dls, err := dep.DeadLetters.List()
+	if err != nil || len(dls) != 2 ||
+		dls[0].Id != 1 || dls[0].Seq != 2 || dls[0].Err != "failKey" ||
+		string(dls[0].Key) != "bad" || string(dls[0].Val) != "{}" ||
+		!dls[0].Superseded ||
+		dls[1].Id != 2 || dls[1].Seq != 3 || dls[1].Superseded {
+		t.Errorf("unexpected dead letters: %+v, err: %v", dls, err)
+	}
+
+	// A later, applied mutation of the key supersedes its dead letter.
+	d.fails = 0
+	err = dep.DataUpdate("0", []byte("bad"), 4, []byte("{}"),
+		0, DEST_EXTRAS_TYPE_NIL, nil)
+	if err != nil {
+		t.Errorf("expected update to work, err: %v", err)
+	}
+	dls, _ = dep.DeadLetters.List()
+	if len(dls) != 2 || !dls[1].Superseded {
+		t.Errorf("expected superseded dead letter, dls: %+v", dls)
+	}
+	if pending, _ := dep.DeadLetters.HasPending(); pending {
+		t.Errorf("expected no pending dead letters")
+	}
+}
+
+func TestDeadLetterStore(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	path := filepath.Join(emptyDir, DEAD_LETTERS_FILENAME)
+
+	s := NewDeadLetterStore(path)
+	if dls, err := s.List(); err != nil || len(dls) != 0 {
+		t.Errorf("expected an empty store, err: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected no file before an Add")
+	}
+
+	for i := 0; i < 3; i++ {
+		s.Add(&DeadLetter{Partition: "0", Key: []byte("k"), Seq: uint64(i)})
+	}
+	s.Close()
+
+	// A partial last line is ignored, and ids continue after reopening.
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	f.Write([]byte(`{"id":4,"parti`))
+	f.Close()
+
+	s = NewDeadLetterStore(path)
+
+	dl, err := s.Get(2)
+	if err != nil || dl == nil || dl.Seq != 1 {
+		t.Errorf("expected Get to work, dl: %+v, err: %v", dl, err)
+	}
+	if dl, _ = s.Get(4); dl != nil {
+		t.Errorf("expected no partial dead letter")
+	}
+
+	n, err := s.Remove(map[uint64]bool{2: true, 10: true})
+	if err != nil || n != 1 {
+		t.Errorf("expected Remove to work, n: %d, err: %v", n, err)
+	}
+
+	s.Add(&DeadLetter{Partition: "0", Key: []byte("k"), Seq: 3})
+
+	dls, _ := s.List()
+	ids := []uint64{}
+	for _, dl := range dls {
+		ids = append(ids, dl.Id)
+	}
+	if !reflect.DeepEqual(ids, []uint64{1, 3, 4}) {
+		t.Errorf("unexpected ids: %v", ids)
+	}
+
+	// Superseded markers survive a rewrite.
+	for _, dl := range dls {
+		if dl.Superseded != (dl.Id != 4) {
+			t.Errorf("unexpected superseded, dl: %+v", dl)
+		}
+	}
+
+	n, err = s.Remove(map[uint64]bool{1: true, 3: true, 4: true})
+	if err != nil || n != 3 {
+		t.Errorf("expected Remove of all to work, n: %d, err: %v", n, err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected no file after removing all")
+	}
+
+	// Past its bound, the store refuses more dead letters.
+	maxEntries := DeadLetterStoreMaxEntries
+	DeadLetterStoreMaxEntries = 2
+	defer func() { DeadLetterStoreMaxEntries = maxEntries }()
+
+	for i := 0; i < 3; i++ {
+		err = s.Add(&DeadLetter{Partition: "0",
+			Key: []byte(fmt.Sprintf("k%d", i)), Seq: uint64(i)})
+		if (err != nil) != (i >= 2) {
+			t.Errorf("expected only the entry past the bound to fail,"+
+				" i: %d, err: %v", i, err)
+		}
+	}
+}
+
+func TestManagerDeadLetterControl(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	mgr := NewManager(VERSION, NewCfgMem(), NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+
+	dest := newHTTPFeedTestDest()
+	dest.failKey = "bad"
+
+	pindex := &PIndex{
+		Name:         "p0",
+		SourceParams: `{"errorPolicy":{"policy":"deadLetter"}}`,
+		Path:         PIndexPath(emptyDir, "p0"),
+		Dest:         dest,
+	}
+	mgr.registerPIndex(pindex)
+
+	fd, err := feedDests("feedName", []*PIndex{pindex})
+	if err != nil {
+		t.Fatalf("expected feedDests to work, err: %v", err)
+	}
+	if unwrapDest(fd[""]) != dest {
+		t.Errorf("expected a wrapped pindex.Dest")
+	}
+
+	for seq, key := range []string{"bad", "bad", "bad"} {
+		fd[""].DataUpdate("", []byte(key), uint64(seq+1), nil,
+			0, DEST_EXTRAS_TYPE_NIL, nil)
+	}
+
+	dest.failKey = "bad2"
+	fd[""].DataUpdate("", []byte("bad2"), 4, nil,
+		0, DEST_EXTRAS_TYPE_NIL, nil)
+	dest.failKey = "bad"
+
+	n, err := mgr.DeadLetterControl("p0", DEAD_LETTER_OP_PURGE, 2)
+	if err != nil || n != 1 {
+		t.Errorf("expected purge to work, n: %d, err: %v", n, err)
+	}
+
+	// A replay stops at the first error, after removing the dead
+	// letter 1, which the dead letter 3 superseded.
+	n, err = mgr.DeadLetterControl("p0", DEAD_LETTER_OP_REPLAY, 0)
+	if err == nil || n != 1 {
+		t.Errorf("expected replay to fail, n: %d, err: %v", n, err)
+	}
+
+	// The feed applies a later mutation of bad2, which supersedes its
+	// dead letter, so the replay doesn't overwrite it.
+	dest.failKey = ""
+	fd[""].DataUpdate("", []byte("bad2"), 6, nil,
+		0, DEST_EXTRAS_TYPE_NIL, nil)
+	dest.updates = nil
+
+	n, err = mgr.DeadLetterControl("p0", DEAD_LETTER_OP_REPLAY, 0)
+	if err != nil || n != 2 ||
+		!reflect.DeepEqual(dest.updates, []string{"/bad/3"}) {
+		t.Errorf("expected replay to work, n: %d, err: %v, updates: %v",
+			n, err, dest.updates)
+	}
+
+	dls, _ := pindex.DeadLetters().List()
+	if len(dls) != 0 {
+		t.Errorf("expected no dead letters left, dls: %+v", dls)
+	}
+
+	for _, args := range []struct {
+		pindexName, op string
+		id             uint64
+	}{
+		{"p0", "unknown", 0},
+		{"p0", DEAD_LETTER_OP_PURGE, 1},
+		{"p1", DEAD_LETTER_OP_PURGE, 0},
+	} {
+		_, err = mgr.DeadLetterControl(args.pindexName, args.op, args.id)
+		if err == nil {
+			t.Errorf("expected err, args: %+v", args)
+		}
+	}
+
+	if mgr.stats.TotDeadLetterControl != 6 ||
+		mgr.stats.TotDeadLetterControlOk != 2 {
+		t.Errorf("unexpected stats: %+v", mgr.stats)
+	}
+}
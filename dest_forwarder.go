@@ -71,6 +71,19 @@ func (t *DestForwarder) DataDelete(partition string,
 		cas, extrasType, extras)
 }
 
+// DataBatch forwards a batch to the provided Dest, which receives the
+// batch's mutations one at a time unless it also implements
+// DestBatch.
+func (t *DestForwarder) DataBatch(partition string,
+	batch *DestBatchData) error {
+	dest, err := t.DestProvider.Dest(partition)
+	if err != nil {
+		return err
+	}
+
+	return AsDestBatch(dest).DataBatch(partition, batch)
+}
+
 func (t *DestForwarder) SnapshotStart(partition string,
 	snapStart, snapEnd uint64) error {
 	dest, err := t.DestProvider.Dest(partition)
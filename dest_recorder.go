@@ -0,0 +1,514 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// The ops of a DestRecord.
+const (
+	DEST_RECORD_OP_BEGIN    = byte('B') // Seq is the start, in unix nanosecs.
+	DEST_RECORD_OP_UPDATE   = byte('U')
+	DEST_RECORD_OP_DELETE   = byte('D')
+	DEST_RECORD_OP_SNAPSHOT = byte('S') // Seq is the snapStart.
+	DEST_RECORD_OP_OPAQUE   = byte('O')
+	DEST_RECORD_OP_ROLLBACK = byte('R') // Seq is the rollbackSeq.
+)
+
+// DEST_RECORD_MAX_FIELD_SIZE bounds the allocations of a
+// DestRecordReader on a corrupted recording.
+const DEST_RECORD_MAX_FIELD_SIZE = 256 * 1024 * 1024
+
+// DestRecord represents a recorded Dest method call.
+type DestRecord struct {
+	Op         byte // See DEST_RECORD_OP_XXX.
+	At         time.Duration
+	Partition  string
+	Key        []byte
+	Val        []byte // Also the value of an OpaqueSet.
+	Seq        uint64
+	SnapEnd    uint64
+	Cas        uint64
+	ExtrasType DestExtrasType
+	Extras     []byte
+}
+
+// A DestRecorder implements the Dest, DestEx and DestBatch
+// interfaces by forwarding method calls to another Dest, after
+// recording the calls that change the Dest into a DestRecordWriter.
+// The recording can be played back by the "replay" source type.
+//
+// The DestEx method calls are recorded as their Dest equivalents,
+// with DEST_EXTRAS_TYPE_DCP extras, so a recording doesn't hold the
+// whole requests of a DCP feed, and a DataBatch is recorded as its
+// DataUpdate and DataDelete calls.
+type DestRecorder struct {
+	Dest      Dest
+	Recording *DestRecordWriter
+}
+
+func (t *DestRecorder) Close() error {
+	return t.Dest.Close()
+}
+
+func (t *DestRecorder) DataUpdate(partition string,
+	key []byte, seq uint64, val []byte,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	err := t.Recording.Write(&DestRecord{
+		Op:         DEST_RECORD_OP_UPDATE,
+		Partition:  partition,
+		Key:        key,
+		Val:        val,
+		Seq:        seq,
+		Cas:        cas,
+		ExtrasType: extrasType,
+		Extras:     extras,
+	})
+	if err != nil {
+		return err
+	}
+
+	return t.Dest.DataUpdate(partition, key, seq, val,
+		cas, extrasType, extras)
+}
+
+func (t *DestRecorder) DataDelete(partition string,
+	key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	err := t.Recording.Write(&DestRecord{
+		Op:         DEST_RECORD_OP_DELETE,
+		Partition:  partition,
+		Key:        key,
+		Seq:        seq,
+		Cas:        cas,
+		ExtrasType: extrasType,
+		Extras:     extras,
+	})
+	if err != nil {
+		return err
+	}
+
+	return t.Dest.DataDelete(partition, key, seq,
+		cas, extrasType, extras)
+}
+
+func (t *DestRecorder) SnapshotStart(partition string,
+	snapStart, snapEnd uint64) error {
+	err := t.Recording.Write(&DestRecord{
+		Op:        DEST_RECORD_OP_SNAPSHOT,
+		Partition: partition,
+		Seq:       snapStart,
+		SnapEnd:   snapEnd,
+	})
+	if err != nil {
+		return err
+	}
+
+	return t.Dest.SnapshotStart(partition, snapStart, snapEnd)
+}
+
+func (t *DestRecorder) OpaqueGet(partition string) (
+	value []byte, lastSeq uint64, err error) {
+	return t.Dest.OpaqueGet(partition)
+}
+
+func (t *DestRecorder) OpaqueSet(partition string, value []byte) error {
+	err := t.Recording.Write(&DestRecord{
+		Op:        DEST_RECORD_OP_OPAQUE,
+		Partition: partition,
+		Val:       value,
+	})
+	if err != nil {
+		return err
+	}
+
+	return t.Dest.OpaqueSet(partition, value)
+}
+
+func (t *DestRecorder) Rollback(partition string, rollbackSeq uint64) error {
+	err := t.Recording.Write(&DestRecord{
+		Op:        DEST_RECORD_OP_ROLLBACK,
+		Partition: partition,
+		Seq:       rollbackSeq,
+	})
+	if err != nil {
+		return err
+	}
+
+	return t.Dest.Rollback(partition, rollbackSeq)
+}
+
+func (t *DestRecorder) DataUpdateEx(partition string,
+	key []byte, seq uint64, val []byte,
+	cas uint64,
+	extrasType DestExtrasType, req interface{}) error {
+	err := t.Recording.Write(&DestRecord{
+		Op:         DEST_RECORD_OP_UPDATE,
+		Partition:  partition,
+		Key:        key,
+		Val:        val,
+		Seq:        seq,
+		Cas:        cas,
+		ExtrasType: DEST_EXTRAS_TYPE_DCP,
+		Extras:     destReqExtras(req),
+	})
+	if err != nil {
+		return err
+	}
+
+	if destEx, ok := t.Dest.(DestEx); ok {
+		return destEx.DataUpdateEx(partition, key, seq, val,
+			cas, extrasType, req)
+	}
+	return t.Dest.DataUpdate(partition, key, seq, val,
+		cas, DEST_EXTRAS_TYPE_DCP, destReqExtras(req))
+}
+
+func (t *DestRecorder) DataDeleteEx(partition string,
+	key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, req interface{}) error {
+	err := t.Recording.Write(&DestRecord{
+		Op:         DEST_RECORD_OP_DELETE,
+		Partition:  partition,
+		Key:        key,
+		Seq:        seq,
+		Cas:        cas,
+		ExtrasType: DEST_EXTRAS_TYPE_DCP,
+		Extras:     destReqExtras(req),
+	})
+	if err != nil {
+		return err
+	}
+
+	if destEx, ok := t.Dest.(DestEx); ok {
+		return destEx.DataDeleteEx(partition, key, seq,
+			cas, extrasType, req)
+	}
+	return t.Dest.DataDelete(partition, key, seq,
+		cas, DEST_EXTRAS_TYPE_DCP, destReqExtras(req))
+}
+
+func (t *DestRecorder) RollbackEx(partition string, partitionUUID uint64,
+	rollbackSeq uint64) error {
+	err := t.Recording.Write(&DestRecord{
+		Op:        DEST_RECORD_OP_ROLLBACK,
+		Partition: partition,
+		Seq:       rollbackSeq,
+	})
+	if err != nil {
+		return err
+	}
+
+	if destEx, ok := t.Dest.(DestEx); ok {
+		return destEx.RollbackEx(partition, partitionUUID, rollbackSeq)
+	}
+	return t.Dest.Rollback(partition, rollbackSeq)
+}
+
+func (t *DestRecorder) DataBatch(partition string,
+	batch *DestBatchData) error {
+	for i, seq := range batch.Seqs {
+		op, val := DEST_RECORD_OP_UPDATE, batch.Vals[i]
+		if batch.Deletes[i] {
+			op, val = DEST_RECORD_OP_DELETE, nil
+		}
+
+		err := t.Recording.Write(&DestRecord{
+			Op:         op,
+			Partition:  partition,
+			Key:        batch.Keys[i],
+			Val:        val,
+			Seq:        seq,
+			Cas:        batch.Cas[i],
+			ExtrasType: batch.ExtrasType,
+			Extras:     batch.Extras[i],
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return AsDestBatch(t.Dest).DataBatch(partition, batch)
+}
+
+// destReqExtras returns the extras of the request of a DestEx method
+// call, for the equivalent Dest method call.
+func destReqExtras(req interface{}) []byte {
+	if mcr, ok := req.(*gomemcached.MCRequest); ok && mcr != nil {
+		return mcr.Extras
+	}
+	return nil
+}
+
+func (t *DestRecorder) ConsistencyWait(partition, partitionUUID string,
+	consistencyLevel string,
+	consistencySeq uint64,
+	cancelCh <-chan bool) error {
+	return t.Dest.ConsistencyWait(partition, partitionUUID,
+		consistencyLevel, consistencySeq, cancelCh)
+}
+
+func (t *DestRecorder) Count(pindex *PIndex, cancelCh <-chan bool) (
+	uint64, error) {
+	return t.Dest.Count(pindex, cancelCh)
+}
+
+func (t *DestRecorder) Query(pindex *PIndex, req []byte, res io.Writer,
+	cancelCh <-chan bool) error {
+	return t.Dest.Query(pindex, req, res, cancelCh)
+}
+
+func (t *DestRecorder) Stats(w io.Writer) error {
+	return t.Dest.Stats(w)
+}
+
+// -----------------------------------------------------
+
+// A DestRecordWriter encodes DestRecords into a compact binary
+// format, and is safe for concurrent use.  Each DestRecord is a
+// single Write() to the underlying io.Writer, so a crash loses at
+// most a partial last DestRecord.
+type DestRecordWriter struct {
+	m      sync.Mutex
+	w      io.Writer
+	start  time.Time
+	buf    []byte
+	closed bool
+}
+
+// NewDestRecordWriter starts a recording, which may be appended to
+// an earlier recording.
+func NewDestRecordWriter(w io.Writer) (*DestRecordWriter, error) {
+	rw := &DestRecordWriter{w: w, start: time.Now()}
+
+	err := rw.Write(&DestRecord{
+		Op:  DEST_RECORD_OP_BEGIN,
+		Seq: uint64(rw.start.UnixNano()),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rw, nil
+}
+
+func (rw *DestRecordWriter) Write(rec *DestRecord) error {
+	rw.m.Lock()
+	defer rw.m.Unlock()
+
+	if rw.closed {
+		return fmt.Errorf("dest_recorder: write after close")
+	}
+
+	at := time.Since(rw.start)
+
+	b := append(rw.buf[:0], rec.Op)
+	b = appendUvarint(b, uint64(at))
+	b = appendUvarintBytes(b, []byte(rec.Partition))
+	b = appendUvarintBytes(b, rec.Key)
+	b = appendUvarintBytes(b, rec.Val)
+	b = appendUvarint(b, rec.Seq)
+	b = appendUvarint(b, rec.SnapEnd)
+	b = appendUvarint(b, rec.Cas)
+	b = appendUvarint(b, uint64(rec.ExtrasType))
+	b = appendUvarintBytes(b, rec.Extras)
+	rw.buf = b
+
+	_, err := rw.w.Write(b)
+	if err != nil {
+		return fmt.Errorf("dest_recorder: write, err: %v", err)
+	}
+
+	return nil
+}
+
+// Close closes the underlying io.Writer if it's an io.Closer, and
+// may be invoked more than once.
+func (rw *DestRecordWriter) Close() error {
+	rw.m.Lock()
+	defer rw.m.Unlock()
+
+	if rw.closed {
+		return nil
+	}
+	rw.closed = true
+
+	if c, ok := rw.w.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(b, tmp[:binary.PutUvarint(tmp[:], v)]...)
+}
+
+func appendUvarintBytes(b []byte, v []byte) []byte {
+	return append(appendUvarint(b, uint64(len(v))), v...)
+}
+
+// -----------------------------------------------------
+
+// A DestRecordReader decodes the DestRecords of a recording.
+type DestRecordReader struct {
+	r *bufio.Reader
+}
+
+func NewDestRecordReader(r io.Reader) *DestRecordReader {
+	return &DestRecordReader{r: bufio.NewReader(r)}
+}
+
+// Read returns the next DestRecord, or io.EOF at the end of the
+// recording, or io.ErrUnexpectedEOF for a partial last DestRecord.
+func (rr *DestRecordReader) Read() (*DestRecord, error) {
+	op, err := rr.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch op {
+	case DEST_RECORD_OP_BEGIN, DEST_RECORD_OP_UPDATE,
+		DEST_RECORD_OP_DELETE, DEST_RECORD_OP_SNAPSHOT,
+		DEST_RECORD_OP_OPAQUE, DEST_RECORD_OP_ROLLBACK:
+	default:
+		return nil, fmt.Errorf("dest_recorder: unknown op: %d", op)
+	}
+
+	rec := &DestRecord{Op: op}
+
+	var extrasType uint64
+	var partition []byte
+
+	at, err := rr.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, b := range []*[]byte{&partition, &rec.Key, &rec.Val} {
+		*b, err = rr.readBytes()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, u := range []*uint64{&rec.Seq, &rec.SnapEnd, &rec.Cas, &extrasType} {
+		*u, err = rr.readUvarint()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rec.Extras, err = rr.readBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	rec.At = time.Duration(at)
+	rec.Partition = string(partition)
+	rec.ExtrasType = DestExtrasType(extrasType)
+
+	return rec, nil
+}
+
+func (rr *DestRecordReader) readUvarint() (uint64, error) {
+	v, err := binary.ReadUvarint(rr.r)
+	if err == io.EOF {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return v, err
+}
+
+func (rr *DestRecordReader) readBytes() ([]byte, error) {
+	n, err := rr.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	if n > DEST_RECORD_MAX_FIELD_SIZE {
+		return nil, fmt.Errorf("dest_recorder: field too large: %d", n)
+	}
+
+	b := make([]byte, n)
+
+	_, err = io.ReadFull(rr.r, b)
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return b, err
+}
+
+// -----------------------------------------------------
+
+// FeedRecordDirOption is the manager option of a directory where the
+// janitor records the Dest method calls of each feed, into a
+// "<feedName>.rec" file that's appended to on each feed restart.
+const FeedRecordDirOption = "feedRecordDir"
+
+// recordDests wraps dests with DestRecorders that share a recording
+// into a feed specific file in the dir.
+func recordDests(dir, feedName string, dests map[string]Dest) (
+	map[string]Dest, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, feedName+".rec"),
+		os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	rw, err := NewDestRecordWriter(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	rv := make(map[string]Dest, len(dests))
+	for partition, dest := range dests {
+		rv[partition] = &DestRecorder{Dest: dest, Recording: rw}
+	}
+
+	return rv, nil
+}
+
+// closeDestRecordings closes the recordings of any DestRecorders,
+// including those that are wrapped by DestPipelines.
+func closeDestRecordings(dests map[string]Dest) {
+	for _, dest := range dests {
+		dest = unwrapDestCoalesce(dest)
+		if dp, ok := dest.(*DestPipeline); ok {
+			dest = dp.Dest
+		}
+		if dr, ok := dest.(*DestRecorder); ok {
+			dr.Recording.Close()
+		}
+	}
+}
@@ -0,0 +1,146 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDestRecordRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+
+	rw, err := NewDestRecordWriter(&buf)
+	if err != nil {
+		t.Fatalf("expected NewDestRecordWriter to work, err: %v", err)
+	}
+
+	recs := []*DestRecord{
+		{Op: DEST_RECORD_OP_SNAPSHOT, Partition: "3", Seq: 10, SnapEnd: 20},
+		{Op: DEST_RECORD_OP_UPDATE, Partition: "3", Key: []byte("k"),
+			Val: []byte(`{"a":1}`), Seq: 11, Cas: 99,
+			ExtrasType: DEST_EXTRAS_TYPE_NIL, Extras: []byte("x")},
+		{Op: DEST_RECORD_OP_DELETE, Partition: "3", Key: []byte("k"), Seq: 12},
+		{Op: DEST_RECORD_OP_OPAQUE, Partition: "3", Val: []byte("o")},
+		{Op: DEST_RECORD_OP_ROLLBACK, Partition: "3", Seq: 5},
+	}
+	for _, rec := range recs {
+		err = rw.Write(rec)
+		if err != nil {
+			t.Fatalf("expected Write to work, err: %v", err)
+		}
+	}
+
+	data := buf.Bytes()
+
+	rr := NewDestRecordReader(bytes.NewReader(data))
+
+	rec, err := rr.Read()
+	if err != nil || rec.Op != DEST_RECORD_OP_BEGIN || rec.Seq == 0 {
+		t.Fatalf("expected a begin record, rec: %+v, err: %v", rec, err)
+	}
+
+	for i, exp := range recs {
+		rec, err = rr.Read()
+		if err != nil {
+			t.Fatalf("expected Read to work, i: %d, err: %v", i, err)
+		}
+		rec.At = 0
+		if !reflect.DeepEqual(rec, exp) {
+			t.Errorf("expected a round trip, i: %d, exp: %+v, got: %+v",
+				i, exp, rec)
+		}
+	}
+
+	_, err = rr.Read()
+	if err != io.EOF {
+		t.Errorf("expected EOF, err: %v", err)
+	}
+
+	// A partial last record is an unexpected EOF.
+	rr = NewDestRecordReader(bytes.NewReader(data[:len(data)-1]))
+	for err = nil; err == nil; {
+		_, err = rr.Read()
+	}
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected an unexpected EOF, err: %v", err)
+	}
+
+	_, err = NewDestRecordReader(bytes.NewReader([]byte("?"))).Read()
+	if err == nil {
+		t.Errorf("expected an err on an unknown op")
+	}
+}
+
+func TestDestRecorder(t *testing.T) {
+	testDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testDir)
+
+	dest := newHTTPFeedTestDest()
+
+	for i := 0; i < 2; i++ {
+		dests, err := recordDests(testDir, "f", map[string]Dest{"0": dest})
+		if err != nil {
+			t.Fatalf("expected recordDests to work, err: %v", err)
+		}
+
+		d := dests["0"]
+		d.SnapshotStart("0", 1, 2)
+		d.DataUpdate("0", []byte("a"), 1, []byte("{}"), 0, DEST_EXTRAS_TYPE_NIL, nil)
+		d.DataDelete("0", []byte("a"), 2, 0, DEST_EXTRAS_TYPE_NIL, nil)
+		d.OpaqueSet("0", []byte("o"))
+		d.(DestEx).RollbackEx("0", 123, 1)
+
+		closeDestRecordings(dests)
+		closeDestRecordings(dests)
+
+		err = d.DataUpdate("0", []byte("b"), 3, []byte("{}"), 0,
+			DEST_EXTRAS_TYPE_NIL, nil)
+		if err == nil {
+			t.Errorf("expected an err after the recording was closed")
+		}
+	}
+
+	if len(dest.updates) != 2 || len(dest.deletes) != 2 ||
+		len(dest.snapshots) != 2 || string(dest.opaques["0"]) != "o" {
+		t.Errorf("expected calls to be forwarded, dest: %+v", dest)
+	}
+
+	f, err := os.Open(filepath.Join(testDir, "f.rec"))
+	if err != nil {
+		t.Fatalf("expected a recording, err: %v", err)
+	}
+	defer f.Close()
+
+	var ops []byte
+	rr := NewDestRecordReader(f)
+	for {
+		rec, err := rr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("expected Read to work, err: %v", err)
+		}
+		ops = append(ops, rec.Op)
+	}
+
+	// The restarted recording is appended.
+	if string(ops) != "BSUDORBSUDOR" {
+		t.Errorf("unexpected recorded ops: %s", ops)
+	}
+}
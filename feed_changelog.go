@@ -0,0 +1,830 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/couchbase/clog"
+)
+
+const SOURCE_CHANGELOG = "changelog"
+
+const CHANGELOG_FEED_SLEEP_START_MS = 100
+const CHANGELOG_FEED_BACKOFF_FACTOR = 1.5
+const CHANGELOG_FEED_MAX_SLEEP_MS = 1000
+
+// CHANGELOG_FEED_OFFSET_BITS is the number of low bits of a
+// changelog seq that hold a byte offset, with the segment number in
+// the high bits.
+const CHANGELOG_FEED_OFFSET_BITS = 40
+
+// The ops of a ChangelogRecord.
+const (
+	CHANGELOG_FEED_OP_UPSERT = "upsert"
+	CHANGELOG_FEED_OP_DELETE = "delete"
+)
+
+// changelogFeedTailSize is the number of bytes before an offset that
+// are checksummed to detect a truncated or rewritten segment.
+const changelogFeedTailSize = 64
+
+func init() {
+	RegisterFeedType(SOURCE_CHANGELOG, &FeedType{
+		Start:      StartChangelogFeed,
+		Partitions: PrimaryFeedPartitions,
+		// Keys are hashed to partitions like the "http" source type.
+		PartitionLookUp: HTTPFeedPartitionLookUp,
+		Public:          true,
+		Description: "general/changelog" +
+			" - append-only changelog segment files under a dataDir" +
+			" subdirectory will be tailed as the data source",
+		StartSample: &ChangelogFeedParams{
+			NumPartitions: 16,
+			SegmentSuffix: ".log",
+			SleepStartMS:  CHANGELOG_FEED_SLEEP_START_MS,
+			BackoffFactor: CHANGELOG_FEED_BACKOFF_FACTOR,
+			MaxSleepMS:    CHANGELOG_FEED_MAX_SLEEP_MS,
+		},
+	})
+}
+
+// ChangelogFeed is a Feed interface implementation that tails a
+// directory of append-only changelog segment files...
+//
+//    <dataDir>/changelog/<sourceName>/<segmentNumber><segmentSuffix>
+//
+// Segments are read in the order of their segment numbers, and each
+// segment is a sequence of JSON lines of ChangelogRecords, whose keys
+// are hashed into source partitions.  The seq of a record is its
+// segment number and the byte offset of the end of its line (see
+// ChangelogFeedSeq), so seqs increase across segments, and a
+// snapshot never spans segments.
+//
+// The position of each partition is persisted via the Dest's
+// OpaqueSet() along with a checksum of the bytes before it, so a
+// restarted ChangelogFeed resumes from OpaqueGet().  When a segment
+// turns out to have been truncated or rewritten, the partitions that
+// are past its start are rolled back via the Dest's Rollback() and
+// then resume from their rolled back positions.
+//
+// Limitations: only the segment that's being tailed (and, on
+// restart, the segments of the resume positions) are checked for
+// rewrites.  A removed segment is skipped, as with retention.
+type ChangelogFeed struct {
+	mgr        *Manager
+	name       string
+	indexName  string
+	sourceName string
+	params     *ChangelogFeedParams
+	dests      map[string]Dest
+	disable    bool
+
+	m       sync.Mutex
+	closeCh chan struct{}
+
+	stats ChangelogFeedStats
+
+	// The following are only accessed by the feed's goroutine.
+	dir    string
+	parts  map[string]*changelogFeedPartition
+	reader *changelogFeedReader
+}
+
+// ChangelogFeedParams represents the JSON expected as the
+// sourceParams for a ChangelogFeed.
+type ChangelogFeedParams struct {
+	NumPartitions int     `json:"numPartitions"`
+	SegmentSuffix string  `json:"segmentSuffix"`
+	SleepStartMS  int     `json:"sleepStartMS"`
+	BackoffFactor float32 `json:"backoffFactor"`
+	MaxSleepMS    int     `json:"maxSleepMS"`
+}
+
+// ChangelogFeedStats holds the counters of a ChangelogFeed.
+type ChangelogFeedStats struct {
+	TotSegment    uint64 // Segments that were completely read.
+	TotDataUpdate uint64
+	TotDataDelete uint64
+	TotParseErr   uint64
+	TotRollback   uint64
+}
+
+// ChangelogRecord represents a JSON line of a changelog segment.
+type ChangelogRecord struct {
+	Op    string          `json:"op"` // See CHANGELOG_FEED_OP_XXX.
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// changelogFeedOpaque is the JSON persisted with the Dest's
+// OpaqueSet().
+type changelogFeedOpaque struct {
+	Seq     uint64 `json:"seq"`
+	TailCRC uint32 `json:"tailCRC"`
+}
+
+type changelogFeedPartition struct {
+	dest Dest
+	seq  uint64 // The position of the partition.
+}
+
+// changelogFeedReader is the position of the tailing.
+type changelogFeedReader struct {
+	segment uint64
+	path    string
+	offset  int64
+	tailCRC uint32
+}
+
+// changelogFeedSegment is a segment file.
+type changelogFeedSegment struct {
+	num  uint64
+	path string
+}
+
+// ChangelogFeedSeq returns the seq of a segment number and offset.
+func ChangelogFeedSeq(segment uint64, offset int64) uint64 {
+	return segment<<CHANGELOG_FEED_OFFSET_BITS | uint64(offset)
+}
+
+// ChangelogFeedSeqSplit returns the segment number and offset of a
+// seq.
+func ChangelogFeedSeqSplit(seq uint64) (uint64, int64) {
+	return seq >> CHANGELOG_FEED_OFFSET_BITS,
+		int64(seq & (1<<CHANGELOG_FEED_OFFSET_BITS - 1))
+}
+
+// StartChangelogFeed starts a ChangelogFeed and is the callback
+// function registered at init/startup time.
+func StartChangelogFeed(mgr *Manager, feedName, indexName, indexUUID,
+	sourceType, sourceName, sourceUUID, params string,
+	dests map[string]Dest) error {
+	feed, err := NewChangelogFeed(mgr, feedName, indexName, sourceName,
+		params, dests, mgr.tagsMap != nil && !mgr.tagsMap["feed"])
+	if err != nil {
+		return fmt.Errorf("feed_changelog: NewChangelogFeed,"+
+			" feedName: %s, err: %v", feedName, err)
+	}
+	err = feed.Start()
+	if err != nil {
+		return fmt.Errorf("feed_changelog: could not start,"+
+			" feedName: %s, err: %v", feedName, err)
+	}
+	err = mgr.registerFeed(feed)
+	if err != nil {
+		feed.Close()
+		return err
+	}
+	return nil
+}
+
+// NewChangelogFeed creates a ready-to-be-started ChangelogFeed.
+func NewChangelogFeed(mgr *Manager, name, indexName, sourceName,
+	paramsStr string, dests map[string]Dest, disable bool) (
+	*ChangelogFeed, error) {
+	if sourceName == "" {
+		return nil, fmt.Errorf("feed_changelog: missing source name")
+	}
+
+	if strings.Index(sourceName, "..") >= 0 {
+		return nil, fmt.Errorf("feed_changelog: disallowed source name,"+
+			" name: %s, sourceName: %q", name, sourceName)
+	}
+
+	params := &ChangelogFeedParams{}
+	if paramsStr != "" {
+		err := json.Unmarshal([]byte(paramsStr), params)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if params.SegmentSuffix == "" {
+		params.SegmentSuffix = ".log"
+	}
+
+	return &ChangelogFeed{
+		mgr:        mgr,
+		name:       name,
+		indexName:  indexName,
+		sourceName: sourceName,
+		params:     params,
+		dests:      dests,
+		disable:    disable,
+		closeCh:    make(chan struct{}),
+	}, nil
+}
+
+func (t *ChangelogFeed) Name() string {
+	return t.name
+}
+
+func (t *ChangelogFeed) IndexName() string {
+	return t.indexName
+}
+
+func (t *ChangelogFeed) Start() error {
+	if t.disable {
+		log.Printf("feed_changelog: disable, name: %s", t.Name())
+		return nil
+	}
+
+	t.m.Lock()
+	closeCh := t.closeCh
+	t.m.Unlock()
+
+	if closeCh == nil {
+		return nil // Closed.
+	}
+
+	t.dir = t.mgr.DataDir() +
+		string(os.PathSeparator) + SOURCE_CHANGELOG +
+		string(os.PathSeparator) + t.sourceName
+
+	startSleepMS := t.params.SleepStartMS
+	if startSleepMS <= 0 {
+		startSleepMS = CHANGELOG_FEED_SLEEP_START_MS
+	}
+
+	backoffFactor := t.params.BackoffFactor
+	if backoffFactor <= 0 {
+		backoffFactor = CHANGELOG_FEED_BACKOFF_FACTOR
+	}
+
+	maxSleepMS := t.params.MaxSleepMS
+	if maxSleepMS <= 0 {
+		maxSleepMS = CHANGELOG_FEED_MAX_SLEEP_MS
+	}
+
+	go func() {
+		err := t.loadPartitions()
+		if err != nil {
+			log.Warnf("feed_changelog: name: %s, err: %v", t.Name(), err)
+			return
+		}
+
+		ExponentialBackoffLoop(t.Name(),
+			func() int {
+				select {
+				case <-closeCh:
+					return -1
+				default:
+				}
+
+				progress, err := t.poll()
+				if err != nil {
+					log.Warnf("feed_changelog: name: %s, err: %v",
+						t.Name(), err)
+					return -1
+				}
+				if progress {
+					return 1
+				}
+				return 0
+			},
+			startSleepMS,
+			backoffFactor,
+			maxSleepMS)
+	}()
+
+	return nil
+}
+
+func (t *ChangelogFeed) Close() error {
+	t.m.Lock()
+	if t.closeCh != nil {
+		close(t.closeCh)
+		t.closeCh = nil
+	}
+	t.m.Unlock()
+
+	return nil
+}
+
+func (t *ChangelogFeed) Dests() map[string]Dest {
+	return t.dests
+}
+
+func (t *ChangelogFeed) Stats(w io.Writer) error {
+	_, err := fmt.Fprintf(w, `{"TotSegment":%d,"TotDataUpdate":%d,`+
+		`"TotDataDelete":%d,"TotParseErr":%d,"TotRollback":%d}`,
+		atomic.LoadUint64(&t.stats.TotSegment),
+		atomic.LoadUint64(&t.stats.TotDataUpdate),
+		atomic.LoadUint64(&t.stats.TotDataDelete),
+		atomic.LoadUint64(&t.stats.TotParseErr),
+		atomic.LoadUint64(&t.stats.TotRollback))
+	return err
+}
+
+// -----------------------------------------------------
+
+// loadPartitions restores the positions of the partitions from their
+// dests, rolling back the partitions whose positions are in segments
+// that were truncated or rewritten.
+func (t *ChangelogFeed) loadPartitions() error {
+	t.parts = map[string]*changelogFeedPartition{}
+
+	segments, err := t.segments()
+	if err != nil {
+		return err
+	}
+
+	for partition, dest := range t.dests {
+		p := &changelogFeedPartition{dest: dest}
+		t.parts[partition] = p
+
+		opaque, err := t.opaqueGet(partition, dest)
+		if err != nil {
+			return err
+		}
+
+		p.seq = opaque.Seq
+
+		rollbackSeq, ok := t.checkSeq(segments, opaque)
+		if !ok {
+			err = t.rollbackPartition(partition, p, rollbackSeq)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (t *ChangelogFeed) opaqueGet(partition string, dest Dest) (
+	*changelogFeedOpaque, error) {
+	value, lastSeq, err := dest.OpaqueGet(partition)
+	if err != nil {
+		return nil, fmt.Errorf("feed_changelog: OpaqueGet,"+
+			" partition: %s, err: %v", partition, err)
+	}
+
+	opaque := &changelogFeedOpaque{}
+	if len(value) > 0 {
+		err = json.Unmarshal(value, opaque)
+		if err != nil {
+			return nil, fmt.Errorf("feed_changelog: could not parse"+
+				" opaque, partition: %s, value: %s, err: %v",
+				partition, value, err)
+		}
+	}
+
+	if opaque.Seq < lastSeq {
+		opaque.Seq = lastSeq
+		opaque.TailCRC = 0 // Unknown, so it isn't checked.
+	}
+
+	return opaque, nil
+}
+
+// checkSeq returns false, along with the seq to rollback to, when
+// the segment of a persisted position was truncated or rewritten.
+func (t *ChangelogFeed) checkSeq(segments []*changelogFeedSegment,
+	opaque *changelogFeedOpaque) (uint64, bool) {
+	segment, offset := ChangelogFeedSeqSplit(opaque.Seq)
+	if offset <= 0 {
+		return 0, true
+	}
+
+	for _, s := range segments {
+		if s.num < segment {
+			continue
+		}
+
+		if s.num > segment {
+			return 0, true // The segment was removed, as with retention.
+		}
+
+		fi, err := os.Stat(s.path)
+		if err != nil || fi.Size() < offset {
+			return ChangelogFeedSeq(segment, 0), false
+		}
+
+		if opaque.TailCRC != 0 {
+			tailCRC, err := changelogFeedTailCRC(s.path, offset)
+			if err != nil || tailCRC != opaque.TailCRC {
+				return ChangelogFeedSeq(segment, 0), false
+			}
+		}
+
+		return 0, true
+	}
+
+	// The changelog was reset to earlier segments.
+	return 0, false
+}
+
+// rollback rolls back the partitions that are past the rollbackSeq,
+// and restarts the tailing from the earliest position.
+func (t *ChangelogFeed) rollback(rollbackSeq uint64) error {
+	for partition, p := range t.parts {
+		if p.seq > rollbackSeq {
+			err := t.rollbackPartition(partition, p, rollbackSeq)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	t.reader = nil
+
+	return nil
+}
+
+func (t *ChangelogFeed) rollbackPartition(partition string,
+	p *changelogFeedPartition, rollbackSeq uint64) error {
+	log.Printf("feed_changelog: rollback, name: %s, partition: %s,"+
+		" seq: %d, rollbackSeq: %d", t.Name(), partition, p.seq, rollbackSeq)
+
+	atomic.AddUint64(&t.stats.TotRollback, 1)
+
+	err := p.dest.Rollback(partition, rollbackSeq)
+	if err != nil {
+		return fmt.Errorf("feed_changelog: Rollback,"+
+			" partition: %s, err: %v", partition, err)
+	}
+
+	// The dest may have rolled back even further.
+	opaque, err := t.opaqueGet(partition, p.dest)
+	if err != nil {
+		return err
+	}
+
+	p.seq = opaque.Seq
+	if p.seq > rollbackSeq {
+		p.seq = rollbackSeq
+	}
+
+	return nil
+}
+
+// segments returns the segment files, sorted by segment number.
+func (t *ChangelogFeed) segments() ([]*changelogFeedSegment, error) {
+	fis, err := ioutil.ReadDir(t.dir)
+	if err != nil {
+		return nil, fmt.Errorf("feed_changelog: could not read dir,"+
+			" dir: %s, err: %v", t.dir, err)
+	}
+
+	var segments []*changelogFeedSegment
+
+	for _, fi := range fis {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasSuffix(name, t.params.SegmentSuffix) {
+			continue
+		}
+
+		num, err := strconv.ParseUint(
+			strings.TrimSuffix(name, t.params.SegmentSuffix), 10, 64)
+		if err != nil || num >= 1<<(64-CHANGELOG_FEED_OFFSET_BITS) {
+			continue
+		}
+
+		segments = append(segments, &changelogFeedSegment{
+			num:  num,
+			path: t.dir + string(os.PathSeparator) + name,
+		})
+	}
+
+	sort.Sort(changelogFeedSegments(segments))
+
+	return segments, nil
+}
+
+type changelogFeedSegments []*changelogFeedSegment
+
+func (a changelogFeedSegments) Len() int           { return len(a) }
+func (a changelogFeedSegments) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a changelogFeedSegments) Less(i, j int) bool { return a[i].num < a[j].num }
+
+// seek positions the reader at the earliest position of the
+// partitions.
+func (t *ChangelogFeed) seek(segments []*changelogFeedSegment) error {
+	var seq uint64
+	first := true
+	for _, p := range t.parts {
+		if first || p.seq < seq {
+			seq, first = p.seq, false
+		}
+	}
+
+	segment, offset := ChangelogFeedSeqSplit(seq)
+
+	for _, s := range segments {
+		if s.num < segment {
+			continue
+		}
+
+		if s.num > segment {
+			offset = 0 // The segment was removed.
+		}
+
+		t.reader = &changelogFeedReader{
+			segment: s.num,
+			path:    s.path,
+			offset:  offset,
+		}
+
+		if offset > 0 {
+			tailCRC, err := changelogFeedTailCRC(s.path, offset)
+			if err != nil {
+				return err
+			}
+			t.reader.tailCRC = tailCRC
+		}
+
+		return nil
+	}
+
+	return nil
+}
+
+// poll emits the complete records that were appended to the segment
+// that's being tailed, or moves on to the next segment, and returns
+// true on progress.
+func (t *ChangelogFeed) poll() (bool, error) {
+	segments, err := t.segments()
+	if err != nil {
+		return false, err
+	}
+
+	if t.reader == nil {
+		err = t.seek(segments)
+		if err != nil || t.reader == nil {
+			return false, err
+		}
+	}
+
+	r := t.reader
+
+	var next *changelogFeedSegment
+	for _, s := range segments {
+		if s.num > r.segment {
+			next = s
+			break
+		}
+	}
+
+	fi, err := os.Stat(r.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return false, err
+		}
+		if next == nil {
+			// The changelog was reset to earlier segments.
+			return true, t.rollback(0)
+		}
+		t.reader = &changelogFeedReader{segment: next.num, path: next.path}
+		return true, nil
+	}
+
+	if fi.Size() < r.offset {
+		return true, t.rollback(ChangelogFeedSeq(r.segment, 0))
+	}
+
+	if r.offset > 0 {
+		tailCRC, err := changelogFeedTailCRC(r.path, r.offset)
+		if err != nil {
+			return false, err
+		}
+		if tailCRC != r.tailCRC {
+			return true, t.rollback(ChangelogFeedSeq(r.segment, 0))
+		}
+	}
+
+	data, err := changelogFeedRead(r.path, r.offset)
+	if err != nil {
+		return false, err
+	}
+
+	end := bytes.LastIndexByte(data, '\n') + 1
+	if end > 0 {
+		err = t.emit(r, data[:end])
+		if err != nil {
+			return false, err
+		}
+
+		r.offset += int64(end)
+
+		r.tailCRC, err = changelogFeedTailCRC(r.path, r.offset)
+		if err != nil {
+			return false, err
+		}
+
+		return true, nil
+	}
+
+	if next == nil {
+		return false, nil
+	}
+
+	// The segment is complete, so move on to the next segment.
+	if len(data) > 0 {
+		log.Warnf("feed_changelog: incomplete last record,"+
+			" name: %s, path: %s, offset: %d", t.Name(), r.path, r.offset)
+	}
+
+	err = t.checkpoint(r)
+	if err != nil {
+		return false, err
+	}
+
+	atomic.AddUint64(&t.stats.TotSegment, 1)
+
+	t.reader = &changelogFeedReader{segment: next.num, path: next.path}
+
+	return true, nil
+}
+
+// emit sends the records of the data, which starts at the reader's
+// offset, to the dests of their partitions, as a snapshot per
+// partition.
+func (t *ChangelogFeed) emit(r *changelogFeedReader, data []byte) error {
+	type mutation struct {
+		seq uint64
+		rec *ChangelogRecord
+	}
+
+	mutations := map[string][]*mutation{}
+
+	offset := r.offset
+
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		line := data[:i]
+		data = data[i+1:]
+		offset += int64(i + 1)
+
+		line = bytes.TrimSpace(line)
+		if len(line) <= 0 {
+			continue
+		}
+
+		seq := ChangelogFeedSeq(r.segment, offset)
+
+		rec := &ChangelogRecord{}
+		err := json.Unmarshal(line, rec)
+		if err != nil || rec.Key == "" ||
+			(rec.Op == CHANGELOG_FEED_OP_UPSERT && len(rec.Value) <= 0) ||
+			(rec.Op != CHANGELOG_FEED_OP_UPSERT &&
+				rec.Op != CHANGELOG_FEED_OP_DELETE) {
+			atomic.AddUint64(&t.stats.TotParseErr, 1)
+			log.Warnf("feed_changelog: invalid record, name: %s,"+
+				" path: %s, seq: %d, err: %v", t.Name(), r.path, seq, err)
+			continue
+		}
+
+		partition := HTTPFeedPartition([]byte(rec.Key), t.params.NumPartitions)
+
+		p := t.parts[partition]
+		if p == nil || seq <= p.seq {
+			continue
+		}
+
+		mutations[partition] = append(mutations[partition],
+			&mutation{seq: seq, rec: rec})
+	}
+
+	for partition, ms := range mutations {
+		p := t.parts[partition]
+
+		err := p.dest.SnapshotStart(partition, ms[0].seq, ms[len(ms)-1].seq)
+		if err != nil {
+			return fmt.Errorf("feed_changelog: SnapshotStart,"+
+				" partition: %s, err: %v", partition, err)
+		}
+
+		for _, m := range ms {
+			key := []byte(m.rec.Key)
+
+			if m.rec.Op == CHANGELOG_FEED_OP_DELETE {
+				err = p.dest.DataDelete(partition, key, m.seq,
+					0, DEST_EXTRAS_TYPE_NIL, nil)
+				atomic.AddUint64(&t.stats.TotDataDelete, 1)
+			} else {
+				err = p.dest.DataUpdate(partition, key, m.seq,
+					m.rec.Value, 0, DEST_EXTRAS_TYPE_NIL, nil)
+				atomic.AddUint64(&t.stats.TotDataUpdate, 1)
+			}
+			if err != nil {
+				return fmt.Errorf("feed_changelog: mutation,"+
+					" partition: %s, seq: %d, err: %v", partition, m.seq, err)
+			}
+
+			p.seq = m.seq
+		}
+
+		err = t.opaqueSet(partition, p, r.path)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkpoint moves the partitions that are behind the end of the
+// reader's completed segment up to its end, so that a restart
+// doesn't re-read the segment for partitions that had no records.
+func (t *ChangelogFeed) checkpoint(r *changelogFeedReader) error {
+	seq := ChangelogFeedSeq(r.segment, r.offset)
+
+	for partition, p := range t.parts {
+		if p.seq < seq {
+			p.seq = seq
+
+			err := t.opaqueSet(partition, p, r.path)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (t *ChangelogFeed) opaqueSet(partition string,
+	p *changelogFeedPartition, path string) error {
+	_, offset := ChangelogFeedSeqSplit(p.seq)
+
+	tailCRC, err := changelogFeedTailCRC(path, offset)
+	if err != nil {
+		return err
+	}
+
+	buf, _ := json.Marshal(changelogFeedOpaque{Seq: p.seq, TailCRC: tailCRC})
+
+	err = p.dest.OpaqueSet(partition, buf)
+	if err != nil {
+		return fmt.Errorf("feed_changelog: OpaqueSet,"+
+			" partition: %s, err: %v", partition, err)
+	}
+
+	return nil
+}
+
+// changelogFeedRead returns the bytes of a file after an offset.
+func changelogFeedRead(path string, offset int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(f)
+}
+
+// changelogFeedTailCRC returns the checksum of the bytes of a file
+// before an offset, which is 0 for an offset of 0.
+func changelogFeedTailCRC(path string, offset int64) (uint32, error) {
+	if offset <= 0 {
+		return 0, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	n := int64(changelogFeedTailSize)
+	if n > offset {
+		n = offset
+	}
+
+	buf := make([]byte, n)
+
+	_, err = f.ReadAt(buf, offset-n)
+	if err != nil {
+		return 0, err
+	}
+
+	return crc32.ChecksumIEEE(buf), nil
+}
@@ -0,0 +1,189 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// changelogFeedTestDest is a httpFeedTestDest whose rollbacks clear
+// its opaque values, as if it rolled back to zero.
+type changelogFeedTestDest struct {
+	*httpFeedTestDest
+
+	rollbacks []string // Entries of "partition/rollbackSeq".
+}
+
+func (d *changelogFeedTestDest) Rollback(partition string,
+	rollbackSeq uint64) error {
+	d.rollbacks = append(d.rollbacks, fmt.Sprintf("%s/%d", partition, rollbackSeq))
+	delete(d.opaques, partition)
+	return nil
+}
+
+func TestChangelogFeedSeq(t *testing.T) {
+	seq := ChangelogFeedSeq(3, 1234)
+	segment, offset := ChangelogFeedSeqSplit(seq)
+	if segment != 3 || offset != 1234 {
+		t.Errorf("expected a round trip, segment: %d, offset: %d",
+			segment, offset)
+	}
+	if ChangelogFeedSeq(2, 1<<30) >= ChangelogFeedSeq(3, 0) {
+		t.Errorf("expected seqs to increase across segments")
+	}
+}
+
+func TestChangelogFeed(t *testing.T) {
+	testDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testDir)
+
+	mgr := NewManager(VERSION, NewCfgMem(), NewUUID(), nil,
+		"", 1, "", ":1000", testDir, "some-datasource", nil)
+
+	dir := filepath.Join(testDir, SOURCE_CHANGELOG, "src")
+	os.MkdirAll(dir, 0700)
+
+	segPath := func(n int) string {
+		return filepath.Join(dir, fmt.Sprintf("%08d.log", n))
+	}
+
+	appendSeg := func(n int, s string) {
+		f, _ := os.OpenFile(segPath(n), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		f.Write([]byte(s))
+		f.Close()
+	}
+
+	dest := &changelogFeedTestDest{httpFeedTestDest: newHTTPFeedTestDest()}
+	dests := map[string]Dest{"0": dest, "1": dest}
+
+	// start returns a feed whose polls are driven by the test.
+	start := func() *ChangelogFeed {
+		feed, err := NewChangelogFeed(mgr, "f", "idx", "src",
+			`{"numPartitions":2}`, dests, false)
+		if err != nil {
+			t.Fatalf("expected NewChangelogFeed to work, err: %v", err)
+		}
+		feed.dir = dir
+		err = feed.loadPartitions()
+		if err != nil {
+			t.Fatalf("expected loadPartitions to work, err: %v", err)
+		}
+		return feed
+	}
+
+	pollAll := func(feed *ChangelogFeed) {
+		for i := 0; i < 100; i++ {
+			progress, err := feed.poll()
+			if err != nil {
+				t.Fatalf("expected poll to work, err: %v", err)
+			}
+			if !progress {
+				return
+			}
+		}
+		t.Fatalf("expected polls to settle")
+	}
+
+	recA := `{"op":"upsert","key":"a","value":{"v":1}}` + "\n"
+	recB := `{"op":"upsert","key":"b","value":{"v":2}}` + "\n"
+	delA := `{"op":"delete","key":"a"}` + "\n"
+
+	appendSeg(1, recA+recB+"not json\n"+delA)
+
+	feed := start()
+	pollAll(feed)
+
+	pa := HTTPFeedPartition([]byte("a"), 2)
+	pb := HTTPFeedPartition([]byte("b"), 2)
+
+	seqA := ChangelogFeedSeq(1, int64(len(recA)))
+	seqB := ChangelogFeedSeq(1, int64(len(recA+recB)))
+	seqDelA := ChangelogFeedSeq(1, int64(len(recA+recB+"not json\n"+delA)))
+
+	updates := StringsToMap(dest.updates)
+	if len(dest.updates) != 2 ||
+		!updates[fmt.Sprintf("%s/a/%d", pa, seqA)] ||
+		!updates[fmt.Sprintf("%s/b/%d", pb, seqB)] ||
+		len(dest.deletes) != 1 ||
+		dest.deletes[0] != fmt.Sprintf("%s/a/%d", pa, seqDelA) {
+		t.Errorf("unexpected mutations, updates: %v, deletes: %v",
+			dest.updates, dest.deletes)
+	}
+	if feed.stats.TotParseErr != 1 {
+		t.Errorf("expected a parse err, stats: %+v", feed.stats)
+	}
+
+	// An incomplete record is left until it's completed.
+	appendSeg(1, `{"op":"upsert","key":"c",`)
+	pollAll(feed)
+	if len(dest.updates) != 2 {
+		t.Errorf("expected no update for an incomplete record")
+	}
+	appendSeg(1, `"value":{}}`+"\n")
+	pollAll(feed)
+	if len(dest.updates) != 3 {
+		t.Errorf("expected an update for the completed record")
+	}
+
+	// The next segment gets its own snapshots.
+	dest.snapshots = nil
+	appendSeg(2, `{"op":"upsert","key":"d","value":{}}`+"\n")
+	pollAll(feed)
+
+	pd := HTTPFeedPartition([]byte("d"), 2)
+	seqD := ChangelogFeedSeq(2, int64(len(`{"op":"upsert","key":"d","value":{}}`+"\n")))
+	if len(dest.snapshots) != 1 ||
+		dest.snapshots[0] != fmt.Sprintf("%s/%d/%d", pd, seqD, seqD) {
+		t.Errorf("expected a snapshot of segment 2, got: %v", dest.snapshots)
+	}
+	if feed.stats.TotSegment != 1 {
+		t.Errorf("expected a completed segment, stats: %+v", feed.stats)
+	}
+
+	// A restarted feed resumes without re-emitting.
+	numUpdates := len(dest.updates)
+	feed = start()
+	pollAll(feed)
+	if len(dest.updates) != numUpdates || len(dest.rollbacks) != 0 {
+		t.Errorf("expected no re-emits, updates: %v", dest.updates)
+	}
+
+	// A truncated segment rolls back and re-reads from the rolled
+	// back positions.
+	ioutil.WriteFile(segPath(2), []byte(`{"op":"delete","key":"e"}`+"\n"), 0600)
+	pollAll(feed)
+
+	if len(dest.rollbacks) != 1 ||
+		dest.rollbacks[0] != fmt.Sprintf("%s/%d", pd, ChangelogFeedSeq(2, 0)) {
+		t.Errorf("expected a rollback of the partition of d, got: %v",
+			dest.rollbacks)
+	}
+	if dest.deletes[len(dest.deletes)-1] !=
+		fmt.Sprintf("%s/e/%d", HTTPFeedPartition([]byte("e"), 2),
+			ChangelogFeedSeq(2, int64(len(`{"op":"delete","key":"e"}`+"\n")))) {
+		t.Errorf("expected the rewritten record, deletes: %v", dest.deletes)
+	}
+
+	// A segment that's rewritten while the feed is stopped is rolled
+	// back on restart.
+	dest.rollbacks = nil
+	ioutil.WriteFile(segPath(2), []byte(`{"op":"delete","key":"f"}`+"\n"), 0600)
+	feed = start()
+	if len(dest.rollbacks) <= 0 {
+		t.Errorf("expected a rollback on restart")
+	}
+	pollAll(feed)
+}
@@ -0,0 +1,574 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/couchbase/clog"
+)
+
+// FeedCoalesceMaxBytesDefault is the memory bound of a FeedCoalescer
+// whose maxBytes isn't specified.
+var FeedCoalesceMaxBytesDefault = int64(16 * 1024 * 1024)
+
+// destCoalesceItemOverhead approximates the memory of a buffered
+// mutation beyond its key, val and extras.
+const destCoalesceItemOverhead = 96
+
+// FeedCoalesceSourceParams represents the optional "coalesce" part of
+// a sourceParams JSON, which opts a feed into coalescing the
+// mutations within each snapshot, for example...
+//
+//    {"coalesce":{"maxBytes":10000000}}
+type FeedCoalesceSourceParams struct {
+	Coalesce *FeedCoalesceParams `json:"coalesce"`
+}
+
+// FeedCoalesceParams represents the JSON of a feed's coalescing.
+type FeedCoalesceParams struct {
+	// MaxBytes bounds the memory of the buffered mutations of all
+	// the partitions of a feed, where 0 means the default of
+	// FeedCoalesceMaxBytesDefault.
+	MaxBytes int64 `json:"maxBytes"`
+}
+
+// FeedCoalesceStats holds the counters of a FeedCoalescer.
+type FeedCoalesceStats struct {
+	TotIn          uint64 // Mutations received from the feed.
+	TotOut         uint64 // Mutations delivered to the dests.
+	TotCoalesced   uint64 // Mutations superseded by a later version.
+	TotFlush       uint64
+	TotOverflow    uint64 // Times the memory bound was reached.
+	TotPassThrough uint64 // Mutations delivered without buffering.
+}
+
+// A FeedCoalescer holds the configuration, memory accounting and
+// stats that are shared by the DestCoalesce's of a feed.
+type FeedCoalescer struct {
+	maxBytes int64
+	curBytes int64 // Accessed atomically.
+
+	stats FeedCoalesceStats
+}
+
+// NewFeedCoalescer parses the coalesce part of a sourceParams JSON,
+// returning nil when the feed isn't opted into coalescing.
+func NewFeedCoalescer(sourceParams string) (*FeedCoalescer, error) {
+	if !strings.Contains(sourceParams, `"coalesce"`) {
+		return nil, nil
+	}
+
+	var params FeedCoalesceSourceParams
+
+	err := json.Unmarshal([]byte(sourceParams), &params)
+	if err != nil {
+		return nil, fmt.Errorf("feed_coalesce: could not parse"+
+			" sourceParams, err: %v", err)
+	}
+
+	if params.Coalesce == nil {
+		return nil, nil
+	}
+
+	if params.Coalesce.MaxBytes < 0 {
+		return nil, fmt.Errorf("feed_coalesce: invalid maxBytes: %d",
+			params.Coalesce.MaxBytes)
+	}
+
+	maxBytes := params.Coalesce.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = FeedCoalesceMaxBytesDefault
+	}
+
+	return &FeedCoalescer{maxBytes: maxBytes}, nil
+}
+
+// reserve accounts for n more bytes of buffered mutations, returning
+// false when that would exceed the memory bound.
+func (c *FeedCoalescer) reserve(n int64) bool {
+	if atomic.AddInt64(&c.curBytes, n) > c.maxBytes && n > 0 {
+		atomic.AddInt64(&c.curBytes, -n)
+		return false
+	}
+	return true
+}
+
+func (c *FeedCoalescer) release(n int64) {
+	atomic.AddInt64(&c.curBytes, -n)
+}
+
+func (c *FeedCoalescer) Stats(w io.Writer) error {
+	_, err := fmt.Fprintf(w, `{"TotIn":%d,"TotOut":%d,"TotCoalesced":%d,`+
+		`"TotFlush":%d,"TotOverflow":%d,"TotPassThrough":%d,`+
+		`"CurBytes":%d,"MaxBytes":%d}`,
+		atomic.LoadUint64(&c.stats.TotIn),
+		atomic.LoadUint64(&c.stats.TotOut),
+		atomic.LoadUint64(&c.stats.TotCoalesced),
+		atomic.LoadUint64(&c.stats.TotFlush),
+		atomic.LoadUint64(&c.stats.TotOverflow),
+		atomic.LoadUint64(&c.stats.TotPassThrough),
+		atomic.LoadInt64(&c.curBytes),
+		c.maxBytes)
+	return err
+}
+
+// -----------------------------------------------------
+
+// A DestCoalesce implements the Dest and DestBatch interfaces by
+// buffering the mutations of a partition between a SnapshotStart()
+// and the snapshot's end seq, keeping only the last version of each
+// key, and then delivering the buffered mutations in seq order, as
+// batches.  Buffered mutations are also delivered before any
+// OpaqueSet() or OpaqueGet(), after DestBatchMaxLatency and when the
+// feed closes, and are dropped on a rollback.  When the
+// FeedCoalescer's memory bound would be exceeded, the partition's
+// buffered mutations are delivered and the rest of its snapshot
+// passes through unbuffered.
+type DestCoalesce struct {
+	Dest
+	Coalescer *FeedCoalescer
+
+	m          sync.Mutex // Protects the fields that follow.
+	closed     bool
+	partitions map[string]*destCoalescePartition
+}
+
+type destCoalescePartition struct {
+	destSnapshotBuffer
+	passThrough bool // True when the memory bound was reached.
+	bytes       int64
+	items       map[string]*destCoalesceItem // Keyed by key.
+}
+
+type destCoalesceItem struct {
+	key        []byte
+	val        []byte
+	seq        uint64
+	cas        uint64
+	deleted    bool
+	extrasType DestExtrasType
+	extras     []byte
+	req        interface{} // Non-nil for a DestEx invocation.
+}
+
+func (i *destCoalesceItem) size() int64 {
+	return int64(len(i.key) + len(i.val) + len(i.extras) +
+		destCoalesceItemOverhead)
+}
+
+func (t *DestCoalesce) partition(partition string) *destCoalescePartition {
+	t.m.Lock()
+	if t.partitions == nil {
+		t.partitions = map[string]*destCoalescePartition{}
+	}
+	p := t.partitions[partition]
+	if p == nil {
+		p = &destCoalescePartition{}
+		p.closed = t.closed
+		t.partitions[partition] = p
+	}
+	t.m.Unlock()
+	return p
+}
+
+func (t *DestCoalesce) DataUpdate(partition string,
+	key []byte, seq uint64, val []byte,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	return t.data(partition, &destCoalesceItem{key: key, val: val,
+		seq: seq, cas: cas, extrasType: extrasType, extras: extras})
+}
+
+func (t *DestCoalesce) DataDelete(partition string,
+	key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	return t.data(partition, &destCoalesceItem{key: key, deleted: true,
+		seq: seq, cas: cas, extrasType: extrasType, extras: extras})
+}
+
+func (t *DestCoalesce) DataUpdateEx(partition string,
+	key []byte, seq uint64, val []byte,
+	cas uint64,
+	extrasType DestExtrasType, req interface{}) error {
+	return t.data(partition, &destCoalesceItem{key: key, val: val,
+		seq: seq, cas: cas, extrasType: extrasType, req: req})
+}
+
+func (t *DestCoalesce) DataDeleteEx(partition string,
+	key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, req interface{}) error {
+	return t.data(partition, &destCoalesceItem{key: key, deleted: true,
+		seq: seq, cas: cas, extrasType: extrasType, req: req})
+}
+
+func (t *DestCoalesce) DataBatch(partition string,
+	batch *DestBatchData) error {
+	for i, seq := range batch.Seqs {
+		err := t.data(partition, &destCoalesceItem{key: batch.Keys[i],
+			val: batch.Vals[i], seq: seq, cas: batch.Cas[i],
+			deleted: batch.Deletes[i], extrasType: batch.ExtrasType,
+			extras: batch.Extras[i]})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *DestCoalesce) data(partition string, item *destCoalesceItem) error {
+	c := t.Coalescer
+
+	atomic.AddUint64(&c.stats.TotIn, 1)
+
+	p := t.partition(partition)
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	err := p.takeErrLOCKED()
+	if err != nil {
+		return err
+	}
+
+	if !p.inSnapshot || p.passThrough {
+		if p.inSnapshot {
+			atomic.AddUint64(&c.stats.TotPassThrough, 1)
+			if p.endLOCKED(item.seq) {
+				p.passThrough = false
+			}
+		}
+		return t.deliver(partition, item)
+	}
+
+	// The buffered item is a copy, as the feed may reuse its buffers,
+	// where a DestEx request is turned into Dest extras as the
+	// request can't be retained.
+	buffered := &destCoalesceItem{
+		key:        append([]byte(nil), item.key...),
+		val:        append([]byte(nil), item.val...),
+		seq:        item.seq,
+		cas:        item.cas,
+		deleted:    item.deleted,
+		extrasType: item.extrasType,
+		extras:     append([]byte(nil), item.extras...),
+	}
+	if item.req != nil {
+		buffered.extrasType = DEST_EXTRAS_TYPE_DCP
+		buffered.extras = append([]byte(nil), destReqExtras(item.req)...)
+	}
+
+	size := buffered.size()
+
+	prev := p.items[string(buffered.key)]
+	if prev != nil {
+		size -= prev.size()
+	}
+
+	if !c.reserve(size) {
+		atomic.AddUint64(&c.stats.TotOverflow, 1)
+
+		p.passThrough = true
+
+		err := t.flushLOCKED(partition, p)
+		if err != nil {
+			return err
+		}
+
+		atomic.AddUint64(&c.stats.TotPassThrough, 1)
+		if p.endLOCKED(item.seq) {
+			p.passThrough = false
+		}
+		return t.deliver(partition, item)
+	}
+
+	if prev != nil {
+		atomic.AddUint64(&c.stats.TotCoalesced, 1)
+	}
+
+	if p.items == nil {
+		p.items = map[string]*destCoalesceItem{}
+	}
+	p.items[string(buffered.key)] = buffered
+	p.bytes += size
+
+	if p.endLOCKED(buffered.seq) {
+		return t.flushLOCKED(partition, p)
+	}
+
+	p.armLOCKED(func() error { return t.flushLOCKED(partition, p) })
+
+	return nil
+}
+
+// flushLOCKED delivers the buffered mutations of a partition in seq
+// order, or the error of an earlier timed flush.
+func (t *DestCoalesce) flushLOCKED(partition string,
+	p *destCoalescePartition) error {
+	p.disarmLOCKED()
+
+	err := p.takeErrLOCKED()
+	if err != nil || len(p.items) <= 0 {
+		return err
+	}
+
+	items := make(destCoalesceItems, 0, len(p.items))
+	for _, item := range p.items {
+		items = append(items, item)
+	}
+	sort.Sort(items)
+
+	t.dropLOCKED(p)
+
+	atomic.AddUint64(&t.Coalescer.stats.TotFlush, 1)
+
+	return t.deliverBatches(partition, items)
+}
+
+// deliverBatches delivers buffered mutations, in seq order, as
+// batches of mutations with the same ExtrasType.
+func (t *DestCoalesce) deliverBatches(partition string,
+	items destCoalesceItems) error {
+	destBatch := AsDestBatch(t.Dest)
+
+	var batch DestBatchData
+
+	for i, item := range items {
+		batch.ExtrasType = item.extrasType
+		batch.Append(item.key, item.seq, item.val, item.cas,
+			item.deleted, item.extras)
+
+		if i+1 < len(items) && items[i+1].extrasType == item.extrasType {
+			continue
+		}
+
+		atomic.AddUint64(&t.Coalescer.stats.TotOut, uint64(batch.Len()))
+
+		err := destBatch.DataBatch(partition, &batch)
+		if err != nil {
+			return err
+		}
+
+		batch.Reset()
+	}
+
+	return nil
+}
+
+// dropLOCKED forgets the buffered mutations of a partition.
+func (t *DestCoalesce) dropLOCKED(p *destCoalescePartition) {
+	t.Coalescer.release(p.bytes)
+	p.bytes = 0
+	p.items = nil
+}
+
+func (t *DestCoalesce) deliver(partition string,
+	item *destCoalesceItem) error {
+	atomic.AddUint64(&t.Coalescer.stats.TotOut, 1)
+
+	if item.req != nil {
+		if destEx, ok := t.Dest.(DestEx); ok {
+			if item.deleted {
+				return destEx.DataDeleteEx(partition, item.key, item.seq,
+					item.cas, item.extrasType, item.req)
+			}
+			return destEx.DataUpdateEx(partition, item.key, item.seq,
+				item.val, item.cas, item.extrasType, item.req)
+		}
+
+		item.extrasType = DEST_EXTRAS_TYPE_DCP
+		item.extras = destReqExtras(item.req)
+	}
+
+	if item.deleted {
+		return t.Dest.DataDelete(partition, item.key, item.seq,
+			item.cas, item.extrasType, item.extras)
+	}
+	return t.Dest.DataUpdate(partition, item.key, item.seq, item.val,
+		item.cas, item.extrasType, item.extras)
+}
+
+type destCoalesceItems []*destCoalesceItem
+
+func (a destCoalesceItems) Len() int           { return len(a) }
+func (a destCoalesceItems) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a destCoalesceItems) Less(i, j int) bool { return a[i].seq < a[j].seq }
+
+func (t *DestCoalesce) SnapshotStart(partition string,
+	snapStart, snapEnd uint64) error {
+	p := t.partition(partition)
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	err := t.flushLOCKED(partition, p)
+	if err != nil {
+		return err
+	}
+
+	p.snapshotStartLOCKED(snapEnd)
+	p.passThrough = false
+
+	return t.Dest.SnapshotStart(partition, snapStart, snapEnd)
+}
+
+func (t *DestCoalesce) OpaqueGet(partition string) (
+	value []byte, lastSeq uint64, err error) {
+	p := t.partition(partition)
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	err = t.flushLOCKED(partition, p)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return t.Dest.OpaqueGet(partition)
+}
+
+func (t *DestCoalesce) OpaqueSet(partition string, value []byte) error {
+	p := t.partition(partition)
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	err := t.flushLOCKED(partition, p)
+	if err != nil {
+		return err
+	}
+
+	return t.Dest.OpaqueSet(partition, value)
+}
+
+func (t *DestCoalesce) Rollback(partition string, rollbackSeq uint64) error {
+	p := t.partition(partition)
+
+	p.m.Lock()
+	t.dropLOCKED(p)
+	p.resetLOCKED()
+	p.passThrough = false
+	p.m.Unlock()
+
+	return t.Dest.Rollback(partition, rollbackSeq)
+}
+
+func (t *DestCoalesce) RollbackEx(partition string, partitionUUID uint64,
+	rollbackSeq uint64) error {
+	p := t.partition(partition)
+
+	p.m.Lock()
+	t.dropLOCKED(p)
+	p.resetLOCKED()
+	p.passThrough = false
+	p.m.Unlock()
+
+	if destEx, ok := t.Dest.(DestEx); ok {
+		return destEx.RollbackEx(partition, partitionUUID, rollbackSeq)
+	}
+	return t.Dest.Rollback(partition, rollbackSeq)
+}
+
+// close delivers the buffered mutations of every partition, as the
+// feed is closing, and stops any later timed flush.
+func (t *DestCoalesce) close() error {
+	t.m.Lock()
+	t.closed = true
+	partitions := make(map[string]*destCoalescePartition, len(t.partitions))
+	for partition, p := range t.partitions {
+		partitions[partition] = p
+	}
+	t.m.Unlock()
+
+	var errFirst error
+
+	for partition, p := range partitions {
+		p.m.Lock()
+		err := t.flushLOCKED(partition, p)
+		p.closeLOCKED()
+		p.m.Unlock()
+
+		if err != nil && errFirst == nil {
+			errFirst = err
+		}
+	}
+
+	return errFirst
+}
+
+// -----------------------------------------------------
+
+// A CoalesceFeed wraps a Feed whose Dests are DestCoalesce's, so the
+// Feed's stats include the stats of the FeedCoalescer, and so the
+// mutations that are still buffered are delivered when the Feed is
+// closed.
+type CoalesceFeed struct {
+	Feed
+	Coalescer *FeedCoalescer
+}
+
+func (t *CoalesceFeed) Close() error {
+	err := t.Feed.Close()
+
+	for partition, dest := range t.Feed.Dests() {
+		if dc, ok := dest.(*DestCoalesce); ok {
+			err2 := dc.close()
+			if err2 != nil {
+				log.Warnf("feed_coalesce: close, name: %s, partition: %s,"+
+					" err: %v", t.Feed.Name(), partition, err2)
+			}
+		}
+	}
+
+	return err
+}
+
+func (t *CoalesceFeed) Stats(w io.Writer) error {
+	return writeFeedStatsWith(w, t.Feed, "coalesce", t.Coalescer.Stats)
+}
+
+// coalesceDests wraps dests with DestCoalesce's.
+func coalesceDests(coalescer *FeedCoalescer,
+	dests map[string]Dest) map[string]Dest {
+	rv := make(map[string]Dest, len(dests))
+	for partition, dest := range dests {
+		rv[partition] = &DestCoalesce{Dest: dest, Coalescer: coalescer}
+	}
+	return rv
+}
+
+// destsCoalescer returns the FeedCoalescer of DestCoalesce's, if any.
+func destsCoalescer(dests map[string]Dest) *FeedCoalescer {
+	for _, dest := range dests {
+		if dc, ok := dest.(*DestCoalesce); ok {
+			return dc.Coalescer
+		}
+	}
+	return nil
+}
+
+// unwrapDestCoalesce returns the Dest that's wrapped by a
+// DestCoalesce.
+func unwrapDestCoalesce(dest Dest) Dest {
+	if dc, ok := dest.(*DestCoalesce); ok {
+		return dc.Dest
+	}
+	return dest
+}
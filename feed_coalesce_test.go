@@ -0,0 +1,250 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewFeedCoalescer(t *testing.T) {
+	for _, sourceParams := range []string{"", "{}", `{"x":1}`} {
+		c, err := NewFeedCoalescer(sourceParams)
+		if err != nil || c != nil {
+			t.Errorf("expected no coalescer, sourceParams: %s", sourceParams)
+		}
+	}
+
+	c, err := NewFeedCoalescer(`{"coalesce":{}}`)
+	if err != nil || c == nil || c.maxBytes != FeedCoalesceMaxBytesDefault {
+		t.Errorf("expected a default coalescer, err: %v", err)
+	}
+
+	for _, sourceParams := range []string{
+		`{"coalesce":1}`,
+		`{"coalesce":{"maxBytes":-1}}`,
+	} {
+		_, err := NewFeedCoalescer(sourceParams)
+		if err == nil {
+			t.Errorf("expected err, sourceParams: %s", sourceParams)
+		}
+	}
+}
+
+func TestDestCoalesce(t *testing.T) {
+	defer func(d time.Duration) { DestBatchMaxLatency = d }(DestBatchMaxLatency)
+	DestBatchMaxLatency = time.Hour
+
+	c, _ := NewFeedCoalescer(`{"coalesce":{}}`)
+
+	dest := newHTTPFeedTestDest()
+	dc := &DestCoalesce{Dest: dest, Coalescer: c}
+
+	update := func(key string, seq uint64) {
+		// The key buffer is reused, like a feed might.
+		buf := []byte(key)
+		dc.DataUpdate("0", buf, seq, []byte("{}"), 0, DEST_EXTRAS_TYPE_NIL, nil)
+		copy(buf, "?")
+	}
+
+	// Outside of a snapshot, mutations pass through.
+	update("x", 1)
+
+	dc.SnapshotStart("0", 2, 7)
+	update("a", 2)
+	update("b", 3)
+	update("a", 4)
+	dc.DataDelete("0", []byte("b"), 5, 0, DEST_EXTRAS_TYPE_NIL, nil)
+	update("c", 6)
+
+	if len(dest.updates) != 1 || len(dest.deletes) != 0 {
+		t.Errorf("expected buffering, updates: %v", dest.updates)
+	}
+
+	// Reaching the snapshot's end flushes in seq order.
+	update("a", 7)
+
+	if !reflect.DeepEqual(dest.updates, []string{"0/x/1", "0/c/6", "0/a/7"}) ||
+		!reflect.DeepEqual(dest.deletes, []string{"0/b/5"}) {
+		t.Errorf("unexpected coalescing, updates: %v, deletes: %v",
+			dest.updates, dest.deletes)
+	}
+
+	// An OpaqueSet flushes first, and a rollback drops.
+	dc.SnapshotStart("0", 8, 20)
+	update("d", 8)
+	dc.OpaqueSet("0", []byte("o"))
+	update("e", 9)
+	dc.Rollback("0", 8)
+	update("f", 10)
+
+	if !reflect.DeepEqual(dest.updates[3:], []string{"0/d/8", "0/f/10"}) {
+		t.Errorf("unexpected updates: %v", dest.updates)
+	}
+
+	var buf bytes.Buffer
+	c.Stats(&buf)
+
+	exp := `{"TotIn":10,"TotOut":6,"TotCoalesced":3,"TotFlush":2,` +
+		`"TotOverflow":0,"TotPassThrough":0,"CurBytes":0,` +
+		`"MaxBytes":16777216}`
+	if buf.String() != exp {
+		t.Errorf("expected stats: %s, got: %s", exp, buf.String())
+	}
+}
+
+func TestDestCoalesceOverflow(t *testing.T) {
+	c, _ := NewFeedCoalescer(`{"coalesce":{"maxBytes":250}}`)
+
+	dest := newHTTPFeedTestDest()
+	dc := &DestCoalesce{Dest: dest, Coalescer: c}
+
+	dc.SnapshotStart("0", 1, 5)
+	for i, key := range []string{"a", "b", "c", "c", "d"} {
+		dc.DataUpdate("0", []byte(key), uint64(i+1), []byte("{}"),
+			0, DEST_EXTRAS_TYPE_NIL, nil)
+	}
+
+	// The 3rd mutation exceeds the bound, so the rest pass through.
+	if !reflect.DeepEqual(dest.updates,
+		[]string{"0/a/1", "0/b/2", "0/c/3", "0/c/4", "0/d/5"}) {
+		t.Errorf("unexpected updates: %v", dest.updates)
+	}
+	if c.stats.TotOverflow != 1 || c.stats.TotPassThrough != 3 ||
+		c.curBytes != 0 {
+		t.Errorf("unexpected stats: %+v, curBytes: %d", c.stats, c.curBytes)
+	}
+
+	// The next snapshot buffers again.
+	dc.SnapshotStart("0", 6, 7)
+	dc.DataUpdate("0", []byte("a"), 6, nil, 0, DEST_EXTRAS_TYPE_NIL, nil)
+	if len(dest.updates) != 5 {
+		t.Errorf("expected buffering, updates: %v", dest.updates)
+	}
+}
+
+// syncCoalesceTestDest is a httpFeedTestDest whose updates may come
+// from a timed flush.
+type syncCoalesceTestDest struct {
+	*httpFeedTestDest
+
+	m sync.Mutex
+}
+
+func (d *syncCoalesceTestDest) DataUpdate(partition string,
+	key []byte, seq uint64, val []byte,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.httpFeedTestDest.DataUpdate(partition, key, seq, val,
+		cas, extrasType, extras)
+}
+
+func (d *syncCoalesceTestDest) Updates() []string {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return append([]string(nil), d.updates...)
+}
+
+func TestDestCoalesceTimedFlushAndClose(t *testing.T) {
+	defer func(d time.Duration) { DestBatchMaxLatency = d }(DestBatchMaxLatency)
+	DestBatchMaxLatency = 10 * time.Millisecond
+
+	c, _ := NewFeedCoalescer(`{"coalesce":{}}`)
+
+	dest := &syncCoalesceTestDest{httpFeedTestDest: newHTTPFeedTestDest()}
+	dc := &DestCoalesce{Dest: dest, Coalescer: c}
+
+	// The snapshot's end seq of 10 is never delivered as a mutation.
+	dc.SnapshotStart("0", 1, 10)
+	dc.DataUpdate("0", []byte("a"), 1, nil, 0, DEST_EXTRAS_TYPE_NIL, nil)
+	dc.DataUpdate("0", []byte("a"), 2, nil, 0, DEST_EXTRAS_TYPE_NIL, nil)
+
+	for i := 0; i < 100 && len(dest.Updates()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !reflect.DeepEqual(dest.Updates(), []string{"0/a/2"}) {
+		t.Errorf("expected a timed flush, updates: %v", dest.Updates())
+	}
+
+	// Closing delivers the rest of the snapshot.
+	DestBatchMaxLatency = time.Hour
+
+	dc.DataUpdate("0", []byte("b"), 3, nil, 0, DEST_EXTRAS_TYPE_NIL, nil)
+
+	err := dc.close()
+	if err != nil {
+		t.Errorf("expected close to work, err: %v", err)
+	}
+	if !reflect.DeepEqual(dest.Updates(), []string{"0/a/2", "0/b/3"}) {
+		t.Errorf("expected a flush on close, updates: %v", dest.Updates())
+	}
+	if c.curBytes != 0 {
+		t.Errorf("expected no buffered bytes, curBytes: %d", c.curBytes)
+	}
+}
+
+func TestCoalesceFeed(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	mgr := NewManager(VERSION, NewCfgMem(), NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+
+	err := mgr.startFeedByType("feedName",
+		"indexName", "indexUUID", "nil",
+		"sourceName", "sourceUUID",
+		`{"coalesce":{"maxBytes":1000},`+
+			`"pipeline":[{"stage":"keyInclude","regexp":"^a"}]}`,
+		map[string]Dest{"": &TestDest{}})
+	if err != nil {
+		t.Fatalf("expected startFeedByType to work, err: %v", err)
+	}
+
+	feeds, _ := mgr.CurrentMaps()
+
+	feed, ok := feeds["feedName"].(*CoalesceFeed)
+	if !ok {
+		t.Fatalf("expected a CoalesceFeed, feeds: %#v", feeds)
+	}
+	if _, ok = UnwrapFeed(feed).(*NILFeed); !ok {
+		t.Errorf("expected a wrapped NILFeed")
+	}
+
+	feed.Dests()[""].DataUpdate("", []byte("b"), 1, []byte("{}"),
+		0, DEST_EXTRAS_TYPE_NIL, nil)
+
+	var buf bytes.Buffer
+	feed.Stats(&buf)
+
+	if !strings.HasPrefix(buf.String(), `{"pipeline":[{"stage":"keyInclude",`) ||
+		!strings.HasSuffix(buf.String(), `,"coalesce":{"TotIn":1,"TotOut":1,`+
+			`"TotCoalesced":0,"TotFlush":0,"TotOverflow":0,`+
+			`"TotPassThrough":0,"CurBytes":0,"MaxBytes":1000}}`) {
+		t.Errorf("unexpected stats: %s", buf.String())
+	}
+
+	err = mgr.startFeedByType("feedName2",
+		"indexName", "indexUUID", "nil",
+		"sourceName", "sourceUUID", `{"coalesce":{"maxBytes":-1}}`,
+		map[string]Dest{"": &TestDest{}})
+	if err == nil {
+		t.Errorf("expected an invalid coalesce to fail")
+	}
+}
@@ -0,0 +1,225 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+const FEED_PARTITION_OP_PAUSE = "pause"
+const FEED_PARTITION_OP_RESUME = "resume"
+const FEED_PARTITION_OP_SEEK = "seek"
+
+// ErrFeedPartitionControlUnsupported is returned by the
+// FeedPartitionControl methods of a feed that can't close and reopen
+// the stream of a single source partition, such as a DCPFeed, whose
+// cbdatasource streams can't be reopened individually.
+var ErrFeedPartitionControlUnsupported = errors.New("feed_control:" +
+	" partition control is not supported by the feed")
+
+// FeedPartitionControl is an optional interface that a Feed can
+// implement to allow the ingest of its individual source partitions
+// to be paused, resumed or seeked at runtime, without a restart of
+// the feed, such as for hot partition mitigation or for targeted
+// reindexing.  A paused partition's stream is closed, and it's
+// reopened from the dest's checkpoint on a resume.
+type FeedPartitionControl interface {
+	// PausePartition stops the delivery of a partition's mutations,
+	// snapshots and opaque updates to its dest, so the dest's
+	// checkpoint stays at the point of the pause.
+	PausePartition(partition string) error
+
+	// ResumePartition restarts the delivery of a paused partition
+	// from its dest's checkpoint.
+	ResumePartition(partition string) error
+
+	// SeekPartition moves a partition back to an earlier seq via the
+	// Rollback or RollbackEx of its dest, so the source partition is
+	// streamed again from that seq.
+	SeekPartition(partition string, seq uint64) error
+
+	// PausedPartitions returns the sorted names of the paused
+	// partitions.
+	PausedPartitions() []string
+}
+
+// ------------------------------------------------------------------
+
+// feedPausedPartitions tracks the paused partitions of a feed.
+type feedPausedPartitions struct {
+	m      sync.Mutex
+	paused map[string]uint64 // Keyed by partition, value is # discarded.
+}
+
+// pause returns false if the partition was already paused.
+func (p *feedPausedPartitions) pause(partition string) bool {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if _, exists := p.paused[partition]; exists {
+		return false
+	}
+	if p.paused == nil {
+		p.paused = map[string]uint64{}
+	}
+	p.paused[partition] = 0
+	return true
+}
+
+// resume returns whether the partition was paused and the number of
+// callbacks that were discarded during the pause.
+func (p *feedPausedPartitions) resume(partition string) (bool, uint64) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	discarded, exists := p.paused[partition]
+	delete(p.paused, partition)
+	return exists, discarded
+}
+
+// discard returns true, and counts the discard, when the callback of
+// a partition should be discarded as the partition is paused.
+func (p *feedPausedPartitions) discard(partition string) bool {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	discarded, exists := p.paused[partition]
+	if exists {
+		p.paused[partition] = discarded + 1
+	}
+	return exists
+}
+
+func (p *feedPausedPartitions) isPaused(partition string) bool {
+	p.m.Lock()
+	_, exists := p.paused[partition]
+	p.m.Unlock()
+	return exists
+}
+
+func (p *feedPausedPartitions) partitions() []string {
+	p.m.Lock()
+	rv := make([]string, 0, len(p.paused))
+	for partition := range p.paused {
+		rv = append(rv, partition)
+	}
+	p.m.Unlock()
+
+	sort.Strings(rv)
+	return rv
+}
+
+// ------------------------------------------------------------------
+
+// feedPartitionVBucketId parses a couchbase partition into its
+// vbucketId, checking that the feed has a dest for the partition.
+func feedPartitionVBucketId(partition string,
+	dests map[string]Dest) (uint16, error) {
+	if _, exists := dests[partition]; !exists {
+		return 0, fmt.Errorf("feed_control: unknown partition: %s",
+			partition)
+	}
+
+	vbucketId, err := strconv.ParseUint(partition, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("feed_control: could not parse"+
+			" partition: %s, err: %v", partition, err)
+	}
+
+	return uint16(vbucketId), nil
+}
+
+// feedPartitionSeekUUID returns the vbucket UUID of a dest's opaque
+// value that's used for RollbackEx, after checking that the seek is
+// not past the dest's lastSeq.
+func feedPartitionSeekUUID(partition string, dest Dest,
+	seq uint64) (uint64, error) {
+	opaqueValue, lastSeq, err := dest.OpaqueGet(partition)
+	if err != nil {
+		return 0, err
+	}
+
+	if seq > lastSeq {
+		return 0, fmt.Errorf("feed_control: can only seek back,"+
+			" partition: %s, seq: %d, lastSeq: %d", partition, seq, lastSeq)
+	}
+
+	vBucketUUID, _ := strconv.ParseUint(ParseOpaqueToUUID(opaqueValue), 10, 64)
+
+	return vBucketUUID, nil
+}
+
+// ------------------------------------------------------------------
+
+// FeedPartitionControl pauses, resumes or seeks a source partition of
+// the feeds of an index on this node, where the feeds must implement
+// the FeedPartitionControl interface.  The seq is only used by the
+// seek op.  ErrFeedPartitionControlUnsupported is returned as-is when
+// a feed doesn't support partition control, which is the case for
+// all feeds other than a GocbDCPFeed.
+func (mgr *Manager) FeedPartitionControl(indexName, partition, op string,
+	seq uint64) error {
+	atomic.AddUint64(&mgr.stats.TotFeedPartitionControl, 1)
+
+	if op != FEED_PARTITION_OP_PAUSE &&
+		op != FEED_PARTITION_OP_RESUME &&
+		op != FEED_PARTITION_OP_SEEK {
+		return fmt.Errorf("feed_control: unsupported op: %s", op)
+	}
+
+	feeds, _ := mgr.CurrentMaps()
+
+	feedNames := make([]string, 0, len(feeds))
+	for feedName, feed := range feeds {
+		if feed.IndexName() == indexName && feed.Dests()[partition] != nil {
+			feedNames = append(feedNames, feedName)
+		}
+	}
+	if len(feedNames) == 0 {
+		return fmt.Errorf("feed_control: no feed for partition on this node,"+
+			" indexName: %s, partition: %s", indexName, partition)
+	}
+
+	sort.Strings(feedNames)
+
+	for _, feedName := range feedNames {
+		fpc, ok := UnwrapFeed(feeds[feedName]).(FeedPartitionControl)
+		if !ok {
+			return ErrFeedPartitionControlUnsupported
+		}
+
+		var err error
+		switch op {
+		case FEED_PARTITION_OP_PAUSE:
+			err = fpc.PausePartition(partition)
+		case FEED_PARTITION_OP_RESUME:
+			err = fpc.ResumePartition(partition)
+		case FEED_PARTITION_OP_SEEK:
+			err = fpc.SeekPartition(partition, seq)
+		}
+		if err == ErrFeedPartitionControlUnsupported {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("feed_control: feedName: %s, partition: %s,"+
+				" op: %s, err: %v", feedName, partition, op, err)
+		}
+	}
+
+	atomic.AddUint64(&mgr.stats.TotFeedPartitionControlOk, 1)
+	return nil
+}
@@ -0,0 +1,166 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/couchbase/gomemcached"
+)
+
+func TestDCPFeedPartitionControl(t *testing.T) {
+	d1 := newFanoutTestDest(10)
+
+	df, err := NewDCPFeed("aaa", "bbb",
+		"url", "poolName", "bucketName", "bucketUUID", "",
+		BasicPartitionFunc, map[string]Dest{"1": d1}, false, nil)
+	if err != nil {
+		t.Fatalf("expected NewDCPFeed to work, err: %v", err)
+	}
+
+	var fpc FeedPartitionControl = df
+
+	// A pause that only discarded callbacks would lose mutations.
+	if fpc.PausePartition("1") != ErrFeedPartitionControlUnsupported ||
+		fpc.ResumePartition("1") != ErrFeedPartitionControlUnsupported ||
+		fpc.SeekPartition("1", 5) != ErrFeedPartitionControlUnsupported {
+		t.Errorf("expected partition control to be unsupported")
+	}
+	if len(fpc.PausedPartitions()) != 0 {
+		t.Errorf("expected no paused partitions")
+	}
+
+	err = df.DataUpdate(1, []byte("k"), 11,
+		&gomemcached.MCRequest{Body: []byte("{}")})
+	if err != nil || len(d1.updates) != 1 || d1.rollbacks != 0 {
+		t.Errorf("expected updates to be delivered, err: %v, d1: %v",
+			err, d1.updates)
+	}
+}
+
+func TestFeedPausedPartitions(t *testing.T) {
+	var p feedPausedPartitions
+
+	if p.discard("1") {
+		t.Errorf("expected no discard when not paused")
+	}
+	if !p.pause("1") || p.pause("1") || !p.pause("0") {
+		t.Errorf("expected only the first pause to take effect")
+	}
+	if !reflect.DeepEqual(p.partitions(), []string{"0", "1"}) {
+		t.Errorf("expected paused partitions, got: %v", p.partitions())
+	}
+
+	p.discard("1")
+	p.discard("1")
+
+	wasPaused, discarded := p.resume("1")
+	if !wasPaused || discarded != 2 || p.isPaused("1") {
+		t.Errorf("expected resume, wasPaused: %t, discarded: %d",
+			wasPaused, discarded)
+	}
+
+	wasPaused, _ = p.resume("1")
+	if wasPaused {
+		t.Errorf("expected a second resume to be a no-op")
+	}
+}
+
+// controlTestFeed is a feed that records its partition control ops.
+type controlTestFeed struct {
+	*NILFeed
+	paused feedPausedPartitions
+	seeks  map[string]uint64
+}
+
+func (f *controlTestFeed) PausePartition(partition string) error {
+	f.paused.pause(partition)
+	return nil
+}
+
+func (f *controlTestFeed) ResumePartition(partition string) error {
+	f.paused.resume(partition)
+	return nil
+}
+
+func (f *controlTestFeed) SeekPartition(partition string, seq uint64) error {
+	f.seeks[partition] = seq
+	return nil
+}
+
+func (f *controlTestFeed) PausedPartitions() []string {
+	return f.paused.partitions()
+}
+
+func TestManagerFeedPartitionControl(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	mgr := NewManager(VERSION, NewCfgMem(), NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+
+	d1 := newFanoutTestDest(10)
+
+	cf := &controlTestFeed{
+		NILFeed: NewNILFeed("aaa", "bbb", map[string]Dest{"1": d1}),
+		seeks:   map[string]uint64{},
+	}
+	mgr.registerFeed(cf)
+	mgr.registerFeed(NewNILFeed("nil", "ccc", map[string]Dest{"1": d1}))
+
+	df, _ := NewDCPFeed("dcp", "ddd",
+		"url", "poolName", "bucketName", "bucketUUID", "",
+		BasicPartitionFunc, map[string]Dest{"1": d1}, false, nil)
+	mgr.registerFeed(df)
+
+	err := mgr.FeedPartitionControl("bbb", "1", FEED_PARTITION_OP_PAUSE, 0)
+	if err != nil || !cf.paused.isPaused("1") {
+		t.Errorf("expected pause to work, err: %v", err)
+	}
+	err = mgr.FeedPartitionControl("bbb", "1", FEED_PARTITION_OP_RESUME, 0)
+	if err != nil || cf.paused.isPaused("1") {
+		t.Errorf("expected resume to work, err: %v", err)
+	}
+	err = mgr.FeedPartitionControl("bbb", "1", FEED_PARTITION_OP_SEEK, 3)
+	if err != nil || cf.seeks["1"] != 3 {
+		t.Errorf("expected seek to work, err: %v", err)
+	}
+
+	for _, args := range [][]string{
+		{"bbb", "1", "unknown"},
+		{"bbb", "2", FEED_PARTITION_OP_PAUSE},
+		{"xxx", "1", FEED_PARTITION_OP_PAUSE},
+	} {
+		err = mgr.FeedPartitionControl(args[0], args[1], args[2], 0)
+		if err == nil || err == ErrFeedPartitionControlUnsupported {
+			t.Errorf("expected err, args: %v, err: %v", args, err)
+		}
+	}
+
+	// The unsupported feeds are distinguished, for a REST 501.
+	for _, args := range [][]string{
+		{"ccc", "1", FEED_PARTITION_OP_PAUSE},
+		{"ddd", "1", FEED_PARTITION_OP_PAUSE},
+	} {
+		err = mgr.FeedPartitionControl(args[0], args[1], args[2], 0)
+		if err != ErrFeedPartitionControlUnsupported {
+			t.Errorf("expected unsupported, args: %v, err: %v", args, err)
+		}
+	}
+
+	if d1.rollbacks != 0 {
+		t.Errorf("expected no rollbacks, rollbacks: %d", d1.rollbacks)
+	}
+}
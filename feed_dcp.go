@@ -139,6 +139,8 @@ type DCPFeed struct {
 	stats   *DestStats
 
 	stopAfterReached map[string]bool // May be nil.
+
+	batcher *destBatcher
 }
 
 // DCPFeedParams are DCP data-source/feed specific connection
@@ -299,6 +301,9 @@ func NewDCPFeed(name, indexName, url, poolName,
 		stats:      NewDestStats(),
 	}
 
+	feed.batcher = newDestBatcher(feed.stats.TimerDataBatch,
+		feed.updateStopAfter)
+
 	feed.bds, err = cbdatasource.NewBucketDataSource(
 		urls, poolName, bucketName, bucketUUID,
 		vbucketIds, auth, feed, options)
@@ -336,7 +341,15 @@ func (t *DCPFeed) Close() error {
 	t.m.Unlock()
 
 	log.Printf("feed_dcp: close, name: %s", t.Name())
-	return t.bds.Close()
+	err := t.bds.Close()
+
+	err2 := t.batcher.close()
+	if err2 != nil {
+		log.Warnf("feed_dcp: close, name: %s, batcher close, err: %v",
+			t.Name(), err2)
+	}
+
+	return err
 }
 
 func (t *DCPFeed) Dests() map[string]Dest {
@@ -428,13 +441,19 @@ func (r *DCPFeed) OnError(err error) {
 
 func (r *DCPFeed) DataUpdate(vbucketId uint16, key []byte, seq uint64,
 	req *gomemcached.MCRequest) error {
-	return Timer(func() error {
-		partition, dest, err :=
-			VBucketIdToPartitionDest(r.pf, r.dests, vbucketId, key)
-		if err != nil || r.checkStopAfter(partition) {
-			return err
-		}
+	partition, dest, err :=
+		VBucketIdToPartitionDest(r.pf, r.dests, vbucketId, key)
+	if err != nil || r.checkStopAfter(partition) {
+		return err
+	}
+
+	batched, err := r.batcher.add(partition, dest, key, seq, req.Body,
+		req.Cas, false, DEST_EXTRAS_TYPE_DCP, req.Extras)
+	if batched {
+		return r.dataBatchErr(partition, key, seq, err)
+	}
 
+	return Timer(func() error {
 		if destEx, ok := dest.(DestEx); ok {
 			err = destEx.DataUpdateEx(partition, key, seq, req.Body,
 				req.Cas, DEST_EXTRAS_TYPE_MCREQUEST, req)
@@ -458,13 +477,19 @@ func (r *DCPFeed) DataUpdate(vbucketId uint16, key []byte, seq uint64,
 
 func (r *DCPFeed) DataDelete(vbucketId uint16, key []byte, seq uint64,
 	req *gomemcached.MCRequest) error {
-	return Timer(func() error {
-		partition, dest, err :=
-			VBucketIdToPartitionDest(r.pf, r.dests, vbucketId, key)
-		if err != nil || r.checkStopAfter(partition) {
-			return err
-		}
+	partition, dest, err :=
+		VBucketIdToPartitionDest(r.pf, r.dests, vbucketId, key)
+	if err != nil || r.checkStopAfter(partition) {
+		return err
+	}
+
+	batched, err := r.batcher.add(partition, dest, key, seq, nil,
+		req.Cas, true, DEST_EXTRAS_TYPE_DCP, req.Extras)
+	if batched {
+		return r.dataBatchErr(partition, key, seq, err)
+	}
 
+	return Timer(func() error {
 		if destEx, ok := dest.(DestEx); ok {
 			err = destEx.DataDeleteEx(partition, key, seq,
 				req.Cas, DEST_EXTRAS_TYPE_MCREQUEST, req)
@@ -486,6 +511,18 @@ func (r *DCPFeed) DataDelete(vbucketId uint16, key []byte, seq uint64,
 	}, r.stats.TimerDataDelete)
 }
 
+// dataBatchErr wraps the err of a batched mutation, where the err
+// comes from the delivery of the batch that the mutation completed.
+func (r *DCPFeed) dataBatchErr(partition string, key []byte, seq uint64,
+	err error) error {
+	if err != nil {
+		return fmt.Errorf("feed_dcp: DataBatch,"+
+			" name: %s, partition: %s, key: %v, seq: %d, err: %v",
+			r.name, partition, log.Tag(log.UserData, key), seq, err)
+	}
+	return nil
+}
+
 func (r *DCPFeed) SnapshotStart(vbucketId uint16,
 	snapStart, snapEnd uint64, snapType uint32) error {
 	return Timer(func() error {
@@ -503,6 +540,11 @@ func (r *DCPFeed) SnapshotStart(vbucketId uint16,
 			}
 		}
 
+		err = r.batcher.snapshotStart(partition, snapEnd)
+		if err != nil {
+			return err
+		}
+
 		return dest.SnapshotStart(partition, snapStart, snapEnd)
 	}, r.stats.TimerSnapshotStart)
 }
@@ -515,6 +557,11 @@ func (r *DCPFeed) SetMetaData(vbucketId uint16, value []byte) error {
 			return err
 		}
 
+		err = r.batcher.flush(partition)
+		if err != nil {
+			return err
+		}
+
 		return dest.OpaqueSet(partition, value)
 	}, r.stats.TimerOpaqueSet)
 }
@@ -528,6 +575,11 @@ func (r *DCPFeed) GetMetaData(vbucketId uint16) (
 			return err2
 		}
 
+		err2 = r.batcher.flush(partition)
+		if err2 != nil {
+			return err2
+		}
+
 		value, lastSeq, err2 = dest.OpaqueGet(partition)
 
 		return err2
@@ -554,6 +606,8 @@ func (r *DCPFeed) Rollback(vbucketId uint16, rollbackSeq uint64) error {
 			r.name, vbucketId, rollbackSeq,
 			partition, opaqueValue, lastSeq)
 
+		r.batcher.reset(partition)
+
 		return dest.Rollback(partition, rollbackSeq)
 	}, r.stats.TimerRollback)
 }
@@ -576,6 +630,8 @@ func (r *DCPFeed) RollbackEx(vbucketId uint16, vBucketUUID uint64, rollbackSeq u
 			r.name, vbucketId, rollbackSeq,
 			partition, opaqueValue, lastSeq)
 
+		r.batcher.reset(partition)
+
 		if destEx, ok := dest.(DestEx); ok {
 			return destEx.RollbackEx(partition, vBucketUUID, rollbackSeq)
 		}
@@ -583,6 +639,27 @@ func (r *DCPFeed) RollbackEx(vbucketId uint16, vBucketUUID uint64, rollbackSeq u
 	}, r.stats.TimerRollback)
 }
 
+// --------------------------------------------------------
+
+// PausePartition is not supported, as the cbdatasource streams of a
+// feed can't be closed and reopened for a single partition, and
+// discarding the partition's callbacks would lose its mutations.
+func (r *DCPFeed) PausePartition(partition string) error {
+	return ErrFeedPartitionControlUnsupported
+}
+
+func (r *DCPFeed) ResumePartition(partition string) error {
+	return ErrFeedPartitionControlUnsupported
+}
+
+func (r *DCPFeed) SeekPartition(partition string, seq uint64) error {
+	return ErrFeedPartitionControlUnsupported
+}
+
+func (r *DCPFeed) PausedPartitions() []string {
+	return nil
+}
+
 // VerifyBucketNotExists returns true only if it's sure the bucket
 // does not exist anymore (including if UUID's no longer match).  A
 // rejected auth or connection failure, for example, results in false.
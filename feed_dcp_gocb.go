@@ -101,6 +101,9 @@ type GocbDCPFeed struct {
 	stats     *DestStats
 
 	stopAfterReached map[string]bool // May be nil.
+
+	paused  feedPausedPartitions
+	batcher *destBatcher
 }
 
 func NewGocbDCPFeed(name, indexName, url,
@@ -161,6 +164,9 @@ func NewGocbDCPFeed(name, indexName, url,
 		active:            make(map[uint16]bool),
 	}
 
+	feed.batcher = newDestBatcher(feed.stats.TimerDataBatch,
+		feed.updateStopAfter)
+
 	for _, vbid := range vbucketIds {
 		feed.lastReceivedSeqno[vbid] = 0
 	}
@@ -237,6 +243,12 @@ func (f *GocbDCPFeed) Close() error {
 
 	f.wait()
 
+	err := f.batcher.close()
+	if err != nil {
+		log.Warnf("feed_gocb_dcp: close, name: %s, batcher close, err: %v",
+			f.Name(), err)
+	}
+
 	log.Printf("feed_gocb_dcp: close, name: %s", f.Name())
 	return nil
 }
@@ -384,7 +396,8 @@ func (f *GocbDCPFeed) SnapshotMarker(startSeqNo, endSeqNo uint64,
 	err := Timer(func() error {
 		partition, dest, err :=
 			VBucketIdToPartitionDest(f.pf, f.dests, vbId, nil)
-		if err != nil || f.checkStopAfter(partition) {
+		if err != nil || f.checkStopAfter(partition) ||
+			f.paused.discard(partition) {
 			return err
 		}
 
@@ -396,6 +409,11 @@ func (f *GocbDCPFeed) SnapshotMarker(startSeqNo, endSeqNo uint64,
 			}
 		}
 
+		err = f.batcher.snapshotStart(partition, endSeqNo)
+		if err != nil {
+			return err
+		}
+
 		return dest.SnapshotStart(partition, startSeqNo, endSeqNo)
 	}, f.stats.TimerSnapshotStart)
 
@@ -443,13 +461,33 @@ func (f *GocbDCPFeed) SnapshotMarker(startSeqNo, endSeqNo uint64,
 func (f *GocbDCPFeed) Mutation(seqNo, revNo uint64,
 	flags, expiry, lockTime uint32, cas uint64, datatype uint8, vbId uint16,
 	key, value []byte) {
-	err := Timer(func() error {
-		partition, dest, err :=
-			VBucketIdToPartitionDest(f.pf, f.dests, vbId, key)
-		if err != nil || f.checkStopAfter(partition) {
-			return err
+	partition, dest, err :=
+		VBucketIdToPartitionDest(f.pf, f.dests, vbId, key)
+	if err != nil || f.checkStopAfter(partition) ||
+		f.paused.discard(partition) {
+		if err != nil {
+			log.Warnf("feed_gocb_dcp: Error in accepting a DCP mutation, err: %v",
+				err)
+		} else {
+			f.lastReceivedSeqno[vbId] = seqNo
 		}
+		return
+	}
+
+	batched, err := f.batcher.add(partition, dest, key, seqNo, value,
+		cas, false, 0, nil)
+	if batched {
+		if err != nil {
+			log.Warnf("feed_gocb_dcp: Error in accepting a DCP mutation batch,"+
+				" name: %s, partition: %s, seq: %d, err: %v",
+				f.name, partition, seqNo, err)
+		} else {
+			f.lastReceivedSeqno[vbId] = seqNo
+		}
+		return
+	}
 
+	err = Timer(func() error {
 		if destEx, ok := dest.(DestEx); ok {
 			err = destEx.DataUpdateEx(partition, key, seqNo, value, cas, 0, nil)
 		} else {
@@ -478,13 +516,33 @@ func (f *GocbDCPFeed) Mutation(seqNo, revNo uint64,
 
 func (f *GocbDCPFeed) Deletion(seqNo, revNo, cas uint64, datatype uint8,
 	vbId uint16, key, value []byte) {
-	err := Timer(func() error {
-		partition, dest, err :=
-			VBucketIdToPartitionDest(f.pf, f.dests, vbId, key)
-		if err != nil || f.checkStopAfter(partition) {
-			return err
+	partition, dest, err :=
+		VBucketIdToPartitionDest(f.pf, f.dests, vbId, key)
+	if err != nil || f.checkStopAfter(partition) ||
+		f.paused.discard(partition) {
+		if err != nil {
+			log.Warnf("feed_gocb_dcp: Error in accepting a DCP deletion, err: %v",
+				err)
+		} else {
+			f.lastReceivedSeqno[vbId] = seqNo
 		}
+		return
+	}
+
+	batched, err := f.batcher.add(partition, dest, key, seqNo, nil,
+		cas, true, 0, nil)
+	if batched {
+		if err != nil {
+			log.Warnf("feed_gocb_dcp: Error in accepting a DCP deletion batch,"+
+				" name: %s, partition: %s, seq: %d, err: %v",
+				f.name, partition, seqNo, err)
+		} else {
+			f.lastReceivedSeqno[vbId] = seqNo
+		}
+		return
+	}
 
+	err = Timer(func() error {
 		if destEx, ok := dest.(DestEx); ok {
 			err = destEx.DataDeleteEx(partition, key, seqNo, cas, 0, nil)
 		} else {
@@ -560,7 +618,8 @@ func (f *GocbDCPFeed) setMetaData(vbId uint16, m *metaData) error {
 	return Timer(func() error {
 		partition, dest, err :=
 			VBucketIdToPartitionDest(f.pf, f.dests, vbId, nil)
-		if err != nil || f.checkStopAfter(partition) {
+		if err != nil || f.checkStopAfter(partition) ||
+			f.paused.discard(partition) {
 			return err
 		}
 
@@ -569,6 +628,11 @@ func (f *GocbDCPFeed) setMetaData(vbId uint16, m *metaData) error {
 			return err
 		}
 
+		err = f.batcher.flush(partition)
+		if err != nil {
+			return err
+		}
+
 		return dest.OpaqueSet(partition, value)
 	}, f.stats.TimerOpaqueSet)
 }
@@ -581,6 +645,11 @@ func (f *GocbDCPFeed) getMetaData(vbId uint16) (value []byte, lastSeq uint64, er
 			return err
 		}
 
+		err = f.batcher.flush(partition)
+		if err != nil {
+			return err
+		}
+
 		value, lastSeq, err = dest.OpaqueGet(partition)
 
 		return err
@@ -628,6 +697,8 @@ func (f *GocbDCPFeed) rollbackAndReinitiate(vbId uint16, entries []gocbcore.Fail
 			return err
 		}
 
+		f.batcher.reset(partition)
+
 		if destEx, ok := dest.(DestEx); ok {
 			return destEx.RollbackEx(partition, rollbackVbuuid, rollbackSeqno)
 		}
@@ -647,14 +718,141 @@ func (f *GocbDCPFeed) rollbackAndReinitiate(vbId uint16, entries []gocbcore.Fail
 
 // ----------------------------------------------------------------
 
+// PausePartition closes the DCP stream of a partition, where any
+// callbacks of the partition that are still in flight are discarded.
+func (f *GocbDCPFeed) PausePartition(partition string) error {
+	vbId, err := feedPartitionVBucketId(partition, f.dests)
+	if err != nil {
+		return err
+	}
+
+	if !f.paused.pause(partition) {
+		return nil
+	}
+
+	log.Printf("feed_gocb_dcp: pause, name: %s, partition: %s",
+		f.name, partition)
+
+	err = f.closeStream(vbId)
+	if err != nil {
+		return err
+	}
+
+	return f.batcher.flush(partition)
+}
+
+// ResumePartition reopens the DCP stream of a paused partition from
+// its dest's checkpoint.
+func (f *GocbDCPFeed) ResumePartition(partition string) error {
+	vbId, err := feedPartitionVBucketId(partition, f.dests)
+	if err != nil {
+		return err
+	}
+
+	wasPaused, discarded := f.paused.resume(partition)
+	if !wasPaused {
+		return nil
+	}
+
+	log.Printf("feed_gocb_dcp: resume, name: %s, partition: %s,"+
+		" discarded: %d", f.name, partition, discarded)
+
+	return f.initiateStream(vbId, true)
+}
+
+// SeekPartition closes the DCP stream of a partition, rolls back its
+// dest like a rollback from the server and then, unless the partition
+// is paused, reopens the stream from the dest's checkpoint.
+func (f *GocbDCPFeed) SeekPartition(partition string, seq uint64) error {
+	vbId, err := feedPartitionVBucketId(partition, f.dests)
+	if err != nil {
+		return err
+	}
+
+	vBucketUUID, err := feedPartitionSeekUUID(partition,
+		f.dests[partition], seq)
+	if err != nil {
+		return err
+	}
+
+	wasPaused := !f.paused.pause(partition)
+	if !wasPaused {
+		err = f.closeStream(vbId)
+		if err != nil {
+			f.paused.resume(partition)
+			return err
+		}
+	}
+
+	log.Printf("feed_gocb_dcp: seek, name: %s, partition: %s, seq: %d",
+		f.name, partition, seq)
+
+	f.batcher.reset(partition)
+
+	dest := f.dests[partition]
+	if destEx, ok := dest.(DestEx); ok && vBucketUUID != 0 {
+		err = destEx.RollbackEx(partition, vBucketUUID, seq)
+	} else {
+		err = dest.Rollback(partition, seq)
+	}
+	if err != nil || wasPaused {
+		return err
+	}
+
+	f.paused.resume(partition)
+
+	return f.initiateStream(vbId, true)
+}
+
+func (f *GocbDCPFeed) PausedPartitions() []string {
+	return f.paused.partitions()
+}
+
+// closeStream closes the DCP stream of a vbucket and waits for the
+// close to be acknowledged.
+func (f *GocbDCPFeed) closeStream(vbId uint16) error {
+	signal := make(chan error, 1)
+	op, err := f.agent.CloseStream(vbId, func(er error) {
+		signal <- er
+	})
+	if err != nil {
+		return err
+	}
+
+	timeoutTmr := gocbcore.AcquireTimer(60 * time.Second)
+	select {
+	case err = <-signal:
+		gocbcore.ReleaseTimer(timeoutTmr, false)
+	case <-timeoutTmr.C:
+		gocbcore.ReleaseTimer(timeoutTmr, true)
+		if !op.Cancel() {
+			err = <-signal
+		} else {
+			err = gocb.ErrTimeout
+		}
+	}
+
+	if err != nil && err != gocb.ErrStreamClosed {
+		return err
+	}
+
+	f.complete(vbId)
+
+	return nil
+}
+
+// ----------------------------------------------------------------
+
 func (f *GocbDCPFeed) wait() {
 	f.remaining.Wait()
 }
 
 func (f *GocbDCPFeed) complete(vbId uint16) {
 	f.m.Lock()
-	f.remaining.Done()
-	f.active[vbId] = false
+	if f.active[vbId] {
+		f.remaining.Done()
+		f.active[vbId] = false
+	}
 	f.m.Unlock()
 }
 
@@ -12,18 +12,21 @@
 package cbgt
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"hash"
 	"hash/crc32"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/couchbase/clog"
@@ -33,6 +36,23 @@ const FILES_FEED_SLEEP_START_MS = 5000
 const FILES_FEED_BACKOFF_FACTOR = 1.5
 const FILES_FEED_MAX_SLEEP_MS = 1000 * 60 * 5 // 5 minutes.
 
+// FILES_FEED_NOTIFY_BATCH_MS is how long a FilesFeed gathers change
+// notifications before emitting them.
+const FILES_FEED_NOTIFY_BATCH_MS = 200
+
+// FILES_FEED_MOD_TIME_SLACK_MS allows for coarse file modification
+// times and for in-flight change notifications, so that a restarted
+// FilesFeed re-emits rather than misses recently changed files.
+const FILES_FEED_MOD_TIME_SLACK_MS = 5000
+
+// FILES_FEED_MAX_SNAPSHOT_SIZE bounds the number of files that are
+// read into memory and emitted as a single snapshot.
+const FILES_FEED_MAX_SNAPSHOT_SIZE = 1000
+
+// FILES_FEED_MANIFEST_COMPACT_MIN is the minimum number of journaled
+// entries before a partition's manifest is compacted.
+const FILES_FEED_MANIFEST_COMPACT_MIN = 10000
+
 func init() {
 	RegisterFeedType("files", &FeedType{
 		Start:      StartFilesFeed,
@@ -45,6 +65,7 @@ func init() {
 			SleepStartMS:  FILES_FEED_SLEEP_START_MS,
 			BackoffFactor: FILES_FEED_BACKOFF_FACTOR,
 			MaxSleepMS:    FILES_FEED_MAX_SLEEP_MS,
+			NotifyBatchMS: FILES_FEED_NOTIFY_BATCH_MS,
 		},
 	})
 }
@@ -59,28 +80,82 @@ func init() {
 // FilesFeed supports optional regexp patterns to allow you to filter
 // for only the file paths that you want.
 //
+// FilesFeed first walks the subdirectory tree and then follows its
+// changes through change notifications (inotify, on linux).  When
+// notifications aren't available (or are disabled with the
+// disableNotify sourceParam), FilesFeed instead polls by walking the
+// whole subdirectory tree with exponential backoff.  Files that are
+// removed or that stop matching are emitted as deletions.
+//
+// Each source partition has its own sequence numbers, which are
+// persisted along with a file modification time high-watermark via
+// the Dest's OpaqueSet(), so that a restarted FilesFeed continues
+// from its previous sequence numbers and only re-emits the files that
+// were modified since.
+//
+// Each source partition also has a manifest of its files, persisted
+// under <dataDir>/files-feeds/<indexName> as a journal of JSON lines
+// that's appended to after every emit, and that's compacted on start
+// and once it's mostly superseded entries.  A
+// restarted FilesFeed diffs its manifests against the subdirectory
+// tree, so that the files removed while it was stopped are emitted as
+// deletions, and so that unchanged files aren't re-read.  Manifest
+// entries that are newer than the dest's persisted seq are ignored.
+//
+// By default, a file is emitted as a single FileDoc.  With a format
+// of jsonl or csv, each line or row of a file is instead emitted as
+// its own document, keyed by its position or by a KeyField.  Appends
+// to an uncompressed file only emit the appended records, while a
+// rewritten file has all its records re-emitted and its missing
+// records deleted.  Files can also be gzip, zip or tar archives,
+// whose members are then the units that are split into records.
+//
+// FilesFeed is meant to scale to millions of files per feed with
+// change notifications, where the work after the initial walk is in
+// proportion to the changed files.
+//
 // Limitations:
 //
-// - Only a small number of files will work well (hundreds to low
-// thousands, not millions).
+// - The state of every file is tracked in memory, at roughly 200
+// bytes plus the length of its path, so a million files take a few
+// hundred MB per feed.  The keys of the records of archives and of
+// files with a KeyField are also tracked in memory and in the
+// manifests.  Archives are re-read whole on every change.
 //
-// - FilesFeed polls for file modification timestamp changes as a
-// poor-man's approach instead of properly tracking sequence numbers.
-// That has implications such as whenever a FilesFeed (re-)starts
-// (e.g., the process restarts), the FilesFeed will re-emits all files
-// and then track the max modification timestamp going forwards as it
-// regularly polls for file changes.
+// - Every start, and every rescan after lost notifications, walks and
+// stats the whole subdirectory tree, but only re-reads the files that
+// changed since their manifest entries.  Every poll also walks and
+// stats the whole tree, so polling suits up to about a hundred
+// thousand files per feed.
+//
+// - inotify needs a watch per directory, which is limited by the
+// fs.inotify.max_user_watches sysctl, and the feed falls back to
+// polling when the watches run out.
 type FilesFeed struct {
 	mgr        *Manager
 	name       string
 	indexName  string
 	sourceName string
 	params     *FilesFeedParams
+	regExps    []*regexp.Regexp
 	dests      map[string]Dest
 	disable    bool
 
 	m       sync.Mutex
 	closeCh chan struct{}
+
+	stats FilesFeedStats
+
+	// The manifests of the partitions are kept in the stateDir, unless
+	// it's empty.
+	stateDir string
+
+	// The following are only accessed by the feed's goroutine.
+	walkPath   string
+	h          hash.Hash32
+	partitions []string
+	parts      map[string]*filesFeedPartition // Keyed by partition.
+	scanGen    uint64
 }
 
 // FilesFeedParams represents the JSON expected as the sourceParams
@@ -92,6 +167,34 @@ type FilesFeedParams struct {
 	SleepStartMS  int      `json:"sleepStartMS"`
 	BackoffFactor float32  `json:"backoffFactor"`
 	MaxSleepMS    int      `json:"maxSleepMS"`
+
+	// DisableNotify, when true, polls instead of using change
+	// notifications.
+	DisableNotify bool `json:"disableNotify"`
+	NotifyBatchMS int  `json:"notifyBatchMS"`
+
+	// Format is how a file is split into records, which are emitted
+	// as separate documents, and is one of FILES_FEED_FORMAT_XXX.
+	Format string `json:"format"`
+
+	// Archive is how a file is compressed or bundled, and is one of
+	// FILES_FEED_ARCHIVE_XXX.
+	Archive string `json:"archive"`
+
+	// KeyField, if non-empty, is the dotted path of a jsonl field or
+	// the name of a csv column whose values are the record keys,
+	// instead of the default keys of <path>[!<member>]#<recordNum>.
+	KeyField string `json:"keyField"`
+}
+
+// FilesFeedStats holds the counters of a FilesFeed.
+type FilesFeedStats struct {
+	TotScan       uint64 // Walks of the whole subdirectory tree.
+	TotNotify     uint64 // Change notifications.
+	TotDataUpdate uint64
+	TotDataDelete uint64
+	TotReadErr    uint64
+	TotParseErr   uint64 // Records that couldn't be parsed or keyed.
 }
 
 // FileDoc represents the JSON for each file/document that will be
@@ -102,6 +205,84 @@ type FileDoc struct {
 	Contents string `json:"contents"`
 }
 
+// filesFeedPartition tracks the files of a source partition.
+type filesFeedPartition struct {
+	seq        uint64
+	modTimeGTE int64 // Unix nanoseconds.
+	files      map[string]*filesFeedFile
+
+	manifest        *os.File // Opened for appends, nil when disabled.
+	manifestEntries int
+	manifestLoaded  bool // Whether the files were restored from it.
+}
+
+type filesFeedFile struct {
+	modTime int64 // Unix nanoseconds.
+	size    int64
+	scanGen uint64 // The last full walk that saw the file.
+	seq     uint64 // The partition's seq when it was journaled.
+
+	// The following are for record oriented formats, where an
+	// uncompressed file is read incrementally from its offset.
+	offset     int64    // After the last complete record.
+	tailCRC    uint32   // Of the bytes before the offset.
+	numRecords uint64   // For positional record keys.
+	header     []string // Of a csv file.
+	keys       []string // When they can't be derived from numRecords.
+}
+
+// filesFeedOpaque is the JSON persisted with the Dest's OpaqueSet().
+type filesFeedOpaque struct {
+	Seq        uint64 `json:"seq"`
+	ModTimeGTE int64  `json:"modTimeGTE"`
+}
+
+// filesFeedManifestEntry is a JSON line of a partition's manifest,
+// where the path is relative to the subdirectory tree.
+type filesFeedManifestEntry struct {
+	Seq  uint64                 `json:"seq"`
+	Path string                 `json:"path"`
+	File *filesFeedManifestFile `json:"file,omitempty"` // Nil if removed.
+}
+
+type filesFeedManifestFile struct {
+	ModTime    int64    `json:"modTime"`
+	Size       int64    `json:"size"`
+	Offset     int64    `json:"offset,omitempty"`
+	TailCRC    uint32   `json:"tailCRC,omitempty"`
+	NumRecords uint64   `json:"numRecords,omitempty"`
+	Header     []string `json:"header,omitempty"`
+	Keys       []string `json:"keys,omitempty"`
+}
+
+// filesFeedBatch holds the files to be emitted, keyed by partition
+// and then by path, where a nil filesFeedFile means a deletion.
+type filesFeedBatch map[string]map[string]*filesFeedFile
+
+func (b filesFeedBatch) add(partition, path string, f *filesFeedFile) {
+	m := b[partition]
+	if m == nil {
+		m = map[string]*filesFeedFile{}
+		b[partition] = m
+	}
+	m[path] = f
+}
+
+// filesWatcher delivers change notifications for a subdirectory
+// tree, and has platform specific implementations.
+type filesWatcher interface {
+	Events() <-chan filesWatchEvent
+	Close() error
+}
+
+// filesWatchEvent is a change notification from a filesWatcher.
+type filesWatchEvent struct {
+	Path   string // A file or directory that might have changed.
+	Dir    bool
+	Rescan bool  // When notifications were lost.
+	Err    error // When the filesWatcher failed.
+}
+
 // StartFilesFeed starts a FilesFeed and is the the callback function
 // registered at init/startup time.
 func StartFilesFeed(mgr *Manager, feedName, indexName, indexUUID,
@@ -147,15 +328,37 @@ func NewFilesFeed(mgr *Manager, name, indexName, sourceName,
 		}
 	}
 
+	err := filesFeedCheckFormat(params)
+	if err != nil {
+		return nil, err
+	}
+
+	var regExps []*regexp.Regexp
+	for _, reStr := range params.RegExps {
+		re, err := regexp.Compile(reStr)
+		if err != nil {
+			return nil, fmt.Errorf("feed_files: could not compile,"+
+				" reStr: %s, err: %v", reStr, err)
+		}
+		regExps = append(regExps, re)
+	}
+
+	var stateDir string
+	if mgr != nil {
+		stateDir = filepath.Join(mgr.DataDir(), "files-feeds", indexName)
+	}
+
 	return &FilesFeed{
 		mgr:        mgr,
 		name:       name,
 		indexName:  indexName,
 		sourceName: sourceName,
 		params:     params,
+		regExps:    regExps,
 		dests:      dests,
 		disable:    disable,
 		closeCh:    make(chan struct{}),
+		stateDir:   stateDir,
 	}, nil
 }
 
@@ -173,6 +376,158 @@ func (t *FilesFeed) Start() error {
 		return nil
 	}
 
+	numPartitions := t.params.NumPartitions
+	if numPartitions < 0 {
+		numPartitions = 0
+	}
+
+	t.h = crc32.NewIEEE()
+	t.partitions = make([]string, numPartitions)
+	for i := 0; i < len(t.partitions); i++ {
+		t.partitions[i] = strconv.Itoa(i)
+	}
+
+	t.m.Lock()
+	closeCh := t.closeCh
+	t.m.Unlock()
+
+	if closeCh == nil {
+		return nil // Closed.
+	}
+
+	go t.run(closeCh)
+
+	return nil
+}
+
+func (t *FilesFeed) run(closeCh chan struct{}) {
+	walkPath, err := filepath.EvalSymlinks(t.mgr.DataDir() +
+		string(os.PathSeparator) + "files" +
+		string(os.PathSeparator) + t.sourceName)
+	if err != nil {
+		log.Warnf("feed_files: missing source dir,"+
+			" name: %s, err: %v", t.Name(), err)
+		return
+	}
+
+	t.walkPath = walkPath
+
+	err = t.loadPartitions()
+	if err != nil {
+		log.Warnf("feed_files: name: %s, err: %v", t.Name(), err)
+		return
+	}
+
+	defer t.closeManifests()
+
+	// The watcher is created before the initial walk so that changes
+	// during the walk aren't missed.
+	var watcher filesWatcher
+	if !t.params.DisableNotify {
+		watcher, err = newFilesWatcher(walkPath)
+		if err != nil {
+			log.Printf("feed_files: polling instead of notify,"+
+				" name: %s, err: %v", t.Name(), err)
+			watcher = nil
+		}
+	}
+
+	_, err = t.scanAll(walkPath, true)
+	if err != nil {
+		if watcher != nil {
+			watcher.Close()
+		}
+		log.Warnf("feed_files: name: %s, err: %v", t.Name(), err)
+		return
+	}
+
+	// The manifests are rewritten after the initial walk, which tracked
+	// the files that it didn't emit, and are then only appended to.
+	for partition, p := range t.parts {
+		t.compactManifest(partition, p)
+	}
+
+	if watcher != nil {
+		notifyLost, err := t.notifyLoop(watcher, walkPath, closeCh)
+		watcher.Close()
+		if err != nil {
+			log.Warnf("feed_files: name: %s, err: %v", t.Name(), err)
+			return
+		}
+		if !notifyLost {
+			return // Closed.
+		}
+		log.Printf("feed_files: polling after notify lost,"+
+			" name: %s", t.Name())
+	}
+
+	t.pollLoop(walkPath, closeCh)
+}
+
+// notifyLoop emits the changes from the watcher's notifications until
+// the feed is closed, and returns true when notifications were lost
+// and the feed should instead poll.
+func (t *FilesFeed) notifyLoop(watcher filesWatcher, walkPath string,
+	closeCh chan struct{}) (bool, error) {
+	batchMS := t.params.NotifyBatchMS
+	if batchMS <= 0 {
+		batchMS = FILES_FEED_NOTIFY_BATCH_MS
+	}
+
+	events := watcher.Events()
+
+	for {
+		pending := map[string]bool{} // Keyed by path, value is dir-ness.
+		rescan := false
+
+		var batchCh <-chan time.Time
+
+	GATHER:
+		for {
+			select {
+			case <-closeCh:
+				return false, nil
+
+			case ev, ok := <-events:
+				if !ok || ev.Err != nil {
+					log.Warnf("feed_files: notify, name: %s, err: %v",
+						t.Name(), ev.Err)
+					return true, nil
+				}
+
+				atomic.AddUint64(&t.stats.TotNotify, 1)
+
+				if ev.Rescan {
+					rescan = true
+				} else {
+					pending[ev.Path] = pending[ev.Path] || ev.Dir
+				}
+
+				if batchCh == nil {
+					batchCh = time.After(time.Duration(batchMS) *
+						time.Millisecond)
+				}
+
+			case <-batchCh:
+				break GATHER
+			}
+		}
+
+		var err error
+		if rescan {
+			_, err = t.scanAll(walkPath, false)
+		} else {
+			_, err = t.scanPaths(pending)
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// pollLoop walks the whole subdirectory tree with exponential backoff
+// until the feed is closed.
+func (t *FilesFeed) pollLoop(walkPath string, closeCh chan struct{}) {
 	startSleepMS := t.params.SleepStartMS
 	if startSleepMS <= 0 {
 		startSleepMS = FILES_FEED_SLEEP_START_MS
@@ -188,181 +543,592 @@ func (t *FilesFeed) Start() error {
 		maxSleepMS = FILES_FEED_MAX_SLEEP_MS
 	}
 
-	numPartitions := t.params.NumPartitions
-	if numPartitions < 0 {
-		numPartitions = 0
+	ExponentialBackoffLoop(t.Name(),
+		func() int {
+			select {
+			case <-closeCh:
+				return -1
+			default:
+			}
+
+			n, err := t.scanAll(walkPath, false)
+			if err != nil {
+				log.Warnf("feed_files: name: %s, err: %v", t.Name(), err)
+				return -1
+			}
+			if n > 0 {
+				return 1
+			}
+			return 0
+		},
+		startSleepMS,
+		backoffFactor,
+		maxSleepMS)
+}
+
+// loadPartitions restores the sequence numbers and modification time
+// high-watermarks of the partitions from their dests, and their files
+// from their manifests.
+func (t *FilesFeed) loadPartitions() error {
+	t.parts = map[string]*filesFeedPartition{}
+
+	for partition, dest := range t.dests {
+		value, lastSeq, err := dest.OpaqueGet(partition)
+		if err != nil {
+			return fmt.Errorf("feed_files: OpaqueGet,"+
+				" partition: %s, err: %v", partition, err)
+		}
+
+		var opaque filesFeedOpaque
+		if len(value) > 0 {
+			err = json.Unmarshal(value, &opaque)
+			if err != nil {
+				return fmt.Errorf("feed_files: could not parse opaque,"+
+					" partition: %s, value: %s, err: %v",
+					partition, value, err)
+			}
+		}
+
+		if opaque.Seq < lastSeq {
+			opaque.Seq = lastSeq
+		}
+
+		p := &filesFeedPartition{
+			seq:        opaque.Seq,
+			modTimeGTE: opaque.ModTimeGTE,
+			files:      map[string]*filesFeedFile{},
+		}
+
+		t.loadManifest(partition, p)
+
+		t.parts[partition] = p
+	}
+
+	return nil
+}
+
+// scanAll walks the whole subdirectory tree and emits the new,
+// changed and removed files.  On the initial walk, the files that
+// were modified before the persisted high-watermark are only tracked
+// and not re-emitted.
+func (t *FilesFeed) scanAll(walkPath string, initial bool) (int, error) {
+	// A missing subdirectory tree isn't treated as having had all its
+	// files removed.
+	_, err := os.Stat(walkPath)
+	if err != nil {
+		return 0, fmt.Errorf("feed_files: scan, err: %v", err)
 	}
 
-	partitions := make([]string, numPartitions)
-	for i := 0; i < len(partitions); i++ {
-		partitions[i] = strconv.Itoa(i)
+	atomic.AddUint64(&t.stats.TotScan, 1)
+
+	modTimeGTE := filesFeedModTimeGTE()
+
+	t.scanGen++
+
+	batch := filesFeedBatch{}
+
+	t.walk(walkPath, initial, batch)
+
+	for partition, p := range t.parts {
+		for path, f := range p.files {
+			if f.scanGen != t.scanGen {
+				batch.add(partition, path, nil)
+			}
+		}
 	}
 
-	go func() {
-		initTime := time.Now()
-		initTimeMicroSecs := initTime.UnixNano() / int64(1000)
+	return t.emit(batch, modTimeGTE)
+}
+
+// scanPaths emits the changes of the notified paths.
+func (t *FilesFeed) scanPaths(paths map[string]bool) (int, error) {
+	modTimeGTE := filesFeedModTimeGTE()
+
+	batch := filesFeedBatch{}
+
+	for path, dir := range paths {
+		fi, err := os.Lstat(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Warnf("feed_files: lstat, name: %s, path: %s, err: %v",
+					t.Name(), path, err)
+				continue
+			}
 
-		// TODO: NOTE: We're assuming (lazily, incorrectly) that this
-		// way of initializing a sequence number never goes downwards,
-		// even during fast restarts or clock changes or node
-		// rebalances/reassignments.
-		seqs := map[string]uint64{}
-		for partition := range t.dests {
-			seqs[partition] = uint64(initTimeMicroSecs)
+			if dir {
+				t.removeDir(path, batch)
+			} else {
+				t.check(path, nil, false, batch)
+			}
+			continue
 		}
 
-		var prevStartTime time.Time
+		if fi.IsDir() {
+			t.walk(path, false, batch)
+		} else {
+			t.check(path, fi, false, batch)
+		}
+	}
 
-		ExponentialBackoffLoop(t.Name(),
-			func() int {
-				t.m.Lock()
-				closeCh := t.closeCh
-				t.m.Unlock()
+	return t.emit(batch, modTimeGTE)
+}
 
-				select {
-				case <-closeCh:
-					return -1
-				default:
-				}
+func (t *FilesFeed) walk(root string, initial bool, batch filesFeedBatch) {
+	filepath.Walk(root,
+		func(path string, fi os.FileInfo, err error) error {
+			if err == nil && !fi.IsDir() {
+				t.check(path, fi, initial, batch)
+			}
+			return nil
+		})
+}
+
+// check adds a file to the batch if it's new or changed, or if it's
+// known but is gone (nil fi) or no longer matches.
+func (t *FilesFeed) check(path string, fi os.FileInfo, initial bool,
+	batch filesFeedBatch) {
+	partition := FilesPathToPartition(t.h, t.partitions, path)
+
+	p := t.parts[partition]
+	if p == nil {
+		return
+	}
 
-				h := crc32.NewIEEE()
+	prev := p.files[path]
 
-				startTime := time.Now()
+	if fi == nil || !t.matches(path, fi) {
+		if prev != nil {
+			batch.add(partition, path, nil)
+		}
+		return
+	}
+
+	f := &filesFeedFile{
+		modTime: fi.ModTime().UnixNano(),
+		size:    fi.Size(),
+		scanGen: t.scanGen,
+	}
+
+	if prev != nil {
+		prev.scanGen = t.scanGen
+		if prev.modTime == f.modTime && prev.size == f.size {
+			return
+		}
+	}
 
-				progress := false
+	if initial && prev == nil && !p.manifestLoaded &&
+		f.modTime < p.modTimeGTE {
+		// Emitted before a restart without a manifest, so the state of
+		// a record oriented file is rebuilt by re-reading it.
+		if t.wholeFile(path) {
+			p.files[path] = f
+		} else if _, err := t.readRecords(path, nil, f); err == nil {
+			p.files[path] = f
+		}
+		return
+	}
+
+	batch.add(partition, path, f)
+}
+
+// removeDir adds the known files under a removed directory to the
+// batch as deletions.
+func (t *FilesFeed) removeDir(dir string, batch filesFeedBatch) {
+	prefix := dir + string(os.PathSeparator)
+
+	for partition, p := range t.parts {
+		for path := range p.files {
+			if strings.HasPrefix(path, prefix) {
+				batch.add(partition, path, nil)
+			}
+		}
+	}
+}
 
-				paths, err := FilesFindMatches(t.mgr.DataDir(),
-					t.sourceName, t.params.RegExps, prevStartTime,
-					t.params.MaxFileSize)
+func (t *FilesFeed) matches(path string, fi os.FileInfo) bool {
+	if t.params.MaxFileSize > 0 && fi.Size() > t.params.MaxFileSize {
+		return false
+	}
+
+	if len(t.regExps) <= 0 {
+		return true
+	}
+
+	for _, re := range t.regExps {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// emit sends the records of the batch's files to the dests, as
+// snapshots of at most FILES_FEED_MAX_SNAPSHOT_SIZE records, and
+// returns the number of emitted records.  A partition's modTimeGTE is
+// only persisted with its last snapshot, after all its changes have
+// been emitted.
+func (t *FilesFeed) emit(batch filesFeedBatch, modTimeGTE int64) (
+	int, error) {
+	n := 0
+
+	for partition, files := range batch {
+		p := t.parts[partition]
+		dest := t.dests[partition]
+
+		paths := make([]string, 0, len(files))
+		for path := range files {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+
+		var recs []*filesFeedRecord
+
+		for _, path := range paths {
+			recs = append(recs, t.prepare(p, path, files[path])...)
+
+			for len(recs) >= FILES_FEED_MAX_SNAPSHOT_SIZE {
+				err := t.emitRecords(partition, p, dest,
+					recs[:FILES_FEED_MAX_SNAPSHOT_SIZE], p.modTimeGTE)
 				if err != nil {
-					log.Warnf("feed_files, FilesFindMatches, err: %v", err)
-					return -1
+					return n, err
 				}
 
-				seqDeltaMax := uint64(0)
+				n += FILES_FEED_MAX_SNAPSHOT_SIZE
+				recs = recs[FILES_FEED_MAX_SNAPSHOT_SIZE:]
+			}
+		}
 
-				seqEnds := map[string]uint64{}
+		err := t.emitRecords(partition, p, dest, recs, modTimeGTE)
+		if err != nil {
+			return n, err
+		}
 
-				for _, path := range paths {
-					partition := FilesPathToPartition(h, partitions, path)
+		n += len(recs)
 
-					if t.dests[partition] == nil {
-						continue
-					}
+		t.appendManifest(partition, p, paths)
+	}
 
-					seq := seqs[partition]
+	return n, nil
+}
 
-					seqEnd, exists := seqEnds[partition]
-					if exists {
-						seqEnd = seqEnd + 1
-					} else {
-						seqEnd = seq
-					}
-					seqEnds[partition] = seqEnd
+// prepare reads a file of the batch, updates its tracked state, and
+// returns its records to be emitted, where a nil f means the file is
+// gone.
+func (t *FilesFeed) prepare(p *filesFeedPartition, path string,
+	f *filesFeedFile) []*filesFeedRecord {
+	prev := p.files[path]
+
+	if f != nil {
+		recs, err := t.readRecords(path, prev, f)
+		if err == nil {
+			p.files[path] = f
+			return recs
+		}
 
-					if seqDeltaMax < seqEnd-seq {
-						seqDeltaMax = seqEnd - seq
-					}
-				}
+		if !os.IsNotExist(err) {
+			atomic.AddUint64(&t.stats.TotReadErr, 1)
+			log.Warnf("feed_files: read file,"+
+				" name: %s, path: %s, err: %v", t.Name(), path, err)
+			return nil
+		}
 
-				snapshotSent := map[string]bool{}
-
-				for _, path := range paths {
-					select {
-					case <-closeCh:
-						return -1
-					default:
-					}
-
-					partition := FilesPathToPartition(h, partitions, path)
-
-					dest := t.dests[partition]
-					if dest == nil {
-						continue
-					}
-
-					seqCur := seqs[partition]
-					seqs[partition] = seqCur + 1
-
-					buf, err := ioutil.ReadFile(path)
-					if err != nil {
-						log.Warnf("feed_files: read file,"+
-							" name: %s, path: %s, err: %v",
-							t.Name(), path, err)
-						continue
-					}
-
-					jbuf, err := json.Marshal(FileDoc{
-						Name:     filepath.Base(path),
-						Path:     path,
-						Contents: string(buf),
-					})
-					if err != nil {
-						log.Warnf("feed_files: json marshal file,"+
-							" name: %s, path: %s, err: %v",
-							t.Name(), path, err)
-						continue
-					}
-
-					if !snapshotSent[partition] {
-						err = dest.SnapshotStart(partition, seqCur,
-							seqEnds[partition])
-						if err != nil {
-							log.Warnf("feed_files: SnapshotStart,"+
-								" name: %s, partition: %s, seqCur: %d,"+
-								" seqEnd: %d, err: %v", t.Name(), partition,
-								seqCur, seqEnds[partition], err)
-							return -1
-						}
-
-						snapshotSent[partition] = true
-					}
-
-					pathBuf := []byte(path)
-
-					err = dest.DataUpdate(partition, pathBuf, seqCur,
-						jbuf, 0, DEST_EXTRAS_TYPE_NIL, nil)
-					if err != nil {
-						log.Warnf("feed_files: DataUpdate,"+
-							" name: %s, path: %s, partition: %s,"+
-							" seqCur: %d, err: %v", t.Name(), path,
-							partition, seqCur, err)
-						return -1
-					}
-
-					progress = true
-				}
+		// Otherwise, the file was removed since the scan.
+	}
 
-				prevStartTime = startTime
-
-				// NOTE: We may need to sleep a certain amount in case
-				// there were tons of file updates/mutations, and we
-				// want to reduce the window of potentially repeating
-				// sequence numbers.  The window still exists if we
-				// crash and quickly restart during the sleep, where
-				// the restarted process might have a
-				// lower-than-wanted initTime.
-				wantTime := initTime // Copy, because Add() mutates.
-				wantTime.Add(time.Duration(int64(seqDeltaMax)))
-
-				currTime := time.Now()
-				if wantTime.After(currTime) {
-					time.Sleep(wantTime.Sub(currTime))
-				}
+	if prev == nil {
+		return nil
+	}
 
-				if progress {
-					return 1
-				}
-				return 0
-			},
-			startSleepMS,
-			backoffFactor,
-			maxSleepMS)
-	}()
+	delete(p.files, path)
+
+	keys := t.fileKeys(path, prev)
+
+	recs := make([]*filesFeedRecord, len(keys))
+	for i, key := range keys {
+		recs[i] = &filesFeedRecord{key: key, deleted: true}
+	}
+
+	return recs
+}
+
+// emitRecords sends the records to a partition's dest as a snapshot,
+// and then persists the partition's seq and the modTimeGTE.
+func (t *FilesFeed) emitRecords(partition string, p *filesFeedPartition,
+	dest Dest, recs []*filesFeedRecord, modTimeGTE int64) error {
+	if len(recs) > 0 {
+		err := dest.SnapshotStart(partition,
+			p.seq+1, p.seq+uint64(len(recs)))
+		if err != nil {
+			return fmt.Errorf("feed_files: SnapshotStart,"+
+				" name: %s, partition: %s, err: %v",
+				t.Name(), partition, err)
+		}
+	}
+
+	for _, rec := range recs {
+		seq := p.seq + 1
+
+		if rec.deleted {
+			err := dest.DataDelete(partition, []byte(rec.key), seq,
+				0, DEST_EXTRAS_TYPE_NIL, nil)
+			if err != nil {
+				return fmt.Errorf("feed_files: DataDelete,"+
+					" name: %s, key: %s, partition: %s,"+
+					" seq: %d, err: %v", t.Name(), rec.key,
+					partition, seq, err)
+			}
+
+			atomic.AddUint64(&t.stats.TotDataDelete, 1)
+		} else {
+			err := dest.DataUpdate(partition, []byte(rec.key), seq,
+				rec.val, 0, DEST_EXTRAS_TYPE_NIL, nil)
+			if err != nil {
+				return fmt.Errorf("feed_files: DataUpdate,"+
+					" name: %s, key: %s, partition: %s,"+
+					" seq: %d, err: %v", t.Name(), rec.key,
+					partition, seq, err)
+			}
+
+			atomic.AddUint64(&t.stats.TotDataUpdate, 1)
+		}
+
+		p.seq = seq
+	}
+
+	buf, _ := json.Marshal(filesFeedOpaque{
+		Seq:        p.seq,
+		ModTimeGTE: modTimeGTE,
+	})
+
+	err := dest.OpaqueSet(partition, buf)
+	if err != nil {
+		return fmt.Errorf("feed_files: OpaqueSet,"+
+			" name: %s, partition: %s, err: %v",
+			t.Name(), partition, err)
+	}
+
+	p.modTimeGTE = modTimeGTE
 
 	return nil
 }
 
+// -----------------------------------------------------
+
+func (t *FilesFeed) manifestPath(partition string) string {
+	return filepath.Join(t.stateDir, "partition-"+partition+".manifest")
+}
+
+// loadManifest replays a partition's manifest into its files, keeping
+// only the entries that the dest has persisted, and stops at a torn
+// or unparsable entry.
+func (t *FilesFeed) loadManifest(partition string, p *filesFeedPartition) {
+	if t.stateDir == "" {
+		return
+	}
+
+	f, err := os.Open(t.manifestPath(partition))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("feed_files: open manifest, name: %s,"+
+				" partition: %s, err: %v", t.Name(), partition, err)
+		}
+		return
+	}
+	defer f.Close()
+
+	p.manifestLoaded = true
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var e filesFeedManifestEntry
+		err = dec.Decode(&e)
+		if err != nil {
+			if err != io.EOF {
+				log.Warnf("feed_files: manifest, name: %s,"+
+					" partition: %s, err: %v", t.Name(), partition, err)
+			}
+			return
+		}
+
+		if e.Seq > p.seq {
+			continue // Lost by the dest, so its earlier entry is kept.
+		}
+
+		path := filepath.Join(t.walkPath, e.Path)
+		if e.File == nil {
+			delete(p.files, path)
+			continue
+		}
+
+		p.files[path] = &filesFeedFile{
+			modTime:    e.File.ModTime,
+			size:       e.File.Size,
+			seq:        e.Seq,
+			offset:     e.File.Offset,
+			tailCRC:    e.File.TailCRC,
+			numRecords: e.File.NumRecords,
+			header:     e.File.Header,
+			keys:       e.File.Keys,
+		}
+	}
+}
+
+// compactManifest rewrites a partition's manifest with its current
+// files, and then opens it for appends.
+func (t *FilesFeed) compactManifest(partition string,
+	p *filesFeedPartition) {
+	if t.stateDir == "" {
+		return
+	}
+
+	t.closeManifest(p)
+
+	err := t.writeManifest(partition, p)
+	if err != nil {
+		log.Warnf("feed_files: write manifest, name: %s,"+
+			" partition: %s, err: %v", t.Name(), partition, err)
+		return
+	}
+
+	p.manifest, err = os.OpenFile(t.manifestPath(partition),
+		os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		log.Warnf("feed_files: open manifest, name: %s,"+
+			" partition: %s, err: %v", t.Name(), partition, err)
+		return
+	}
+
+	p.manifestEntries = len(p.files)
+}
+
+func (t *FilesFeed) writeManifest(partition string,
+	p *filesFeedPartition) error {
+	err := os.MkdirAll(t.stateDir, 0700)
+	if err != nil {
+		return err
+	}
+
+	path := t.manifestPath(partition)
+
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+
+	for filePath, ff := range p.files {
+		err = enc.Encode(t.manifestEntry(filePath, ff, ff.seq))
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// appendManifest journals the current state of a partition's emitted
+// paths, and compacts the manifest once it's mostly superseded
+// entries.  A manifest that can't be written is disabled, as the dest
+// has the emitted changes either way.
+func (t *FilesFeed) appendManifest(partition string,
+	p *filesFeedPartition, paths []string) {
+	if p.manifest == nil {
+		return
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+
+	for _, path := range paths {
+		f := p.files[path]
+		if f != nil {
+			f.seq = p.seq
+		}
+		enc.Encode(t.manifestEntry(path, f, p.seq))
+	}
+
+	_, err := p.manifest.Write(buf.Bytes())
+	if err == nil {
+		err = p.manifest.Sync()
+	}
+	if err != nil {
+		log.Warnf("feed_files: append manifest, name: %s,"+
+			" partition: %s, err: %v", t.Name(), partition, err)
+		t.closeManifest(p)
+		return
+	}
+
+	p.manifestEntries += len(paths)
+
+	if p.manifestEntries >= FILES_FEED_MANIFEST_COMPACT_MIN &&
+		p.manifestEntries >= 2*len(p.files) {
+		t.compactManifest(partition, p)
+	}
+}
+
+// manifestEntry returns the manifest entry of a file, where a nil f
+// means the file is gone.
+func (t *FilesFeed) manifestEntry(path string, f *filesFeedFile,
+	seq uint64) *filesFeedManifestEntry {
+	rel, err := filepath.Rel(t.walkPath, path)
+	if err != nil {
+		rel = path
+	}
+
+	e := &filesFeedManifestEntry{Seq: seq, Path: rel}
+	if f != nil {
+		e.File = &filesFeedManifestFile{
+			ModTime:    f.modTime,
+			Size:       f.size,
+			Offset:     f.offset,
+			TailCRC:    f.tailCRC,
+			NumRecords: f.numRecords,
+			Header:     f.header,
+			Keys:       f.keys,
+		}
+	}
+
+	return e
+}
+
+func (t *FilesFeed) closeManifest(p *filesFeedPartition) {
+	if p.manifest != nil {
+		p.manifest.Close()
+		p.manifest = nil
+	}
+}
+
+func (t *FilesFeed) closeManifests() {
+	for _, p := range t.parts {
+		t.closeManifest(p)
+	}
+}
+
+// filesFeedModTimeGTE returns the modification time high-watermark
+// for changes that are about to be scanned.
+func filesFeedModTimeGTE() int64 {
+	return time.Now().Add(-FILES_FEED_MOD_TIME_SLACK_MS *
+		time.Millisecond).UnixNano()
+}
+
 func (t *FilesFeed) Close() error {
 	t.m.Lock()
 	if t.closeCh != nil {
@@ -379,7 +1145,15 @@ func (t *FilesFeed) Dests() map[string]Dest {
 }
 
 func (t *FilesFeed) Stats(w io.Writer) error {
-	_, err := w.Write([]byte("{}"))
+	_, err := fmt.Fprintf(w, `{"TotScan":%d,"TotNotify":%d,`+
+		`"TotDataUpdate":%d,"TotDataDelete":%d,"TotReadErr":%d,`+
+		`"TotParseErr":%d}`,
+		atomic.LoadUint64(&t.stats.TotScan),
+		atomic.LoadUint64(&t.stats.TotNotify),
+		atomic.LoadUint64(&t.stats.TotDataUpdate),
+		atomic.LoadUint64(&t.stats.TotDataDelete),
+		atomic.LoadUint64(&t.stats.TotReadErr),
+		atomic.LoadUint64(&t.stats.TotParseErr))
 	return err
 }
 
@@ -0,0 +1,556 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/couchbase/clog"
+)
+
+// The formats of FilesFeedParams.Format.
+const (
+	FILES_FEED_FORMAT_WHOLE = "whole" // The default.
+	FILES_FEED_FORMAT_JSONL = "jsonl"
+	FILES_FEED_FORMAT_CSV   = "csv" // With a header row.
+)
+
+// The archives of FilesFeedParams.Archive.
+const (
+	FILES_FEED_ARCHIVE_NONE = "" // The default.
+	FILES_FEED_ARCHIVE_GZIP = "gzip"
+	FILES_FEED_ARCHIVE_ZIP  = "zip"
+	FILES_FEED_ARCHIVE_TAR  = "tar"
+	FILES_FEED_ARCHIVE_TGZ  = "tgz"
+	FILES_FEED_ARCHIVE_AUTO = "auto" // By file name extension.
+)
+
+// filesFeedTailSize is the number of bytes before a record oriented
+// file's offset that are checksummed to tell appends from rewrites.
+const filesFeedTailSize = 64
+
+// filesFeedRecord is a document to be emitted by a FilesFeed.
+type filesFeedRecord struct {
+	key     string
+	val     []byte
+	deleted bool
+}
+
+// filesFeedMember is a file, or a file of an archive.
+type filesFeedMember struct {
+	name string // Empty for a file that's not an archive.
+	data []byte
+}
+
+func filesFeedCheckFormat(params *FilesFeedParams) error {
+	switch params.Format {
+	case "", FILES_FEED_FORMAT_WHOLE,
+		FILES_FEED_FORMAT_JSONL, FILES_FEED_FORMAT_CSV:
+	default:
+		return fmt.Errorf("feed_files_format: unknown format: %q",
+			params.Format)
+	}
+
+	switch params.Archive {
+	case FILES_FEED_ARCHIVE_NONE, FILES_FEED_ARCHIVE_GZIP,
+		FILES_FEED_ARCHIVE_ZIP, FILES_FEED_ARCHIVE_TAR,
+		FILES_FEED_ARCHIVE_TGZ, FILES_FEED_ARCHIVE_AUTO:
+	default:
+		return fmt.Errorf("feed_files_format: unknown archive: %q",
+			params.Archive)
+	}
+
+	return nil
+}
+
+func (t *FilesFeed) format() string {
+	if t.params.Format == "" {
+		return FILES_FEED_FORMAT_WHOLE
+	}
+	return t.params.Format
+}
+
+// archive returns how a file is compressed or bundled.
+func (t *FilesFeed) archive(path string) string {
+	if t.params.Archive != FILES_FEED_ARCHIVE_AUTO {
+		return t.params.Archive
+	}
+
+	switch {
+	case strings.HasSuffix(path, ".tar.gz"), strings.HasSuffix(path, ".tgz"):
+		return FILES_FEED_ARCHIVE_TGZ
+	case strings.HasSuffix(path, ".gz"):
+		return FILES_FEED_ARCHIVE_GZIP
+	case strings.HasSuffix(path, ".zip"):
+		return FILES_FEED_ARCHIVE_ZIP
+	case strings.HasSuffix(path, ".tar"):
+		return FILES_FEED_ARCHIVE_TAR
+	}
+
+	return FILES_FEED_ARCHIVE_NONE
+}
+
+// wholeFile returns true when a file is emitted as a single FileDoc.
+func (t *FilesFeed) wholeFile(path string) bool {
+	return t.format() == FILES_FEED_FORMAT_WHOLE &&
+		t.archive(path) == FILES_FEED_ARCHIVE_NONE
+}
+
+// readRecords reads a file and returns its records to be emitted,
+// including deletions of the records that a rewrite removed, and
+// updates f with the file's state.  Only the appended records of an
+// uncompressed, record oriented file are returned, given the file's
+// prev state.
+func (t *FilesFeed) readRecords(path string, prev, f *filesFeedFile) (
+	[]*filesFeedRecord, error) {
+	if t.wholeFile(path) {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		return []*filesFeedRecord{t.fileDocRecord(path, "", buf)}, nil
+	}
+
+	archive := t.archive(path)
+	if archive == FILES_FEED_ARCHIVE_NONE {
+		return t.readAppended(path, prev, f)
+	}
+
+	members, err := filesFeedReadMembers(path, archive)
+	if err != nil {
+		return nil, err
+	}
+
+	var recs []*filesFeedRecord
+
+	for _, member := range members {
+		if t.format() == FILES_FEED_FORMAT_WHOLE {
+			recs = append(recs, t.fileDocRecord(path, member.name, member.data))
+			continue
+		}
+
+		memberRecs, _, _, _ := t.parseRecords(member.data,
+			filesFeedSrc(path, member.name), nil, 0, true)
+
+		recs = append(recs, memberRecs...)
+	}
+
+	f.keys = make([]string, 0, len(recs))
+	for _, rec := range recs {
+		f.keys = append(f.keys, rec.key)
+	}
+
+	return append(recs, t.staleRecords(path, prev, f)...), nil
+}
+
+// readAppended reads the records of an uncompressed file from the
+// offset of its prev state, unless the file was rewritten.
+func (t *FilesFeed) readAppended(path string, prev, f *filesFeedFile) (
+	[]*filesFeedRecord, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	appended := false
+	if prev != nil && prev.offset > 0 && prev.offset <= f.size {
+		tailCRC, err := filesFeedTailCRC(fh, prev.offset)
+		appended = err == nil && tailCRC == prev.tailCRC
+	}
+
+	var header []string
+	var numRecords uint64
+
+	if appended {
+		f.offset = prev.offset
+		header = prev.header
+		numRecords = prev.numRecords
+		if prev.keys != nil {
+			f.keys = append(make([]string, 0, len(prev.keys)), prev.keys...)
+		}
+	} else {
+		f.offset = 0
+	}
+
+	_, err = fh.Seek(f.offset, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(fh)
+	if err != nil {
+		return nil, err
+	}
+
+	// An incomplete last line is left for when it's completed.
+	recs, header, numRecords, consumed :=
+		t.parseRecords(data, path, header, numRecords, false)
+
+	f.offset += int64(consumed)
+	f.header = header
+	f.numRecords = numRecords
+
+	f.tailCRC, err = filesFeedTailCRC(fh, f.offset)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.params.KeyField != "" {
+		if f.keys == nil {
+			f.keys = make([]string, 0, len(recs))
+		}
+		for _, rec := range recs {
+			f.keys = append(f.keys, rec.key)
+		}
+	}
+
+	if appended {
+		return recs, nil
+	}
+
+	return append(recs, t.staleRecords(path, prev, f)...), nil
+}
+
+// staleRecords returns the deletions of the records of a file's prev
+// state that are missing from its rewritten state, f.
+func (t *FilesFeed) staleRecords(path string,
+	prev, f *filesFeedFile) []*filesFeedRecord {
+	if prev == nil {
+		return nil
+	}
+
+	keys := map[string]bool{}
+	for _, key := range t.fileKeys(path, f) {
+		keys[key] = true
+	}
+
+	var recs []*filesFeedRecord
+	for _, key := range t.fileKeys(path, prev) {
+		if !keys[key] {
+			recs = append(recs, &filesFeedRecord{key: key, deleted: true})
+			keys[key] = true
+		}
+	}
+
+	return recs
+}
+
+// fileKeys returns the keys of the records of a file's state.
+func (t *FilesFeed) fileKeys(path string, f *filesFeedFile) []string {
+	if f.keys != nil {
+		return f.keys
+	}
+
+	if t.wholeFile(path) {
+		return []string{path}
+	}
+
+	keys := make([]string, f.numRecords)
+	for i := range keys {
+		keys[i] = filesFeedRecordKey(path, uint64(i+1))
+	}
+	return keys
+}
+
+func (t *FilesFeed) fileDocRecord(path, member string,
+	buf []byte) *filesFeedRecord {
+	name := filepath.Base(path)
+	if member != "" {
+		name = filepath.Base(member)
+	}
+
+	src := filesFeedSrc(path, member)
+
+	val, _ := json.Marshal(FileDoc{
+		Name:     name,
+		Path:     src,
+		Contents: string(buf),
+	})
+
+	return &filesFeedRecord{key: src, val: val}
+}
+
+// parseRecords splits data into records, numbering them after
+// numRecords, and returns them along with the csv header, the new
+// numRecords and the number of bytes consumed.  Unless final, the
+// data after the last newline is not consumed.
+func (t *FilesFeed) parseRecords(data []byte, src string, header []string,
+	numRecords uint64, final bool) (
+	[]*filesFeedRecord, []string, uint64, int) {
+	end := len(data)
+	if !final {
+		end = bytes.LastIndexByte(data, '\n') + 1
+	}
+
+	var recs []*filesFeedRecord
+
+	parseErr := func(err error) {
+		atomic.AddUint64(&t.stats.TotParseErr, 1)
+		log.Warnf("feed_files_format: parse, name: %s, src: %s,"+
+			" record: %d, err: %v", t.Name(), src, numRecords, err)
+	}
+
+	if t.format() == FILES_FEED_FORMAT_CSV {
+		r := csv.NewReader(bytes.NewReader(data[:end]))
+		r.FieldsPerRecord = -1
+
+		for {
+			row, err := r.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				if _, ok := err.(*csv.ParseError); !ok {
+					parseErr(err)
+					break
+				}
+				if header != nil {
+					numRecords++
+				}
+				parseErr(err)
+				continue
+			}
+
+			if header == nil {
+				header = row
+				continue
+			}
+
+			numRecords++
+
+			obj := map[string]string{}
+			for i, v := range row {
+				if i < len(header) {
+					obj[header[i]] = v
+				}
+			}
+
+			key := filesFeedRecordKey(src, numRecords)
+			if t.params.KeyField != "" {
+				key = obj[t.params.KeyField]
+				if key == "" {
+					parseErr(fmt.Errorf("missing keyField: %s",
+						t.params.KeyField))
+					continue
+				}
+			}
+
+			val, _ := json.Marshal(obj)
+
+			recs = append(recs, &filesFeedRecord{key: key, val: val})
+		}
+
+		return recs, header, numRecords, end
+	}
+
+	for _, line := range bytes.Split(data[:end], []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) <= 0 {
+			continue
+		}
+
+		numRecords++
+
+		key := filesFeedRecordKey(src, numRecords)
+		if t.params.KeyField != "" {
+			var err error
+			key, err = filesFeedJSONKey(line, t.params.KeyField)
+			if err != nil {
+				parseErr(err)
+				continue
+			}
+		} else if !json.Valid(line) {
+			parseErr(fmt.Errorf("invalid json"))
+			continue
+		}
+
+		recs = append(recs, &filesFeedRecord{
+			key: key,
+			val: append([]byte(nil), line...),
+		})
+	}
+
+	return recs, header, numRecords, end
+}
+
+// filesFeedJSONKey returns the string or number value of a dotted
+// path of fields of a JSON object.
+func filesFeedJSONKey(buf []byte, keyField string) (string, error) {
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+
+	var v interface{}
+	err := dec.Decode(&v)
+	if err != nil {
+		return "", err
+	}
+
+	for _, field := range strings.Split(keyField, ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("missing keyField: %s", keyField)
+		}
+		v = obj[field]
+	}
+
+	switch v := v.(type) {
+	case string:
+		if v != "" {
+			return v, nil
+		}
+	case json.Number:
+		return v.String(), nil
+	}
+
+	return "", fmt.Errorf("missing keyField: %s", keyField)
+}
+
+// filesFeedSrc returns the source of a document, which is the path of
+// a file, or of a file of an archive.
+func filesFeedSrc(path, member string) string {
+	if member == "" {
+		return path
+	}
+	return path + "!" + member
+}
+
+// filesFeedRecordKey returns the positional key of a record.
+func filesFeedRecordKey(src string, recordNum uint64) string {
+	return src + "#" + strconv.FormatUint(recordNum, 10)
+}
+
+// filesFeedTailCRC returns the checksum of the bytes before an offset.
+func filesFeedTailCRC(fh *os.File, offset int64) (uint32, error) {
+	n := int64(filesFeedTailSize)
+	if n > offset {
+		n = offset
+	}
+
+	buf := make([]byte, n)
+
+	_, err := fh.ReadAt(buf, offset-n)
+	if err != nil {
+		return 0, err
+	}
+
+	return crc32.ChecksumIEEE(buf), nil
+}
+
+// filesFeedReadMembers decompresses a file, or the regular files of
+// an archive.
+func filesFeedReadMembers(path, archive string) (
+	[]*filesFeedMember, error) {
+	if archive == FILES_FEED_ARCHIVE_ZIP {
+		r, err := zip.OpenReader(path)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+
+		var members []*filesFeedMember
+
+		for _, zf := range r.File {
+			if zf.FileInfo().IsDir() {
+				continue
+			}
+
+			rc, err := zf.Open()
+			if err != nil {
+				return nil, err
+			}
+
+			data, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return nil, err
+			}
+
+			members = append(members,
+				&filesFeedMember{name: zf.Name, data: data})
+		}
+
+		return members, nil
+	}
+
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	var r io.Reader = fh
+
+	if archive == FILES_FEED_ARCHIVE_GZIP || archive == FILES_FEED_ARCHIVE_TGZ {
+		gr, err := gzip.NewReader(fh)
+		if err != nil {
+			return nil, fmt.Errorf("feed_files_format: gzip,"+
+				" path: %s, err: %v", path, err)
+		}
+		defer gr.Close()
+
+		if archive == FILES_FEED_ARCHIVE_GZIP {
+			data, err := ioutil.ReadAll(gr)
+			if err != nil {
+				return nil, fmt.Errorf("feed_files_format: gzip,"+
+					" path: %s, err: %v", path, err)
+			}
+
+			return []*filesFeedMember{{data: data}}, nil
+		}
+
+		r = gr
+	}
+
+	var members []*filesFeedMember
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("feed_files_format: tar,"+
+				" path: %s, err: %v", path, err)
+		}
+
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("feed_files_format: tar,"+
+				" path: %s, err: %v", path, err)
+		}
+
+		members = append(members, &filesFeedMember{name: hdr.Name, data: data})
+	}
+
+	return members, nil
+}
@@ -0,0 +1,248 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// filesFeedFormatTest drives the scans of a FilesFeed synchronously.
+type filesFeedFormatTest struct {
+	t         *testing.T
+	ff        *FilesFeed
+	dest      *filesFeedTestDest
+	sourceDir string
+	modTime   time.Time
+}
+
+func newFilesFeedFormatTest(t *testing.T, testDir, params string) *filesFeedFormatTest {
+	mgr := NewManager(VERSION, NewCfgMem(), NewUUID(), nil,
+		"", 1, "", ":1000", testDir, "some-datasource", nil)
+
+	sourceDir := filepath.Join(testDir, "files", "src")
+	os.MkdirAll(sourceDir, 0700)
+
+	dest := newFilesFeedTestDest()
+
+	ff, err := NewFilesFeed(mgr, "name", "indexName", "src",
+		params, map[string]Dest{"0": dest}, false)
+	if err != nil {
+		t.Fatalf("expected NewFilesFeed to work, err: %v", err)
+	}
+
+	ff.h = crc32.NewIEEE()
+	ff.partitions = []string{"0"}
+	ff.loadPartitions()
+
+	return &filesFeedFormatTest{
+		t:         t,
+		ff:        ff,
+		dest:      dest,
+		sourceDir: sourceDir,
+		modTime:   time.Now().Add(-time.Hour),
+	}
+}
+
+func (ft *filesFeedFormatTest) path(name string) string {
+	return filepath.Join(ft.sourceDir, name)
+}
+
+func (ft *filesFeedFormatTest) write(name string, data []byte) {
+	ioutil.WriteFile(ft.path(name), data, 0600)
+	ft.modTime = ft.modTime.Add(time.Minute)
+	os.Chtimes(ft.path(name), ft.modTime, ft.modTime)
+}
+
+// scan returns the sorted "op:key" entries of the scan's mutations.
+func (ft *filesFeedFormatTest) scan() []string {
+	_, err := ft.ff.scanAll(ft.sourceDir, false)
+	if err != nil {
+		ft.t.Fatalf("expected scan to work, err: %v", err)
+	}
+
+	rv := ft.dest.take()
+	sort.Strings(rv)
+	return rv
+}
+
+func (ft *filesFeedFormatTest) expect(desc string, exp ...string) {
+	got := ft.scan()
+	if !reflect.DeepEqual(got, exp) && !(len(got) == 0 && len(exp) == 0) {
+		ft.t.Errorf("%s, expected: %v, got: %v", desc, exp, got)
+	}
+}
+
+func TestFilesFeedCheckFormat(t *testing.T) {
+	for _, params := range []string{
+		`{"format":"xml"}`,
+		`{"archive":"rar"}`,
+	} {
+		_, err := NewFilesFeed(nil, "name", "indexName", "src",
+			params, nil, false)
+		if err == nil {
+			t.Errorf("expected err, params: %s", params)
+		}
+	}
+}
+
+func TestFilesFeedJSONL(t *testing.T) {
+	testDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testDir)
+
+	ft := newFilesFeedFormatTest(t, testDir,
+		`{"numPartitions":1,"format":"jsonl","keyField":"meta.id"}`)
+
+	ft.write("a.jsonl", []byte(`{"meta":{"id":"a"}}`+"\n"+
+		`{"meta":{"id":7}}`+"\n"))
+	ft.expect("initial", "update:7", "update:a")
+
+	// Only the appended and completed records are emitted.
+	ft.write("a.jsonl", []byte(`{"meta":{"id":"a"}}`+"\n"+
+		`{"meta":{"id":7}}`+"\n"+
+		`{"meta":{"id":"c"}}`+"\n"+
+		`not json`+"\n"+
+		`{"meta":{"id":"d"`))
+	ft.expect("append", "update:c")
+
+	if ft.ff.stats.TotParseErr != 1 {
+		t.Errorf("expected a parse err, stats: %+v", ft.ff.stats)
+	}
+
+	f, _ := os.OpenFile(ft.path("a.jsonl"), os.O_APPEND|os.O_WRONLY, 0600)
+	f.Write([]byte("}}\n"))
+	f.Close()
+	ft.modTime = ft.modTime.Add(time.Minute)
+	os.Chtimes(ft.path("a.jsonl"), ft.modTime, ft.modTime)
+	ft.expect("completed", "update:d")
+
+	// A rewrite re-emits the records and deletes the missing ones.
+	ft.write("a.jsonl", []byte(`{"meta":{"id":"d"}}`+"\n"))
+	ft.expect("rewrite", "delete:7", "delete:a", "delete:c", "update:d")
+
+	os.Remove(ft.path("a.jsonl"))
+	ft.expect("remove", "delete:d")
+}
+
+func TestFilesFeedCSV(t *testing.T) {
+	testDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testDir)
+
+	ft := newFilesFeedFormatTest(t, testDir,
+		`{"numPartitions":1,"format":"csv"}`)
+
+	ft.write("a.csv", []byte("name,n\nx,1\ny,2\n"))
+
+	key := ft.path("a.csv")
+	ft.expect("initial", "update:"+key+"#1", "update:"+key+"#2")
+
+	ft.write("a.csv", []byte("name,n\nx,1\ny,2\nz,3\n"))
+
+	ft.dest.m.Lock()
+	ft.dest.mutations = nil
+	ft.dest.m.Unlock()
+
+	ft.ff.scanAll(ft.sourceDir, false)
+
+	ft.dest.m.Lock()
+	if len(ft.dest.mutations) != 1 ||
+		string(ft.dest.mutations[0].val) != `{"n":"3","name":"z"}` {
+		t.Errorf("expected the appended row as JSON")
+	}
+	ft.dest.mutations = nil
+	ft.dest.m.Unlock()
+
+	// Positional keys of a shorter rewrite are deleted.
+	ft.write("a.csv", []byte("name,n\nx,1\n"))
+	ft.expect("rewrite", "delete:"+key+"#2", "delete:"+key+"#3",
+		"update:"+key+"#1")
+}
+
+func TestFilesFeedArchives(t *testing.T) {
+	testDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testDir)
+
+	ft := newFilesFeedFormatTest(t, testDir,
+		`{"numPartitions":1,"format":"jsonl","archive":"auto"}`)
+
+	var gzBuf bytes.Buffer
+	gw := gzip.NewWriter(&gzBuf)
+	gw.Write([]byte("{}\n{}"))
+	gw.Close()
+	ft.write("a.jsonl.gz", gzBuf.Bytes())
+
+	var zipBuf bytes.Buffer
+	zw := zip.NewWriter(&zipBuf)
+	w, _ := zw.Create("x.jsonl")
+	w.Write([]byte("{}\n"))
+	w, _ = zw.Create("y.jsonl")
+	w.Write([]byte("{}\n{}\n"))
+	zw.Close()
+	ft.write("b.zip", zipBuf.Bytes())
+
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	tw.WriteHeader(&tar.Header{Name: "t.jsonl", Mode: 0600, Size: 3,
+		Typeflag: tar.TypeReg})
+	tw.Write([]byte("{}\n"))
+	tw.Close()
+	ft.write("c.tar", tarBuf.Bytes())
+
+	a, b, c := ft.path("a.jsonl.gz"), ft.path("b.zip"), ft.path("c.tar")
+
+	ft.expect("initial",
+		"update:"+a+"#1", "update:"+a+"#2",
+		"update:"+b+"!x.jsonl#1",
+		"update:"+b+"!y.jsonl#1", "update:"+b+"!y.jsonl#2",
+		"update:"+c+"!t.jsonl#1")
+
+	os.Remove(b)
+	ft.expect("remove",
+		"delete:"+b+"!x.jsonl#1",
+		"delete:"+b+"!y.jsonl#1", "delete:"+b+"!y.jsonl#2")
+
+	// Whole members are emitted as FileDocs.
+	ft.ff.params.Format = FILES_FEED_FORMAT_WHOLE
+
+	ft.write("c.tar", tarBuf.Bytes())
+
+	ft.dest.m.Lock()
+	ft.dest.mutations = nil
+	ft.dest.m.Unlock()
+
+	ft.ff.scanAll(ft.sourceDir, false)
+
+	ft.dest.m.Lock()
+	defer ft.dest.m.Unlock()
+
+	var doc FileDoc
+	for _, mutation := range ft.dest.mutations {
+		if mutation.key == c+"!t.jsonl" {
+			json.Unmarshal(mutation.val, &doc)
+		}
+	}
+	if doc.Name != "t.jsonl" || doc.Contents != "{}\n" {
+		t.Errorf("expected a FileDoc of the member, mutations: %+v",
+			ft.dest.mutations)
+	}
+}
@@ -0,0 +1,188 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+// +build linux
+
+package cbgt
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyWatcherMask = syscall.IN_ATTRIB | syscall.IN_CLOSE_WRITE |
+	syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_DELETE_SELF |
+	syscall.IN_MOVE_SELF | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// inotifyWatcher is a filesWatcher that has an inotify watch on every
+// directory of a subdirectory tree, adding watches as directories are
+// created.
+type inotifyWatcher struct {
+	fd      int
+	f       *os.File
+	root    string
+	events  chan filesWatchEvent
+	closeCh chan struct{}
+
+	dirs map[int32]string // Keyed by watch descriptor.
+}
+
+func newFilesWatcher(root string) (filesWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("feed_files_notify: inotify init, err: %v", err)
+	}
+
+	w := &inotifyWatcher{
+		fd: fd,
+		// The fd is non-blocking, so the os.File uses the runtime
+		// poller and a Close() interrupts a blocked Read().
+		f:       os.NewFile(uintptr(fd), "inotify"),
+		root:    root,
+		events:  make(chan filesWatchEvent),
+		closeCh: make(chan struct{}),
+		dirs:    map[int32]string{},
+	}
+
+	err = w.addTree(root)
+	if err != nil {
+		w.f.Close()
+		return nil, err
+	}
+
+	go w.readLoop()
+
+	return w, nil
+}
+
+func (w *inotifyWatcher) Events() <-chan filesWatchEvent {
+	return w.events
+}
+
+func (w *inotifyWatcher) Close() error {
+	close(w.closeCh)
+	return w.f.Close()
+}
+
+// addTree adds watches for a directory and its subdirectories.
+func (w *inotifyWatcher) addTree(root string) error {
+	return filepath.Walk(root,
+		func(path string, fi os.FileInfo, err error) error {
+			if err != nil || !fi.IsDir() {
+				return nil // Vanished paths have their own events.
+			}
+
+			wd, err := syscall.InotifyAddWatch(w.fd, path,
+				inotifyWatcherMask|syscall.IN_ONLYDIR)
+			if err != nil {
+				if err == syscall.ENOENT || err == syscall.ENOTDIR {
+					return nil
+				}
+				return fmt.Errorf("feed_files_notify: add watch,"+
+					" path: %s, err: %v", path, err)
+			}
+
+			// A moved directory keeps its watch descriptor.
+			w.dirs[int32(wd)] = path
+
+			return nil
+		})
+}
+
+func (w *inotifyWatcher) readLoop() {
+	defer close(w.events)
+
+	buf := make([]byte, syscall.SizeofInotifyEvent*4096)
+
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			w.send(filesWatchEvent{Err: fmt.Errorf("feed_files_notify:"+
+				" read, err: %v", err)})
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+
+			offset += syscall.SizeofInotifyEvent
+
+			name := ""
+			if raw.Len > 0 {
+				name = strings.TrimRight(
+					string(buf[offset:offset+int(raw.Len)]), "\x00")
+				offset += int(raw.Len)
+			}
+
+			if !w.handle(raw.Wd, raw.Mask, name) {
+				return
+			}
+		}
+	}
+}
+
+// handle processes an inotify event, and returns false when the
+// watcher is done.
+func (w *inotifyWatcher) handle(wd int32, mask uint32, name string) bool {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		return w.send(filesWatchEvent{Rescan: true})
+	}
+
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.dirs, wd)
+		return true
+	}
+
+	dir, exists := w.dirs[wd]
+	if !exists {
+		return true
+	}
+
+	if mask&(syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF) != 0 {
+		if dir == w.root {
+			return w.send(filesWatchEvent{Rescan: true})
+		}
+		return true // The parent directory's watch has an event.
+	}
+
+	path := dir
+	if name != "" {
+		path = filepath.Join(dir, name)
+	}
+
+	isDir := mask&syscall.IN_ISDIR != 0
+	if isDir {
+		if mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+			err := w.addTree(path)
+			if err != nil {
+				w.send(filesWatchEvent{Err: err})
+				return false
+			}
+		} else if mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) == 0 {
+			return true
+		}
+	}
+
+	return w.send(filesWatchEvent{Path: path, Dir: isDir})
+}
+
+func (w *inotifyWatcher) send(ev filesWatchEvent) bool {
+	select {
+	case w.events <- ev:
+		return true
+	case <-w.closeCh:
+		return false
+	}
+}
@@ -13,10 +13,14 @@ package cbgt
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"hash/crc32"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sort"
+	"sync"
 	"testing"
 	"time"
 )
@@ -352,3 +356,241 @@ func TestStartFilesFeed(t *testing.T) {
 	// Let the file walkers run a little.
 	time.Sleep(100 * time.Millisecond)
 }
+
+// filesFeedTestDest records the mutations and opaque values that it
+// receives from a FilesFeed's goroutine.
+type filesFeedTestDest struct {
+	TestDest
+
+	m         sync.Mutex
+	mutations []*filesFeedTestMutation
+	opaques   map[string][]byte
+}
+
+type filesFeedTestMutation struct {
+	op        string // "update" or "delete".
+	partition string
+	key       string
+	seq       uint64
+	val       []byte
+}
+
+func newFilesFeedTestDest() *filesFeedTestDest {
+	return &filesFeedTestDest{opaques: map[string][]byte{}}
+}
+
+func (d *filesFeedTestDest) DataUpdate(partition string,
+	key []byte, seq uint64, val []byte,
+	cas uint64, extrasType DestExtrasType, extras []byte) error {
+	d.m.Lock()
+	d.mutations = append(d.mutations, &filesFeedTestMutation{
+		"update", partition, string(key), seq, append([]byte(nil), val...)})
+	d.m.Unlock()
+	return nil
+}
+
+func (d *filesFeedTestDest) DataDelete(partition string,
+	key []byte, seq uint64,
+	cas uint64, extrasType DestExtrasType, extras []byte) error {
+	d.m.Lock()
+	d.mutations = append(d.mutations, &filesFeedTestMutation{
+		"delete", partition, string(key), seq, nil})
+	d.m.Unlock()
+	return nil
+}
+
+func (d *filesFeedTestDest) OpaqueSet(partition string, value []byte) error {
+	d.m.Lock()
+	d.opaques[partition] = append([]byte(nil), value...)
+	d.m.Unlock()
+	return nil
+}
+
+func (d *filesFeedTestDest) OpaqueGet(partition string) (
+	[]byte, uint64, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.opaques[partition], 0, nil
+}
+
+// count returns the number of mutations of an op for a file name.
+func (d *filesFeedTestDest) count(op, name string) int {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	n := 0
+	for _, mutation := range d.mutations {
+		if mutation.op == op && filepath.Base(mutation.key) == name {
+			n++
+		}
+	}
+	return n
+}
+
+// take returns and clears the mutations as "op:key" entries.
+func (d *filesFeedTestDest) take() []string {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	var rv []string
+	for _, mutation := range d.mutations {
+		rv = append(rv, mutation.op+":"+mutation.key)
+	}
+	d.mutations = nil
+	return rv
+}
+
+func TestFilesFeedChanges(t *testing.T) {
+	for _, disableNotify := range []bool{false, true} {
+		testFilesFeedChanges(t, disableNotify)
+	}
+}
+
+func testFilesFeedChanges(t *testing.T, disableNotify bool) {
+	testDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testDir)
+
+	mgr := NewManager(VERSION, NewCfgMem(), NewUUID(), nil,
+		"", 1, "", ":1000", testDir, "some-datasource", nil)
+
+	sourceDir := filepath.Join(testDir, "files", "src")
+	os.MkdirAll(sourceDir, 0700)
+
+	// Files get distinct modification times in the past, so that they
+	// aren't re-emitted after a restart.
+	modTime := time.Now().Add(-time.Hour)
+	write := func(name, contents string) {
+		path := filepath.Join(sourceDir, name)
+		os.MkdirAll(filepath.Dir(path), 0700)
+		ioutil.WriteFile(path, []byte(contents), 0600)
+		modTime = modTime.Add(time.Minute)
+		os.Chtimes(path, modTime, modTime)
+	}
+
+	waitFor := func(desc string, f func() bool) {
+		for i := 0; i < 500; i++ {
+			if f() {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("disableNotify: %t, timed out waiting for %s",
+			disableNotify, desc)
+	}
+
+	dest := newFilesFeedTestDest()
+	dests := map[string]Dest{"0": dest, "1": dest}
+
+	params := fmt.Sprintf(`{"numPartitions":2,"regExps":[".txt$"],`+
+		`"sleepStartMS":10,"maxSleepMS":20,"notifyBatchMS":10,`+
+		`"disableNotify":%t}`, disableNotify)
+
+	write("a.txt", "a")
+	write("b.txt", "b")
+	write("skip.md", "skip")
+
+	ff, err := NewFilesFeed(mgr, "name", "indexName", "src",
+		params, dests, false)
+	if err != nil {
+		t.Fatalf("expected NewFilesFeed to work, err: %v", err)
+	}
+	ff.Start()
+
+	waitFor("initial files", func() bool {
+		return dest.count("update", "a.txt") == 1 &&
+			dest.count("update", "b.txt") == 1
+	})
+
+	write("a.txt", "a2")
+	write(filepath.Join("sub", "c.txt"), "c")
+
+	waitFor("changed files", func() bool {
+		return dest.count("update", "a.txt") >= 2 &&
+			dest.count("update", "c.txt") >= 1
+	})
+
+	os.Remove(filepath.Join(sourceDir, "b.txt"))
+
+	waitFor("removed file", func() bool {
+		return dest.count("delete", "b.txt") == 1
+	})
+
+	os.RemoveAll(filepath.Join(sourceDir, "sub"))
+
+	waitFor("removed dir", func() bool {
+		return dest.count("delete", "c.txt") == 1
+	})
+
+	if dest.count("update", "skip.md") != 0 {
+		t.Errorf("expected unmatched files to be skipped")
+	}
+
+	var buf bytes.Buffer
+	ff.Stats(&buf)
+	var stats map[string]uint64
+	json.Unmarshal(buf.Bytes(), &stats)
+	if stats["TotDataDelete"] != 2 || stats["TotScan"] < 1 {
+		t.Errorf("unexpected stats: %s", buf.Bytes())
+	}
+
+	ff.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// A restarted feed only emits the files changed while it was
+	// stopped, including the files removed while it was stopped, and
+	// continues the sequence numbers.
+	numA := dest.count("update", "a.txt")
+
+	ioutil.WriteFile(filepath.Join(sourceDir, "d.txt"), []byte("d"), 0600)
+	write("e.txt", "e")
+
+	ff, _ = NewFilesFeed(mgr, "name", "indexName", "src",
+		params, dests, false)
+	ff.Start()
+
+	waitFor("restart", func() bool {
+		return dest.count("update", "d.txt") == 1 &&
+			dest.count("update", "e.txt") == 1
+	})
+
+	if dest.count("update", "a.txt") != numA {
+		t.Errorf("expected no re-emit after restart, disableNotify: %t",
+			disableNotify)
+	}
+
+	ff.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	_, err = os.Stat(filepath.Join(testDir, "files-feeds", "indexName"))
+	if err != nil {
+		t.Errorf("expected manifests, err: %v", err)
+	}
+
+	os.Remove(filepath.Join(sourceDir, "a.txt"))
+
+	ff, _ = NewFilesFeed(mgr, "name", "indexName", "src",
+		params, dests, false)
+	ff.Start()
+	defer ff.Close()
+
+	waitFor("removed while stopped", func() bool {
+		return dest.count("delete", "a.txt") == 1
+	})
+
+	if dest.count("update", "e.txt") != 1 {
+		t.Errorf("expected no re-emit after restart, disableNotify: %t",
+			disableNotify)
+	}
+
+	dest.m.Lock()
+	defer dest.m.Unlock()
+
+	lastSeqs := map[string]uint64{}
+	for _, mutation := range dest.mutations {
+		if mutation.seq != lastSeqs[mutation.partition]+1 {
+			t.Errorf("expected consecutive seqs, partition: %s, seq: %d",
+				mutation.partition, mutation.seq)
+		}
+		lastSeqs[mutation.partition] = mutation.seq
+	}
+}
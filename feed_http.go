@@ -0,0 +1,855 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// SOURCE_HTTP is the sourceType of an index whose documents are
+// upserted and deleted by applications through the REST API.
+const SOURCE_HTTP = "http"
+
+// The ops of a HTTPFeedDoc.
+const (
+	HTTP_FEED_OP_UPSERT = "upsert"
+	HTTP_FEED_OP_DELETE = "delete"
+)
+
+func init() {
+	RegisterFeedType(SOURCE_HTTP, &FeedType{
+		Start:           StartHTTPFeed,
+		Partitions:      PrimaryFeedPartitions,
+		PartitionLookUp: HTTPFeedPartitionLookUp,
+		Public:          true,
+		Description: "general/http" +
+			" - documents are upserted and deleted through the REST API",
+		StartSample: &PrimarySourceParams{NumPartitions: 16},
+	})
+}
+
+// HTTP_FEED_SEQS_KEY is the Cfg key of the seq numbers that the
+// HTTPFeeds have reserved, keyed by indexUUID and source partition.
+const HTTP_FEED_SEQS_KEY = "httpFeedSeqs"
+
+// HTTPFeedSeqReserve is how many seq numbers a HTTPFeed reserves in
+// the Cfg at a time for a source partition.
+var HTTPFeedSeqReserve = uint64(1000)
+
+// HTTPFeed is a Feed interface implementation whose documents are
+// pushed by applications, instead of being pulled from a data source.
+// Each document key is hashed into one of the
+// PrimarySourceParams.NumPartitions source partitions.
+//
+// The documents of a partition are sent to the primary, which is the
+// plan node with the lowest priority that may write to the
+// partition's pindex.  The primary's HTTPFeed assigns increasing seq
+// numbers to the mutations, which it reserves in blocks in the Cfg
+// under HTTP_FEED_SEQS_KEY, so that the seqs stay increasing even
+// after the pindex is moved or rebuilt, and it then replicates the
+// documents, along with their seqs, to the HTTPFeeds of the other
+// plan nodes of the partition.  The seqs are also persisted
+// in-stream with the Dest's OpaqueSet(), so that they survive
+// restarts of the pindex.
+//
+// Limitations: as the documents are not kept anywhere else, a pindex
+// that's rebuilt or moved to another node starts out empty.
+type HTTPFeed struct {
+	name          string
+	indexName     string
+	indexUUID     string
+	numPartitions int
+	dests         map[string]Dest
+	disable       bool
+	cfg           Cfg // Optional, for the seq reservations.
+
+	m        sync.Mutex // Serializes the seq assignments.
+	seqs     map[string]uint64
+	reserved map[string]uint64 // Only for the partitions of a primary.
+	closed   bool
+
+	stats HTTPFeedStats
+}
+
+// HTTPFeedStats holds the counters of a HTTPFeed.
+type HTTPFeedStats struct {
+	TotApply      uint64
+	TotApplyErr   uint64
+	TotDataUpdate uint64
+	TotDataDelete uint64
+}
+
+// HTTPFeedDoc represents a document upsert or delete for a HTTPFeed.
+type HTTPFeedDoc struct {
+	Op    string          `json:"op"` // See HTTP_FEED_OP_XXX.
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value,omitempty"`
+	Seq   uint64          `json:"seq,omitempty"` // Assigned by the primary.
+}
+
+// HTTPFeedReplicateFunc sends the docs of a primary HTTPFeed, whose
+// seqs were assigned, to the HTTPFeeds of the replicas of their
+// source partitions.
+type HTTPFeedReplicateFunc func(docs []*HTTPFeedDoc) error
+
+// httpFeedOpaque is the JSON persisted with the Dest's OpaqueSet().
+type httpFeedOpaque struct {
+	Seq uint64 `json:"seq"`
+}
+
+// httpFeedSeqs is the JSON of the HTTP_FEED_SEQS_KEY Cfg value.
+type httpFeedSeqs struct {
+	// Keyed by indexUUID and then by source partition.
+	Reserved map[string]map[string]uint64 `json:"reserved"`
+}
+
+// StartHTTPFeed starts a HTTPFeed and is the callback function
+// registered at init/startup time.
+func StartHTTPFeed(mgr *Manager, feedName, indexName, indexUUID,
+	sourceType, sourceName, sourceUUID, params string,
+	dests map[string]Dest) error {
+	feed, err := NewHTTPFeed(feedName, indexName, indexUUID, params,
+		dests, mgr.tagsMap != nil && !mgr.tagsMap["feed"])
+	if err != nil {
+		return fmt.Errorf("feed_http: NewHTTPFeed,"+
+			" feedName: %s, err: %v", feedName, err)
+	}
+	feed.cfg = mgr.Cfg()
+	err = feed.Start()
+	if err != nil {
+		return fmt.Errorf("feed_http: could not start,"+
+			" feedName: %s, err: %v", feedName, err)
+	}
+	err = mgr.registerFeed(feed)
+	if err != nil {
+		feed.Close()
+		return err
+	}
+	return nil
+}
+
+// NewHTTPFeed creates a ready-to-be-started HTTPFeed.
+func NewHTTPFeed(name, indexName, indexUUID, paramsStr string,
+	dests map[string]Dest, disable bool) (*HTTPFeed, error) {
+	params := &PrimarySourceParams{}
+	if paramsStr != "" {
+		err := json.Unmarshal([]byte(paramsStr), params)
+		if err != nil {
+			return nil, fmt.Errorf("feed_http: could not parse"+
+				" sourceParams: %s, err: %v", paramsStr, err)
+		}
+	}
+
+	return &HTTPFeed{
+		name:          name,
+		indexName:     indexName,
+		indexUUID:     indexUUID,
+		numPartitions: params.NumPartitions,
+		dests:         dests,
+		disable:       disable,
+		seqs:          map[string]uint64{},
+		reserved:      map[string]uint64{},
+	}, nil
+}
+
+func (t *HTTPFeed) Name() string {
+	return t.name
+}
+
+func (t *HTTPFeed) IndexName() string {
+	return t.indexName
+}
+
+func (t *HTTPFeed) IndexUUID() string {
+	return t.indexUUID
+}
+
+func (t *HTTPFeed) Start() error {
+	return nil
+}
+
+func (t *HTTPFeed) Close() error {
+	t.m.Lock()
+	t.closed = true
+	t.m.Unlock()
+	return nil
+}
+
+func (t *HTTPFeed) Dests() map[string]Dest {
+	return t.dests
+}
+
+func (t *HTTPFeed) Stats(w io.Writer) error {
+	_, err := fmt.Fprintf(w, `{"TotApply":%d,"TotApplyErr":%d,`+
+		`"TotDataUpdate":%d,"TotDataDelete":%d}`,
+		atomic.LoadUint64(&t.stats.TotApply),
+		atomic.LoadUint64(&t.stats.TotApplyErr),
+		atomic.LoadUint64(&t.stats.TotDataUpdate),
+		atomic.LoadUint64(&t.stats.TotDataDelete))
+	return err
+}
+
+// Apply feeds the docs to the dests of their source partitions, where
+// every doc must belong to a source partition of the feed.  The docs
+// of a source partition are sent as a single snapshot.  The returned
+// consistency vector holds the last seq of each affected partition.
+func (t *HTTPFeed) Apply(docs []*HTTPFeedDoc) (ConsistencyVector, error) {
+	return t.ApplyEx(docs, nil)
+}
+
+// ApplyEx is like Apply, where the feed is the primary of the docs'
+// source partitions, and the optional replicate callback is invoked
+// with the docs and their assigned seqs before ApplyEx returns, so
+// that the replicas receive the docs in seq order.
+func (t *HTTPFeed) ApplyEx(docs []*HTTPFeedDoc,
+	replicate HTTPFeedReplicateFunc) (ConsistencyVector, error) {
+	atomic.AddUint64(&t.stats.TotApply, 1)
+
+	rv, err := t.apply(docs, false, replicate)
+	if err != nil {
+		atomic.AddUint64(&t.stats.TotApplyErr, 1)
+	}
+
+	return rv, err
+}
+
+// ApplyReplica feeds the docs that were replicated by the primary of
+// their source partitions, with the seqs that the primary assigned.
+// Docs with seqs that the feed already has are skipped, so that a
+// retried replication is idempotent.
+func (t *HTTPFeed) ApplyReplica(docs []*HTTPFeedDoc) (
+	ConsistencyVector, error) {
+	atomic.AddUint64(&t.stats.TotApply, 1)
+
+	rv, err := t.apply(docs, true, nil)
+	if err != nil {
+		atomic.AddUint64(&t.stats.TotApplyErr, 1)
+	}
+
+	return rv, err
+}
+
+func (t *HTTPFeed) apply(docs []*HTTPFeedDoc, replica bool,
+	replicate HTTPFeedReplicateFunc) (ConsistencyVector, error) {
+	if t.disable {
+		return nil, fmt.Errorf("feed_http: disabled, name: %s", t.name)
+	}
+
+	var partitions []string
+
+	byPartition := map[string][]*HTTPFeedDoc{}
+	for _, doc := range docs {
+		partition := HTTPFeedPartition([]byte(doc.Key), t.numPartitions)
+		if t.dests[partition] == nil {
+			return nil, fmt.Errorf("feed_http: no dest for key: %s,"+
+				" partition: %s, name: %s", doc.Key, partition, t.name)
+		}
+		if byPartition[partition] == nil {
+			partitions = append(partitions, partition)
+		}
+		byPartition[partition] = append(byPartition[partition], doc)
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if t.closed {
+		return nil, fmt.Errorf("feed_http: closed, name: %s", t.name)
+	}
+
+	rv := ConsistencyVector{}
+
+	var replicated []*HTTPFeedDoc
+
+	for _, partition := range partitions {
+		var seq uint64
+		var err error
+
+		if replica {
+			seq, err = t.applyReplicaPartitionLOCKED(partition,
+				byPartition[partition])
+		} else {
+			var seqDocs []*HTTPFeedDoc
+
+			seq, seqDocs, err = t.applyPartitionLOCKED(partition,
+				byPartition[partition])
+			replicated = append(replicated, seqDocs...)
+		}
+		if err != nil {
+			// Reload the seq from the dest next time, as the dest
+			// might have persisted only some of the docs.
+			delete(t.seqs, partition)
+			delete(t.reserved, partition)
+			return nil, err
+		}
+		rv[partition] = seq
+	}
+
+	if replicate != nil && len(replicated) > 0 {
+		err := replicate(replicated)
+		if err != nil {
+			return nil, fmt.Errorf("feed_http: replicate,"+
+				" name: %s, err: %v", t.name, err)
+		}
+	}
+
+	return rv, nil
+}
+
+// seqLOCKED returns the last seq of a partition, which is loaded from
+// the partition's dest the first time.
+func (t *HTTPFeed) seqLOCKED(partition string) (uint64, error) {
+	seq, exists := t.seqs[partition]
+	if exists {
+		return seq, nil
+	}
+
+	value, lastSeq, err := t.dests[partition].OpaqueGet(partition)
+	if err != nil {
+		return 0, fmt.Errorf("feed_http: OpaqueGet,"+
+			" partition: %s, err: %v", partition, err)
+	}
+
+	seq = lastSeq
+
+	if len(value) > 0 {
+		var opaque httpFeedOpaque
+		err = json.Unmarshal(value, &opaque)
+		if err != nil {
+			return 0, fmt.Errorf("feed_http: could not parse opaque,"+
+				" partition: %s, value: %s, err: %v",
+				partition, value, err)
+		}
+		if seq < opaque.Seq {
+			seq = opaque.Seq
+		}
+	}
+
+	t.seqs[partition] = seq
+
+	return seq, nil
+}
+
+// applyPartitionLOCKED assigns seqs to the docs of a partition whose
+// primary is the feed, and applies them.  A copy of the docs with
+// their seqs is returned, for the replicas.
+func (t *HTTPFeed) applyPartitionLOCKED(partition string,
+	docs []*HTTPFeedDoc) (uint64, []*HTTPFeedDoc, error) {
+	dest := t.dests[partition]
+
+	seq, err := t.seqLOCKED(partition)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if _, exists := t.reserved[partition]; !exists {
+		// The seqs up to the reservation might have been assigned by
+		// a previous primary, so they're skipped.
+		reserved, err := t.reservedSeqLOCKED(partition)
+		if err != nil {
+			return 0, nil, err
+		}
+		if seq < reserved {
+			seq = reserved
+		}
+		t.reserved[partition] = reserved
+	}
+
+	err = t.reserveSeqsLOCKED(partition, seq+uint64(len(docs)))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	err = dest.SnapshotStart(partition, seq+1, seq+uint64(len(docs)))
+	if err != nil {
+		return 0, nil, fmt.Errorf("feed_http: SnapshotStart,"+
+			" partition: %s, err: %v", partition, err)
+	}
+
+	seqDocs := make([]*HTTPFeedDoc, 0, len(docs))
+
+	for _, doc := range docs {
+		seq++
+
+		err = t.applyDocLOCKED(partition, doc, seq)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		seqDoc := *doc
+		seqDoc.Seq = seq
+		seqDocs = append(seqDocs, &seqDoc)
+	}
+
+	err = t.opaqueSetLOCKED(partition, seq)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return seq, seqDocs, nil
+}
+
+// applyReplicaPartitionLOCKED applies the docs of a partition with
+// the seqs that were assigned by the partition's primary.
+func (t *HTTPFeed) applyReplicaPartitionLOCKED(partition string,
+	docs []*HTTPFeedDoc) (uint64, error) {
+	seq, err := t.seqLOCKED(partition)
+	if err != nil {
+		return 0, err
+	}
+
+	// The feed is not the primary, so the next time it's the primary,
+	// the reservation is loaded again.
+	delete(t.reserved, partition)
+
+	var todo []*HTTPFeedDoc
+	for _, doc := range docs {
+		if doc.Seq > seq &&
+			(len(todo) <= 0 || doc.Seq > todo[len(todo)-1].Seq) {
+			todo = append(todo, doc)
+		}
+	}
+	if len(todo) <= 0 {
+		return seq, nil
+	}
+
+	err = t.dests[partition].SnapshotStart(partition,
+		todo[0].Seq, todo[len(todo)-1].Seq)
+	if err != nil {
+		return 0, fmt.Errorf("feed_http: SnapshotStart,"+
+			" partition: %s, err: %v", partition, err)
+	}
+
+	for _, doc := range todo {
+		err = t.applyDocLOCKED(partition, doc, doc.Seq)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	seq = todo[len(todo)-1].Seq
+
+	err = t.opaqueSetLOCKED(partition, seq)
+	if err != nil {
+		return 0, err
+	}
+
+	return seq, nil
+}
+
+func (t *HTTPFeed) applyDocLOCKED(partition string, doc *HTTPFeedDoc,
+	seq uint64) error {
+	dest := t.dests[partition]
+
+	var err error
+	if doc.Op == HTTP_FEED_OP_DELETE {
+		err = dest.DataDelete(partition, []byte(doc.Key), seq,
+			0, DEST_EXTRAS_TYPE_NIL, nil)
+		atomic.AddUint64(&t.stats.TotDataDelete, 1)
+	} else {
+		err = dest.DataUpdate(partition, []byte(doc.Key), seq,
+			doc.Value, 0, DEST_EXTRAS_TYPE_NIL, nil)
+		atomic.AddUint64(&t.stats.TotDataUpdate, 1)
+	}
+	if err != nil {
+		return fmt.Errorf("feed_http: %s, key: %s,"+
+			" partition: %s, err: %v", doc.Op, doc.Key, partition, err)
+	}
+
+	return nil
+}
+
+func (t *HTTPFeed) opaqueSetLOCKED(partition string, seq uint64) error {
+	opaque, _ := json.Marshal(httpFeedOpaque{Seq: seq})
+
+	err := t.dests[partition].OpaqueSet(partition, opaque)
+	if err != nil {
+		return fmt.Errorf("feed_http: OpaqueSet,"+
+			" partition: %s, err: %v", partition, err)
+	}
+
+	t.seqs[partition] = seq
+
+	return nil
+}
+
+// reservedSeqLOCKED returns the seq up to which the partition's seqs
+// were reserved in the Cfg.
+func (t *HTTPFeed) reservedSeqLOCKED(partition string) (uint64, error) {
+	if t.cfg == nil {
+		return 0, nil
+	}
+
+	seqs, _, err := cfgGetHTTPFeedSeqs(t.cfg)
+	if err != nil {
+		return 0, err
+	}
+
+	return seqs.Reserved[t.indexUUID][partition], nil
+}
+
+// reserveSeqsLOCKED makes sure that the partition's seqs are reserved
+// in the Cfg up to at least the given seq, by reserving another
+// block of HTTPFeedSeqReserve seqs when needed.
+func (t *HTTPFeed) reserveSeqsLOCKED(partition string, seq uint64) error {
+	if t.cfg == nil || seq <= t.reserved[partition] {
+		return nil
+	}
+
+	for {
+		seqs, cas, err := cfgGetHTTPFeedSeqs(t.cfg)
+		if err != nil {
+			return err
+		}
+
+		reserved := seqs.Reserved[t.indexUUID][partition]
+		if reserved < seq {
+			reserved = seq
+		}
+		reserved += HTTPFeedSeqReserve
+
+		err = t.pruneHTTPFeedSeqs(seqs)
+		if err != nil {
+			return err
+		}
+
+		if seqs.Reserved[t.indexUUID] == nil {
+			seqs.Reserved[t.indexUUID] = map[string]uint64{}
+		}
+		seqs.Reserved[t.indexUUID][partition] = reserved
+
+		buf, err := json.Marshal(seqs)
+		if err != nil {
+			return err
+		}
+
+		_, err = t.cfg.Set(HTTP_FEED_SEQS_KEY, buf, cas)
+		if err != nil {
+			if _, ok := err.(*CfgCASError); ok {
+				continue
+			}
+			return fmt.Errorf("feed_http: could not reserve seqs,"+
+				" partition: %s, err: %v", partition, err)
+		}
+
+		t.reserved[partition] = reserved
+
+		return nil
+	}
+}
+
+// pruneHTTPFeedSeqs removes the reservations of the indexes that no
+// longer exist.
+func (t *HTTPFeed) pruneHTTPFeedSeqs(seqs *httpFeedSeqs) error {
+	indexDefs, _, err := CfgGetIndexDefs(t.cfg)
+	if err != nil {
+		return err
+	}
+
+	indexUUIDs := map[string]bool{t.indexUUID: true}
+	if indexDefs != nil {
+		for _, indexDef := range indexDefs.IndexDefs {
+			indexUUIDs[indexDef.UUID] = true
+		}
+	}
+
+	for indexUUID := range seqs.Reserved {
+		if !indexUUIDs[indexUUID] {
+			delete(seqs.Reserved, indexUUID)
+		}
+	}
+
+	return nil
+}
+
+func cfgGetHTTPFeedSeqs(cfg Cfg) (*httpFeedSeqs, uint64, error) {
+	v, cas, err := cfg.Get(HTTP_FEED_SEQS_KEY, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	seqs := &httpFeedSeqs{}
+	if len(v) > 0 {
+		err = json.Unmarshal(v, seqs)
+		if err != nil {
+			return nil, 0, fmt.Errorf("feed_http: could not parse"+
+				" %s, err: %v", HTTP_FEED_SEQS_KEY, err)
+		}
+	}
+	if seqs.Reserved == nil {
+		seqs.Reserved = map[string]map[string]uint64{}
+	}
+
+	return seqs, cas, nil
+}
+
+// -----------------------------------------------------
+
+// HTTPFeedPartition returns the source partition of a document key,
+// given the PrimarySourceParams.NumPartitions of an index.
+func HTTPFeedPartition(key []byte, numPartitions int) string {
+	if numPartitions <= 0 {
+		return ""
+	}
+	return strconv.Itoa(int(crc32.ChecksumIEEE(key) % uint32(numPartitions)))
+}
+
+// HTTPFeedPartitionLookUp returns the source partition of a docID,
+// and is the FeedPartitionLookUpFunc of the "http" source type.
+func HTTPFeedPartitionLookUp(docID, server string,
+	sourceDetails *IndexDef, req *http.Request) (string, error) {
+	params := &PrimarySourceParams{}
+	if sourceDetails.SourceParams != "" {
+		err := json.Unmarshal([]byte(sourceDetails.SourceParams), params)
+		if err != nil {
+			return "", fmt.Errorf("feed_http: could not parse"+
+				" sourceParams: %s, err: %v", sourceDetails.SourceParams, err)
+		}
+	}
+	return HTTPFeedPartition([]byte(docID), params.NumPartitions), nil
+}
+
+// -----------------------------------------------------
+
+// HTTPFeedRouteDocs groups the docs of a "http" sourced index by the
+// primary node of their source partition, which is the wanted node
+// with the lowest priority that may write to the partition's plan
+// pindex.  The nodeDefs of the primaries are also returned.
+func HTTPFeedRouteDocs(mgr *Manager, indexDef *IndexDef,
+	docs []*HTTPFeedDoc) (map[string][]*HTTPFeedDoc, map[string]*NodeDef,
+	error) {
+	params, nodeDefs, primaries, _, err := httpFeedPartitionNodes(mgr,
+		indexDef)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rv := map[string][]*HTTPFeedDoc{}
+	rvNodeDefs := map[string]*NodeDef{}
+
+	for _, doc := range docs {
+		partition := HTTPFeedPartition([]byte(doc.Key), params.NumPartitions)
+
+		primary := primaries[partition]
+		if primary == "" {
+			return nil, nil, fmt.Errorf("feed_http: no writable node"+
+				" for key: %s, partition: %s, index: %s",
+				doc.Key, partition, indexDef.Name)
+		}
+
+		rv[primary] = append(rv[primary], doc)
+		rvNodeDefs[primary] = nodeDefs.NodeDefs[primary]
+	}
+
+	return rv, rvNodeDefs, nil
+}
+
+// HTTPFeedRouteReplicas groups the docs of a "http" sourced index,
+// whose seqs were assigned by their primary, by the other wanted
+// plan nodes of their source partition.  The nodeDefs of the replicas
+// are also returned.
+func HTTPFeedRouteReplicas(mgr *Manager, indexDef *IndexDef,
+	docs []*HTTPFeedDoc) (map[string][]*HTTPFeedDoc, map[string]*NodeDef,
+	error) {
+	params, nodeDefs, _, replicas, err := httpFeedPartitionNodes(mgr,
+		indexDef)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rv := map[string][]*HTTPFeedDoc{}
+	rvNodeDefs := map[string]*NodeDef{}
+
+	for _, doc := range docs {
+		partition := HTTPFeedPartition([]byte(doc.Key), params.NumPartitions)
+
+		for _, replica := range replicas[partition] {
+			rv[replica] = append(rv[replica], doc)
+			rvNodeDefs[replica] = nodeDefs.NodeDefs[replica]
+		}
+	}
+
+	return rv, rvNodeDefs, nil
+}
+
+// httpFeedPartitionNodes returns the primary nodeUUID and the replica
+// nodeUUIDs of each source partition of a "http" sourced index.
+func httpFeedPartitionNodes(mgr *Manager, indexDef *IndexDef) (
+	*PrimarySourceParams, *NodeDefs, map[string]string,
+	map[string][]string, error) {
+	if indexDef.SourceType != SOURCE_HTTP {
+		return nil, nil, nil, nil, fmt.Errorf("feed_http: index: %s,"+
+			" has sourceType: %s, not: %s",
+			indexDef.Name, indexDef.SourceType, SOURCE_HTTP)
+	}
+
+	params := &PrimarySourceParams{}
+	if indexDef.SourceParams != "" {
+		err := json.Unmarshal([]byte(indexDef.SourceParams), params)
+		if err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("feed_http: could not"+
+				" parse sourceParams: %s, err: %v", indexDef.SourceParams, err)
+		}
+	}
+
+	nodeDefs, err := mgr.GetNodeDefs(NODE_DEFS_WANTED, false)
+	if err != nil || nodeDefs == nil {
+		return nil, nil, nil, nil, fmt.Errorf("feed_http: could not get"+
+			" wanted nodeDefs, err: %v", err)
+	}
+
+	_, planPIndexesByName, err := mgr.GetPlanPIndexes(false)
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("feed_http: could not get"+
+			" planPIndexes, err: %v", err)
+	}
+
+	// Keyed by source partition.
+	primaries := map[string]string{}
+	replicas := map[string][]string{}
+
+	for _, planPIndex := range planPIndexesByName[indexDef.Name] {
+		if planPIndex.IndexUUID != indexDef.UUID {
+			continue
+		}
+
+		primary := ""
+		primaryPriority := math.MaxInt64
+
+		var nodeUUIDs []string
+		for nodeUUID := range planPIndex.Nodes {
+			if nodeDefs.NodeDefs[nodeUUID] != nil {
+				nodeUUIDs = append(nodeUUIDs, nodeUUID)
+			}
+		}
+		sort.Strings(nodeUUIDs) // For stability among equal priorities.
+
+		for _, nodeUUID := range nodeUUIDs {
+			planPIndexNode := planPIndex.Nodes[nodeUUID]
+			if PlanPIndexNodeCanWrite(planPIndexNode) &&
+				planPIndexNode.Priority < primaryPriority {
+				primary = nodeUUID
+				primaryPriority = planPIndexNode.Priority
+			}
+		}
+
+		var others []string
+		for _, nodeUUID := range nodeUUIDs {
+			if nodeUUID != primary {
+				others = append(others, nodeUUID)
+			}
+		}
+
+		for _, partition := range strings.Split(planPIndex.SourcePartitions, ",") {
+			primaries[partition] = primary
+			replicas[partition] = others
+		}
+	}
+
+	return params, nodeDefs, primaries, replicas, nil
+}
+
+// HTTPFeedApply feeds the docs of a "http" sourced index to the local
+// HTTPFeed's of the index, where the local node must be the primary
+// of the docs' source partitions.  The optional replicate callback
+// is invoked by each HTTPFeed with its docs and their assigned seqs.
+func HTTPFeedApply(mgr *Manager, indexDef *IndexDef,
+	docs []*HTTPFeedDoc, replicate HTTPFeedReplicateFunc) (
+	ConsistencyVector, error) {
+	return httpFeedApply(mgr, indexDef, docs,
+		func(httpFeed *HTTPFeed, docs []*HTTPFeedDoc) (
+			ConsistencyVector, error) {
+			return httpFeed.ApplyEx(docs, replicate)
+		})
+}
+
+// HTTPFeedApplyReplica feeds the docs of a "http" sourced index,
+// which were replicated by the primaries of their source partitions,
+// to the local HTTPFeed's of the index.
+func HTTPFeedApplyReplica(mgr *Manager, indexDef *IndexDef,
+	docs []*HTTPFeedDoc) (ConsistencyVector, error) {
+	return httpFeedApply(mgr, indexDef, docs,
+		func(httpFeed *HTTPFeed, docs []*HTTPFeedDoc) (
+			ConsistencyVector, error) {
+			return httpFeed.ApplyReplica(docs)
+		})
+}
+
+func httpFeedApply(mgr *Manager, indexDef *IndexDef,
+	docs []*HTTPFeedDoc, apply func(*HTTPFeed, []*HTTPFeedDoc) (
+		ConsistencyVector, error)) (ConsistencyVector, error) {
+	params := &PrimarySourceParams{}
+	if indexDef.SourceParams != "" {
+		err := json.Unmarshal([]byte(indexDef.SourceParams), params)
+		if err != nil {
+			return nil, fmt.Errorf("feed_http: could not parse"+
+				" sourceParams: %s, err: %v", indexDef.SourceParams, err)
+		}
+	}
+
+	// Keyed by source partition.
+	httpFeeds := map[string]*HTTPFeed{}
+
+	feeds, _ := mgr.CurrentMaps()
+	for _, feed := range feeds {
+		httpFeed, ok := UnwrapFeed(feed).(*HTTPFeed)
+		if ok && httpFeed.IndexName() == indexDef.Name &&
+			httpFeed.IndexUUID() == indexDef.UUID {
+			for partition := range httpFeed.Dests() {
+				httpFeeds[partition] = httpFeed
+			}
+		}
+	}
+
+	var feedsOrdered []*HTTPFeed
+
+	byFeed := map[*HTTPFeed][]*HTTPFeedDoc{}
+	for _, doc := range docs {
+		partition := HTTPFeedPartition([]byte(doc.Key), params.NumPartitions)
+
+		httpFeed := httpFeeds[partition]
+		if httpFeed == nil {
+			return nil, fmt.Errorf("feed_http: no local feed"+
+				" for key: %s, partition: %s, index: %s",
+				doc.Key, partition, indexDef.Name)
+		}
+
+		if byFeed[httpFeed] == nil {
+			feedsOrdered = append(feedsOrdered, httpFeed)
+		}
+		byFeed[httpFeed] = append(byFeed[httpFeed], doc)
+	}
+
+	rv := ConsistencyVector{}
+
+	for _, httpFeed := range feedsOrdered {
+		cv, err := apply(httpFeed, byFeed[httpFeed])
+		if err != nil {
+			return nil, err
+		}
+		for partition, seq := range cv {
+			rv[partition] = seq
+		}
+	}
+
+	return rv, nil
+}
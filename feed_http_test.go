@@ -0,0 +1,369 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// httpFeedTestDest records the mutations and opaque values it
+// receives, and can be made to fail.
+type httpFeedTestDest struct {
+	TestDest
+
+	updates   []string // Entries of "partition/key/seq".
+	deletes   []string
+	snapshots []string // Entries of "partition/start/end".
+	opaques   map[string][]byte
+	failKey   string
+}
+
+func newHTTPFeedTestDest() *httpFeedTestDest {
+	return &httpFeedTestDest{opaques: map[string][]byte{}}
+}
+
+func (d *httpFeedTestDest) DataUpdate(partition string,
+	key []byte, seq uint64, val []byte,
+	cas uint64, extrasType DestExtrasType, extras []byte) error {
+	if string(key) == d.failKey {
+		return fmt.Errorf("failKey")
+	}
+	d.updates = append(d.updates, fmt.Sprintf("%s/%s/%d", partition, key, seq))
+	return nil
+}
+
+func (d *httpFeedTestDest) DataDelete(partition string,
+	key []byte, seq uint64,
+	cas uint64, extrasType DestExtrasType, extras []byte) error {
+	d.deletes = append(d.deletes, fmt.Sprintf("%s/%s/%d", partition, key, seq))
+	return nil
+}
+
+func (d *httpFeedTestDest) SnapshotStart(partition string,
+	snapStart, snapEnd uint64) error {
+	d.snapshots = append(d.snapshots,
+		fmt.Sprintf("%s/%d/%d", partition, snapStart, snapEnd))
+	return nil
+}
+
+func (d *httpFeedTestDest) OpaqueSet(partition string, value []byte) error {
+	d.opaques[partition] = append([]byte(nil), value...)
+	return nil
+}
+
+func (d *httpFeedTestDest) OpaqueGet(partition string) (
+	[]byte, uint64, error) {
+	return d.opaques[partition], 0, nil
+}
+
+func TestHTTPFeedPartition(t *testing.T) {
+	if p := HTTPFeedPartition([]byte("a"), 0); p != "" {
+		t.Errorf("expected the \"\" partition, got: %s", p)
+	}
+
+	counts := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+
+		p := HTTPFeedPartition(key, 8)
+		if p != HTTPFeedPartition(key, 8) {
+			t.Errorf("expected a stable partition, key: %s", key)
+		}
+
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 || n >= 8 {
+			t.Errorf("expected a partition in range, got: %s", p)
+		}
+		counts[p]++
+	}
+	if len(counts) != 8 {
+		t.Errorf("expected every partition to be used, got: %v", counts)
+	}
+
+	p, err := HTTPFeedPartitionLookUp("key-1", "", &IndexDef{
+		SourceParams: `{"numPartitions":8}`,
+	}, nil)
+	if err != nil || p != HTTPFeedPartition([]byte("key-1"), 8) {
+		t.Errorf("expected lookup to match, p: %s, err: %v", p, err)
+	}
+}
+
+func TestHTTPFeedApply(t *testing.T) {
+	dest := newHTTPFeedTestDest()
+
+	dests := map[string]Dest{}
+	for i := 0; i < 2; i++ {
+		dests[strconv.Itoa(i)] = dest
+	}
+
+	feed, err := NewHTTPFeed("f", "idx", "uuid", `{"numPartitions":2}`,
+		dests, false)
+	if err != nil {
+		t.Fatalf("expected NewHTTPFeed to work, err: %v", err)
+	}
+
+	var keys [2]string // A key per partition.
+	for i := 0; keys[0] == "" || keys[1] == ""; i++ {
+		key := fmt.Sprintf("k%d", i)
+		n, _ := strconv.Atoi(HTTPFeedPartition([]byte(key), 2))
+		keys[n] = key
+	}
+
+	cv, err := feed.Apply([]*HTTPFeedDoc{
+		{Op: HTTP_FEED_OP_UPSERT, Key: keys[0], Value: []byte(`{}`)},
+		{Op: HTTP_FEED_OP_UPSERT, Key: keys[0], Value: []byte(`{}`)},
+		{Op: HTTP_FEED_OP_DELETE, Key: keys[1]},
+	})
+	if err != nil {
+		t.Fatalf("expected Apply to work, err: %v", err)
+	}
+	if len(cv) != 2 || cv["0"] != 2 || cv["1"] != 1 {
+		t.Errorf("unexpected consistency vector: %v", cv)
+	}
+	if len(dest.updates) != 2 || dest.updates[1] != "0/"+keys[0]+"/2" ||
+		len(dest.deletes) != 1 || dest.deletes[0] != "1/"+keys[1]+"/1" {
+		t.Errorf("unexpected mutations, updates: %v, deletes: %v",
+			dest.updates, dest.deletes)
+	}
+	if len(dest.snapshots) != 2 || dest.snapshots[0] != "0/1/2" {
+		t.Errorf("expected a snapshot per partition, got: %v", dest.snapshots)
+	}
+
+	// A restarted feed continues from the persisted seqs.
+	feed2, _ := NewHTTPFeed("f", "idx", "uuid", `{"numPartitions":2}`,
+		dests, false)
+	cv, err = feed2.Apply([]*HTTPFeedDoc{
+		{Op: HTTP_FEED_OP_UPSERT, Key: keys[0], Value: []byte(`{}`)},
+	})
+	if err != nil || cv["0"] != 3 {
+		t.Errorf("expected seq 3, cv: %v, err: %v", cv, err)
+	}
+
+	// A failed apply doesn't persist its seqs.
+	dest.failKey = keys[0]
+	_, err = feed2.Apply([]*HTTPFeedDoc{
+		{Op: HTTP_FEED_OP_UPSERT, Key: keys[0], Value: []byte(`{}`)},
+	})
+	if err == nil {
+		t.Errorf("expected a dest err")
+	}
+	dest.failKey = ""
+	cv, _ = feed2.Apply([]*HTTPFeedDoc{
+		{Op: HTTP_FEED_OP_UPSERT, Key: keys[0], Value: []byte(`{}`)},
+	})
+	if cv["0"] != 4 {
+		t.Errorf("expected seq 4 after a failure, cv: %v", cv)
+	}
+
+	// Keys of partitions that the feed doesn't have are rejected.
+	feed3, _ := NewHTTPFeed("f", "idx", "uuid", `{"numPartitions":2}`,
+		map[string]Dest{"0": dest}, false)
+	_, err = feed3.Apply([]*HTTPFeedDoc{{Op: HTTP_FEED_OP_DELETE, Key: keys[1]}})
+	if err == nil {
+		t.Errorf("expected an err for a partition without a dest")
+	}
+
+	feed3.Close()
+	_, err = feed3.Apply([]*HTTPFeedDoc{{Op: HTTP_FEED_OP_DELETE, Key: keys[0]}})
+	if err == nil {
+		t.Errorf("expected an err for a closed feed")
+	}
+
+	disabled, _ := NewHTTPFeed("f", "idx", "uuid", `{"numPartitions":2}`,
+		dests, true)
+	_, err = disabled.Apply([]*HTTPFeedDoc{{Op: HTTP_FEED_OP_DELETE, Key: keys[0]}})
+	if err == nil {
+		t.Errorf("expected an err for a disabled feed")
+	}
+}
+
+func TestHTTPFeedReplicate(t *testing.T) {
+	dest, replicaDest := newHTTPFeedTestDest(), newHTTPFeedTestDest()
+
+	feed, _ := NewHTTPFeed("f", "idx", "uuid", `{"numPartitions":1}`,
+		map[string]Dest{"0": dest}, false)
+	replica, _ := NewHTTPFeed("f", "idx", "uuid", `{"numPartitions":1}`,
+		map[string]Dest{"0": replicaDest}, false)
+
+	var replicated []*HTTPFeedDoc
+
+	replicate := func(docs []*HTTPFeedDoc) error {
+		replicated = append(replicated, docs...)
+		_, err := replica.ApplyReplica(docs)
+		return err
+	}
+
+	cv, err := feed.ApplyEx([]*HTTPFeedDoc{
+		{Op: HTTP_FEED_OP_UPSERT, Key: "a", Value: []byte(`{}`)},
+		{Op: HTTP_FEED_OP_DELETE, Key: "b"},
+	}, replicate)
+	if err != nil || cv["0"] != 2 {
+		t.Fatalf("expected ApplyEx to work, cv: %v, err: %v", cv, err)
+	}
+	if len(replicated) != 2 || replicated[0].Seq != 1 ||
+		replicated[1].Seq != 2 {
+		t.Errorf("expected the docs with their seqs, got: %+v", replicated)
+	}
+	if len(replicaDest.updates) != 1 || replicaDest.updates[0] != "0/a/1" ||
+		len(replicaDest.deletes) != 1 || replicaDest.deletes[0] != "0/b/2" ||
+		len(replicaDest.snapshots) != 1 || replicaDest.snapshots[0] != "0/1/2" {
+		t.Errorf("expected the replica to have the primary's seqs,"+
+			" updates: %v, deletes: %v, snapshots: %v", replicaDest.updates,
+			replicaDest.deletes, replicaDest.snapshots)
+	}
+
+	// A retried replication is skipped.
+	cv, err = replica.ApplyReplica(replicated)
+	if err != nil || cv["0"] != 2 || len(replicaDest.updates) != 1 {
+		t.Errorf("expected a retry to be skipped, cv: %v, err: %v", cv, err)
+	}
+
+	// A failed replication fails the apply.
+	_, err = feed.ApplyEx([]*HTTPFeedDoc{{Op: HTTP_FEED_OP_DELETE, Key: "a"}},
+		func(docs []*HTTPFeedDoc) error { return fmt.Errorf("down") })
+	if err == nil {
+		t.Errorf("expected a replication err")
+	}
+}
+
+func TestHTTPFeedSeqReserve(t *testing.T) {
+	defer func(n uint64) { HTTPFeedSeqReserve = n }(HTTPFeedSeqReserve)
+	HTTPFeedSeqReserve = 10
+
+	cfg := NewCfgMem()
+
+	apply := func(feed *HTTPFeed, n int) ConsistencyVector {
+		var docs []*HTTPFeedDoc
+		for i := 0; i < n; i++ {
+			docs = append(docs, &HTTPFeedDoc{Op: HTTP_FEED_OP_DELETE, Key: "a"})
+		}
+		cv, err := feed.Apply(docs)
+		if err != nil {
+			t.Fatalf("expected Apply to work, err: %v", err)
+		}
+		return cv
+	}
+
+	feed, _ := NewHTTPFeed("f", "idx", "uuid", `{"numPartitions":1}`,
+		map[string]Dest{"0": newHTTPFeedTestDest()}, false)
+	feed.cfg = cfg
+
+	if cv := apply(feed, 3); cv["0"] != 3 {
+		t.Errorf("expected seq 3, cv: %v", cv)
+	}
+	if cv := apply(feed, 12); cv["0"] != 15 {
+		t.Errorf("expected seq 15, cv: %v", cv)
+	}
+
+	seqs, _, err := cfgGetHTTPFeedSeqs(cfg)
+	if err != nil || seqs.Reserved["uuid"]["0"] != 25 {
+		t.Errorf("expected a reservation in the cfg, seqs: %+v, err: %v",
+			seqs, err)
+	}
+
+	// A pindex that's moved to another node starts out empty, but its
+	// seqs continue after the reservation of the previous primary.
+	moved, _ := NewHTTPFeed("f", "idx", "uuid", `{"numPartitions":1}`,
+		map[string]Dest{"0": newHTTPFeedTestDest()}, false)
+	moved.cfg = cfg
+
+	if cv := apply(moved, 1); cv["0"] != 26 {
+		t.Errorf("expected seq 26 after a move, cv: %v", cv)
+	}
+
+	// The reservations of deleted indexes are pruned.
+	seqs.Reserved["deleted"] = map[string]uint64{"0": 1}
+	buf, _ := json.Marshal(seqs)
+	cfg.Set(HTTP_FEED_SEQS_KEY, buf, 0)
+
+	apply(moved, 20)
+
+	seqs, _, _ = cfgGetHTTPFeedSeqs(cfg)
+	if seqs.Reserved["deleted"] != nil || seqs.Reserved["uuid"]["0"] != 56 {
+		t.Errorf("expected a pruned reservation, seqs: %+v", seqs)
+	}
+}
+
+func TestHTTPFeedManager(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	mgr := NewManager(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil)
+	err := mgr.Start("wanted")
+	if err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+
+	err = mgr.CreateIndex(SOURCE_HTTP, "src", "", `{"numPartitions":4}`,
+		"blackhole", "idx", "", PlanParams{MaxPartitionsPerPIndex: 1}, "")
+	if err != nil {
+		t.Fatalf("expected CreateIndex to work, err: %v", err)
+	}
+	err = mgr.CreateIndex("primary", "src", "", "",
+		"blackhole", "notHTTP", "", PlanParams{}, "")
+	if err != nil {
+		t.Fatalf("expected CreateIndex to work, err: %v", err)
+	}
+
+	mgr.PlannerKick("test")
+	mgr.JanitorKick("test")
+
+	feeds, _ := mgr.CurrentMaps()
+	numHTTPFeeds := 0
+	for _, feed := range feeds {
+		if _, ok := feed.(*HTTPFeed); ok {
+			numHTTPFeeds++
+		}
+	}
+	if numHTTPFeeds != 1 {
+		t.Errorf("expected a http feed, feeds: %v", feeds)
+	}
+
+	indexDef, _, _ := mgr.GetIndexDef("idx", true)
+
+	var docs []*HTTPFeedDoc
+	for i := 0; i < 20; i++ {
+		docs = append(docs, &HTTPFeedDoc{Op: HTTP_FEED_OP_UPSERT,
+			Key: fmt.Sprintf("k%d", i), Value: []byte(`{}`)})
+	}
+
+	docsByNode, nodeDefs, err := HTTPFeedRouteDocs(mgr, indexDef, docs)
+	if err != nil || len(docsByNode) != 1 ||
+		len(docsByNode[mgr.UUID()]) != 20 || nodeDefs[mgr.UUID()] == nil {
+		t.Fatalf("expected every doc to route to the node, err: %v", err)
+	}
+
+	cv, err := HTTPFeedApply(mgr, indexDef, docs, nil)
+	if err != nil || len(cv) != 4 {
+		t.Fatalf("expected a seq per partition, cv: %v, err: %v", cv, err)
+	}
+	total := uint64(0)
+	for _, seq := range cv {
+		total += seq
+	}
+	if total != 20 {
+		t.Errorf("expected seqs to add up to the docs, cv: %v", cv)
+	}
+
+	notHTTP, _, _ := mgr.GetIndexDef("notHTTP", false)
+	_, _, err = HTTPFeedRouteDocs(mgr, notHTTP, docs)
+	if err == nil {
+		t.Errorf("expected routing of a non-http index to fail")
+	}
+}
@@ -0,0 +1,672 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// The stage types of a FeedPipeline.
+const (
+	// Drops mutations whose keys don't match the Regexp.
+	FEED_PIPELINE_STAGE_KEY_INCLUDE = "keyInclude"
+
+	// Drops mutations whose keys match the Regexp.
+	FEED_PIPELINE_STAGE_KEY_EXCLUDE = "keyExclude"
+
+	// Rewrites the keys that match the Regexp with the Replace
+	// template, which may refer to submatches like $1.
+	FEED_PIPELINE_STAGE_KEY_REWRITE = "keyRewrite"
+
+	// Keeps only the Fields of JSON documents.
+	FEED_PIPELINE_STAGE_PROJECT = "project"
+
+	// Renames the fields of JSON documents per the Rename map.
+	FEED_PIPELINE_STAGE_RENAME = "rename"
+
+	// Drops the JSON documents whose Field satisfies the Op and
+	// Value, by turning their updates into deletions.
+	FEED_PIPELINE_STAGE_DROP = "drop"
+)
+
+// The ops of a FEED_PIPELINE_STAGE_DROP.
+const (
+	FEED_PIPELINE_OP_EQ      = "eq"
+	FEED_PIPELINE_OP_NE      = "ne"
+	FEED_PIPELINE_OP_LT      = "lt"
+	FEED_PIPELINE_OP_GT      = "gt"
+	FEED_PIPELINE_OP_EXISTS  = "exists"
+	FEED_PIPELINE_OP_MISSING = "missing"
+)
+
+// FeedPipelineSourceParams represents the part of the sourceParams
+// of any source type that configures a FeedPipeline, such as...
+//
+//    {"pipeline":[
+//      {"stage":"keyInclude","regexp":"^user:"},
+//      {"stage":"drop","field":"status","op":"eq","value":"draft"},
+//      {"stage":"project","fields":["name","address.city"]},
+//      {"stage":"rename","rename":{"address.city":"city"}}
+//    ]}
+type FeedPipelineSourceParams struct {
+	Pipeline []*FeedPipelineStageDef `json:"pipeline"`
+}
+
+// A FeedPipelineStageDef defines a stage of a FeedPipeline, where
+// the fields that are used depend on the Stage type.  Fields are
+// dotted paths into JSON documents.
+type FeedPipelineStageDef struct {
+	Stage   string            `json:"stage"` // See FEED_PIPELINE_STAGE_XXX.
+	Regexp  string            `json:"regexp,omitempty"`
+	Replace string            `json:"replace,omitempty"`
+	Fields  []string          `json:"fields,omitempty"`
+	Rename  map[string]string `json:"rename,omitempty"`
+	Field   string            `json:"field,omitempty"`
+	Op      string            `json:"op,omitempty"` // See FEED_PIPELINE_OP_XXX.
+	Value   interface{}       `json:"value,omitempty"`
+}
+
+// FeedPipelineStageStats holds the counters of a stage.
+type FeedPipelineStageStats struct {
+	TotIn       uint64
+	TotOut      uint64
+	TotDropped  uint64 // Mutations that were dropped entirely.
+	TotModified uint64 // Mutations whose key or value were changed.
+	TotDeleted  uint64 // Updates that were turned into deletions.
+}
+
+// A FeedPipeline is a chain of stages that filter and shape the
+// mutations of a Feed before they reach its Dests, so the same
+// source data can be shaped differently for each index.  The key
+// stages apply to both updates and deletions, while the document
+// stages apply only to the updates of JSON documents.
+type FeedPipeline struct {
+	stages []*feedPipelineStage
+}
+
+type feedPipelineStage struct {
+	def   *FeedPipelineStageDef
+	re    *regexp.Regexp
+	stats FeedPipelineStageStats
+	value interface{} // The Value of a drop stage, normalized.
+}
+
+// feedPipelineMutation is a mutation that's flowing through the
+// stages of a FeedPipeline.
+type feedPipelineMutation struct {
+	key      []byte
+	val      []byte
+	doc      map[string]interface{} // Lazily parsed from the val.
+	notJSON  bool
+	deleted  bool
+	modified bool
+}
+
+// NewFeedPipeline returns the FeedPipeline configured by the
+// sourceParams, or nil when there's no pipeline.
+func NewFeedPipeline(sourceParams string) (*FeedPipeline, error) {
+	if !strings.Contains(sourceParams, `"pipeline"`) {
+		return nil, nil
+	}
+
+	var params FeedPipelineSourceParams
+	err := json.Unmarshal([]byte(sourceParams), &params)
+	if err != nil {
+		return nil, fmt.Errorf("feed_pipeline: could not parse"+
+			" sourceParams, err: %v", err)
+	}
+
+	if len(params.Pipeline) <= 0 {
+		return nil, nil
+	}
+
+	rv := &FeedPipeline{}
+
+	for i, def := range params.Pipeline {
+		if def == nil {
+			return nil, fmt.Errorf("feed_pipeline: missing stage, i: %d", i)
+		}
+
+		s := &feedPipelineStage{def: def}
+
+		switch def.Stage {
+		case FEED_PIPELINE_STAGE_KEY_INCLUDE,
+			FEED_PIPELINE_STAGE_KEY_EXCLUDE,
+			FEED_PIPELINE_STAGE_KEY_REWRITE:
+			s.re, err = regexp.Compile(def.Regexp)
+			if err != nil {
+				return nil, fmt.Errorf("feed_pipeline: stage: %d (%s),"+
+					" regexp: %q, err: %v", i, def.Stage, def.Regexp, err)
+			}
+
+		case FEED_PIPELINE_STAGE_PROJECT:
+			if len(def.Fields) <= 0 {
+				return nil, fmt.Errorf("feed_pipeline: stage: %d (%s),"+
+					" missing fields", i, def.Stage)
+			}
+
+		case FEED_PIPELINE_STAGE_RENAME:
+			if len(def.Rename) <= 0 {
+				return nil, fmt.Errorf("feed_pipeline: stage: %d (%s),"+
+					" missing rename", i, def.Stage)
+			}
+
+		case FEED_PIPELINE_STAGE_DROP:
+			if def.Field == "" {
+				return nil, fmt.Errorf("feed_pipeline: stage: %d (%s),"+
+					" missing field", i, def.Stage)
+			}
+
+			switch def.Op {
+			case FEED_PIPELINE_OP_EQ, FEED_PIPELINE_OP_NE:
+				s.value = feedPipelineNormalize(def.Value)
+			case FEED_PIPELINE_OP_LT, FEED_PIPELINE_OP_GT:
+				if _, ok := feedPipelineNumber(def.Value); !ok {
+					return nil, fmt.Errorf("feed_pipeline: stage: %d (%s),"+
+						" op: %s needs a number value", i, def.Stage, def.Op)
+				}
+			case FEED_PIPELINE_OP_EXISTS, FEED_PIPELINE_OP_MISSING:
+			default:
+				return nil, fmt.Errorf("feed_pipeline: stage: %d (%s),"+
+					" unknown op: %q", i, def.Stage, def.Op)
+			}
+
+		default:
+			return nil, fmt.Errorf("feed_pipeline: stage: %d,"+
+				" unknown stage: %q", i, def.Stage)
+		}
+
+		rv.stages = append(rv.stages, s)
+	}
+
+	return rv, nil
+}
+
+// process runs a mutation through the stages, returning false when
+// the mutation's dropped entirely.
+func (p *FeedPipeline) process(m *feedPipelineMutation) bool {
+	for _, s := range p.stages {
+		atomic.AddUint64(&s.stats.TotIn, 1)
+
+		wasDeleted := m.deleted
+
+		keep, modified := s.process(m)
+		if !keep {
+			atomic.AddUint64(&s.stats.TotDropped, 1)
+			return false
+		}
+
+		atomic.AddUint64(&s.stats.TotOut, 1)
+
+		if m.deleted && !wasDeleted {
+			atomic.AddUint64(&s.stats.TotDeleted, 1)
+		} else if modified {
+			atomic.AddUint64(&s.stats.TotModified, 1)
+			m.modified = true
+		}
+	}
+
+	if m.doc != nil && m.modified && !m.deleted {
+		val, err := json.Marshal(m.doc)
+		if err == nil {
+			m.val = val
+		}
+	}
+
+	return true
+}
+
+func (s *feedPipelineStage) process(m *feedPipelineMutation) (
+	keep, modified bool) {
+	switch s.def.Stage {
+	case FEED_PIPELINE_STAGE_KEY_INCLUDE:
+		return s.re.Match(m.key), false
+
+	case FEED_PIPELINE_STAGE_KEY_EXCLUDE:
+		return !s.re.Match(m.key), false
+
+	case FEED_PIPELINE_STAGE_KEY_REWRITE:
+		if !s.re.Match(m.key) {
+			return true, false
+		}
+		m.key = s.re.ReplaceAll(m.key, []byte(s.def.Replace))
+		return true, true
+	}
+
+	if m.deleted || !m.parse() {
+		return true, false
+	}
+
+	switch s.def.Stage {
+	case FEED_PIPELINE_STAGE_PROJECT:
+		doc := map[string]interface{}{}
+		for _, field := range s.def.Fields {
+			if v, ok := feedPipelineGet(m.doc, field); ok {
+				feedPipelineSet(doc, field, v)
+			}
+		}
+		m.doc = doc
+		return true, true
+
+	case FEED_PIPELINE_STAGE_RENAME:
+		for from, to := range s.def.Rename {
+			if v, ok := feedPipelineGet(m.doc, from); ok {
+				feedPipelineDel(m.doc, from)
+				feedPipelineSet(m.doc, to, v)
+				modified = true
+			}
+		}
+		return true, modified
+
+	case FEED_PIPELINE_STAGE_DROP:
+		if s.matches(m.doc) {
+			// An update becomes a deletion, so an earlier version of
+			// the document doesn't linger in the Dest.
+			m.deleted = true
+			m.doc = nil
+			m.val = nil
+		}
+		return true, false
+	}
+
+	return true, false
+}
+
+func (s *feedPipelineStage) matches(doc map[string]interface{}) bool {
+	v, exists := feedPipelineGet(doc, s.def.Field)
+
+	switch s.def.Op {
+	case FEED_PIPELINE_OP_EXISTS:
+		return exists
+	case FEED_PIPELINE_OP_MISSING:
+		return !exists
+	case FEED_PIPELINE_OP_EQ:
+		return exists && reflect.DeepEqual(feedPipelineNormalize(v), s.value)
+	case FEED_PIPELINE_OP_NE:
+		return !exists || !reflect.DeepEqual(feedPipelineNormalize(v), s.value)
+	}
+
+	a, ok := feedPipelineNumber(v)
+	if !exists || !ok {
+		return false
+	}
+	b, _ := feedPipelineNumber(s.def.Value)
+
+	if s.def.Op == FEED_PIPELINE_OP_LT {
+		return a < b
+	}
+	return a > b
+}
+
+// parse lazily parses the val of an update as a JSON object.
+func (m *feedPipelineMutation) parse() bool {
+	if m.doc != nil {
+		return true
+	}
+	if m.notJSON {
+		return false
+	}
+
+	d := json.NewDecoder(bytes.NewReader(m.val))
+	d.UseNumber()
+
+	err := d.Decode(&m.doc)
+	if err != nil || m.doc == nil {
+		m.doc = nil
+		m.notJSON = true
+		return false
+	}
+
+	return true
+}
+
+// Stats writes the per-stage stats as a JSON array.
+func (p *FeedPipeline) Stats(w io.Writer) error {
+	w.Write([]byte("["))
+	for i, s := range p.stages {
+		if i > 0 {
+			w.Write(JsonComma)
+		}
+		_, err := fmt.Fprintf(w, `{"stage":%q,"TotIn":%d,"TotOut":%d,`+
+			`"TotDropped":%d,"TotModified":%d,"TotDeleted":%d}`,
+			s.def.Stage,
+			atomic.LoadUint64(&s.stats.TotIn),
+			atomic.LoadUint64(&s.stats.TotOut),
+			atomic.LoadUint64(&s.stats.TotDropped),
+			atomic.LoadUint64(&s.stats.TotModified),
+			atomic.LoadUint64(&s.stats.TotDeleted))
+		if err != nil {
+			return err
+		}
+	}
+	_, err := w.Write([]byte("]"))
+	return err
+}
+
+// -----------------------------------------------------
+
+func feedPipelineGet(doc map[string]interface{}, path string) (
+	interface{}, bool) {
+	var v interface{} = doc
+	for _, part := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		v, ok = m[part]
+		if !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func feedPipelineSet(doc map[string]interface{}, path string,
+	v interface{}) {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := doc[part].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			doc[part] = next
+		}
+		doc = next
+	}
+	doc[parts[len(parts)-1]] = v
+}
+
+func feedPipelineDel(doc map[string]interface{}, path string) {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := doc[part].(map[string]interface{})
+		if !ok {
+			return
+		}
+		doc = next
+	}
+	delete(doc, parts[len(parts)-1])
+}
+
+// feedPipelineNormalize allows numbers of JSON documents, which are
+// parsed as json.Number's, to equal the float64's of the
+// FeedPipelineStageDef's.
+func feedPipelineNormalize(v interface{}) interface{} {
+	if f, ok := feedPipelineNumber(v); ok {
+		return f
+	}
+	return v
+}
+
+func feedPipelineNumber(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case float64:
+		return x, true
+	case json.Number:
+		f, err := x.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// -----------------------------------------------------
+
+// A DestPipeline implements the Dest, DestEx and DestBatch
+// interfaces by running the mutations through a FeedPipeline before
+// forwarding them to another Dest.  A dropped mutation is forwarded
+// as a deletion of its key with the same seq, so the Dest still
+// reaches the end of each snapshot, as ConsistencyWait() expects, and
+// a document that's newly dropped is removed from the index.
+type DestPipeline struct {
+	Dest     Dest
+	Pipeline *FeedPipeline
+}
+
+func (t *DestPipeline) Close() error {
+	return t.Dest.Close()
+}
+
+// process runs a mutation through the FeedPipeline, where a dropped
+// mutation becomes a deletion of its original key.
+func (t *DestPipeline) process(m *feedPipelineMutation) {
+	key := m.key
+	if !t.Pipeline.process(m) {
+		m.key, m.val, m.deleted, m.modified = key, nil, true, false
+	}
+}
+
+func (t *DestPipeline) DataUpdate(partition string,
+	key []byte, seq uint64, val []byte,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	m := &feedPipelineMutation{key: key, val: val}
+	t.process(m)
+	if m.deleted {
+		return t.Dest.DataDelete(partition, m.key, seq,
+			cas, extrasType, extras)
+	}
+	return t.Dest.DataUpdate(partition, m.key, seq, m.val,
+		cas, extrasType, extras)
+}
+
+func (t *DestPipeline) DataDelete(partition string,
+	key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	m := &feedPipelineMutation{key: key, deleted: true}
+	t.process(m)
+	return t.Dest.DataDelete(partition, m.key, seq,
+		cas, extrasType, extras)
+}
+
+func (t *DestPipeline) DataUpdateEx(partition string,
+	key []byte, seq uint64, val []byte,
+	cas uint64,
+	extrasType DestExtrasType, req interface{}) error {
+	m := &feedPipelineMutation{key: key, val: val}
+	t.process(m)
+
+	destEx, ok := t.Dest.(DestEx)
+	if ok && !m.deleted && !m.modified {
+		return destEx.DataUpdateEx(partition, key, seq, val,
+			cas, extrasType, req)
+	}
+
+	// A DestEx might read the request, which doesn't reflect a
+	// modified key or value, so the Dest methods are used instead.
+	extras := destReqExtras(req)
+	if m.deleted {
+		return t.Dest.DataDelete(partition, m.key, seq,
+			cas, DEST_EXTRAS_TYPE_DCP, extras)
+	}
+	return t.Dest.DataUpdate(partition, m.key, seq, m.val,
+		cas, DEST_EXTRAS_TYPE_DCP, extras)
+}
+
+func (t *DestPipeline) DataDeleteEx(partition string,
+	key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, req interface{}) error {
+	m := &feedPipelineMutation{key: key, deleted: true}
+	t.process(m)
+
+	destEx, ok := t.Dest.(DestEx)
+	if ok && !m.modified {
+		return destEx.DataDeleteEx(partition, key, seq,
+			cas, extrasType, req)
+	}
+
+	return t.Dest.DataDelete(partition, m.key, seq,
+		cas, DEST_EXTRAS_TYPE_DCP, destReqExtras(req))
+}
+
+// DataBatch runs each mutation of the batch through the FeedPipeline,
+// and delivers the resulting mutations as a batch.
+func (t *DestPipeline) DataBatch(partition string,
+	batch *DestBatchData) error {
+	out := &DestBatchData{ExtrasType: batch.ExtrasType}
+
+	for i, seq := range batch.Seqs {
+		m := &feedPipelineMutation{key: batch.Keys[i],
+			val: batch.Vals[i], deleted: batch.Deletes[i]}
+		t.process(m)
+
+		val := m.val
+		if m.deleted {
+			val = nil
+		}
+
+		out.Append(m.key, seq, val, batch.Cas[i], m.deleted,
+			batch.Extras[i])
+	}
+
+	if out.Len() <= 0 {
+		return nil
+	}
+
+	return AsDestBatch(t.Dest).DataBatch(partition, out)
+}
+
+func (t *DestPipeline) SnapshotStart(partition string,
+	snapStart, snapEnd uint64) error {
+	return t.Dest.SnapshotStart(partition, snapStart, snapEnd)
+}
+
+func (t *DestPipeline) OpaqueGet(partition string) (
+	value []byte, lastSeq uint64, err error) {
+	return t.Dest.OpaqueGet(partition)
+}
+
+func (t *DestPipeline) OpaqueSet(partition string, value []byte) error {
+	return t.Dest.OpaqueSet(partition, value)
+}
+
+func (t *DestPipeline) Rollback(partition string, rollbackSeq uint64) error {
+	return t.Dest.Rollback(partition, rollbackSeq)
+}
+
+func (t *DestPipeline) RollbackEx(partition string, partitionUUID uint64,
+	rollbackSeq uint64) error {
+	if destEx, ok := t.Dest.(DestEx); ok {
+		return destEx.RollbackEx(partition, partitionUUID, rollbackSeq)
+	}
+	return t.Dest.Rollback(partition, rollbackSeq)
+}
+
+func (t *DestPipeline) ConsistencyWait(partition, partitionUUID string,
+	consistencyLevel string,
+	consistencySeq uint64,
+	cancelCh <-chan bool) error {
+	return t.Dest.ConsistencyWait(partition, partitionUUID,
+		consistencyLevel, consistencySeq, cancelCh)
+}
+
+func (t *DestPipeline) Count(pindex *PIndex, cancelCh <-chan bool) (
+	uint64, error) {
+	return t.Dest.Count(pindex, cancelCh)
+}
+
+func (t *DestPipeline) Query(pindex *PIndex, req []byte, res io.Writer,
+	cancelCh <-chan bool) error {
+	return t.Dest.Query(pindex, req, res, cancelCh)
+}
+
+func (t *DestPipeline) Stats(w io.Writer) error {
+	return t.Dest.Stats(w)
+}
+
+// -----------------------------------------------------
+
+// A PipelineFeed wraps a Feed whose Dests are DestPipelines, so the
+// Feed's stats include the per-stage stats of the FeedPipeline.
+type PipelineFeed struct {
+	Feed
+	Pipeline *FeedPipeline
+}
+
+func (t *PipelineFeed) Stats(w io.Writer) error {
+	return writeFeedStatsWith(w, t.Feed, "pipeline", t.Pipeline.Stats)
+}
+
+// writeFeedStatsWith writes the stats JSON of a feed with an extra
+// field, whose value is written by the stats func.
+func writeFeedStatsWith(w io.Writer, feed Feed, field string,
+	stats func(io.Writer) error) error {
+	var buf bytes.Buffer
+
+	err := feed.Stats(&buf)
+	if err != nil {
+		return err
+	}
+
+	b := bytes.TrimSpace(buf.Bytes())
+	if len(b) > 0 && b[len(b)-1] == '}' {
+		b = bytes.TrimSpace(b[:len(b)-1])
+		w.Write(b)
+		if len(b) > 1 {
+			w.Write(JsonComma)
+		}
+	} else {
+		w.Write(JsonOpenBrace)
+	}
+
+	w.Write([]byte(`"` + field + `":`))
+
+	err = stats(w)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(JsonCloseBrace)
+	return err
+}
+
+// UnwrapFeed returns the Feed that's wrapped by PipelineFeeds or
+// CoalesceFeeds, for type assertions on concrete feed types.
+func UnwrapFeed(feed Feed) Feed {
+	for {
+		switch f := feed.(type) {
+		case *PipelineFeed:
+			feed = f.Feed
+		case *CoalesceFeed:
+			feed = f.Feed
+		default:
+			return feed
+		}
+	}
+}
+
+// pipelineDests wraps dests with DestPipelines.
+func pipelineDests(pipeline *FeedPipeline,
+	dests map[string]Dest) map[string]Dest {
+	rv := make(map[string]Dest, len(dests))
+	for partition, dest := range dests {
+		rv[partition] = &DestPipeline{Dest: dest, Pipeline: pipeline}
+	}
+	return rv
+}
+
+// destsPipeline returns the FeedPipeline of DestPipelines, if any.
+func destsPipeline(dests map[string]Dest) *FeedPipeline {
+	for _, dest := range dests {
+		if dp, ok := unwrapDestCoalesce(dest).(*DestPipeline); ok {
+			return dp.Pipeline
+		}
+	}
+	return nil
+}
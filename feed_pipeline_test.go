@@ -0,0 +1,179 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestNewFeedPipeline(t *testing.T) {
+	for _, sourceParams := range []string{"", "{}", `{"pipeline":[]}`} {
+		p, err := NewFeedPipeline(sourceParams)
+		if err != nil || p != nil {
+			t.Errorf("expected no pipeline, sourceParams: %s", sourceParams)
+		}
+	}
+
+	for _, sourceParams := range []string{
+		`{"pipeline":"x"}`,
+		`{"pipeline":[null]}`,
+		`{"pipeline":[{"stage":"unknown"}]}`,
+		`{"pipeline":[{"stage":"keyInclude","regexp":"("}]}`,
+		`{"pipeline":[{"stage":"project"}]}`,
+		`{"pipeline":[{"stage":"rename"}]}`,
+		`{"pipeline":[{"stage":"drop","op":"eq"}]}`,
+		`{"pipeline":[{"stage":"drop","field":"a","op":"like"}]}`,
+		`{"pipeline":[{"stage":"drop","field":"a","op":"lt","value":"x"}]}`,
+	} {
+		_, err := NewFeedPipeline(sourceParams)
+		if err == nil {
+			t.Errorf("expected err, sourceParams: %s", sourceParams)
+		}
+	}
+}
+
+func TestDestPipeline(t *testing.T) {
+	pipeline, err := NewFeedPipeline(`{"numPartitions":1,"pipeline":[
+		{"stage":"keyExclude","regexp":"^_"},
+		{"stage":"keyRewrite","regexp":"^user::(.*)$","replace":"u:$1"},
+		{"stage":"drop","field":"status","op":"eq","value":"draft"},
+		{"stage":"drop","field":"age","op":"lt","value":18},
+		{"stage":"project","fields":["name","address.city","age"]},
+		{"stage":"rename","rename":{"address.city":"city"}}
+	]}`)
+	if err != nil || pipeline == nil {
+		t.Fatalf("expected a pipeline, err: %v", err)
+	}
+
+	dest := newFilesFeedTestDest()
+	dp := &DestPipeline{Dest: dest, Pipeline: pipeline}
+
+	update := func(key, val string) {
+		err := dp.DataUpdate("0", []byte(key), 1, []byte(val),
+			0, DEST_EXTRAS_TYPE_NIL, nil)
+		if err != nil {
+			t.Errorf("expected DataUpdate to work, err: %v", err)
+		}
+	}
+
+	update("_sync", `{}`)
+	update("user::a", `{"name":"a","age":30,"x":1,"address":{"city":"c","zip":1}}`)
+	update("user::b", `{"name":"b","status":"draft"}`)
+	update("user::c", `{"name":"c","age":12}`)
+	update("raw", `not json`)
+	dp.DataDelete("0", []byte("user::d"), 2, 0, DEST_EXTRAS_TYPE_NIL, nil)
+	dp.DataDelete("0", []byte("_d"), 2, 0, DEST_EXTRAS_TYPE_NIL, nil)
+
+	dest.m.Lock()
+	var got []string
+	vals := map[string]string{}
+	for _, m := range dest.mutations {
+		got = append(got, m.op+":"+m.key)
+		vals[m.key] = string(m.val)
+	}
+	dest.m.Unlock()
+
+	// Dropped mutations are forwarded as deletions of their keys.
+	exp := []string{"delete:_sync", "update:u:a", "delete:u:b",
+		"delete:u:c", "update:raw", "delete:u:d", "delete:_d"}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected: %v, got: %v", exp, got)
+	}
+	if m := dest.mutations[len(dest.mutations)-1]; m.seq != 2 {
+		t.Errorf("expected a dropped mutation to keep its seq, m: %+v", m)
+	}
+
+	var doc map[string]interface{}
+	json.Unmarshal([]byte(vals["u:a"]), &doc)
+	if !reflect.DeepEqual(doc, map[string]interface{}{
+		"name": "a", "age": float64(30),
+		"address": map[string]interface{}{}, "city": "c",
+	}) {
+		t.Errorf("unexpected shaped doc: %s", vals["u:a"])
+	}
+	if vals["raw"] != "not json" {
+		t.Errorf("expected a non-JSON value to pass through")
+	}
+
+	var buf bytes.Buffer
+	pipeline.Stats(&buf)
+
+	var stats []map[string]interface{}
+	err = json.Unmarshal(buf.Bytes(), &stats)
+	if err != nil || len(stats) != 6 {
+		t.Fatalf("expected stats per stage, stats: %s", buf.Bytes())
+	}
+	if stats[0]["TotIn"] != float64(7) || stats[0]["TotDropped"] != float64(2) ||
+		stats[1]["TotModified"] != float64(4) ||
+		stats[2]["TotDeleted"] != float64(1) ||
+		stats[3]["TotDeleted"] != float64(1) ||
+		stats[5]["TotModified"] != float64(1) {
+		t.Errorf("unexpected stats: %s", buf.Bytes())
+	}
+}
+
+func TestPipelineFeed(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	mgr := NewManager(VERSION, NewCfgMem(), NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+
+	err := mgr.startFeedByType("feedName",
+		"indexName", "indexUUID", "nil",
+		"sourceName", "sourceUUID",
+		`{"pipeline":[{"stage":"keyInclude","regexp":"^a"}]}`,
+		map[string]Dest{"": &TestDest{}})
+	if err != nil {
+		t.Fatalf("expected startFeedByType to work, err: %v", err)
+	}
+
+	feeds, _ := mgr.CurrentMaps()
+
+	feed, ok := feeds["feedName"].(*PipelineFeed)
+	if !ok {
+		t.Fatalf("expected a PipelineFeed, feeds: %#v", feeds)
+	}
+	if _, ok = UnwrapFeed(feed).(*NILFeed); !ok {
+		t.Errorf("expected a wrapped NILFeed")
+	}
+
+	feed.Dests()[""].DataUpdate("", []byte("b"), 1, []byte("{}"),
+		0, DEST_EXTRAS_TYPE_NIL, nil)
+
+	var buf bytes.Buffer
+	feed.Stats(&buf)
+
+	exp := `{"pipeline":[{"stage":"keyInclude","TotIn":1,"TotOut":0,` +
+		`"TotDropped":1,"TotModified":0,"TotDeleted":0}]}`
+	if buf.String() != exp {
+		t.Errorf("expected stats: %s, got: %s", exp, buf.String())
+	}
+
+	err = mgr.stopFeed(feed)
+	if err != nil {
+		t.Errorf("expected stopFeed to work, err: %v", err)
+	}
+
+	err = mgr.startFeedByType("feedName2",
+		"indexName", "indexUUID", "nil",
+		"sourceName", "sourceUUID", `{"pipeline":[{"stage":"x"}]}`,
+		map[string]Dest{"": &TestDest{}})
+	if err == nil {
+		t.Errorf("expected an invalid pipeline to fail")
+	}
+}
@@ -0,0 +1,370 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/couchbase/clog"
+)
+
+const SOURCE_REPLAY = "replay"
+
+func init() {
+	RegisterFeedType(SOURCE_REPLAY, &FeedType{
+		Start:      StartReplayFeed,
+		Partitions: PrimaryFeedPartitions,
+		Public:     true,
+		Description: "general/replay" +
+			" - a recording of Dest method calls (see feedRecordDir)" +
+			" under a dataDir subdirectory will be played back",
+		StartSample: &ReplayFeedParams{
+			NumPartitions: 1024,
+		},
+	})
+}
+
+// ReplayFeed is a Feed interface implementation that plays back a
+// recording of Dest method calls, as written by DestRecorders, from
+// the file...
+//
+//    <dataDir>/replay/<sourceName>
+//
+// Each recorded DataUpdate, DataDelete, SnapshotStart, OpaqueSet and
+// Rollback is invoked on the dest of the recorded partition, so the
+// numPartitions of the ReplayFeedParams must cover the partitions of
+// the recording, such as 1024 for a recording of a couchbase bucket.
+//
+// The recording is played back as fast as possible, or with a Speed
+// relative to the recorded timing.  Faults can be injected by
+// dropping or duplicating mutations, or by stopping after a number
+// of records, where the faults are a deterministic function of the
+// Seed.
+//
+// Limitations: a restarted ReplayFeed plays back the recording from
+// its start, as the recorded OpaqueSet's are played back as-is.
+type ReplayFeed struct {
+	mgr        *Manager
+	name       string
+	indexName  string
+	sourceName string
+	params     *ReplayFeedParams
+	dests      map[string]Dest
+	disable    bool
+
+	m       sync.Mutex
+	closeCh chan struct{}
+
+	stats ReplayFeedStats
+}
+
+// ReplayFeedParams represents the JSON expected as the sourceParams
+// for a ReplayFeed.
+type ReplayFeedParams struct {
+	NumPartitions int `json:"numPartitions"`
+
+	// Speed of 0 plays back as fast as possible, 1 plays back with
+	// the recorded timing, 2 plays back twice as fast, etc.
+	Speed float64 `json:"speed"`
+
+	// Seed of the pseudo-random fault injection.
+	Seed int64 `json:"seed"`
+
+	// DropRate is the probability of skipping a mutation.
+	DropRate float64 `json:"dropRate"`
+
+	// DuplicateRate is the probability of delivering a mutation twice.
+	DuplicateRate float64 `json:"duplicateRate"`
+
+	// StopAfter, when > 0, stops the play back after that many
+	// records, as if the feed crashed.
+	StopAfter int `json:"stopAfter"`
+}
+
+// ReplayFeedStats holds the counters of a ReplayFeed.
+type ReplayFeedStats struct {
+	TotRecord        uint64
+	TotDataUpdate    uint64
+	TotDataDelete    uint64
+	TotSnapshotStart uint64
+	TotOpaqueSet     uint64
+	TotRollback      uint64
+	TotDropped       uint64
+	TotDuplicated    uint64
+	TotUnknownDest   uint64 // Records of partitions without a dest.
+	TotDestErr       uint64
+	TotDone          uint64 // 1 when the play back has finished.
+}
+
+// StartReplayFeed starts a ReplayFeed and is the callback function
+// registered at init/startup time.
+func StartReplayFeed(mgr *Manager, feedName, indexName, indexUUID,
+	sourceType, sourceName, sourceUUID, params string,
+	dests map[string]Dest) error {
+	feed, err := NewReplayFeed(mgr, feedName, indexName, sourceName,
+		params, dests, mgr.tagsMap != nil && !mgr.tagsMap["feed"])
+	if err != nil {
+		return fmt.Errorf("feed_replay: NewReplayFeed,"+
+			" feedName: %s, err: %v", feedName, err)
+	}
+	err = feed.Start()
+	if err != nil {
+		return fmt.Errorf("feed_replay: could not start,"+
+			" feedName: %s, err: %v", feedName, err)
+	}
+	err = mgr.registerFeed(feed)
+	if err != nil {
+		feed.Close()
+		return err
+	}
+	return nil
+}
+
+// NewReplayFeed creates a ready-to-be-started ReplayFeed.
+func NewReplayFeed(mgr *Manager, name, indexName, sourceName,
+	paramsStr string, dests map[string]Dest, disable bool) (
+	*ReplayFeed, error) {
+	if sourceName == "" {
+		return nil, fmt.Errorf("feed_replay: missing source name")
+	}
+
+	if strings.Index(sourceName, "..") >= 0 {
+		return nil, fmt.Errorf("feed_replay: disallowed source name,"+
+			" name: %s, sourceName: %q", name, sourceName)
+	}
+
+	params := &ReplayFeedParams{}
+	if paramsStr != "" {
+		err := json.Unmarshal([]byte(paramsStr), params)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if params.Speed < 0 ||
+		params.DropRate < 0 || params.DropRate > 1 ||
+		params.DuplicateRate < 0 || params.DuplicateRate > 1 {
+		return nil, fmt.Errorf("feed_replay: invalid params,"+
+			" name: %s, params: %s", name, paramsStr)
+	}
+
+	return &ReplayFeed{
+		mgr:        mgr,
+		name:       name,
+		indexName:  indexName,
+		sourceName: sourceName,
+		params:     params,
+		dests:      dests,
+		disable:    disable,
+		closeCh:    make(chan struct{}),
+	}, nil
+}
+
+func (t *ReplayFeed) Name() string {
+	return t.name
+}
+
+func (t *ReplayFeed) IndexName() string {
+	return t.indexName
+}
+
+func (t *ReplayFeed) Start() error {
+	if t.disable {
+		log.Printf("feed_replay: disable, name: %s", t.Name())
+		return nil
+	}
+
+	t.m.Lock()
+	closeCh := t.closeCh
+	t.m.Unlock()
+
+	if closeCh == nil {
+		return nil // Closed.
+	}
+
+	path := t.mgr.DataDir() +
+		string(os.PathSeparator) + SOURCE_REPLAY +
+		string(os.PathSeparator) + t.sourceName
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("feed_replay: could not open recording,"+
+			" name: %s, err: %v", t.Name(), err)
+	}
+
+	go func() {
+		defer f.Close()
+
+		err := t.replay(f, closeCh)
+		if err != nil {
+			log.Warnf("feed_replay: name: %s, err: %v", t.Name(), err)
+		}
+	}()
+
+	return nil
+}
+
+func (t *ReplayFeed) Close() error {
+	t.m.Lock()
+	if t.closeCh != nil {
+		close(t.closeCh)
+		t.closeCh = nil
+	}
+	t.m.Unlock()
+
+	return nil
+}
+
+func (t *ReplayFeed) Dests() map[string]Dest {
+	return t.dests
+}
+
+func (t *ReplayFeed) Stats(w io.Writer) error {
+	_, err := fmt.Fprintf(w, `{"TotRecord":%d,"TotDataUpdate":%d,`+
+		`"TotDataDelete":%d,"TotSnapshotStart":%d,"TotOpaqueSet":%d,`+
+		`"TotRollback":%d,"TotDropped":%d,"TotDuplicated":%d,`+
+		`"TotUnknownDest":%d,"TotDestErr":%d,"TotDone":%d}`,
+		atomic.LoadUint64(&t.stats.TotRecord),
+		atomic.LoadUint64(&t.stats.TotDataUpdate),
+		atomic.LoadUint64(&t.stats.TotDataDelete),
+		atomic.LoadUint64(&t.stats.TotSnapshotStart),
+		atomic.LoadUint64(&t.stats.TotOpaqueSet),
+		atomic.LoadUint64(&t.stats.TotRollback),
+		atomic.LoadUint64(&t.stats.TotDropped),
+		atomic.LoadUint64(&t.stats.TotDuplicated),
+		atomic.LoadUint64(&t.stats.TotUnknownDest),
+		atomic.LoadUint64(&t.stats.TotDestErr),
+		atomic.LoadUint64(&t.stats.TotDone))
+	return err
+}
+
+// -----------------------------------------------------
+
+// replay plays back the recording of r until its end, until
+// StopAfter records, or until the closeCh is closed.
+func (t *ReplayFeed) replay(r io.Reader, closeCh chan struct{}) error {
+	rr := NewDestRecordReader(r)
+
+	rnd := rand.New(rand.NewSource(t.params.Seed))
+
+	var begin time.Time // Wall clock time of the recording's start.
+
+	for n := 0; t.params.StopAfter <= 0 || n < t.params.StopAfter; n++ {
+		select {
+		case <-closeCh:
+			return nil
+		default:
+		}
+
+		rec, err := rr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("feed_replay: read, err: %v", err)
+		}
+
+		atomic.AddUint64(&t.stats.TotRecord, 1)
+
+		if rec.Op == DEST_RECORD_OP_BEGIN {
+			// A recording may be appended to by a restarted feed,
+			// where each restart has its own timing.
+			begin = time.Now()
+			continue
+		}
+
+		if t.params.Speed > 0 {
+			d := time.Duration(float64(rec.At)/t.params.Speed) -
+				time.Since(begin)
+			if d > 0 {
+				select {
+				case <-closeCh:
+					return nil
+				case <-time.After(d):
+				}
+			}
+		}
+
+		dest := t.dests[rec.Partition]
+		if dest == nil {
+			dest = t.dests[""]
+			if dest == nil {
+				atomic.AddUint64(&t.stats.TotUnknownDest, 1)
+				continue
+			}
+		}
+
+		times := 1
+		if rec.Op == DEST_RECORD_OP_UPDATE || rec.Op == DEST_RECORD_OP_DELETE {
+			// Both draws happen for every mutation, so the faults of
+			// a seed don't depend on the rates.
+			drop := rnd.Float64() < t.params.DropRate
+			dup := rnd.Float64() < t.params.DuplicateRate
+			if drop {
+				atomic.AddUint64(&t.stats.TotDropped, 1)
+				times = 0
+			} else if dup {
+				atomic.AddUint64(&t.stats.TotDuplicated, 1)
+				times = 2
+			}
+		}
+
+		for i := 0; i < times; i++ {
+			err = t.apply(dest, rec)
+			if err != nil {
+				atomic.AddUint64(&t.stats.TotDestErr, 1)
+				log.Warnf("feed_replay: name: %s, op: %c, partition: %s,"+
+					" err: %v", t.Name(), rec.Op, rec.Partition, err)
+			}
+		}
+	}
+
+	atomic.StoreUint64(&t.stats.TotDone, 1)
+
+	return nil
+}
+
+func (t *ReplayFeed) apply(dest Dest, rec *DestRecord) error {
+	switch rec.Op {
+	case DEST_RECORD_OP_UPDATE:
+		atomic.AddUint64(&t.stats.TotDataUpdate, 1)
+		return dest.DataUpdate(rec.Partition, rec.Key, rec.Seq, rec.Val,
+			rec.Cas, rec.ExtrasType, rec.Extras)
+
+	case DEST_RECORD_OP_DELETE:
+		atomic.AddUint64(&t.stats.TotDataDelete, 1)
+		return dest.DataDelete(rec.Partition, rec.Key, rec.Seq,
+			rec.Cas, rec.ExtrasType, rec.Extras)
+
+	case DEST_RECORD_OP_SNAPSHOT:
+		atomic.AddUint64(&t.stats.TotSnapshotStart, 1)
+		return dest.SnapshotStart(rec.Partition, rec.Seq, rec.SnapEnd)
+
+	case DEST_RECORD_OP_OPAQUE:
+		atomic.AddUint64(&t.stats.TotOpaqueSet, 1)
+		return dest.OpaqueSet(rec.Partition, rec.Val)
+
+	case DEST_RECORD_OP_ROLLBACK:
+		atomic.AddUint64(&t.stats.TotRollback, 1)
+		return dest.Rollback(rec.Partition, rec.Seq)
+	}
+
+	return nil
+}
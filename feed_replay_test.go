@@ -0,0 +1,205 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// replayFeedTestRecording returns a recording of mutations on two
+// partitions.
+func replayFeedTestRecording(t *testing.T, n int) []byte {
+	var buf bytes.Buffer
+
+	rw, err := NewDestRecordWriter(&buf)
+	if err != nil {
+		t.Fatalf("expected NewDestRecordWriter to work, err: %v", err)
+	}
+
+	dests := map[string]Dest{}
+	for _, partition := range []string{"0", "1"} {
+		dests[partition] = &DestRecorder{
+			Dest:      newHTTPFeedTestDest(),
+			Recording: rw,
+		}
+	}
+
+	for i := 1; i <= n; i++ {
+		d := dests[fmt.Sprintf("%d", i%2)]
+		partition := fmt.Sprintf("%d", i%2)
+		d.SnapshotStart(partition, uint64(i), uint64(i))
+		d.DataUpdate(partition, []byte(fmt.Sprintf("k%d", i)), uint64(i),
+			[]byte("{}"), 0, DEST_EXTRAS_TYPE_NIL, nil)
+		if i%5 == 0 {
+			d.DataDelete(partition, []byte(fmt.Sprintf("k%d", i-2)), uint64(i),
+				0, DEST_EXTRAS_TYPE_NIL, nil)
+		}
+		d.OpaqueSet(partition, []byte(fmt.Sprintf("%d", i)))
+	}
+
+	return buf.Bytes()
+}
+
+func replayFeedTest(t *testing.T, params string, recording []byte) (
+	*ReplayFeed, *httpFeedTestDest) {
+	dest := newHTTPFeedTestDest()
+
+	feed, err := NewReplayFeed(nil, "f", "idx", "src", params,
+		map[string]Dest{"0": dest, "1": dest}, false)
+	if err != nil {
+		t.Fatalf("expected NewReplayFeed to work, err: %v", err)
+	}
+
+	err = feed.replay(bytes.NewReader(recording), make(chan struct{}))
+	if err != nil {
+		t.Fatalf("expected replay to work, err: %v", err)
+	}
+
+	return feed, dest
+}
+
+func TestReplayFeedParams(t *testing.T) {
+	for _, params := range []string{
+		`{"speed":-1}`,
+		`{"dropRate":2}`,
+		`{"duplicateRate":-0.5}`,
+	} {
+		_, err := NewReplayFeed(nil, "f", "idx", "src", params, nil, false)
+		if err == nil {
+			t.Errorf("expected err, params: %s", params)
+		}
+	}
+
+	_, err := NewReplayFeed(nil, "f", "idx", "../src", "", nil, false)
+	if err == nil {
+		t.Errorf("expected err on a disallowed source name")
+	}
+}
+
+func TestReplayFeed(t *testing.T) {
+	recording := replayFeedTestRecording(t, 20)
+
+	feed, dest := replayFeedTest(t, `{"numPartitions":2}`, recording)
+	if len(dest.updates) != 20 || len(dest.deletes) != 4 ||
+		len(dest.snapshots) != 20 ||
+		string(dest.opaques["0"]) != "20" || string(dest.opaques["1"]) != "19" {
+		t.Errorf("expected a faithful replay, dest: %+v", dest)
+	}
+	if dest.updates[0] != "1/k1/1" || dest.deletes[0] != "1/k3/5" {
+		t.Errorf("unexpected replayed mutations, dest: %+v", dest)
+	}
+	if feed.stats.TotDone != 1 || feed.stats.TotRecord != 1+20*3+4 {
+		t.Errorf("unexpected stats: %+v", feed.stats)
+	}
+
+	// Faults are deterministic for a seed.
+	params := `{"numPartitions":2,"seed":7,"dropRate":0.3,"duplicateRate":0.3}`
+	feed1, dest1 := replayFeedTest(t, params, recording)
+	_, dest2 := replayFeedTest(t, params, recording)
+	if !reflect.DeepEqual(dest1.updates, dest2.updates) ||
+		!reflect.DeepEqual(dest1.deletes, dest2.deletes) {
+		t.Errorf("expected deterministic faults, %v vs %v",
+			dest1.updates, dest2.updates)
+	}
+	if feed1.stats.TotDropped == 0 || feed1.stats.TotDuplicated == 0 {
+		t.Errorf("expected faults, stats: %+v", feed1.stats)
+	}
+	if uint64(len(dest1.updates)+len(dest1.deletes)) !=
+		24-feed1.stats.TotDropped+feed1.stats.TotDuplicated {
+		t.Errorf("unexpected mutations, stats: %+v", feed1.stats)
+	}
+
+	feed, dest = replayFeedTest(t, `{"numPartitions":2,"stopAfter":4}`,
+		recording)
+	if len(dest.updates) != 1 || feed.stats.TotRecord != 4 {
+		t.Errorf("expected a stop after 4 records, dest: %+v", dest)
+	}
+
+	// Partitions without a dest are counted.
+	dest = newHTTPFeedTestDest()
+	feed, _ = NewReplayFeed(nil, "f", "idx", "src", "",
+		map[string]Dest{"0": dest}, false)
+	feed.replay(bytes.NewReader(recording), make(chan struct{}))
+	if len(dest.updates) != 10 || feed.stats.TotUnknownDest != 32 {
+		t.Errorf("expected unknown dests, stats: %+v", feed.stats)
+	}
+}
+
+func TestReplayFeedSpeed(t *testing.T) {
+	var buf bytes.Buffer
+
+	rw, _ := NewDestRecordWriter(&buf)
+	rw.Write(&DestRecord{Op: DEST_RECORD_OP_SNAPSHOT, Partition: "0"})
+	time.Sleep(100 * time.Millisecond)
+	rw.Write(&DestRecord{Op: DEST_RECORD_OP_SNAPSHOT, Partition: "0"})
+
+	startTime := time.Now()
+	replayFeedTest(t, `{"numPartitions":1,"speed":2}`, buf.Bytes())
+	if time.Since(startTime) < 40*time.Millisecond {
+		t.Errorf("expected the recorded timing at half the time")
+	}
+
+	startTime = time.Now()
+	replayFeedTest(t, `{"numPartitions":1}`, buf.Bytes())
+	if time.Since(startTime) > 40*time.Millisecond {
+		t.Errorf("expected a replay as fast as possible")
+	}
+}
+
+func TestReplayFeedStart(t *testing.T) {
+	testDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testDir)
+
+	mgr := NewManager(VERSION, NewCfgMem(), NewUUID(), nil,
+		"", 1, "", ":1000", testDir, "some-datasource", nil)
+
+	dest := newHTTPFeedTestDest()
+
+	feed, _ := NewReplayFeed(mgr, "f", "idx", "src", "",
+		map[string]Dest{"": dest}, false)
+	if feed.Start() == nil {
+		t.Errorf("expected an err on a missing recording")
+	}
+
+	os.MkdirAll(filepath.Join(testDir, SOURCE_REPLAY), 0700)
+	ioutil.WriteFile(filepath.Join(testDir, SOURCE_REPLAY, "src"),
+		replayFeedTestRecording(t, 3), 0600)
+
+	feed, _ = NewReplayFeed(mgr, "f", "idx", "src", "",
+		map[string]Dest{"": dest}, false)
+	err := feed.Start()
+	if err != nil {
+		t.Fatalf("expected Start to work, err: %v", err)
+	}
+	defer feed.Close()
+
+	for i := 0; i < 100; i++ {
+		var buf bytes.Buffer
+		feed.Stats(&buf)
+		if bytes.Contains(buf.Bytes(), []byte(`"TotDone":1`)) {
+			if len(dest.updates) != 3 {
+				t.Errorf("expected updates via the default dest, dest: %+v",
+					dest)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("expected the replay to finish")
+}
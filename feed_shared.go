@@ -0,0 +1,549 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/couchbase/clog"
+)
+
+// SHARED_FEED_NAME_PREFIX is the prefix of the names of the feeds of
+// the FeedAllotmentShared feed allotment.
+const SHARED_FEED_NAME_PREFIX = "shared_"
+
+// sharedFeedName returns the name of the feed that's shared by the
+// pindexes, of any index, with the same source and source params.
+//
+// The pipeline and feedAllotment are per-index and don't affect the
+// upstream feed, so they're ignored.  The credentials are also
+// ignored, as their encrypted values differ across indexes, so the
+// pindexes of indexes with credentials share a feed that's started
+// with the credentials of one of them.
+func sharedFeedName(pindex *PIndex) string {
+	return SHARED_FEED_NAME_PREFIX + pindex.SourceType +
+		"_" + pindex.SourceName + "_" + pindex.SourceUUID +
+		fmt.Sprintf("_%08x", crc32.ChecksumIEEE([]byte(
+			sharedFeedNameSourceParams(pindex.SourceParams))))
+}
+
+// sharedFeedNameSourceParams returns the normalized sourceParams of a
+// shared upstream feed without the SecretFields.
+func sharedFeedNameSourceParams(sourceParams string) string {
+	var m map[string]interface{}
+
+	d := json.NewDecoder(strings.NewReader(
+		sharedFeedSourceParams(sourceParams)))
+	d.UseNumber()
+
+	err := d.Decode(&m)
+	if err != nil || m == nil {
+		return sourceParams
+	}
+
+	for _, field := range SecretFields {
+		delete(m, field)
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return sourceParams
+	}
+
+	return string(b)
+}
+
+// sharedFeedSourceParams returns the sourceParams of a shared
+// upstream feed, which are normalized without the per-index parts.
+func sharedFeedSourceParams(sourceParams string) string {
+	var m map[string]interface{}
+
+	d := json.NewDecoder(strings.NewReader(sourceParams))
+	d.UseNumber()
+
+	err := d.Decode(&m)
+	if err != nil || m == nil {
+		return sourceParams
+	}
+
+	delete(m, "pipeline")
+	delete(m, "errorPolicy")
+	delete(m, FeedAllotmentOption)
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return sourceParams
+	}
+
+	return string(b)
+}
+
+// sharedFeedDests returns the DestFanouts, keyed by source partition,
+// that fan out a shared feed to the pindexes.
+func sharedFeedDests(mgr *Manager, pindexes []*PIndex) (
+	map[string]Dest, error) {
+	fanouts := map[string]*DestFanout{}
+
+	for _, pindex := range pindexes {
+		dest, err := sharedFeedTargetDest(pindex)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, partition := range pindexSourcePartitions(pindex) {
+			fanout, exists := fanouts[partition]
+			if !exists {
+				fanout = NewDestFanout()
+				fanout.mgr = mgr
+				fanouts[partition] = fanout
+			}
+
+			// The skipUntil positions are loaded when the feed
+			// invokes OpaqueGet() as it starts.
+			fanout.targets[pindex.Name] = &destFanoutTarget{dest: dest}
+		}
+	}
+
+	rv := make(map[string]Dest, len(fanouts))
+	for partition, fanout := range fanouts {
+		rv[partition] = fanout
+	}
+
+	return rv, nil
+}
+
+// sharedFeedTargetDest returns the dest of a pindex of a shared feed,
+// which runs the index's own pipeline and error policy, if any.
+func sharedFeedTargetDest(pindex *PIndex) (Dest, error) {
+	dest, err := pindexFeedDest(pindex)
+	if err != nil {
+		return nil, fmt.Errorf("feed_shared: invalid errorPolicy,"+
+			" pindex: %s, err: %v", pindex.Name, err)
+	}
+
+	pipeline, err := NewFeedPipeline(pindex.SourceParams)
+	if err != nil {
+		return nil, fmt.Errorf("feed_shared: invalid pipeline,"+
+			" pindex: %s, err: %v", pindex.Name, err)
+	}
+	if pipeline != nil {
+		return &DestPipeline{Dest: dest, Pipeline: pipeline}, nil
+	}
+	return dest, nil
+}
+
+func pindexSourcePartitions(pindex *PIndex) []string {
+	if pindex.SourcePartitions == "" {
+		return []string{""}
+	}
+	return strings.Split(pindex.SourcePartitions, ",")
+}
+
+// destsFanouts returns the DestFanouts of the dests of a shared feed,
+// keyed by source partition, including those that are recorded.
+func destsFanouts(dests map[string]Dest) map[string]*DestFanout {
+	var rv map[string]*DestFanout
+	for partition, dest := range dests {
+		dest = unwrapDestCoalesce(dest)
+		if dr, ok := dest.(*DestRecorder); ok {
+			dest = dr.Dest
+		}
+		if fanout, ok := dest.(*DestFanout); ok {
+			if rv == nil {
+				rv = map[string]*DestFanout{}
+			}
+			rv[partition] = fanout
+		}
+	}
+	return rv
+}
+
+// updateSharedFeed attaches and detaches the pindexes of a shared
+// feed, restarting the feed when an attached pindex is behind the
+// feed's position, so the feed re-streams from the pindex's position
+// while the other pindexes skip what they've already seen.
+func (mgr *Manager) updateSharedFeed(u *FeedUpdate) error {
+	fanouts := destsFanouts(u.Feed.Dests())
+
+	for _, pindexName := range u.Detach {
+		for _, fanout := range fanouts {
+			fanout.Detach(pindexName)
+		}
+	}
+
+	restart := false
+
+ATTACH:
+	for _, pindex := range u.Attach {
+		dest, err := sharedFeedTargetDest(pindex)
+		if err != nil {
+			return err
+		}
+
+		for _, partition := range pindexSourcePartitions(pindex) {
+			fanout := fanouts[partition]
+			if fanout == nil {
+				restart = true
+				break ATTACH
+			}
+
+			_, lastSeq, err := dest.OpaqueGet(partition)
+			if err != nil {
+				return fmt.Errorf("feed_shared: OpaqueGet,"+
+					" pindex: %s, partition: %s, err: %v",
+					pindex.Name, partition, err)
+			}
+
+			if !fanout.Attach(pindex.Name, dest, lastSeq) {
+				restart = true
+				break ATTACH
+			}
+		}
+	}
+
+	if !restart {
+		return nil
+	}
+
+	log.Printf("feed_shared: restart, name: %s", u.Feed.Name())
+
+	err := mgr.stopFeed(u.Feed)
+	if err != nil {
+		return err
+	}
+
+	return mgr.startFeed(u.PIndexes)
+}
+
+// -----------------------------------------------------
+
+// A DestFanout implements the Dest, DestEx and DestBatch interfaces
+// by forwarding the method calls for a source partition to the dests
+// of multiple pindexes, where each dest has its own checkpoints.
+//
+// As a feed starts, OpaqueGet() returns the opaque value of the
+// laggiest dest, so the feed streams from the earliest position, and
+// each dest skips the mutations up to its own position.  A dest whose
+// method call fails is detached, so it doesn't lose mutations while
+// the other dests advance, and the janitor is kicked to re-attach it,
+// which restarts the feed from the dest's position.
+type DestFanout struct {
+	mgr *Manager // For janitor kicks, may be nil.
+
+	m       sync.Mutex
+	targets map[string]*destFanoutTarget // Keyed by pindex name.
+	seq     uint64                       // The position of the feed.
+	snapEnd uint64                       // The end of the current snapshot.
+}
+
+type destFanoutTarget struct {
+	dest      Dest
+	skipUntil uint64 // Mutations with seq <= skipUntil are skipped.
+}
+
+// NewDestFanout returns a DestFanout without dests.
+func NewDestFanout() *DestFanout {
+	return &DestFanout{targets: map[string]*destFanoutTarget{}}
+}
+
+// Attach adds the dest of a pindex, whose position is lastSeq, and
+// returns false when the dest is behind the DestFanout, in which case
+// the feed needs to be restarted.
+func (t *DestFanout) Attach(pindexName string, dest Dest,
+	lastSeq uint64) bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	// The dest needs to start at the next snapshot.
+	if lastSeq < t.seq || lastSeq < t.snapEnd {
+		return false
+	}
+
+	t.targets[pindexName] = &destFanoutTarget{dest: dest, skipUntil: lastSeq}
+
+	return true
+}
+
+// Detach removes the dest of a pindex.
+func (t *DestFanout) Detach(pindexName string) {
+	t.m.Lock()
+	delete(t.targets, pindexName)
+	t.m.Unlock()
+}
+
+// PIndexNames returns the sorted names of the attached pindexes.
+func (t *DestFanout) PIndexNames() []string {
+	t.m.Lock()
+	rv := make([]string, 0, len(t.targets))
+	for pindexName := range t.targets {
+		rv = append(rv, pindexName)
+	}
+	t.m.Unlock()
+
+	sort.Strings(rv)
+
+	return rv
+}
+
+// forwardLOCKED invokes f on the dests that pass the filter,
+// detaching the dests whose invocations fail and kicking the janitor
+// to re-attach them.
+func (t *DestFanout) forwardLOCKED(partition string,
+	filter func(*destFanoutTarget) bool, f func(Dest) error) {
+	for pindexName, target := range t.targets {
+		if !filter(target) {
+			continue
+		}
+
+		err := f(target.dest)
+		if err != nil {
+			log.Warnf("feed_shared: detaching pindex: %s,"+
+				" partition: %s, err: %v", pindexName, partition, err)
+
+			delete(t.targets, pindexName)
+
+			if t.mgr != nil {
+				// The janitor may be waiting on t.m, so it's kicked
+				// asynchronously.
+				go t.mgr.JanitorKick("feed_shared: detached pindex: " +
+					pindexName)
+			}
+		}
+	}
+}
+
+func (t *DestFanout) Close() error {
+	return nil // The pindexes close their own dests.
+}
+
+func (t *DestFanout) DataUpdate(partition string,
+	key []byte, seq uint64, val []byte,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	return t.mutation(partition, seq, func(dest Dest) error {
+		return dest.DataUpdate(partition, key, seq, val,
+			cas, extrasType, extras)
+	})
+}
+
+func (t *DestFanout) DataDelete(partition string,
+	key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, extras []byte) error {
+	return t.mutation(partition, seq, func(dest Dest) error {
+		return dest.DataDelete(partition, key, seq,
+			cas, extrasType, extras)
+	})
+}
+
+func (t *DestFanout) DataUpdateEx(partition string,
+	key []byte, seq uint64, val []byte,
+	cas uint64,
+	extrasType DestExtrasType, req interface{}) error {
+	return t.mutation(partition, seq, func(dest Dest) error {
+		if destEx, ok := dest.(DestEx); ok {
+			return destEx.DataUpdateEx(partition, key, seq, val,
+				cas, extrasType, req)
+		}
+		return dest.DataUpdate(partition, key, seq, val,
+			cas, DEST_EXTRAS_TYPE_DCP, destReqExtras(req))
+	})
+}
+
+func (t *DestFanout) DataDeleteEx(partition string,
+	key []byte, seq uint64,
+	cas uint64,
+	extrasType DestExtrasType, req interface{}) error {
+	return t.mutation(partition, seq, func(dest Dest) error {
+		if destEx, ok := dest.(DestEx); ok {
+			return destEx.DataDeleteEx(partition, key, seq,
+				cas, extrasType, req)
+		}
+		return dest.DataDelete(partition, key, seq,
+			cas, DEST_EXTRAS_TYPE_DCP, destReqExtras(req))
+	})
+}
+
+func (t *DestFanout) mutation(partition string, seq uint64,
+	f func(Dest) error) error {
+	t.m.Lock()
+	if t.seq < seq {
+		t.seq = seq
+	}
+	t.forwardLOCKED(partition, func(target *destFanoutTarget) bool {
+		return seq > target.skipUntil
+	}, f)
+	t.m.Unlock()
+
+	return nil
+}
+
+// DataBatch forwards to each dest the batch's mutations that are
+// after the dest's skipUntil position, as a batch.
+func (t *DestFanout) DataBatch(partition string,
+	batch *DestBatchData) error {
+	n := batch.Len()
+	if n <= 0 {
+		return nil
+	}
+
+	var sub *DestBatchData // Of the target that passed the filter.
+
+	t.m.Lock()
+	if t.seq < batch.Seqs[n-1] {
+		t.seq = batch.Seqs[n-1]
+	}
+	t.forwardLOCKED(partition, func(target *destFanoutTarget) bool {
+		i := sort.Search(n, func(i int) bool {
+			return batch.Seqs[i] > target.skipUntil
+		})
+		sub = batch.from(i)
+		return i < n
+	}, func(dest Dest) error {
+		return AsDestBatch(dest).DataBatch(partition, sub)
+	})
+	t.m.Unlock()
+
+	return nil
+}
+
+func (t *DestFanout) SnapshotStart(partition string,
+	snapStart, snapEnd uint64) error {
+	t.m.Lock()
+	t.snapEnd = snapEnd
+	t.forwardLOCKED(partition, func(target *destFanoutTarget) bool {
+		return snapEnd > target.skipUntil
+	}, func(dest Dest) error {
+		return dest.SnapshotStart(partition, snapStart, snapEnd)
+	})
+	t.m.Unlock()
+
+	return nil
+}
+
+// OpaqueGet returns the opaque value and lastSeq of the laggiest
+// dest, and (re-)loads the positions of the dests.
+func (t *DestFanout) OpaqueGet(partition string) (
+	value []byte, lastSeq uint64, err error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	first := true
+
+	for pindexName, target := range t.targets {
+		v, seq, err := target.dest.OpaqueGet(partition)
+		if err != nil {
+			return nil, 0, fmt.Errorf("feed_shared: OpaqueGet,"+
+				" pindex: %s, partition: %s, err: %v",
+				pindexName, partition, err)
+		}
+
+		target.skipUntil = seq
+
+		if first || seq < lastSeq {
+			value, lastSeq, first = v, seq, false
+		}
+	}
+
+	t.seq = lastSeq
+	t.snapEnd = lastSeq
+
+	return value, lastSeq, nil
+}
+
+func (t *DestFanout) OpaqueSet(partition string, value []byte) error {
+	t.m.Lock()
+	t.forwardLOCKED(partition, func(target *destFanoutTarget) bool {
+		return t.seq >= target.skipUntil || t.snapEnd > target.skipUntil
+	}, func(dest Dest) error {
+		return dest.OpaqueSet(partition, value)
+	})
+	t.m.Unlock()
+
+	return nil
+}
+
+func (t *DestFanout) Rollback(partition string, rollbackSeq uint64) error {
+	return t.rollback(partition, func(dest Dest) error {
+		return dest.Rollback(partition, rollbackSeq)
+	})
+}
+
+func (t *DestFanout) RollbackEx(partition string, partitionUUID uint64,
+	rollbackSeq uint64) error {
+	return t.rollback(partition, func(dest Dest) error {
+		if destEx, ok := dest.(DestEx); ok {
+			return destEx.RollbackEx(partition, partitionUUID, rollbackSeq)
+		}
+		return dest.Rollback(partition, rollbackSeq)
+	})
+}
+
+// rollback rolls back every dest, as the rolled back mutations were
+// streamed to all of them, and then the feed reloads the positions
+// of the dests via OpaqueGet().
+func (t *DestFanout) rollback(partition string, f func(Dest) error) error {
+	t.m.Lock()
+	t.forwardLOCKED(partition, func(*destFanoutTarget) bool {
+		return true
+	}, f)
+	t.seq = 0
+	t.snapEnd = 0
+	t.m.Unlock()
+
+	return nil
+}
+
+func (t *DestFanout) ConsistencyWait(partition, partitionUUID string,
+	consistencyLevel string,
+	consistencySeq uint64,
+	cancelCh <-chan bool) error {
+	return fmt.Errorf("feed_shared: ConsistencyWait unsupported")
+}
+
+func (t *DestFanout) Count(pindex *PIndex, cancelCh <-chan bool) (
+	uint64, error) {
+	return 0, fmt.Errorf("feed_shared: Count unsupported")
+}
+
+func (t *DestFanout) Query(pindex *PIndex, req []byte, res io.Writer,
+	cancelCh <-chan bool) error {
+	return fmt.Errorf("feed_shared: Query unsupported")
+}
+
+func (t *DestFanout) Stats(w io.Writer) error {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `{"seq":%d,"snapEnd":%d,"pindexes":{`,
+		t.seq, t.snapEnd)
+	first := true
+	for pindexName, target := range t.targets {
+		if !first {
+			buf.Write(JsonComma)
+		}
+		first = false
+		fmt.Fprintf(&buf, `%q:{"skipUntil":%d}`, pindexName, target.skipUntil)
+	}
+	buf.Write([]byte("}}"))
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,241 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fanoutTestDest is a httpFeedTestDest with a position.
+type fanoutTestDest struct {
+	*httpFeedTestDest
+
+	lastSeq   uint64
+	rollbacks int
+}
+
+func newFanoutTestDest(lastSeq uint64) *fanoutTestDest {
+	return &fanoutTestDest{
+		httpFeedTestDest: newHTTPFeedTestDest(),
+		lastSeq:          lastSeq,
+	}
+}
+
+func (d *fanoutTestDest) OpaqueGet(partition string) (
+	[]byte, uint64, error) {
+	return []byte(fmt.Sprintf("%d", d.lastSeq)), d.lastSeq, nil
+}
+
+func (d *fanoutTestDest) Rollback(partition string, rollbackSeq uint64) error {
+	d.rollbacks++
+	return nil
+}
+
+func TestDestFanout(t *testing.T) {
+	a, b := newFanoutTestDest(10), newFanoutTestDest(20)
+
+	// Without the janitor tag, janitor kicks are only counted.
+	mgr := NewManager(VERSION, NewCfgMem(), NewUUID(), []string{"feed"},
+		"", 1, "", ":1000", "", "some-datasource", nil)
+
+	fanout := NewDestFanout()
+	fanout.mgr = mgr
+	fanout.targets["a"] = &destFanoutTarget{dest: a}
+	fanout.targets["b"] = &destFanoutTarget{dest: b}
+
+	// The feed starts from the laggiest position.
+	v, lastSeq, err := fanout.OpaqueGet("0")
+	if err != nil || string(v) != "10" || lastSeq != 10 {
+		t.Errorf("expected the laggiest opaque, v: %s, lastSeq: %d, err: %v",
+			v, lastSeq, err)
+	}
+
+	fanout.SnapshotStart("0", 11, 21)
+	fanout.OpaqueSet("0", []byte("x"))
+	for seq := uint64(11); seq <= 21; seq++ {
+		fanout.DataUpdate("0", []byte("k"), seq, []byte("{}"),
+			0, DEST_EXTRAS_TYPE_NIL, nil)
+	}
+	fanout.OpaqueSet("0", []byte("y"))
+
+	if len(a.updates) != 11 || len(b.updates) != 1 ||
+		b.updates[0] != "0/k/21" {
+		t.Errorf("expected b to skip what it has, a: %v, b: %v",
+			a.updates, b.updates)
+	}
+	if len(a.snapshots) != 1 || len(b.snapshots) != 1 {
+		t.Errorf("expected snapshots for both, a: %v, b: %v",
+			a.snapshots, b.snapshots)
+	}
+	if string(a.opaques["0"]) != "y" || string(b.opaques["0"]) != "y" {
+		t.Errorf("expected opaques, a: %v, b: %v", a.opaques, b.opaques)
+	}
+
+	// A dest that's behind can't be attached.
+	if fanout.Attach("c", newFanoutTestDest(5), 5) {
+		t.Errorf("expected attach of a lagging dest to fail")
+	}
+	c := newFanoutTestDest(21)
+	if !fanout.Attach("c", c, 21) {
+		t.Errorf("expected attach of a caught up dest to work")
+	}
+	if !reflect.DeepEqual(fanout.PIndexNames(), []string{"a", "b", "c"}) {
+		t.Errorf("unexpected pindexes: %v", fanout.PIndexNames())
+	}
+
+	// A failing dest is detached, and the janitor is kicked to
+	// re-attach it.
+	b.failKey = "bad"
+	fanout.DataUpdate("0", []byte("bad"), 22, []byte("{}"),
+		0, DEST_EXTRAS_TYPE_NIL, nil)
+	if !reflect.DeepEqual(fanout.PIndexNames(), []string{"a", "c"}) {
+		t.Errorf("expected b to be detached, pindexes: %v",
+			fanout.PIndexNames())
+	}
+	for i := 0; i < 100 && atomic.LoadUint64(&mgr.stats.TotJanitorKick) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadUint64(&mgr.stats.TotJanitorKick) == 0 {
+		t.Errorf("expected a janitor kick after a detach")
+	}
+
+	fanout.Rollback("0", 5)
+	if a.rollbacks != 1 || c.rollbacks != 1 {
+		t.Errorf("expected rollbacks to reach all dests")
+	}
+
+	fanout.Detach("c")
+	if !reflect.DeepEqual(fanout.PIndexNames(), []string{"a"}) {
+		t.Errorf("expected c to be detached, pindexes: %v",
+			fanout.PIndexNames())
+	}
+}
+
+func TestSharedFeedName(t *testing.T) {
+	p := func(sourceParams string) *PIndex {
+		return &PIndex{SourceType: "couchbase", SourceName: "b",
+			SourceUUID: "u", SourceParams: sourceParams}
+	}
+
+	n0 := FeedNameForPIndex(p(`{"x":1}`), FeedAllotmentShared)
+	n1 := FeedNameForPIndex(p(`{"pipeline":[],"x":1}`), FeedAllotmentShared)
+	n2 := FeedNameForPIndex(p(`{"x":2}`), FeedAllotmentShared)
+	n3 := FeedNameForPIndex(p(`{"x":1,"feedAllotment":"sharedFeed"}`), "")
+	n4 := FeedNameForPIndex(p(`{"x":1,"authPassword":"`+
+		SECRET_PREFIX+`keyfile:abc"}`), FeedAllotmentShared)
+
+	if !strings.HasPrefix(n0, SHARED_FEED_NAME_PREFIX) ||
+		n0 != n1 || n0 == n2 || n0 != n3 || n0 != n4 {
+		t.Errorf("unexpected shared feed names: %s, %s, %s, %s, %s",
+			n0, n1, n2, n3, n4)
+	}
+}
+
+func TestManagerSharedFeed(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	options := map[string]string{"feedAllotment": FeedAllotmentShared}
+	m := NewManagerEx(VERSION, NewCfgMem(), NewUUID(), nil, "", 1, "",
+		":1000", emptyDir, "some-datasource", nil, options)
+	if err := m.Start("wanted"); err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+
+	create := func(indexName string, maxPartitionsPerPIndex int) {
+		err := m.CreateIndex("primary", "default", "123",
+			`{"numPartitions":6}`, "blackhole", indexName, "",
+			PlanParams{MaxPartitionsPerPIndex: maxPartitionsPerPIndex}, "")
+		if err != nil {
+			t.Fatalf("expected CreateIndex() to work, err: %v", err)
+		}
+	}
+
+	// attached returns the single feed and its attached pindexes.
+	attached := func() (Feed, map[string]bool) {
+		feeds, _ := m.CurrentMaps()
+		if len(feeds) != 1 {
+			t.Fatalf("expected 1 shared feed, feeds: %+v", feeds)
+		}
+		var feed Feed
+		for _, f := range feeds {
+			feed = f
+		}
+		names := map[string]bool{}
+		for _, fanout := range destsFanouts(feed.Dests()) {
+			for _, name := range fanout.PIndexNames() {
+				names[name] = true
+			}
+		}
+		return feed, names
+	}
+
+	create("foo", 1)
+	create("bar", 3)
+
+	feed, names := attached()
+	if len(feed.Dests()) != 6 || len(names) != 8 {
+		t.Errorf("expected 6 partitions and 8 pindexes, dests: %d,"+
+			" pindexes: %v", len(feed.Dests()), names)
+	}
+
+	// Deleting an index detaches its pindexes without a restart.
+	err := m.DeleteIndex("foo")
+	if err != nil {
+		t.Fatalf("expected DeleteIndex() to work, err: %v", err)
+	}
+	feed2, names := attached()
+	if feed2 != feed || len(names) != 2 {
+		t.Errorf("expected a detach, pindexes: %v", names)
+	}
+
+	// A new index that's not behind attaches without a restart.
+	create("baz", 6)
+	feed3, names := attached()
+	if feed3 != feed || len(names) != 3 {
+		t.Errorf("expected an attach, pindexes: %v", names)
+	}
+
+	// Without attach support, CalcFeedsDelta restarts the feed.
+	for _, fanout := range destsFanouts(feed.Dests()) {
+		for name := range names {
+			if strings.HasPrefix(name, "baz_") {
+				fanout.Detach(name)
+			}
+		}
+	}
+
+	feeds, pindexes := m.CurrentMaps()
+	planPIndexes, _, _ := CfgGetPlanPIndexes(m.cfg)
+
+	addFeeds, removeFeeds, updateFeeds := CalcFeedsDeltaEx(m.uuid,
+		planPIndexes, feeds, pindexes, FeedAllotmentShared)
+	if len(addFeeds) != 0 || len(removeFeeds) != 0 ||
+		len(updateFeeds) != 1 || len(updateFeeds[0].Attach) != 1 ||
+		len(updateFeeds[0].PIndexes) != 3 {
+		t.Errorf("expected an attach, updateFeeds: %+v", updateFeeds)
+	}
+
+	addFeeds, removeFeeds = CalcFeedsDelta(m.uuid,
+		planPIndexes, feeds, pindexes, FeedAllotmentShared)
+	if len(addFeeds) != 1 || len(removeFeeds) != 1 {
+		t.Errorf("expected a restart, addFeeds: %v, removeFeeds: %v",
+			addFeeds, removeFeeds)
+	}
+}
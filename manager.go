@@ -79,6 +79,11 @@ type Manager struct {
 
 	coveringCache map[CoveringPIndexesSpec]*CoveringPIndexes
 
+	// The Cfg CAS values seen by the last successful planner and
+	// janitor runs, which allow later runs to work from deltas.
+	plannerCAS     planCAS
+	janitorPlanCAS uint64
+
 	stats  ManagerStats
 	events *list.List
 }
@@ -110,6 +115,12 @@ type ManagerStats struct {
 	TotIndexControl   uint64
 	TotIndexControlOk uint64
 
+	TotFeedPartitionControl   uint64
+	TotFeedPartitionControlOk uint64
+
+	TotDeadLetterControl   uint64
+	TotDeadLetterControlOk uint64
+
 	TotDeleteIndexBySource    uint64
 	TotDeleteIndexBySourceErr uint64
 	TotDeleteIndexBySourceOk  uint64
@@ -125,6 +136,7 @@ type ManagerStats struct {
 	TotPlannerKickChanged       uint64
 	TotPlannerKickErr           uint64
 	TotPlannerKickOk            uint64
+	TotPlannerKickDelta         uint64
 	TotPlannerUnknownErr        uint64
 	TotPlannerSubscriptionEvent uint64
 	TotPlannerStop              uint64
@@ -139,6 +151,7 @@ type ManagerStats struct {
 	TotJanitorKickStart         uint64
 	TotJanitorKickErr           uint64
 	TotJanitorKickOk            uint64
+	TotJanitorKickDelta         uint64
 	TotJanitorClosePIndex       uint64
 	TotJanitorRemovePIndex      uint64
 	TotJanitorRestartPIndex     uint64
@@ -223,6 +236,12 @@ func (mgr *Manager) Start(register string) error {
 		return err
 	}
 
+	err = mgr.initSecretKeyfile()
+	if err != nil {
+		log.Warnf("manager: could not create the default secret keyfile,"+
+			" err: %v", err)
+	}
+
 	if mgr.tagsMap == nil || mgr.tagsMap["pindex"] {
 		mldd := mgr.options["managerLoadDataDir"]
 		if mldd == "sync" || mldd == "async" || mldd == "" {
@@ -625,6 +644,15 @@ func (mgr *Manager) registerFeed(feed Feed) error {
 			feed.Name())
 	}
 
+	// A feed whose dests run a pipeline or coalesce reports those
+	// stats along with its own.
+	if pipeline := destsPipeline(feed.Dests()); pipeline != nil {
+		feed = &PipelineFeed{Feed: feed, Pipeline: pipeline}
+	}
+	if coalescer := destsCoalescer(feed.Dests()); coalescer != nil {
+		feed = &CoalesceFeed{Feed: feed, Coalescer: coalescer}
+	}
+
 	feeds := mgr.copyFeedsLOCKED()
 	feeds[feed.Name()] = feed
 	mgr.feeds = feeds
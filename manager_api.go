@@ -42,6 +42,46 @@ func (mgr *Manager) CreateIndex(sourceType,
 			" indexName is invalid, indexName: %q", indexName)
 	}
 
+	// Credentials in the sourceParams are handled in the clear until
+	// they're encrypted right before the indexDefs are saved.  A
+	// redacted credential means keep the previous one.
+	if prevIndexUUID != "" {
+		prevIndexDef, _ := mgr.CheckAndGetIndexDef(indexName, false)
+		if prevIndexDef != nil {
+			sourceParams, err = UnredactSourceParams(sourceParams,
+				prevIndexDef.SourceParams)
+			if err != nil {
+				return fmt.Errorf("manager_api: CreateIndex,"+
+					" indexName: %s, err: %v", indexName, err)
+			}
+		}
+	}
+
+	sourceParams, err = DecryptSourceParams(sourceParams, mgr.SecretOptions())
+	if err != nil {
+		return fmt.Errorf("manager_api: CreateIndex,"+
+			" could not decrypt sourceParams, indexName: %s, err: %v",
+			indexName, err)
+	}
+
+	_, err = NewFeedPipeline(sourceParams)
+	if err != nil {
+		return fmt.Errorf("manager_api: CreateIndex,"+
+			" invalid pipeline, indexName: %s, err: %v", indexName, err)
+	}
+
+	_, err = NewFeedCoalescer(sourceParams)
+	if err != nil {
+		return fmt.Errorf("manager_api: CreateIndex,"+
+			" invalid coalesce, indexName: %s, err: %v", indexName, err)
+	}
+
+	_, err = NewDestErrorPolicyParams(sourceParams)
+	if err != nil {
+		return fmt.Errorf("manager_api: CreateIndex,"+
+			" invalid errorPolicy, indexName: %s, err: %v", indexName, err)
+	}
+
 	indexDef := &IndexDef{
 		Type:         indexType,
 		Name:         indexName,
@@ -92,7 +132,14 @@ func (mgr *Manager) CreateIndex(sourceType,
 			" sourceType: %s, sourceName: %s, sourceUUID: %s, err: %v",
 			sourceType, sourceName, sourceUUID, err)
 	}
-	indexDef.SourceParams = sourceParams
+
+	indexDef.SourceParams, err = EncryptSourceParams(sourceParams,
+		mgr.SecretOptions())
+	if err != nil {
+		return fmt.Errorf("manager_api: CreateIndex,"+
+			" could not encrypt sourceParams, indexName: %s, err: %v",
+			indexName, err)
+	}
 
 	// Validate maxReplicasAllowed here.
 	maxReplicasAllowed, _ := strconv.Atoi(mgr.Options()["maxReplicasAllowed"])
@@ -101,14 +148,19 @@ func (mgr *Manager) CreateIndex(sourceType,
 			" '%v', but request for '%v'", maxReplicasAllowed, planParams.NumReplicas)
 	}
 
+	cfgTxn, cfgTxnOk := mgr.cfg.(CfgTxn)
+
 	tries := 0
-	version := CfgGetVersion(mgr.cfg)
+	version, versionCAS := CfgGetVersionCAS(mgr.cfg)
 	for {
 		tries += 1
 		if tries > 100 {
 			return fmt.Errorf("manager_api: CreateIndex,"+
 				" too many tries: %d", tries)
 		}
+		if tries > 1 {
+			version, versionCAS = CfgGetVersionCAS(mgr.cfg)
+		}
 
 		indexDefs, cas, err := CfgGetIndexDefs(mgr.cfg)
 		if err != nil {
@@ -154,9 +206,21 @@ func (mgr *Manager) CreateIndex(sourceType,
 		indexDefs.ImplVersion = version
 
 		// NOTE: If our ImplVersion is still too old due to a race, we
-		// expect a more modern planner to catch it later.
-
-		_, err = CfgSetIndexDefs(mgr.cfg, indexDefs, cas)
+		// expect a more modern planner to catch it later, unless the
+		// Cfg supports transactions, where the version is checked.
+
+		if cfgTxnOk {
+			var op CfgTxnOp
+			op, err = CfgTxnOpSetIndexDefs(indexDefs, cas)
+			if err == nil {
+				_, err = cfgTxn.Txn([]CfgTxnOp{
+					{Op: CFG_TXN_OP_CHECK, Key: VERSION_KEY, CAS: versionCAS},
+					op,
+				})
+			}
+		} else {
+			_, err = CfgSetIndexDefs(mgr.cfg, indexDefs, cas)
+		}
 		if err != nil {
 			if _, ok := err.(*CfgCASError); ok {
 				continue // Retry on CAS mismatch.
@@ -234,7 +298,12 @@ func (mgr *Manager) DeleteIndexEx(indexName, indexUUID string) error {
 	// NOTE: if our ImplVersion is still too old due to a race, we
 	// expect a more modern planner to catch it later.
 
-	_, err = CfgSetIndexDefs(mgr.cfg, indexDefs, cas)
+	plansRemoved := false
+	if cfgTxn, ok := mgr.cfg.(CfgTxn); ok {
+		plansRemoved, err = mgr.deleteIndexTxn(cfgTxn, indexDefs, cas, indexDef)
+	} else {
+		_, err = CfgSetIndexDefs(mgr.cfg, indexDefs, cas)
+	}
 	if err != nil {
 		return fmt.Errorf("manager_api: could not save indexDefs,"+
 			" err: %v", err)
@@ -246,10 +315,65 @@ func (mgr *Manager) DeleteIndexEx(indexName, indexUUID string) error {
 
 	mgr.GetIndexDefs(true)
 	mgr.PlannerKick("api/DeleteIndex, indexName: " + indexName)
+	if plansRemoved {
+		mgr.JanitorKick("api/DeleteIndex, plans removed, indexName: " +
+			indexName)
+	}
 	atomic.AddUint64(&mgr.stats.TotDeleteIndexOk, 1)
 	return nil
 }
 
+// deleteIndexTxn saves the indexDefs, which no longer have the
+// deleted indexDef, and removes the deleted index's planPIndexes in
+// the same transaction, so that the plan never refers to a deleted
+// index.  The returned bool is true when planPIndexes were removed.
+func (mgr *Manager) deleteIndexTxn(cfgTxn CfgTxn, indexDefs *IndexDefs,
+	cas uint64, indexDef *IndexDef) (bool, error) {
+	opIndexDefs, err := CfgTxnOpSetIndexDefs(indexDefs, cas)
+	if err != nil {
+		return false, err
+	}
+
+	for tries := 1; ; tries++ {
+		ops := []CfgTxnOp{opIndexDefs}
+
+		removed := false
+
+		planPIndexes, planPIndexesCAS, err := CfgGetPlanPIndexes(mgr.cfg)
+		if err != nil {
+			return false, err
+		}
+		if planPIndexes != nil {
+			for name, planPIndex := range planPIndexes.PlanPIndexes {
+				if planPIndex.IndexName == indexDef.Name &&
+					planPIndex.IndexUUID == indexDef.UUID {
+					delete(planPIndexes.PlanPIndexes, name)
+					removed = true
+				}
+			}
+			if removed {
+				planPIndexes.UUID = NewUUID()
+
+				op, err := CfgTxnOpSetPlanPIndexes(planPIndexes,
+					planPIndexesCAS)
+				if err != nil {
+					return false, err
+				}
+				ops = append(ops, op)
+			}
+		}
+
+		_, err = cfgTxn.Txn(ops)
+		if _, ok := err.(*CfgCASError); ok && tries < 10 {
+			continue // Perhaps the planner raced us, so retry.
+		}
+		if err != nil {
+			return false, err
+		}
+		return removed, nil
+	}
+}
+
 // IndexControl is used to change runtime properties of an index
 // definition.
 func (mgr *Manager) IndexControl(indexName, indexUUID, readOp, writeOp,
@@ -17,6 +17,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -33,6 +34,11 @@ const FeedAllotmentOption = "feedAllotment"
 // single feed per pindex.
 const FeedAllotmentOnePerPIndex = "oneFeedPerPIndex"
 
+// FeedAllotmentShared specifies that the pindexes of all the indexes
+// on a node with the same source should share a single feed, which
+// fans out to the pindexes.
+const FeedAllotmentShared = "sharedFeed"
+
 const JANITOR_CLOSE_PINDEX = "janitor_close_pindex"
 const JANITOR_REMOVE_PINDEX = "janitor_remove_pindex"
 const JANITOR_LOAD_DATA_DIR = "janitor_load_data_dir"
@@ -55,14 +61,31 @@ func (mgr *Manager) JanitorKick(msg string) {
 	}
 }
 
+// janitorKickDelta synchronously kicks the manager's janitor, if any,
+// with a delta of the planPIndexes.
+func (mgr *Manager) janitorKickDelta(msg string, ev *CfgDeltaEvent) {
+	atomic.AddUint64(&mgr.stats.TotJanitorKick, 1)
+
+	if mgr.tagsMap == nil || (mgr.tagsMap["pindex"] && mgr.tagsMap["janitor"]) {
+		syncWorkReq(mgr.janitorCh, WORK_KICK, msg, ev)
+	}
+}
+
 // JanitorLoop is the main loop for the janitor.
 func (mgr *Manager) JanitorLoop() {
 	if mgr.cfg != nil { // Might be nil for testing.
 		go func() {
 			ec := make(chan CfgEvent)
-			mgr.cfg.Subscribe(PLAN_PINDEXES_KEY, ec)
-			mgr.cfg.Subscribe(PLAN_PINDEXES_DIRECTORY_STAMP, ec)
 			mgr.cfg.Subscribe(CfgNodeDefsKey(NODE_DEFS_WANTED), ec)
+
+			// The planPIndexes changes are followed as deltas, so
+			// that the janitor can work on just what changed.
+			dc := make(chan *CfgDeltaEvent)
+			err := CfgSubscribeDeltas(mgr.cfg, PLAN_PINDEXES_KEY, dc, mgr.stopCh)
+			if err != nil {
+				log.Warnf("janitor: CfgSubscribeDeltas, err: %v", err)
+			}
+
 			for {
 				select {
 				case <-mgr.stopCh:
@@ -70,6 +93,9 @@ func (mgr *Manager) JanitorLoop() {
 				case e := <-ec:
 					atomic.AddUint64(&mgr.stats.TotJanitorSubscriptionEvent, 1)
 					mgr.JanitorKick("cfg changed, key: " + e.Key)
+				case ev := <-dc:
+					atomic.AddUint64(&mgr.stats.TotJanitorSubscriptionEvent, 1)
+					mgr.janitorKickDelta("cfg changed, key: "+ev.Key, ev)
 				}
 			}
 		}()
@@ -90,7 +116,11 @@ func (mgr *Manager) JanitorLoop() {
 
 			if m.op == WORK_KICK {
 				atomic.AddUint64(&mgr.stats.TotJanitorKickStart, 1)
-				err = mgr.JanitorOnce(m.msg)
+				if ev, ok := m.obj.(*CfgDeltaEvent); ok {
+					err = mgr.JanitorOnceDelta(m.msg, ev)
+				} else {
+					err = mgr.JanitorOnce(m.msg)
+				}
 				if err != nil {
 					// Keep looping as perhaps it's a transient issue.
 					// TODO: Perhaps need a rescheduled janitor kick.
@@ -103,12 +133,15 @@ func (mgr *Manager) JanitorLoop() {
 				atomic.AddUint64(&mgr.stats.TotJanitorNOOPOk, 1)
 			} else if m.op == JANITOR_CLOSE_PINDEX {
 				mgr.stopPIndex(m.obj.(*PIndex), false)
+				mgr.setJanitorPlanCAS(0)
 				atomic.AddUint64(&mgr.stats.TotJanitorClosePIndex, 1)
 			} else if m.op == JANITOR_REMOVE_PINDEX {
 				mgr.stopPIndex(m.obj.(*PIndex), true)
+				mgr.setJanitorPlanCAS(0)
 				atomic.AddUint64(&mgr.stats.TotJanitorRemovePIndex, 1)
 			} else if m.op == JANITOR_LOAD_DATA_DIR {
 				mgr.LoadDataDir()
+				mgr.setJanitorPlanCAS(0)
 				atomic.AddUint64(&mgr.stats.TotJanitorLoadDataDir, 1)
 			} else {
 				err = fmt.Errorf("janitor: unknown op: %s, m: %#v", m.op, m)
@@ -338,13 +371,11 @@ func (mgr *Manager) JanitorOnce(reason string) error {
 		return fmt.Errorf("janitor: skipped due to nil cfg")
 	}
 
-	feedAllotment := mgr.GetOptions()[FeedAllotmentOption]
-
 	// NOTE: The janitor doesn't reconfirm that we're a wanted node
 	// because instead some planner will see that & update the plan;
 	// then relevant janitors will react by closing pindexes & feeds.
 
-	planPIndexes, _, err := CfgGetPlanPIndexes(mgr.cfg)
+	planPIndexes, cas, err := CfgGetPlanPIndexes(mgr.cfg)
 	if err != nil {
 		return fmt.Errorf("janitor: skipped on CfgGetPlanPIndexes err: %v", err)
 	}
@@ -353,7 +384,76 @@ func (mgr *Manager) JanitorOnce(reason string) error {
 		return fmt.Errorf("janitor: skipped on nil planPIndexes")
 	}
 
+	return mgr.janitorOnce(planPIndexes, cas, nil)
+}
+
+// JanitorOnceDelta is like JanitorOnce, but only works on the
+// pindexes and feeds of the indexes that are in the planPIndexes
+// delta.  It falls back to a full JanitorOnce when the delta does not
+// follow from the plan of the last successful janitor run.
+func (mgr *Manager) JanitorOnceDelta(reason string, ev *CfgDeltaEvent) error {
+	if mgr.cfg == nil { // Can occur during testing.
+		return fmt.Errorf("janitor: skipped due to nil cfg")
+	}
+
+	if ev == nil || ev.Error != nil || ev.Key != PLAN_PINDEXES_KEY ||
+		ev.PlanPIndexes == nil || ev.PlanPIndexesDelta == nil {
+		return mgr.JanitorOnce(reason)
+	}
+
+	mgr.m.Lock()
+	janitorPlanCAS := mgr.janitorPlanCAS
+	mgr.m.Unlock()
+
+	if janitorPlanCAS != 0 && janitorPlanCAS == ev.CAS {
+		return nil // An earlier run already handled this plan.
+	}
+	if janitorPlanCAS == 0 || janitorPlanCAS != ev.PrevCAS {
+		return mgr.JanitorOnce(reason)
+	}
+
+	atomic.AddUint64(&mgr.stats.TotJanitorKickDelta, 1)
+
+	return mgr.janitorOnce(ev.PlanPIndexes, ev.CAS, ev.PlanPIndexesDelta)
+}
+
+func (mgr *Manager) setJanitorPlanCAS(cas uint64) {
+	mgr.m.Lock()
+	mgr.janitorPlanCAS = cas
+	mgr.m.Unlock()
+}
+
+// janitorOnce brings the pindexes and feeds in line with the
+// planPIndexes, where a non-nil delta limits the work to the indexes
+// of the delta.
+func (mgr *Manager) janitorOnce(planPIndexes *PlanPIndexes,
+	planPIndexesCAS uint64, delta *PlanPIndexesDelta) error {
+	feedAllotment := mgr.GetOptions()[FeedAllotmentOption]
+
+	// Invalidated until this run succeeds.
+	mgr.setJanitorPlanCAS(0)
+
+	// The pindexes of other indexes that share a feed aren't covered
+	// by a delta, so shared feeds need a full run.
+	if delta != nil &&
+		janitorSharedFeeds(planPIndexes, feedAllotment) {
+		log.Printf("janitor: delta, full run for shared feeds")
+		delta = nil
+	}
+
+	var indexNames map[string]bool
+	if delta != nil {
+		indexNames = delta.IndexNames()
+
+		log.Printf("janitor: delta, indexes: %d", len(indexNames))
+
+		planPIndexes = janitorFilterPlanPIndexes(planPIndexes, indexNames)
+	}
+
+	var err error
+
 	_, currPIndexes := mgr.CurrentMaps()
+	currPIndexes = janitorFilterPIndexes(currPIndexes, indexNames)
 
 	addPlanPIndexes, removePIndexes :=
 		CalcPIndexesDelta(mgr.uuid, currPIndexes, planPIndexes)
@@ -394,9 +494,11 @@ func (mgr *Manager) JanitorOnce(reason string) error {
 
 	var currFeeds map[string]Feed
 	currFeeds, currPIndexes = mgr.CurrentMaps()
+	currFeeds = janitorFilterFeeds(currFeeds, indexNames)
+	currPIndexes = janitorFilterPIndexes(currPIndexes, indexNames)
 
-	addFeeds, removeFeeds :=
-		CalcFeedsDelta(mgr.uuid, planPIndexes, currFeeds, currPIndexes,
+	addFeeds, removeFeeds, updateFeeds :=
+		CalcFeedsDeltaEx(mgr.uuid, planPIndexes, currFeeds, currPIndexes,
 			feedAllotment)
 
 	log.Printf("janitor: feeds to remove: %d", len(removeFeeds))
@@ -410,6 +512,12 @@ func (mgr *Manager) JanitorOnce(reason string) error {
 		}
 	}
 
+	log.Printf("janitor: feeds to update: %d", len(updateFeeds))
+	for _, u := range updateFeeds {
+		log.Printf("  %s, attach: %d, detach: %d",
+			u.Feed.Name(), len(u.Attach), len(u.Detach))
+	}
+
 	// First, teardown feeds that need to be removed.
 	for _, removeFeed := range removeFeeds {
 		err = mgr.stopFeed(removeFeed)
@@ -427,6 +535,15 @@ func (mgr *Manager) JanitorOnce(reason string) error {
 				fmt.Errorf("janitor: adding feed, err: %v", err))
 		}
 	}
+	// Then, attach and detach the pindexes of shared feeds.
+	for _, u := range updateFeeds {
+		err = mgr.updateSharedFeed(u)
+		if err != nil {
+			errs = append(errs,
+				fmt.Errorf("janitor: updating feed, name: %s, err: %v",
+					u.Feed.Name(), err))
+		}
+	}
 
 	if len(errs) > 0 {
 		var s []string
@@ -437,9 +554,73 @@ func (mgr *Manager) JanitorOnce(reason string) error {
 			len(errs), s)
 	}
 
+	mgr.setJanitorPlanCAS(planPIndexesCAS)
+
 	return nil
 }
 
+// janitorSharedFeeds returns true when any plan pindex might use a
+// shared feed.
+func janitorSharedFeeds(planPIndexes *PlanPIndexes,
+	feedAllotment string) bool {
+	if feedAllotment == FeedAllotmentShared {
+		return true
+	}
+	for _, planPIndex := range planPIndexes.PlanPIndexes {
+		if strings.Contains(planPIndex.SourceParams, FeedAllotmentShared) &&
+			feedAllotmentOption(planPIndex.SourceParams) == FeedAllotmentShared {
+			return true
+		}
+	}
+	return false
+}
+
+// janitorFilterPlanPIndexes returns a copy of the planPIndexes with
+// only the plan pindexes of the given indexes.
+func janitorFilterPlanPIndexes(planPIndexes *PlanPIndexes,
+	indexNames map[string]bool) *PlanPIndexes {
+	rv := *planPIndexes
+	rv.PlanPIndexes = map[string]*PlanPIndex{}
+	for name, planPIndex := range planPIndexes.PlanPIndexes {
+		if indexNames[planPIndex.IndexName] {
+			rv.PlanPIndexes[name] = planPIndex
+		}
+	}
+	return &rv
+}
+
+// janitorFilterPIndexes returns the pindexes of the given indexes,
+// or all the pindexes when indexNames is nil.
+func janitorFilterPIndexes(pindexes map[string]*PIndex,
+	indexNames map[string]bool) map[string]*PIndex {
+	if indexNames == nil {
+		return pindexes
+	}
+	rv := map[string]*PIndex{}
+	for name, pindex := range pindexes {
+		if indexNames[pindex.IndexName] {
+			rv[name] = pindex
+		}
+	}
+	return rv
+}
+
+// janitorFilterFeeds returns the feeds of the given indexes, or all
+// the feeds when indexNames is nil.
+func janitorFilterFeeds(feeds map[string]Feed,
+	indexNames map[string]bool) map[string]Feed {
+	if indexNames == nil {
+		return feeds
+	}
+	rv := map[string]Feed{}
+	for name, feed := range feeds {
+		if indexNames[feed.IndexName()] {
+			rv[name] = feed
+		}
+	}
+	return rv
+}
+
 func classifyAddRemoveRestartPIndexes(addPlanPIndexes []*PlanPIndex,
 	removePIndexes []*PIndex) (planPIndexesToAdd []*PlanPIndex,
 	pindexesToRemove []*PIndex, pindexesToRestart []*pindexRestartReq) {
@@ -653,6 +834,36 @@ func CalcPIndexesDelta(mgrUUID string,
 func CalcFeedsDelta(nodeUUID string, planPIndexes *PlanPIndexes,
 	currFeeds map[string]Feed, pindexes map[string]*PIndex,
 	feedAllotment string) (addFeeds [][]*PIndex, removeFeeds []Feed) {
+	addFeeds, removeFeeds, updateFeeds := CalcFeedsDeltaEx(nodeUUID,
+		planPIndexes, currFeeds, pindexes, feedAllotment)
+
+	// Without support for attach and detach, shared feeds that need
+	// updates are restarted.
+	for _, u := range updateFeeds {
+		addFeeds = append(addFeeds, u.PIndexes)
+		removeFeeds = append(removeFeeds, u.Feed)
+	}
+
+	return addFeeds, removeFeeds
+}
+
+// A FeedUpdate represents the pindexes to attach to and detach from
+// a running shared feed (see FeedAllotmentShared).
+type FeedUpdate struct {
+	Feed     Feed
+	PIndexes []*PIndex // All the pindexes of the feed, once updated.
+	Attach   []*PIndex
+	Detach   []string // Names of pindexes.
+}
+
+// CalcFeedsDeltaEx is like CalcFeedsDelta, but running shared feeds
+// whose pindexes changed appear on the updateFeeds output instead of
+// being removed and added, as long as their source partitions are
+// covered.
+func CalcFeedsDeltaEx(nodeUUID string, planPIndexes *PlanPIndexes,
+	currFeeds map[string]Feed, pindexes map[string]*PIndex,
+	feedAllotment string) (addFeeds [][]*PIndex, removeFeeds []Feed,
+	updateFeeds []*FeedUpdate) {
 	// Group the writable pindexes by their feed names.  Non-writable
 	// pindexes (perhaps index ingest is paused) will have their feeds
 	// removed.  Of note, currently, a pindex is never fed by >1 feed,
@@ -690,7 +901,15 @@ func CalcFeedsDelta(nodeUUID string, planPIndexes *PlanPIndexes,
 				}
 			}
 
-			if changed {
+			if !changed {
+				// A shared feed attaches and detaches pindexes.
+				if fanouts := destsFanouts(currDests); len(fanouts) > 0 {
+					u := calcFeedUpdate(currFeed, fanouts, feedPIndexes)
+					if u != nil {
+						updateFeeds = append(updateFeeds, u)
+					}
+				}
+			} else {
 				addFeeds = append(addFeeds, feedPIndexes)
 
 				if currFeeds[feedName] != nil {
@@ -712,7 +931,51 @@ func CalcFeedsDelta(nodeUUID string, planPIndexes *PlanPIndexes,
 		}
 	}
 
-	return addFeeds, removeFeeds
+	return addFeeds, removeFeeds, updateFeeds
+}
+
+// calcFeedUpdate returns the FeedUpdate of a shared feed, or nil when
+// its attached pindexes already match the feedPIndexes.
+func calcFeedUpdate(feed Feed, fanouts map[string]*DestFanout,
+	feedPIndexes []*PIndex) *FeedUpdate {
+	attached := map[string]bool{}           // Keyed by pindex name.
+	attachedPartitions := map[string]bool{} // Keyed by "partition/name".
+	for partition, fanout := range fanouts {
+		for _, pindexName := range fanout.PIndexNames() {
+			attached[pindexName] = true
+			attachedPartitions[partition+"/"+pindexName] = true
+		}
+	}
+
+	u := &FeedUpdate{Feed: feed, PIndexes: feedPIndexes}
+
+	wanted := map[string]bool{}
+	for _, pindex := range feedPIndexes {
+		wanted[pindex.Name] = true
+
+		// A pindex that was detached from some partitions, such as
+		// after a failure, is attached again.
+		for _, partition := range pindexSourcePartitions(pindex) {
+			if !attachedPartitions[partition+"/"+pindex.Name] {
+				u.Attach = append(u.Attach, pindex)
+				break
+			}
+		}
+	}
+
+	for pindexName := range attached {
+		if !wanted[pindexName] {
+			u.Detach = append(u.Detach, pindexName)
+		}
+	}
+
+	if len(u.Attach) <= 0 && len(u.Detach) <= 0 {
+		return nil
+	}
+
+	sort.Strings(u.Detach)
+
+	return u
 }
 
 func ParseFeedAllotmentOption(sourceParams string) (string, error) {
@@ -747,12 +1010,25 @@ func feedAllotmentOption(sourceParams string) string {
 	return ""
 }
 
-// FeedNameForPIndex functionally computes the name of a feed given a pindex.
-func FeedNameForPIndex(pindex *PIndex, defaultFeedAllotment string) string {
+// pindexFeedAllotment returns the feed allotment of a pindex, which
+// may be overridden by its sourceParams.
+func pindexFeedAllotment(pindex *PIndex, defaultFeedAllotment string) string {
 	feedAllotment := feedAllotmentOption(pindex.SourceParams)
 	if feedAllotment == "" {
 		feedAllotment = defaultFeedAllotment
 	}
+	return feedAllotment
+}
+
+// FeedNameForPIndex functionally computes the name of a feed given a pindex.
+func FeedNameForPIndex(pindex *PIndex, defaultFeedAllotment string) string {
+	feedAllotment := pindexFeedAllotment(pindex, defaultFeedAllotment)
+
+	if feedAllotment == FeedAllotmentShared {
+		// The pindexes of all the indexes with the same source will
+		// share a feed.
+		return sharedFeedName(pindex)
+	}
 
 	if feedAllotment == FeedAllotmentOnePerPIndex {
 		// Using the pindex.Name for the feed name means each pindex
@@ -832,7 +1108,7 @@ func (mgr *Manager) stopPIndex(pindex *PIndex, remove bool) error {
 	feeds, _ := mgr.CurrentMaps()
 	for _, feed := range feeds {
 		for _, dest := range feed.Dests() {
-			if dest == pindex.Dest {
+			if unwrapDest(dest) == pindex.Dest {
 				err := mgr.stopFeed(feed)
 				if err != nil {
 					return err
@@ -865,6 +1141,26 @@ func (mgr *Manager) stopPIndex(pindex *PIndex, remove bool) error {
 	return pindex.Close(remove)
 }
 
+// unwrapDest returns the Dest that's wrapped by the DestCoalesce,
+// DestPipeline, DestRecorder and DestErrorPolicy wrappers of a feed's
+// dest, which is a pindex's Dest for a feed that isn't shared.
+func unwrapDest(dest Dest) Dest {
+	for {
+		switch d := dest.(type) {
+		case *DestCoalesce:
+			dest = d.Dest
+		case *DestPipeline:
+			dest = d.Dest
+		case *DestRecorder:
+			dest = d.Dest
+		case *DestErrorPolicy:
+			dest = d.Dest
+		default:
+			return dest
+		}
+	}
+}
+
 // --------------------------------------------------------
 
 func (mgr *Manager) startFeed(pindexes []*PIndex) error {
@@ -877,12 +1173,67 @@ func (mgr *Manager) startFeed(pindexes []*PIndex) error {
 	pindexFirst := pindexes[0]
 	feedName := FeedNameForPIndex(pindexFirst, feedAllotment)
 
-	dests := make(map[string]Dest)
 	for _, pindex := range pindexes {
 		if f := FeedNameForPIndex(pindex, feedAllotment); f != feedName {
 			return fmt.Errorf("janitor: unexpected feedName: %s != %s,"+
 				" pindex: %#v", f, feedName, pindex)
 		}
+	}
+
+	indexName, indexUUID := pindexFirst.IndexName, pindexFirst.IndexUUID
+	sourceParams := pindexFirst.SourceParams
+
+	var dests map[string]Dest
+	var err error
+
+	if pindexFeedAllotment(pindexFirst, feedAllotment) == FeedAllotmentShared {
+		// A shared feed isn't owned by any single index.
+		indexName, indexUUID = "", ""
+		sourceParams = sharedFeedSourceParams(sourceParams)
+
+		dests, err = sharedFeedDests(mgr, pindexes)
+		if err != nil {
+			return err
+		}
+	} else {
+		dests, err = feedDests(feedName, pindexes)
+		if err != nil {
+			return err
+		}
+	}
+
+	recordDir := mgr.GetOptions()[FeedRecordDirOption]
+	if recordDir != "" {
+		dests, err = recordDests(recordDir, feedName, dests)
+		if err != nil {
+			return fmt.Errorf("janitor: could not record feed,"+
+				" feedName: %s, err: %v", feedName, err)
+		}
+	}
+
+	err = mgr.startFeedByType(feedName, indexName, indexUUID,
+		pindexFirst.SourceType, pindexFirst.SourceName,
+		pindexFirst.SourceUUID, sourceParams,
+		dests)
+	if err != nil && recordDir != "" {
+		closeDestRecordings(dests)
+	}
+
+	return err
+}
+
+// feedDests returns the dests of the pindexes of a feed, keyed by
+// source partition.
+func feedDests(feedName string, pindexes []*PIndex) (
+	map[string]Dest, error) {
+	dests := make(map[string]Dest)
+	for _, pindex := range pindexes {
+		dest, err := pindexFeedDest(pindex)
+		if err != nil {
+			return nil, fmt.Errorf("janitor: invalid errorPolicy,"+
+				" feedName: %s, pindex: %s, err: %v",
+				feedName, pindex.Name, err)
+		}
 
 		addSourcePartition := func(sourcePartition string) error {
 			if _, exists := dests[sourcePartition]; exists {
@@ -890,31 +1241,27 @@ func (mgr *Manager) startFeed(pindexes []*PIndex) error {
 					" sourcePartition: %s, feedName: %s, pindex: %#v",
 					sourcePartition, feedName, pindex)
 			}
-			dests[sourcePartition] = pindex.Dest
+			dests[sourcePartition] = dest
 			return nil
 		}
 
 		if pindex.SourcePartitions == "" {
 			err := addSourcePartition("")
 			if err != nil {
-				return err
+				return nil, err
 			}
 		} else {
 			sourcePartitionsArr := strings.Split(pindex.SourcePartitions, ",")
 			for _, sourcePartition := range sourcePartitionsArr {
 				err := addSourcePartition(sourcePartition)
 				if err != nil {
-					return err
+					return nil, err
 				}
 			}
 		}
 	}
 
-	return mgr.startFeedByType(feedName,
-		pindexFirst.IndexName, pindexFirst.IndexUUID,
-		pindexFirst.SourceType, pindexFirst.SourceName,
-		pindexFirst.SourceUUID, pindexFirst.SourceParams,
-		dests)
+	return dests, nil
 }
 
 // TODO: Need way to track dead cows (non-beef)
@@ -932,6 +1279,30 @@ func (mgr *Manager) startFeedByType(feedName, indexName, indexUUID,
 		return fmt.Errorf("janitor: unknown sourceType: %s", sourceType)
 	}
 
+	sourceParams, err := DecryptSourceParams(sourceParams, mgr.SecretOptions())
+	if err != nil {
+		return fmt.Errorf("janitor: could not decrypt sourceParams,"+
+			" feedName: %s, err: %v", feedName, err)
+	}
+
+	pipeline, err := NewFeedPipeline(sourceParams)
+	if err != nil {
+		return fmt.Errorf("janitor: invalid pipeline,"+
+			" feedName: %s, err: %v", feedName, err)
+	}
+	if pipeline != nil {
+		dests = pipelineDests(pipeline, dests)
+	}
+
+	coalescer, err := NewFeedCoalescer(sourceParams)
+	if err != nil {
+		return fmt.Errorf("janitor: invalid coalesce,"+
+			" feedName: %s, err: %v", feedName, err)
+	}
+	if coalescer != nil {
+		dests = coalesceDests(coalescer, dests)
+	}
+
 	return feedType.Start(mgr, feedName, indexName, indexUUID,
 		sourceType, sourceName, sourceUUID, sourceParams, dests)
 }
@@ -955,5 +1326,9 @@ func (mgr *Manager) stopFeed(feed Feed) error {
 
 	// NOTE: We're depending on feed to synchronously close, so we
 	// know it'll no longer be sending to any of its dests anymore.
-	return feed.Close()
+	err = feed.Close()
+
+	closeDestRecordings(feed.Dests())
+
+	return err
 }
@@ -12,6 +12,7 @@
 package cbgt
 
 import (
+	"encoding/json"
 	"fmt"
 	"hash/crc32"
 	"io"
@@ -95,13 +96,31 @@ func (mgr *Manager) PlannerKick(msg string) {
 	}
 }
 
+// plannerKickDelta synchronously kicks the manager's planner, if any,
+// with a delta of the indexDefs.
+func (mgr *Manager) plannerKickDelta(msg string, ev *CfgDeltaEvent) {
+	atomic.AddUint64(&mgr.stats.TotPlannerKick, 1)
+
+	if mgr.tagsMap == nil || mgr.tagsMap["planner"] {
+		syncWorkReq(mgr.plannerCh, WORK_KICK, msg, ev)
+	}
+}
+
 // PlannerLoop is the main loop for the planner.
 func (mgr *Manager) PlannerLoop() {
 	if mgr.cfg != nil { // Might be nil for testing.
 		go func() {
 			ec := make(chan CfgEvent)
-			mgr.cfg.Subscribe(INDEX_DEFS_KEY, ec)
 			mgr.cfg.Subscribe(CfgNodeDefsKey(NODE_DEFS_WANTED), ec)
+
+			// The indexDefs changes are followed as deltas, so that
+			// the planner can replan just the changed indexes.
+			dc := make(chan *CfgDeltaEvent)
+			err := CfgSubscribeDeltas(mgr.cfg, INDEX_DEFS_KEY, dc, mgr.stopCh)
+			if err != nil {
+				log.Warnf("planner: CfgSubscribeDeltas, err: %v", err)
+			}
+
 			for {
 				select {
 				case <-mgr.stopCh:
@@ -109,6 +128,9 @@ func (mgr *Manager) PlannerLoop() {
 				case e := <-ec:
 					atomic.AddUint64(&mgr.stats.TotPlannerSubscriptionEvent, 1)
 					mgr.PlannerKick("cfg changed, key: " + e.Key)
+				case ev := <-dc:
+					atomic.AddUint64(&mgr.stats.TotPlannerSubscriptionEvent, 1)
+					mgr.plannerKickDelta("cfg changed, key: "+ev.Key, ev)
 				}
 			}
 		}()
@@ -129,7 +151,8 @@ func (mgr *Manager) PlannerLoop() {
 
 			if m.op == WORK_KICK {
 				atomic.AddUint64(&mgr.stats.TotPlannerKickStart, 1)
-				changed, err2 := mgr.PlannerOnce(m.msg)
+				ev, _ := m.obj.(*CfgDeltaEvent)
+				changed, res, err2 := mgr.plannerOnce(m.msg, ev)
 				if err2 != nil {
 					log.Warnf("planner: PlannerOnce, err: %v", err2)
 					atomic.AddUint64(&mgr.stats.TotPlannerKickErr, 1)
@@ -137,7 +160,15 @@ func (mgr *Manager) PlannerLoop() {
 				} else {
 					if changed {
 						atomic.AddUint64(&mgr.stats.TotPlannerKickChanged, 1)
-						mgr.JanitorKick("the plans have changed")
+						mgr.janitorKickDelta("the plans have changed",
+							&CfgDeltaEvent{
+								Key:          PLAN_PINDEXES_KEY,
+								CAS:          res.cas.planPIndexes,
+								PrevCAS:      res.planPIndexesPrevCAS,
+								PlanPIndexes: res.planPIndexes,
+								PlanPIndexesDelta: CalcPlanPIndexesDelta(
+									res.planPIndexesPrev, res.planPIndexes),
+							})
 					}
 					atomic.AddUint64(&mgr.stats.TotPlannerKickOk, 1)
 				}
@@ -165,14 +196,105 @@ func (mgr *Manager) PlannerLoop() {
 
 // PlannerOnce is the main body of a PlannerLoop.
 func (mgr *Manager) PlannerOnce(reason string) (bool, error) {
+	changed, _, err := mgr.plannerOnce(reason, nil)
+	return changed, err
+}
+
+// PlannerOnceDelta is like PlannerOnce, but only replans the indexes
+// that were added or changed in the indexDefs delta, while the plans
+// of the other indexes are kept.  It falls back to a full replan
+// when the delta does not follow from the Cfg entries that were used
+// by the last successful planner run.
+func (mgr *Manager) PlannerOnceDelta(reason string, ev *CfgDeltaEvent) (
+	bool, error) {
+	changed, _, err := mgr.plannerOnce(reason, ev)
+	return changed, err
+}
+
+func (mgr *Manager) plannerOnce(reason string, ev *CfgDeltaEvent) (
+	bool, *planResult, error) {
 	log.Printf("planner: once, reason: %s", reason)
 
 	if mgr.cfg == nil { // Can occur during testing.
-		return false, fmt.Errorf("planner: skipped due to nil cfg")
+		return false, nil, fmt.Errorf("planner: skipped due to nil cfg")
 	}
 
-	return Plan(mgr.cfg, mgr.version, mgr.uuid, mgr.server,
-		mgr.Options(), nil)
+	mgr.m.Lock()
+	plannerCAS := mgr.plannerCAS
+	mgr.m.Unlock()
+
+	var plannerFilterFn func(planCAS) PlannerFilter
+
+	if ev != nil && ev.Error == nil && ev.Key == INDEX_DEFS_KEY &&
+		ev.IndexDefsDelta != nil && plannerCAS.indexDefs != 0 {
+		if plannerCAS.indexDefs == ev.CAS {
+			return false, nil, nil // An earlier run already planned this.
+		}
+
+		plannerFilterFn = func(cas planCAS) PlannerFilter {
+			if cas.indexDefs != ev.CAS ||
+				plannerCAS.indexDefs != ev.PrevCAS ||
+				plannerCAS.nodeDefs != cas.nodeDefs ||
+				plannerCAS.planPIndexes != cas.planPIndexes {
+				return nil
+			}
+
+			atomic.AddUint64(&mgr.stats.TotPlannerKickDelta, 1)
+
+			return plannerFilterDelta(ev.IndexDefsDelta)
+		}
+	}
+
+	mgr.m.Lock()
+	mgr.plannerCAS = planCAS{} // Invalidated until this run succeeds.
+	mgr.m.Unlock()
+
+	changed, res, err := plan(mgr.cfg, mgr.version, mgr.uuid, mgr.server,
+		mgr.SecretOptions(), plannerFilterFn)
+	if err != nil {
+		return false, nil, err
+	}
+
+	mgr.m.Lock()
+	mgr.plannerCAS = res.cas
+	mgr.m.Unlock()
+
+	return changed, res, nil
+}
+
+// plannerFilterDelta returns a PlannerFilter that allows only the
+// added or changed indexes of an indexDefs delta to be replanned,
+// and that keeps the previous plans of the other indexes.
+func plannerFilterDelta(delta *IndexDefsDelta) PlannerFilter {
+	return func(indexDef *IndexDef,
+		planPIndexesPrev, planPIndexes *PlanPIndexes) bool {
+		if delta.Added[indexDef.Name] != nil ||
+			delta.Changed[indexDef.Name] != nil {
+			return true
+		}
+
+		// Copy over the previous plan and warnings, if any, for the index.
+		if planPIndexesPrev != nil && planPIndexes != nil {
+			for n, p := range planPIndexesPrev.PlanPIndexes {
+				if p.IndexName == indexDef.Name &&
+					p.IndexUUID == indexDef.UUID {
+					planPIndexes.PlanPIndexes[n] = p
+				}
+			}
+
+			if planPIndexesPrev.Warnings != nil {
+				warnings, exists := planPIndexesPrev.Warnings[indexDef.Name]
+				if exists {
+					if planPIndexes.Warnings == nil {
+						planPIndexes.Warnings = map[string][]string{}
+					}
+					planPIndexes.Warnings[indexDef.Name] = warnings
+				}
+			}
+		}
+
+		return false
+	}
 }
 
 // A PlannerFilter callback func should return true if the plans for
@@ -184,10 +306,52 @@ type PlannerFilter func(indexDef *IndexDef,
 // Plan runs the planner once.
 func Plan(cfg Cfg, version, uuid, server string, options map[string]string,
 	plannerFilter PlannerFilter) (bool, error) {
-	indexDefs, nodeDefs, planPIndexesPrev, cas, err :=
-		PlannerGetPlan(cfg, version, uuid)
+	changed, _, err := plan(cfg, version, uuid, server, options,
+		func(planCAS) PlannerFilter { return plannerFilter })
+	return changed, err
+}
+
+// planCAS holds the CAS values of the Cfg entries used by a planner.
+type planCAS struct {
+	indexDefs    uint64
+	nodeDefs     uint64
+	planPIndexes uint64
+}
+
+// planResult is the outcome of a successful plan().
+type planResult struct {
+	cas planCAS // The planPIndexes CAS is for the saved plan, if any.
+
+	planPIndexesPrev    *PlanPIndexes
+	planPIndexesPrevCAS uint64
+	planPIndexes        *PlanPIndexes
+}
+
+// plan runs the planner once, where the plannerFilterFn chooses a
+// PlannerFilter based on the CAS values of the retrieved Cfg entries.
+func plan(cfg Cfg, version, uuid, server string, options map[string]string,
+	plannerFilterFn func(planCAS) PlannerFilter) (
+	bool, *planResult, error) {
+	indexDefs, indexDefsCAS, nodeDefs, nodeDefsCAS,
+		planPIndexesPrev, cas, err := plannerGetPlan(cfg, version, uuid)
 	if err != nil {
-		return false, err
+		return false, nil, err
+	}
+
+	res := &planResult{
+		cas: planCAS{
+			indexDefs:    indexDefsCAS,
+			nodeDefs:     nodeDefsCAS,
+			planPIndexes: cas,
+		},
+		planPIndexesPrev:    planPIndexesPrev,
+		planPIndexesPrevCAS: cas,
+		planPIndexes:        planPIndexesPrev,
+	}
+
+	var plannerFilter PlannerFilter
+	if plannerFilterFn != nil {
+		plannerFilter = plannerFilterFn(res.cas)
 	}
 
 	// use the effective version while calculating the new plan
@@ -201,21 +365,64 @@ func Plan(cfg Cfg, version, uuid, server string, options map[string]string,
 	planPIndexes, err := CalcPlan("", indexDefs, nodeDefs,
 		planPIndexesPrev, version, server, options, plannerFilter)
 	if err != nil {
-		return false, fmt.Errorf("planner: CalcPlan, err: %v", err)
+		return false, nil, fmt.Errorf("planner: CalcPlan, err: %v", err)
 	}
 
 	if SamePlanPIndexes(planPIndexes, planPIndexesPrev) {
-		return false, nil
+		return false, res, nil
 	}
 
-	_, err = CfgSetPlanPIndexes(cfg, planPIndexes, cas)
+	var casSuccess uint64
+
+	if cfgTxn, ok := cfg.(CfgTxn); ok {
+		// Save the plan only if it was calculated from the latest
+		// index and node definitions.
+		var op CfgTxnOp
+		op, err = CfgTxnOpSetPlanPIndexes(planPIndexes, cas)
+		if err == nil {
+			var casSuccesses []uint64
+			casSuccesses, err = cfgTxn.Txn([]CfgTxnOp{
+				{Op: CFG_TXN_OP_CHECK, Key: INDEX_DEFS_KEY,
+					CAS: indexDefsCAS},
+				{Op: CFG_TXN_OP_CHECK, Key: CfgNodeDefsKey(NODE_DEFS_WANTED),
+					CAS: nodeDefsCAS},
+				op,
+			})
+			if err == nil {
+				casSuccess = casSuccesses[2]
+			}
+		}
+	} else {
+		casSuccess, err = CfgSetPlanPIndexes(cfg, planPIndexes, cas)
+	}
 	if err != nil {
-		return false, fmt.Errorf("planner: could not save new plan,"+
+		return false, nil, fmt.Errorf("planner: could not save new plan,"+
 			" perhaps a concurrent planner won, cas: %d, err: %v",
 			cas, err)
 	}
 
-	return true, nil
+	// Others will see the plan as parsed from the Cfg, which might
+	// differ from the calculated plan, such as in its IndexParams.
+	res.planPIndexes, err = planPIndexesReparse(planPIndexes)
+	if err != nil {
+		return false, nil, err
+	}
+	res.cas.planPIndexes = casSuccess
+
+	return true, res, nil
+}
+
+func planPIndexesReparse(planPIndexes *PlanPIndexes) (*PlanPIndexes, error) {
+	buf, err := json.Marshal(planPIndexes)
+	if err != nil {
+		return nil, fmt.Errorf("planner: could not marshal plan, err: %v", err)
+	}
+	rv := &PlanPIndexes{}
+	err = json.Unmarshal(buf, rv)
+	if err != nil {
+		return nil, fmt.Errorf("planner: could not parse plan, err: %v", err)
+	}
+	return rv, nil
 }
 
 // PlannerGetPlan retrieves plan related info from the Cfg.
@@ -225,31 +432,50 @@ func PlannerGetPlan(cfg Cfg, version string, uuid string) (
 	planPIndexes *PlanPIndexes,
 	planPIndexesCAS uint64,
 	err error) {
+	indexDefs, _, nodeDefs, _, planPIndexes, planPIndexesCAS, err =
+		plannerGetPlan(cfg, version, uuid)
+
+	return indexDefs, nodeDefs, planPIndexes, planPIndexesCAS, err
+}
+
+// plannerGetPlan is like PlannerGetPlan, but also returns the CAS
+// values of the index and node definitions.
+func plannerGetPlan(cfg Cfg, version string, uuid string) (
+	indexDefs *IndexDefs,
+	indexDefsCAS uint64,
+	nodeDefs *NodeDefs,
+	nodeDefsCAS uint64,
+	planPIndexes *PlanPIndexes,
+	planPIndexesCAS uint64,
+	err error) {
 	// use the incoming version for a potential version bump
 	err = PlannerCheckVersion(cfg, version)
 	if err != nil {
-		return nil, nil, nil, 0, err
+		return nil, 0, nil, 0, nil, 0, err
 	}
 
-	indexDefs, err = PlannerGetIndexDefs(cfg, version)
+	indexDefs, indexDefsCAS, err = plannerGetIndexDefs(cfg, version)
 	if err != nil {
-		return nil, nil, nil, 0, err
+		return nil, 0, nil, 0, nil, 0, err
 	}
 
-	nodeDefs, err = PlannerGetNodeDefs(cfg, version, uuid)
+	nodeDefs, nodeDefsCAS, err = plannerGetNodeDefs(cfg, version, uuid)
 	if err != nil {
-		return nil, nil, nil, 0, err
+		return nil, 0, nil, 0, nil, 0, err
 	}
 
 	planPIndexes, planPIndexesCAS, err = PlannerGetPlanPIndexes(cfg, version)
 	if err != nil {
-		return nil, nil, nil, 0, err
+		return nil, 0, nil, 0, nil, 0, err
 	}
 
-	return indexDefs, nodeDefs, planPIndexes, planPIndexesCAS, nil
+	return indexDefs, indexDefsCAS, nodeDefs, nodeDefsCAS,
+		planPIndexes, planPIndexesCAS, nil
 }
 
-// PlannerCheckVersion errors if a version string is too low.
+// PlannerCheckVersion errors if a version string is too low.  It
+// also applies any pending CfgMigration steps, as the Cfg's version
+// might have just been advanced.
 func PlannerCheckVersion(cfg Cfg, version string) error {
 	ok, err := CheckVersion(cfg, version)
 	if err != nil {
@@ -258,53 +484,77 @@ func PlannerCheckVersion(cfg Cfg, version string) error {
 	if !ok {
 		return fmt.Errorf("planner: version too low: %v", version)
 	}
+	_, err = CfgMigrate(cfg, false)
+	if err != nil {
+		return fmt.Errorf("planner: CfgMigrate err: %v", err)
+	}
 	return nil
 }
 
 // PlannerGetIndexDefs retrives index definitions from a Cfg.
 func PlannerGetIndexDefs(cfg Cfg, version string) (*IndexDefs, error) {
-	indexDefs, _, err := CfgGetIndexDefs(cfg)
+	indexDefs, _, err := plannerGetIndexDefs(cfg, version)
+	return indexDefs, err
+}
+
+// PlannerGetIndexDefsCAS is like PlannerGetIndexDefs, but also
+// returns the CAS of the index definitions, such as for use in a
+// CfgTxn "check" op.
+func PlannerGetIndexDefsCAS(cfg Cfg, version string) (
+	*IndexDefs, uint64, error) {
+	return plannerGetIndexDefs(cfg, version)
+}
+
+func plannerGetIndexDefs(cfg Cfg, version string) (
+	*IndexDefs, uint64, error) {
+	indexDefs, cas, err := CfgGetIndexDefs(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("planner: CfgGetIndexDefs err: %v", err)
+		return nil, 0, fmt.Errorf("planner: CfgGetIndexDefs err: %v", err)
 	}
 	if indexDefs == nil {
-		return NewIndexDefs(CfgGetVersion(cfg)), nil
+		return NewIndexDefs(CfgGetVersion(cfg)), cas, nil
 	}
 	if VersionGTE(version, indexDefs.ImplVersion) == false {
-		return nil, fmt.Errorf("planner: indexDefs.ImplVersion: %s"+
+		return nil, 0, fmt.Errorf("planner: indexDefs.ImplVersion: %s"+
 			" > version: %s", indexDefs.ImplVersion, version)
 	}
-	return indexDefs, nil
+	return indexDefs, cas, nil
 }
 
 // PlannerGetNodeDefs retrieves node definitions from a Cfg.
 func PlannerGetNodeDefs(cfg Cfg, version, uuid string) (
 	*NodeDefs, error) {
-	nodeDefs, _, err := CfgGetNodeDefs(cfg, NODE_DEFS_WANTED)
+	nodeDefs, _, err := plannerGetNodeDefs(cfg, version, uuid)
+	return nodeDefs, err
+}
+
+func plannerGetNodeDefs(cfg Cfg, version, uuid string) (
+	*NodeDefs, uint64, error) {
+	nodeDefs, cas, err := CfgGetNodeDefs(cfg, NODE_DEFS_WANTED)
 	if err != nil {
-		return nil, fmt.Errorf("planner: CfgGetNodeDefs err: %v", err)
+		return nil, 0, fmt.Errorf("planner: CfgGetNodeDefs err: %v", err)
 	}
 	if nodeDefs == nil {
 		nodeDefs = NewNodeDefs(CfgGetVersion(cfg))
 	}
 	if VersionGTE(version, nodeDefs.ImplVersion) == false {
-		return nil, fmt.Errorf("planner: nodeDefs.ImplVersion: %s"+
+		return nil, 0, fmt.Errorf("planner: nodeDefs.ImplVersion: %s"+
 			" > version: %s", nodeDefs.ImplVersion, version)
 	}
 	if uuid == "" { // The caller may not be a node, so has empty uuid.
-		return nodeDefs, nil
+		return nodeDefs, cas, nil
 	}
 	nodeDef, exists := nodeDefs.NodeDefs[uuid]
 	if !exists || nodeDef == nil {
-		return nil, fmt.Errorf("planner: no NodeDef, uuid: %s", uuid)
+		return nil, 0, fmt.Errorf("planner: no NodeDef, uuid: %s", uuid)
 	}
 	if nodeDef.ImplVersion != version {
-		return nil, fmt.Errorf("planner: ended since NodeDef, uuid: %s,"+
+		return nil, 0, fmt.Errorf("planner: ended since NodeDef, uuid: %s,"+
 			" NodeDef.ImplVersion: %s != version: %s",
 			uuid, nodeDef.ImplVersion, version)
 	}
 	if nodeDef.UUID != uuid {
-		return nil, fmt.Errorf("planner: ended since NodeDef, uuid: %s,"+
+		return nil, 0, fmt.Errorf("planner: ended since NodeDef, uuid: %s,"+
 			" NodeDef.UUID: %s != uuid: %s",
 			uuid, nodeDef.UUID, uuid)
 	}
@@ -318,10 +568,10 @@ func PlannerGetNodeDefs(cfg Cfg, version, uuid string) (
 		}
 	}
 	if !isPlanner {
-		return nil, fmt.Errorf("planner: ended since node, uuid: %s,"+
+		return nil, 0, fmt.Errorf("planner: ended since node, uuid: %s,"+
 			" is not a planner, tags: %#v", uuid, nodeDef.Tags)
 	}
-	return nodeDefs, nil
+	return nodeDefs, cas, nil
 }
 
 // PlannerGetPlanPIndexes retrieves the planned pindexes from a Cfg.
@@ -589,8 +839,14 @@ func SplitIndexDefIntoPlanPIndexes(indexDef *IndexDef, server string,
 	map[string]*PlanPIndex, error) {
 	maxPartitionsPerPIndex := indexDef.PlanParams.MaxPartitionsPerPIndex
 
+	sourceParams, err := DecryptSourceParams(indexDef.SourceParams, options)
+	if err != nil {
+		return nil, fmt.Errorf("planner: could not decrypt sourceParams,"+
+			" indexDef.Name: %s, err: %v", indexDef.Name, err)
+	}
+
 	sourcePartitionsArr, err := DataSourcePartitions(indexDef.SourceType,
-		indexDef.SourceName, indexDef.SourceUUID, indexDef.SourceParams,
+		indexDef.SourceName, indexDef.SourceUUID, sourceParams,
 		server, options)
 	if err != nil {
 		return nil, fmt.Errorf("planner: could not get partitions,"+
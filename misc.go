@@ -19,7 +19,10 @@ import (
 	"math"
 	"math/rand"
 	"net/http"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync/atomic"
@@ -188,6 +191,59 @@ func StringsIntersectStrings(a, b []string) []string {
 	return rv
 }
 
+// WriteFileSync replaces the file at the path with the data via a
+// temp file that's synced and then renamed over the path, followed by
+// a sync of the parent directory, so that the data survives a crash
+// once WriteFileSync returns.
+func WriteFileSync(path string, data []byte, perm os.FileMode) error {
+	pathTmp := path + ".tmp"
+
+	f, err := os.OpenFile(pathTmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	errClose := f.Close()
+	if err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Rename(pathTmp, path)
+	}
+	if err != nil {
+		os.Remove(pathTmp)
+		return err
+	}
+
+	return SyncDir(filepath.Dir(path))
+}
+
+// SyncDir syncs a directory, so that the files that were created,
+// renamed or removed in it survive a crash.  It's a no-op on windows,
+// which doesn't support the sync of a directory.
+func SyncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	err = d.Sync()
+	errClose := d.Close()
+	if err == nil {
+		err = errClose
+	}
+
+	return err
+}
+
 // TimeoutCancelChan creates a channel that closes after a given
 // timeout in milliseconds.
 func TimeoutCancelChan(timeout int64) <-chan bool {
@@ -17,6 +17,7 @@ import (
 	"io/ioutil"
 	"math"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 )
@@ -45,8 +46,9 @@ type PIndex struct {
 
 	sourcePartitionsMap map[string]bool // Non-persisted memoization.
 
-	m      sync.Mutex
-	closed bool
+	m           sync.Mutex
+	closed      bool
+	deadLetters *DeadLetterStore // Created on demand.
 }
 
 // Close down a pindex, optionally removing its stored files.
@@ -58,8 +60,13 @@ func (p *PIndex) Close(remove bool) error {
 	}
 
 	p.closed = true
+	deadLetters := p.deadLetters
 	p.m.Unlock()
 
+	if deadLetters != nil {
+		deadLetters.Close()
+	}
+
 	if p.Dest != nil {
 		err := p.Dest.Close()
 		if err != nil {
@@ -95,6 +102,7 @@ func (p *PIndex) Clone() *PIndex {
 			Impl:                p.Impl,
 			Dest:                p.Dest,
 			closed:              p.closed,
+			deadLetters:         p.deadLetters,
 		}
 		p.m.Unlock()
 		return pi
@@ -102,6 +110,19 @@ func (p *PIndex) Clone() *PIndex {
 	return nil
 }
 
+// DeadLetters returns the DeadLetterStore of the pindex, whose file
+// is in the pindex's directory.
+func (p *PIndex) DeadLetters() *DeadLetterStore {
+	p.m.Lock()
+	if p.deadLetters == nil {
+		p.deadLetters = NewDeadLetterStore(
+			filepath.Join(p.Path, DEAD_LETTERS_FILENAME))
+	}
+	rv := p.deadLetters
+	p.m.Unlock()
+	return rv
+}
+
 func restartPIndex(mgr *Manager, pindex *PIndex) {
 	pindex.m.Lock()
 	closed := pindex.closed
@@ -97,6 +97,11 @@ func (t *BlackHole) DataDelete(partition string,
 	return nil
 }
 
+func (t *BlackHole) DataBatch(partition string,
+	batch *DestBatchData) error {
+	return nil
+}
+
 func (t *BlackHole) SnapshotStart(partition string,
 	snapStart, snapEnd uint64) error {
 	return nil
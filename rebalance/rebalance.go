@@ -665,7 +665,8 @@ func (r *Rebalancer) assignPIndexLOCKED(index, pindex, node, state, op string) (
 		return nil, nil, "", err
 	}
 
-	indexDefs, err := cbgt.PlannerGetIndexDefs(r.cfg, r.version)
+	indexDefs, indexDefsCAS, err :=
+		cbgt.PlannerGetIndexDefsCAS(r.cfg, r.version)
 	if err != nil {
 		return nil, nil, "", err
 	}
@@ -690,7 +691,21 @@ func (r *Rebalancer) assignPIndexLOCKED(index, pindex, node, state, op string) (
 		return nil, nil, formerPrimaryNode, nil
 	}
 
-	_, err = cbgt.CfgSetPlanPIndexes(r.cfg, planPIndexes, cas)
+	if cfgTxn, ok := r.cfg.(cbgt.CfgTxn); ok {
+		// Save the plan only if the index definitions weren't changed
+		// meanwhile, such as by a concurrent index deletion.
+		var op cbgt.CfgTxnOp
+		op, err = cbgt.CfgTxnOpSetPlanPIndexes(planPIndexes, cas)
+		if err == nil {
+			_, err = cfgTxn.Txn([]cbgt.CfgTxnOp{
+				{Op: cbgt.CFG_TXN_OP_CHECK, Key: cbgt.INDEX_DEFS_KEY,
+					CAS: indexDefsCAS},
+				op,
+			})
+		}
+	} else {
+		_, err = cbgt.CfgSetPlanPIndexes(r.cfg, planPIndexes, cas)
+	}
 	if err != nil {
 		return nil, nil, "", err
 	}
@@ -744,3 +744,96 @@ func TestRebalanceStatsErrorCase(t *testing.T) {
 		})
 	}
 }
+
+// TestRebalanceCfgFaultyChaos runs rebalances against a Cfg with
+// injected faults, and checks that the faults are reported instead of
+// being lost, and that a rebalance after the faults stop converges.
+func TestRebalanceCfgFaultyChaos(t *testing.T) {
+	testDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testDir)
+
+	inner := cbgt.NewCfgMem()
+	cfg := cbgt.NewCfgFaulty(inner, cbgt.CfgFaultyOptions{})
+	cf := cbgt.GetCfgFaulty(cfg)
+
+	mgr, err := startNodeManager(testDir, inner, "a", "wanted", nil, ".")
+	if err != nil || mgr == nil {
+		t.Fatalf("expected no err, got: %#v", err)
+	}
+	defer mgr.Stop()
+
+	testCreateIndex(t, mgr, "x", nil, func() {})
+
+	httpGet := func(url string) (resp *http.Response, err error) {
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBuffer([]byte("{}"))),
+		}, nil
+	}
+
+	rebalance := func() (startErr, endErr error) {
+		r, err := StartRebalance(cbgt.VERSION, cfg, ".", nil, nil,
+			RebalanceOptions{
+				HttpGet:       httpGet,
+				SkipSeqChecks: true,
+			},
+		)
+		if err != nil {
+			return err, nil
+		}
+
+		for progress := range r.ProgressCh() {
+			if progress.Error != nil {
+				endErr = progress.Error
+			}
+		}
+
+		r.Stop()
+
+		return nil, endErr
+	}
+
+	cf.Partition(0)
+	startErr, _ := rebalance()
+	if startErr == nil {
+		t.Errorf("expected rebalance to fail to start in a partition")
+	}
+	cf.Heal()
+
+	// Every plan write fails, after the rebalance has started.
+	cf.SetOptions(cbgt.CfgFaultyOptions{
+		ErrorEvery: map[string]int{
+			cbgt.CFG_FAULTY_OP_SET: 1,
+			cbgt.CFG_FAULTY_OP_TXN: 1,
+		},
+		Keys: []string{cbgt.PLAN_PINDEXES_KEY},
+	})
+	startErr, endErr := rebalance()
+	if startErr != nil || endErr == nil {
+		t.Errorf("expected the plan write faults to be reported,"+
+			" startErr: %v, endErr: %v", startErr, endErr)
+	}
+	if cf.Stats().TotErrors == 0 {
+		t.Errorf("expected plan write faults, stats: %#v", cf.Stats())
+	}
+
+	cf.SetOptions(cbgt.CfgFaultyOptions{})
+	startErr, endErr = rebalance()
+	if startErr != nil || endErr != nil {
+		t.Errorf("expected rebalance to work once healed,"+
+			" startErr: %v, endErr: %v", startErr, endErr)
+	}
+
+	planPIndexes, _, err := cbgt.CfgGetPlanPIndexes(inner)
+	if err != nil || planPIndexes == nil ||
+		len(planPIndexes.PlanPIndexes) != 4 {
+		t.Fatalf("expected 4 plan pindexes, got: %#v, err: %v",
+			planPIndexes, err)
+	}
+	for name, planPIndex := range planPIndexes.PlanPIndexes {
+		if planPIndex.Nodes["a"] == nil || len(planPIndex.Nodes) != 1 {
+			t.Errorf("expected plan pindex on node a, name: %s, nodes: %#v",
+				name, planPIndex.Nodes)
+		}
+	}
+}
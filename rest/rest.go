@@ -78,8 +78,9 @@ func PropagateError(w http.ResponseWriter, requestBody []byte, msg string, code
 		requestBodyMap := map[string]interface{}{}
 		err := json.Unmarshal(requestBody, &requestBodyMap)
 		if err != nil {
-			details["request"] = fmt.Sprintf("%v", string(requestBody))
+			details["request"] = cbgt.RedactSourceParams(string(requestBody))
 		} else {
+			RedactSourceParamsField(requestBodyMap)
 			details["request"] = requestBodyMap
 		}
 	}
@@ -96,6 +97,19 @@ func PropagateError(w http.ResponseWriter, requestBody []byte, msg string, code
 
 }
 
+// RedactSourceParamsField redacts the credentials in the
+// "sourceParams" field of a JSON object, such as an index definition
+// or a pindex, where the sourceParams may be either a JSON string or
+// a nested JSON object.
+func RedactSourceParamsField(m map[string]interface{}) {
+	switch sp := m["sourceParams"].(type) {
+	case string:
+		m["sourceParams"] = cbgt.RedactSourceParams(sp)
+	case map[string]interface{}:
+		cbgt.RedactSourceParamsMap(sp)
+	}
+}
+
 func MustEncode(w io.Writer, i interface{}) {
 	rw, rwOk := w.(http.ResponseWriter)
 	if rwOk {
@@ -487,6 +501,21 @@ func InitRESTRouterEx(r *mux.Router, versionMain string,
 				`Allowed values for op are "pause" or "resume".`,
 			"version introduced": "0.0.1",
 		})
+	handle("/api/index/{indexName}/partitionControl/{op}", "POST",
+		NewFeedPartitionControlHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index management",
+			"_about": `Pause, resume or seek back the ingest of a source
+                          partition of an index on this node, without
+                          restarting its feed.  Only the feeds of the "gocb"
+                          source type support per-partition streams, and
+                          other feeds, including those of the "couchbase"
+                          and "couchbase-dcp" source types, respond with a
+                          501 (Not Implemented).`,
+			"param: op": "required, string, URL path parameter\n\n" +
+				`Allowed values for op are "pause", "resume" or "seek".`,
+			"version introduced": "6.0.0",
+		})
 	handle("/api/index/{indexName}/queryControl/{op}", "POST",
 		NewIndexControlHandler(mgr, "read", map[string]bool{
 			"allow":    true,
@@ -525,6 +554,34 @@ func InitRESTRouterEx(r *mux.Router, versionMain string,
 				"_category":          "x/Advanced|x/Index partition querying",
 				"version introduced": "0.2.0",
 			})
+		handle("/api/pindex/{pindexName}/deadLetter", "GET",
+			NewListDeadLetterHandler(mgr),
+			map[string]string{
+				"_category": "x/Advanced|x/Index partition dead letters",
+				"_about": `Returns the mutations of an index partition that
+                          were dead-lettered by the index's errorPolicy,
+                          without their values.`,
+				"version introduced": "6.0.0",
+			})
+		handle("/api/pindex/{pindexName}/deadLetter/{id}", "GET",
+			NewGetDeadLetterHandler(mgr),
+			map[string]string{
+				"_category":          "x/Advanced|x/Index partition dead letters",
+				"_about":             `Returns a dead-lettered mutation.`,
+				"version introduced": "6.0.0",
+			})
+		handle("/api/pindex/{pindexName}/deadLetterControl/{op}", "POST",
+			NewDeadLetterControlHandler(mgr),
+			map[string]string{
+				"_category": "x/Advanced|x/Index partition dead letters",
+				"_about": `Replay dead-lettered mutations into the index
+                          partition, removing those that are applied and
+                          skipping those whose documents have since
+                          changed, or purge them.`,
+				"param: op": "required, string, URL path parameter\n\n" +
+					`Allowed values for op are "replay" or "purge".`,
+				"version introduced": "6.0.0",
+			})
 	}
 	handle("/api/index/{indexName}/pindexLookup", "POST", NewPIndexLookUpHandler(mgr),
 		map[string]string{
@@ -533,6 +590,37 @@ func InitRESTRouterEx(r *mux.Router, versionMain string,
 			"version introduced": "5.0.0",
 		})
 
+	handle("/api/index/{indexName}/doc/{docID}", "PUT",
+		NewHTTPFeedDocHandler(mgr, cbgt.HTTP_FEED_OP_UPSERT),
+		map[string]string{
+			"_category": "Indexing|Index ingest",
+			"_about": `Upserts a document, where the request body is
+                       the document's value, into an index whose
+                       sourceType is "http".  Returns the consistency
+                       params that can be passed to later queries.`,
+			"version introduced": "6.0.0",
+		})
+	handle("/api/index/{indexName}/doc/{docID}", "DELETE",
+		NewHTTPFeedDocHandler(mgr, cbgt.HTTP_FEED_OP_DELETE),
+		map[string]string{
+			"_category": "Indexing|Index ingest",
+			"_about": `Deletes a document from an index whose
+                       sourceType is "http".  Returns the consistency
+                       params that can be passed to later queries.`,
+			"version introduced": "6.0.0",
+		})
+	handle("/api/index/{indexName}/docs", "POST",
+		NewHTTPFeedDocsHandler(mgr),
+		map[string]string{
+			"_category": "Indexing|Index ingest",
+			"_about": `Upserts or deletes a JSON array of documents,
+                       like [{"op":"upsert","key":"k","value":{...}},
+                       {"op":"delete","key":"k2"}], of an index whose
+                       sourceType is "http".  Returns the consistency
+                       params that can be passed to later queries.`,
+			"version introduced": "6.0.0",
+		})
+
 	handle("/api/managerOptions", "PUT", NewManagerOptions(mgr),
 		map[string]string{
 			"_category":          "Node|Node configuration",
@@ -572,6 +660,111 @@ func InitRESTRouterEx(r *mux.Router, versionMain string,
 			"version introduced": "5.5.0",
 		})
 
+	handle("/api/cfg/kv", "GET", NewCfgKVGetHandler(mgr),
+		map[string]string{
+			"_category": "Node|Node configuration",
+			"_about": `Returns the value and CAS of the Cfg key in
+                       the "key" param, for Cfg clients, where the
+                       credentials in any sourceParams are redacted.`,
+			"version introduced": "6.0.0",
+		})
+
+	handle("/api/cfg/kv", "PUT", NewCfgKVSetHandler(mgr),
+		map[string]string{
+			"_category": "Node|Node configuration",
+			"_about": `Sets the Cfg key in the "key" param to the
+                       request body, where the "cas" param must match
+                       the key's current CAS, unless it's 0.  Redacted
+                       credentials are restored from the current value,
+                       or for new planPIndexes, from their indexDef.`,
+			"version introduced": "6.0.0",
+		})
+
+	handle("/api/cfg/kv", "DELETE", NewCfgKVDelHandler(mgr),
+		map[string]string{
+			"_category": "Node|Node configuration",
+			"_about": `Deletes the Cfg key in the "key" param, where
+                       the "cas" param must match the key's current
+                       CAS, unless it's 0.`,
+			"version introduced": "6.0.0",
+		})
+
+	handle("/api/cfg/kv/subscribe", "GET", NewCfgKVSubscribeHandler(mgr),
+		map[string]string{
+			"_category": "Node|Node configuration",
+			"_about": `Long-polls until the CAS of the Cfg key in the
+                       "key" param differs from the "cas" param, or
+                       until the "timeoutMS" param elapses.`,
+			"version introduced": "6.0.0",
+		})
+
+	handle("/api/cfg/check", "GET", NewCfgCheckHandler(mgr),
+		map[string]string{
+			"_category": "Node|Node configuration",
+			"_about": `Returns the inconsistencies between the
+                       indexDefs, nodeDefs and planPIndexes of the Cfg,
+                       each with a severity.`,
+			"version introduced": "6.0.0",
+		})
+
+	handle("/api/cfg/check", "POST", NewCfgRepairHandler(mgr),
+		map[string]string{
+			"_category": "Plan|Plan configuration",
+			"_about": `Repairs the inconsistencies of the planPIndexes,
+                       by pruning orphaned plan pindexes and unwanted
+                       nodes and replanning the affected indexes; this
+                       is a dry run unless the "apply" param is true.`,
+			"version introduced": "6.0.0",
+		})
+
+	handle("/api/cfg/history", "GET", NewCfgHistoryHandler(mgr),
+		map[string]string{
+			"_category": "Node|Node configuration",
+			"_about": `Returns the recent revisions of the well-known
+                       Cfg keys, when the Cfg history is enabled.`,
+			"version introduced": "6.0.0",
+		})
+
+	handle("/api/cfg/history/{cfgKey}", "GET", NewCfgHistoryHandler(mgr),
+		map[string]string{
+			"_category": "Node|Node configuration",
+			"_about": `Returns the recent revisions of a Cfg key,
+                       when the Cfg history is enabled.`,
+			"version introduced": "6.0.0",
+		})
+
+	handle("/api/cfg/history/{cfgKey}/diff", "GET",
+		NewCfgHistoryDiffHandler(mgr),
+		map[string]string{
+			"_category": "Node|Node configuration",
+			"_about": `Returns the differences between the "from"
+                       and "to" revisions of a Cfg key, where a missing
+                       "to" means the key's current value.`,
+			"version introduced": "6.0.0",
+		})
+
+	handle("/api/cfg/history/{cfgKey}/{rev}", "GET",
+		NewCfgHistoryRevHandler(mgr),
+		map[string]string{
+			"_category": "Node|Node configuration",
+			"_about": `Returns a revision of a Cfg key,
+                       including its value.`,
+			"version introduced": "6.0.0",
+		})
+
+	handle("/api/cfg/history/{cfgKey}/{rev}/restore", "POST",
+		NewCfgHistoryRestoreHandler(mgr),
+		map[string]string{
+			"_category": "Plan|Plan configuration",
+			"_about": `Restores a revision of the indexDefs or
+                       planPIndexes, where the "cas" param must match
+                       the key's current CAS.  The credentials are kept
+                       from the current value, so a revision with
+                       credentials of since removed indexes or plans
+                       can't be restored.`,
+			"version introduced": "6.0.0",
+		})
+
 	handle("/api/log", "GET", NewLogGetHandler(mgr, mr),
 		map[string]string{
 			"_category": "Node|Node diagnostics",
@@ -0,0 +1,102 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package rest
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/couchbase/cbgt"
+)
+
+// CfgCheckHandler is a REST handler that reports the inconsistencies
+// between the indexDefs, nodeDefs and planPIndexes of the Cfg.
+type CfgCheckHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewCfgCheckHandler(mgr *cbgt.Manager) *CfgCheckHandler {
+	return &CfgCheckHandler{mgr: mgr}
+}
+
+func (h *CfgCheckHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	issues, err := cbgt.CheckCfgInvariants(h.mgr.Cfg())
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_cfg_check:"+
+			" could not check cfg, err: %v", err),
+			http.StatusInternalServerError)
+		return
+	}
+
+	if issues == nil {
+		issues = []*cbgt.CfgCheckIssue{}
+	}
+
+	MustEncode(w, struct {
+		Status string                `json:"status"`
+		Issues []*cbgt.CfgCheckIssue `json:"issues"`
+	}{
+		Status: "ok",
+		Issues: issues,
+	})
+}
+
+// ---------------------------------------------------
+
+// CfgRepairHandler is a REST handler that repairs the inconsistencies
+// of the plan, which is only a dry run unless the "apply" param is
+// true.
+type CfgRepairHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewCfgRepairHandler(mgr *cbgt.Manager) *CfgRepairHandler {
+	return &CfgRepairHandler{mgr: mgr}
+}
+
+func (h *CfgRepairHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	apply := false
+	if v := req.FormValue("apply"); v != "" {
+		var err error
+		apply, err = strconv.ParseBool(v)
+		if err != nil {
+			ShowError(w, req, fmt.Sprintf("rest_cfg_check:"+
+				" invalid apply: %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	res, err := cbgt.RepairCfgInvariants(h.mgr.Cfg(),
+		cbgt.CfgCheckRepairOptions{
+			DryRun:  !apply,
+			Version: h.mgr.Version(),
+			Server:  h.mgr.Server(),
+			Options: h.mgr.Options(),
+		})
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_cfg_check:"+
+			" could not repair cfg, err: %v", err),
+			http.StatusInternalServerError)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status string                     `json:"status"`
+		Repair *cbgt.CfgCheckRepairResult `json:"repair"`
+	}{
+		Status: "ok",
+		Repair: res,
+	})
+}
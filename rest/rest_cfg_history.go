@@ -0,0 +1,294 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package rest
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/couchbase/cbgt"
+)
+
+// cfgHistoryLookup returns the CfgHistory of a manager's Cfg, or
+// responds with an error.
+func cfgHistoryLookup(w http.ResponseWriter, req *http.Request,
+	mgr *cbgt.Manager) *cbgt.CfgHistory {
+	cfgHistory := cbgt.GetCfgHistory(mgr.Cfg())
+	if cfgHistory == nil {
+		ShowError(w, req, "rest_cfg_history: cfg history is not enabled",
+			http.StatusNotImplemented)
+	}
+	return cfgHistory
+}
+
+// cfgHistoryRevParse parses a revision number, where "" is allowed
+// (and returned as 0) only if optional is true.
+func cfgHistoryRevParse(w http.ResponseWriter, req *http.Request,
+	name, v string, optional bool) (uint64, bool) {
+	if v == "" && optional {
+		return 0, true
+	}
+	rev, err := strconv.ParseUint(v, 10, 64)
+	if err != nil || rev == 0 {
+		ShowError(w, req, fmt.Sprintf("rest_cfg_history:"+
+			" invalid %s: %q", name, v), http.StatusBadRequest)
+		return 0, false
+	}
+	return rev, true
+}
+
+// cfgHistoryRedactDiffVal redacts a value in a CfgHistoryDiff when
+// it's a sourceParams or a credential within a sourceParams.
+func cfgHistoryRedactDiffVal(path string, v interface{}) interface{} {
+	name := path[strings.LastIndex(path, "/")+1:]
+	if name == "sourceParams" {
+		switch sp := v.(type) {
+		case string:
+			return cbgt.RedactSourceParams(sp)
+		case map[string]interface{}:
+			cbgt.RedactSourceParamsMap(sp)
+		}
+		return v
+	}
+
+	if s, ok := v.(string); ok && s != "" &&
+		strings.Contains(path, "/sourceParams/") {
+		for _, field := range cbgt.SecretFields {
+			if name == field {
+				return cbgt.SECRET_REDACTED
+			}
+		}
+	}
+
+	return v
+}
+
+// ---------------------------------------------------
+
+// CfgHistoryHandler is a REST handler that lists the revisions of the
+// well-known Cfg keys, or of a single key.
+type CfgHistoryHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewCfgHistoryHandler(mgr *cbgt.Manager) *CfgHistoryHandler {
+	return &CfgHistoryHandler{mgr: mgr}
+}
+
+func (h *CfgHistoryHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	cfgHistory := cfgHistoryLookup(w, req, h.mgr)
+	if cfgHistory == nil {
+		return
+	}
+
+	keys := cbgt.CfgHistoryKeys
+	if key := RequestVariableLookup(req, "cfgKey"); key != "" {
+		keys = []string{key}
+	}
+
+	history := map[string][]*cbgt.CfgHistoryRevision{}
+	for _, key := range keys {
+		revs, err := cfgHistory.Revisions(key)
+		if err != nil {
+			ShowError(w, req, fmt.Sprintf("rest_cfg_history:"+
+				" could not get revisions, key: %s, err: %v", key, err),
+				http.StatusInternalServerError)
+			return
+		}
+		history[key] = revs
+	}
+
+	MustEncode(w, struct {
+		Status  string                                `json:"status"`
+		History map[string][]*cbgt.CfgHistoryRevision `json:"history"`
+	}{
+		Status:  "ok",
+		History: history,
+	})
+}
+
+// ---------------------------------------------------
+
+// CfgHistoryRevHandler is a REST handler that returns a single
+// revision of a Cfg key, including its value.
+type CfgHistoryRevHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewCfgHistoryRevHandler(mgr *cbgt.Manager) *CfgHistoryRevHandler {
+	return &CfgHistoryRevHandler{mgr: mgr}
+}
+
+func (h *CfgHistoryRevHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	cfgHistory := cfgHistoryLookup(w, req, h.mgr)
+	if cfgHistory == nil {
+		return
+	}
+
+	key := RequestVariableLookup(req, "cfgKey")
+	rev, ok := cfgHistoryRevParse(w, req, "rev",
+		RequestVariableLookup(req, "rev"), false)
+	if !ok {
+		return
+	}
+
+	r, val, err := cfgHistory.Revision(key, rev)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_cfg_history:"+
+			" could not get revision, key: %s, rev: %d, err: %v",
+			key, rev, err), http.StatusNotFound)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status   string                   `json:"status"`
+		Revision *cbgt.CfgHistoryRevision `json:"revision"`
+		Val      string                   `json:"val"`
+	}{
+		Status:   "ok",
+		Revision: r,
+		Val:      string(cbgt.RedactCfgVal(key, val)),
+	})
+}
+
+// ---------------------------------------------------
+
+// CfgHistoryDiffHandler is a REST handler that returns the
+// differences between two revisions of a Cfg key, where a missing
+// "to" parameter means the key's current value.
+type CfgHistoryDiffHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewCfgHistoryDiffHandler(mgr *cbgt.Manager) *CfgHistoryDiffHandler {
+	return &CfgHistoryDiffHandler{mgr: mgr}
+}
+
+func (h *CfgHistoryDiffHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	cfgHistory := cfgHistoryLookup(w, req, h.mgr)
+	if cfgHistory == nil {
+		return
+	}
+
+	key := RequestVariableLookup(req, "cfgKey")
+	revFrom, ok := cfgHistoryRevParse(w, req, "from",
+		req.FormValue("from"), false)
+	if !ok {
+		return
+	}
+	revTo, ok := cfgHistoryRevParse(w, req, "to",
+		req.FormValue("to"), true)
+	if !ok {
+		return
+	}
+
+	diffs, err := cfgHistory.Diff(key, revFrom, revTo)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_cfg_history:"+
+			" could not diff, key: %s, from: %d, to: %d, err: %v",
+			key, revFrom, revTo, err), http.StatusNotFound)
+		return
+	}
+	if diffs == nil {
+		diffs = []*cbgt.CfgHistoryDiff{}
+	}
+
+	for _, d := range diffs {
+		d.Old = cfgHistoryRedactDiffVal(d.Path, d.Old)
+		d.New = cfgHistoryRedactDiffVal(d.Path, d.New)
+	}
+
+	MustEncode(w, struct {
+		Status string                 `json:"status"`
+		Diffs  []*cbgt.CfgHistoryDiff `json:"diffs"`
+	}{
+		Status: "ok",
+		Diffs:  diffs,
+	})
+}
+
+// ---------------------------------------------------
+
+// CfgHistoryRestoreHandler is a REST handler that restores an earlier
+// revision of the indexDefs or planPIndexes, where the "cas"
+// parameter must match the key's current CAS.
+type CfgHistoryRestoreHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewCfgHistoryRestoreHandler(mgr *cbgt.Manager) *CfgHistoryRestoreHandler {
+	return &CfgHistoryRestoreHandler{mgr: mgr}
+}
+
+func (h *CfgHistoryRestoreHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	cfgHistory := cfgHistoryLookup(w, req, h.mgr)
+	if cfgHistory == nil {
+		return
+	}
+
+	key := RequestVariableLookup(req, "cfgKey")
+	if key != cbgt.INDEX_DEFS_KEY && key != cbgt.PLAN_PINDEXES_KEY {
+		ShowError(w, req, fmt.Sprintf("rest_cfg_history:"+
+			" restore is not supported for key: %s", key),
+			http.StatusBadRequest)
+		return
+	}
+
+	rev, ok := cfgHistoryRevParse(w, req, "rev",
+		RequestVariableLookup(req, "rev"), false)
+	if !ok {
+		return
+	}
+
+	casStr := req.FormValue("cas")
+	cas, err := strconv.ParseUint(casStr, 10, 64)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_cfg_history:"+
+			" invalid cas: %q", casStr), http.StatusBadRequest)
+		return
+	}
+
+	casResult, err := cfgHistory.Restore(key, rev, cas, h.mgr.SecretOptions())
+	if err != nil {
+		code := http.StatusBadRequest
+		if _, ok := err.(*cbgt.CfgCASError); ok {
+			code = http.StatusConflict
+		}
+		ShowError(w, req, fmt.Sprintf("rest_cfg_history:"+
+			" could not restore, key: %s, rev: %d, err: %v",
+			key, rev, err), code)
+		return
+	}
+
+	msg := fmt.Sprintf("api/cfg/history, restored key: %s, rev: %d", key, rev)
+	if key == cbgt.INDEX_DEFS_KEY {
+		h.mgr.GetIndexDefs(true)
+		h.mgr.Kick(msg)
+	} else {
+		h.mgr.GetPlanPIndexes(true)
+		h.mgr.JanitorKick(msg)
+	}
+
+	MustEncode(w, struct {
+		Status string `json:"status"`
+		CAS    uint64 `json:"cas"`
+	}{
+		Status: "ok",
+		CAS:    casResult,
+	})
+}
@@ -0,0 +1,360 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package rest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/couchbase/cbgt"
+)
+
+// The default and max durations of a /api/cfg/kv/subscribe long poll.
+var CfgKVSubscribeTimeoutDefault = 30 * time.Second
+var CfgKVSubscribeTimeoutMax = 5 * time.Minute
+
+// CfgKVSubscribeKeys are the Cfg keys whose /api/cfg/kv/subscribe
+// long polls are served by Cfg subscriptions, which are never torn
+// down, as a Cfg has no unsubscribe.  The long polls of other keys
+// poll the Cfg every CfgKVSubscribePollInterval instead.
+var CfgKVSubscribeKeys = []string{
+	cbgt.VERSION_KEY,
+	cbgt.INDEX_DEFS_KEY,
+	cbgt.PLAN_PINDEXES_KEY,
+	cbgt.CfgNodeDefsKey(cbgt.NODE_DEFS_KNOWN),
+	cbgt.CfgNodeDefsKey(cbgt.NODE_DEFS_WANTED),
+}
+
+var CfgKVSubscribePollInterval = time.Second
+
+// RESTCfgKV is the JSON response of the /api/cfg/kv endpoints, and
+// is the wire format of the cbgt.CfgREST client.  A nil Val means the
+// key does not exist.
+type RESTCfgKV struct {
+	Status  string `json:"status"`
+	Key     string `json:"key"`
+	CAS     uint64 `json:"cas"`
+	Val     []byte `json:"val,omitempty"`
+	Changed bool   `json:"changed,omitempty"` // Only for subscribe.
+}
+
+// cfgKVParse parses the "key" and the optional "cas" request params,
+// or responds with an error.
+func cfgKVParse(w http.ResponseWriter, req *http.Request) (
+	string, uint64, bool) {
+	key := req.FormValue("key")
+	if key == "" {
+		ShowErrorBody(w, nil, "rest_cfg_kv: missing key",
+			http.StatusBadRequest)
+		return "", 0, false
+	}
+
+	var cas uint64
+	if casStr := req.FormValue("cas"); casStr != "" {
+		var err error
+		cas, err = strconv.ParseUint(casStr, 10, 64)
+		if err != nil {
+			ShowErrorBody(w, nil, fmt.Sprintf("rest_cfg_kv:"+
+				" invalid cas: %q", casStr), http.StatusBadRequest)
+			return "", 0, false
+		}
+	}
+
+	return key, cas, true
+}
+
+// cfgKVShowError responds with a Cfg error, where a CAS mismatch is a
+// http.StatusConflict.  The request body, which might hold
+// credentials, is not logged.
+func cfgKVShowError(w http.ResponseWriter, op, key string, err error) {
+	code := http.StatusInternalServerError
+	if _, ok := err.(*cbgt.CfgCASError); ok {
+		code = http.StatusConflict
+	}
+	ShowErrorBody(w, nil, fmt.Sprintf("rest_cfg_kv: could not %s,"+
+		" key: %s, err: %v", op, key, err), code)
+}
+
+// ---------------------------------------------------
+
+// CfgKVGetHandler is a REST handler that returns the value and CAS
+// of a single Cfg key, meant for Cfg clients, such as cbgt.CfgREST.
+// Like /api/cfg, the credentials in any sourceParams are redacted.
+type CfgKVGetHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewCfgKVGetHandler(mgr *cbgt.Manager) *CfgKVGetHandler {
+	return &CfgKVGetHandler{mgr: mgr}
+}
+
+func (h *CfgKVGetHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	key, cas, ok := cfgKVParse(w, req)
+	if !ok {
+		return
+	}
+
+	val, casResult, err := h.mgr.Cfg().Get(key, cas)
+	if err != nil {
+		cfgKVShowError(w, "get", key, err)
+		return
+	}
+
+	if val != nil {
+		val = cbgt.RedactCfgVal(key, val)
+	}
+
+	MustEncode(w, RESTCfgKV{
+		Status: "ok",
+		Key:    key,
+		CAS:    casResult,
+		Val:    val,
+	})
+}
+
+// ---------------------------------------------------
+
+// CfgKVSetHandler is a REST handler that sets a single Cfg key to the
+// request body, where the "cas" param has the same meaning as with
+// Cfg.Set(), and a CAS mismatch is a http.StatusConflict.  Any
+// sourceParams that were redacted by a CfgKVGetHandler are restored
+// by cbgt.SecureCfgVal(), so that a planner that's a Cfg client can
+// write new planPIndexes, and the credentials are encrypted.
+type CfgKVSetHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewCfgKVSetHandler(mgr *cbgt.Manager) *CfgKVSetHandler {
+	return &CfgKVSetHandler{mgr: mgr}
+}
+
+func (h *CfgKVSetHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	key, cas, ok := cfgKVParse(w, req)
+	if !ok {
+		return
+	}
+
+	val, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		ShowErrorBody(w, nil, fmt.Sprintf("rest_cfg_kv:"+
+			" could not read request body, err: %v", err),
+			http.StatusBadRequest)
+		return
+	}
+
+	val, err = cbgt.SecureCfgVal(h.mgr.Cfg(), key, val, h.mgr.SecretOptions())
+	if err != nil {
+		ShowErrorBody(w, nil, fmt.Sprintf("rest_cfg_kv:"+
+			" could not secure value, key: %s, err: %v", key, err),
+			http.StatusBadRequest)
+		return
+	}
+
+	casResult, err := h.mgr.Cfg().Set(key, val, cas)
+	if err != nil {
+		cfgKVShowError(w, "set", key, err)
+		return
+	}
+
+	MustEncode(w, RESTCfgKV{
+		Status: "ok",
+		Key:    key,
+		CAS:    casResult,
+	})
+}
+
+// ---------------------------------------------------
+
+// CfgKVDelHandler is a REST handler that deletes a single Cfg key,
+// where the "cas" param has the same meaning as with Cfg.Del(), and a
+// CAS mismatch is a http.StatusConflict.
+type CfgKVDelHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewCfgKVDelHandler(mgr *cbgt.Manager) *CfgKVDelHandler {
+	return &CfgKVDelHandler{mgr: mgr}
+}
+
+func (h *CfgKVDelHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	key, cas, ok := cfgKVParse(w, req)
+	if !ok {
+		return
+	}
+
+	err := h.mgr.Cfg().Del(key, cas)
+	if err != nil {
+		cfgKVShowError(w, "del", key, err)
+		return
+	}
+
+	MustEncode(w, RESTCfgKV{
+		Status: "ok",
+		Key:    key,
+	})
+}
+
+// ---------------------------------------------------
+
+// CfgKVSubscribeHandler is a REST handler that long-polls for a
+// change to a Cfg key.  It responds as soon as the key's CAS differs
+// from the "cas" param, or with a false "changed" once the
+// "timeoutMS" param elapses.
+type CfgKVSubscribeHandler struct {
+	mgr     *cbgt.Manager
+	watcher *cfgKVWatcher
+}
+
+func NewCfgKVSubscribeHandler(mgr *cbgt.Manager) *CfgKVSubscribeHandler {
+	return &CfgKVSubscribeHandler{
+		mgr:     mgr,
+		watcher: newCfgKVWatcher(mgr.Cfg(), CfgKVSubscribeKeys),
+	}
+}
+
+func (h *CfgKVSubscribeHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	key, cas, ok := cfgKVParse(w, req)
+	if !ok {
+		return
+	}
+
+	timeout := CfgKVSubscribeTimeoutDefault
+	if v := req.FormValue("timeoutMS"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 0 {
+			ShowErrorBody(w, nil, fmt.Sprintf("rest_cfg_kv:"+
+				" invalid timeoutMS: %q", v), http.StatusBadRequest)
+			return
+		}
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+	if timeout > CfgKVSubscribeTimeoutMax {
+		timeout = CfgKVSubscribeTimeoutMax
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		// Watch before the Get, so that no change can be missed.
+		changedCh, err := h.watcher.changedCh(key)
+		if err != nil {
+			cfgKVShowError(w, "subscribe", key, err)
+			return
+		}
+
+		_, casCurr, err := h.mgr.Cfg().Get(key, 0)
+		if err != nil {
+			cfgKVShowError(w, "get", key, err)
+			return
+		}
+
+		if casCurr != cas {
+			MustEncode(w, RESTCfgKV{
+				Status:  "ok",
+				Key:     key,
+				CAS:     casCurr,
+				Changed: true,
+			})
+			return
+		}
+
+		select {
+		case <-changedCh:
+		case <-timer.C:
+			MustEncode(w, RESTCfgKV{
+				Status: "ok",
+				Key:    key,
+				CAS:    casCurr,
+			})
+			return
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// A cfgKVWatcher has a single Cfg subscription per watched key, whose
+// events are broadcast to any number of long polls by closing the
+// key's current changedCh.  Only a fixed set of keys is watched, so
+// that clients can't make the watcher subscribe without bound.
+type cfgKVWatcher struct {
+	cfg  cbgt.Cfg
+	keys map[string]bool // The keys that may be watched.
+
+	m          sync.Mutex
+	changedChs map[string]chan struct{} // Keyed by Cfg key.
+}
+
+func newCfgKVWatcher(cfg cbgt.Cfg, keys []string) *cfgKVWatcher {
+	return &cfgKVWatcher{
+		cfg:        cfg,
+		keys:       cbgt.StringsToMap(keys),
+		changedChs: map[string]chan struct{}{},
+	}
+}
+
+// changedCh returns a channel that's closed on the next change of a
+// key, or, for a key that's not watched, after the
+// CfgKVSubscribePollInterval.
+func (cw *cfgKVWatcher) changedCh(key string) (<-chan struct{}, error) {
+	if !cw.keys[key] {
+		ch := make(chan struct{})
+		time.AfterFunc(CfgKVSubscribePollInterval, func() { close(ch) })
+		return ch, nil
+	}
+
+	cw.m.Lock()
+	defer cw.m.Unlock()
+
+	ch, exists := cw.changedChs[key]
+	if exists {
+		return ch, nil
+	}
+
+	ec := make(chan cbgt.CfgEvent)
+
+	err := cw.cfg.Subscribe(key, ec)
+	if err != nil {
+		return nil, err
+	}
+
+	if key == cbgt.PLAN_PINDEXES_KEY {
+		// Some Cfg providers store plans separately.
+		err = cw.cfg.Subscribe(cbgt.PLAN_PINDEXES_DIRECTORY_STAMP, ec)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ch = make(chan struct{})
+	cw.changedChs[key] = ch
+
+	go func() {
+		for range ec {
+			cw.m.Lock()
+			close(cw.changedChs[key])
+			cw.changedChs[key] = make(chan struct{})
+			cw.m.Unlock()
+		}
+	}()
+
+	return ch, nil
+}
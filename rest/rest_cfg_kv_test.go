@@ -0,0 +1,301 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbase/cbgt"
+)
+
+func TestCfgREST(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := cbgt.NewCfgMem()
+	mgr := cbgt.NewManager(cbgt.VERSION, cfg, cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil)
+
+	router, _, err := NewRESTRouter("v0", mgr, "static", "", nil,
+		AssetDir, Asset)
+	if err != nil {
+		t.Fatalf("expected NewRESTRouter to work, err: %v", err)
+	}
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	_, err = cbgt.NewCfgREST("not-a-url", nil)
+	if err == nil {
+		t.Errorf("expected err on a bad url")
+	}
+
+	c, err := cbgt.NewCfgREST(server.URL, map[string]string{
+		"cfgRESTPollTimeoutMS": "100",
+	})
+	if err != nil {
+		t.Fatalf("expected NewCfgREST to work, err: %v", err)
+	}
+	defer c.Close()
+
+	v, cas, err := c.Get("a", 0)
+	if err != nil || v != nil || cas != 0 {
+		t.Errorf("expected a missing key, v: %s, cas: %d, err: %v", v, cas, err)
+	}
+
+	cas, err = c.Set("a", []byte("A"), 0)
+	if err != nil || cas == 0 {
+		t.Fatalf("expected Set to work, err: %v", err)
+	}
+
+	_, err = c.Set("a", []byte("B"), cas+100)
+	if _, ok := err.(*cbgt.CfgCASError); !ok {
+		t.Errorf("expected a CAS mismatch, err: %v", err)
+	}
+
+	_, _, err = c.Get("a", cas+100)
+	if _, ok := err.(*cbgt.CfgCASError); !ok {
+		t.Errorf("expected a Get CAS mismatch, err: %v", err)
+	}
+
+	v, cas2, err := cfg.Get("a", 0)
+	if err != nil || string(v) != "A" || cas2 != cas {
+		t.Errorf("expected Set to reach the node's cfg, v: %s", v)
+	}
+
+	ch := make(chan cbgt.CfgEvent, 10)
+	err = c.Subscribe("a", ch)
+	if err != nil {
+		t.Fatalf("expected Subscribe to work, err: %v", err)
+	}
+
+	// Outlast a few long polls.
+	time.Sleep(250 * time.Millisecond)
+
+	cas, _ = cfg.Set("a", []byte("B"), cas)
+
+	select {
+	case ev := <-ch:
+		if ev.Key != "a" || ev.CAS != cas {
+			t.Errorf("unexpected event: %#v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected an event")
+	}
+
+	err = c.Refresh()
+	if err != nil {
+		t.Errorf("expected Refresh to work, err: %v", err)
+	}
+	select {
+	case ev := <-ch:
+		if ev.CAS != cas {
+			t.Errorf("unexpected refresh event: %#v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected a refresh event")
+	}
+
+	err = c.Del("a", cas+100)
+	if _, ok := err.(*cbgt.CfgCASError); !ok {
+		t.Errorf("expected a Del CAS mismatch, err: %v", err)
+	}
+	err = c.Del("a", cas)
+	if err != nil {
+		t.Errorf("expected Del to work, err: %v", err)
+	}
+
+	select {
+	case ev := <-ch:
+		if ev.CAS != 0 {
+			t.Errorf("unexpected del event: %#v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected a del event")
+	}
+
+	for _, path := range []string{
+		"/api/cfg/kv",
+		"/api/cfg/kv?key=a&cas=x",
+		"/api/cfg/kv/subscribe?key=a&timeoutMS=x",
+	} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil || resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected a bad request, path: %s", path)
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+	}
+}
+
+func TestCfgKVSourceParams(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	keyFile := emptyDir + string(os.PathSeparator) + "test.keys"
+	cbgt.CreateSecretKeyfile(keyFile)
+
+	cfg := cbgt.NewCfgMem()
+	mgr := cbgt.NewManagerEx(cbgt.VERSION, cfg, cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", nil,
+		map[string]string{
+			"secretKeyFile": keyFile,
+		})
+
+	err := mgr.Start("wanted")
+	if err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+
+	router, _, err := NewRESTRouter("v0", mgr, "static", "", nil,
+		AssetDir, Asset)
+	if err != nil {
+		t.Fatalf("expected NewRESTRouter to work, err: %v", err)
+	}
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	c, err := cbgt.NewCfgREST(server.URL, nil)
+	if err != nil {
+		t.Fatalf("expected NewCfgREST to work, err: %v", err)
+	}
+	defer c.Close()
+
+	err = mgr.CreateIndex("nil", "", "",
+		`{"authUser":"u","authPassword":"secretpw"}`,
+		"blackhole", "idx0", "", cbgt.PlanParams{}, "")
+	if err != nil {
+		t.Fatalf("expected CreateIndex to work, err: %v", err)
+	}
+
+	sourceParams := func(name string) string {
+		indexDefs, _, err := cbgt.CfgGetIndexDefs(cfg)
+		if err != nil || indexDefs.IndexDefs[name] == nil {
+			t.Fatalf("expected indexDef: %s, err: %v", name, err)
+		}
+		sp := indexDefs.IndexDefs[name].SourceParams
+		if !strings.Contains(sp, cbgt.SECRET_PREFIX) {
+			t.Errorf("expected encrypted sourceParams, got: %s", sp)
+		}
+		sp, err = cbgt.DecryptSourceParams(sp, mgr.GetOptions())
+		if err != nil {
+			t.Errorf("expected DecryptSourceParams to work, err: %v", err)
+		}
+		return sp
+	}
+
+	v, cas, err := c.Get(cbgt.INDEX_DEFS_KEY, 0)
+	if err != nil || strings.Contains(string(v), "secretpw") ||
+		strings.Contains(string(v), cbgt.SECRET_PREFIX) ||
+		!strings.Contains(string(v), "redacted") {
+		t.Fatalf("expected redacted indexDefs, v: %s, err: %v", v, err)
+	}
+
+	// A redacted value that's written back keeps its credentials, and
+	// a new plaintext password is encrypted.
+	var indexDefs cbgt.IndexDefs
+	json.Unmarshal(v, &indexDefs)
+	indexDef1 := *indexDefs.IndexDefs["idx0"]
+	indexDef1.Name = "idx1"
+	indexDef1.SourceParams = `{"authUser":"u","authPassword":"newpw"}`
+	indexDefs.IndexDefs["idx1"] = &indexDef1
+
+	v, _ = json.Marshal(&indexDefs)
+	_, err = c.Set(cbgt.INDEX_DEFS_KEY, v, cas)
+	if err != nil {
+		t.Fatalf("expected Set to work, err: %v", err)
+	}
+
+	if sp := sourceParams("idx0"); !strings.Contains(sp, "secretpw") {
+		t.Errorf("expected the credentials to be kept, got: %s", sp)
+	}
+	if sp := sourceParams("idx1"); !strings.Contains(sp, "newpw") {
+		t.Errorf("expected the new credentials, got: %s", sp)
+	}
+
+	// A planner that's a Cfg client writes new planPIndexes with the
+	// redacted sourceParams of their indexDefs.
+	v, _, err = c.Get(cbgt.INDEX_DEFS_KEY, 0)
+	if err != nil {
+		t.Fatalf("expected Get to work, err: %v", err)
+	}
+	json.Unmarshal(v, &indexDefs)
+	indexDef0 := indexDefs.IndexDefs["idx0"]
+
+	planPIndexes := cbgt.NewPlanPIndexes(cbgt.VERSION)
+	planPIndexes.PlanPIndexes["idx0_p0"] = &cbgt.PlanPIndex{
+		Name:         "idx0_p0",
+		IndexName:    "idx0",
+		IndexUUID:    indexDef0.UUID,
+		SourceParams: indexDef0.SourceParams,
+	}
+	v, _ = json.Marshal(planPIndexes)
+	_, err = c.Set(cbgt.PLAN_PINDEXES_KEY, v, 0)
+	if err != nil {
+		t.Fatalf("expected Set of a new plan to work, err: %v", err)
+	}
+
+	planPIndexes, _, err = cbgt.CfgGetPlanPIndexes(cfg)
+	if err != nil || planPIndexes.PlanPIndexes["idx0_p0"] == nil {
+		t.Fatalf("expected the plan, err: %v", err)
+	}
+	sp, err := cbgt.DecryptSourceParams(
+		planPIndexes.PlanPIndexes["idx0_p0"].SourceParams, mgr.GetOptions())
+	if err != nil || !strings.Contains(sp, "secretpw") {
+		t.Errorf("expected the plan's credentials, sp: %s, err: %v", sp, err)
+	}
+}
+
+func TestCfgKVWatcher(t *testing.T) {
+	cw := newCfgKVWatcher(cbgt.NewCfgMem(), []string{"a"})
+
+	ch, err := cw.changedCh("a")
+	if err != nil || ch == nil || len(cw.changedChs) != 1 {
+		t.Fatalf("expected a watched key, err: %v", err)
+	}
+	cw.cfg.Set("a", []byte("A"), 0)
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected a change of a watched key")
+	}
+
+	prev := CfgKVSubscribePollInterval
+	CfgKVSubscribePollInterval = 10 * time.Millisecond
+	defer func() { CfgKVSubscribePollInterval = prev }()
+
+	for i := 0; i < 10; i++ {
+		ch, err = cw.changedCh(fmt.Sprintf("b%d", i))
+		if err != nil {
+			t.Fatalf("expected an unwatched key to work, err: %v", err)
+		}
+	}
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected an unwatched key to be polled")
+	}
+	if len(cw.changedChs) != 1 {
+		t.Errorf("expected no subscriptions of unwatched keys, got: %d",
+			len(cw.changedChs))
+	}
+}
@@ -121,6 +121,13 @@ func (h *DiagGetHandler) ServeHTTP(
 			strings.HasSuffix(f.Name(), ".json") { // Matches index_meta.json.
 			b, err2 := ioutil.ReadFile(path)
 			if err2 == nil {
+				// Redact the sourceParams of pindex metadata.
+				var contents map[string]interface{}
+				if json.Unmarshal(b, &contents) == nil &&
+					contents["sourceParams"] != nil {
+					RedactSourceParamsField(contents)
+					b, _ = json.Marshal(contents)
+				}
 				m["Contents"] = string(b)
 			}
 		}
@@ -0,0 +1,297 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/couchbase/cbgt"
+)
+
+// HTTPFeedForwardClient is used to forward docs to the nodes that own
+// their source partitions.
+var HTTPFeedForwardClient = &http.Client{Timeout: 30 * time.Second}
+
+// HTTPFeedDocHandler is a REST handler that upserts or deletes a
+// single document of an index with the "http" sourceType.
+type HTTPFeedDocHandler struct {
+	mgr *cbgt.Manager
+	op  string // See cbgt.HTTP_FEED_OP_XXX.
+}
+
+func NewHTTPFeedDocHandler(mgr *cbgt.Manager, op string) *HTTPFeedDocHandler {
+	return &HTTPFeedDocHandler{mgr: mgr, op: op}
+}
+
+func (h *HTTPFeedDocHandler) RESTOpts(opts map[string]string) {
+	opts["param: indexName"] =
+		"required, string, URL path parameter\n\n" +
+			"The name of an index whose sourceType is \"http\"."
+	opts["param: docID"] =
+		"required, string, URL path parameter\n\n" +
+			"The key of the document."
+}
+
+func (h *HTTPFeedDocHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	docID := DocIDLookup(req)
+	if docID == "" {
+		ShowError(w, req, "rest_feed_http: docID is required",
+			http.StatusBadRequest)
+		return
+	}
+
+	doc := &cbgt.HTTPFeedDoc{Op: h.op, Key: docID}
+
+	if h.op == cbgt.HTTP_FEED_OP_UPSERT {
+		value, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			ShowError(w, req, fmt.Sprintf("rest_feed_http:"+
+				" could not read request body, err: %v", err),
+				http.StatusBadRequest)
+			return
+		}
+		doc.Value = value
+	}
+
+	httpFeedIngest(w, req, h.mgr, []*cbgt.HTTPFeedDoc{doc})
+}
+
+// ---------------------------------------------------
+
+// HTTPFeedDocsHandler is a REST handler that upserts or deletes a
+// JSON array of documents of an index with the "http" sourceType.
+type HTTPFeedDocsHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewHTTPFeedDocsHandler(mgr *cbgt.Manager) *HTTPFeedDocsHandler {
+	return &HTTPFeedDocsHandler{mgr: mgr}
+}
+
+func (h *HTTPFeedDocsHandler) RESTOpts(opts map[string]string) {
+	opts["param: indexName"] =
+		"required, string, URL path parameter\n\n" +
+			"The name of an index whose sourceType is \"http\"."
+}
+
+func (h *HTTPFeedDocsHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_feed_http:"+
+			" could not read request body, err: %v", err),
+			http.StatusBadRequest)
+		return
+	}
+
+	var docs []*cbgt.HTTPFeedDoc
+
+	err = json.Unmarshal(requestBody, &docs)
+	if err != nil {
+		ShowErrorBody(w, requestBody, fmt.Sprintf("rest_feed_http:"+
+			" could not parse docs, err: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	for i, doc := range docs {
+		if doc == nil || doc.Key == "" ||
+			(doc.Op != cbgt.HTTP_FEED_OP_UPSERT &&
+				doc.Op != cbgt.HTTP_FEED_OP_DELETE) {
+			ShowErrorBody(w, requestBody, fmt.Sprintf("rest_feed_http:"+
+				" invalid doc, index: %d, a doc needs a key and an op"+
+				" of %q or %q", i, cbgt.HTTP_FEED_OP_UPSERT,
+				cbgt.HTTP_FEED_OP_DELETE), http.StatusBadRequest)
+			return
+		}
+	}
+
+	httpFeedIngest(w, req, h.mgr, docs)
+}
+
+// ---------------------------------------------------
+
+// httpFeedIngest applies the docs of the source partitions whose
+// primary is the local node, which replicates them to the other plan
+// nodes of the partitions, and forwards the other docs to their
+// primaries, and responds with the consistency params that a client
+// can pass to later queries.
+func httpFeedIngest(w http.ResponseWriter, req *http.Request,
+	mgr *cbgt.Manager, docs []*cbgt.HTTPFeedDoc) {
+	indexName := IndexNameLookup(req)
+	if indexName == "" {
+		ShowError(w, req, "rest_feed_http: index name is required",
+			http.StatusBadRequest)
+		return
+	}
+
+	indexDef, _, err := mgr.GetIndexDef(indexName, false)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_feed_http: %v", err),
+			http.StatusNotFound)
+		return
+	}
+
+	if indexDef.SourceType != cbgt.SOURCE_HTTP {
+		ShowError(w, req, fmt.Sprintf("rest_feed_http: index: %s,"+
+			" does not have sourceType: %s", indexName, cbgt.SOURCE_HTTP),
+			http.StatusBadRequest)
+		return
+	}
+
+	if req.FormValue("replica") == "true" {
+		cv, err := cbgt.HTTPFeedApplyReplica(mgr, indexDef, docs)
+		if err != nil {
+			ShowError(w, req, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		httpFeedRespond(w, indexName, cv)
+		return
+	}
+
+	docsByNode, nodeDefs, err := cbgt.HTTPFeedRouteDocs(mgr, indexDef, docs)
+	if err != nil {
+		ShowError(w, req, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	// Forwarded docs are applied only locally, so that nodes with
+	// differing views of the plan don't forward docs back and forth.
+	forwarded := req.FormValue("forwarded") == "true"
+
+	// The replicas receive the docs from the primary, along with the
+	// assigned seqs, while the primary's feed is locked, so that they
+	// receive the docs in seq order.
+	replicate := func(seqDocs []*cbgt.HTTPFeedDoc) error {
+		docsByReplica, replicaNodeDefs, err :=
+			cbgt.HTTPFeedRouteReplicas(mgr, indexDef, seqDocs)
+		if err != nil {
+			return err
+		}
+
+		for nodeUUID, replicaDocs := range docsByReplica {
+			_, err = httpFeedForward(req, replicaNodeDefs[nodeUUID],
+				indexName, "replica=true", replicaDocs)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	vector := cbgt.ConsistencyVector{}
+
+	for nodeUUID, nodeDocs := range docsByNode {
+		var cv cbgt.ConsistencyVector
+
+		if nodeUUID == mgr.UUID() {
+			cv, err = cbgt.HTTPFeedApply(mgr, indexDef, nodeDocs, replicate)
+			if err != nil {
+				ShowError(w, req, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		} else {
+			if forwarded {
+				ShowError(w, req, fmt.Sprintf("rest_feed_http:"+
+					" not the owner of forwarded docs, index: %s, owner: %s",
+					indexName, nodeUUID), http.StatusServiceUnavailable)
+				return
+			}
+
+			cv, err = httpFeedForward(req, nodeDefs[nodeUUID], indexName,
+				"forwarded=true", nodeDocs)
+			if err != nil {
+				ShowError(w, req, err.Error(), http.StatusBadGateway)
+				return
+			}
+		}
+
+		for partition, seq := range cv {
+			vector[partition] = seq
+		}
+	}
+
+	httpFeedRespond(w, indexName, vector)
+}
+
+func httpFeedRespond(w http.ResponseWriter, indexName string,
+	vector cbgt.ConsistencyVector) {
+	MustEncode(w, struct {
+		Status      string                 `json:"status"`
+		Consistency cbgt.ConsistencyParams `json:"consistency"`
+	}{
+		Status: "ok",
+		Consistency: cbgt.ConsistencyParams{
+			Level: "at_plus",
+			Vectors: map[string]cbgt.ConsistencyVector{
+				indexName: vector,
+			},
+		},
+	})
+}
+
+// httpFeedForward sends docs to another node, which is either the
+// primary of their source partitions or a replica, as given by the
+// query, passing along the request's credentials.
+func httpFeedForward(req *http.Request, nodeDef *cbgt.NodeDef,
+	indexName, query string, docs []*cbgt.HTTPFeedDoc) (
+	cbgt.ConsistencyVector, error) {
+	buf, err := json.Marshal(docs)
+	if err != nil {
+		return nil, err
+	}
+
+	u := "http://" + nodeDef.HostPort + "/api/index/" +
+		url.PathEscape(indexName) + "/docs?" + query
+
+	fwdReq, err := http.NewRequest("POST", u, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	fwdReq.Header.Set("Content-Type", "application/json")
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		fwdReq.Header.Set("Authorization", auth)
+	}
+
+	resp, err := HTTPFeedForwardClient.Do(fwdReq)
+	if err != nil {
+		return nil, fmt.Errorf("rest_feed_http: could not forward,"+
+			" node: %s, err: %v", nodeDef.UUID, err)
+	}
+	defer resp.Body.Close()
+
+	respBuf, err := ioutil.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rest_feed_http: forward failed,"+
+			" node: %s, status: %d, resp: %s, err: %v",
+			nodeDef.UUID, resp.StatusCode, respBuf, err)
+	}
+
+	var rv struct {
+		Consistency cbgt.ConsistencyParams `json:"consistency"`
+	}
+	err = json.Unmarshal(respBuf, &rv)
+	if err != nil {
+		return nil, fmt.Errorf("rest_feed_http: could not parse"+
+			" forward response, node: %s, err: %v", nodeDef.UUID, err)
+	}
+
+	return rv.Consistency.Vectors[indexName], nil
+}
@@ -0,0 +1,214 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/couchbase/cbgt"
+)
+
+// startHTTPFeedTestNode starts a manager whose bindHttp is the
+// address of its REST server.
+func startHTTPFeedTestNode(t *testing.T, cfg cbgt.Cfg) (
+	*cbgt.Manager, *httptest.Server) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected listen to work, err: %v", err)
+	}
+
+	mgr := cbgt.NewManager(cbgt.VERSION, cfg, cbgt.NewUUID(),
+		nil, "", 1, "", ln.Addr().String(), emptyDir, "some-datasource", nil)
+
+	router, _, err := NewRESTRouter("v0", mgr, "static", "", nil,
+		AssetDir, Asset)
+	if err != nil {
+		t.Fatalf("expected NewRESTRouter to work, err: %v", err)
+	}
+
+	server := &httptest.Server{
+		Listener: ln,
+		Config:   &http.Server{Handler: router},
+	}
+	server.Start()
+
+	err = mgr.Start("wanted")
+	if err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+
+	return mgr, server
+}
+
+func httpFeedTestStats(t *testing.T, mgr *cbgt.Manager) map[string]uint64 {
+	feeds, _ := mgr.CurrentMaps()
+	for _, feed := range feeds {
+		if _, ok := feed.(*cbgt.HTTPFeed); ok {
+			var buf bytes.Buffer
+			feed.Stats(&buf)
+
+			var rv map[string]uint64
+			err := json.Unmarshal(buf.Bytes(), &rv)
+			if err != nil {
+				t.Fatalf("expected stats JSON, buf: %s, err: %v", buf.Bytes(), err)
+			}
+			return rv
+		}
+	}
+	return nil
+}
+
+func TestHTTPFeedIngest(t *testing.T) {
+	cfg := cbgt.NewCfgMem()
+
+	mgr0, server0 := startHTTPFeedTestNode(t, cfg)
+	defer server0.Close()
+	defer os.RemoveAll(mgr0.DataDir())
+
+	mgr1, server1 := startHTTPFeedTestNode(t, cfg)
+	defer server1.Close()
+	defer os.RemoveAll(mgr1.DataDir())
+
+	err := mgr0.CreateIndex(cbgt.SOURCE_HTTP, "src", "", `{"numPartitions":8}`,
+		"blackhole", "idx", "", cbgt.PlanParams{MaxPartitionsPerPIndex: 1}, "")
+	if err != nil {
+		t.Fatalf("expected CreateIndex to work, err: %v", err)
+	}
+	err = mgr0.CreateIndex("primary", "src", "", "",
+		"blackhole", "notHTTP", "", cbgt.PlanParams{}, "")
+	if err != nil {
+		t.Fatalf("expected CreateIndex to work, err: %v", err)
+	}
+
+	for _, mgr := range []*cbgt.Manager{mgr0, mgr1} {
+		mgr.PlannerKick("test")
+	}
+	for _, mgr := range []*cbgt.Manager{mgr0, mgr1} {
+		mgr.GetPlanPIndexes(true)
+		mgr.JanitorKick("test")
+	}
+
+	do := func(method, path, body string) (int, []byte) {
+		req, _ := http.NewRequest(method, server0.URL+path,
+			strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("expected request to work, err: %v", err)
+		}
+		defer resp.Body.Close()
+		buf, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, buf
+	}
+
+	var docs []*cbgt.HTTPFeedDoc
+	for i := 0; i < 40; i++ {
+		docs = append(docs, &cbgt.HTTPFeedDoc{Op: cbgt.HTTP_FEED_OP_UPSERT,
+			Key: fmt.Sprintf("k%d", i), Value: []byte(`{"i":1}`)})
+	}
+	docs = append(docs, &cbgt.HTTPFeedDoc{Op: cbgt.HTTP_FEED_OP_DELETE,
+		Key: "k0"})
+	body, _ := json.Marshal(docs)
+
+	code, buf := do("POST", "/api/index/idx/docs", string(body))
+	if code != http.StatusOK {
+		t.Fatalf("expected bulk ingest to work, code: %d, buf: %s", code, buf)
+	}
+
+	var rv struct {
+		Status      string                 `json:"status"`
+		Consistency cbgt.ConsistencyParams `json:"consistency"`
+	}
+	json.Unmarshal(buf, &rv)
+
+	vector := rv.Consistency.Vectors["idx"]
+	if rv.Consistency.Level != "at_plus" || len(vector) != 8 {
+		t.Errorf("expected a seq per partition, buf: %s", buf)
+	}
+	total := uint64(0)
+	for _, seq := range vector {
+		total += seq
+	}
+	if total != 41 {
+		t.Errorf("expected seqs to add up to the docs, vector: %v", vector)
+	}
+
+	stats0 := httpFeedTestStats(t, mgr0)
+	stats1 := httpFeedTestStats(t, mgr1)
+	if stats0 == nil || stats1 == nil ||
+		stats0["TotDataUpdate"] == 0 || stats1["TotDataUpdate"] == 0 ||
+		stats0["TotDataUpdate"]+stats1["TotDataUpdate"] != 40 ||
+		stats0["TotDataDelete"]+stats1["TotDataDelete"] != 1 {
+		t.Errorf("expected docs on both nodes, stats0: %v, stats1: %v",
+			stats0, stats1)
+	}
+
+	partition := cbgt.HTTPFeedPartition([]byte("k1"), 8)
+
+	code, buf = do("PUT", "/api/index/idx/doc/k1", `{"i":2}`)
+	json.Unmarshal(buf, &rv)
+	if code != http.StatusOK ||
+		rv.Consistency.Vectors["idx"][partition] != vector[partition]+1 {
+		t.Errorf("expected an upsert, code: %d, buf: %s", code, buf)
+	}
+
+	code, buf = do("DELETE", "/api/index/idx/doc/k1", "")
+	json.Unmarshal(buf, &rv)
+	if code != http.StatusOK ||
+		rv.Consistency.Vectors["idx"][partition] != vector[partition]+2 {
+		t.Errorf("expected a delete, code: %d, buf: %s", code, buf)
+	}
+
+	code, _ = do("POST", "/api/index/idx/docs", `[{"op":"bad","key":"k"}]`)
+	if code != http.StatusBadRequest {
+		t.Errorf("expected a bad op to fail, code: %d", code)
+	}
+
+	code, _ = do("POST", "/api/index/idx/docs", `not json`)
+	if code != http.StatusBadRequest {
+		t.Errorf("expected bad json to fail, code: %d", code)
+	}
+
+	code, _ = do("PUT", "/api/index/notHTTP/doc/k1", `{}`)
+	if code != http.StatusBadRequest {
+		t.Errorf("expected a non-http index to fail, code: %d", code)
+	}
+
+	code, _ = do("PUT", "/api/index/missing/doc/k1", `{}`)
+	if code != http.StatusNotFound {
+		t.Errorf("expected a missing index to fail, code: %d", code)
+	}
+
+	// Forwarded docs that the node doesn't own are rejected.
+	indexDef, _, _ := mgr0.GetIndexDef("idx", false)
+	docsByNode, _, _ := cbgt.HTTPFeedRouteDocs(mgr0, indexDef, docs)
+	if len(docsByNode[mgr1.UUID()]) <= 0 {
+		t.Fatalf("expected docs owned by the other node")
+	}
+	remoteKey := docsByNode[mgr1.UUID()][0].Key
+
+	code, _ = do("PUT", "/api/index/idx/doc/"+remoteKey+"?forwarded=true", `{}`)
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("expected a forwarded doc of another node to fail,"+
+			" code: %d", code)
+	}
+}
@@ -17,6 +17,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -54,7 +55,7 @@ func (h *ListIndexHandler) ServeHTTP(
 		IndexDefs *cbgt.IndexDefs `json:"indexDefs"`
 	}{
 		Status:    "ok",
-		IndexDefs: indexDefs,
+		IndexDefs: cbgt.RedactIndexDefs(indexDefs),
 	}
 	MustEncode(w, rv)
 }
@@ -114,7 +115,10 @@ func (h *GetIndexHandler) ServeHTTP(
 
 	planPIndexesForIndex := []*cbgt.PlanPIndex(nil)
 	if planPIndexesByName != nil {
-		planPIndexesForIndex = planPIndexesByName[indexName]
+		for _, planPIndex := range planPIndexesByName[indexName] {
+			planPIndexesForIndex = append(planPIndexesForIndex,
+				cbgt.RedactPlanPIndex(planPIndex))
+		}
 	}
 
 	planPIndexesWarnings := []string(nil)
@@ -129,7 +133,7 @@ func (h *GetIndexHandler) ServeHTTP(
 		Warnings     []string           `json:"warnings"`
 	}{
 		Status:       "ok",
-		IndexDef:     indexDef,
+		IndexDef:     cbgt.RedactIndexDef(indexDef),
 		PlanPIndexes: planPIndexesForIndex,
 		Warnings:     planPIndexesWarnings,
 	})
@@ -408,6 +412,82 @@ func (h *IndexControlHandler) ServeHTTP(
 	MustEncode(w, rv)
 }
 
+// ---------------------------------------------------
+
+// FeedPartitionControlHandler is a REST handler for pausing, resuming
+// or seeking the ingest of a source partition of an index on this
+// node, without restarting its feed.  A feed that doesn't support
+// partition control, which is any feed other than a GocbDCPFeed,
+// results in a 501 (Not Implemented).
+type FeedPartitionControlHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewFeedPartitionControlHandler(
+	mgr *cbgt.Manager) *FeedPartitionControlHandler {
+	return &FeedPartitionControlHandler{mgr: mgr}
+}
+
+func (h *FeedPartitionControlHandler) RESTOpts(opts map[string]string) {
+	opts["param: indexName"] =
+		"required, string, URL path parameter\n\n" +
+			"The name of the index whose source partition will be controlled."
+	opts["param: partition"] =
+		"required, string, form parameter\n\n" +
+			"The source partition, such as a vbucket id."
+	opts["param: seq"] =
+		"optional, integer, form parameter\n\n" +
+			`The seq to seek back to, required for the "seek" op.`
+}
+
+func (h *FeedPartitionControlHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := IndexNameLookup(req)
+	if indexName == "" {
+		ShowError(w, req, "index name is required", http.StatusBadRequest)
+		return
+	}
+
+	partition := req.FormValue("partition")
+	if partition == "" {
+		ShowError(w, req, "rest_index: FeedPartitionControl,"+
+			" partition is required", http.StatusBadRequest)
+		return
+	}
+
+	op := RequestVariableLookup(req, "op")
+
+	var seq uint64
+	if op == cbgt.FEED_PARTITION_OP_SEEK {
+		var err error
+		seq, err = strconv.ParseUint(req.FormValue("seq"), 10, 64)
+		if err != nil {
+			ShowError(w, req, fmt.Sprintf("rest_index: FeedPartitionControl,"+
+				" could not parse seq, err: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	err := h.mgr.FeedPartitionControl(indexName, partition, op, seq)
+	if err == cbgt.ErrFeedPartitionControlUnsupported {
+		ShowError(w, req, fmt.Sprintf("rest_index: FeedPartitionControl,"+
+			" op: %s, err: %v", op, err), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_index: FeedPartitionControl,"+
+			" could not op: %s, err: %v", op, err), http.StatusBadRequest)
+		return
+	}
+
+	rv := struct {
+		Status string `json:"status"`
+	}{
+		Status: "ok",
+	}
+	MustEncode(w, rv)
+}
+
 // ------------------------------------------------------------------
 
 // ListPIndexHandler is a REST handler for listing pindexes.
@@ -421,7 +501,12 @@ func NewListPIndexHandler(mgr *cbgt.Manager) *ListPIndexHandler {
 
 func (h *ListPIndexHandler) ServeHTTP(
 	w http.ResponseWriter, req *http.Request) {
-	_, pindexes := h.mgr.CurrentMaps()
+	_, pindexesCurr := h.mgr.CurrentMaps()
+
+	pindexes := make(map[string]*cbgt.PIndex, len(pindexesCurr))
+	for name, pindex := range pindexesCurr {
+		pindexes[name] = cbgt.RedactPIndex(pindex)
+	}
 
 	rv := struct {
 		Status   string                  `json:"status"`
@@ -465,7 +550,7 @@ func (h *GetPIndexHandler) ServeHTTP(
 		PIndex *cbgt.PIndex `json:"pindex"`
 	}{
 		Status: "ok",
-		PIndex: pindex,
+		PIndex: cbgt.RedactPIndex(pindex),
 	})
 }
 
@@ -606,6 +691,177 @@ func (h *QueryPIndexHandler) ServeHTTP(
 	}
 }
 
+// ---------------------------------------------------
+
+// ListDeadLetterHandler is a REST handler for listing the
+// dead-lettered mutations of a pindex, without their vals and extras.
+type ListDeadLetterHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewListDeadLetterHandler(mgr *cbgt.Manager) *ListDeadLetterHandler {
+	return &ListDeadLetterHandler{mgr: mgr}
+}
+
+func (h *ListDeadLetterHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	pindexName := PIndexNameLookup(req)
+	if pindexName == "" {
+		ShowError(w, req, "rest_index: pindex name is required", http.StatusBadRequest)
+		return
+	}
+
+	store, err := h.mgr.PIndexDeadLetters(pindexName)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_index: ListDeadLetter,"+
+			" err: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	deadLetters, err := store.List()
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_index: ListDeadLetter,"+
+			" pindexName: %s, err: %v", pindexName, err),
+			http.StatusInternalServerError)
+		return
+	}
+
+	for _, dl := range deadLetters {
+		dl.Val, dl.Extras = nil, nil
+	}
+
+	rv := struct {
+		Status      string             `json:"status"`
+		DeadLetters []*cbgt.DeadLetter `json:"deadLetters"`
+	}{
+		Status:      "ok",
+		DeadLetters: deadLetters,
+	}
+	MustEncode(w, rv)
+}
+
+// ---------------------------------------------------
+
+// GetDeadLetterHandler is a REST handler for inspecting a
+// dead-lettered mutation of a pindex.
+type GetDeadLetterHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewGetDeadLetterHandler(mgr *cbgt.Manager) *GetDeadLetterHandler {
+	return &GetDeadLetterHandler{mgr: mgr}
+}
+
+func (h *GetDeadLetterHandler) RESTOpts(opts map[string]string) {
+	opts["param: id"] =
+		"required, integer, URL path parameter\n\n" +
+			"The id of the dead-lettered mutation."
+}
+
+func (h *GetDeadLetterHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	pindexName := PIndexNameLookup(req)
+	if pindexName == "" {
+		ShowError(w, req, "rest_index: pindex name is required", http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.ParseUint(RequestVariableLookup(req, "id"), 10, 64)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_index: GetDeadLetter,"+
+			" could not parse id, err: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	store, err := h.mgr.PIndexDeadLetters(pindexName)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_index: GetDeadLetter,"+
+			" err: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	deadLetter, err := store.Get(id)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_index: GetDeadLetter,"+
+			" pindexName: %s, err: %v", pindexName, err),
+			http.StatusInternalServerError)
+		return
+	}
+	if deadLetter == nil {
+		ShowError(w, req, fmt.Sprintf("rest_index: GetDeadLetter,"+
+			" no dead letter, pindexName: %s, id: %d", pindexName, id),
+			http.StatusNotFound)
+		return
+	}
+
+	MustEncode(w, struct {
+		Status     string           `json:"status"`
+		DeadLetter *cbgt.DeadLetter `json:"deadLetter"`
+	}{
+		Status:     "ok",
+		DeadLetter: deadLetter,
+	})
+}
+
+// ---------------------------------------------------
+
+// DeadLetterControlHandler is a REST handler for replaying or purging
+// the dead-lettered mutations of a pindex.
+type DeadLetterControlHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewDeadLetterControlHandler(
+	mgr *cbgt.Manager) *DeadLetterControlHandler {
+	return &DeadLetterControlHandler{mgr: mgr}
+}
+
+func (h *DeadLetterControlHandler) RESTOpts(opts map[string]string) {
+	opts["param: id"] =
+		"optional, integer, form parameter\n\n" +
+			"The id of a dead-lettered mutation, where the default" +
+			" is every dead-lettered mutation of the pindex."
+}
+
+func (h *DeadLetterControlHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	pindexName := PIndexNameLookup(req)
+	if pindexName == "" {
+		ShowError(w, req, "rest_index: pindex name is required", http.StatusBadRequest)
+		return
+	}
+
+	var id uint64
+	if idStr := req.FormValue("id"); idStr != "" {
+		var err error
+		id, err = strconv.ParseUint(idStr, 10, 64)
+		if err != nil || id == 0 {
+			ShowError(w, req, fmt.Sprintf("rest_index: DeadLetterControl,"+
+				" could not parse id: %q", idStr), http.StatusBadRequest)
+			return
+		}
+	}
+
+	op := RequestVariableLookup(req, "op")
+
+	n, err := h.mgr.DeadLetterControl(pindexName, op, id)
+	if err != nil {
+		ShowError(w, req, fmt.Sprintf("rest_index: DeadLetterControl,"+
+			" could not op: %s, count: %d, err: %v", op, n, err),
+			http.StatusBadRequest)
+		return
+	}
+
+	rv := struct {
+		Status string `json:"status"`
+		Count  int    `json:"count"`
+	}{
+		Status: "ok",
+		Count:  n,
+	}
+	MustEncode(w, rv)
+}
+
 func showConsistencyError(err error, methodName, itemName string,
 	requestBody []byte, w http.ResponseWriter) bool {
 	if errCW, ok := err.(*cbgt.ErrorConsistencyWait); ok {
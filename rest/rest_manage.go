@@ -224,7 +224,6 @@ func NewCfgGetHandler(mgr *cbgt.Manager) *CfgGetHandler {
 
 func (h *CfgGetHandler) ServeHTTP(
 	w http.ResponseWriter, req *http.Request) {
-	// TODO: Might need to scrub auth passwords from this output.
 	cfg := h.mgr.Cfg()
 	indexDefs, indexDefsCAS, indexDefsErr :=
 		cbgt.CfgGetIndexDefs(cfg)
@@ -236,7 +235,7 @@ func (h *CfgGetHandler) ServeHTTP(
 		cbgt.CfgGetPlanPIndexes(cfg)
 	MustEncode(w, RESTCfg{
 		Status:            "ok",
-		IndexDefs:         indexDefs,
+		IndexDefs:         cbgt.RedactIndexDefs(indexDefs),
 		IndexDefsCAS:      indexDefsCAS,
 		IndexDefsErr:      indexDefsErr,
 		NodeDefsWanted:    nodeDefsWanted,
@@ -245,7 +244,7 @@ func (h *CfgGetHandler) ServeHTTP(
 		NodeDefsKnown:     nodeDefsKnown,
 		NodeDefsKnownCAS:  nodeDefsKnownCAS,
 		NodeDefsKnownErr:  nodeDefsKnownErr,
-		PlanPIndexes:      planPIndexes,
+		PlanPIndexes:      cbgt.RedactPlanPIndexes(planPIndexes),
 		PlanPIndexesCAS:   planPIndexesCAS,
 		PlanPIndexesErr:   planPIndexesErr,
 	})
@@ -76,9 +76,17 @@ func (h *SourcePartitionSeqsHandler) ServeHTTP(
 		return
 	}
 
+	sourceParams, err := cbgt.DecryptSourceParams(indexDef.SourceParams,
+		h.mgr.SecretOptions())
+	if err != nil {
+		ShowError(w, req, "could not decrypt source params",
+			http.StatusInternalServerError)
+		return
+	}
+
 	partitionSeqs, err := feedType.PartitionSeqs(
 		indexDef.SourceType, indexDef.SourceName, indexDef.SourceUUID,
-		indexDef.SourceParams, h.mgr.Server(), h.mgr.Options())
+		sourceParams, h.mgr.Server(), h.mgr.Options())
 	if err != nil {
 		ShowError(w, req, "could not retrieve partition seqs",
 			http.StatusInternalServerError)
@@ -147,9 +155,17 @@ func (h *SourceStatsHandler) ServeHTTP(
 		return
 	}
 
+	sourceParams, err := cbgt.DecryptSourceParams(indexDef.SourceParams,
+		h.mgr.SecretOptions())
+	if err != nil {
+		ShowError(w, req, "could not decrypt source params",
+			http.StatusInternalServerError)
+		return
+	}
+
 	stats, err := feedType.Stats(
 		indexDef.SourceType, indexDef.SourceName, indexDef.SourceUUID,
-		indexDef.SourceParams, h.mgr.Server(), h.mgr.Options(),
+		sourceParams, h.mgr.Server(), h.mgr.Options(),
 		req.FormValue("statsKind"))
 	if err != nil {
 		ShowError(w, req, "could not retrieve stats", http.StatusInternalServerError)
@@ -13,6 +13,7 @@ package rest
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -353,6 +354,17 @@ func TestHandlersForEmptyManager(t *testing.T) {
 			Status:       http.StatusBadRequest,
 			ResponseBody: []byte(`rest_manage: no request body found`),
 		},
+		{
+			Desc:   "cfg history when not enabled",
+			Path:   "/api/cfg/history",
+			Method: "GET",
+			Params: nil,
+			Body:   nil,
+			Status: http.StatusNotImplemented,
+			ResponseMatch: map[string]bool{
+				`cfg history is not enabled`: true,
+			},
+		},
 		{
 			Desc:   "manager kick on empty, unchanged manager",
 			Path:   "/api/managerKick",
@@ -619,6 +631,321 @@ func TestHandlersForEmptyManager(t *testing.T) {
 	testRESTHandlers(t, tests, router)
 }
 
+func TestHandlersForCfgHistory(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := cbgt.NewCfgHistory(cbgt.NewCfgMem(), "node0", 0)
+	meh := &TestMEH{}
+	mgr := cbgt.NewManager(cbgt.VERSION, cfg, cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", meh)
+	err := mgr.Start("wanted")
+	if err != nil {
+		t.Errorf("expected start ok")
+	}
+
+	mr, _ := cbgt.NewMsgRing(os.Stderr, 1000)
+
+	router, _, err := NewRESTRouter("v0", mgr, "static", "", mr,
+		AssetDir, Asset)
+	if err != nil || router == nil {
+		t.Errorf("no mux router")
+	}
+
+	restoreParams := url.Values{}
+
+	tests := []*RESTHandlerTest{
+		{
+			Desc:   "create an index",
+			Path:   "/api/index/idx0",
+			Method: "PUT",
+			Body:   []byte(`{"type":"blackhole","sourceType":"nil"}`),
+			Status: http.StatusOK,
+		},
+		{
+			Desc:   "delete the index",
+			Path:   "/api/index/idx0",
+			Method: "DELETE",
+			Status: http.StatusOK,
+		},
+		{
+			Desc:   "list the history",
+			Path:   "/api/cfg/history",
+			Method: "GET",
+			Status: http.StatusOK,
+			ResponseMatch: map[string]bool{
+				`"status":"ok"`:      true,
+				`"indexDefs":[{`:     true,
+				`"nodeUUID":"node0"`: true,
+			},
+		},
+		{
+			Desc:   "get a revision",
+			Path:   "/api/cfg/history/indexDefs/1",
+			Method: "GET",
+			Status: http.StatusOK,
+			ResponseMatch: map[string]bool{
+				`"rev":1`: true,
+				`idx0`:    true,
+			},
+		},
+		{
+			Desc:   "get a missing revision",
+			Path:   "/api/cfg/history/indexDefs/100",
+			Method: "GET",
+			Status: http.StatusNotFound,
+		},
+		{
+			Desc:   "diff against the current value",
+			Path:   "/api/cfg/history/indexDefs/diff",
+			Method: "GET",
+			Params: url.Values{"from": []string{"1"}},
+			Status: http.StatusOK,
+			ResponseMatch: map[string]bool{
+				`"path":"/indexDefs/idx0","op":"remove"`: true,
+			},
+		},
+		{
+			Desc:   "diff with a bad rev",
+			Path:   "/api/cfg/history/indexDefs/diff",
+			Method: "GET",
+			Params: url.Values{"from": []string{"x"}},
+			Status: http.StatusBadRequest,
+		},
+		{
+			Desc:   "restore an unsupported key",
+			Path:   "/api/cfg/history/version/1/restore",
+			Method: "POST",
+			Params: url.Values{"cas": []string{"0"}},
+			Status: http.StatusBadRequest,
+		},
+		{
+			Desc:   "restore with a wrong cas",
+			Path:   "/api/cfg/history/indexDefs/1/restore",
+			Method: "POST",
+			Params: url.Values{"cas": []string{"12345"}},
+			Status: http.StatusConflict,
+		},
+		{
+			Desc: "restore the deleted index",
+			Before: func() {
+				_, cas, _ := cbgt.CfgGetIndexDefs(cfg)
+				restoreParams.Set("cas", fmt.Sprintf("%d", cas))
+			},
+			Path:   "/api/cfg/history/indexDefs/1/restore",
+			Method: "POST",
+			Params: restoreParams,
+			Status: http.StatusOK,
+			ResponseMatch: map[string]bool{
+				`"status":"ok"`: true,
+			},
+			After: func() {
+				indexDefs, _, _ := cbgt.CfgGetIndexDefs(cfg)
+				if indexDefs == nil || indexDefs.IndexDefs["idx0"] == nil {
+					t.Errorf("expected idx0 to be restored")
+				}
+			},
+		},
+	}
+
+	testRESTHandlers(t, tests, router)
+}
+
+func TestHandlersForCfgCheck(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := cbgt.NewCfgMem()
+	meh := &TestMEH{}
+	mgr := cbgt.NewManager(cbgt.VERSION, cfg, cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", meh)
+	err := mgr.Start("wanted")
+	if err != nil {
+		t.Errorf("expected start ok")
+	}
+
+	mr, _ := cbgt.NewMsgRing(os.Stderr, 1000)
+
+	router, _, err := NewRESTRouter("v0", mgr, "static", "", mr,
+		AssetDir, Asset)
+	if err != nil || router == nil {
+		t.Errorf("no mux router")
+	}
+
+	addOrphan := func() {
+		planPIndexes, cas, _ := cbgt.CfgGetPlanPIndexes(cfg)
+		if planPIndexes == nil {
+			planPIndexes = cbgt.NewPlanPIndexes(cbgt.VERSION)
+		}
+		planPIndexes.PlanPIndexes["gone_0"] = &cbgt.PlanPIndex{
+			Name:      "gone_0",
+			IndexName: "gone",
+			IndexUUID: "gone-uuid",
+			Nodes:     map[string]*cbgt.PlanPIndexNode{},
+		}
+		_, err := cbgt.CfgSetPlanPIndexes(cfg, planPIndexes, cas)
+		if err != nil {
+			t.Errorf("expected set of an orphan to work, err: %v", err)
+		}
+	}
+
+	orphanExists := func() bool {
+		planPIndexes, _, _ := cbgt.CfgGetPlanPIndexes(cfg)
+		return planPIndexes != nil &&
+			planPIndexes.PlanPIndexes["gone_0"] != nil
+	}
+
+	tests := []*RESTHandlerTest{
+		{
+			Desc:   "check a consistent cfg",
+			Path:   "/api/cfg/check",
+			Method: "GET",
+			Status: http.StatusOK,
+			ResponseMatch: map[string]bool{
+				`"status":"ok"`: true,
+				`"issues":[]`:   true,
+			},
+		},
+		{
+			Desc:   "check an orphaned plan pindex",
+			Before: addOrphan,
+			Path:   "/api/cfg/check",
+			Method: "GET",
+			Status: http.StatusOK,
+			ResponseMatch: map[string]bool{
+				`"kind":"planPIndexIndexMissing"`: true,
+				`"planPIndexName":"gone_0"`:       true,
+			},
+		},
+		{
+			Desc:   "repair with a bad apply",
+			Path:   "/api/cfg/check",
+			Method: "POST",
+			Params: url.Values{"apply": []string{"x"}},
+			Status: http.StatusBadRequest,
+		},
+		{
+			Desc:   "repair as a dry run",
+			Path:   "/api/cfg/check",
+			Method: "POST",
+			Status: http.StatusOK,
+			ResponseMatch: map[string]bool{
+				`"dryRun":true`:                   true,
+				`"prunedPlanPIndexes":["gone_0"]`: true,
+				`"saved":false`:                   true,
+			},
+			After: func() {
+				if !orphanExists() {
+					t.Errorf("expected a dry run to keep the orphan")
+				}
+			},
+		},
+		{
+			Desc:   "repair",
+			Path:   "/api/cfg/check",
+			Method: "POST",
+			Params: url.Values{"apply": []string{"true"}},
+			Status: http.StatusOK,
+			ResponseMatch: map[string]bool{
+				`"saved":true`: true,
+			},
+			After: func() {
+				if orphanExists() {
+					t.Errorf("expected the orphan to be pruned")
+				}
+			},
+		},
+	}
+
+	testRESTHandlers(t, tests, router)
+}
+
+func TestHandlersRedactSourceParams(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	keyFile := emptyDir + string(os.PathSeparator) + "test.keys"
+	cbgt.CreateSecretKeyfile(keyFile)
+
+	cfg := cbgt.NewCfgMem()
+	meh := &TestMEH{}
+	mgr := cbgt.NewManagerEx(cbgt.VERSION, cfg, cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", emptyDir, "some-datasource", meh,
+		map[string]string{
+			"secretKeyFile": keyFile,
+		})
+	err := mgr.Start("wanted")
+	if err != nil {
+		t.Errorf("expected start ok")
+	}
+
+	mr, _ := cbgt.NewMsgRing(os.Stderr, 1000)
+
+	router, _, err := NewRESTRouter("v0", mgr, "static", "", mr,
+		AssetDir, Asset)
+	if err != nil || router == nil {
+		t.Errorf("no mux router")
+	}
+
+	redacted := map[string]bool{
+		`secretpw`: false,
+		`redacted`: true,
+	}
+
+	tests := []*RESTHandlerTest{
+		{
+			Desc:   "create an index with credentials",
+			Path:   "/api/index/idx0",
+			Method: "PUT",
+			Body: []byte(`{"type":"blackhole","sourceType":"nil",` +
+				`"sourceParams":{"authUser":"u","authPassword":"secretpw"}}`),
+			Status: http.StatusOK,
+			After: func() {
+				mgr.Kick("test")
+			},
+		},
+		{
+			Desc:          "list indexes",
+			Path:          "/api/index",
+			Method:        "GET",
+			Status:        http.StatusOK,
+			ResponseMatch: redacted,
+		},
+		{
+			Desc:          "get index",
+			Path:          "/api/index/idx0",
+			Method:        "GET",
+			Status:        http.StatusOK,
+			ResponseMatch: redacted,
+		},
+		{
+			Desc:          "get cfg",
+			Path:          "/api/cfg",
+			Method:        "GET",
+			Status:        http.StatusOK,
+			ResponseMatch: redacted,
+		},
+		{
+			Desc:          "list pindexes",
+			Path:          "/api/pindex",
+			Method:        "GET",
+			Status:        http.StatusOK,
+			ResponseMatch: redacted,
+		},
+		{
+			Desc:   "error that echoes the request",
+			Path:   "/api/index/idx1",
+			Method: "PUT",
+			Body: []byte(`{"type":"not-a-type","sourceType":"nil",` +
+				`"sourceParams":{"authUser":"u","authPassword":"secretpw"}}`),
+			Status:        http.StatusBadRequest,
+			ResponseMatch: redacted,
+		},
+	}
+
+	testRESTHandlers(t, tests, router)
+}
+
 func TestPathFocusName(t *testing.T) {
 	tests := []struct {
 		inp string
@@ -0,0 +1,794 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	log "github.com/couchbase/clog"
+)
+
+// SECRET_PREFIX starts the value of an encrypted sourceParams field,
+// and is followed by the name of the SecretProvider, a ':', and the
+// ciphertext from that SecretProvider.
+const SECRET_PREFIX = "cbgtSecret:"
+
+// SECRET_REDACTED replaces the values of the SecretFields in REST
+// responses.  When an index definition update has a SECRET_REDACTED
+// value, the value from the previous index definition is kept.
+const SECRET_REDACTED = "<redacted>"
+
+// SecretFields are the top-level sourceParams JSON fields that hold
+// data source credentials, such as in DCPFeedParams.
+var SecretFields = []string{
+	"authUser",
+	"authPassword",
+	"authSaslUser",
+	"authSaslPassword",
+}
+
+// A SecretProvider encrypts and decrypts the values of the
+// SecretFields.  The ciphertext must be a printable string, and it
+// should identify the key used, so that the provider can rotate keys
+// while still decrypting older ciphertexts.
+type SecretProvider interface {
+	Encrypt(plaintext []byte) (ciphertext string, err error)
+	Decrypt(ciphertext string) (plaintext []byte, err error)
+}
+
+// A SecretProviderFactory returns the SecretProvider that's
+// configured by the given manager options.  It's invoked often, so
+// it should cache its SecretProvider.
+type SecretProviderFactory func(options map[string]string) (
+	SecretProvider, error)
+
+// SecretProviders is a registry of the available SecretProviders,
+// keyed by name.
+var SecretProviders = map[string]SecretProviderFactory{}
+
+// RegisterSecretProvider is invoked at init/startup time to register
+// a SecretProviderFactory.
+func RegisterSecretProvider(name string, f SecretProviderFactory) {
+	SecretProviders[name] = f
+}
+
+// SECRET_PROVIDER_NONE is the "secretProvider" manager option value
+// that explicitly opts out of encrypting credentials.
+const SECRET_PROVIDER_NONE = "none"
+
+// SecretProviderName returns the name of the SecretProvider that's
+// used to encrypt credentials, based on the "secretProvider" manager
+// option.  When that option is unset, the "keyfile" provider is used
+// by default.  A result of "" means credentials are not encrypted,
+// which happens only when the option is SECRET_PROVIDER_NONE.
+func SecretProviderName(options map[string]string) string {
+	name := options["secretProvider"]
+	if name == SECRET_PROVIDER_NONE {
+		return ""
+	}
+	if name == "" {
+		return SECRET_PROVIDER_KEYFILE
+	}
+	return name
+}
+
+func secretProvider(name string, options map[string]string) (
+	SecretProvider, error) {
+	f, exists := SecretProviders[name]
+	if !exists || f == nil {
+		return nil, fmt.Errorf("secret: unknown secretProvider: %s", name)
+	}
+	return f(options)
+}
+
+// ------------------------------------------------------------------------
+
+// EncryptSourceParams returns the sourceParams with the values of the
+// SecretFields encrypted by the configured SecretProvider.  Values
+// that are empty or already encrypted are left as is, and the
+// sourceParams are returned unchanged if encryption is disabled.
+func EncryptSourceParams(sourceParams string,
+	options map[string]string) (string, error) {
+	name := SecretProviderName(options)
+	if name == "" {
+		return sourceParams, nil
+	}
+
+	var p SecretProvider
+
+	return secretMapSourceParams(sourceParams,
+		func(field, v string) (string, error) {
+			if v == "" || strings.HasPrefix(v, SECRET_PREFIX) {
+				return v, nil
+			}
+
+			if p == nil {
+				var err error
+				p, err = secretProvider(name, options)
+				if err != nil {
+					return "", err
+				}
+			}
+
+			c, err := p.Encrypt([]byte(v))
+			if err != nil {
+				return "", err
+			}
+
+			return SECRET_PREFIX + name + ":" + c, nil
+		})
+}
+
+// DecryptSourceParams returns the sourceParams with any encrypted
+// values of the SecretFields decrypted.  It's meant to be used only
+// right before the sourceParams are handed to a FeedType, so that the
+// decrypted credentials are never stored.
+func DecryptSourceParams(sourceParams string,
+	options map[string]string) (string, error) {
+	if !strings.Contains(sourceParams, SECRET_PREFIX) {
+		return sourceParams, nil
+	}
+
+	return secretMapSourceParams(sourceParams,
+		func(field, v string) (string, error) {
+			if !strings.HasPrefix(v, SECRET_PREFIX) {
+				return v, nil
+			}
+			return secretDecryptValue(v, options)
+		})
+}
+
+// secretSplitValue splits an encrypted value into the name of its
+// SecretProvider and the ciphertext.
+func secretSplitValue(v string) (name, ciphertext string, err error) {
+	nameCiphertext := v[len(SECRET_PREFIX):]
+
+	i := strings.Index(nameCiphertext, ":")
+	if i < 0 {
+		return "", "", fmt.Errorf("secret: malformed secret")
+	}
+
+	return nameCiphertext[:i], nameCiphertext[i+1:], nil
+}
+
+func secretDecryptValue(v string, options map[string]string) (
+	string, error) {
+	name, ciphertext, err := secretSplitValue(v)
+	if err != nil {
+		return "", err
+	}
+
+	p, err := secretProvider(name, options)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := p.Decrypt(ciphertext)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+// A SecretKeyReporter is an optional interface of a SecretProvider
+// that reports which of its keys encrypted a ciphertext, so that
+// re-encryption can skip the ciphertexts of the active key, and so
+// that the keys that are no longer used can be found.
+type SecretKeyReporter interface {
+	ActiveKeyID() string
+	CiphertextKeyID(ciphertext string) string
+}
+
+// ReencryptSourceParams returns the sourceParams with the values of
+// the SecretFields encrypted by the configured SecretProvider, such
+// as after a key rotation.  Values that are encrypted by another
+// provider or by an older key are decrypted and encrypted again, and
+// plaintext values are encrypted.
+func ReencryptSourceParams(sourceParams string,
+	options map[string]string) (string, error) {
+	name := SecretProviderName(options)
+	if name == "" {
+		return "", fmt.Errorf("secret: re-encryption needs a" +
+			" secretProvider or secretKeyFile option")
+	}
+
+	p, err := secretProvider(name, options)
+	if err != nil {
+		return "", err
+	}
+
+	reporter, _ := p.(SecretKeyReporter)
+
+	return secretMapSourceParams(sourceParams,
+		func(field, v string) (string, error) {
+			if v == "" {
+				return v, nil
+			}
+
+			if strings.HasPrefix(v, SECRET_PREFIX) {
+				vName, ciphertext, err := secretSplitValue(v)
+				if err != nil {
+					return "", err
+				}
+
+				if vName == name && reporter != nil &&
+					reporter.CiphertextKeyID(ciphertext) ==
+						reporter.ActiveKeyID() {
+					return v, nil
+				}
+
+				v, err = secretDecryptValue(v, options)
+				if err != nil {
+					return "", err
+				}
+			}
+
+			c, err := p.Encrypt([]byte(v))
+			if err != nil {
+				return "", err
+			}
+
+			return SECRET_PREFIX + name + ":" + c, nil
+		})
+}
+
+// RedactSourceParams returns the sourceParams with the non-empty
+// values of the SecretFields, whether encrypted or not, replaced by
+// SECRET_REDACTED.
+func RedactSourceParams(sourceParams string) string {
+	mentioned := false
+	for _, field := range SecretFields {
+		if strings.Contains(sourceParams, field) {
+			mentioned = true
+			break
+		}
+	}
+	if !mentioned {
+		return sourceParams
+	}
+
+	rv, err := secretMapSourceParams(sourceParams,
+		func(field, v string) (string, error) {
+			if v == "" {
+				return v, nil
+			}
+			return SECRET_REDACTED, nil
+		})
+	if err != nil {
+		return SECRET_REDACTED
+	}
+
+	return rv
+}
+
+// RedactSourceParamsMap is like RedactSourceParams, but works on a
+// sourceParams that's already been parsed into a map.
+func RedactSourceParamsMap(m map[string]interface{}) {
+	for _, field := range SecretFields {
+		if v, ok := m[field].(string); ok && v != "" {
+			m[field] = SECRET_REDACTED
+		}
+	}
+}
+
+// UnredactSourceParams returns the sourceParams with any
+// SECRET_REDACTED values of the SecretFields replaced by the values
+// from the prevSourceParams, which allows a client to send back an
+// index definition that it retrieved from the REST API.
+func UnredactSourceParams(sourceParams, prevSourceParams string) (
+	string, error) {
+	// The SECRET_REDACTED might be JSON escaped, as in "\u003credacted".
+	if !strings.Contains(sourceParams, "redacted") {
+		return sourceParams, nil
+	}
+
+	prev, _ := secretParseSourceParams(prevSourceParams)
+
+	return secretMapSourceParams(sourceParams,
+		func(field, v string) (string, error) {
+			if v != SECRET_REDACTED {
+				return v, nil
+			}
+			if pv, ok := prev[field].(string); ok {
+				return pv, nil
+			}
+			return "", fmt.Errorf("secret: no previous value" +
+				" for a redacted field")
+		})
+}
+
+// ------------------------------------------------------------------------
+
+// RedactIndexDef returns a copy of the indexDef with its sourceParams
+// redacted, for use in REST responses.
+func RedactIndexDef(indexDef *IndexDef) *IndexDef {
+	if indexDef == nil {
+		return nil
+	}
+	rv := *indexDef
+	rv.SourceParams = RedactSourceParams(rv.SourceParams)
+	return &rv
+}
+
+// RedactIndexDefs returns a copy of the indexDefs with the
+// sourceParams redacted, for use in REST responses.
+func RedactIndexDefs(indexDefs *IndexDefs) *IndexDefs {
+	if indexDefs == nil {
+		return nil
+	}
+	rv := *indexDefs
+	if indexDefs.IndexDefs == nil {
+		return &rv
+	}
+	rv.IndexDefs = make(map[string]*IndexDef, len(indexDefs.IndexDefs))
+	for name, indexDef := range indexDefs.IndexDefs {
+		rv.IndexDefs[name] = RedactIndexDef(indexDef)
+	}
+	return &rv
+}
+
+// RedactPlanPIndex returns a copy of the planPIndex with its
+// sourceParams redacted, for use in REST responses.
+func RedactPlanPIndex(planPIndex *PlanPIndex) *PlanPIndex {
+	if planPIndex == nil {
+		return nil
+	}
+	rv := *planPIndex
+	rv.SourceParams = RedactSourceParams(rv.SourceParams)
+	return &rv
+}
+
+// RedactPlanPIndexes returns a copy of the planPIndexes with the
+// sourceParams redacted, for use in REST responses.
+func RedactPlanPIndexes(planPIndexes *PlanPIndexes) *PlanPIndexes {
+	if planPIndexes == nil {
+		return nil
+	}
+	rv := *planPIndexes
+	if planPIndexes.PlanPIndexes == nil {
+		return &rv
+	}
+	rv.PlanPIndexes = make(map[string]*PlanPIndex,
+		len(planPIndexes.PlanPIndexes))
+	for name, planPIndex := range planPIndexes.PlanPIndexes {
+		rv.PlanPIndexes[name] = RedactPlanPIndex(planPIndex)
+	}
+	return &rv
+}
+
+// RedactPIndex returns a copy of the pindex with its sourceParams
+// redacted, for use in REST responses.
+func RedactPIndex(pindex *PIndex) *PIndex {
+	rv := pindex.Clone()
+	if rv != nil {
+		rv.SourceParams = RedactSourceParams(rv.SourceParams)
+	}
+	return rv
+}
+
+// RedactCfgVal returns a Cfg value with any sourceParams redacted,
+// for use in REST responses, where the key determines the value's
+// format.
+func RedactCfgVal(key string, val []byte) []byte {
+	var v interface{}
+	switch key {
+	case INDEX_DEFS_KEY:
+		indexDefs := &IndexDefs{}
+		if json.Unmarshal(val, indexDefs) != nil {
+			return val
+		}
+		v = RedactIndexDefs(indexDefs)
+	case PLAN_PINDEXES_KEY:
+		planPIndexes := &PlanPIndexes{}
+		if json.Unmarshal(val, planPIndexes) != nil {
+			return val
+		}
+		v = RedactPlanPIndexes(planPIndexes)
+	default:
+		return val
+	}
+
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return val
+	}
+	return buf
+}
+
+// SecureCfgVal prepares a Cfg value that's written by a REST client
+// to be stored, where the key determines the value's format.  Any
+// redacted sourceParams, as returned by RedactCfgVal(), are restored
+// from the current value of the key in the cfg, and the credentials
+// are then encrypted, like CreateIndex() does.
+//
+// A planPIndex that's new, as from a planner that's a Cfg client,
+// has no current planPIndex of the same name, so its redacted
+// sourceParams are restored from its indexDef of the same name and
+// UUID, from which the planner copied the sourceParams, or else from
+// another planPIndex of the same index.
+func SecureCfgVal(cfg Cfg, key string, val []byte,
+	options map[string]string) ([]byte, error) {
+	if key != INDEX_DEFS_KEY && key != PLAN_PINDEXES_KEY {
+		return val, nil
+	}
+
+	prevVal, _, err := cfg.Get(key, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	secure := func(sourceParams, prevSourceParams string) (string, error) {
+		sp, err := UnredactSourceParams(sourceParams, prevSourceParams)
+		if err != nil {
+			return "", err
+		}
+		return EncryptSourceParams(sp, options)
+	}
+
+	var v interface{}
+	switch key {
+	case INDEX_DEFS_KEY:
+		indexDefs, prev := &IndexDefs{}, &IndexDefs{}
+		if json.Unmarshal(val, indexDefs) != nil {
+			return val, nil
+		}
+		json.Unmarshal(prevVal, prev)
+		for name, indexDef := range indexDefs.IndexDefs {
+			if indexDef == nil {
+				continue
+			}
+			prevSourceParams := ""
+			if prev.IndexDefs[name] != nil {
+				prevSourceParams = prev.IndexDefs[name].SourceParams
+			}
+			sp, err := secure(indexDef.SourceParams, prevSourceParams)
+			if err != nil {
+				return nil, fmt.Errorf("secret: SecureCfgVal,"+
+					" indexDef: %s, err: %v", name, err)
+			}
+			indexDef.SourceParams = sp
+		}
+		v = indexDefs
+	case PLAN_PINDEXES_KEY:
+		planPIndexes, prev := &PlanPIndexes{}, &PlanPIndexes{}
+		if json.Unmarshal(val, planPIndexes) != nil {
+			return val, nil
+		}
+		json.Unmarshal(prevVal, prev)
+
+		var indexDefs *IndexDefs // Lazily loaded.
+
+		prevPlanSourceParams := func(name string, planPIndex *PlanPIndex) (
+			string, error) {
+			if prev.PlanPIndexes[name] != nil {
+				return prev.PlanPIndexes[name].SourceParams, nil
+			}
+			if indexDefs == nil {
+				var err error
+				indexDefs, _, err = CfgGetIndexDefs(cfg)
+				if err != nil {
+					return "", err
+				}
+				if indexDefs == nil {
+					indexDefs = &IndexDefs{}
+				}
+			}
+			indexDef := indexDefs.IndexDefs[planPIndex.IndexName]
+			if indexDef != nil && indexDef.UUID == planPIndex.IndexUUID {
+				return indexDef.SourceParams, nil
+			}
+			for _, p := range prev.PlanPIndexes {
+				if p != nil && p.IndexName == planPIndex.IndexName &&
+					p.IndexUUID == planPIndex.IndexUUID {
+					return p.SourceParams, nil
+				}
+			}
+			return "", nil
+		}
+
+		for name, planPIndex := range planPIndexes.PlanPIndexes {
+			if planPIndex == nil {
+				continue
+			}
+			prevSourceParams := ""
+			if strings.Contains(planPIndex.SourceParams, "redacted") {
+				prevSourceParams, err = prevPlanSourceParams(name, planPIndex)
+				if err != nil {
+					return nil, err
+				}
+			}
+			sp, err := secure(planPIndex.SourceParams, prevSourceParams)
+			if err != nil {
+				return nil, fmt.Errorf("secret: SecureCfgVal,"+
+					" planPIndex: %s, err: %v", name, err)
+			}
+			planPIndex.SourceParams = sp
+		}
+		v = planPIndexes
+	}
+
+	return json.Marshal(v)
+}
+
+// ------------------------------------------------------------------------
+
+// SecretReencryptResult is the outcome of ReencryptCfgSecrets().
+type SecretReencryptResult struct {
+	DryRun       bool     `json:"dryRun"`
+	IndexDefs    []string `json:"indexDefs"`    // Re-encrypted index names.
+	PlanPIndexes []string `json:"planPIndexes"` // Re-encrypted plan names.
+	Saved        bool     `json:"saved"`
+}
+
+// ReencryptCfgSecrets re-encrypts the credentials in the indexDefs and
+// planPIndexes of the Cfg with ReencryptSourceParams(), which is meant
+// to follow a key rotation, so that the older keys can afterwards be
+// removed.  In a cluster, the rotated keyfile must be on every node
+// before the credentials are re-encrypted.  Unless it's a dryRun, the
+// changes are saved in a single txn if the Cfg supports CfgTxn, and
+// only if the indexDefs and planPIndexes did not concurrently change.
+// As the planPIndexes change, the affected pindexes are restarted.
+func ReencryptCfgSecrets(cfg Cfg, options map[string]string,
+	dryRun bool) (*SecretReencryptResult, error) {
+	indexDefs, indexDefsCAS, err := CfgGetIndexDefs(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	planPIndexes, planPIndexesCAS, err := CfgGetPlanPIndexes(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &SecretReencryptResult{DryRun: dryRun}
+
+	// The plan pindexes of an index share its sourceParams, so they
+	// are re-encrypted to the same ciphertexts as the index.
+	reencrypted := map[string]string{}
+
+	reencrypt := func(sourceParams string) (string, bool, error) {
+		if rv, exists := reencrypted[sourceParams]; exists {
+			return rv, rv != sourceParams, nil
+		}
+		rv, err := ReencryptSourceParams(sourceParams, options)
+		if err != nil {
+			return "", false, err
+		}
+		reencrypted[sourceParams] = rv
+		return rv, rv != sourceParams, nil
+	}
+
+	if indexDefs != nil {
+		for _, name := range cfgCheckSortedKeys(indexDefs.IndexDefs) {
+			indexDef := indexDefs.IndexDefs[name]
+			sp, changed, err := reencrypt(indexDef.SourceParams)
+			if err != nil {
+				return nil, fmt.Errorf("secret: ReencryptCfgSecrets,"+
+					" indexDef: %s, err: %v", name, err)
+			}
+			if changed {
+				indexDef.SourceParams = sp
+				res.IndexDefs = append(res.IndexDefs, name)
+			}
+		}
+	}
+
+	if planPIndexes != nil {
+		for _, name := range cfgCheckSortedKeys(planPIndexes.PlanPIndexes) {
+			planPIndex := planPIndexes.PlanPIndexes[name]
+			sp, changed, err := reencrypt(planPIndex.SourceParams)
+			if err != nil {
+				return nil, fmt.Errorf("secret: ReencryptCfgSecrets,"+
+					" planPIndex: %s, err: %v", name, err)
+			}
+			if changed {
+				planPIndex.SourceParams = sp
+				res.PlanPIndexes = append(res.PlanPIndexes, name)
+			}
+		}
+	}
+
+	if dryRun || (len(res.IndexDefs) <= 0 && len(res.PlanPIndexes) <= 0) {
+		return res, nil
+	}
+
+	var ops []CfgTxnOp
+
+	if len(res.IndexDefs) > 0 {
+		op, err := CfgTxnOpSetIndexDefs(indexDefs, indexDefsCAS)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	} else {
+		ops = append(ops, CfgTxnOp{Op: CFG_TXN_OP_CHECK,
+			Key: INDEX_DEFS_KEY, CAS: indexDefsCAS})
+	}
+
+	if len(res.PlanPIndexes) > 0 {
+		op, err := CfgTxnOpSetPlanPIndexes(planPIndexes, planPIndexesCAS)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+
+	if cfgTxn, ok := cfg.(CfgTxn); ok {
+		_, err = cfgTxn.Txn(ops)
+	} else {
+		// Without a txn, the indexDefs are saved first, where the
+		// plan keeps working with the older, not yet removed keys
+		// until it's saved, too.
+		for _, op := range ops {
+			if op.Op == CFG_TXN_OP_SET {
+				_, err = cfg.Set(op.Key, op.Val, op.CAS)
+				if err != nil {
+					break
+				}
+			}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("secret: ReencryptCfgSecrets,"+
+			" could not save, err: %v", err)
+	}
+
+	res.Saved = true
+
+	log.Printf("secret: re-encrypted credentials, indexDefs: %v,"+
+		" planPIndexes: %d", res.IndexDefs, len(res.PlanPIndexes))
+
+	return res, nil
+}
+
+// SecretKeyIDsInCfg returns the ids of the keys of the named
+// SecretProvider that encrypted the credentials in the indexDefs and
+// planPIndexes of the Cfg, where the provider must implement
+// SecretKeyReporter.
+func SecretKeyIDsInCfg(cfg Cfg, name string,
+	options map[string]string) (map[string]bool, error) {
+	p, err := secretProvider(name, options)
+	if err != nil {
+		return nil, err
+	}
+
+	reporter, ok := p.(SecretKeyReporter)
+	if !ok {
+		return nil, fmt.Errorf("secret: secretProvider: %s,"+
+			" does not report its keys", name)
+	}
+
+	indexDefs, _, err := CfgGetIndexDefs(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	planPIndexes, _, err := CfgGetPlanPIndexes(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var sourceParamsAll []string
+	if indexDefs != nil {
+		for _, indexDef := range indexDefs.IndexDefs {
+			sourceParamsAll = append(sourceParamsAll, indexDef.SourceParams)
+		}
+	}
+	if planPIndexes != nil {
+		for _, planPIndex := range planPIndexes.PlanPIndexes {
+			sourceParamsAll = append(sourceParamsAll, planPIndex.SourceParams)
+		}
+	}
+
+	rv := map[string]bool{}
+
+	for _, sourceParams := range sourceParamsAll {
+		_, err = secretMapSourceParams(sourceParams,
+			func(field, v string) (string, error) {
+				if !strings.HasPrefix(v, SECRET_PREFIX) {
+					return v, nil
+				}
+				vName, ciphertext, err := secretSplitValue(v)
+				if err != nil {
+					return "", err
+				}
+				if vName == name {
+					rv[reporter.CiphertextKeyID(ciphertext)] = true
+				}
+				return v, nil
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return rv, nil
+}
+
+// ------------------------------------------------------------------------
+
+// secretParseSourceParams parses a JSON object sourceParams, where
+// the ok result is false if the sourceParams is not a JSON object.
+func secretParseSourceParams(sourceParams string) (
+	m map[string]interface{}, ok bool) {
+	if sourceParams == "" {
+		return nil, true
+	}
+
+	d := json.NewDecoder(strings.NewReader(sourceParams))
+	d.UseNumber() // Keeps numbers as they were written.
+
+	err := d.Decode(&m)
+	if err != nil {
+		return nil, false
+	}
+
+	return m, true
+}
+
+// secretMapSourceParams returns the sourceParams with the string
+// value of each of the SecretFields replaced by the result of f.  The
+// sourceParams are returned unchanged when f changes nothing or when
+// the sourceParams are not a JSON object (which cannot hold any
+// SecretFields), except that the latter is an error if the
+// sourceParams mention a SecretField.
+func secretMapSourceParams(sourceParams string,
+	f func(field, v string) (string, error)) (string, error) {
+	m, ok := secretParseSourceParams(sourceParams)
+	if !ok {
+		for _, field := range SecretFields {
+			if strings.Contains(sourceParams, field) {
+				return "", fmt.Errorf("secret: could not parse" +
+					" sourceParams with credentials")
+			}
+		}
+		return sourceParams, nil
+	}
+
+	changed := false
+	for _, field := range SecretFields {
+		v, ok := m[field].(string)
+		if !ok {
+			continue
+		}
+
+		v2, err := f(field, v)
+		if err != nil {
+			return "", fmt.Errorf("secret: field: %s, err: %v", field, err)
+		}
+
+		if v2 != v {
+			m[field] = v2
+			changed = true
+		}
+	}
+
+	if !changed {
+		return sourceParams, nil
+	}
+
+	var buf bytes.Buffer
+
+	e := json.NewEncoder(&buf)
+	e.SetEscapeHTML(false)
+
+	err := e.Encode(m)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(buf.String()), nil
+}
@@ -0,0 +1,579 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/couchbase/clog"
+)
+
+// SECRET_PROVIDER_KEYFILE is the name of the SecretProvider that keeps
+// its keys in a local file, whose path is given by the "secretKeyFile"
+// manager option, and which is the default SecretProvider.
+const SECRET_PROVIDER_KEYFILE = "keyfile"
+
+// SECRET_KEYFILE_DEFAULT is the name of the keyfile in the dataDir of
+// a Manager, which is used when the "secretKeyFile" option is unset.
+const SECRET_KEYFILE_DEFAULT = "secret.keys"
+
+func init() {
+	RegisterSecretProvider(SECRET_PROVIDER_KEYFILE, secretKeyfileProvider)
+}
+
+var secretKeyfilesM sync.Mutex
+var secretKeyfiles = map[string]*SecretKeyfile{} // Keyed by path.
+
+func secretKeyfileProvider(options map[string]string) (
+	SecretProvider, error) {
+	return SecretKeyfileForOptions(options)
+}
+
+// SecretKeyfileForOptions returns the SecretKeyfile at the path of the
+// "secretKeyFile" manager option, which must already exist.
+func SecretKeyfileForOptions(options map[string]string) (
+	*SecretKeyfile, error) {
+	path := options["secretKeyFile"]
+	if path == "" {
+		return nil, fmt.Errorf("secret_keyfile: secretKeyFile option needed,"+
+			" or a secretProvider option of %q to not encrypt credentials",
+			SECRET_PROVIDER_NONE)
+	}
+
+	secretKeyfilesM.Lock()
+	defer secretKeyfilesM.Unlock()
+
+	kf := secretKeyfiles[path]
+	if kf == nil {
+		var err error
+		kf, err = NewSecretKeyfile(path)
+		if err != nil {
+			return nil, err
+		}
+		secretKeyfiles[path] = kf
+	}
+
+	return kf, nil
+}
+
+// SecretKeyfileDefaultOptions returns the options with the path of
+// the SECRET_KEYFILE_DEFAULT in the dataDir as the "secretKeyFile"
+// option, when the keyfile provider is used without that option.
+// The given options are not modified.
+func SecretKeyfileDefaultOptions(options map[string]string,
+	dataDir string) map[string]string {
+	if dataDir == "" || options["secretKeyFile"] != "" ||
+		SecretProviderName(options) != SECRET_PROVIDER_KEYFILE {
+		return options
+	}
+
+	rv := make(map[string]string, len(options)+1)
+	for k, v := range options {
+		rv[k] = v
+	}
+	rv["secretKeyFile"] = filepath.Join(dataDir, SECRET_KEYFILE_DEFAULT)
+
+	return rv
+}
+
+// SecretOptions returns the manager options for encrypting and
+// decrypting credentials, where the default keyfile provider uses the
+// SECRET_KEYFILE_DEFAULT in the dataDir unless the "secretKeyFile"
+// option is set.
+func (mgr *Manager) SecretOptions() map[string]string {
+	return SecretKeyfileDefaultOptions(mgr.GetOptions(), mgr.dataDir)
+}
+
+// initSecretKeyfile creates the SECRET_KEYFILE_DEFAULT in the dataDir
+// when the Manager uses it and it doesn't exist yet, so credentials
+// are encrypted by default.  As a node can't decrypt the credentials
+// that another node encrypted with its own keys, in a cluster the
+// created file must be copied to every node, or a shared
+// "secretKeyFile" should be configured instead.
+func (mgr *Manager) initSecretKeyfile() error {
+	options := mgr.GetOptions()
+	if mgr.dataDir == "" || options["secretKeyFile"] != "" ||
+		SecretProviderName(options) != SECRET_PROVIDER_KEYFILE {
+		return nil
+	}
+
+	path := filepath.Join(mgr.dataDir, SECRET_KEYFILE_DEFAULT)
+
+	_, err := os.Stat(path)
+	if err == nil || !os.IsNotExist(err) {
+		return err
+	}
+
+	_, err = CreateSecretKeyfile(path)
+	if err != nil {
+		return err
+	}
+
+	log.Warnf("secret_keyfile: created the default keyfile, path: %s;"+
+		" in a cluster, copy it to every node, or configure a shared"+
+		" secretKeyFile option, or a secretProvider option of %q to"+
+		" not encrypt credentials", path, SECRET_PROVIDER_NONE)
+
+	return nil
+}
+
+// SecretKeyfile is a SecretProvider that encrypts with AES-256-GCM,
+// using keys that are kept in a local JSON file.  The file should be
+// readable only by the process owner, and in a cluster the same file
+// must be copied to every node, as any node may start a feed, so the
+// file is created only explicitly, by CreateSecretKeyfile(), or as the
+// SECRET_KEYFILE_DEFAULT when a Manager starts.
+//
+// Rotate() adds a new key that's used for later encryptions, while
+// the older keys are kept so that existing ciphertexts, which name
+// their key, can still be decrypted.  After the rotated file is
+// copied to every node, ReencryptCfgSecrets() and then
+// RemoveUnusedSecretKeys() retire the older keys.
+type SecretKeyfile struct {
+	m       sync.Mutex
+	path    string
+	keys    *SecretKeys
+	modTime time.Time // Of the file when the keys were loaded.
+}
+
+// SecretKeys is the JSON content of a SecretKeyfile.
+type SecretKeys struct {
+	Active string       `json:"active"` // The SecretKey.ID for encryption.
+	Keys   []*SecretKey `json:"keys"`
+}
+
+// A SecretKey is a single key in a SecretKeyfile.
+type SecretKey struct {
+	ID      string    `json:"id"`
+	Key     []byte    `json:"key"`
+	Created time.Time `json:"created"`
+}
+
+// NewSecretKeyfile returns a SecretKeyfile that's backed by the
+// existing file at the given path.  A missing file is an error rather
+// than being created, as each node would otherwise have its own keys
+// and could not decrypt the credentials that other nodes encrypted.
+func NewSecretKeyfile(path string) (*SecretKeyfile, error) {
+	kf := &SecretKeyfile{path: path}
+
+	kf.m.Lock()
+	defer kf.m.Unlock()
+
+	err := kf.load()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("secret_keyfile: no keyfile, path: %s;"+
+				" create one with the secretKeyCreate step of cbgt-ctl"+
+				" and copy it to every node, or use a secretProvider"+
+				" option of %q to not encrypt credentials",
+				path, SECRET_PROVIDER_NONE)
+		}
+		return nil, err
+	}
+
+	return kf, nil
+}
+
+// CreateSecretKeyfile creates a new keyfile at the given path, with a
+// single, new key, where it's an error if the file already exists.
+// In a cluster, the created file must then be copied to every node.
+func CreateSecretKeyfile(path string) (*SecretKeyfile, error) {
+	kf := &SecretKeyfile{path: path}
+
+	kf.m.Lock()
+	defer kf.m.Unlock()
+
+	_, err := kf.rotateLOCKED(false)
+	if err != nil {
+		return nil, err
+	}
+
+	return kf, nil
+}
+
+func (kf *SecretKeyfile) load() error {
+	fi, err := os.Stat(kf.path)
+	if err != nil {
+		return err
+	}
+
+	buf, err := ioutil.ReadFile(kf.path)
+	if err != nil {
+		return err
+	}
+
+	keys := &SecretKeys{}
+	err = json.Unmarshal(buf, keys)
+	if err != nil {
+		return fmt.Errorf("secret_keyfile: could not parse, path: %s,"+
+			" err: %v", kf.path, err)
+	}
+	if keys.key(keys.Active) == nil {
+		return fmt.Errorf("secret_keyfile: missing active key, path: %s",
+			kf.path)
+	}
+
+	kf.keys = keys
+	kf.modTime = fi.ModTime()
+
+	return nil
+}
+
+// refreshLOCKED reloads the keys if the file was changed, such as by
+// a Rotate() in another process.
+func (kf *SecretKeyfile) refreshLOCKED() {
+	fi, err := os.Stat(kf.path)
+	if err != nil || fi.ModTime().Equal(kf.modTime) {
+		return
+	}
+
+	err = kf.load()
+	if err != nil {
+		log.Warnf("secret_keyfile: could not reload, path: %s, err: %v",
+			kf.path, err)
+	}
+}
+
+func (kf *SecretKeyfile) save() error {
+	buf, err := json.MarshalIndent(kf.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	pathTmp := kf.path + ".tmp"
+
+	err = ioutil.WriteFile(pathTmp, buf, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(pathTmp, kf.path)
+	if err != nil {
+		os.Remove(pathTmp)
+		return err
+	}
+
+	return nil
+}
+
+// lockFile takes an advisory lock on a sibling ".lock" file, so that
+// processes sharing the keyfile do not lose each other's keys.
+func (kf *SecretKeyfile) lockFile() (*os.File, error) {
+	f, err := os.OpenFile(kf.path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = flockFile(f, true)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (k *SecretKeys) key(id string) *SecretKey {
+	for _, key := range k.Keys {
+		if key.ID == id {
+			return key
+		}
+	}
+	return nil
+}
+
+// ------------------------------------------------------------------------
+
+// Rotate adds a new key, which becomes the active key for later
+// encryptions, and returns its id.
+func (kf *SecretKeyfile) Rotate() (string, error) {
+	kf.m.Lock()
+	defer kf.m.Unlock()
+
+	return kf.rotateLOCKED(true)
+}
+
+func (kf *SecretKeyfile) rotateLOCKED(mustExist bool) (string, error) {
+	f, err := kf.lockFile()
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		funlockFile(f)
+		f.Close()
+	}()
+
+	// Reload, as others may have changed the file.
+	err = kf.load()
+	if err != nil {
+		if mustExist || !os.IsNotExist(err) {
+			return "", err
+		}
+
+		kf.keys = &SecretKeys{}
+	} else if !mustExist {
+		return "", fmt.Errorf("secret_keyfile: already exists, path: %s",
+			kf.path)
+	}
+
+	key := &SecretKey{
+		ID:      NewUUID(),
+		Key:     make([]byte, 32),
+		Created: time.Now(),
+	}
+
+	_, err = io.ReadFull(rand.Reader, key.Key)
+	if err != nil {
+		return "", err
+	}
+
+	keys := &SecretKeys{
+		Active: key.ID,
+		Keys:   append(append([]*SecretKey(nil), kf.keys.Keys...), key),
+	}
+
+	keysPrev := kf.keys
+	kf.keys = keys
+
+	err = kf.save()
+	if err != nil {
+		kf.keys = keysPrev
+		return "", err
+	}
+
+	kf.refreshLOCKED()
+
+	log.Printf("secret_keyfile: new active key, path: %s, id: %s",
+		kf.path, key.ID)
+
+	return key.ID, nil
+}
+
+// RemoveKey removes an older, non-active key, after which the
+// ciphertexts that were encrypted with it can no longer be decrypted,
+// so RemoveUnusedSecretKeys() should usually be used instead.
+func (kf *SecretKeyfile) RemoveKey(id string) error {
+	kf.m.Lock()
+	defer kf.m.Unlock()
+
+	f, err := kf.lockFile()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		funlockFile(f)
+		f.Close()
+	}()
+
+	err = kf.load()
+	if err != nil {
+		return err
+	}
+
+	if id == kf.keys.Active {
+		return fmt.Errorf("secret_keyfile: cannot remove the active key,"+
+			" id: %s", id)
+	}
+	if kf.keys.key(id) == nil {
+		return fmt.Errorf("secret_keyfile: no such key, id: %s", id)
+	}
+
+	keys := &SecretKeys{Active: kf.keys.Active}
+	for _, key := range kf.keys.Keys {
+		if key.ID != id {
+			keys.Keys = append(keys.Keys, key)
+		}
+	}
+
+	kf.keys = keys
+
+	err = kf.save()
+	if err != nil {
+		return err
+	}
+
+	kf.refreshLOCKED()
+
+	log.Printf("secret_keyfile: removed key, path: %s, id: %s", kf.path, id)
+
+	return nil
+}
+
+// RemoveUnusedSecretKeys removes the non-active keys of the keyfile
+// that's configured by the options, except for the keys that still
+// encrypt credentials in the indexDefs or planPIndexes of the Cfg, so
+// ReencryptCfgSecrets() should be used first.  Only the Cfg is
+// checked, so older CfgHistory revisions might no longer be
+// restorable with their credentials.  The removed key ids are
+// returned, which are only the removable key ids on a dryRun.
+func RemoveUnusedSecretKeys(cfg Cfg, options map[string]string,
+	dryRun bool) ([]string, error) {
+	kf, err := SecretKeyfileForOptions(options)
+	if err != nil {
+		return nil, err
+	}
+
+	used, err := SecretKeyIDsInCfg(cfg, SECRET_PROVIDER_KEYFILE, options)
+	if err != nil {
+		return nil, err
+	}
+
+	ids, active := kf.KeyIDs()
+
+	var removed []string
+	for _, id := range ids {
+		if id == active || used[id] {
+			continue
+		}
+
+		if !dryRun {
+			err = kf.RemoveKey(id)
+			if err != nil {
+				return removed, err
+			}
+		}
+
+		removed = append(removed, id)
+	}
+
+	return removed, nil
+}
+
+// KeyIDs returns the ids of the keys, oldest first, and the id of the
+// active key.
+func (kf *SecretKeyfile) KeyIDs() (ids []string, active string) {
+	kf.m.Lock()
+	defer kf.m.Unlock()
+
+	kf.refreshLOCKED()
+
+	for _, key := range kf.keys.Keys {
+		ids = append(ids, key.ID)
+	}
+
+	return ids, kf.keys.Active
+}
+
+// ------------------------------------------------------------------------
+
+// ActiveKeyID returns the id of the key that's used for encryption.
+func (kf *SecretKeyfile) ActiveKeyID() string {
+	kf.m.Lock()
+	defer kf.m.Unlock()
+
+	kf.refreshLOCKED()
+
+	return kf.keys.Active
+}
+
+// CiphertextKeyID returns the id of the key that encrypted the
+// ciphertext.
+func (kf *SecretKeyfile) CiphertextKeyID(ciphertext string) string {
+	i := strings.Index(ciphertext, ":")
+	if i < 0 {
+		return ""
+	}
+	return ciphertext[:i]
+}
+
+// Encrypt returns a ciphertext of the form "<keyID>:<base64 data>".
+func (kf *SecretKeyfile) Encrypt(plaintext []byte) (string, error) {
+	kf.m.Lock()
+	kf.refreshLOCKED() // Another process might have rotated the keys.
+	key := kf.keys.key(kf.keys.Active)
+	kf.m.Unlock()
+
+	gcm, err := secretKeyfileGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	data := gcm.Seal(nonce, nonce, plaintext, nil)
+
+	return key.ID + ":" + base64.StdEncoding.EncodeToString(data), nil
+}
+
+func (kf *SecretKeyfile) Decrypt(ciphertext string) ([]byte, error) {
+	i := strings.Index(ciphertext, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("secret_keyfile: malformed ciphertext")
+	}
+
+	id := ciphertext[:i]
+
+	data, err := base64.StdEncoding.DecodeString(ciphertext[i+1:])
+	if err != nil {
+		return nil, fmt.Errorf("secret_keyfile: malformed ciphertext,"+
+			" err: %v", err)
+	}
+
+	kf.m.Lock()
+	key := kf.keys.key(id)
+	if key == nil {
+		// The key might have been added by another process.
+		err = kf.load()
+		if err == nil {
+			key = kf.keys.key(id)
+		}
+	}
+	kf.m.Unlock()
+
+	if key == nil {
+		return nil, fmt.Errorf("secret_keyfile: unknown key, id: %s,"+
+			" path: %s", id, kf.path)
+	}
+
+	gcm, err := secretKeyfileGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("secret_keyfile: short ciphertext")
+	}
+
+	plaintext, err := gcm.Open(nil,
+		data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("secret_keyfile: could not decrypt,"+
+			" id: %s, err: %v", id, err)
+	}
+
+	return plaintext, nil
+}
+
+func secretKeyfileGCM(key *SecretKey) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key.Key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
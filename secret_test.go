@@ -0,0 +1,530 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbgt
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSecretKeyfile(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	path := emptyDir + string(os.PathSeparator) + "test.keys"
+
+	_, err := NewSecretKeyfile(path)
+	if err == nil {
+		t.Errorf("expected NewSecretKeyfile of a missing file to fail")
+	}
+	_, err = os.Stat(path)
+	if !os.IsNotExist(err) {
+		t.Errorf("expected NewSecretKeyfile to not create a file, err: %v", err)
+	}
+
+	kf, err := CreateSecretKeyfile(path)
+	if err != nil {
+		t.Fatalf("expected CreateSecretKeyfile to work, err: %v", err)
+	}
+
+	_, err = CreateSecretKeyfile(path)
+	if err == nil {
+		t.Errorf("expected CreateSecretKeyfile of an existing file to fail")
+	}
+
+	ids, active := kf.KeyIDs()
+	if len(ids) != 1 || ids[0] != active {
+		t.Errorf("expected 1 active key, ids: %v, active: %s", ids, active)
+	}
+
+	c1, err := kf.Encrypt([]byte("hello"))
+	if err != nil || strings.Contains(c1, "hello") ||
+		!strings.HasPrefix(c1, active+":") {
+		t.Errorf("expected Encrypt to work, c1: %s, err: %v", c1, err)
+	}
+
+	// Another instance on the same file, such as in another process.
+	kf2, err := NewSecretKeyfile(path)
+	if err != nil {
+		t.Fatalf("expected reopen to work, err: %v", err)
+	}
+
+	newActive, err := kf.Rotate()
+	if err != nil || newActive == active {
+		t.Fatalf("expected Rotate to work, err: %v", err)
+	}
+
+	c2, _ := kf.Encrypt([]byte("world"))
+	if !strings.HasPrefix(c2, newActive+":") {
+		t.Errorf("expected the new key to be used, c2: %s", c2)
+	}
+
+	for _, k := range []*SecretKeyfile{kf, kf2} {
+		p, err := k.Decrypt(c1)
+		if err != nil || string(p) != "hello" {
+			t.Errorf("expected old ciphertext to decrypt, err: %v", err)
+		}
+		p, err = k.Decrypt(c2)
+		if err != nil || string(p) != "world" {
+			t.Errorf("expected new ciphertext to decrypt, err: %v", err)
+		}
+	}
+
+	_, err = kf.Decrypt(c1[:len(c1)-4] + "AAA=")
+	if err == nil {
+		t.Errorf("expected tampered ciphertext to fail")
+	}
+
+	err = kf.RemoveKey(newActive)
+	if err == nil {
+		t.Errorf("expected RemoveKey of active key to fail")
+	}
+	err = kf.RemoveKey(active)
+	if err != nil {
+		t.Errorf("expected RemoveKey to work, err: %v", err)
+	}
+	_, err = kf.Decrypt(c1)
+	if err == nil {
+		t.Errorf("expected Decrypt with a removed key to fail")
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("expected keyfile to be private, fi: %v, err: %v", fi, err)
+	}
+}
+
+func TestSecretSourceParams(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	options := map[string]string{
+		"secretKeyFile": emptyDir + string(os.PathSeparator) + "test.keys",
+	}
+
+	CreateSecretKeyfile(options["secretKeyFile"])
+
+	sp := `{"authUser":"u","authPassword":"p","authSaslUser":"",` +
+		`"noopTimeIntervalSecs":120}`
+
+	a, err := EncryptSourceParams(sp,
+		map[string]string{"secretProvider": SECRET_PROVIDER_NONE})
+	if err != nil || a != sp {
+		t.Errorf("expected no encryption when opted out, a: %s", a)
+	}
+
+	_, err = EncryptSourceParams(sp, nil)
+	if err == nil {
+		t.Errorf("expected err when encrypting by default without a keyfile")
+	}
+
+	_, err = EncryptSourceParams(sp,
+		map[string]string{"secretProvider": SECRET_PROVIDER_KEYFILE})
+	if err == nil {
+		t.Errorf("expected err when the keyfile is not configured")
+	}
+
+	_, err = EncryptSourceParams(sp, map[string]string{
+		"secretKeyFile": emptyDir + string(os.PathSeparator) + "missing.keys",
+	})
+	if err == nil {
+		t.Errorf("expected err when the keyfile does not exist")
+	}
+
+	a, err = EncryptSourceParams(`{"authUser":""}`, nil)
+	if err != nil || a != `{"authUser":""}` {
+		t.Errorf("expected no err without credentials, a: %s, err: %v", a, err)
+	}
+
+	enc, err := EncryptSourceParams(sp, options)
+	if err != nil {
+		t.Fatalf("expected EncryptSourceParams to work, err: %v", err)
+	}
+	if strings.Contains(enc, `"p"`) || strings.Contains(enc, `"u"`) ||
+		!strings.Contains(enc, `"authPassword":"`+SECRET_PREFIX+"keyfile:") ||
+		!strings.Contains(enc, `"authSaslUser":""`) ||
+		!strings.Contains(enc, `"noopTimeIntervalSecs":120`) {
+		t.Errorf("expected credentials to be encrypted, enc: %s", enc)
+	}
+
+	enc2, err := EncryptSourceParams(enc, options)
+	if err != nil || enc2 != enc {
+		t.Errorf("expected re-encryption to be a no-op, err: %v", err)
+	}
+
+	dec, err := DecryptSourceParams(enc, options)
+	if err != nil {
+		t.Fatalf("expected DecryptSourceParams to work, err: %v", err)
+	}
+	params := NewDCPFeedParams()
+	err = json.Unmarshal([]byte(dec), params)
+	if err != nil || params.AuthUser != "u" || params.AuthPassword != "p" ||
+		params.NoopTimeIntervalSecs != 120 {
+		t.Errorf("expected decrypted params, dec: %s, err: %v", dec, err)
+	}
+
+	_, err = DecryptSourceParams(enc,
+		map[string]string{"secretProvider": "not-a-provider"})
+	if err == nil {
+		t.Errorf("expected err when the keyfile is not configured")
+	}
+
+	for _, s := range []string{enc, sp} {
+		r := RedactSourceParams(s)
+		if strings.Contains(r, SECRET_PREFIX) || strings.Contains(r, `"p"`) ||
+			!strings.Contains(r, `"authPassword":"`+SECRET_REDACTED+`"`) ||
+			!strings.Contains(r, `"authSaslUser":""`) {
+			t.Errorf("expected redacted, r: %s", r)
+		}
+
+		u, err := UnredactSourceParams(r, s)
+		var um, sm map[string]interface{}
+		json.Unmarshal([]byte(u), &um)
+		json.Unmarshal([]byte(s), &sm)
+		if err != nil || !reflect.DeepEqual(um, sm) {
+			t.Errorf("expected unredacted, u: %s, err: %v", u, err)
+		}
+	}
+
+	_, err = UnredactSourceParams(RedactSourceParams(sp), "")
+	if err == nil {
+		t.Errorf("expected err on unredact without a previous value")
+	}
+
+	for _, s := range []string{"", "not json", `{"numPartitions":6}`} {
+		for _, f := range []func(string, map[string]string) (string, error){
+			EncryptSourceParams, DecryptSourceParams,
+		} {
+			r, err := f(s, options)
+			if err != nil || r != s {
+				t.Errorf("expected unchanged, s: %s, r: %s, err: %v", s, r, err)
+			}
+		}
+		if RedactSourceParams(s) != s {
+			t.Errorf("expected unchanged redact, s: %s", s)
+		}
+	}
+
+	if RedactSourceParams(`authPassword=p`) != SECRET_REDACTED {
+		t.Errorf("expected unparsable credentials to be fully redacted")
+	}
+}
+
+func TestManagerSecretSourceParams(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	var m sync.Mutex
+	var started []string
+
+	RegisterFeedType("secretTest", &FeedType{
+		Start: func(mgr *Manager, feedName, indexName, indexUUID,
+			sourceType, sourceName, sourceUUID, params string,
+			dests map[string]Dest) error {
+			m.Lock()
+			started = append(started, params)
+			m.Unlock()
+			return mgr.registerFeed(NewNILFeed(feedName, indexName, dests))
+		},
+		Partitions: func(sourceType, sourceName, sourceUUID, sourceParams,
+			server string, options map[string]string) ([]string, error) {
+			if !strings.Contains(sourceParams, `"authPassword":"p"`) {
+				t.Errorf("expected decrypted Partitions sourceParams: %s",
+					sourceParams)
+			}
+			return []string{"0"}, nil
+		},
+	})
+	defer delete(FeedTypes, "secretTest")
+
+	options := map[string]string{
+		"secretKeyFile": emptyDir + string(os.PathSeparator) + "test.keys",
+	}
+
+	CreateSecretKeyfile(options["secretKeyFile"])
+
+	cfg := NewCfgMem()
+	mgr := NewManagerEx(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1000",
+		emptyDir, "some-datasource", nil, options)
+	err := mgr.Start("wanted")
+	if err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+
+	sourceParams := `{"authPassword":"p","authUser":"u"}`
+
+	err = mgr.CreateIndex("secretTest", "default", "", sourceParams,
+		"blackhole", "foo", "", PlanParams{}, "")
+	if err != nil {
+		t.Fatalf("expected CreateIndex to work, err: %v", err)
+	}
+
+	indexDefs, _, _ := CfgGetIndexDefs(cfg)
+	stored := indexDefs.IndexDefs["foo"].SourceParams
+	if strings.Contains(stored, `"p"`) ||
+		!strings.Contains(stored, SECRET_PREFIX) {
+		t.Errorf("expected stored credentials to be encrypted: %s", stored)
+	}
+
+	mgr.PlannerKick("test")
+	mgr.JanitorKick("test")
+
+	planPIndexes, _, _ := CfgGetPlanPIndexes(cfg)
+	for _, planPIndex := range planPIndexes.PlanPIndexes {
+		if planPIndex.SourceParams != stored {
+			t.Errorf("expected plans to keep the encrypted sourceParams")
+		}
+	}
+
+	m.Lock()
+	if len(started) != 1 || started[0] != sourceParams {
+		t.Errorf("expected feed to start with decrypted sourceParams,"+
+			" started: %v", started)
+	}
+	m.Unlock()
+
+	// An update that sends back redacted credentials keeps them.
+	err = mgr.CreateIndex("secretTest", "default", "",
+		RedactSourceParams(stored),
+		"blackhole", "foo", "", PlanParams{}, indexDefs.IndexDefs["foo"].UUID)
+	if err != nil {
+		t.Fatalf("expected CreateIndex update to work, err: %v", err)
+	}
+
+	indexDefs, _, _ = CfgGetIndexDefs(cfg)
+	dec, err := DecryptSourceParams(
+		indexDefs.IndexDefs["foo"].SourceParams, options)
+	if err != nil || dec != sourceParams {
+		t.Errorf("expected credentials to be kept, dec: %s, err: %v", dec, err)
+	}
+}
+
+func TestSecretKeyfileDefaultOptions(t *testing.T) {
+	dataDir := "data"
+	path := dataDir + string(os.PathSeparator) + SECRET_KEYFILE_DEFAULT
+
+	options := map[string]string{"foo": "bar"}
+
+	o := SecretKeyfileDefaultOptions(options, dataDir)
+	if o["secretKeyFile"] != path || o["foo"] != "bar" {
+		t.Errorf("expected the default keyfile, o: %v", o)
+	}
+	if len(options) != 1 {
+		t.Errorf("expected options to be unmodified, options: %v", options)
+	}
+
+	o = SecretKeyfileDefaultOptions(map[string]string{
+		"secretProvider": SECRET_PROVIDER_KEYFILE}, dataDir)
+	if o["secretKeyFile"] != path {
+		t.Errorf("expected the default keyfile, o: %v", o)
+	}
+
+	o = SecretKeyfileDefaultOptions(map[string]string{
+		"secretKeyFile": "other.keys"}, dataDir)
+	if o["secretKeyFile"] != "other.keys" {
+		t.Errorf("expected the configured keyfile, o: %v", o)
+	}
+
+	o = SecretKeyfileDefaultOptions(map[string]string{
+		"secretProvider": SECRET_PROVIDER_NONE}, dataDir)
+	if o["secretKeyFile"] != "" {
+		t.Errorf("expected no keyfile when opted out, o: %v", o)
+	}
+
+	o = SecretKeyfileDefaultOptions(nil, "")
+	if o["secretKeyFile"] != "" {
+		t.Errorf("expected no keyfile without a dataDir, o: %v", o)
+	}
+}
+
+func TestManagerSecretDefaultKeyfile(t *testing.T) {
+	RegisterFeedType("secretDefaultTest", &FeedType{
+		Start: func(mgr *Manager, feedName, indexName, indexUUID,
+			sourceType, sourceName, sourceUUID, params string,
+			dests map[string]Dest) error {
+			return mgr.registerFeed(NewNILFeed(feedName, indexName, dests))
+		},
+		Partitions: func(sourceType, sourceName, sourceUUID, sourceParams,
+			server string, options map[string]string) ([]string, error) {
+			return []string{"0"}, nil
+		},
+	})
+	defer delete(FeedTypes, "secretDefaultTest")
+
+	sourceParams := `{"authPassword":"p","authUser":"u"}`
+
+	for _, options := range []map[string]string{
+		nil,
+		{"secretProvider": SECRET_PROVIDER_NONE},
+	} {
+		emptyDir, _ := ioutil.TempDir("./tmp", "test")
+		defer os.RemoveAll(emptyDir)
+
+		cfg := NewCfgMem()
+		mgr := NewManagerEx(VERSION, cfg, NewUUID(), nil, "", 1, "", ":1000",
+			emptyDir, "some-datasource", nil, options)
+		err := mgr.Start("wanted")
+		if err != nil {
+			t.Fatalf("expected Manager.Start() to work, err: %v", err)
+		}
+
+		err = mgr.CreateIndex("secretDefaultTest", "default", "",
+			sourceParams, "blackhole", "foo", "", PlanParams{}, "")
+		if err != nil {
+			t.Fatalf("expected CreateIndex to work, options: %v, err: %v",
+				options, err)
+		}
+
+		indexDefs, _, _ := CfgGetIndexDefs(cfg)
+		stored := indexDefs.IndexDefs["foo"].SourceParams
+
+		path := emptyDir + string(os.PathSeparator) + SECRET_KEYFILE_DEFAULT
+		_, err = os.Stat(path)
+
+		if options == nil {
+			if err != nil {
+				t.Errorf("expected the default keyfile, err: %v", err)
+			}
+			if strings.Contains(stored, `"p"`) ||
+				!strings.Contains(stored, SECRET_PREFIX) {
+				t.Errorf("expected encryption by default: %s", stored)
+			}
+
+			dec, err := DecryptSourceParams(stored, mgr.SecretOptions())
+			if err != nil || dec != sourceParams {
+				t.Errorf("expected decryption with the default keyfile,"+
+					" dec: %s, err: %v", dec, err)
+			}
+		} else {
+			if !os.IsNotExist(err) {
+				t.Errorf("expected no keyfile when opted out, err: %v", err)
+			}
+			if stored != sourceParams {
+				t.Errorf("expected no encryption when opted out: %s", stored)
+			}
+		}
+
+		mgr.Stop()
+	}
+}
+
+func TestSecretReencryptCfg(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	options := map[string]string{
+		"secretKeyFile": emptyDir + string(os.PathSeparator) + "test.keys",
+	}
+
+	kf, err := CreateSecretKeyfile(options["secretKeyFile"])
+	if err != nil {
+		t.Fatalf("expected CreateSecretKeyfile to work, err: %v", err)
+	}
+	_, keyOld := kf.KeyIDs()
+
+	sourceParams := `{"authPassword":"p","authUser":"u"}`
+
+	enc, err := EncryptSourceParams(sourceParams, options)
+	if err != nil {
+		t.Fatalf("expected EncryptSourceParams to work, err: %v", err)
+	}
+
+	cfg := NewCfgMem()
+
+	indexDefs := NewIndexDefs(VERSION)
+	indexDefs.IndexDefs["foo"] = &IndexDef{Name: "foo", UUID: "u0",
+		SourceParams: enc}
+	indexDefs.IndexDefs["bar"] = &IndexDef{Name: "bar", UUID: "u1",
+		SourceParams: `{"numPartitions":6}`}
+	CfgSetIndexDefs(cfg, indexDefs, 0)
+
+	planPIndexes := NewPlanPIndexes(VERSION)
+	for _, name := range []string{"foo_0", "foo_1"} {
+		planPIndexes.PlanPIndexes[name] = &PlanPIndex{Name: name,
+			IndexName: "foo", IndexUUID: "u0", SourceParams: enc}
+	}
+	CfgSetPlanPIndexes(cfg, planPIndexes, 0)
+
+	res, err := ReencryptCfgSecrets(cfg, options, false)
+	if err != nil || res.Saved ||
+		len(res.IndexDefs) != 0 || len(res.PlanPIndexes) != 0 {
+		t.Errorf("expected no changes before a rotation, res: %#v, err: %v",
+			res, err)
+	}
+
+	removed, err := RemoveUnusedSecretKeys(cfg, options, false)
+	if err != nil || len(removed) != 0 {
+		t.Errorf("expected the active key to be kept, removed: %v", removed)
+	}
+
+	keyNew, err := kf.Rotate()
+	if err != nil {
+		t.Fatalf("expected Rotate to work, err: %v", err)
+	}
+
+	removed, err = RemoveUnusedSecretKeys(cfg, options, false)
+	if err != nil || len(removed) != 0 {
+		t.Errorf("expected the used old key to be kept, removed: %v", removed)
+	}
+
+	res, err = ReencryptCfgSecrets(cfg, options, true)
+	if err != nil || res.Saved || len(res.IndexDefs) != 1 {
+		t.Errorf("expected a dry run, res: %#v, err: %v", res, err)
+	}
+
+	res, err = ReencryptCfgSecrets(cfg, options, false)
+	if err != nil || !res.Saved ||
+		!reflect.DeepEqual(res.IndexDefs, []string{"foo"}) ||
+		!reflect.DeepEqual(res.PlanPIndexes, []string{"foo_0", "foo_1"}) {
+		t.Errorf("expected re-encryption, res: %#v, err: %v", res, err)
+	}
+
+	indexDefs, _, _ = CfgGetIndexDefs(cfg)
+	planPIndexes, _, _ = CfgGetPlanPIndexes(cfg)
+
+	enc2 := indexDefs.IndexDefs["foo"].SourceParams
+	if !strings.Contains(enc2, SECRET_PREFIX+"keyfile:"+keyNew+":") ||
+		strings.Contains(enc2, keyOld) {
+		t.Errorf("expected the new key to be used, enc2: %s", enc2)
+	}
+	for _, planPIndex := range planPIndexes.PlanPIndexes {
+		if planPIndex.SourceParams != enc2 {
+			t.Errorf("expected plans to match the indexDef, planPIndex: %#v",
+				planPIndex)
+		}
+	}
+
+	removed, err = RemoveUnusedSecretKeys(cfg, options, true)
+	if err != nil || !reflect.DeepEqual(removed, []string{keyOld}) {
+		t.Errorf("expected a dry run removal, removed: %v", removed)
+	}
+	ids, _ := kf.KeyIDs()
+	if len(ids) != 2 {
+		t.Errorf("expected a dry run to keep the keys, ids: %v", ids)
+	}
+
+	removed, err = RemoveUnusedSecretKeys(cfg, options, false)
+	if err != nil || !reflect.DeepEqual(removed, []string{keyOld}) {
+		t.Errorf("expected the old key to be removed, removed: %v", removed)
+	}
+
+	dec, err := DecryptSourceParams(enc2, options)
+	if err != nil || dec != sourceParams {
+		t.Errorf("expected decryption after removal, dec: %s, err: %v",
+			dec, err)
+	}
+}
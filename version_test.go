@@ -48,10 +48,9 @@ func TestCheckVersion(t *testing.T) {
 	}
 
 	for i := 0; i < 3; i++ {
-		cfg = NewCfgMem()
-		eac := &ErrorAfterCfg{
-			inner:    cfg,
-			errAfter: i,
+		eac := newErrorOnlyCfg()
+		if i > 0 {
+			eac = NewCfgFaulty(NewCfgMem(), CfgFaultyOptions{ErrorAfter: i})
 		}
 		ok, err = CheckVersion(eac, "1.0.0")
 		if err == nil || ok {
@@ -59,21 +58,13 @@ func TestCheckVersion(t *testing.T) {
 		}
 	}
 
-	cfg = NewCfgMem()
-	eac := &ErrorAfterCfg{
-		inner:    cfg,
-		errAfter: 3,
-	}
+	eac := NewCfgFaulty(NewCfgMem(), CfgFaultyOptions{ErrorAfter: 3})
 	ok, err = CheckVersion(eac, "1.0.0")
 	if err != nil || !ok {
 		t.Errorf("expected ok when cfg doesn't error until 3rd op ")
 	}
 
-	cfg = NewCfgMem()
-	eac = &ErrorAfterCfg{
-		inner:    cfg,
-		errAfter: 4,
-	}
+	eac = NewCfgFaulty(NewCfgMem(), CfgFaultyOptions{ErrorAfter: 4})
 	ok, err = CheckVersion(eac, "1.0.0")
 	if err != nil || !ok {
 		t.Errorf("expected ok on first version init")
@@ -274,11 +265,11 @@ func TestCheckVersionForUpgrades(t *testing.T) {
 }
 
 func TestVerifyEffectiveClusterVersion(t *testing.T) {
-	cfg := NewCfgMem()
-	eac := &ErrorUntilCfg{
-		inner:    cfg,
-		errUntil: 2,
-	}
+	version, _ := CompatibilityVersion(LeanPlanVersion)
+
+	// The 1st operation fails.
+	eac := NewCfgFaulty(&versionTestCfg{NewCfgMem(), version},
+		CfgFaultyOptions{ErrorUntil: 1})
 
 	rv, err := VerifyEffectiveClusterVersion(eac, LeanPlanVersion)
 	if err != nil {